@@ -33,8 +33,20 @@ func dbg(x string, args...interface{}) {
 // - CMD: http://www.t13.org/documents/uploadeddocuments/docs2007/d1699r4a-ata8-acs.pdf
 //
 
+// the disk on the first port that works, which holds the root file system
 var Ahci fs.Disk_i
 
+// the disks attached to the HBA, indexed by port
+var ports [32]*ahci_disk_t
+
+// returns the disk attached to port n
+func Port(n int) (fs.Disk_i, bool) {
+	if n < 0 || n >= len(ports) || ports[n] == nil {
+		return nil, false
+	}
+	return ports[n], true
+}
+
 type blockmem_t struct {
 }
 
@@ -64,10 +76,24 @@ func (ahci *ahci_disk_t) Start(req *fs.Bdev_req_t) bool {
 	if ahci.port == nil {
 		panic("nil port")
 	}
+	if req.Cmd == fs.BDEV_WRITE_FUA && !ahci.port.fua {
+		// without FUA, the write is durable once the cache is flushed
+		w := fs.MkRequest(req.Blks, fs.BDEV_WRITE, true)
+		ahci.port.start(w)
+		<-w.AckCh
+		f := fs.MkRequest(nil, fs.BDEV_FLUSH, true)
+		ahci.port.start(f)
+		<-f.AckCh
+		return false
+	}
 	ahci.port.start(req)
 	return true
 }
 
+func (ahci *ahci_disk_t) Nblocks() int {
+	return int(ahci.nsectors / (fs.BSIZE / 512))
+}
+
 func (ahci *ahci_disk_t) Stats() string {
 	if ahci == nil {
 		panic("no adisk")
@@ -177,16 +203,24 @@ func attach_ahci(vid, did int, t pci.Pcitag_t) {
 	d.ncs = ((LD(&d.ahci.cap) >> 8) & 0x1f) + 1
 	dbg("AHCI: ncs %#x\n", d.ncs)
 
+	// each port gets its own disk, which shares the HBA registers
 	for i := 0; i < 32; i++ {
 		if LD(&d.ahci.pi)&(1<<uint32(i)) != 0x0 {
-			if d.probe_port(i) {
-				break
+			pd := &ahci_disk_t{}
+			*pd = *d
+			if pd.probe_port(i) {
+				ports[i] = pd
+				if Ahci == nil {
+					Ahci = pd
+				}
 			}
 		}
 	}
 
 	go d.int_handler(vec)
-	Ahci = d
+	if Ahci == nil {
+		Ahci = d
+	}
 }
 
 //
@@ -324,6 +358,7 @@ type ahci_cmd_table struct {
 type ahci_port_stat_t struct {
 	Nbarrier  stats.Counter_t
 	Nwrite    stats.Counter_t
+	Nfua      stats.Counter_t
 	Niwrite   stats.Counter_t
 	Nvwrite   stats.Counter_t
 	Nread     stats.Counter_t
@@ -345,6 +380,8 @@ type ahci_port_t struct {
 	queued    *list.List
 	nwaiting  int
 	nflush    int
+	// true if the disk supports WRITE DMA FUA EXT
+	fua       bool
 
 	block_pa [32]uintptr
 	block    [32]*[512]uint8
@@ -372,7 +409,7 @@ type identify_device_t struct {
 	sata_caps     uint16     // Word 76
 	_             [6]uint16  // Words 77-82
 	features83    uint16     // Words 83
-	_             uint16     // Word 84
+	features84    uint16     // Word 84
 	features85    uint16     // Word 85
 	features86    uint16     // Word 86
 	features87    uint16     // Word 87
@@ -422,6 +459,7 @@ const (
 
 	IDE_CMD_READ_DMA_EXT    uint8 = 0x25
 	IDE_CMD_WRITE_DMA_EXT   uint8 = 0x35
+	IDE_CMD_WRITE_DMA_FUA_EXT uint8 = 0x3d
 	IDE_CMD_FLUSH_CACHE_EXT       = 0xea
 	IDE_CMD_IDENTIFY        uint8 = 0xec
 	IDE_CMD_SETFEATURES     uint8 = 0xef
@@ -429,6 +467,7 @@ const (
 	IDE_DEV_LBA   = 0x40
 	IDE_CTL_LBA48 = 0x80
 
+	IDE_FEATURE84_FUA   uint16 = (1 << 6)
 	IDE_FEATURE86_LBA48 uint16 = (1 << 10)
 	IDE_STAT_BSY        uint32 = 0x80
 
@@ -849,10 +888,9 @@ func (p *ahci_port_t) start(req *fs.Bdev_req_t) {
 	p.Lock()
 
 	// Flush waits until outstanding commands have finished and then flushes
-	// the non-volatile cache of the storage device.  XXX It might be better
-	// to have a just a barrier operation (i.e., not flushing non-volatile
-	// cache), and tag writes with FUA for writes that need to persist
-	// immediately (instead of flusing the complete on-disk cache).
+	// the non-volatile cache of the storage device.  Writes that need to
+	// persist immediately, but don't need the writes before them to
+	// persist, are tagged with FUA instead (BDEV_WRITE_FUA).
 	for req.Cmd == fs.BDEV_FLUSH {
 		ci := LD(&p.port.ci)
 		sact := LD(&p.port.sact)
@@ -866,7 +904,7 @@ func (p *ahci_port_t) start(req *fs.Bdev_req_t) {
 		}
 	}
 
-	if req.Cmd == fs.BDEV_WRITE {
+	if req.Cmd == fs.BDEV_WRITE || req.Cmd == fs.BDEV_WRITE_FUA {
 		p.stat.Nwrite++
 	}
 
@@ -896,6 +934,9 @@ func (p *ahci_port_t) startslot(req *fs.Bdev_req_t, s int) {
 			p.stat.Niwrite++
 		}
 		p.issue(s, req.Blks, IDE_CMD_WRITE_DMA_EXT)
+	case fs.BDEV_WRITE_FUA:
+		p.stat.Nfua++
+		p.issue(s, req.Blks, IDE_CMD_WRITE_DMA_FUA_EXT)
 	case fs.BDEV_READ:
 		p.stat.Nread++
 		p.issue(s, req.Blks, IDE_CMD_READ_DMA_EXT)
@@ -949,7 +990,7 @@ func (p *ahci_port_t) issue(s int, blks *fs.BlkList_t, cmd uint8) {
 	fis.sector_count_ex = uint8((nsector >> 8) & 0xff)
 
 	p.fill_fis(s, fis) // sets flags to length fis
-	if cmd == IDE_CMD_WRITE_DMA_EXT {
+	if cmd == IDE_CMD_WRITE_DMA_EXT || cmd == IDE_CMD_WRITE_DMA_FUA_EXT {
 		SET16(&p.cmdh[s].flags, AHCI_CMD_FLAGS_WRITE)
 	}
 	dbg("cmdh: prdtl %#x flags %#x bc %v\n", LD16(&p.cmdh[s].prdtl),
@@ -1017,10 +1058,12 @@ func (ahci *ahci_disk_t) probe_port(pid int) bool {
 			dbg("AHCI: write cache %v read ahead %v\n",
 				LD16(&id.features85)&(1<<5) != 0,
 				LD16(&id.features85)&(1<<4) != 0)
+			p.fua = LD16(&id.features84)&IDE_FEATURE84_FUA != 0
+			dbg("AHCI: FUA %v\n", p.fua)
 			ahci.clear_is()
 			ahci.enable_interrupt()
 			go p.queuemgr()
-			return true// only one port
+			return true
 		}
 	}
 	return false
@@ -1037,7 +1080,7 @@ func (p *ahci_port_t) port_intr(ahci *ahci_disk_t) {
 		if p.inflight[s] != nil && ci&(1<<s) == 0 {
 			int = true
 			dbg("port_intr: slot %v interrupt\n", s)
-			if p.inflight[s].Cmd == fs.BDEV_WRITE {
+			if c := p.inflight[s].Cmd; c == fs.BDEV_WRITE || c == fs.BDEV_WRITE_FUA {
 				// page has been written, don't need a reference to it
 				// and can be removed from cache.
 				p.inflight[s].Blks.Apply(func(b *fs.Bdev_block_t) {
@@ -1072,15 +1115,16 @@ func (ahci *ahci_disk_t) intr() {
 	is := LD(&ahci.ahci.is)
 	for i := uint32(0); i < 32; i++ {
 		if is&(1<<i) != 0 {
-			if i != uint32(ahci.portid) {
+			pd := ports[i]
+			if pd == nil {
 				panic("intr: wrong port\n")
 			}
 			int = true
 
 			// clear port interrupt. interrupts coming in while we are
 			// processing will be deliver after clear_is().
-			SET(&ahci.port.port.is, 0x1<<i)
-			ahci.port.port_intr(ahci)
+			SET(&pd.port.port.is, 0x1<<i)
+			pd.port.port_intr(pd)
 		}
 	}
 	if !int {
@@ -11,6 +11,7 @@ import "unsafe"
 
 import "bounds"
 import "circbuf"
+import "cred"
 import "defs"
 import "fdops"
 import "limits"
@@ -1070,6 +1071,7 @@ func (tcl *tcplisten_t) tcbready(tinc tcpinc_t, rack uint32, rwin uint16,
 	tcb.set_seqs(tinc.snd.nxt, tinc.rcv.nxt)
 	tcb.snd.win = tinc.snd.win
 	tcb.snd.mss = tinc.opt.Mss
+	tcb.cc_init()
 
 	tcb.snd.wl1 = tinc.rcv.nxt
 	tcb.snd.wl2 = tinc.snd.nxt
@@ -1306,7 +1308,7 @@ type tcptimers_t struct {
 	curto  time.Time
 	// ackw granularity: 10ms, width: 1s
 	ackw timerwheel_t
-	// txw granularity: 100ms, width: 10s
+	// txw granularity: 100ms, width: 1m
 	txw timerwheel_t
 	// twaitw granularity: 1s, width: 2m
 	twaitw timerwheel_t
@@ -1316,7 +1318,7 @@ var bigtw = &tcptimers_t{}
 
 func (tt *tcptimers_t) _tcptimers_start() {
 	tt.ackw.twinit(10*time.Millisecond, time.Second)
-	tt.txw.twinit(100*time.Millisecond, 10*time.Second)
+	tt.txw.twinit(100*time.Millisecond, time.Minute)
 	tt.twaitw.twinit(time.Second, 2*time.Minute)
 	tt.kicker = make(chan bool, 1)
 	go tt._tcptimers_daemon()
@@ -1422,9 +1424,9 @@ func (tt *tcptimers_t) tosched_ack(tcb *Tcptcb_t) {
 }
 
 // tcb must be locked.
-func (tt *tcptimers_t) tosched_tx(tcb *Tcptcb_t) {
+func (tt *tcptimers_t) tosched_tx(tcb *Tcptcb_t, wait time.Duration) {
 	tcb._sanity()
-	dline := time.Now().Add(5 * time.Second)
+	dline := time.Now().Add(wait)
 	tt._tosched(&tcb.txl, &tt.txw, dline)
 }
 
@@ -1547,6 +1549,9 @@ type Tcptcb_t struct {
 		tstart bool
 		target millis_t
 	}
+	// congestion control; nil until the connection is established
+	cc  tcpcc_i
+	rtt tcprtt_t
 	// data to send over the TCP connection
 	txbuf tcpbuf_t
 	// data received over the TCP connection
@@ -1920,22 +1925,12 @@ func (tc *Tcptcb_t) seg_maybe() {
 	// prune unacknowledged segments which are now outside of the send
 	// window
 	tc.snd.tsegs.prune(winend)
-	// have retransmit timeouts expired?
+	// has the retransmit timeout expired? without sacks, retransmit
+	// everything from snd.una as the congestion window allows.
 	segged := false
 	now := Fastmillis()
-	for i := 0; i < len(tc.snd.tsegs.segs); i++ {
-		if now < tc.snd.tsegs.segs[i].when + Secondms {
-			continue
-		}
-		seq := tc.snd.tsegs.segs[i].seq
-		// XXXPANIC
-		if seq == winend {
-			panic("how?")
-		}
-		did := tc.seg_one(seq)
-		// reset() modifies segs[]
-		tc.snd.tsegs.reset(seq, uint32(did))
-		segged = true
+	if nts, ok := tc.snd.tsegs.nextts(); ok && now >= nts+tc.rtt.rto {
+		tc.cc_timeout()
 	}
 	// XXXPANIC
 	{
@@ -1948,28 +1943,32 @@ func (tc *Tcptcb_t) seg_maybe() {
 		}
 	}
 	// XXX nagle's?
-	// transmit any unsent data in the send window
-	upto := winend
+	// transmit any unsent data in the send window, limited by the
+	// congestion window
+	upto := tc._swinend()
 	if _seqbetween(tc.snd.una, tc.txbuf.end_seq(), upto) {
 		upto = tc.txbuf.end_seq()
 	}
 	isdata := !tc.txdone || tc.snd.nxt != tc.snd.finseq+1
 	sbegin := tc.snd.nxt
-	if isdata && _seqdiff(upto, sbegin) > 0 {
-		did := tc.seg_one(sbegin)
+	// the congestion window may have shrunk below snd.nxt
+	if isdata && sbegin != upto && _seqbetween(tc.snd.una, sbegin, upto) {
+		did := tc.seg_one(sbegin, _seqdiff(upto, sbegin))
 		tc.snd.tsegs.addnow(sbegin, uint32(did), winend)
+		tc.rtt.start_maybe(sbegin, sbegin+uint32(did), now)
 		segged = true
 	}
 	// send lone FIN only if FIN wasn't already set on a just-transmitted
 	// segment
 	if !segged && tc.txdone && tc.snd.nxt == tc.snd.finseq {
-		tc.seg_one(tc.snd.finseq)
+		tc.seg_one(tc.snd.finseq, 1)
 		tc.snd.tsegs.addnow(tc.snd.finseq, 1, winend)
 	}
 	tc._txtimeout_start(now)
 }
 
-func (tc *Tcptcb_t) seg_one(seq uint32) int {
+// sends at most max bytes starting at seq
+func (tc *Tcptcb_t) seg_one(seq uint32, max int) int {
 	winend := tc.snd.una + uint32(tc.snd.win)
 	// XXXPANIC
 	if !_seqbetween(tc.snd.una, seq, winend) {
@@ -1995,7 +1994,11 @@ func (tc *Tcptcb_t) seg_one(seq uint32) int {
 		opt = opts
 	} else {
 		// the data to send may be larger than MSS
-		buf1, buf2 := tc.txbuf.sysread(seq, _seqdiff(winend, seq))
+		l := _seqdiff(winend, seq)
+		if l > max {
+			l = max
+		}
+		buf1, buf2 := tc.txbuf.sysread(seq, l)
 		dlen = len(buf1) + len(buf2)
 		if dlen == 0 {
 			panic("must send non-zero amount")
@@ -2046,13 +2049,8 @@ func (tc *Tcptcb_t) _txtimeout_start(now millis_t) {
 	}
 	tc.remseg.tstart = true
 	tc.remseg.target = nts
-	// XXX rto calculation
-	deadline := nts + Secondms * 5
-	if now > deadline {
-		fmt.Printf("** timeouts are shat upon!\n")
-		return
-	}
-	bigtw.tosched_tx(tc)
+	deadline := nts + tc.rtt.rto
+	bigtw.tosched_tx(tc, _rtowait(deadline, now))
 }
 
 var _deftcpopts = []uint8{
@@ -2219,6 +2217,7 @@ func (tc *Tcptcb_t) synsent(tcp *Tcphdr_t, mss uint16, ropt Tcpopt_t,
 	theirseq := Ntohl(tcp.Seq)
 	tc.set_seqs(tc.snd.nxt, theirseq+1)
 	tc.snd.mss = mss
+	tc.cc_init()
 	tc.snd.una = ack
 	var dlen int
 	for _, r := range rest {
@@ -2284,10 +2283,17 @@ func (tc *Tcptcb_t) data_in(rseq, rack uint32, rwin uint16, rest [][]uint8,
 	if rtstamp >= tc.tstamp.recent && rseq <= tc.tstamp.acksent {
 		tc.tstamp.recent = rtstamp
 	}
+	dupack := rack == tc.snd.una && dlen == 0 && rwin == tc.snd.win &&
+		tc.snd.una != tc.snd.nxt
 	// +1 in case our FIN's sequence number is just outside the send window
 	swinend := tc.snd.una + uint32(tc.snd.win) + 1
-	if _seqbetween(tc.snd.una, rack, swinend) {
+	if rack != tc.snd.una && _seqbetween(tc.snd.una, rack, swinend) {
 		tc.snd.tsegs.ackupto(rack)
+		acked := uint32(_seqdiff(rack, tc.snd.una))
+		// a retransmit timeout may have moved snd.nxt backwards
+		if !_seqbetween(tc.snd.una, rack, tc.snd.nxt) {
+			tc.snd.nxt = rack
+		}
 		tc.snd.una = rack
 		// distinguish between acks for data and the ack for our FIN
 		pack := rack
@@ -2295,6 +2301,9 @@ func (tc *Tcptcb_t) data_in(rseq, rack uint32, rwin uint16, rest [][]uint8,
 			pack = tc.snd.finseq
 		}
 		tc.txbuf.ackup(pack)
+		tc.cc_acked(rack, acked)
+	} else if dupack {
+		tc.cc_dupack()
 	}
 	// figure out which bytes are in our window: is the beginning of
 	// segment outside our window?
@@ -2536,6 +2545,7 @@ func (tc *Tcptcb_t) tcb_init(lip, rip Ip4_t, lport, rport uint16, smac,
 	tc.rcv.win = uint16(tc.rxbuf.cbuf.Left())
 	// assume 12 bytes of TCP options (nop, nop, timestamp)
 	tc.rcv.mss = 1448
+	tc.rtt.init()
 	tc.snd.nxt = sndnxt
 	tc.snd.una = sndnxt
 	tc.ackl.linit(tc)
@@ -2783,9 +2793,43 @@ func (tc *tcpcons_t) listen_del(tcl *tcplisten_t) {
 	delete(tc.listns, lk)
 }
 
+// returns the TCP connection table, one connection per line: the local and
+// remote address and the state. since tcpcons' mutex is a leaf lock, the
+// states are read without the connections' locks and may be stale.
+func (tc *tcpcons_t) dump() string {
+	tc.l.Lock()
+	defer tc.l.Unlock()
+
+	var lines []string
+	for _, tcl := range tc.listns {
+		lines = append(lines, fmt.Sprintf("%s:%d 0.0.0.0:0 LISTEN\n",
+			Ip2str(tcl.lip), tcl.lport))
+	}
+	for _, tcb := range tc.econns {
+		sn, ok := statestr[tcb.state]
+		if !ok {
+			sn = "CLOSED"
+		}
+		lines = append(lines, fmt.Sprintf("%s:%d %s:%d %s\n",
+			Ip2str(tcb.lip), tcb.lport, Ip2str(tcb.rip), tcb.rport,
+			sn))
+	}
+	sort.Strings(lines)
+	s := "local remote state\n"
+	for _, l := range lines {
+		s += l
+	}
+	return s
+}
+
 // tcpcons' mutex is a leaf lock
 var tcpcons tcpcons_t
 
+// returns the TCP connection table for /proc/net/tcp
+func Tcpconns() string {
+	return tcpcons.dump()
+}
+
 func send_rst(seq uint32, k tcpkey_t) {
 	_send_rst(seq, 0, k, false)
 }
@@ -3005,6 +3049,9 @@ func (tf *Tcpfops_t) Write(src fdops.Userio_i) (int, defs.Err_t) {
 		}
 	}
 	tf.tcb.tcb_unlock()
+	if err == -defs.EPIPE {
+		proc.Sigpipe()
+	}
 	return wrote, err
 }
 
@@ -3012,6 +3059,26 @@ func (tf *Tcpfops_t) Truncate(newlen uint) defs.Err_t {
 	return -defs.EINVAL
 }
 
+func (tf *Tcpfops_t) Utimens(*cred.Cred_t, int, int) defs.Err_t {
+	return -defs.EINVAL
+}
+
+func (tf *Tcpfops_t) Fchmod(*cred.Cred_t, uint) defs.Err_t {
+	return -defs.EINVAL
+}
+
+func (tf *Tcpfops_t) Fchown(*cred.Cred_t, int, int) defs.Err_t {
+	return -defs.EINVAL
+}
+
+func (tf *Tcpfops_t) Getdents(fdops.Userio_i) (int, defs.Err_t) {
+	return 0, -defs.ENOTDIR
+}
+
+func (tf *Tcpfops_t) Fsync(bool) defs.Err_t {
+	return -defs.EINVAL
+}
+
 func (tf *Tcpfops_t) Pread(dst fdops.Userio_i, offset int) (int, defs.Err_t) {
 	return 0, -defs.ESPIPE
 }
@@ -3205,11 +3272,30 @@ func (tf *Tcpfops_t) Fcntl(cmd, opt int) int {
 	}
 }
 
-func (tf *Tcpfops_t) Getsockopt(opt int, bufarg fdops.Userio_i,
+// FIONREAD counts the received bytes not yet read
+func (tf *Tcpfops_t) Ioctl(req int, arg fdops.Userio_i) defs.Err_t {
+	switch req {
+	case defs.FIONREAD:
+		tf.tcb.tcb_lock()
+		n := tf.tcb.rxbuf.cbuf.Used()
+		tf.tcb.tcb_unlock()
+		return fdops.Intout(arg, n)
+	case defs.FIONBIO:
+		return fdops.Fionbio(tf, arg)
+	default:
+		return -defs.ENOTTY
+	}
+}
+
+func (tf *Tcpfops_t) Getsockopt(lev, opt int, bufarg fdops.Userio_i,
 	intarg int) (int, defs.Err_t) {
 	tf.tcb.tcb_lock()
 	defer tf.tcb.tcb_unlock()
 
+	// TCP_INFO is the only option of the TCP level
+	if (lev == defs.IPPROTO_TCP) != (opt == defs.TCP_INFO) {
+		return 0, -defs.ENOPROTOOPT
+	}
 	switch opt {
 	case defs.SO_NAME, defs.SO_PEER:
 		if !tf.tcb.bound {
@@ -3228,6 +3314,8 @@ func (tf *Tcpfops_t) Getsockopt(opt int, bufarg fdops.Userio_i,
 		util.Writen(b, 4, 4, ip)
 		did, err := bufarg.Uiowrite(b)
 		return did, err
+	case defs.TCP_INFO:
+		return tf.tcb.tcpinfo(bufarg)
 	default:
 		return 0, -defs.EOPNOTSUPP
 	}
@@ -3346,8 +3434,10 @@ func (tl *tcplfops_t) Close() defs.Err_t {
 	return 0
 }
 
-func (tl *tcplfops_t) Fstat(*stat.Stat_t) defs.Err_t {
-	panic("no imp")
+func (tl *tcplfops_t) Fstat(st *stat.Stat_t) defs.Err_t {
+	sockmode := defs.Mkdev(2, 0)
+	st.Wmode(sockmode)
+	return 0
 }
 
 func (tl *tcplfops_t) Lseek(int, int) (int, defs.Err_t) {
@@ -3381,6 +3471,26 @@ func (tl *tcplfops_t) Truncate(newlen uint) defs.Err_t {
 	return -defs.EINVAL
 }
 
+func (tl *tcplfops_t) Utimens(*cred.Cred_t, int, int) defs.Err_t {
+	return -defs.EINVAL
+}
+
+func (tl *tcplfops_t) Fchmod(*cred.Cred_t, uint) defs.Err_t {
+	return -defs.EINVAL
+}
+
+func (tl *tcplfops_t) Fchown(*cred.Cred_t, int, int) defs.Err_t {
+	return -defs.EINVAL
+}
+
+func (tl *tcplfops_t) Getdents(fdops.Userio_i) (int, defs.Err_t) {
+	return 0, -defs.ENOTDIR
+}
+
+func (tl *tcplfops_t) Fsync(bool) defs.Err_t {
+	return -defs.EINVAL
+}
+
 func (tl *tcplfops_t) Pread(dst fdops.Userio_i, offset int) (int, defs.Err_t) {
 	return 0, -defs.ESPIPE
 }
@@ -3511,8 +3621,22 @@ func (tl *tcplfops_t) Fcntl(cmd, opt int) int {
 	}
 }
 
-func (tl *tcplfops_t) Getsockopt(opt int, bufarg fdops.Userio_i,
+func (tl *tcplfops_t) Ioctl(req int, arg fdops.Userio_i) defs.Err_t {
+	switch req {
+	case defs.FIONREAD:
+		return -defs.EINVAL
+	case defs.FIONBIO:
+		return fdops.Fionbio(tl, arg)
+	default:
+		return -defs.ENOTTY
+	}
+}
+
+func (tl *tcplfops_t) Getsockopt(lev, opt int, bufarg fdops.Userio_i,
 	intarg int) (int, defs.Err_t) {
+	if lev != defs.SOL_SOCKET {
+		return 0, -defs.ENOPROTOOPT
+	}
 	switch opt {
 	case defs.SO_ERROR:
 		dur := [4]uint8{}
@@ -3567,6 +3691,9 @@ type nic_i interface {
 	Tx_ipv4(buf [][]uint8) bool
 	Tx_tcp(buf [][]uint8) bool
 	Tx_tcp_tso(buf [][]uint8, tcphlen, mss int) bool
+	// like Tx_tcp, the UDP header's cksum field must hold the pseudo
+	// header partial cksum; the NIC computes the rest.
+	Tx_udp(buf [][]uint8) bool
 	Lmac() *Mac_t
 }
 
@@ -3651,11 +3778,14 @@ func Net_start(pkt [][]uint8, tlen int) {
 		proto := ippkt.Proto
 		icmp := uint8(0x01)
 		tcp := uint8(0x06)
+		udp := uint8(0x11)
 		switch proto {
 		case icmp:
 			net_icmp(pkt, tlen)
 		case tcp:
 			net_tcp(pkt, tlen)
+		case udp:
+			net_udp(pkt, tlen)
 		}
 	}
 }
@@ -3673,6 +3803,9 @@ func netchk() {
 	if TCPLEN != 20 {
 		panic("bad tcp header size")
 	}
+	if UDPLEN != 8 {
+		panic("bad udp header size")
+	}
 }
 
 func Net_init(pm mem.Page_i) {
@@ -3696,6 +3829,7 @@ func Net_init(pm mem.Page_i) {
 	go icmp_daemon()
 
 	tcpcons.init()
+	udpcons.init()
 
 	_rstchan = make(chan rstmsg_t, 32)
 	nrst := 4
@@ -4000,6 +4134,10 @@ func (l *lo_t) Tx_tcp_tso(buf [][]uint8, tcphlen, mss int) bool {
 	return l._copysend(buf, tcphlen, mss)
 }
 
+func (l *lo_t) Tx_udp(buf [][]uint8) bool {
+	return l._copysend(buf, 0, 0)
+}
+
 func (l *lo_t) Lmac() *Mac_t {
 	return &l.mac
 }
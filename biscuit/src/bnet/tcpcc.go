@@ -0,0 +1,360 @@
+package bnet
+
+import "time"
+
+import "defs"
+import "fdops"
+import "util"
+
+// a TCP congestion control algorithm. the congestion window limits the
+// number of unacknowledged bytes in addition to the peer's receive window. all
+// methods are called with the tcb locked.
+type tcpcc_i interface {
+	// resets the state for a new connection whose sender MSS is smss and
+	// whose initial send sequence number is iss
+	init(smss, iss uint32)
+	// una advanced to ack, acknowledging acked bytes of new data. nxt is
+	// the next sequence to send. returns true if the segment at the new
+	// snd.una should be retransmitted immediately.
+	acked(ack, acked, nxt uint32) bool
+	// a duplicate ACK was received while flight bytes are outstanding.
+	// returns true if the segment at snd.una should be retransmitted
+	// immediately.
+	dupack(una, nxt, flight uint32) bool
+	// the retransmit timer expired with flight bytes outstanding
+	timeout(nxt, flight uint32)
+	cwnd() uint32
+	ssthresh() uint32
+}
+
+// NewReno (RFC 5681 and RFC 6582)
+type newreno_t struct {
+	smss    uint32
+	_cwnd   uint32
+	_ssth   uint32
+	dupacks int
+	// true during fast recovery, which ends once recover is acknowledged
+	inrec   bool
+	recover uint32
+}
+
+func (nr *newreno_t) init(smss, iss uint32) {
+	nr.smss = smss
+	// RFC 3390 initial window
+	iw := 4 * smss
+	if iw > 4380 {
+		iw = 4380
+		if iw < 2*smss {
+			iw = 2 * smss
+		}
+	}
+	nr._cwnd = iw
+	nr._ssth = ^uint32(0)
+	nr.dupacks = 0
+	nr.inrec = false
+	// RFC 6582 section 3.2
+	nr.recover = iss
+}
+
+// returns half the flight size, but no less than two segments
+func (nr *newreno_t) _halve(flight uint32) uint32 {
+	ret := flight / 2
+	if ret < 2*nr.smss {
+		ret = 2 * nr.smss
+	}
+	return ret
+}
+
+func (nr *newreno_t) acked(ack, acked, nxt uint32) bool {
+	nr.dupacks = 0
+	if nr.inrec {
+		if _seqbetween(ack, nr.recover, nxt) && ack != nr.recover {
+			// partial ACK: deflate by the amount acknowledged, add
+			// back one segment, and retransmit the next hole.
+			if acked < nr._cwnd {
+				nr._cwnd -= acked
+			} else {
+				nr._cwnd = 0
+			}
+			if acked >= nr.smss {
+				nr._cwnd += nr.smss
+			}
+			if nr._cwnd < nr.smss {
+				nr._cwnd = nr.smss
+			}
+			return true
+		}
+		// full ACK
+		nr.inrec = false
+		nr._cwnd = nr._ssth
+		return false
+	}
+	if nr._cwnd < nr._ssth {
+		// slow start
+		inc := acked
+		if inc > nr.smss {
+			inc = nr.smss
+		}
+		nr._cwnd += inc
+	} else {
+		// congestion avoidance
+		inc := nr.smss * nr.smss / nr._cwnd
+		if inc == 0 {
+			inc = 1
+		}
+		nr._cwnd += inc
+	}
+	return false
+}
+
+func (nr *newreno_t) dupack(una, nxt, flight uint32) bool {
+	if nr.inrec {
+		// inflate the window for the segment that left the network
+		nr._cwnd += nr.smss
+		return false
+	}
+	nr.dupacks++
+	if nr.dupacks != 3 {
+		return false
+	}
+	// avoid multiple window reductions for losses in the same window of
+	// data
+	if nr.recover != una && _seqbetween(una, nr.recover, nxt) {
+		return false
+	}
+	nr._ssth = nr._halve(flight)
+	nr._cwnd = nr._ssth + 3*nr.smss
+	nr.recover = nxt
+	nr.inrec = true
+	return true
+}
+
+func (nr *newreno_t) timeout(nxt, flight uint32) {
+	nr._ssth = nr._halve(flight)
+	nr._cwnd = nr.smss
+	nr.dupacks = 0
+	nr.inrec = false
+	nr.recover = nxt
+}
+
+func (nr *newreno_t) cwnd() uint32 {
+	return nr._cwnd
+}
+
+func (nr *newreno_t) ssthresh() uint32 {
+	return nr._ssth
+}
+
+// round-trip time estimation and the retransmission timeout (RFC 6298)
+type tcprtt_t struct {
+	srtt   millis_t
+	rttvar millis_t
+	rto    millis_t
+	// false until the first measurement
+	valid bool
+	// the time a segment ending at seq was sent, if timing is true. only
+	// one segment is timed at a time.
+	timing bool
+	seq    uint32
+	start  millis_t
+	// by Karn's algorithm, segments which may be retransmissions (those
+	// before rxmax) are not timed.
+	rexmit bool
+	rxmax  uint32
+}
+
+const (
+	rtomin millis_t = Secondms
+	rtomax millis_t = 60 * Secondms
+)
+
+func (rt *tcprtt_t) init() {
+	*rt = tcprtt_t{}
+	rt.rto = Secondms
+}
+
+// starts timing the segment [seq, end) unless a segment is already timed or
+// the segment is a retransmission.
+func (rt *tcprtt_t) start_maybe(seq, end uint32, now millis_t) {
+	if rt.timing {
+		return
+	}
+	if rt.rexmit && _seqdiff(rt.rxmax, seq) > 0 &&
+		_seqdiff(rt.rxmax, seq) < 1<<31 {
+		return
+	}
+	rt.timing = true
+	rt.seq = end
+	rt.start = now
+}
+
+// una advanced to ack; takes a measurement if the timed segment was
+// acknowledged.
+func (rt *tcprtt_t) acked(ack, nxt uint32, now millis_t) {
+	if rt.rexmit && _seqbetween(rt.rxmax, ack, nxt) {
+		rt.rexmit = false
+	}
+	if !rt.timing || !_seqbetween(rt.seq, ack, nxt) {
+		return
+	}
+	rt.timing = false
+	r := now - rt.start
+	if !rt.valid {
+		rt.valid = true
+		rt.srtt = r
+		rt.rttvar = r / 2
+	} else {
+		diff := rt.srtt - r
+		if r > rt.srtt {
+			diff = r - rt.srtt
+		}
+		rt.rttvar = (3*rt.rttvar + diff) / 4
+		rt.srtt = (7*rt.srtt + r) / 8
+	}
+	// our clock granularity is 1ms
+	k := 4 * rt.rttvar
+	if k == 0 {
+		k = 1
+	}
+	rt.rto = rt.srtt + k
+	if rt.rto < rtomin {
+		rt.rto = rtomin
+	}
+	if rt.rto > rtomax {
+		rt.rto = rtomax
+	}
+}
+
+// data up to nxt is being retransmitted; stop timing and back off the timer.
+func (rt *tcprtt_t) retransmit(nxt uint32, backoff bool) {
+	rt.timing = false
+	rt.rexmit = true
+	rt.rxmax = nxt
+	if backoff {
+		rt.rto *= 2
+		if rt.rto > rtomax {
+			rt.rto = rtomax
+		}
+	}
+}
+
+// initializes congestion control once the sender MSS is known
+func (tc *Tcptcb_t) cc_init() {
+	tc.cc = &newreno_t{}
+	// only the SYN, whose sequence number is the ISS, has been sent
+	tc.cc.init(tc._smss(), tc.snd.nxt-1)
+}
+
+// the sender MSS, excluding our TCP options
+func (tc *Tcptcb_t) _smss() uint32 {
+	smss := int(tc.snd.mss) - len(tc.opt)
+	if smss < 536 {
+		smss = 536
+	}
+	return uint32(smss)
+}
+
+// returns the end of the usable send window: the peer's receive window limited
+// by the congestion window.
+func (tc *Tcptcb_t) _swinend() uint32 {
+	win := uint32(tc.snd.win)
+	if tc.cc != nil {
+		if cw := tc.cc.cwnd(); cw < win {
+			win = cw
+		}
+	}
+	return tc.snd.una + win
+}
+
+func (tc *Tcptcb_t) _flight() uint32 {
+	return uint32(_seqdiff(tc.snd.nxt, tc.snd.una))
+}
+
+// una advanced to ack, acknowledging acked bytes
+func (tc *Tcptcb_t) cc_acked(ack, acked uint32) {
+	tc.rtt.acked(ack, tc.snd.nxt, Fastmillis())
+	if tc.cc == nil {
+		return
+	}
+	if tc.cc.acked(ack, acked, tc.snd.nxt) {
+		tc._rexmit_una()
+	}
+}
+
+func (tc *Tcptcb_t) cc_dupack() {
+	if tc.cc == nil {
+		return
+	}
+	if tc.cc.dupack(tc.snd.una, tc.snd.nxt, tc._flight()) {
+		tc._rexmit_una()
+	}
+}
+
+// the retransmit timer expired: shrink the congestion window and go back to
+// sending from snd.una.
+func (tc *Tcptcb_t) cc_timeout() {
+	if tc.cc != nil {
+		tc.cc.timeout(tc.snd.nxt, tc._flight())
+	}
+	tc.rtt.retransmit(tc.snd.nxt, true)
+	tc.snd.nxt = tc.snd.una
+	tc.snd.tsegs.segs = tc.snd.tsegs.segs[:0]
+}
+
+// fast retransmit: resend one segment starting at snd.una
+func (tc *Tcptcb_t) _rexmit_una() {
+	if tc.dead || tc.twdeath || tc.snd.una == tc.snd.nxt {
+		return
+	}
+	tc.rtt.retransmit(tc.snd.nxt, false)
+	tc.seg_one(tc.snd.una, int(tc._smss()))
+	// restart the retransmit timer for the segment
+	if ss := tc.snd.tsegs.segs; len(ss) != 0 && ss[0].seq == tc.snd.una {
+		ss[0].when = Fastmillis()
+	}
+}
+
+// the layout of struct tcp_info, as defined by litc. all fields are 32 bits;
+// windows are in bytes and times in milliseconds.
+const (
+	ti_state    = 0
+	ti_mss      = 4
+	ti_cwnd     = 8
+	ti_ssthresh = 12
+	ti_rtt      = 16
+	ti_rttvar   = 20
+	ti_rto      = 24
+	ti_sz       = 28
+)
+
+// writes the connection's TCP_INFO to dst. the tcb must be locked.
+func (tc *Tcptcb_t) tcpinfo(dst fdops.Userio_i) (int, defs.Err_t) {
+	b := make([]uint8, ti_sz)
+	util.Writen(b, 4, ti_state, int(tc.state))
+	var cw, ssth uint32
+	if tc.cc != nil {
+		util.Writen(b, 4, ti_mss, int(tc._smss()))
+		cw, ssth = tc.cc.cwnd(), tc.cc.ssthresh()
+	}
+	util.Writen(b, 4, ti_cwnd, int(cw))
+	util.Writen(b, 4, ti_ssthresh, int(ssth))
+	util.Writen(b, 4, ti_rtt, int(tc.rtt.srtt))
+	util.Writen(b, 4, ti_rttvar, int(tc.rtt.rttvar))
+	util.Writen(b, 4, ti_rto, int(tc.rtt.rto))
+	return dst.Uiowrite(b)
+}
+
+// converts the retransmit deadline to a wait for the timer wheel
+func _rtowait(deadline, now millis_t) time.Duration {
+	// the tx timer wheel's granularity is 100ms; never schedule in the
+	// current bucket.
+	const minwait = 200 * time.Millisecond
+	if deadline <= now {
+		return minwait
+	}
+	ret := time.Duration(deadline-now) * time.Millisecond
+	if ret < minwait {
+		ret = minwait
+	}
+	return ret
+}
@@ -0,0 +1,714 @@
+package bnet
+
+import "fmt"
+import "math/rand"
+import "sync"
+
+import "cred"
+import "defs"
+import "fdops"
+import "limits"
+import "mem"
+import "proc"
+import "stat"
+import "util"
+import "vm"
+
+import . "inet"
+
+// we do not fragment, thus a datagram must fit in one ethernet frame
+const udpmaxpay = 1500 - IP4LEN - UDPLEN
+
+// default limit on the total payload bytes queued on a socket
+const udprcvsz = 1 << 16
+
+type udpdgram_t struct {
+	sip   Ip4_t
+	sport uint16
+	data  []uint8
+}
+
+type udpsock_t struct {
+	sync.Mutex
+	cond    *sync.Cond
+	pollers fdops.Pollers_t
+	lip     Ip4_t
+	lport   uint16
+	bound   bool
+	// default destination, set by connect(2). datagrams from other
+	// sources are dropped once connected.
+	rip   Ip4_t
+	rport uint16
+	conn  bool
+	// received datagrams in arrival order. each queued datagram is charged
+	// to the socket limit and the total payload is bounded by rcvsz.
+	rxq     []udpdgram_t
+	rxbytes int
+	rcvsz   int
+	rdone   bool
+	wdone   bool
+	openc   int
+}
+
+func (us *udpsock_t) us_init() {
+	us.cond = sync.NewCond(us)
+	us.rcvsz = udprcvsz
+	us.openc = 1
+}
+
+// the caller must hold the socket's lock
+func (us *udpsock_t) _rready() {
+	us.cond.Broadcast()
+	us.pollers.Wakeready(fdops.R_READ)
+}
+
+// queues the payload of a received datagram; pkt references DMA memory and
+// thus the payload is copied. the caller must hold the socket's lock.
+func (us *udpsock_t) _deliver(sip Ip4_t, sport uint16, pkt [][]uint8, dlen int) {
+	if us.rdone || us.openc == 0 {
+		return
+	}
+	if us.conn && (sip != us.rip || sport != us.rport) {
+		return
+	}
+	if us.rxbytes+dlen > us.rcvsz {
+		return
+	}
+	if !limits.Syslimit.Socks.Take() {
+		return
+	}
+	data := make([]uint8, dlen)
+	tmp := data
+	for i := 0; i < len(pkt) && len(tmp) != 0; i++ {
+		did := copy(tmp, pkt[i])
+		tmp = tmp[did:]
+	}
+	us.rxq = append(us.rxq, udpdgram_t{sip: sip, sport: sport, data: data})
+	us.rxbytes += dlen
+	us._rready()
+}
+
+// removes the oldest queued datagram. the caller must hold the socket's lock.
+func (us *udpsock_t) _dequeue() udpdgram_t {
+	dg := us.rxq[0]
+	us.rxq[0] = udpdgram_t{}
+	us.rxq = us.rxq[1:]
+	us.rxbytes -= len(dg.data)
+	limits.Syslimit.Socks.Give()
+	return dg
+}
+
+// drops all queued datagrams. the caller must hold the socket's lock.
+func (us *udpsock_t) _purge() {
+	for len(us.rxq) != 0 {
+		us._dequeue()
+	}
+	us.rxq = nil
+}
+
+type udpcons_t struct {
+	l sync.Mutex
+	// bound sockets by local IP/port. like TCP, a port may be bound on a
+	// particular local IP or all local IPs.
+	socks map[tcplkey_t]*udpsock_t
+}
+
+func (uc *udpcons_t) init() {
+	uc.socks = make(map[tcplkey_t]*udpsock_t)
+}
+
+// try to bind us to the IP/port pair. returns true on success.
+func (uc *udpcons_t) reserve(us *udpsock_t, lip Ip4_t, lport uint16) bool {
+	uc.l.Lock()
+	defer uc.l.Unlock()
+
+	k := tcplkey_t{lip: lip, lport: lport}
+	anyk := k
+	anyk.lip = defs.INADDR_ANY
+	if uc.socks[k] != nil || uc.socks[anyk] != nil {
+		return false
+	}
+	uc.socks[k] = us
+	return true
+}
+
+// returns allocated port and true if successful.
+func (uc *udpcons_t) reserve_ephemeral(us *udpsock_t, lip Ip4_t) (uint16, bool) {
+	uc.l.Lock()
+	defer uc.l.Unlock()
+
+	k := tcplkey_t{lip: lip, lport: uint16(rand.Uint32())}
+	if k.lport == 0 {
+		k.lport++
+	}
+	anyk := k
+	anyk.lip = defs.INADDR_ANY
+	used := uc.socks[k] != nil || uc.socks[anyk] != nil
+	for i := 0; i <= int(^uint16(0)) && used; i++ {
+		k.lport++
+		anyk.lport++
+		used = k.lport == 0 || uc.socks[k] != nil || uc.socks[anyk] != nil
+	}
+	if used {
+		fmt.Printf("out of ephemeral ports\n")
+		return 0, false
+	}
+	uc.socks[k] = us
+	return k.lport, true
+}
+
+func (uc *udpcons_t) unreserve(lip Ip4_t, lport uint16) {
+	uc.l.Lock()
+	defer uc.l.Unlock()
+
+	lk := tcplkey_t{lip: lip, lport: lport}
+	// XXXPANIC
+	if uc.socks[lk] == nil {
+		panic("must be reserved")
+	}
+	delete(uc.socks, lk)
+}
+
+func (uc *udpcons_t) lookup(lip Ip4_t, lport uint16) (*udpsock_t, bool) {
+	uc.l.Lock()
+	defer uc.l.Unlock()
+
+	lk := tcplkey_t{lip: lip, lport: lport}
+	us, ok := uc.socks[lk]
+	if !ok {
+		lk.lip = defs.INADDR_ANY
+		us, ok = uc.socks[lk]
+	}
+	return us, ok
+}
+
+// udpcons' mutex is a leaf lock
+var udpcons udpcons_t
+
+func net_udp(pkt [][]uint8, tlen int) {
+	hdr := pkt[0]
+	if len(hdr) < ETHERLEN {
+		return
+	}
+	ip4, rest, ok := Sl2iphdr(hdr[ETHERLEN:])
+	if !ok {
+		return
+	}
+	udph, rest, ok := Sl2udphdr(rest)
+	if !ok {
+		return
+	}
+	// the NIC verified the checksum
+	dlen := int(Ntohs(udph.Len)) - UDPLEN
+	if dlen < 0 || dlen > tlen-ETHERLEN-IP4LEN-UDPLEN {
+		return
+	}
+
+	sip := Sl2ip(ip4.Sip[:])
+	dip := Sl2ip(ip4.Dip[:])
+	us, ok := udpcons.lookup(dip, Ntohs(udph.Dport))
+	if !ok {
+		// XXX send ICMP port unreachable
+		return
+	}
+	pkt[0] = rest
+	us.Lock()
+	us._deliver(sip, Ntohs(udph.Sport), pkt, dlen)
+	us.Unlock()
+}
+
+// transmits one datagram from lip:lport to rip:rport. if lip is
+// defs.INADDR_ANY, the source IP is that of the NIC which routes to rip.
+func udp_tx(lip, rip Ip4_t, lport, rport uint16, data []uint8) defs.Err_t {
+	localip, routeip, err := Routetbl.Lookup(rip)
+	if err != 0 {
+		return err
+	}
+	if lip != defs.INADDR_ANY && lip != localip {
+		return -defs.ENETUNREACH
+	}
+	nic, ok := Nic_lookup(localip)
+	if !ok {
+		return -defs.EHOSTUNREACH
+	}
+	dmac, err := Arp_resolve(localip, routeip)
+	if err != 0 {
+		return err
+	}
+
+	pkt := &Udppkt_t{}
+	l4len := UDPLEN + len(data)
+	pkt.Ether.Init_ip4(nic.Lmac()[:], dmac[:])
+	pkt.Iphdr.Init_udp(l4len, localip, rip)
+	pkt.Udphdr.Init(lport, rport, len(data))
+	pkt.Crc(l4len, localip, rip)
+	eth, iph, udph := pkt.Hdrbytes()
+	sgbuf := [][]uint8{eth, iph, udph, data}
+	// like any other datagram, one dropped by a full transmit queue is
+	// simply lost.
+	nic.Tx_udp(sgbuf)
+	return 0
+}
+
+// parses a struct sockaddr_in, returning the IP, port, and error
+func _udpsaddr(saddr []uint8) (Ip4_t, uint16, defs.Err_t) {
+	if len(saddr) < 8 {
+		return 0, 0, -defs.EINVAL
+	}
+	if util.Readn(saddr, 1, 1) != defs.AF_INET {
+		return 0, 0, -defs.EAFNOSUPPORT
+	}
+	port := Ntohs(Be16(util.Readn(saddr, 2, 2)))
+	ip := Ip4_t(Ntohl(Be32(util.Readn(saddr, 4, 4))))
+	return ip, port, 0
+}
+
+func _mkudpsaddr(ip Ip4_t, port uint16) []uint8 {
+	b := []uint8{8, defs.AF_INET, 0, 0, 0, 0, 0, 0}
+	util.Writen(b, 2, 2, int(port))
+	util.Writen(b, 4, 4, int(ip))
+	return b
+}
+
+// an empty buffer for Recvmsg's optional arguments
+var _udpnilbuf = &vm.Fakeubuf_t{}
+
+type Udpfops_t struct {
+	us      *udpsock_t
+	options defs.Fdopt_t
+}
+
+func (uf *Udpfops_t) Set(opt defs.Fdopt_t) {
+	uf.us = &udpsock_t{}
+	uf.us.us_init()
+	uf.options = opt
+}
+
+// to prevent an operation racing with a close
+func (uf *Udpfops_t) _closed() (defs.Err_t, bool) {
+	if uf.us.openc == 0 {
+		return -defs.EBADF, false
+	}
+	return 0, true
+}
+
+// binds the socket to an ephemeral port on all local IPs if it is not bound
+// yet. the caller must hold the socket's lock.
+func (uf *Udpfops_t) _autobind() defs.Err_t {
+	us := uf.us
+	if us.bound {
+		return 0
+	}
+	lport, ok := udpcons.reserve_ephemeral(us, defs.INADDR_ANY)
+	if !ok {
+		return -defs.EADDRINUSE
+	}
+	us.lip = defs.INADDR_ANY
+	us.lport = lport
+	us.bound = true
+	return 0
+}
+
+func (uf *Udpfops_t) Close() defs.Err_t {
+	us := uf.us
+	us.Lock()
+	defer us.Unlock()
+
+	if err, ok := uf._closed(); !ok {
+		return err
+	}
+	us.openc--
+	if us.openc == 0 {
+		if us.bound {
+			udpcons.unreserve(us.lip, us.lport)
+			us.bound = false
+		}
+		us._purge()
+		us.cond.Broadcast()
+		us.pollers.Wakeready(fdops.R_READ | fdops.R_WRITE | fdops.R_ERROR)
+		limits.Syslimit.Socks.Give()
+	}
+	return 0
+}
+
+func (uf *Udpfops_t) Fstat(st *stat.Stat_t) defs.Err_t {
+	sockmode := defs.Mkdev(2, 0)
+	st.Wmode(sockmode)
+	return 0
+}
+
+func (uf *Udpfops_t) Lseek(int, int) (int, defs.Err_t) {
+	return 0, -defs.ESPIPE
+}
+
+func (uf *Udpfops_t) Mmapi(int, int, bool) ([]mem.Mmapinfo_t, defs.Err_t) {
+	return nil, -defs.EINVAL
+}
+
+func (uf *Udpfops_t) Pathi() defs.Inum_t {
+	panic("udp socket cwd")
+}
+
+func (uf *Udpfops_t) Read(dst fdops.Userio_i) (int, defs.Err_t) {
+	did, _, _, _, err := uf.Recvmsg(dst, _udpnilbuf, _udpnilbuf, 0)
+	return did, err
+}
+
+func (uf *Udpfops_t) Reopen() defs.Err_t {
+	uf.us.Lock()
+	uf.us.openc++
+	uf.us.Unlock()
+	return 0
+}
+
+func (uf *Udpfops_t) Write(src fdops.Userio_i) (int, defs.Err_t) {
+	return uf.Sendmsg(src, nil, nil, 0)
+}
+
+func (uf *Udpfops_t) Truncate(newlen uint) defs.Err_t {
+	return -defs.EINVAL
+}
+
+func (uf *Udpfops_t) Utimens(*cred.Cred_t, int, int) defs.Err_t {
+	return -defs.EINVAL
+}
+
+func (uf *Udpfops_t) Fchmod(*cred.Cred_t, uint) defs.Err_t {
+	return -defs.EINVAL
+}
+
+func (uf *Udpfops_t) Fchown(*cred.Cred_t, int, int) defs.Err_t {
+	return -defs.EINVAL
+}
+
+func (uf *Udpfops_t) Getdents(fdops.Userio_i) (int, defs.Err_t) {
+	return 0, -defs.ENOTDIR
+}
+
+func (uf *Udpfops_t) Fsync(bool) defs.Err_t {
+	return -defs.EINVAL
+}
+
+func (uf *Udpfops_t) Pread(dst fdops.Userio_i, offset int) (int, defs.Err_t) {
+	return 0, -defs.ESPIPE
+}
+
+func (uf *Udpfops_t) Pwrite(src fdops.Userio_i, offset int) (int, defs.Err_t) {
+	return 0, -defs.ESPIPE
+}
+
+func (uf *Udpfops_t) Accept(fdops.Userio_i) (fdops.Fdops_i, int, defs.Err_t) {
+	return nil, 0, -defs.EOPNOTSUPP
+}
+
+func (uf *Udpfops_t) Bind(saddr []uint8) defs.Err_t {
+	lip, lport, err := _udpsaddr(saddr)
+	if err != 0 {
+		return err
+	}
+	if lip != defs.INADDR_ANY {
+		if _, ok := Nic_lookup(lip); !ok {
+			return -defs.EADDRNOTAVAIL
+		}
+	}
+
+	us := uf.us
+	us.Lock()
+	defer us.Unlock()
+
+	if err, ok := uf._closed(); !ok {
+		return err
+	}
+	if us.bound {
+		return -defs.EINVAL
+	}
+	var ok bool
+	if lport == 0 {
+		lport, ok = udpcons.reserve_ephemeral(us, lip)
+	} else {
+		ok = udpcons.reserve(us, lip, lport)
+	}
+	if !ok {
+		return -defs.EADDRINUSE
+	}
+	us.lip = lip
+	us.lport = lport
+	us.bound = true
+	return 0
+}
+
+// sets the default destination; an AF_UNSPEC address dissolves the
+// association.
+func (uf *Udpfops_t) Connect(saddr []uint8) defs.Err_t {
+	us := uf.us
+	us.Lock()
+	defer us.Unlock()
+
+	if err, ok := uf._closed(); !ok {
+		return err
+	}
+	if len(saddr) >= 2 && util.Readn(saddr, 1, 1) == defs.AF_UNSPEC {
+		us.conn = false
+		return 0
+	}
+	rip, rport, err := _udpsaddr(saddr)
+	if err != 0 {
+		return err
+	}
+	if rport == 0 {
+		return -defs.EINVAL
+	}
+	if _, _, err := Routetbl.Lookup(rip); err != 0 {
+		return err
+	}
+	if err := uf._autobind(); err != 0 {
+		return err
+	}
+	us.rip = rip
+	us.rport = rport
+	us.conn = true
+	return 0
+}
+
+func (uf *Udpfops_t) Listen(backlog int) (fdops.Fdops_i, defs.Err_t) {
+	return nil, -defs.EOPNOTSUPP
+}
+
+func (uf *Udpfops_t) Sendmsg(src fdops.Userio_i,
+	toaddr []uint8, cmsg []uint8, flags int) (int, defs.Err_t) {
+	if len(cmsg) != 0 {
+		panic("no imp")
+	}
+	sz := src.Totalsz()
+	if sz > udpmaxpay {
+		return 0, -defs.EMSGSIZE
+	}
+	data := make([]uint8, sz)
+	if _, err := src.Uioread(data); err != 0 {
+		return 0, err
+	}
+
+	us := uf.us
+	us.Lock()
+	if err, ok := uf._closed(); !ok {
+		us.Unlock()
+		return 0, err
+	}
+	if us.wdone {
+		us.Unlock()
+		proc.Sigpipe()
+		return 0, -defs.EPIPE
+	}
+	rip, rport := us.rip, us.rport
+	if len(toaddr) != 0 {
+		if us.conn {
+			us.Unlock()
+			return 0, -defs.EISCONN
+		}
+		var err defs.Err_t
+		rip, rport, err = _udpsaddr(toaddr)
+		if err != 0 {
+			us.Unlock()
+			return 0, err
+		}
+	} else if !us.conn {
+		us.Unlock()
+		return 0, -defs.EDESTADDRREQ
+	}
+	if err := uf._autobind(); err != 0 {
+		us.Unlock()
+		return 0, err
+	}
+	lip, lport := us.lip, us.lport
+	// do not hold the lock while resolving the destination's MAC
+	us.Unlock()
+
+	if err := udp_tx(lip, rip, lport, rport, data); err != 0 {
+		return 0, err
+	}
+	return sz, 0
+}
+
+// like recvmsg(2) on Linux, the part of a datagram which does not fit in dst
+// is discarded and MSG_TRUNC is set.
+func (uf *Udpfops_t) Recvmsg(dst fdops.Userio_i,
+	fromsa fdops.Userio_i, cmsg fdops.Userio_i, flag int) (int, int, int,
+	defs.Msgfl_t, defs.Err_t) {
+	if cmsg.Totalsz() != 0 {
+		panic("no imp")
+	}
+	us := uf.us
+	us.Lock()
+	for {
+		if err, ok := uf._closed(); !ok {
+			us.Unlock()
+			return 0, 0, 0, 0, err
+		}
+		if len(us.rxq) != 0 {
+			break
+		}
+		if us.rdone {
+			us.Unlock()
+			return 0, 0, 0, 0, 0
+		}
+		if uf.options&defs.O_NONBLOCK != 0 {
+			us.Unlock()
+			return 0, 0, 0, 0, -defs.EAGAIN
+		}
+		if err := proc.KillableWait(us.cond); err != 0 {
+			us.Unlock()
+			return 0, 0, 0, 0, err
+		}
+	}
+	dg := us._dequeue()
+	us.Unlock()
+
+	var fdid int
+	if fromsa.Totalsz() != 0 {
+		var err defs.Err_t
+		fdid, err = fromsa.Uiowrite(_mkudpsaddr(dg.sip, dg.sport))
+		if err != 0 {
+			return 0, 0, 0, 0, err
+		}
+	}
+	did, err := dst.Uiowrite(dg.data)
+	if err != 0 {
+		return 0, 0, 0, 0, err
+	}
+	var fl defs.Msgfl_t
+	if did < len(dg.data) {
+		fl |= defs.MSG_TRUNC
+	}
+	return did, fdid, 0, fl, 0
+}
+
+func (uf *Udpfops_t) Pollone(pm fdops.Pollmsg_t) (fdops.Ready_t, defs.Err_t) {
+	us := uf.us
+	us.Lock()
+	defer us.Unlock()
+
+	var ready fdops.Ready_t
+	if us.openc == 0 {
+		return ready, 0
+	}
+	if pm.Events&fdops.R_READ != 0 && (len(us.rxq) != 0 || us.rdone) {
+		ready |= fdops.R_READ
+	}
+	// sends never block
+	if pm.Events&fdops.R_WRITE != 0 && !us.wdone {
+		ready |= fdops.R_WRITE
+	}
+	if pm.Events&fdops.R_HUP != 0 && us.rdone && us.wdone {
+		ready |= fdops.R_HUP
+	}
+	var err defs.Err_t
+	if ready == 0 && pm.Dowait {
+		err = us.pollers.Addpoller(&pm)
+	}
+	return ready, err
+}
+
+func (uf *Udpfops_t) Fcntl(cmd, opt int) int {
+	uf.us.Lock()
+	defer uf.us.Unlock()
+
+	switch cmd {
+	case defs.F_GETFL:
+		return int(uf.options)
+	case defs.F_SETFL:
+		uf.options = defs.Fdopt_t(opt)
+		return 0
+	default:
+		panic("weird cmd")
+	}
+}
+
+// FIONREAD returns the size of the next datagram
+func (uf *Udpfops_t) Ioctl(req int, arg fdops.Userio_i) defs.Err_t {
+	switch req {
+	case defs.FIONREAD:
+		us := uf.us
+		us.Lock()
+		var n int
+		if len(us.rxq) != 0 {
+			n = len(us.rxq[0].data)
+		}
+		us.Unlock()
+		return fdops.Intout(arg, n)
+	case defs.FIONBIO:
+		return fdops.Fionbio(uf, arg)
+	default:
+		return -defs.ENOTTY
+	}
+}
+
+func (uf *Udpfops_t) Getsockopt(lev, opt int, bufarg fdops.Userio_i,
+	intarg int) (int, defs.Err_t) {
+	if lev != defs.SOL_SOCKET {
+		return 0, -defs.ENOPROTOOPT
+	}
+	us := uf.us
+	us.Lock()
+	defer us.Unlock()
+
+	switch opt {
+	case defs.SO_NAME:
+		if !us.bound {
+			return 0, -defs.EADDRNOTAVAIL
+		}
+		return bufarg.Uiowrite(_mkudpsaddr(us.lip, us.lport))
+	case defs.SO_PEER:
+		if !us.conn {
+			return 0, -defs.ENOTCONN
+		}
+		return bufarg.Uiowrite(_mkudpsaddr(us.rip, us.rport))
+	case defs.SO_RCVBUF:
+		return us.rcvsz, 0
+	case defs.SO_ERROR:
+		return 0, 0
+	default:
+		return 0, -defs.EOPNOTSUPP
+	}
+}
+
+func (uf *Udpfops_t) Setsockopt(lev, opt int, src fdops.Userio_i,
+	intarg int) defs.Err_t {
+	us := uf.us
+	us.Lock()
+	defer us.Unlock()
+
+	if lev != defs.SOL_SOCKET {
+		return -defs.EOPNOTSUPP
+	}
+	switch opt {
+	case defs.SO_RCVBUF:
+		// queued datagrams beyond a smaller limit stay queued
+		if intarg < udpmaxpay || intarg > 1<<20 {
+			return -defs.EINVAL
+		}
+		us.rcvsz = intarg
+		return 0
+	default:
+		return -defs.EOPNOTSUPP
+	}
+}
+
+func (uf *Udpfops_t) Shutdown(read, write bool) defs.Err_t {
+	us := uf.us
+	us.Lock()
+	defer us.Unlock()
+
+	if !us.conn {
+		return -defs.ENOTCONN
+	}
+	if read {
+		us.rdone = true
+		us._purge()
+		us._rready()
+	}
+	if write {
+		us.wdone = true
+		us.pollers.Wakeready(fdops.R_WRITE)
+	}
+	return 0
+}
@@ -6,6 +6,8 @@ import "ustr"
 type Pathparts_t struct {
 	path ustr.Ustr
 	loc  int
+	// offset of the component last returned by Next
+	coff int
 }
 
 func (pp *Pathparts_t) Pp_init(path ustr.Ustr) {
@@ -19,6 +21,7 @@ func (pp *Pathparts_t) Next() (ustr.Ustr, bool) {
 		if pp.loc == len(pp.path) {
 			return ustr.MkUstr(), false
 		}
+		pp.coff = pp.loc
 		ret = pp.path[pp.loc:]
 		nloc := ustr.Ustr.IndexByte(ret, '/')
 		if nloc != -1 {
@@ -31,6 +34,12 @@ func (pp *Pathparts_t) Next() (ustr.Ustr, bool) {
 	return ret, true
 }
 
+// returns the offset in the path of the component most recently returned by
+// Next
+func (pp *Pathparts_t) Off() int {
+	return pp.coff
+}
+
 func Sdirname(path ustr.Ustr) (ustr.Ustr, ustr.Ustr) {
 	fn := path
 	l := len(fn)
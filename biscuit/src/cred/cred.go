@@ -0,0 +1,93 @@
+package cred
+
+// the permission bits requested by an access check, in the order of the rwx
+// bits of a file mode
+const (
+	MAY_EXEC  uint = 1
+	MAY_WRITE uint = 2
+	MAY_READ  uint = 4
+)
+
+// process credentials. a Cred_t is never modified once it is shared; changing
+// the credentials of a process replaces its Cred_t.
+type Cred_t struct {
+	// real, effective, and saved user ids
+	Ruid int
+	Euid int
+	Suid int
+	// real, effective, and saved group ids
+	Rgid int
+	Egid int
+	Sgid int
+	// supplementary groups
+	Groups []int
+}
+
+// the credentials of init and the kernel
+var Root = &Cred_t{}
+
+func (cr *Cred_t) Isroot() bool {
+	return cr.Euid == 0
+}
+
+// returns true if gid is the effective gid or a supplementary group
+func (cr *Cred_t) Ingroup(gid int) bool {
+	if cr.Egid == gid {
+		return true
+	}
+	for _, g := range cr.Groups {
+		if g == gid {
+			return true
+		}
+	}
+	return false
+}
+
+// returns true if cr may access a file with owner uid, group gid, and mode
+// bits mode in the way described by want. root may do anything except
+// execute a file with no execute bits set.
+func (cr *Cred_t) Permits(uid, gid int, mode, want uint, isdir bool) bool {
+	if cr.Isroot() {
+		if want&MAY_EXEC == 0 || isdir {
+			return true
+		}
+		return mode&0111 != 0
+	}
+	var bits uint
+	switch {
+	case cr.Euid == uid:
+		bits = mode >> 6
+	case cr.Ingroup(gid):
+		bits = mode >> 3
+	default:
+		bits = mode
+	}
+	return bits&want == want
+}
+
+// returns true if cr may signal a process with credentials t: root may signal
+// any process, other users only the processes whose real or saved uid is
+// their real or effective uid.
+func (cr *Cred_t) Maysignal(t *Cred_t) bool {
+	if cr.Isroot() {
+		return true
+	}
+	return cr.Ruid == t.Ruid || cr.Ruid == t.Suid || cr.Euid == t.Ruid ||
+		cr.Euid == t.Suid
+}
+
+// returns a copy of cr whose effective ids are the real ids; access(2) checks
+// permissions using the real ids.
+func (cr *Cred_t) Real() *Cred_t {
+	ret := *cr
+	ret.Euid = cr.Ruid
+	ret.Egid = cr.Rgid
+	return &ret
+}
+
+// returns a copy of cr. the copy's Groups share the same backing array, which
+// must not be modified.
+func (cr *Cred_t) Copy() *Cred_t {
+	ret := *cr
+	return &ret
+}
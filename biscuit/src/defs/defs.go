@@ -34,9 +34,15 @@ const (
 const (
 	TFSIZE    = 24
 	TFREGS    = 17
+	TF_GSBASE = 0
 	TF_FSBASE = 1
+	TF_R15    = 2
+	TF_R14    = 3
 	TF_R13    = 4
 	TF_R12    = 5
+	TF_R11    = 6
+	TF_R10    = 7
+	TF_R9     = 8
 	TF_R8     = 9
 	TF_RBP    = 10
 	TF_RSI    = 11
@@ -9,8 +9,12 @@ const (
 	D_RAWDISK = 5
 	D_STAT    = 6
 	D_PROF    = 7
-	D_FIRST   = D_CONSOLE
-	D_LAST    = D_SUS
+	// the pseudo-terminal multiplexer, whose opens each make a new
+	// pseudo-terminal and return its master, and the slaves
+	D_PTMX  = 8
+	D_PTS   = 9
+	D_FIRST = D_CONSOLE
+	D_LAST  = D_SUS
 )
 
 func Mkdev(_maj, _min int) uint {
@@ -6,6 +6,7 @@ const (
 	ESRCH         Err_t = 3
 	EINTR         Err_t = 4
 	EIO           Err_t = 5
+	ENXIO         Err_t = 6
 	E2BIG         Err_t = 7
 	EBADF         Err_t = 9
 	ECHILD        Err_t = 10
@@ -16,15 +17,20 @@ const (
 	EFAULT        Err_t = 14
 	EBUSY         Err_t = 16
 	EEXIST        Err_t = 17
+	EXDEV         Err_t = 18
 	ENODEV        Err_t = 19
 	ENOTDIR       Err_t = 20
 	EISDIR        Err_t = 21
 	EINVAL        Err_t = 22
 	EMFILE        Err_t = 24
+	ENOTTY        Err_t = 25
+	ETXTBSY       Err_t = 26
+	EFBIG         Err_t = 27
 	ENOSPC        Err_t = 28
 	ESPIPE        Err_t = 29
 	EPIPE         Err_t = 32
 	ERANGE        Err_t = 34
+	EDEADLK       Err_t = 35
 	ENAMETOOLONG  Err_t = 36
 	ENOSYS        Err_t = 38
 	ENOTEMPTY     Err_t = 39
@@ -34,9 +40,11 @@ const (
 	EADDRNOTAVAIL Err_t = 49
 	ENETDOWN      Err_t = 50
 	ENETUNREACH   Err_t = 51
+	ELOOP         Err_t = 62
 	EHOSTUNREACH  Err_t = 65
 	ENOTSOCK      Err_t = 88
 	EMSGSIZE      Err_t = 90
+	ENOPROTOOPT   Err_t = 92
 	EOPNOTSUPP    Err_t = 95
 	ECONNRESET    Err_t = 104
 	EISCONN       Err_t = 106
@@ -4,60 +4,97 @@ type Msgfl_t uint
 type Fdopt_t uint
 
 const (
-	SYS_READ            = 0
-	SYS_WRITE           = 1
-	SYS_OPEN            = 2
-	O_RDONLY    Fdopt_t = 0
-	O_WRONLY    Fdopt_t = 1
-	O_RDWR      Fdopt_t = 2
-	O_CREAT     Fdopt_t = 0x40
-	O_EXCL      Fdopt_t = 0x80
-	O_TRUNC     Fdopt_t = 0x200
-	O_APPEND    Fdopt_t = 0x400
-	O_NONBLOCK  Fdopt_t = 0x800
-	O_DIRECTORY Fdopt_t = 0x10000
-	O_CLOEXEC   Fdopt_t = 0x80000
-	SYS_CLOSE           = 3
-	SYS_STAT            = 4
-	SYS_FSTAT           = 5
-	SYS_POLL            = 7
-	POLLRDNORM          = 0x1
-	POLLRDBAND          = 0x2
-	POLLIN              = (POLLRDNORM | POLLRDBAND)
-	POLLPRI             = 0x4
-	POLLWRNORM          = 0x8
-	POLLOUT             = POLLWRNORM
-	POLLWRBAND          = 0x10
-	POLLERR             = 0x20
-	POLLHUP             = 0x40
-	POLLNVAL            = 0x80
-	SYS_LSEEK           = 8
-	SEEK_SET            = 0x1
-	SEEK_CUR            = 0x2
-	SEEK_END            = 0x4
-	SYS_MMAP            = 9
-	MAP_SHARED          = uint(0x1)
-	MAP_PRIVATE         = uint(0x2)
-	MAP_FIXED           = 0x10
-	MAP_ANON            = 0x20
-	MAP_FAILED          = -1
-	PROT_NONE           = 0x0
-	PROT_READ           = 0x1
-	PROT_WRITE          = 0x2
-	PROT_EXEC           = 0x4
-	SYS_MUNMAP          = 11
-	SYS_SIGACT          = 13
-	SYS_READV           = 19
-	SYS_WRITEV          = 20
-	SYS_ACCESS          = 21
-	SYS_DUP2            = 33
-	SYS_PAUSE           = 34
-	SYS_GETPID          = 39
-	SYS_GETPPID         = 40
-	SYS_SOCKET          = 41
+	SYS_READ                = 0
+	SYS_WRITE               = 1
+	SYS_OPEN                = 2
+	O_RDONLY        Fdopt_t = 0
+	O_WRONLY        Fdopt_t = 1
+	O_RDWR          Fdopt_t = 2
+	O_CREAT         Fdopt_t = 0x40
+	O_EXCL          Fdopt_t = 0x80
+	O_TRUNC         Fdopt_t = 0x200
+	O_APPEND        Fdopt_t = 0x400
+	O_NONBLOCK      Fdopt_t = 0x800
+	O_DIRECTORY     Fdopt_t = 0x10000
+	O_NOFOLLOW      Fdopt_t = 0x20000
+	O_CLOEXEC       Fdopt_t = 0x80000
+	O_EXEC          Fdopt_t = 0x200000 // kernel only: open to execute or search
+	SYS_CLOSE               = 3
+	SYS_STAT                = 4
+	SYS_FSTAT               = 5
+	SYS_LSTAT               = 6
+	SYS_POLL                = 7
+	POLLRDNORM              = 0x1
+	POLLRDBAND              = 0x2
+	POLLIN                  = (POLLRDNORM | POLLRDBAND)
+	POLLPRI                 = 0x4
+	POLLWRNORM              = 0x8
+	POLLOUT                 = POLLWRNORM
+	POLLWRBAND              = 0x10
+	POLLERR                 = 0x20
+	POLLHUP                 = 0x40
+	POLLNVAL                = 0x80
+	SYS_LSEEK               = 8
+	SEEK_SET                = 0x1
+	SEEK_CUR                = 0x2
+	SEEK_END                = 0x4
+	SYS_MMAP                = 9
+	MAP_SHARED              = uint(0x1)
+	MAP_PRIVATE             = uint(0x2)
+	MAP_FIXED               = 0x10
+	MAP_ANON                = 0x20
+	MAP_FAILED              = -1
+	PROT_NONE               = 0x0
+	PROT_READ               = 0x1
+	PROT_WRITE              = 0x2
+	PROT_EXEC               = 0x4
+	SYS_MPROTECT            = 10
+	SYS_MUNMAP              = 11
+	SYS_SIGACT              = 13
+	SYS_SIGMASK             = 14
+	SYS_SIGRET              = 15
+	SYS_IOCTL               = 16
+	TCGETS                  = 0x5401
+	TCSETS                  = 0x5402
+	TCSETSW                 = 0x5403
+	TCSETSF                 = 0x5404
+	TIOCSCTTY               = 0x540e
+	TIOCGPGRP               = 0x540f
+	TIOCSPGRP               = 0x5410
+	TIOCGWINSZ              = 0x5413
+	TIOCSWINSZ              = 0x5414
+	TIOCGPTN                = 0x80045430
+	TIOCSPTLCK              = 0x40045431
+	FIONREAD                = 0x541b
+	FIONBIO                 = 0x5421
+	BLKGETSIZE              = 0x1260
+	BLKSSZGET               = 0x1268
+	BLKGETSIZE64            = 0x80081272
+	SYS_READV               = 19
+	SYS_WRITEV              = 20
+	SYS_ACCESS              = 21
+	R_OK                    = 1 << 0
+	W_OK                    = 1 << 1
+	X_OK                    = 1 << 2
+	SYS_MSYNC               = 26
+	MS_ASYNC                = 0x1
+	MS_INVALIDATE           = 0x2
+	MS_SYNC                 = 0x4
+	SYS_MADVISE             = 28
+	MADV_NORMAL             = 0
+	MADV_RANDOM             = 1
+	MADV_SEQUENTIAL         = 2
+	MADV_WILLNEED           = 3
+	MADV_DONTNEED           = 4
+	SYS_DUP2                = 33
+	SYS_PAUSE               = 34
+	SYS_GETPID              = 39
+	SYS_GETPPID             = 40
+	SYS_SOCKET              = 41
 	// domains
-	AF_UNIX = 1
-	AF_INET = 2
+	AF_UNSPEC = 0
+	AF_UNIX   = 1
+	AF_INET   = 2
 	// types
 	SOCK_STREAM            = 1 << 0
 	SOCK_DGRAM             = 1 << 1
@@ -83,7 +120,8 @@ const (
 	SYS_GETSOCKOPT         = 55
 	SYS_SETSOCKOPT         = 56
 	// socket levels
-	SOL_SOCKET = 1
+	SOL_SOCKET  = 1
+	IPPROTO_TCP = 6
 	// socket options
 	SO_SNDBUF        = 1
 	SO_SNDTIMEO      = 2
@@ -91,6 +129,7 @@ const (
 	SO_RCVBUF        = 5
 	SO_NAME          = 10
 	SO_PEER          = 11
+	TCP_INFO         = 21
 	SYS_FORK         = 57
 	FORK_PROCESS     = 0x1
 	FORK_THREAD      = 0x2
@@ -99,6 +138,8 @@ const (
 	CONTINUED        = 1 << 9
 	EXITED           = 1 << 10
 	SIGNALED         = 1 << 11
+	COREDUMP         = 1 << 12
+	STOPPED          = 1 << 13
 	SIGSHIFT         = 27
 	SYS_WAIT4        = 61
 	WAIT_ANY         = -1
@@ -112,6 +153,19 @@ const (
 	F_SETFL          = 2
 	F_GETFD          = 3
 	F_SETFD          = 4
+	F_SETLK          = 5
+	F_SETLKW         = 6
+	F_GETLK          = 8
+	F_RDLCK          = 0
+	F_WRLCK          = 1
+	F_UNLCK          = 2
+	SYS_FLOCK        = 73
+	LOCK_SH          = 1
+	LOCK_EX          = 2
+	LOCK_NB          = 4
+	LOCK_UN          = 8
+	SYS_FSYNC        = 74
+	SYS_FDATASYNC    = 75
 	SYS_TRUNC        = 76
 	SYS_FTRUNC       = 77
 	SYS_GETCWD       = 79
@@ -120,19 +174,58 @@ const (
 	SYS_MKDIR        = 83
 	SYS_LINK         = 86
 	SYS_UNLINK       = 87
+	SYS_SYMLINK      = 88
+	SYS_READLINK     = 89
+	SYS_CHMOD        = 90
+	S_ISUID          = 04000
+	S_ISGID          = 02000
+	S_ISVTX          = 01000
+	SYS_FCHMOD       = 91
+	SYS_CHOWN        = 92
+	SYS_FCHOWN       = 93
+	SYS_UMASK        = 95
 	SYS_GETTOD       = 96
 	SYS_GETRLMT      = 97
 	RLIMIT_NOFILE    = 1
+	RLIMIT_CORE      = 2
 	RLIM_INFINITY    = ^uint(0)
 	SYS_GETRUSG      = 98
 	RUSAGE_SELF      = 1
 	RUSAGE_CHILDREN  = 2
+	SYS_GETUID       = 102
+	SYS_GETGID       = 104
+	SYS_SETUID       = 105
+	SYS_SETGID       = 106
+	SYS_GETEUID      = 107
+	SYS_GETEGID      = 108
+	SYS_SETPGID      = 109
+	SYS_SETSID       = 112
+	SYS_GETGROUPS    = 115
+	NGROUPS_MAX      = 32
+	SYS_SETGROUPS    = 116
+	SYS_GETPGID      = 121
 	SYS_MKNOD        = 133
+	SYS_PERSONA      = 135
 	SYS_SETRLMT      = 160
 	SYS_SYNC         = 162
+	SYS_MOUNT        = 165
+	SYS_UMOUNT       = 166
+	SYS_SWAPON       = 167
 	SYS_REBOOT       = 169
+	SYS_GETDENTS     = 217
+	DT_UNKNOWN       = 0
+	DT_CHR           = 2
+	DT_DIR           = 4
+	DT_REG           = 8
+	DT_LNK           = 10
+	DT_SOCK          = 12
 	SYS_NANOSLEEP    = 230
+	SYS_UTIMES       = 235
+	UTIME_NOW        = (1 << 30) - 1
+	UTIME_OMIT       = (1 << 30) - 2
 	SYS_PIPE2        = 293
+	SYS_MEMFD        = 319
+	MFD_CLOEXEC      = 1 << 0
 	SYS_PROF         = 31337
 	PROF_DISABLE     = 1 << 0
 	PROF_GOLANG      = 1 << 1
@@ -164,14 +257,113 @@ const (
 	FUTEX_WAKE       = 2
 	FUTEX_CNDGIVE    = 3
 	SYS_GETTID       = 31343
+	SYS_FUTIMENS     = 31344
+	SYS_COREDIR      = 31345
 )
 
+// termios(3) flags and control characters, with Linux's values
 const (
-	SIGKILL = 9
+	// c_iflag
+	ISTRIP = 0x20
+	INLCR  = 0x40
+	IGNCR  = 0x80
+	ICRNL  = 0x100
+	// c_oflag
+	OPOST = 0x1
+	ONLCR = 0x4
+	// c_cflag
+	B38400 = 0xf
+	CS8    = 0x30
+	CREAD  = 0x80
+	// c_lflag
+	ISIG    = 0x1
+	ICANON  = 0x2
+	ECHO    = 0x8
+	ECHOE   = 0x10
+	ECHOK   = 0x20
+	ECHONL  = 0x40
+	NOFLSH  = 0x80
+	TOSTOP  = 0x100
+	ECHOCTL = 0x200
+	IEXTEN  = 0x8000
+	// indices of c_cc
+	VINTR  = 0
+	VQUIT  = 1
+	VERASE = 2
+	VKILL  = 3
+	VEOF   = 4
+	VTIME  = 5
+	VMIN   = 6
+	VSUSP  = 10
+	VEOL   = 11
+	NCCS   = 19
+)
+
+// the times given to the file systems for UTIME_OMIT and UTIME_NOW; other
+// times are nanoseconds since the epoch
+const (
+	UT_OMIT = -1
+	UT_NOW  = -2
+)
+
+// personality(2) flags
+const (
+	// exec(2) does not randomize the layout of the address space
+	ADDR_NO_RANDOMIZE uint = 0x0040000
+)
+
+const (
+	SIGHUP   = 1
+	SIGINT   = 2
+	SIGQUIT  = 3
+	SIGILL   = 4
+	SIGFPE   = 8
+	SIGKILL  = 9
+	SIGUSR1  = 10
+	SIGSEGV  = 11
+	SIGSYS   = 12
+	SIGPIPE  = 13
+	SIGALRM  = 14
+	SIGTERM  = 15
+	SIGSTOP  = 17
+	SIGTSTP  = 18
+	SIGCONT  = 19
+	SIGCHLD  = 20
+	SIGTTIN  = 21
+	SIGTTOU  = 22
+	SIGIO    = 23
+	SIGWINCH = 28
+	SIGUSR2  = 31
+	NSIG     = 32
+)
+
+const (
+	// sigaction flags
+	SA_SIGINFO   = 0x1
+	SA_NODEFER   = 0x2
+	SA_RESETHAND = 0x4
+	// special handler values
+	SIG_DFL = 1
+	SIG_IGN = 2
+	// sigprocmask operations
+	SIG_BLOCK   = 1
+	SIG_SETMASK = 2
+	SIG_UNBLOCK = 3
+	// siginfo codes
+	SI_USER     = 0
+	SI_KERNEL   = 0x80
+	SEGV_MAPERR = 1
+	SEGV_ACCERR = 2
+	// SIGCHLD codes
+	CLD_EXITED    = 1
+	CLD_KILLED    = 2
+	CLD_DUMPED    = 3
+	CLD_STOPPED   = 5
+	CLD_CONTINUED = 6
 )
 
 func Mkexitsig(sig int) int {
-	if sig < 0 || sig > 32 {
+	if sig < 0 || sig > NSIG {
 		panic("bad sig")
 	}
 	return sig << SIGSHIFT
@@ -1,6 +1,7 @@
 package fd
 
 import "sync"
+import "sync/atomic"
 
 import "bpath"
 import "defs"
@@ -40,6 +41,17 @@ type Cwd_t struct {
 	sync.Mutex // to serialize chdirs
 	Fd         *Fd_t
 	Path       ustr.Ustr
+	// the file mode creation mask; like Linux, it is kept with the cwd
+	umask uint32
+}
+
+func (cwd *Cwd_t) Umask() uint {
+	return uint(atomic.LoadUint32(&cwd.umask))
+}
+
+// sets the umask, returning the old one
+func (cwd *Cwd_t) Setumask(m uint) uint {
+	return uint(atomic.SwapUint32(&cwd.umask, uint32(m&0777)))
 }
 
 func (cwd *Cwd_t) Fullpath(p ustr.Ustr) ustr.Ustr {
@@ -2,10 +2,12 @@ package fdops
 
 import "time"
 
+import "cred"
 import "defs"
 import "mem"
 import "stat"
 import "tinfo"
+import "util"
 
 type Ready_t uint8
 
@@ -41,6 +43,19 @@ type Fdops_i interface {
 	Reopen() defs.Err_t
 	Write(Userio_i) (int, defs.Err_t)
 	Truncate(uint) defs.Err_t
+	// sets the access and modification times, in nanoseconds since the
+	// epoch. a negative time is left unchanged.
+	Utimens(*cred.Cred_t, int, int) defs.Err_t
+	// change the permission bits and the owner and group of the file. an
+	// id of -1 is left unchanged.
+	Fchmod(*cred.Cred_t, uint) defs.Err_t
+	Fchown(*cred.Cred_t, int, int) defs.Err_t
+	// fills the buffer with directory entries, starting at the entry
+	// whose cookie is the file offset
+	Getdents(Userio_i) (int, defs.Err_t)
+	// commits the file's modifications to disk. if the bool is true,
+	// modifications of only the file's timestamps need not be committed.
+	Fsync(bool) defs.Err_t
 
 	Pread(Userio_i, int) (int, defs.Err_t)
 	Pwrite(Userio_i, int) (int, defs.Err_t)
@@ -70,11 +85,101 @@ type Fdops_i interface {
 	Pollone(Pollmsg_t) (Ready_t, defs.Err_t)
 
 	Fcntl(int, int) int
-	Getsockopt(int, Userio_i, int) (int, defs.Err_t)
+	// performs the device-specific ioctl(2) request. the argument is the
+	// request's buffer in user memory, sized by the syscall for the
+	// request. returns ENOTTY for requests the file does not support.
+	Ioctl(int, Userio_i) defs.Err_t
+	Getsockopt(int, int, Userio_i, int) (int, defs.Err_t)
 	Setsockopt(int, int, Userio_i, int) defs.Err_t
 	Shutdown(rdone, wdone bool) defs.Err_t
 }
 
+// a byte-range lock of fcntl(2). the range starts at the absolute offset
+// Start; a Len of 0 extends it to the end of the file, however large the file
+// grows.
+type Flock_t struct {
+	Type  int
+	Start int
+	Len   int
+	Pid   int
+}
+
+// implemented by the fops of files whose pages can be mapped shared
+type Pagesync_i interface {
+	// writes back the pages at the file offsets offs, which were modified
+	// through a mapping, and waits for them to be committed if wait is
+	// true.
+	Syncpages(offs []int, wait bool) defs.Err_t
+}
+
+// implemented by the fops of files that support advisory locks
+type Lockable_i interface {
+	// flock(2)
+	Flock(how int) defs.Err_t
+	// F_GETLK, F_SETLK, and F_SETLKW on behalf of process pid. F_GETLK
+	// replaces the lock with one that conflicts with it, or sets its type
+	// to F_UNLCK if there is none.
+	Reclock(pid, cmd int, fl *Flock_t) defs.Err_t
+	// releases the record locks of process pid; a process releases its
+	// record locks on a file when it closes any of its fds for the file.
+	Unlockall(pid int)
+}
+
+// copies the n-byte argument of an ioctl(2) request from user memory
+func Argin(arg Userio_i, n int) ([]uint8, defs.Err_t) {
+	b := make([]uint8, n)
+	did, err := arg.Uioread(b)
+	if err != 0 {
+		return nil, err
+	}
+	if did != n {
+		return nil, -defs.EFAULT
+	}
+	return b, 0
+}
+
+// copies the result of an ioctl(2) request to user memory
+func Argout(arg Userio_i, b []uint8) defs.Err_t {
+	did, err := arg.Uiowrite(b)
+	if err != 0 {
+		return err
+	}
+	if did != len(b) {
+		return -defs.EFAULT
+	}
+	return 0
+}
+
+// copies the int result of a request like FIONREAD to user memory
+func Intout(arg Userio_i, v int) defs.Err_t {
+	var b [4]uint8
+	util.Writen(b[:], 4, 0, v)
+	return Argout(arg, b[:])
+}
+
+// implements FIONBIO for fops which keep their file status flags for
+// fcntl(2): a non-zero argument sets O_NONBLOCK and zero clears it.
+func Fionbio(fops Fdops_i, arg Userio_i) defs.Err_t {
+	b, err := Argin(arg, 4)
+	if err != 0 {
+		return err
+	}
+	fl := fops.Fcntl(defs.F_GETFL, 0)
+	if fl < 0 {
+		return -defs.ENOTTY
+	}
+	opts := defs.Fdopt_t(fl)
+	if util.Readn(b, 4, 0) != 0 {
+		opts |= defs.O_NONBLOCK
+	} else {
+		opts &^= defs.O_NONBLOCK
+	}
+	if ret := fops.Fcntl(defs.F_SETFL, int(opts)); ret < 0 {
+		return defs.Err_t(ret)
+	}
+	return 0
+}
+
 type Pollmsg_t struct {
 	notif  chan bool
 	Events Ready_t
@@ -111,6 +111,11 @@ func (bcache *bcache_t) Write(b *Bdev_block_t) {
 	b.Write()
 }
 
+func (bcache *bcache_t) Write_fua(b *Bdev_block_t) {
+	bcache.Refup(b, "write_fua")
+	b.Write_fua()
+}
+
 func (bcache *bcache_t) Write_async(b *Bdev_block_t) {
 	bcache.Refup(b, "write_async")
 	b.Write_async()
@@ -323,8 +328,10 @@ func mkBallocater(fs *Fs_t, start, len, first int) *bbitmap_t {
 	return balloc
 }
 
-func (balloc *bbitmap_t) Balloc(opid opid_t) (int, defs.Err_t) {
-	ret, err := balloc.balloc1(opid)
+// allocates a block, preferring block goal if it is free. a goal of 0 means no
+// preference.
+func (balloc *bbitmap_t) Balloc(opid opid_t, goal int) (int, defs.Err_t) {
+	ret, err := balloc.balloc1(opid, goal)
 	if err != 0 {
 		return 0, err
 	}
@@ -371,8 +378,12 @@ func (balloc *bbitmap_t) Stats() string {
 // allocates a block, marking it used in the free block bitmap. free blocks and
 // log blocks are not accounted for in the free bitmap; all others are. balloc
 // should only ever acquire fblock.
-func (balloc *bbitmap_t) balloc1(opid opid_t) (int, defs.Err_t) {
-	blkn, err := balloc.alloc.FindAndMark(opid)
+func (balloc *bbitmap_t) balloc1(opid opid_t, goal int) (int, defs.Err_t) {
+	bit := -1
+	if goal >= balloc.first && goal < balloc.fs.superb.Lastblock() {
+		bit = goal - balloc.first
+	}
+	blkn, err := balloc.alloc.FindAndMarkNear(opid, bit)
 	if err != 0 {
 		fmt.Printf("balloc1: %v\n", err)
 		return 0, err
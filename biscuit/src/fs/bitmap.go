@@ -23,6 +23,9 @@ type bitmapstats_t struct {
 	Nalloc stats.Counter_t
 	Nfree  stats.Counter_t
 	Nhit   stats.Counter_t
+	Ngoal  stats.Counter_t
+	Nnear  stats.Counter_t
+	Nrun   stats.Counter_t
 }
 
 type bitmap_t struct {
@@ -40,6 +43,17 @@ type bitmap_t struct {
 
 const NFREE = 1000
 
+const (
+	// the number of bits after a goal that FindDiskMap searches for a free
+	// bit when the goal is taken
+	nearwin = 256
+	// the number of free bits that FindDiskMap looks for when it starts a
+	// new run of bits, such as the first blocks of a file, so that the run
+	// can grow contiguously, and how far it searches for them
+	runlen = 16
+	runwin = bitsperblk
+)
+
 func mkAllocater(fs *Fs_t, start, len int, s storage_i) *bitmap_t {
 	a := &bitmap_t{}
 	a.fs = fs
@@ -129,22 +143,52 @@ func (alloc *bitmap_t) apply(start int, f func(b, v int) bool) bool {
 
 func (alloc *bitmap_t) CheckAndMark(opid opid_t) (int, defs.Err_t) {
 	bitno := alloc.lastbit
-	blkno := blkno(alloc.lastbit)
-	byte := byteno(alloc.lastbit)
-	bit := byteoffset(alloc.lastbit)
+	if alloc._trymark(opid, bitno) {
+		alloc.lastbit++
+		return bitno, 0
+	}
+	return 0, -defs.ENOMEM
+}
+
+// marks bit if it is free. returns true if it was.
+func (alloc *bitmap_t) _trymark(opid opid_t, bitno int) bool {
+	byte := byteno(bitno)
+	bit := byteoffset(bitno)
 
-	blk := alloc.Fbread(blkno)
+	blk := alloc.Fbread(blkno(bitno))
 	if blk.Data[byte]&(1<<uint(bit)) == 0 {
-		alloc.lastbit++
 		blk.Data[byte] |= (1 << uint(bit))
 		blk.Unlock()
 		alloc.storage.Write(opid, blk)
 		alloc.storage.Relse(blk, "CheckAndMark")
-		return bitno, 0
+		return true
 	}
 	blk.Unlock()
 	alloc.storage.Relse(blk, "alloc CheckAndMark")
-	return 0, -defs.ENOMEM
+	return false
+}
+
+// returns the first bit of the first run of n free bits that starts in
+// [start, end), or -1 if there is none
+func (alloc *bitmap_t) _findfree(start, end, n int) int {
+	ret := -1
+	run := 0
+	alloc.apply(start, func(b, v int) bool {
+		if run == 0 && b >= end {
+			return false
+		}
+		if v != 0 {
+			run = 0
+			return true
+		}
+		run++
+		if run == n {
+			ret = b - n + 1
+			return false
+		}
+		return true
+	})
+	return ret
 }
 
 func (alloc *bitmap_t) populateFreeMap() {
@@ -159,9 +203,26 @@ func (alloc *bitmap_t) populateFreeMap() {
 	//fmt.Printf("freemap %d\n", len(alloc.freemap))
 }
 
-func (alloc *bitmap_t) FindFreeMap(opid opid_t) (int, defs.Err_t) {
+// returns true if goal is a valid bit, in which case FindFreeMap and
+// FindDiskMap try to allocate it before any other bit.
+func (alloc *bitmap_t) _goalok(goal int) bool {
+	return goal >= 0 && goal < alloc.freelen*bitsperblk
+}
+
+func (alloc *bitmap_t) FindFreeMap(opid opid_t, goal int) (int, defs.Err_t) {
 	alloc.Lock()
 
+	if alloc._goalok(goal) {
+		i := goal / 8
+		j := goal % 8
+		if alloc.freemap[i]&(1<<uint(j)) == 0 {
+			alloc.freemap[i] |= 1 << uint(j)
+			alloc.nfreebits--
+			alloc.stats.Ngoal.Inc()
+			alloc.Unlock()
+			return goal, 0
+		}
+	}
 	once := false
 	for i := alloc.last; true; {
 		if alloc.freemap[i] != uint8(0xFF) {
@@ -191,23 +252,70 @@ func (alloc *bitmap_t) FindFreeMap(opid opid_t) (int, defs.Err_t) {
 	return 0, -defs.ENOMEM
 }
 
-func (alloc *bitmap_t) FindDiskMap(opid opid_t) (int, defs.Err_t) {
+// allocates goal, or else a free bit shortly after it, without moving lastbit,
+// which is shared by all allocations. returns -1 if neither is free.
+func (alloc *bitmap_t) _findgoal(opid opid_t, goal int) int {
+	if !alloc._goalok(goal) {
+		return -1
+	}
+	if alloc._trymark(opid, goal) {
+		alloc.stats.Ngoal.Inc()
+		return goal
+	}
+	if b := alloc._findfree(goal+1, goal+1+nearwin, 1); b != -1 {
+		if !alloc._trymark(opid, b) {
+			panic("free bit is marked")
+		}
+		alloc.stats.Nnear.Inc()
+		return b
+	}
+	return -1
+}
+
+// allocates the first bit of a run of runlen free bits after lastbit and moves
+// lastbit past the run, so that the goals of later allocations can extend the
+// run without other runs starting inside it. returns -1 if there is no such
+// run nearby.
+func (alloc *bitmap_t) _findrun(opid opid_t) int {
+	b := alloc._findfree(alloc.lastbit, alloc.lastbit+runwin, runlen)
+	if b == -1 {
+		return -1
+	}
+	if !alloc._trymark(opid, b) {
+		panic("free bit is marked")
+	}
+	alloc.lastbit = b + runlen
+	if alloc.lastbit >= alloc.freelen*bitsperblk {
+		alloc.lastbit = 0
+	}
+	alloc.stats.Nrun.Inc()
+	return b
+}
+
+func (alloc *bitmap_t) FindDiskMap(opid opid_t, goal int) (int, defs.Err_t) {
 	alloc.Lock()
 
-	bit, err := alloc.CheckAndMark(opid)
-	if err == 0 {
-		alloc.stats.Nhit.Inc()
-	} else {
-		alloc.apply(0, func(b, v int) bool {
-			if v == 0 {
-				alloc.lastbit = b
-				return false
-			}
-			return true
-		})
+	bit := alloc._findgoal(opid, goal)
+	if bit == -1 {
+		bit = alloc._findrun(opid)
+	}
+	if bit == -1 {
+		var err defs.Err_t
 		bit, err = alloc.CheckAndMark(opid)
-		if err != 0 {
-			panic("FindAndMark")
+		if err == 0 {
+			alloc.stats.Nhit.Inc()
+		} else {
+			alloc.apply(0, func(b, v int) bool {
+				if v == 0 {
+					alloc.lastbit = b
+					return false
+				}
+				return true
+			})
+			bit, err = alloc.CheckAndMark(opid)
+			if err != 0 {
+				panic("FindAndMark")
+			}
 		}
 	}
 	alloc.stats.Nalloc.Inc()
@@ -217,10 +325,16 @@ func (alloc *bitmap_t) FindDiskMap(opid opid_t) (int, defs.Err_t) {
 }
 
 func (alloc *bitmap_t) FindAndMark(opid opid_t) (int, defs.Err_t) {
+	return alloc.FindAndMarkNear(opid, -1)
+}
+
+// like FindAndMark, but allocates bit goal if it is free. a negative goal means
+// no preference.
+func (alloc *bitmap_t) FindAndMarkNear(opid opid_t, goal int) (int, defs.Err_t) {
 	if alloc.fs.diskfs {
-		return alloc.FindDiskMap(opid)
+		return alloc.FindDiskMap(opid, goal)
 	} else {
-		return alloc.FindFreeMap(opid)
+		return alloc.FindFreeMap(opid, goal)
 	}
 }
 
@@ -48,6 +48,9 @@ const (
 	BDEV_WRITE Bdevcmd_t = 1
 	BDEV_READ            = 2
 	BDEV_FLUSH           = 3
+	// a write that is durable once it completes, though the writes
+	// before it may not be
+	BDEV_WRITE_FUA = 4
 )
 
 // A wrapper around List for blocks
@@ -164,6 +167,11 @@ type Disk_i interface {
 	Stats() string
 }
 
+// a disk whose size is known
+type Disksize_i interface {
+	Nblocks() int
+}
+
 func (blk *Bdev_block_t) Key() int {
 	return blk.Block
 }
@@ -209,6 +217,19 @@ func (b *Bdev_block_t) Write() {
 	}
 }
 
+// returns once b is durable
+func (b *Bdev_block_t) Write_fua() {
+	if bdev_debug {
+		fmt.Printf("bdev_write_fua %v %v\n", b.Block, b.Name)
+	}
+	l := MkBlkList()
+	l.PushBack(b)
+	req := MkRequest(l, BDEV_WRITE_FUA, true)
+	if b.Disk.Start(req) {
+		<-req.AckCh
+	}
+}
+
 func (b *Bdev_block_t) Write_async() {
 	if bdev_debug {
 		fmt.Printf("bdev_write_async %v %s\n", b.Block, b.Name)
@@ -205,11 +205,13 @@ func (idm *imemnode_t) _deinsert(opid opid_t, name ustr.Ustr, inum defs.Inum_t)
 	b.Unlock()
 	idm.fs.fslog.Write(opid, b)
 	idm.fs.fslog.Relse(b, "_deinsert")
+	idm._logged(false)
 
 	icd := &icdent_t{offset: noff, inum: inum, name: name}
 	ok := idm._dceadd(name, icd)
 	dc := &idm.dentc
 	dc.haveall = dc.haveall && ok
+	idm._mtouch()
 	return 0
 }
 
@@ -217,11 +219,18 @@ func (idm *imemnode_t) _deinsert(opid opid_t, name ustr.Ustr, inum defs.Inum_t)
 // or it has been called on all directory entries. _descan returns true if f
 // returned true.
 func (idm *imemnode_t) _descan(opid opid_t, f func(fn ustr.Ustr, de *icdent_t) bool) (bool, defs.Err_t) {
+	return idm._descanfrom(opid, 0, f)
+}
+
+// like _descan, but starts at the first directory entry whose offset is not
+// less than off.
+func (idm *imemnode_t) _descanfrom(opid opid_t, off int, f func(fn ustr.Ustr, de *icdent_t) bool) (bool, defs.Err_t) {
 	if !idm._amlocked {
 		panic("lsjdf")
 	}
 	found := false
-	for i := 0; i < idm.size; i += BSIZE {
+	start := off % BSIZE
+	for i := off - start; i < idm.size && !found; i += BSIZE {
 		if !res.Resadd_noblock(bounds.Bounds(bounds.B_IMEMNODE_T__DESCAN)) {
 			return false, -defs.ENOHEAP
 		}
@@ -230,7 +239,7 @@ func (idm *imemnode_t) _descan(opid opid_t, f func(fn ustr.Ustr, de *icdent_t) b
 			return false, err
 		}
 		dd := Dirdata_t{b.Data[:]}
-		for j := 0; j < NDIRENTS; j++ {
+		for j := (start + NDBYTES - 1) / NDBYTES; j < NDIRENTS; j++ {
 			tfn := dd.Filename(j)
 			tpriv := dd.inodenext(j)
 			tde := &icdent_t{offset: i + j*NDBYTES, inum: tpriv, name: tfn}
@@ -239,6 +248,7 @@ func (idm *imemnode_t) _descan(opid opid_t, f func(fn ustr.Ustr, de *icdent_t) b
 				break
 			}
 		}
+		start = 0
 		b.Unlock()
 		idm.fs.fslog.Relse(b, "_descan")
 	}
@@ -312,9 +322,11 @@ func (idm *imemnode_t) _deremove(opid opid_t, fn ustr.Ustr) (*icdent_t, defs.Err
 		b.Unlock()
 		idm.fs.fslog.Write(opid, b)
 		idm.fs.fslog.Relse(b, "_deremove")
+		idm._logged(false)
 	}
 	idm._deremove_dent(de)
 	idm._deaddempty(de.offset)
+	idm._mtouch()
 	return de, 0
 }
 
@@ -552,3 +564,100 @@ func (idm *imemnode_t) idirempty(opid opid_t) (bool, defs.Err_t) {
 	}
 	return idm._deempty(opid)
 }
+
+// getdents records are laid out like Linux's linux_dirent64:
+// 0-7,   inode number
+// 8-15,  cookie of the next entry
+// 16-17, record length
+// 18,    type
+// 19-,   nul-terminated file name, padded to a multiple of 8 bytes
+const DIRENT_HDR = 19
+
+// returns the getdents records, at most max bytes, for the entries of directory
+// idm starting at the slot at offset off, and the cookie following the last
+// entry returned. returns EINVAL if the first record does not fit. the cookie
+// of an entry is the offset of the slot after it; since directory entries
+// never move, a cookie stays valid across concurrent inserts and unlinks.
+func (idm *imemnode_t) idents(opid opid_t, off, max int) ([]uint8, int, defs.Err_t) {
+	if idm.itype != I_DIR {
+		panic("i am not a dir")
+	}
+	var des []*icdent_t
+	used := 0
+	next := off
+	toosmall := false
+	_, err := idm._descanfrom(opid, off, func(fn ustr.Ustr, de *icdent_t) bool {
+		if len(fn) != 0 {
+			reclen := util.Roundup(DIRENT_HDR+len(fn)+1, 8)
+			if used+reclen > max {
+				toosmall = len(des) == 0
+				return true
+			}
+			used += reclen
+			des = append(des, de)
+		}
+		next = de.offset + NDBYTES
+		return false
+	})
+	if err != 0 {
+		return nil, 0, err
+	}
+	if toosmall {
+		return nil, 0, -defs.EINVAL
+	}
+	ret := make([]uint8, used)
+	rec := ret
+	for _, de := range des {
+		reclen := util.Roundup(DIRENT_HDR+len(de.name)+1, 8)
+		util.Writen(rec, 8, 0, int(de.inum))
+		util.Writen(rec, 8, 8, de.offset+NDBYTES)
+		util.Writen(rec, 2, 16, reclen)
+		rec[18] = idm._detype(de)
+		copy(rec[DIRENT_HDR:], de.name)
+		rec = rec[reclen:]
+	}
+	return ret, next, 0
+}
+
+// returns the getdents type of the inode referenced by directory entry de. the
+// type is read from the inode's block rather than through a reference, which
+// would load every inode of a listed directory into the inode cache; the type
+// never changes while the inode is linked. an in-memory file system has no
+// inode blocks, but all of its inodes are cached.
+func (idm *imemnode_t) _detype(de *icdent_t) uint8 {
+	if de.name.Isdot() || de.name.Isdotdot() {
+		return defs.DT_DIR
+	}
+	var itype, major int
+	if idm.fs.diskfs {
+		blk := idm.fs.fslog.Get_fill(idm.fs.ialloc.Iblock(de.inum),
+			"_detype", true)
+		ind := &Inode_t{blk, ioffset(de.inum)}
+		itype, major = ind.itype(), ind.major()
+		blk.Unlock()
+		idm.fs.fslog.Relse(blk, "_detype")
+	} else {
+		child := idm.fs.icache.Iref(de.inum, "_detype")
+		itype, major = child.itype, child.major
+		if child.Refdown("_detype") {
+			panic("linked inode freed")
+		}
+	}
+	var ret uint8
+	switch itype {
+	case I_FILE:
+		ret = defs.DT_REG
+	case I_DIR:
+		ret = defs.DT_DIR
+	case I_SYMLINK:
+		ret = defs.DT_LNK
+	case I_DEV:
+		ret = defs.DT_CHR
+		if major == defs.D_SUD || major == defs.D_SUS {
+			ret = defs.DT_SOCK
+		}
+	default:
+		ret = defs.DT_UNKNOWN
+	}
+	return ret
+}
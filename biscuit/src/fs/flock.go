@@ -0,0 +1,279 @@
+package fs
+
+import "math"
+import "sync"
+import "sync/atomic"
+
+import "defs"
+import "fdops"
+import "proc"
+
+// advisory locks. a flock(2) lock covers the whole file and is owned by an
+// open file (an fsfops_t), which shares it with the fds dup'ed or inherited
+// from it; it is released when the last of those fds is closed. a record lock
+// of fcntl(2) covers a range of bytes and is owned by a process; like POSIX,
+// the process releases its record locks on a file when it closes any of its
+// fds for the file, and thus when it exits, and a forked child does not
+// inherit them. the two kinds of locks do not conflict with each other.
+//
+// the locks of a file are kept in its imemnode_t, which stays in the icache
+// while the file is open.
+
+// a lock held on a file, or a request for one
+type flock_t struct {
+	// the owner: the open file of a flock lock, or the pid of the process
+	// that holds a record lock
+	fo   *fsfops_t
+	pid  int
+	excl bool
+	// the locked range [start, end)
+	start int
+	end   int
+}
+
+func (l *flock_t) sameowner(o *flock_t) bool {
+	return l.fo == o.fo && l.pid == o.pid
+}
+
+func (l *flock_t) conflicts(o *flock_t) bool {
+	if (l.fo == nil) != (o.fo == nil) || l.sameowner(o) {
+		return false
+	}
+	if !l.excl && !o.excl {
+		return false
+	}
+	return l.start < o.end && o.start < l.end
+}
+
+// all lock state is protected by one mutex since locks are rare. a process
+// that waits for a lock sleeps on the cond of the file.
+var _locks = struct {
+	sync.Mutex
+	// the record lock requests that are waiting, and the pid of the owner
+	// of a conflicting lock that each waits for
+	waiters map[*flock_t]int
+	// the number of record locks held, so that closing a file needn't
+	// look for record locks when there are none
+	nrec int64
+}{waiters: make(map[*flock_t]int)}
+
+// returns true if a process waiting for a record lock held by owner would
+// wait for itself: owner, or a process that owner waits for, and so on, is
+// pid. the caller must hold _locks.
+func _lkdeadlock(pid, owner int, seen map[int]bool) bool {
+	if owner == pid {
+		return true
+	}
+	if seen[owner] {
+		return false
+	}
+	seen[owner] = true
+	for w, next := range _locks.waiters {
+		if w.pid == owner && _lkdeadlock(pid, next, seen) {
+			return true
+		}
+	}
+	return false
+}
+
+// returns a lock that conflicts with want. the caller must hold _locks.
+func (idm *imemnode_t) _lkconflict(want *flock_t) *flock_t {
+	for _, l := range idm.locks {
+		if l.conflicts(want) {
+			return l
+		}
+	}
+	return nil
+}
+
+// releases the range [start, end) of the locks held by the owner of o,
+// splitting the locks that extend past it, and wakes up the waiters. the
+// caller must hold _locks.
+func (idm *imemnode_t) _lkremove(o *flock_t, start, end int) {
+	var nlocks []*flock_t
+	did := false
+	for _, l := range idm.locks {
+		if !l.sameowner(o) || l.end <= start || end <= l.start {
+			nlocks = append(nlocks, l)
+			continue
+		}
+		did = true
+		if l.start < start {
+			left := *l
+			left.end = start
+			nlocks = append(nlocks, &left)
+		}
+		if end < l.end {
+			right := *l
+			right.start = end
+			nlocks = append(nlocks, &right)
+		}
+	}
+	if o.fo == nil {
+		atomic.AddInt64(&_locks.nrec, int64(len(nlocks)-len(idm.locks)))
+	}
+	idm.locks = nlocks
+	if did && idm.lkcond != nil {
+		idm.lkcond.Broadcast()
+	}
+}
+
+// acquires want, replacing the locks its owner holds on its range. if a lock
+// of another owner conflicts, waits for it to be released if wait is true, and
+// otherwise fails with EAGAIN.
+func (idm *imemnode_t) lkacquire(want *flock_t, wait bool) defs.Err_t {
+	_locks.Lock()
+	defer _locks.Unlock()
+
+	// like Linux, converting a flock lock releases the old lock first, so
+	// that two processes upgrading shared locks don't deadlock. a record
+	// lock isn't changed unless the new one can be acquired.
+	if want.fo != nil {
+		idm._lkremove(want, 0, math.MaxInt64)
+	}
+	for {
+		c := idm._lkconflict(want)
+		if c == nil {
+			break
+		}
+		if !wait {
+			return -defs.EAGAIN
+		}
+		if want.fo == nil {
+			if _lkdeadlock(want.pid, c.pid, make(map[int]bool)) {
+				return -defs.EDEADLK
+			}
+			_locks.waiters[want] = c.pid
+		}
+		if idm.lkcond == nil {
+			idm.lkcond = sync.NewCond(&_locks.Mutex)
+		}
+		err := proc.KillableWait(idm.lkcond)
+		delete(_locks.waiters, want)
+		if err != 0 {
+			return err
+		}
+	}
+	idm._lkremove(want, want.start, want.end)
+	idm.locks = append(idm.locks, want)
+	if want.fo == nil {
+		atomic.AddInt64(&_locks.nrec, 1)
+	}
+	return 0
+}
+
+// releases the range [start, end) of the locks of o's owner
+func (idm *imemnode_t) lkrelease(o *flock_t, start, end int) {
+	_locks.Lock()
+	idm._lkremove(o, start, end)
+	_locks.Unlock()
+}
+
+// returns a copy of a lock that conflicts with want, or nil
+func (idm *imemnode_t) lktest(want *flock_t) *flock_t {
+	_locks.Lock()
+	defer _locks.Unlock()
+	c := idm._lkconflict(want)
+	if c == nil {
+		return nil
+	}
+	ret := *c
+	return &ret
+}
+
+// returns the inode of the open file; the caller must Refdown it
+func (fo *fsfops_t) _lkinode() (*imemnode_t, defs.Err_t) {
+	fo.Lock()
+	defer fo.Unlock()
+	if fo.count <= 0 {
+		return nil, -defs.EBADF
+	}
+	return fo.fs.icache.Iref(fo.priv, "lock"), 0
+}
+
+func (fo *fsfops_t) Flock(how int) defs.Err_t {
+	idm, err := fo._lkinode()
+	if err != 0 {
+		return err
+	}
+	defer idm.Refdown("flock")
+
+	want := &flock_t{fo: fo, start: 0, end: math.MaxInt64}
+	switch how &^ defs.LOCK_NB {
+	case defs.LOCK_SH:
+	case defs.LOCK_EX:
+		want.excl = true
+	case defs.LOCK_UN:
+		idm.lkrelease(want, 0, math.MaxInt64)
+		return 0
+	default:
+		return -defs.EINVAL
+	}
+	err = idm.lkacquire(want, how&defs.LOCK_NB == 0)
+	if err == 0 {
+		fo.Lock()
+		fo.flocked = true
+		fo.Unlock()
+	}
+	return err
+}
+
+func (fo *fsfops_t) Reclock(pid, cmd int, fl *fdops.Flock_t) defs.Err_t {
+	if fl.Start < 0 || fl.Len < 0 {
+		return -defs.EINVAL
+	}
+	idm, err := fo._lkinode()
+	if err != 0 {
+		return err
+	}
+	defer idm.Refdown("reclock")
+
+	want := &flock_t{pid: pid, excl: fl.Type == defs.F_WRLCK,
+		start: fl.Start, end: fl.Start + fl.Len}
+	if fl.Len == 0 {
+		want.end = math.MaxInt64
+	}
+	switch {
+	case cmd == defs.F_GETLK:
+		c := idm.lktest(want)
+		if c == nil {
+			fl.Type = defs.F_UNLCK
+			return 0
+		}
+		fl.Type = defs.F_RDLCK
+		if c.excl {
+			fl.Type = defs.F_WRLCK
+		}
+		fl.Start = c.start
+		fl.Len = c.end - c.start
+		if c.end == math.MaxInt64 {
+			fl.Len = 0
+		}
+		fl.Pid = c.pid
+		return 0
+	case fl.Type == defs.F_UNLCK:
+		idm.lkrelease(want, want.start, want.end)
+		return 0
+	default:
+		return idm.lkacquire(want, cmd == defs.F_SETLKW)
+	}
+}
+
+func (fo *fsfops_t) Unlockall(pid int) {
+	if atomic.LoadInt64(&_locks.nrec) == 0 {
+		return
+	}
+	idm, err := fo._lkinode()
+	if err != 0 {
+		return
+	}
+	idm.lkrelease(&flock_t{pid: pid}, 0, math.MaxInt64)
+	idm.Refdown("unlockall")
+}
+
+// releases the flock lock of fo, whose last fd was closed
+func (fo *fsfops_t) _flockclose() {
+	idm := fo.fs.icache.Iref(fo.priv, "flockclose")
+	idm.lkrelease(&flock_t{fo: fo}, 0, math.MaxInt64)
+	idm.Refdown("flockclose")
+}
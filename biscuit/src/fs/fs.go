@@ -2,9 +2,11 @@ package fs
 
 import "fmt"
 import "sync"
+import "sync/atomic"
 
 import "bounds"
 import "bpath"
+import "cred"
 import "defs"
 import "fd"
 import "fdops"
@@ -14,6 +16,7 @@ import "proc"
 import "res"
 import "stat"
 import "stats"
+import "tty"
 import "ustr"
 import "util"
 
@@ -35,6 +38,19 @@ type Fs_t struct {
 	istats       *inode_stats_t
 	root         *imemnode_t
 	diskfs       bool // disk or in-mem file system?
+	// the device number reported by stat
+	dev uint
+	// the number of open files, which keeps the file system from being
+	// unmounted
+	nopen int64
+}
+
+// the device number of the next file system
+var _nextdev uint32
+
+// returns an unused device number for a file system
+func Newdev() uint {
+	return uint(atomic.AddUint32(&_nextdev, 1) - 1)
 }
 
 func StartFS(mem Blockmem_i, disk Disk_i, console proc.Cons_i, diskfs bool) (*fd.Fd_t, *Fs_t) {
@@ -47,7 +63,23 @@ func StartFS(mem Blockmem_i, disk Disk_i, console proc.Cons_i, diskfs bool) (*fd
 	// reset taken
 	limits.Syslimit = limits.MkSysLimit()
 
+	fs, err := AttachFS(mem, disk, diskfs)
+	if err != 0 {
+		panic("bad superblock start")
+	}
+	return &fd.Fd_t{Fops: &fsfops_t{priv: iroot, fs: fs, count: 1}}, fs
+}
+
+// starts the file system on disk without touching the kernel's global state,
+// so that several file systems may run at once. fails if disk doesn't hold a
+// file system.
+func AttachFS(mem Blockmem_i, disk Disk_i, diskfs bool) (*Fs_t, defs.Err_t) {
+	if mem == nil || disk == nil {
+		panic("nil arg")
+	}
+
 	fs := &Fs_t{}
+	fs.dev = Newdev()
 	fs.diskfs = diskfs
 	fs.ahci = disk
 	fs.istats = &inode_stats_t{}
@@ -59,18 +91,26 @@ func StartFS(mem Blockmem_i, disk Disk_i, console proc.Cons_i, diskfs bool) (*fd
 
 	// find the first fs block; the build system installs it in block 0 for
 	// us
+	nblks := 0
+	if ds, ok := disk.(Disksize_i); ok {
+		nblks = ds.Nblocks()
+	}
 	b := fs.bcache.Get_fill(0, "fsoff", false)
 	fs.superb_start = util.Readn(b.Data[:], 4, FSOFF)
 	//fmt.Printf("fs.superb_start %v\n", fs.superb_start)
-	if fs.superb_start <= 0 {
-		panic("bad superblock start")
-	}
 	fs.bcache.Relse(b, "fs_init")
+	if fs.superb_start <= 0 || (nblks != 0 && fs.superb_start >= nblks) {
+		return nil, -defs.EINVAL
+	}
 
 	// superblock is never changed, so reading before recovery is fine
 	b = fs.bcache.Get_fill(fs.superb_start, "super", false) // don't relse b, because superb is global
 
 	fs.superb = Superblock_t{b.Data}
+	if !fs.superb.Valid(fs.superb_start, nblks) {
+		fs.bcache.Relse(b, "fs_init")
+		return nil, -defs.EINVAL
+	}
 
 	logstart := fs.superb_start + 1
 	loglen := fs.superb.Loglen()
@@ -85,9 +125,6 @@ func StartFS(mem Blockmem_i, disk Disk_i, console proc.Cons_i, diskfs bool) (*fd
 	imaplen := fs.superb.Imaplen()
 	//fmt.Printf("orphanstart %v orphan len %v\n", iorphanstart, iorphanlen)
 	//fmt.Printf("imapstart %v imaplen %v\n", imapstart, imaplen)
-	if iorphanlen != imaplen {
-		panic("number of iorphan map blocks != inode map block")
-	}
 
 	bmapstart := fs.superb.Freeblock()
 	bmaplen := fs.superb.Freeblocklen()
@@ -106,7 +143,7 @@ func StartFS(mem Blockmem_i, disk Disk_i, console proc.Cons_i, diskfs bool) (*fd
 
 	fs.root = fs.icache.Iref(iroot, "fs_namei_root")
 
-	return &fd.Fd_t{Fops: &fsfops_t{priv: iroot, fs: fs, count: 1}}, fs
+	return fs, 0
 }
 
 func (fs *Fs_t) Sizes() (int, int) {
@@ -117,10 +154,30 @@ func (fs *Fs_t) StopFS() {
 	fs.fslog.StopLog()
 }
 
+// returns true if any file of the file system is open
+func (fs *Fs_t) Fs_busy() bool {
+	return atomic.LoadInt64(&fs.nopen) != 0
+}
+
 func (fs *Fs_t) Fs_size() (uint, uint) {
 	return fs.ialloc.alloc.nfreebits, fs.balloc.alloc.nfreebits
 }
 
+// returns the number of transactions that recovery discarded because their
+// checksum didn't match
+func (fs *Fs_t) Fs_nbadcksum() int {
+	return int(fs.fslog.stats.Nbadcksum)
+}
+
+// returns the number of fsync and fdatasync calls, and the number of those
+// that didn't have to force a commit
+func (fs *Fs_t) Fs_nfsync() (int, int) {
+	fs.fslog.Lock()
+	defer fs.fslog.Unlock()
+	st := &fs.fslog.stats
+	return int(st.Nfsync), int(st.Nfsyncclean + st.Nfsynctimes)
+}
+
 func (fs *Fs_t) IrefRoot() *imemnode_t {
 	r := fs.root
 	r.Refup("IrefRoot")
@@ -137,7 +194,7 @@ func (fs *Fs_t) Unpin(pa mem.Pa_t) {
 	fs.bcache.unpin(pa)
 }
 
-func (fs *Fs_t) Fs_op_link(old ustr.Ustr, new ustr.Ustr, cwd *fd.Cwd_t) ([]*imemnode_t, defs.Err_t) {
+func (fs *Fs_t) Fs_op_link(old ustr.Ustr, new ustr.Ustr, cwd *fd.Cwd_t, cr *cred.Cred_t) ([]*imemnode_t, defs.Err_t) {
 	opid := fs.fslog.Op_begin("Fs_link")
 	defer fs.fslog.Op_end(opid)
 
@@ -148,14 +205,14 @@ func (fs *Fs_t) Fs_op_link(old ustr.Ustr, new ustr.Ustr, cwd *fd.Cwd_t) ([]*imem
 	fs.istats.Nilink.Inc()
 
 	var deads []*imemnode_t
-	orig, dead, err := fs.fs_namei_locked(opid, old, cwd, "Fs_link_org")
+	orig, dead, err := fs.fs_lnamei_locked(opid, old, cwd, cr, "Fs_link_org")
 	if err != 0 {
 		if dead != nil {
 			deads = append(deads, dead)
 		}
 		return deads, err
 	}
-	if orig.itype != I_FILE {
+	if orig.itype != I_FILE && orig.itype != I_SYMLINK {
 		if orig.iunlock_refdown("fs_link") {
 			deads = append(deads, dead)
 		}
@@ -166,13 +223,18 @@ func (fs *Fs_t) Fs_op_link(old ustr.Ustr, new ustr.Ustr, cwd *fd.Cwd_t) ([]*imem
 	orig.iunlock("fs_link_orig")
 
 	dirs, fn := bpath.Sdirname(new)
-	newd, dead, err := fs.fs_namei_locked(opid, dirs, cwd, "fs_link_newd")
+	newd, dead, err := fs.fs_namei_locked(opid, dirs, cwd, cr, "fs_link_newd")
 	if err != 0 {
 		if dead != nil {
 			deads = append(deads, dead)
 		}
 		goto undo
 	}
+	if !newd._maydirw(cr) {
+		newd.iunlock_refdown("fs_link_newd")
+		err = -defs.EACCES
+		goto undo
+	}
 	err = newd.do_insert(opid, fn, inum)
 	newd.iunlock_refdown("fs_link_newd")
 	if err != 0 {
@@ -191,15 +253,15 @@ undo:
 	return deads, err
 }
 
-func (fs *Fs_t) Fs_link(old ustr.Ustr, new ustr.Ustr, cwd *fd.Cwd_t) defs.Err_t {
-	deads, err := fs.Fs_op_link(old, new, cwd)
+func (fs *Fs_t) Fs_link(old ustr.Ustr, new ustr.Ustr, cwd *fd.Cwd_t, cr *cred.Cred_t) defs.Err_t {
+	deads, err := fs.Fs_op_link(old, new, cwd, cr)
 	for _, dead := range deads {
 		dead.Free()
 	}
 	return err
 }
 
-func (fs *Fs_t) Fs_op_unlink(paths ustr.Ustr, cwd *fd.Cwd_t, wantdir bool) (*imemnode_t, defs.Err_t) {
+func (fs *Fs_t) Fs_op_unlink(paths ustr.Ustr, cwd *fd.Cwd_t, cr *cred.Cred_t, wantdir bool) (*imemnode_t, defs.Err_t) {
 	opid := fs.fslog.Op_begin("fs_unlink")
 	defer fs.fslog.Op_end(opid)
 
@@ -218,10 +280,14 @@ func (fs *Fs_t) Fs_op_unlink(paths ustr.Ustr, cwd *fd.Cwd_t, wantdir bool) (*ime
 	var par *imemnode_t
 	var err defs.Err_t
 
-	par, dead, err := fs.fs_namei_locked(opid, dirs, cwd, "fs_unlink_par")
+	par, dead, err := fs.fs_namei_locked(opid, dirs, cwd, cr, "fs_unlink_par")
 	if err != 0 {
 		return dead, err
 	}
+	if !par._maydirw(cr) {
+		par.iunlock_refdown("fs_unlink_par")
+		return nil, -defs.EACCES
+	}
 	child, err = par.ilookup(opid, fn)
 	if err != 0 {
 		par.iunlock_refdown("fs_unlink_par")
@@ -252,6 +318,14 @@ func (fs *Fs_t) Fs_op_unlink(paths ustr.Ustr, cwd *fd.Cwd_t, wantdir bool) (*ime
 
 	}
 
+	if !par._mayremove(cr, child) {
+		del := child.iunlock_refdown("fs_unlink_child")
+		if del {
+			dead = child
+		}
+		return dead, -defs.EPERM
+	}
+
 	err = child.do_dirchk(opid, wantdir)
 	if err != 0 {
 		del := child.iunlock_refdown("fs_unlink_child")
@@ -279,8 +353,8 @@ func (fs *Fs_t) Fs_op_unlink(paths ustr.Ustr, cwd *fd.Cwd_t, wantdir bool) (*ime
 	return dead, 0
 }
 
-func (fs *Fs_t) Fs_unlink(paths ustr.Ustr, cwd *fd.Cwd_t, wantdir bool) defs.Err_t {
-	dead, err := fs.Fs_op_unlink(paths, cwd, wantdir)
+func (fs *Fs_t) Fs_unlink(paths ustr.Ustr, cwd *fd.Cwd_t, cr *cred.Cred_t, wantdir bool) defs.Err_t {
+	dead, err := fs.Fs_op_unlink(paths, cwd, cr, wantdir)
 	if dead != nil {
 		dead.Free()
 	}
@@ -292,7 +366,7 @@ var _renamelock = sync.Mutex{}
 
 // first return value is inodes to refdown, second return is inode which needs
 // to be freed...
-func (fs *Fs_t) Fs_op_rename(oldp, newp ustr.Ustr, cwd *fd.Cwd_t) ([]*imemnode_t, *imemnode_t, defs.Err_t) {
+func (fs *Fs_t) Fs_op_rename(oldp, newp ustr.Ustr, cwd *fd.Cwd_t, cr *cred.Cred_t) ([]*imemnode_t, *imemnode_t, defs.Err_t) {
 	odirs, ofn := bpath.Sdirname(oldp)
 	ndirs, nfn := bpath.Sdirname(newp)
 	var refs []*imemnode_t
@@ -316,10 +390,14 @@ func (fs *Fs_t) Fs_op_rename(oldp, newp ustr.Ustr, cwd *fd.Cwd_t) ([]*imemnode_t
 	// lookup all inode references, but we will release locks and lock them
 	// together when we know all references.  the references to the inodes
 	// cannot disppear, so unlocking temporarily is fine.
-	opar, dead, err := fs.fs_namei_locked(opid, odirs, cwd, "fs_rename_opar")
+	opar, dead, err := fs.fs_namei_locked(opid, odirs, cwd, cr, "fs_rename_opar")
 	if err != 0 {
 		return refs, dead, err
 	}
+	if !opar._maydirw(cr) {
+		opar.iunlock("fs_rename_opar")
+		return []*imemnode_t{opar}, nil, -defs.EACCES
+	}
 
 	ochild, err := opar.ilookup(opid, ofn)
 	if err != 0 {
@@ -330,10 +408,14 @@ func (fs *Fs_t) Fs_op_rename(oldp, newp ustr.Ustr, cwd *fd.Cwd_t) ([]*imemnode_t
 	// unlock par after we have ref to child
 	opar.iunlock("fs_rename_par")
 
-	npar, dead, err := fs.fs_namei_locked(opid, ndirs, cwd, "")
+	npar, dead, err := fs.fs_namei_locked(opid, ndirs, cwd, cr, "")
 	if err != 0 {
 		return []*imemnode_t{opar, ochild}, dead, err
 	}
+	if !npar._maydirw(cr) {
+		npar.iunlock("")
+		return []*imemnode_t{opar, ochild, npar}, nil, -defs.EACCES
+	}
 
 	// prevent orphaned loops due to concurrent renames by serializing on
 	// this lock; only renames of directories need to be serialized.
@@ -442,6 +524,16 @@ func (fs *Fs_t) Fs_op_rename(oldp, newp ustr.Ustr, cwd *fd.Cwd_t) ([]*imemnode_t
 		return refs, nil, 0
 	}
 
+	if !opar._mayremove(cr, ochild) ||
+		(nchild != nil && !npar._mayremove(cr, nchild)) {
+		return refs, nil, -defs.EPERM
+	}
+	// moving a directory to a new parent rewrites its ".."
+	if ochild.itype == I_DIR && opar != npar &&
+		!ochild._permits(cr, cred.MAY_WRITE) {
+		return refs, nil, -defs.EACCES
+	}
+
 	// guarantee that any page allocations will succeed before starting the
 	// operation, which will be messy to piece-wise undo.
 	b1, err := npar.probe_insert(opid)
@@ -498,11 +590,13 @@ func (fs *Fs_t) Fs_op_rename(oldp, newp ustr.Ustr, cwd *fd.Cwd_t) ([]*imemnode_t
 			panic("insert after unlink must succeed")
 		}
 	}
+	ochild.ctime = fstime()
+	ochild._iupdate(opid)
 	return refs, nil, 0
 }
 
-func (fs *Fs_t) Fs_rename(oldp, newp ustr.Ustr, cwd *fd.Cwd_t) defs.Err_t {
-	refs, dead, err := fs.Fs_op_rename(oldp, newp, cwd)
+func (fs *Fs_t) Fs_rename(oldp, newp ustr.Ustr, cwd *fd.Cwd_t, cr *cred.Cred_t) defs.Err_t {
+	refs, dead, err := fs.Fs_op_rename(oldp, newp, cwd, cr)
 	for _, r := range refs {
 		del := r.Refdown("Fs_rename")
 		if del {
@@ -583,6 +677,9 @@ type fsfops_t struct {
 	offset int
 	append bool
 	count  int
+	// true if fo has held a flock lock, which must be released when fo
+	// is closed
+	flocked bool
 	//hack	*imemnode_t
 }
 
@@ -606,15 +703,40 @@ func (fo *fsfops_t) _read(dst fdops.Userio_i, toff int) (int, defs.Err_t) {
 		offset = toff
 	}
 	idm := fo.fs.icache.Iref_locked(fo.priv, "_read")
+	if idm.itype == I_DIR {
+		// directories are read with getdents
+		idm.iunlock_refdown("_read")
+		fo.Unlock()
+		return 0, -defs.EISDIR
+	}
 	did, err := idm.do_read(dst, offset)
 	if !useoffset && err == 0 {
 		fo.offset += did
 	}
+	stale := err == 0 && idm._atime_stale(fstime())
 	idm.iunlock_refdown("_read")
+	if stale {
+		fo.fs._atime_update(fo.priv)
+	}
 	fo.Unlock()
 	return did, err
 }
 
+// writes the access time of an inode that was just read
+func (fs *Fs_t) _atime_update(priv defs.Inum_t) {
+	opid := fs.fslog.Op_begin("atime")
+	defer fs.fslog.Op_end(opid)
+
+	idm := fs.icache.Iref_locked(priv, "_atime_update")
+	// a concurrent reader may have updated it already
+	if now := fstime(); idm._atime_stale(now) {
+		fs.istats.Natime.Inc()
+		idm.atime = now
+		idm._iupdate(opid)
+	}
+	idm.iunlock_refdown("_atime_update")
+}
+
 func (fo *fsfops_t) Read(dst fdops.Userio_i) (int, defs.Err_t) {
 	return fo._read(dst, -1)
 }
@@ -623,6 +745,36 @@ func (fo *fsfops_t) Pread(dst fdops.Userio_i, offset int) (int, defs.Err_t) {
 	return fo._read(dst, offset)
 }
 
+// fills dst with directory entries starting at the file offset, which is the
+// cookie of the next entry, and advances the offset.
+func (fo *fsfops_t) Getdents(dst fdops.Userio_i) (int, defs.Err_t) {
+	fo.Lock()
+	defer fo.Unlock()
+	if fo.count <= 0 {
+		return 0, -defs.EBADF
+	}
+
+	idm := fo.fs.icache.Iref_locked(fo.priv, "getdents")
+	if idm.itype != I_DIR {
+		idm.iunlock_refdown("getdents")
+		return 0, -defs.ENOTDIR
+	}
+	recs, next, err := idm.idents(opid_t(0), fo.offset, dst.Remain())
+	did := 0
+	if err == 0 {
+		did, err = dst.Uiowrite(recs)
+	}
+	if err == 0 {
+		fo.offset = next
+	}
+	stale := err == 0 && idm._atime_stale(fstime())
+	idm.iunlock_refdown("getdents")
+	if stale {
+		fo.fs._atime_update(fo.priv)
+	}
+	return did, err
+}
+
 func (fo *fsfops_t) _write(src fdops.Userio_i, toff int) (int, defs.Err_t) {
 	// lock the file to prevent races on offset and closing
 	fo.Lock()
@@ -684,6 +836,64 @@ func (fo *fsfops_t) Pwrite(src fdops.Userio_i, offset int) (int, defs.Err_t) {
 	return fo._write(src, offset)
 }
 
+// commits the transactions that modified the file, ignoring those that only
+// changed its timestamps if datasync is true. unlike Fs_sync, does not force
+// the current transaction if the file is not part of it.
+func (fo *fsfops_t) Fsync(datasync bool) defs.Err_t {
+	fo.Lock()
+	if fo.count <= 0 {
+		fo.Unlock()
+		return -defs.EBADF
+	}
+	idm := fo.fs.icache.Iref_locked(fo.priv, "fsync")
+	tid, mtid := idm.synctid, idm.synctid
+	if datasync {
+		tid = idm.datasynctid
+	}
+	idm.iunlock_refdown("fsync")
+	fo.Unlock()
+
+	fo.fs.fslog.Force_trans(tid, mtid)
+	return 0
+}
+
+// writes back the pages of a shared mapping of the file that were modified
+// through it
+func (fo *fsfops_t) Syncpages(offs []int, wait bool) defs.Err_t {
+	fo.Lock()
+	if fo.count <= 0 {
+		fo.Unlock()
+		return -defs.EBADF
+	}
+	idm := fo.fs.icache.Iref(fo.priv, "syncpages")
+	fo.Unlock()
+	err := idm.do_syncpages(offs)
+	idm.Refdown("syncpages")
+	if err != 0 || !wait {
+		return err
+	}
+	return fo.Fsync(true)
+}
+
+func (fo *fsfops_t) Utimens(cr *cred.Cred_t, atime, mtime int) defs.Err_t {
+	fo.Lock()
+	defer fo.Unlock()
+	if fo.count <= 0 {
+		return -defs.EBADF
+	}
+
+	opid := fo.fs.fslog.Op_begin("utimens")
+	defer fo.fs.fslog.Op_end(opid)
+
+	idm := fo.fs.icache.Iref_locked(fo.priv, "utimens")
+	err := -defs.EPERM
+	if idm._mayutime(cr, atime, mtime) {
+		err = idm.do_utimes(opid, atime, mtime)
+	}
+	idm.iunlock_refdown("utimens")
+	return err
+}
+
 // caller holds fo lock
 func (fo *fsfops_t) fstat(st *stat.Stat_t) defs.Err_t {
 	if fs_debug {
@@ -716,7 +926,12 @@ func (fo *fsfops_t) Close() defs.Err_t {
 		fmt.Printf("Close: %d cnt %d\n", fo.priv, fo.count)
 
 	}
+	release := fo.count == 0 && fo.flocked
 	fo.Unlock()
+	if release {
+		fo._flockclose()
+	}
+	atomic.AddInt64(&fo.fs.nopen, -1)
 	return fo.fs.Fs_close(fo.priv)
 }
 
@@ -743,9 +958,15 @@ func (fo *fsfops_t) Reopen() defs.Err_t {
 	idm.iunlock_refdown("reopen")
 	fo.count++
 	fo.Unlock()
+	atomic.AddInt64(&fo.fs.nopen, 1)
 	return 0
 }
 
+// unpins a page of the file's block cache that was mapped shared
+func (fo *fsfops_t) Unpin(pa mem.Pa_t) {
+	fo.fs.Unpin(pa)
+}
+
 func (fo *fsfops_t) Lseek(off, whence int) (int, defs.Err_t) {
 	// prevent races on fo.offset
 	fo.Lock()
@@ -826,7 +1047,11 @@ func (fo *fsfops_t) Fcntl(cmd, opt int) int {
 	return int(-defs.ENOSYS)
 }
 
-func (fo *fsfops_t) Getsockopt(opt int, bufarg fdops.Userio_i,
+func (fo *fsfops_t) Ioctl(int, fdops.Userio_i) defs.Err_t {
+	return -defs.ENOTTY
+}
+
+func (fo *fsfops_t) Getsockopt(lev, opt int, bufarg fdops.Userio_i,
 	intarg int) (int, defs.Err_t) {
 	return 0, -defs.ENOTSOCK
 }
@@ -977,6 +1202,26 @@ func (df *Devfops_t) Truncate(newlen uint) defs.Err_t {
 	return -defs.EINVAL
 }
 
+func (df *Devfops_t) Utimens(*cred.Cred_t, int, int) defs.Err_t {
+	return -defs.EINVAL
+}
+
+func (df *Devfops_t) Fchmod(*cred.Cred_t, uint) defs.Err_t {
+	return -defs.EINVAL
+}
+
+func (df *Devfops_t) Fchown(*cred.Cred_t, int, int) defs.Err_t {
+	return -defs.EINVAL
+}
+
+func (df *Devfops_t) Getdents(fdops.Userio_i) (int, defs.Err_t) {
+	return 0, -defs.ENOTDIR
+}
+
+func (df *Devfops_t) Fsync(bool) defs.Err_t {
+	return -defs.EINVAL
+}
+
 func (df *Devfops_t) Pread(dst fdops.Userio_i, offset int) (int, defs.Err_t) {
 	df._sane()
 	return 0, -defs.ESPIPE
@@ -1062,7 +1307,16 @@ func (df *Devfops_t) Fcntl(cmd, opt int) int {
 	return int(-defs.ENOSYS)
 }
 
-func (df *Devfops_t) Getsockopt(opt int, bufarg fdops.Userio_i,
+// only the console, which is a terminal, handles requests
+func (df *Devfops_t) Ioctl(req int, arg fdops.Userio_i) defs.Err_t {
+	df._sane()
+	if df.Maj == defs.D_CONSOLE {
+		return cons.Cons_ioctl(req, arg)
+	}
+	return -defs.ENOTTY
+}
+
+func (df *Devfops_t) Getsockopt(lev, opt int, bufarg fdops.Userio_i,
 	intarg int) (int, defs.Err_t) {
 	return 0, -defs.ENOTSOCK
 }
@@ -1133,6 +1387,27 @@ func (raw *rawdfops_t) Truncate(newlen uint) defs.Err_t {
 	return -defs.EINVAL
 }
 
+func (raw *rawdfops_t) Utimens(*cred.Cred_t, int, int) defs.Err_t {
+	return -defs.EINVAL
+}
+
+func (raw *rawdfops_t) Fchmod(*cred.Cred_t, uint) defs.Err_t {
+	return -defs.EINVAL
+}
+
+func (raw *rawdfops_t) Fchown(*cred.Cred_t, int, int) defs.Err_t {
+	return -defs.EINVAL
+}
+
+func (raw *rawdfops_t) Getdents(fdops.Userio_i) (int, defs.Err_t) {
+	return 0, -defs.ENOTDIR
+}
+
+// raw writes are synchronous
+func (raw *rawdfops_t) Fsync(bool) defs.Err_t {
+	return 0
+}
+
 func (raw *rawdfops_t) Pread(dst fdops.Userio_i, offset int) (int, defs.Err_t) {
 	return 0, -defs.ESPIPE
 }
@@ -1217,7 +1492,32 @@ func (raw *rawdfops_t) Fcntl(cmd, opt int) int {
 	return int(-defs.ENOSYS)
 }
 
-func (raw *rawdfops_t) Getsockopt(opt int, bufarg fdops.Userio_i,
+// reports the size of the disk, in bytes for BLKGETSIZE64 and in 512-byte
+// sectors for BLKGETSIZE, and its sector size for BLKSSZGET
+func (raw *rawdfops_t) Ioctl(req int, arg fdops.Userio_i) defs.Err_t {
+	var b []uint8
+	switch req {
+	case defs.BLKGETSIZE, defs.BLKGETSIZE64:
+		ds, ok := raw.fs.ahci.(Disksize_i)
+		if !ok {
+			return -defs.ENOTTY
+		}
+		sz := ds.Nblocks() * BSIZE
+		if req == defs.BLKGETSIZE {
+			sz /= 512
+		}
+		b = make([]uint8, 8)
+		util.Writen(b, 8, 0, sz)
+	case defs.BLKSSZGET:
+		b = make([]uint8, 4)
+		util.Writen(b, 4, 0, 512)
+	default:
+		return -defs.ENOTTY
+	}
+	return fdops.Argout(arg, b)
+}
+
+func (raw *rawdfops_t) Getsockopt(lev, opt int, bufarg fdops.Userio_i,
 	intarg int) (int, defs.Err_t) {
 	return 0, -defs.ENOTSOCK
 }
@@ -1230,8 +1530,8 @@ func (raw *rawdfops_t) Shutdown(read, write bool) defs.Err_t {
 	return -defs.ENOTSOCK
 }
 
-func (fs *Fs_t) Fs_mkdir(paths ustr.Ustr, mode int, cwd *fd.Cwd_t) defs.Err_t {
-	refs, dead, err := fs.Fs_op_mkdir(paths, mode, cwd)
+func (fs *Fs_t) Fs_mkdir(paths ustr.Ustr, mode int, cwd *fd.Cwd_t, cr *cred.Cred_t) defs.Err_t {
+	refs, dead, err := fs.Fs_op_mkdir(paths, mode, cwd, cr)
 	for _, ref := range refs {
 		if ref.Refdown("") {
 			ref.Free()
@@ -1244,7 +1544,7 @@ func (fs *Fs_t) Fs_mkdir(paths ustr.Ustr, mode int, cwd *fd.Cwd_t) defs.Err_t {
 }
 
 // returns refs, dead, and error...
-func (fs *Fs_t) Fs_op_mkdir(paths ustr.Ustr, mode int, cwd *fd.Cwd_t) ([]*imemnode_t, *imemnode_t, defs.Err_t) {
+func (fs *Fs_t) Fs_op_mkdir(paths ustr.Ustr, mode int, cwd *fd.Cwd_t, cr *cred.Cred_t) ([]*imemnode_t, *imemnode_t, defs.Err_t) {
 	opid := fs.fslog.Op_begin("fs_mkdir")
 	defer fs.fslog.Op_end(opid)
 
@@ -1262,12 +1562,17 @@ func (fs *Fs_t) Fs_op_mkdir(paths ustr.Ustr, mode int, cwd *fd.Cwd_t) ([]*imemno
 		return nil, nil, -defs.ENAMETOOLONG
 	}
 
-	par, dead, err := fs.fs_namei_locked(opid, dirs, cwd, "mkdir")
+	par, dead, err := fs.fs_namei_locked(opid, dirs, cwd, cr, "mkdir")
 	if err != 0 {
 		return nil, dead, err
 	}
+	if !par._maydirw(cr) {
+		par.iunlock("fs_mkdir_par")
+		return []*imemnode_t{par}, nil, -defs.EACCES
+	}
 
-	child, err := par.do_createdir(opid, fn)
+	own := par._mkowner(cr, uint(mode)&^cwd.Umask(), true)
+	child, err := par.do_createdir(opid, fn, own)
 	if err != 0 {
 		par.iunlock("fs_mkdir_par")
 		return []*imemnode_t{par}, nil, err
@@ -1303,8 +1608,8 @@ type Fsfile_t struct {
 	Minor int
 }
 
-func (fs *Fs_t) Fs_open_inner(paths ustr.Ustr, flags defs.Fdopt_t, mode int, cwd *fd.Cwd_t, major, minor int) (Fsfile_t, defs.Err_t) {
-	ret, dead, err := fs._fs_open_inner(paths, flags, mode, cwd, major, minor)
+func (fs *Fs_t) Fs_open_inner(paths ustr.Ustr, flags defs.Fdopt_t, mode int, cwd *fd.Cwd_t, cr *cred.Cred_t, major, minor int) (Fsfile_t, defs.Err_t) {
+	ret, dead, err := fs._fs_open_inner(paths, flags, mode, cwd, cr, major, minor)
 	if dead != nil {
 		dead.Free()
 	}
@@ -1312,9 +1617,10 @@ func (fs *Fs_t) Fs_open_inner(paths ustr.Ustr, flags defs.Fdopt_t, mode int, cwd
 }
 
 // returns the file, a dead inode (non-nil only on error) and error
-func (fs *Fs_t) _fs_open_inner(paths ustr.Ustr, flags defs.Fdopt_t, mode int, cwd *fd.Cwd_t, major, minor int) (Fsfile_t, *imemnode_t, defs.Err_t) {
+func (fs *Fs_t) _fs_open_inner(paths ustr.Ustr, flags defs.Fdopt_t, mode int, cwd *fd.Cwd_t, cr *cred.Cred_t, major, minor int) (Fsfile_t, *imemnode_t, defs.Err_t) {
 	trunc := flags&defs.O_TRUNC != 0
 	creat := flags&defs.O_CREAT != 0
+	follow := flags&defs.O_NOFOLLOW == 0
 	nodir := false
 
 	if fs_debug {
@@ -1329,6 +1635,8 @@ func (fs *Fs_t) _fs_open_inner(paths ustr.Ustr, flags defs.Fdopt_t, mode int, cw
 	}
 	var ret Fsfile_t
 	var idm *imemnode_t
+	// the creator of a file may open it regardless of its mode
+	created := false
 	if creat {
 		nodir = true
 		// creat w/execl; must atomically create and open the new file.
@@ -1345,14 +1653,25 @@ func (fs *Fs_t) _fs_open_inner(paths ustr.Ustr, flags defs.Fdopt_t, mode int, cw
 		}
 
 		// with O_CREAT, the file may exist.
-		par, dead, err := fs.fs_namei_locked(opid, dirs, cwd, "Fs_open_inner")
+		par, dead, err := fs.fs_namei_locked(opid, dirs, cwd, cr, "Fs_open_inner")
 		if err != 0 {
 			return ret, dead, err
 		}
-		if isdev {
-			idm, err = par.do_createnod(opid, fn, major, minor)
+		own := par._mkowner(cr, uint(mode)&^cwd.Umask(), false)
+		if !par._permits(cr, cred.MAY_EXEC) {
+			err = -defs.EACCES
+		} else if !par._maydirw(cr) {
+			// an existing file may still be opened
+			idm, err = par.ilookup(opid, fn)
+			if err == 0 {
+				err = -defs.EEXIST
+			} else if err == -defs.ENOENT {
+				err = -defs.EACCES
+			}
+		} else if isdev {
+			idm, err = par.do_createnod(opid, fn, major, minor, own)
 		} else {
-			idm, err = par.do_createfile(opid, fn)
+			idm, err = par.do_createfile(opid, fn, own)
 		}
 		if err != 0 && err != -defs.EEXIST {
 			// XXX must check dead
@@ -1360,6 +1679,7 @@ func (fs *Fs_t) _fs_open_inner(paths ustr.Ustr, flags defs.Fdopt_t, mode int, cw
 			return ret, nil, err
 		}
 		exists := err == -defs.EEXIST
+		created = !exists
 		par.iunlock_refdown("Fs_open_inner_par")
 		idm.ilock("child")
 
@@ -1370,11 +1690,22 @@ func (fs *Fs_t) _fs_open_inner(paths ustr.Ustr, flags defs.Fdopt_t, mode int, cw
 				return ret, nil, -defs.EEXIST
 			}
 		}
+		if exists && idm.itype == I_SYMLINK && follow {
+			// XXX creating the target of a dangling symlink fails
+			// with ENOENT
+			if idm.iunlock_refdown("Fs_open_inner3") {
+				return ret, idm, -defs.ENOENT
+			}
+			idm, dead, err = fs.fs_namei_locked(opid, paths, cwd, cr, "Fs_open_inner_slink")
+			if err != 0 {
+				return ret, dead, err
+			}
+		}
 	} else {
 		// open existing file
 		var err defs.Err_t
 		var dead *imemnode_t
-		idm, dead, err = fs.fs_namei_locked(opid, paths, cwd, "Fs_open_inner_existing")
+		idm, dead, err = fs._fs_namei_locked(opid, paths, cwd, cr, follow)
 		if err != 0 {
 			return ret, dead, err
 		}
@@ -1383,6 +1714,10 @@ func (fs *Fs_t) _fs_open_inner(paths ustr.Ustr, flags defs.Fdopt_t, mode int, cw
 	defer idm.iunlock_refdown("Fs_open_inner_idm")
 
 	itype := idm.itype
+	if itype == I_SYMLINK {
+		// O_NOFOLLOW
+		return ret, nil, -defs.ELOOP
+	}
 
 	o_dir := flags&defs.O_DIRECTORY != 0
 	wantwrite := flags&(defs.O_WRONLY|defs.O_RDWR) != 0
@@ -1401,6 +1736,24 @@ func (fs *Fs_t) _fs_open_inner(paths ustr.Ustr, flags defs.Fdopt_t, mode int, cw
 		}
 	}
 
+	if !created {
+		var want uint
+		if flags&defs.O_EXEC != 0 {
+			want |= cred.MAY_EXEC
+		} else if flags&defs.O_WRONLY == 0 {
+			want |= cred.MAY_READ
+		}
+		if wantwrite || trunc {
+			want |= cred.MAY_WRITE
+		}
+		if !idm._permits(cr, want) {
+			return ret, nil, -defs.EACCES
+		}
+	}
+
+	if (wantwrite || trunc) && idm.swapfile {
+		return ret, nil, -defs.ETXTBSY
+	}
 	if nodir && trunc {
 		idm.do_trunc(opid, 0)
 	}
@@ -1434,9 +1787,21 @@ func (fs *Fs_t) Makefake() *fd.Fd_t {
 // socket files cannot be open(2)'ed (must use connect(2)/sendto(2) etc.)
 var _denyopen = map[int]bool{defs.D_SUD: true, defs.D_SUS: true}
 
-func (fs *Fs_t) Fs_open(paths ustr.Ustr, flags defs.Fdopt_t, mode int, cwd *fd.Cwd_t, major, minor int) (*fd.Fd_t, defs.Err_t) {
+// gives the slave of pseudo-terminal n, pts/n next to the multiplexer at
+// ptmx, to the user cr who opened the master. only the owner may then read
+// the slave; its group may write to it.
+func (fs *Fs_t) _grantpt(ptmx ustr.Ustr, cwd *fd.Cwd_t, cr *cred.Cred_t, n int) {
+	dir, _ := bpath.Sdirname(cwd.Canonicalpath(ptmx))
+	slave := bpath.Canonicalize(dir.ExtendStr(fmt.Sprintf("pts/%d", n)))
+	// a missing slave cannot be opened anyway
+	if fs.Fs_chown(slave, cr.Euid, -1, cwd, cred.Root) == 0 {
+		fs.Fs_chmod(slave, 0620, cwd, cred.Root)
+	}
+}
+
+func (fs *Fs_t) Fs_open(paths ustr.Ustr, flags defs.Fdopt_t, mode int, cwd *fd.Cwd_t, cr *cred.Cred_t, major, minor int) (*fd.Fd_t, defs.Err_t) {
 	fs.istats.Nopen.Inc()
-	fsf, err := fs.Fs_open_inner(paths, flags, mode, cwd, major, minor)
+	fsf, err := fs.Fs_open_inner(paths, flags, mode, cwd, cr, major, minor)
 	if err != 0 {
 		return nil, err
 	}
@@ -1467,16 +1832,40 @@ func (fs *Fs_t) Fs_open(paths ustr.Ustr, flags defs.Fdopt_t, mode int, cwd *fd.C
 			ret.Fops = &Devfops_t{Maj: maj, Min: min}
 		case defs.D_RAWDISK:
 			ret.Fops = &rawdfops_t{minor: min, fs: fs}
+		case defs.D_PTMX:
+			var n int
+			ret.Fops, n, err = tty.Openmaster(cr)
+			if err == 0 {
+				fs._grantpt(paths, cwd, cr, n)
+			}
+		case defs.D_PTS:
+			ret.Fops, err = tty.Openslave(min, cr)
 		default:
 			panic("bad dev")
 		}
+		if err != 0 {
+			return nil, err
+		}
 	} else {
 		apnd := flags&defs.O_APPEND != 0
 		ret.Fops = &fsfops_t{priv: priv, fs: fs, append: apnd, count: 1}
+		atomic.AddInt64(&fs.nopen, 1)
 	}
 	return ret, 0
 }
 
+// creates a device or socket file at paths, returning its inode number
+func (fs *Fs_t) Fs_mknod(paths ustr.Ustr, flags defs.Fdopt_t, mode int, cwd *fd.Cwd_t, cr *cred.Cred_t, major, minor int) (defs.Inum_t, defs.Err_t) {
+	fsf, err := fs.Fs_open_inner(paths, flags|defs.O_CREAT, mode, cwd, cr, major, minor)
+	if err != 0 {
+		return 0, err
+	}
+	if fs.Fs_close(fsf.Inum) != 0 {
+		panic("must succeed")
+	}
+	return fsf.Inum, 0
+}
+
 func (fs *Fs_t) Fs_close(priv defs.Inum_t) defs.Err_t {
 	opid := fs.fslog.Op_begin("Fs_close")
 
@@ -1499,13 +1888,17 @@ func (fs *Fs_t) Fs_close(priv defs.Inum_t) defs.Err_t {
 	return 0
 }
 
-func (fs *Fs_t) Fs_stat(path ustr.Ustr, st *stat.Stat_t, cwd *fd.Cwd_t) defs.Err_t {
+func (fs *Fs_t) Fs_stat(path ustr.Ustr, st *stat.Stat_t, cwd *fd.Cwd_t, cr *cred.Cred_t) defs.Err_t {
+	return fs._fs_stat(path, st, cwd, cr, true)
+}
+
+func (fs *Fs_t) _fs_stat(path ustr.Ustr, st *stat.Stat_t, cwd *fd.Cwd_t, cr *cred.Cred_t, follow bool) defs.Err_t {
 	opid := opid_t(0)
 
 	if fs_debug {
 		fmt.Printf("fstat: %v %v\n", path, cwd)
 	}
-	idm, dead, err := fs.fs_namei_locked(opid, path, cwd, "Fs_stat")
+	idm, dead, err := fs._fs_namei_locked(opid, path, cwd, cr, follow)
 	if err != 0 {
 		if dead != nil {
 			dead.Free()
@@ -1520,8 +1913,39 @@ func (fs *Fs_t) Fs_stat(path ustr.Ustr, st *stat.Stat_t, cwd *fd.Cwd_t) defs.Err
 	return err
 }
 
-// Sync the file system to disk. XXX If Biscuit supported fsync, we could be
-// smarter and flush only the dirty blocks of particular inode.
+// sets the access and modification times of the file at path, in nanoseconds
+// since the epoch, or else to now for UT_NOW; UT_OMIT leaves a time
+// unchanged.
+func (fs *Fs_t) Fs_utimes(path ustr.Ustr, atime, mtime int, cwd *fd.Cwd_t, cr *cred.Cred_t) defs.Err_t {
+	dead, err := fs.Fs_op_utimes(path, atime, mtime, cwd, cr)
+	if dead != nil {
+		dead.Free()
+	}
+	return err
+}
+
+// returns dead and error
+func (fs *Fs_t) Fs_op_utimes(path ustr.Ustr, atime, mtime int, cwd *fd.Cwd_t, cr *cred.Cred_t) (*imemnode_t, defs.Err_t) {
+	opid := fs.fslog.Op_begin("Fs_utimes")
+	defer fs.fslog.Op_end(opid)
+
+	idm, dead, err := fs.fs_namei_locked(opid, path, cwd, cr, "Fs_utimes")
+	if err != 0 {
+		return dead, err
+	}
+	if idm._mayutime(cr, atime, mtime) {
+		err = idm.do_utimes(opid, atime, mtime)
+	} else {
+		err = -defs.EPERM
+	}
+	if idm.iunlock_refdown("Fs_utimes") {
+		return idm, err
+	}
+	return nil, err
+}
+
+// Sync the file system to disk. fsync and fdatasync force only the
+// transactions that modified a particular inode.
 func (fs *Fs_t) Fs_sync() defs.Err_t {
 	if !fs.diskfs {
 		return 0
@@ -1545,8 +1969,25 @@ func (fs *Fs_t) Fs_syncapply() defs.Err_t {
 // imemnode after calling Refdown. if the lookup fails, the second returned
 // inode may be non-nil and must be freed by the caller. since the slow path
 // acquires locks on inodes, the caller must not have any other inode locked,
-// otherwise namei may deadlock.
-func (fs *Fs_t) _fs_namei_locked(opid opid_t, paths ustr.Ustr, cwd *fd.Cwd_t) (*imemnode_t, *imemnode_t, defs.Err_t) {
+// otherwise namei may deadlock. symlinks in the last path component are
+// followed only if follow is true. cr must have search permission on every
+// directory in the path.
+func (fs *Fs_t) _fs_namei_locked(opid opid_t, paths ustr.Ustr, cwd *fd.Cwd_t, cr *cred.Cred_t, follow bool) (*imemnode_t, *imemnode_t, defs.Err_t) {
+	for i := 0; ; i++ {
+		idm, dead, sl, err := fs._fs_namei_walk(opid, paths, cwd, cr, follow)
+		if err != 0 || sl == nil {
+			return idm, dead, err
+		}
+		if i == maxsymlinks {
+			return nil, nil, -defs.ELOOP
+		}
+		paths = _slsplice(paths, sl.coff, sl.cend, sl.target)
+	}
+}
+
+// walks paths. if a symlink which must be followed is encountered, returns the
+// symlink instead of an inode.
+func (fs *Fs_t) _fs_namei_walk(opid opid_t, paths ustr.Ustr, cwd *fd.Cwd_t, cr *cred.Cred_t, follow bool) (*imemnode_t, *imemnode_t, *slink_t, defs.Err_t) {
 	var start *imemnode_t
 	fs.istats.Nnamei.Inc()
 	// ref lookup directory
@@ -1560,16 +2001,41 @@ func (fs *Fs_t) _fs_namei_locked(opid opid_t, paths ustr.Ustr, cwd *fd.Cwd_t) (*
 	pp.Pp_init(paths)
 	var next ustr.Ustr
 	var nextok bool
+	var coff int
 	// lock-free fast path
 	for cp, ok := pp.Next(); ok; cp, ok = next, nextok {
 		// make sure slow path continues on this component if the
 		// lock-free lookup fails
+		coff = pp.Off()
 		next, nextok = pp.Next()
 		lastc := !nextok
+		// the slow path reports the error
+		if !idm._permits(cr, cred.MAY_EXEC) {
+			break
+		}
 		n, found := idm.ilookup_lockfree(cp, lastc)
 		if !found {
 			break
 		}
+		if n.itype == I_SYMLINK && (!lastc || follow) {
+			// symlinks never change, so the cached target can be
+			// used without the lock
+			t := n._slcached()
+			if lastc {
+				// ilookup_lockfree locked n and verified that
+				// it has links; it cannot be freed here
+				if n.iunlock_refdown("") {
+					panic("huh?")
+				}
+			}
+			if t == nil {
+				break
+			}
+			if start.Refdown("") {
+				return nil, start, nil, -defs.ENOENT
+			}
+			return nil, nil, &slink_t{coff, coff + len(cp), *t}, 0
+		}
 		idm = n
 		if lastc {
 			// ilookup_lockfree already locked n
@@ -1580,37 +2046,58 @@ func (fs *Fs_t) _fs_namei_locked(opid opid_t, paths ustr.Ustr, cwd *fd.Cwd_t) (*
 					if n.iunlock_refdown("") {
 						panic("huh?")
 					}
-					return nil, start, -defs.ENOENT
+					return nil, start, nil, -defs.ENOENT
 				}
 			}
-			return n, nil, 0
+			return n, nil, nil, 0
 		}
 		// "start" is the only imemnode whose refcount is incremented
 		if !res.Resadd_noblock(bounds.Bounds(bounds.B_FS_T_FS_NAMEI)) {
 			err := -defs.ENOHEAP
 			if start.Refdown("") {
-				return nil, start, err
+				return nil, start, nil, err
 			}
-			return nil, nil, err
+			return nil, nil, nil, err
 		}
 	}
 	// couldn't ref idm; restart completely
 	idm = start
 	pp.Pp_init(paths)
 
+	// the component which resolved to idm, if any
+	lcoff, lcend := -1, -1
+	// idm is locked and its symlink must be followed. returns the
+	// resulting path.
+	slinkout := func() (*imemnode_t, *imemnode_t, *slink_t, defs.Err_t) {
+		t, err := idm.readlink()
+		if idm.iunlock_refdown("") {
+			return nil, idm, nil, -defs.ENOENT
+		}
+		if err != 0 {
+			return nil, nil, nil, err
+		}
+		return nil, nil, &slink_t{lcoff, lcend, t}, 0
+	}
+
 	// lock-full slow path
 	for cp, ok := pp.Next(); ok; cp, ok = next, nextok {
+		coff = pp.Off()
 		next, nextok = pp.Next()
 
 		idm.ilock("fs_namei")
+		if idm.itype == I_SYMLINK && lcoff != -1 {
+			return slinkout()
+		}
 		// for simplicity, conservatively fail the lookup if links==0
 		// so that namei can return at most one dead inode.
 		var n *imemnode_t
 		var err defs.Err_t
-		if idm.links != 0 {
-			n, err = idm.ilookup(opid, cp)
-		} else {
+		if idm.links == 0 {
 			err = -defs.ENOENT
+		} else if idm.itype == I_DIR && !idm._permits(cr, cred.MAY_EXEC) {
+			err = -defs.EACCES
+		} else {
+			n, err = idm.ilookup(opid, cp)
 		}
 		var dead *imemnode_t
 		// ilookup always increments the refcnt, even on "."
@@ -1626,23 +2113,33 @@ func (fs *Fs_t) _fs_namei_locked(opid opid_t, paths ustr.Ustr, cwd *fd.Cwd_t) (*
 			}
 		}
 		if err != 0 {
-			return nil, dead, err
+			return nil, dead, nil, err
 		}
 		idm = n
+		lcoff, lcend = coff, coff+len(cp)
 		if !res.Resadd_noblock(bounds.Bounds(bounds.B_FS_T_FS_NAMEI)) {
 			err := -defs.ENOHEAP
 			if idm.Refdown("") {
-				return nil, idm, err
+				return nil, idm, nil, err
 			}
-			return nil, nil, err
+			return nil, nil, nil, err
 		}
 	}
 	idm.ilock("")
-	return idm, nil, 0
+	if idm.itype == I_SYMLINK && lcoff != -1 && follow {
+		return slinkout()
+	}
+	return idm, nil, nil, 0
+}
+
+// follows all symlinks
+func (fs *Fs_t) fs_namei_locked(opid opid_t, paths ustr.Ustr, cwd *fd.Cwd_t, cr *cred.Cred_t, s string) (*imemnode_t, *imemnode_t, defs.Err_t) {
+	return fs._fs_namei_locked(opid, paths, cwd, cr, true)
 }
 
-func (fs *Fs_t) fs_namei_locked(opid opid_t, paths ustr.Ustr, cwd *fd.Cwd_t, s string) (*imemnode_t, *imemnode_t, defs.Err_t) {
-	return fs._fs_namei_locked(opid, paths, cwd)
+// does not follow a symlink in the last path component
+func (fs *Fs_t) fs_lnamei_locked(opid opid_t, paths ustr.Ustr, cwd *fd.Cwd_t, cr *cred.Cred_t, s string) (*imemnode_t, *imemnode_t, defs.Err_t) {
+	return fs._fs_namei_locked(opid, paths, cwd, cr, false)
 }
 
 func (fs *Fs_t) Fs_evict() (int, int) {
@@ -0,0 +1,911 @@
+package fs
+
+import "fmt"
+import "sort"
+
+import "defs"
+import "mem"
+import "ustr"
+import "util"
+
+// Offline file system checker. fsck reads the image through an Fsckdisk_i
+// instead of the buffer cache and log, so that a corrupt image cannot trip the
+// consistency panics of the running file system. it first replays the
+// committed transactions in the log into its copy of the image, like
+// recover(), and then checks that copy. repairs are always made to the copy;
+// when checking only, the report describes what a repair would do, and Flush
+// writes the repaired blocks back to the image.
+
+// the image checked by fsck
+type Fsckdisk_i interface {
+	Readblk(blkno int) *mem.Bytepg_t
+	Writeblk(blkno int, d *mem.Bytepg_t)
+	Nblks() int
+}
+
+// kinds of problems found by fsck
+const (
+	FK_SUPER   = "superblock"
+	FK_LOG     = "log"
+	FK_ROOT    = "root"
+	FK_ITYPE   = "itype"
+	FK_BADBLK  = "badblock"
+	FK_DUPBLK  = "dupblock"
+	FK_DIRENT  = "dirent"
+	FK_DOT     = "dot"
+	FK_DOTDOT  = "dotdot"
+	FK_DIRLINK = "dirlink"
+	FK_UNREACH = "unreachable"
+	FK_NLINK   = "linkcount"
+	FK_ORPHAN  = "orphan"
+	FK_IMAP    = "inodemap"
+	FK_BMAP    = "blockmap"
+)
+
+type Fsckprob_t struct {
+	Kind string `json:"kind"`
+	// the inode and block involved, or -1
+	Inum   int    `json:"inum"`
+	Block  int    `json:"block"`
+	Detail string `json:"detail"`
+	// true if the problem was repaired
+	Fixed bool `json:"fixed"`
+}
+
+// the result of a check. the counts describe the file system after the
+// repairs.
+type Fsckreport_t struct {
+	Superblock int `json:"superblock"`
+	// the image is too broken to be checked
+	Fatal bool `json:"fatal"`
+	// number of log blocks replayed
+	Logblks int `json:"logblks"`
+	// unlinked inodes that were waiting in the orphan map to be freed
+	Orphans   []int        `json:"orphans"`
+	Ninodes   int          `json:"ninodes"`
+	Ndirs     int          `json:"ndirs"`
+	Nfiles    int          `json:"nfiles"`
+	Nsymlinks int          `json:"nsymlinks"`
+	Ndevs     int          `json:"ndevs"`
+	Nblocks   int          `json:"nblocks"`
+	Problems  []Fsckprob_t `json:"problems"`
+}
+
+// returns the number of problems and the number of them that were repaired
+func (r *Fsckreport_t) Nprobs() (int, int) {
+	fixed := 0
+	for _, p := range r.Problems {
+		if p.Fixed {
+			fixed++
+		}
+	}
+	return len(r.Problems), fixed
+}
+
+// what fsck knows about an inode
+type fckinode_t struct {
+	// I_INVALID if the inode is free
+	itype int
+	// on-disk link count
+	links int
+	// number of directory entries naming the inode
+	nref  int
+	reach bool
+	// the directory containing a reachable directory
+	parent int
+}
+
+type Fsck_t struct {
+	Rep    *Fsckreport_t
+	disk   Fsckdisk_i
+	repair bool
+	// fsck's copy of the blocks read so far
+	blks  map[int]*mem.Bytepg_t
+	dirty map[int]bool
+	// layout of the image
+	logstart   int
+	loglen     int
+	orphstart  int
+	imapstart  int
+	bmapstart  int
+	inodestart int
+	datastart  int
+	lastblock  int
+	ninodes    int
+	inodes     []fckinode_t
+	// the inode using each data block plus one, or 0 if the block is free
+	bown      []int
+	lostfound int
+}
+
+func MkFsck(disk Fsckdisk_i, repair bool) *Fsck_t {
+	fk := &Fsck_t{disk: disk, repair: repair}
+	fk.Rep = &Fsckreport_t{Orphans: []int{}, Problems: []Fsckprob_t{}}
+	fk.blks = make(map[int]*mem.Bytepg_t)
+	fk.dirty = make(map[int]bool)
+	fk.lostfound = -1
+	return fk
+}
+
+func (fk *Fsck_t) _prob(kind string, inum, blk int, fixable bool, f string, a ...interface{}) {
+	p := Fsckprob_t{Kind: kind, Inum: inum, Block: blk,
+		Detail: fmt.Sprintf(f, a...), Fixed: fixable && fk.repair}
+	fk.Rep.Problems = append(fk.Rep.Problems, p)
+}
+
+func (fk *Fsck_t) _fatal(kind string, f string, a ...interface{}) bool {
+	fk._prob(kind, -1, -1, false, f, a...)
+	fk.Rep.Fatal = true
+	return false
+}
+
+func (fk *Fsck_t) _read(blkno int) *mem.Bytepg_t {
+	if d, ok := fk.blks[blkno]; ok {
+		return d
+	}
+	d := fk.disk.Readblk(blkno)
+	fk.blks[blkno] = d
+	return d
+}
+
+// records that fsck's copy of blkno was modified
+func (fk *Fsck_t) _write(blkno int) {
+	fk.dirty[blkno] = true
+}
+
+func (fk *Fsck_t) _bit(start, bit int) bool {
+	d := fk._read(start + blkno(bit))
+	return d[byteno(bit)]&(1<<uint(byteoffset(bit))) != 0
+}
+
+func (fk *Fsck_t) _setbit(start, bit int, v bool) {
+	bn := start + blkno(bit)
+	d := fk._read(bn)
+	m := uint8(1 << uint(byteoffset(bit)))
+	if v {
+		d[byteno(bit)] |= m
+	} else {
+		d[byteno(bit)] &^= m
+	}
+	fk._write(bn)
+}
+
+func (fk *Fsck_t) _inode(inum int) (*Inode_t, int) {
+	bn := fk.inodestart + inum/(BSIZE/ISIZE)
+	b := MkBlock(bn, "fsck", nil, nil, nil)
+	b.Data = fk._read(bn)
+	return &Inode_t{b, ioffset(defs.Inum_t(inum))}, bn
+}
+
+// unlike Inode_t.itype, does not panic on a bad type
+func (fk *Fsck_t) _itype(inum int) int {
+	ino, _ := fk._inode(inum)
+	return fieldr(ino.Iblk.Data, ifield(ino.Ioff, 0))
+}
+
+// reads and checks the superblock. returns false if the layout is too broken
+// to check the rest of the image.
+func (fk *Fsck_t) Checksuper() bool {
+	n := fk.disk.Nblks()
+	if n < 2 {
+		return fk._fatal(FK_SUPER, "image has only %v blocks", n)
+	}
+	start := util.Readn(fk._read(0)[:], 4, FSOFF)
+	fk.Rep.Superblock = start
+	if start <= 0 || start >= n {
+		return fk._fatal(FK_SUPER, "bad superblock address %v", start)
+	}
+	sb := Superblock_t{fk._read(start)}
+	if v := sb.Version(); v != FSVERSION {
+		// the inodes of other versions have another size
+		return fk._fatal(FK_SUPER, "format version %v, not %v", v,
+			FSVERSION)
+	}
+	fk.logstart = start + 1
+	fk.loglen = sb.Loglen()
+	fk.orphstart = sb.Iorphanblock()
+	fk.imapstart = fk.orphstart + sb.Iorphanlen()
+	fk.bmapstart = sb.Freeblock()
+	fk.inodestart = fk.bmapstart + sb.Freeblocklen()
+	fk.datastart = fk.inodestart + sb.Inodelen()
+	fk.lastblock = sb.Lastblock()
+	fk.ninodes = sb.Inodelen() * (BSIZE / ISIZE)
+
+	if fk.loglen <= LogOffset+1 {
+		return fk._fatal(FK_SUPER, "log length %v too small", fk.loglen)
+	}
+	if fk.orphstart != fk.logstart+fk.loglen {
+		return fk._fatal(FK_SUPER, "orphan map at %v, not after log at %v",
+			fk.orphstart, fk.logstart+fk.loglen)
+	}
+	if sb.Iorphanlen() <= 0 || sb.Iorphanlen() != sb.Imaplen() {
+		return fk._fatal(FK_SUPER, "orphan map length %v, inode map length %v",
+			sb.Iorphanlen(), sb.Imaplen())
+	}
+	if fk.bmapstart != fk.imapstart+sb.Imaplen() {
+		return fk._fatal(FK_SUPER, "block map at %v, not after inode map at %v",
+			fk.bmapstart, fk.imapstart+sb.Imaplen())
+	}
+	if sb.Freeblocklen() <= 0 || sb.Inodelen() <= 0 {
+		return fk._fatal(FK_SUPER, "block map length %v, inode blocks %v",
+			sb.Freeblocklen(), sb.Inodelen())
+	}
+	if fk.ninodes > sb.Imaplen()*bitsperblk {
+		return fk._fatal(FK_SUPER, "inode map too small for %v inodes", fk.ninodes)
+	}
+	if fk.lastblock <= fk.datastart || fk.lastblock > n {
+		return fk._fatal(FK_SUPER, "last block %v not in (%v, %v]",
+			fk.lastblock, fk.datastart, n)
+	}
+	if fk.lastblock-fk.datastart > sb.Freeblocklen()*bitsperblk {
+		return fk._fatal(FK_SUPER, "block map too small for %v blocks",
+			fk.lastblock-fk.datastart)
+	}
+	fk.inodes = make([]fckinode_t, fk.ninodes)
+	fk.bown = make([]int, fk.lastblock-fk.datastart)
+	return true
+}
+
+// checks the log and replays its committed transactions into fsck's copy of
+// the image. a malformed log is discarded.
+func (fk *Fsck_t) Checklog() {
+	lh := &logheader_t{fk._read(fk.logstart)}
+	tail := lh.r_tail()
+	head := lh.r_head()
+	nl := index_t(fk.loglen - LogOffset)
+	if tail > head || head-tail > nl {
+		fk._prob(FK_LOG, -1, fk.logstart, true,
+			"bad log tail %v head %v; discarding log", tail, head)
+		fk._logreset(lh, head)
+		return
+	}
+	if tail == head {
+		return
+	}
+	im, valid, err := fk._logmap(tail, head)
+	if valid != head {
+		fk._prob(FK_LOG, -1, fk.logstart, true,
+			"%v; discarding log from %v till %v", err, valid, head)
+	}
+	for i := tail; i != valid; i++ {
+		li := int(i % nl)
+		if dst := im[li]; dst != Canceled {
+			*fk._read(dst) = *fk._read(fk.logstart + LogOffset + li)
+			fk._write(dst)
+			fk.Rep.Logblks++
+		}
+	}
+	fk._logreset(lh, valid)
+}
+
+func (fk *Fsck_t) _logreset(lh *logheader_t, head index_t) {
+	lh.w_tail(head)
+	lh.w_head(head)
+	fk._write(fk.logstart)
+}
+
+// like installmap, but checks each transaction instead of trusting it.
+// returns the destinations of the log blocks and the end of the transactions
+// that can be replayed. if that isn't head, it also returns why the next
+// transaction cannot be replayed.
+func (fk *Fsck_t) _logmap(tail, head index_t) ([]int, index_t, string) {
+	nl := index_t(fk.loglen - LogOffset)
+	max := util.Min(fk.loglen/2, MaxDescriptor)
+	desc := func(i index_t) *logdescriptor_t {
+		d := fk._read(fk.logstart + LogOffset + int(i%nl))
+		return &logdescriptor_t{d, max}
+	}
+	im := make([]int, nl)
+	for i := tail; i != head; {
+		ti := i
+		db := desc(i)
+		if err := fk._transok(ti, head, db, desc); err != "" {
+			return im, ti, err
+		}
+		im[i%nl] = Canceled
+		i += NCommitBlk
+		j := 1
+		for ; db.r_logdest(j) == int(RevokeBlk); j++ {
+			rb := desc(i)
+			for k := 1; k < max; k++ {
+				r := rb.r_logdest(k)
+				if r == EndDescriptor {
+					break
+				}
+				for x := tail; x != ti; x++ {
+					if im[x%nl] == r {
+						im[x%nl] = Canceled
+					}
+				}
+			}
+			im[i%nl] = Canceled
+			i++
+		}
+		for ; ; j++ {
+			dst := db.r_logdest(j)
+			if dst == EndDescriptor {
+				break
+			}
+			im[i%nl] = dst
+			i++
+		}
+	}
+	return im, head, ""
+}
+
+// checks the transaction at log index i, which is described by commit block
+// db. returns what is wrong with it, if anything.
+func (fk *Fsck_t) _transok(i, head index_t, db *logdescriptor_t, desc func(index_t) *logdescriptor_t) string {
+	if db.r_logdest(0) != int(CommitBlk) {
+		return fmt.Sprintf("no commit block at log index %v", i)
+	}
+	n := db.nblks()
+	if n < 0 {
+		return fmt.Sprintf("unterminated descriptor at log index %v", i)
+	}
+	if head-i < index_t(n) {
+		return fmt.Sprintf("transaction at log index %v past head", i)
+	}
+	ck := logcksum(i, db, func(f func(*mem.Bytepg_t)) {
+		for k := i + NCommitBlk; k != i+index_t(n); k++ {
+			f(desc(k).data)
+		}
+	})
+	if ck != db.r_cksum() {
+		return fmt.Sprintf("bad checksum for transaction at log index %v", i)
+	}
+	for j := 1; j < n; j++ {
+		r := db.r_logdest(j)
+		if r != int(RevokeBlk) && (r < fk.orphstart || r >= fk.lastblock) {
+			return fmt.Sprintf("bad destination %v in transaction at log index %v", r, i)
+		}
+	}
+	return ""
+}
+
+// checks the inodes, the directory tree, and the bitmaps. returns false if
+// there is no root directory.
+func (fk *Fsck_t) Check() bool {
+	if !fk._bit(fk.imapstart, int(iroot)) || fk._itype(int(iroot)) != I_DIR {
+		return fk._fatal(FK_ROOT, "root inode is not a directory")
+	}
+	fk._scaninodes()
+	fk.inodes[iroot].nref = 1
+	fk._walk(int(iroot), int(iroot))
+	fk._unreachable()
+	fk._links()
+	fk._maps()
+	fk._count()
+	return true
+}
+
+// records the type of each allocated inode and claims the blocks it uses
+func (fk *Fsck_t) _scaninodes() {
+	for inum := range fk.inodes {
+		fi := &fk.inodes[inum]
+		fi.parent = -1
+		if !fk._bit(fk.imapstart, inum) {
+			if fk._bit(fk.orphstart, inum) {
+				fk._prob(FK_ORPHAN, inum, -1, true, "free inode in orphan map")
+				fk._setbit(fk.orphstart, inum, false)
+			}
+			continue
+		}
+		it := fk._itype(inum)
+		if it <= I_INVALID || it > I_VALID {
+			fk._prob(FK_ITYPE, inum, -1, true, "allocated inode has type %v", it)
+			fk._ifree(inum)
+			continue
+		}
+		ino, bn := fk._inode(inum)
+		fi.itype = it
+		fi.links = ino.linkcount()
+		if it == I_DEV || (it == I_SYMLINK && ino.size() <= SYMINLINE) {
+			continue
+		}
+		for i := 0; i < NIADDRS; i++ {
+			if a := ino.addr(i); a != 0 && !fk._claim(inum, a) {
+				ino.W_addr(i, 0)
+				fk._write(bn)
+			}
+		}
+		if a := ino.indirect(); a != 0 {
+			if fk._claim(inum, a) {
+				fk._indclaim(inum, a, 1)
+			} else {
+				ino.w_indirect(0)
+				fk._write(bn)
+			}
+		}
+		if a := ino.dindirect(); a != 0 {
+			if fk._claim(inum, a) {
+				fk._indclaim(inum, a, 2)
+			} else {
+				ino.w_dindirect(0)
+				fk._write(bn)
+			}
+		}
+		if a := ino.tindirect(); a != 0 {
+			if fk._claim(inum, a) {
+				fk._indclaim(inum, a, 3)
+			} else {
+				ino.w_tindirect(0)
+				fk._write(bn)
+			}
+		}
+	}
+}
+
+// claims the blocks referenced by indirect block bn, which is depth levels
+// above the data blocks.
+func (fk *Fsck_t) _indclaim(inum, bn, depth int) {
+	d := fk._read(bn)
+	for k := 0; k < INDADDR; k++ {
+		a := util.Readn(d[:], 8, k*8)
+		if a == 0 {
+			continue
+		}
+		if !fk._claim(inum, a) {
+			util.Writen(d[:], 8, k*8, 0)
+			fk._write(bn)
+		} else if depth > 1 {
+			fk._indclaim(inum, a, depth-1)
+		}
+	}
+}
+
+// marks blk as used by inode inum. returns false if blk is not a data block
+// or is already in use; the caller then drops the reference.
+func (fk *Fsck_t) _claim(inum, blk int) bool {
+	if blk < fk.datastart || blk >= fk.lastblock {
+		fk._prob(FK_BADBLK, inum, blk, true, "block address out of range")
+		return false
+	}
+	if o := fk.bown[blk-fk.datastart]; o != 0 {
+		fk._prob(FK_DUPBLK, inum, blk, true, "block already used by inode %v", o-1)
+		return false
+	}
+	fk.bown[blk-fk.datastart] = inum + 1
+	return true
+}
+
+// frees inode inum and the blocks it claimed
+func (fk *Fsck_t) _ifree(inum int) {
+	fk.inodes[inum].itype = I_INVALID
+	for i, o := range fk.bown {
+		if o == inum+1 {
+			fk.bown[i] = 0
+			fk._setbit(fk.bmapstart, i, false)
+		}
+	}
+	ino, bn := fk._inode(inum)
+	ino.W_itype(I_INVALID)
+	fk._write(bn)
+	fk._setbit(fk.imapstart, inum, false)
+	if fk._bit(fk.orphstart, inum) {
+		fk._setbit(fk.orphstart, inum, false)
+	}
+}
+
+// returns the data blocks of directory d that are not holes, in file order
+func (fk *Fsck_t) _dirblks(d int) []int {
+	ino, _ := fk._inode(d)
+	n := (ino.size() + BSIZE - 1) / BSIZE
+	var ret []int
+	fbn := 0
+	for i := 0; i < NIADDRS && fbn < n; i++ {
+		if a := ino.addr(i); a != 0 {
+			ret = append(ret, a)
+		}
+		fbn++
+	}
+	roots := []int{ino.indirect(), ino.dindirect(), ino.tindirect()}
+	for i, r := range roots {
+		if fbn >= n {
+			break
+		}
+		fbn, ret = fk._inddata(r, i+1, fbn, n, ret)
+	}
+	return ret
+}
+
+func (fk *Fsck_t) _inddata(bn, depth, fbn, n int, ret []int) (int, []int) {
+	if bn == 0 {
+		span := 1
+		for i := 0; i < depth; i++ {
+			span *= INDADDR
+		}
+		return fbn + span, ret
+	}
+	d := fk._read(bn)
+	for k := 0; k < INDADDR && fbn < n; k++ {
+		a := util.Readn(d[:], 8, k*8)
+		if depth == 1 {
+			if a != 0 {
+				ret = append(ret, a)
+			}
+			fbn++
+		} else {
+			fbn, ret = fk._inddata(a, depth-1, fbn, n, ret)
+		}
+	}
+	return fbn, ret
+}
+
+// calls f on each used entry of directory d
+func (fk *Fsck_t) _dirents(d int, f func(dd *Dirdata_t, j, bn int)) {
+	for _, bn := range fk._dirblks(d) {
+		dd := &Dirdata_t{fk._read(bn)[:]}
+		for j := 0; j < NDIRENTS; j++ {
+			if len(dd.Filename(j)) != 0 {
+				f(dd, j, bn)
+			}
+		}
+	}
+}
+
+// adds an entry to directory d, growing d by a direct block if it is full.
+// returns false if there is no room.
+func (fk *Fsck_t) _dirinsert(d int, name ustr.Ustr, inum int) bool {
+	for _, bn := range fk._dirblks(d) {
+		dd := &Dirdata_t{fk._read(bn)[:]}
+		for j := 0; j < NDIRENTS; j++ {
+			if len(dd.Filename(j)) == 0 {
+				dd.W_filename(j, name)
+				dd.W_inodenext(j, defs.Inum_t(inum))
+				fk._write(bn)
+				return true
+			}
+		}
+	}
+	ino, ibn := fk._inode(d)
+	fbn := (ino.size() + BSIZE - 1) / BSIZE
+	if fbn >= NIADDRS || ino.addr(fbn) != 0 {
+		return false
+	}
+	bn := fk._balloc(d)
+	if bn == -1 {
+		return false
+	}
+	ino.W_addr(fbn, bn)
+	ino.W_size((fbn + 1) * BSIZE)
+	fk._write(ibn)
+	dd := &Dirdata_t{fk._read(bn)[:]}
+	dd.W_filename(0, name)
+	dd.W_inodenext(0, defs.Inum_t(inum))
+	return true
+}
+
+// allocates a zeroed data block for inode inum. returns -1 if the disk is
+// full.
+func (fk *Fsck_t) _balloc(inum int) int {
+	for i, o := range fk.bown {
+		if o == 0 {
+			fk.bown[i] = inum + 1
+			fk._setbit(fk.bmapstart, i, true)
+			bn := fk.datastart + i
+			fk.blks[bn] = &mem.Bytepg_t{}
+			fk._write(bn)
+			return bn
+		}
+	}
+	return -1
+}
+
+// walks the directory tree rooted at directory dir, whose parent is par
+func (fk *Fsck_t) _walk(dir, par int) {
+	fk.inodes[dir].reach = true
+	fk.inodes[dir].parent = par
+	q := []int{dir}
+	for len(q) > 0 {
+		d := q[0]
+		q = q[1:]
+		q = append(q, fk._dirscan(d)...)
+	}
+}
+
+// checks the entries of directory d. returns the directories in d, which
+// are reachable now.
+func (fk *Fsck_t) _dirscan(d int) []int {
+	var ret []int
+	ndot, ndotdot := 0, 0
+	par := fk.inodes[d].parent
+	fk._dirents(d, func(dd *Dirdata_t, j, bn int) {
+		name := dd.Filename(j)
+		inum := int(dd.inodenext(j))
+		clear := func() {
+			dd.W_filename(j, ustr.MkUstr())
+			dd.W_inodenext(j, 0)
+			fk._write(bn)
+		}
+		switch {
+		case name.Isdot():
+			ndot++
+			if ndot > 1 {
+				fk._prob(FK_DOT, d, bn, true, "duplicate \".\"")
+				clear()
+			} else if inum != d {
+				fk._prob(FK_DOT, d, bn, true, "\".\" is %v", inum)
+				dd.W_inodenext(j, defs.Inum_t(d))
+				fk._write(bn)
+			}
+		case name.Isdotdot():
+			ndotdot++
+			if ndotdot > 1 {
+				fk._prob(FK_DOTDOT, d, bn, true, "duplicate \"..\"")
+				clear()
+			} else if inum != par {
+				fk._prob(FK_DOTDOT, d, bn, true,
+					"\"..\" is %v, not parent %v", inum, par)
+				dd.W_inodenext(j, defs.Inum_t(par))
+				fk._write(bn)
+			}
+		case inum < 0 || inum >= fk.ninodes ||
+			fk.inodes[inum].itype == I_INVALID:
+			fk._prob(FK_DIRENT, d, bn, true,
+				"entry %q refers to free inode %v", name, inum)
+			clear()
+		case fk.inodes[inum].itype == I_DIR && fk.inodes[inum].reach:
+			fk._prob(FK_DIRLINK, d, bn, true,
+				"entry %q is another link to directory %v", name, inum)
+			clear()
+		default:
+			fi := &fk.inodes[inum]
+			fi.nref++
+			fi.reach = true
+			if fi.itype == I_DIR {
+				fi.parent = d
+				ret = append(ret, inum)
+				if d == int(iroot) && name.Eq(ustr.Ustr("lost+found")) {
+					fk.lostfound = inum
+				}
+			}
+		}
+	})
+	if ndot == 0 {
+		ok := fk._dirinsert(d, ustr.MkUstrDot(), d)
+		fk._prob(FK_DOT, d, -1, ok, "missing \".\"")
+	}
+	if ndotdot == 0 {
+		ok := fk._dirinsert(d, ustr.DotDot, par)
+		fk._prob(FK_DOTDOT, d, -1, ok, "missing \"..\"")
+	}
+	return ret
+}
+
+// returns the inode named by the ".." entry of directory d, or -1
+func (fk *Fsck_t) _dotdot(d int) int {
+	ret := -1
+	fk._dirents(d, func(dd *Dirdata_t, j, bn int) {
+		if dd.Filename(j).Isdotdot() {
+			ret = int(dd.inodenext(j))
+		}
+	})
+	return ret
+}
+
+// returns true if inum is an unlinked inode that should be freed
+func (fk *Fsck_t) _unlinked(inum int) bool {
+	return fk.inodes[inum].links == 0 || fk._bit(fk.orphstart, inum)
+}
+
+// frees the unlinked inodes and reconnects the other allocated inodes that
+// are not reachable from the root.
+func (fk *Fsck_t) _unreachable() {
+	for inum := range fk.inodes {
+		fi := &fk.inodes[inum]
+		if fi.itype == I_INVALID || fi.reach || !fk._unlinked(inum) {
+			continue
+		}
+		if fk._bit(fk.orphstart, inum) {
+			fk.Rep.Orphans = append(fk.Rep.Orphans, inum)
+		} else {
+			fk._prob(FK_UNREACH, inum, -1, true,
+				"unlinked inode not in orphan map; freeing")
+		}
+		fk._ifree(inum)
+	}
+	// reconnect directories first, starting with the top of each
+	// disconnected subtree, so that their contents stay with them
+	for inum := range fk.inodes {
+		fi := &fk.inodes[inum]
+		if fi.itype == I_DIR && !fi.reach {
+			fk._reconnect(fk._dirtop(inum))
+		}
+	}
+	for inum := range fk.inodes {
+		fi := &fk.inodes[inum]
+		if fi.itype != I_INVALID && !fi.reach {
+			fk._reconnect(inum)
+		}
+	}
+}
+
+// follows the ".." entries from unreachable directory d to the top of its
+// disconnected subtree
+func (fk *Fsck_t) _dirtop(d int) int {
+	seen := map[int]bool{d: true}
+	for {
+		p := fk._dotdot(d)
+		if p < 0 || p >= fk.ninodes || seen[p] {
+			return d
+		}
+		fp := &fk.inodes[p]
+		if fp.itype != I_DIR || fp.reach {
+			return d
+		}
+		seen[p] = true
+		d = p
+	}
+}
+
+// links unreachable inode inum into lost+found
+func (fk *Fsck_t) _reconnect(inum int) {
+	name := ustr.Ustr(fmt.Sprintf("#%d", inum))
+	lf := fk._lostfound()
+	ok := lf != -1 && fk._dirinsert(lf, name, inum)
+	fk._prob(FK_UNREACH, inum, -1, ok,
+		"inode not reachable from the root; reconnecting as /lost+found/%s", name)
+	fi := &fk.inodes[inum]
+	fi.reach = true
+	if !ok {
+		return
+	}
+	fi.nref++
+	if fi.itype == I_DIR {
+		fk._walk(inum, lf)
+	}
+}
+
+// returns the inode of /lost+found, creating it if necessary, or -1 if it
+// cannot be created.
+func (fk *Fsck_t) _lostfound() int {
+	if fk.lostfound != -1 {
+		return fk.lostfound
+	}
+	lfname := ustr.Ustr("lost+found")
+	busy := false
+	fk._dirents(int(iroot), func(dd *Dirdata_t, j, bn int) {
+		busy = busy || dd.Filename(j).Eq(lfname)
+	})
+	if busy {
+		return -1
+	}
+	inum := -1
+	for i := range fk.inodes {
+		if fk.inodes[i].itype == I_INVALID && !fk._bit(fk.imapstart, i) {
+			inum = i
+			break
+		}
+	}
+	if inum == -1 {
+		return -1
+	}
+	bn := fk._balloc(inum)
+	if bn == -1 {
+		return -1
+	}
+	if !fk._dirinsert(int(iroot), lfname, inum) {
+		fk.bown[bn-fk.datastart] = 0
+		fk._setbit(fk.bmapstart, bn-fk.datastart, false)
+		return -1
+	}
+	ino, ibn := fk._inode(inum)
+	for i := 0; i < NIWORDS; i++ {
+		fieldw(ino.Iblk.Data, ifield(ino.Ioff, i), 0)
+	}
+	now := fstime()
+	ino.W_itype(I_DIR)
+	ino.W_linkcount(1)
+	ino.W_size(BSIZE)
+	ino.W_addr(0, bn)
+	ino.W_atime(now)
+	ino.W_mtime(now)
+	ino.W_ctime(now)
+	ino.W_mode(0700)
+	fk._write(ibn)
+	dd := &Dirdata_t{fk._read(bn)[:]}
+	dd.W_filename(0, ustr.MkUstrDot())
+	dd.W_inodenext(0, defs.Inum_t(inum))
+	dd.W_filename(1, ustr.DotDot)
+	dd.W_inodenext(1, iroot)
+	fk._setbit(fk.imapstart, inum, true)
+	fk.inodes[inum] = fckinode_t{itype: I_DIR, links: 1, nref: 1,
+		reach: true, parent: int(iroot)}
+	fk.lostfound = inum
+	return inum
+}
+
+// makes the link counts of reachable inodes match the number of entries
+// naming them
+func (fk *Fsck_t) _links() {
+	for inum := range fk.inodes {
+		fi := &fk.inodes[inum]
+		if fi.itype == I_INVALID || fi.nref == 0 {
+			continue
+		}
+		if fi.links != fi.nref {
+			fk._prob(FK_NLINK, inum, -1, true, "link count %v, but %v entries",
+				fi.links, fi.nref)
+			ino, bn := fk._inode(inum)
+			ino.W_linkcount(fi.nref)
+			fk._write(bn)
+			fi.links = fi.nref
+		}
+		if fk._bit(fk.orphstart, inum) {
+			fk._prob(FK_ORPHAN, inum, -1, true, "linked inode in orphan map")
+			fk._setbit(fk.orphstart, inum, false)
+		}
+	}
+}
+
+// makes the inode and block bitmaps match the inodes and blocks in use
+func (fk *Fsck_t) _maps() {
+	for inum := range fk.inodes {
+		used := fk.inodes[inum].itype != I_INVALID
+		if fk._bit(fk.imapstart, inum) != used {
+			fk._prob(FK_IMAP, inum, -1, true, "inode map bit is %v", !used)
+			fk._setbit(fk.imapstart, inum, used)
+		}
+	}
+	for bit, o := range fk.bown {
+		used := o != 0
+		if fk._bit(fk.bmapstart, bit) == used {
+			continue
+		}
+		if used {
+			fk._prob(FK_BMAP, o-1, fk.datastart+bit, true,
+				"block in use but marked free")
+		} else {
+			fk._prob(FK_BMAP, -1, fk.datastart+bit, true,
+				"free block marked in use")
+		}
+		fk._setbit(fk.bmapstart, bit, used)
+	}
+}
+
+func (fk *Fsck_t) _count() {
+	r := fk.Rep
+	for _, fi := range fk.inodes {
+		switch fi.itype {
+		case I_INVALID:
+			continue
+		case I_DIR:
+			r.Ndirs++
+		case I_FILE:
+			r.Nfiles++
+		case I_SYMLINK:
+			r.Nsymlinks++
+		case I_DEV:
+			r.Ndevs++
+		}
+		r.Ninodes++
+	}
+	for _, o := range fk.bown {
+		if o != 0 {
+			r.Nblocks++
+		}
+	}
+}
+
+// writes the blocks modified by fsck back to the image. the log header is
+// written last, so that a crash before then replays the log again.
+func (fk *Fsck_t) Flush() {
+	if !fk.repair {
+		panic("fsck is not repairing")
+	}
+	var bns []int
+	for bn := range fk.dirty {
+		if bn != fk.logstart {
+			bns = append(bns, bn)
+		}
+	}
+	sort.Ints(bns)
+	for _, bn := range bns {
+		fk.disk.Writeblk(bn, fk.blks[bn])
+	}
+	if fk.dirty[fk.logstart] {
+		fk.disk.Writeblk(fk.logstart, fk.blks[fk.logstart])
+	}
+	fk.dirty = make(map[int]bool)
+}
@@ -3,6 +3,7 @@ package fs
 import "fmt"
 import "sync"
 import "sort"
+import "time"
 import "unsafe"
 
 import "bounds"
@@ -33,6 +34,8 @@ type inode_stats_t struct {
 	Nifree      stats.Counter_t
 	Nicreate    stats.Counter_t
 	Nilink      stats.Counter_t
+	Nsymlink    stats.Counter_t
+	Natime      stats.Counter_t
 	Nunlink     stats.Counter_t
 	Nrename     stats.Counter_t
 	Nlseek      stats.Counter_t
@@ -65,18 +68,33 @@ const (
 	I_FILE    = 1
 	I_DIR     = 2
 	I_DEV     = 3
-	I_VALID   = I_DEV
+	I_SYMLINK = 4
+	I_VALID   = I_SYMLINK
 	// ready to be reclaimed
-	I_DEAD = 4
+	I_DEAD = 5
 	I_LAST = I_DEAD
 
 	// direct block addresses
 	NIADDRS = 9
-	// number of words in an inode
-	NIWORDS = 7 + NIADDRS
+	// word offsets of the access, modification, and change times (in
+	// nanoseconds since the epoch), which follow the block addresses
+	IATIME = 7 + NIADDRS
+	IMTIME = IATIME + 1
+	ICTIME = IATIME + 2
+	// word offsets of the owner, group, and permission bits
+	IUID  = ICTIME + 1
+	IGID  = ICTIME + 2
+	IMODE = ICTIME + 3
+	// word offset of the triple-indirect block
+	ITINDIRECT = IMODE + 1
+	// number of words in an inode; the words after ITINDIRECT are unused
+	NIWORDS = ISIZE / 8
 	// number of address in indirect block
 	INDADDR = (BSIZE / 8)
-	ISIZE   = 128
+	ISIZE   = 256
+	// symlink targets no longer than SYMINLINE bytes are stored in the
+	// inode's direct block addresses instead of a data block
+	SYMINLINE = NIADDRS * 8
 )
 
 func ifield(iidx int, fieldn int) int {
@@ -116,6 +134,10 @@ func (ind *Inode_t) dindirect() int {
 	return fieldr(ind.Iblk.Data, ifield(ind.Ioff, 6))
 }
 
+func (ind *Inode_t) tindirect() int {
+	return fieldr(ind.Iblk.Data, ifield(ind.Ioff, ITINDIRECT))
+}
+
 func (ind *Inode_t) addr(i int) int {
 	if i < 0 || i > NIADDRS {
 		panic("bad inode block index")
@@ -124,6 +146,30 @@ func (ind *Inode_t) addr(i int) int {
 	return fieldr(ind.Iblk.Data, ifield(ind.Ioff, addroff+i))
 }
 
+func (ind *Inode_t) atime() int {
+	return fieldr(ind.Iblk.Data, ifield(ind.Ioff, IATIME))
+}
+
+func (ind *Inode_t) mtime() int {
+	return fieldr(ind.Iblk.Data, ifield(ind.Ioff, IMTIME))
+}
+
+func (ind *Inode_t) ctime() int {
+	return fieldr(ind.Iblk.Data, ifield(ind.Ioff, ICTIME))
+}
+
+func (ind *Inode_t) uid() int {
+	return fieldr(ind.Iblk.Data, ifield(ind.Ioff, IUID))
+}
+
+func (ind *Inode_t) gid() int {
+	return fieldr(ind.Iblk.Data, ifield(ind.Ioff, IGID))
+}
+
+func (ind *Inode_t) mode() uint {
+	return uint(fieldr(ind.Iblk.Data, ifield(ind.Ioff, IMODE)))
+}
+
 func (ind *Inode_t) W_itype(n int) {
 	if n < I_FIRST || n > I_LAST {
 		panic("weird inode type")
@@ -157,6 +203,10 @@ func (ind *Inode_t) w_dindirect(blk int) {
 	fieldw(ind.Iblk.Data, ifield(ind.Ioff, 6), blk)
 }
 
+func (ind *Inode_t) w_tindirect(blk int) {
+	fieldw(ind.Iblk.Data, ifield(ind.Ioff, ITINDIRECT), blk)
+}
+
 func (ind *Inode_t) W_addr(i int, blk int) {
 	if i < 0 || i > NIADDRS {
 		panic("bad inode block index")
@@ -165,6 +215,30 @@ func (ind *Inode_t) W_addr(i int, blk int) {
 	fieldw(ind.Iblk.Data, ifield(ind.Ioff, addroff+i), blk)
 }
 
+func (ind *Inode_t) W_atime(ns int) {
+	fieldw(ind.Iblk.Data, ifield(ind.Ioff, IATIME), ns)
+}
+
+func (ind *Inode_t) W_mtime(ns int) {
+	fieldw(ind.Iblk.Data, ifield(ind.Ioff, IMTIME), ns)
+}
+
+func (ind *Inode_t) W_ctime(ns int) {
+	fieldw(ind.Iblk.Data, ifield(ind.Ioff, ICTIME), ns)
+}
+
+func (ind *Inode_t) W_uid(uid int) {
+	fieldw(ind.Iblk.Data, ifield(ind.Ioff, IUID), uid)
+}
+
+func (ind *Inode_t) W_gid(gid int) {
+	fieldw(ind.Iblk.Data, ifield(ind.Ioff, IGID), gid)
+}
+
+func (ind *Inode_t) W_mode(mode uint) {
+	fieldw(ind.Iblk.Data, ifield(ind.Ioff, IMODE), int(mode))
+}
+
 // In-memory representation of an inode.
 type imemnode_t struct {
 	// _l protects all fields except for inum (which is the key for lookup
@@ -184,7 +258,36 @@ type imemnode_t struct {
 	minor  int
 	indir  int
 	dindir int
+	tindir int
 	addrs  [NIADDRS]int
+	// the most recently allocated block, which is not persistent. a new
+	// block whose predecessor in the file is unknown, like an indirect
+	// block, is allocated after it if possible.
+	lastblk int
+	// true while the file is a swap area, whose blocks are written
+	// directly; the file cannot be written, truncated, or removed
+	swapfile bool
+	// timestamps in nanoseconds since the epoch
+	atime int
+	mtime int
+	ctime int
+	// owner, group, and permission bits (including the setuid, setgid,
+	// and sticky bits)
+	uid  int
+	gid  int
+	mode uint
+	// the last transaction that modified the inode, and the last one that
+	// modified its data or metadata other than its timestamps. fsync and
+	// fdatasync force only through these transactions.
+	synctid     transid_t
+	datasynctid transid_t
+	// cached symlink target, read without the lock by lock-free namei.
+	// symlinks are never modified once created.
+	slink *ustr.Ustr
+	// advisory locks and the cond their waiters sleep on; protected by
+	// _locks, not _l
+	locks  []*flock_t
+	lkcond *sync.Cond
 	// inode specific metadata blocks
 	dentc struct {
 		// true iff all non-empty directory entries are cached, thus
@@ -290,6 +393,20 @@ func (idm *imemnode_t) idm_init(inum defs.Inum_t) {
 	idm.fill(blk, inum)
 	blk.Unlock()
 	idm.fs.fslog.Relse(blk, "idm_init")
+	// the current transaction may have modified the inode, its size or its
+	// data before it was evicted, so fsync and fdatasync must both force
+	// the log
+	idm._logged(false)
+}
+
+// records that the current transaction modified idm. times is true if only
+// idm's timestamps changed. idm must be locked.
+func (idm *imemnode_t) _logged(times bool) {
+	tid := idm.fs.fslog.Transid()
+	idm.synctid = tid
+	if !times {
+		idm.datasynctid = tid
+	}
 }
 
 func (idm *imemnode_t) iunlock_refdown(s string) bool {
@@ -309,9 +426,10 @@ func (idm *imemnode_t) _iupdate(opid opid_t) defs.Err_t {
 	if idm.fs.diskfs {
 		idm.fs.istats.Niupdate.Inc()
 		iblk := idm.idibread()
-		if idm.flushto(iblk, idm.inum) {
+		if dirty, times := idm.flushto(iblk, idm.inum); dirty {
 			iblk.Unlock()
 			idm.fs.fslog.Write(opid, iblk)
+			idm._logged(times)
 		} else {
 			iblk.Unlock()
 		}
@@ -325,8 +443,12 @@ func (idm *imemnode_t) do_trunc(opid opid_t, truncto uint) defs.Err_t {
 	if idm.itype != I_FILE && idm.itype != I_DEV {
 		panic("bad truncate")
 	}
+	if idm.swapfile {
+		return -defs.ETXTBSY
+	}
 	err := idm.itrunc(opid, truncto)
 	if err == 0 {
+		idm._mtouch()
 		idm._iupdate(opid)
 	}
 	return err
@@ -336,6 +458,81 @@ func (idm *imemnode_t) do_read(dst fdops.Userio_i, offset int) (int, defs.Err_t)
 	return idm.iread(dst, offset)
 }
 
+// writes the blocks at the offsets offs as ordered writes, in ops of at most
+// MaxBlkPerOp blocks. the blocks are pages of shared mappings, which immapinfo
+// pinned in the cache, so they hold the writes through the mappings.
+func (idm *imemnode_t) do_syncpages(offs []int) defs.Err_t {
+	for len(offs) > 0 {
+		n := min(len(offs), MaxBlkPerOp)
+		opid := idm.fs.fslog.Op_begin("syncpages")
+		idm.ilock("")
+		if idm.swapfile {
+			idm.iunlock("")
+			idm.fs.fslog.Op_end(opid)
+			return -defs.ETXTBSY
+		}
+		var err defs.Err_t
+		for _, off := range offs[:n] {
+			// the file may have been truncated
+			if off >= idm.size {
+				continue
+			}
+			var b *Bdev_block_t
+			b, err = idm.off2buf(opid, off, BSIZE, false, true, "syncpages")
+			if err != 0 {
+				break
+			}
+			b.Unlock()
+			idm.fs.fslog.Write_ordered(opid, b)
+			idm.fs.fslog.Relse(b, "syncpages")
+			idm._logged(false)
+		}
+		idm.iunlock("")
+		idm.fs.fslog.Op_end(opid)
+		if err != 0 {
+			return err
+		}
+		offs = offs[n:]
+	}
+	return 0
+}
+
+// returns the disk blocks of the file's pages, allocating the blocks of holes,
+// so that the file can be a swap area
+func (idm *imemnode_t) do_swapmap() ([]int, defs.Err_t) {
+	idm.ilock("")
+	n := idm.size / BSIZE
+	idm.iunlock("")
+	blks := make([]int, 0, n)
+	// account for indirect blocks, like do_write
+	max := MaxBlkPerOp - 3
+	for len(blks) < n {
+		opid := idm.fs.fslog.Op_begin("swapmap")
+		idm.ilock("")
+		var err defs.Err_t
+		for i := 0; i < max && len(blks) < n && len(blks)*BSIZE < idm.size; i++ {
+			var blkn int
+			blkn, _, err = idm.offsetblk(opid, len(blks)*BSIZE, true)
+			if err != 0 {
+				break
+			}
+			blks = append(blks, blkn)
+		}
+		idm._iupdate(opid)
+		short := len(blks)*BSIZE >= idm.size
+		idm.iunlock("")
+		idm.fs.fslog.Op_end(opid)
+		if err != 0 {
+			return nil, err
+		}
+		// stop early if the file was truncated meanwhile
+		if short {
+			break
+		}
+	}
+	return blks, 0
+}
+
 func (idm *imemnode_t) do_write(src fdops.Userio_i, offset int, app bool) (int, defs.Err_t) {
 	// break write system calls into one or more calls with no more than
 	// maxblkpersys blocks per call. account for indirect blocks.
@@ -367,6 +564,11 @@ func (idm *imemnode_t) do_write(src fdops.Userio_i, offset int, app bool) (int,
 		if idm.itype == I_DIR {
 			panic("write to dir")
 		}
+		if idm.swapfile {
+			idm.iunlock("")
+			idm.fs.fslog.Op_end(opid)
+			return i, -defs.ETXTBSY
+		}
 		off := offset + i
 		if app {
 			off = idm.size
@@ -374,6 +576,9 @@ func (idm *imemnode_t) do_write(src fdops.Userio_i, offset int, app bool) (int,
 		s1 := stats.Rdtsc()
 		wrote, err := idm.iwrite(opid, src, off, n)
 		idm.fs.istats.Ciwrite.Add(s1)
+		if wrote > 0 {
+			idm._mtouch()
+		}
 
 		s2 := stats.Rdtsc()
 		idm._iupdate(opid)
@@ -397,14 +602,61 @@ func (idm *imemnode_t) do_write(src fdops.Userio_i, offset int, app bool) (int,
 
 func (idm *imemnode_t) do_stat(st *stat.Stat_t) defs.Err_t {
 	idm.fs.istats.Nistat.Inc()
-	st.Wdev(0)
+	st.Wdev(idm.fs.dev)
 	st.Wino(uint(idm.inum))
 	st.Wmode(idm.mkmode())
 	st.Wsize(uint(idm.size))
 	st.Wrdev(defs.Mkdev(idm.major, idm.minor))
+	st.Watime(idm.atime)
+	st.Wmtime(idm.mtime)
+	st.Wctime(idm.ctime)
+	st.Wuid(uint(idm.uid))
+	st.Wgid(uint(idm.gid))
 	return 0
 }
 
+// the access time is only written back if it is not newer than the
+// modification or change time, or it is older than relatime_max (like Linux's
+// relatime), so that most reads do not log an inode update.
+const relatime_max = int(24 * time.Hour)
+
+// returns the current time in nanoseconds since the epoch
+func fstime() int {
+	return int(time.Now().UnixNano())
+}
+
+// records a modification of the inode's contents. caller must _iupdate.
+func (idm *imemnode_t) _mtouch() {
+	now := fstime()
+	idm.mtime = now
+	idm.ctime = now
+}
+
+// returns true if a read at time now should update the access time
+func (idm *imemnode_t) _atime_stale(now int) bool {
+	return idm.atime <= idm.mtime || idm.atime <= idm.ctime ||
+		now-idm.atime >= relatime_max
+}
+
+// sets the access and modification times; a negative time is left unchanged.
+func (idm *imemnode_t) do_utimes(opid opid_t, atime, mtime int) defs.Err_t {
+	now := fstime()
+	if atime == defs.UT_NOW {
+		atime = now
+	}
+	if mtime == defs.UT_NOW {
+		mtime = now
+	}
+	if atime >= 0 {
+		idm.atime = atime
+	}
+	if mtime >= 0 {
+		idm.mtime = mtime
+	}
+	idm.ctime = now
+	return idm._iupdate(opid)
+}
+
 func (idm *imemnode_t) do_mmapi(off, len int, inc bool) ([]mem.Mmapinfo_t, defs.Err_t) {
 	if idm.itype != I_FILE && idm.itype != I_DIR {
 		panic("bad mmapinfo")
@@ -448,35 +700,35 @@ func (idm *imemnode_t) do_insert(opid opid_t, fn ustr.Ustr, n defs.Inum_t) defs.
 	return err
 }
 
-func (idm *imemnode_t) do_createnod(opid opid_t, fn ustr.Ustr, maj, min int) (*imemnode_t, defs.Err_t) {
+func (idm *imemnode_t) do_createnod(opid opid_t, fn ustr.Ustr, maj, min int, own iowner_t) (*imemnode_t, defs.Err_t) {
 	if idm.itype != I_DIR {
 		return nil, -defs.ENOTDIR
 	}
 
 	itype := I_DEV
-	child, err := idm.icreate(opid, fn, itype, maj, min)
+	child, err := idm.icreate(opid, fn, itype, maj, min, own)
 	idm._iupdate(opid)
 	return child, err
 }
 
-func (idm *imemnode_t) do_createfile(opid opid_t, fn ustr.Ustr) (*imemnode_t, defs.Err_t) {
+func (idm *imemnode_t) do_createfile(opid opid_t, fn ustr.Ustr, own iowner_t) (*imemnode_t, defs.Err_t) {
 	if idm.itype != I_DIR {
 		return nil, -defs.ENOTDIR
 	}
 
 	itype := I_FILE
-	child, err := idm.icreate(opid, fn, itype, 0, 0)
+	child, err := idm.icreate(opid, fn, itype, 0, 0, own)
 	idm._iupdate(opid)
 	return child, err
 }
 
-func (idm *imemnode_t) do_createdir(opid opid_t, fn ustr.Ustr) (*imemnode_t, defs.Err_t) {
+func (idm *imemnode_t) do_createdir(opid opid_t, fn ustr.Ustr, own iowner_t) (*imemnode_t, defs.Err_t) {
 	if idm.itype != I_DIR {
 		return nil, -defs.ENOTDIR
 	}
 
 	itype := I_DIR
-	child, err := idm.icreate(opid, fn, itype, 0, 0)
+	child, err := idm.icreate(opid, fn, itype, 0, 0, own)
 	idm._iupdate(opid)
 	return child, err
 }
@@ -484,6 +736,7 @@ func (idm *imemnode_t) do_createdir(opid opid_t, fn ustr.Ustr) (*imemnode_t, def
 // caller holds lock on idm
 func (idm *imemnode_t) _linkdown(opid opid_t) {
 	idm.links--
+	idm.ctime = fstime()
 	if idm.links <= 0 {
 		idm.fs.icache.markOrphan(opid, idm.inum)
 	}
@@ -492,6 +745,7 @@ func (idm *imemnode_t) _linkdown(opid opid_t) {
 
 func (idm *imemnode_t) _linkup(opid opid_t) {
 	idm.links++
+	idm.ctime = fstime()
 	idm._iupdate(opid)
 }
 
@@ -516,30 +770,47 @@ func (ic *imemnode_t) fill(blk *Bdev_block_t, inum defs.Inum_t) {
 	ic.minor = inode.minor()
 	ic.indir = inode.indirect()
 	ic.dindir = inode.dindirect()
+	ic.tindir = inode.tindirect()
 	for i := 0; i < NIADDRS; i++ {
 		ic.addrs[i] = inode.addr(i)
 	}
+	ic.atime = inode.atime()
+	ic.mtime = inode.mtime()
+	ic.ctime = inode.ctime()
+	ic.uid = inode.uid()
+	ic.gid = inode.gid()
+	ic.mode = inode.mode()
 	if ic.itype == I_DIR {
 		ic.dentc.dents = hashtable.MkHash(100)
 	}
+	ic.slink = nil
+	if ic.itype == I_SYMLINK && ic._slinline() {
+		t := ic._slunpack()
+		ic.slink = &t
+	}
 }
 
 // returns true if the inode data changed, and thus needs to be flushed to disk
-func (ic *imemnode_t) flushto(blk *Bdev_block_t, inum defs.Inum_t) bool {
+// returns whether the inode changed and whether only its timestamps changed
+func (ic *imemnode_t) flushto(blk *Bdev_block_t, inum defs.Inum_t) (bool, bool) {
 	inode := Inode_t{blk, ioffset(inum)}
 	j := inode
 	k := ic
-	ret := false
+	meta := false
 	if j.itype() != k.itype || j.linkcount() != k.links ||
 		j.size() != k.size || j.major() != k.major ||
-		j.minor() != k.minor || j.indirect() != k.indir {
-		ret = true
+		j.minor() != k.minor || j.indirect() != k.indir ||
+		j.dindirect() != k.dindir || j.tindirect() != k.tindir ||
+		j.uid() != k.uid || j.gid() != k.gid || j.mode() != k.mode {
+		meta = true
 	}
 	for i, v := range ic.addrs {
 		if inode.addr(i) != v {
-			ret = true
+			meta = true
 		}
 	}
+	times := j.atime() != k.atime || j.mtime() != k.mtime ||
+		j.ctime() != k.ctime
 	inode.W_itype(ic.itype)
 	inode.W_linkcount(ic.links)
 	inode.W_size(ic.size)
@@ -547,18 +818,44 @@ func (ic *imemnode_t) flushto(blk *Bdev_block_t, inum defs.Inum_t) bool {
 	inode.w_minor(ic.minor)
 	inode.w_indirect(ic.indir)
 	inode.w_dindirect(ic.dindir)
+	inode.w_tindirect(ic.tindir)
 	for i := 0; i < NIADDRS; i++ {
 		inode.W_addr(i, ic.addrs[i])
 	}
-	return ret
+	inode.W_atime(ic.atime)
+	inode.W_mtime(ic.mtime)
+	inode.W_ctime(ic.ctime)
+	inode.W_uid(ic.uid)
+	inode.W_gid(ic.gid)
+	inode.W_mode(ic.mode)
+	return meta || times, !meta
+}
+
+// allocates a block, preferably the one following prev, the block that
+// precedes the new one in the file, or else the one following the most
+// recently allocated block, so that files are laid out contiguously. prev is 0
+// if it is unknown.
+func (idm *imemnode_t) _balloc(opid opid_t, prev int) (int, defs.Err_t) {
+	if prev == 0 {
+		prev = idm.lastblk
+	}
+	goal := -1
+	if prev != 0 {
+		goal = prev + 1
+	}
+	blkn, err := idm.fs.balloc.Balloc(opid, goal)
+	if err == 0 {
+		idm.lastblk = blkn
+	}
+	return blkn, err
 }
 
-// ensure block exists
-func (idm *imemnode_t) ensureb(opid opid_t, blkno int, writing bool) (int, bool, defs.Err_t) {
+// ensure block exists, allocating it after prev like _balloc
+func (idm *imemnode_t) ensureb(opid opid_t, blkno, prev int, writing bool) (int, bool, defs.Err_t) {
 	if !writing || blkno != 0 {
 		return blkno, false, 0
 	}
-	nblkno, err := idm.fs.balloc.Balloc(opid)
+	nblkno, err := idm._balloc(opid, prev)
 	return nblkno, true, err
 }
 
@@ -567,7 +864,11 @@ func (idm *imemnode_t) ensureind(opid opid_t, blk *Bdev_block_t, slot int, writi
 	off := slot * 8
 	s := blk.Data[:]
 	blkn := util.Readn(s, 8, off)
-	blkn, isnew, err := idm.ensureb(opid, blkn, writing)
+	prev := 0
+	if slot > 0 {
+		prev = util.Readn(s, 8, off-8)
+	}
+	blkn, isnew, err := idm.ensureb(opid, blkn, prev, writing)
 	if err != 0 {
 		return 0, err
 	}
@@ -578,6 +879,26 @@ func (idm *imemnode_t) ensureind(opid opid_t, blk *Bdev_block_t, slot int, writi
 	return blkn, 0
 }
 
+// returns the block number of entry fbn of the tree of indirect blocks with
+// the given depth rooted at indno.
+func (idm *imemnode_t) indwalk(opid opid_t, indno, fbn, depth int, writing bool) (int, defs.Err_t) {
+	span := 1
+	for i := 1; i < depth; i++ {
+		span *= INDADDR
+	}
+	blkn := indno
+	for ; span > 0; span /= INDADDR {
+		indblk := idm.mbread(blkn)
+		var err defs.Err_t
+		blkn, err = idm.ensureind(opid, indblk, (fbn/span)%INDADDR, writing)
+		idm.fs.fslog.Relse(indblk, "indwalk")
+		if err != 0 {
+			return 0, err
+		}
+	}
+	return blkn, 0
+}
+
 // Assumes that every block until b exits
 // XXX change to wrap blockiter_t instead
 func (idm *imemnode_t) fbn2block(opid opid_t, fbn int, writing bool) (int, bool, defs.Err_t) {
@@ -585,7 +906,11 @@ func (idm *imemnode_t) fbn2block(opid opid_t, fbn int, writing bool) (int, bool,
 		if idm.addrs[fbn] != 0 {
 			return idm.addrs[fbn], false, 0
 		}
-		blkn, err := idm.fs.balloc.Balloc(opid)
+		prev := 0
+		if fbn > 0 {
+			prev = idm.addrs[fbn-1]
+		}
+		blkn, err := idm._balloc(opid, prev)
 		if err != 0 {
 			return 0, false, err
 		}
@@ -593,47 +918,33 @@ func (idm *imemnode_t) fbn2block(opid opid_t, fbn int, writing bool) (int, bool,
 		// icache is updated on disk
 		idm.addrs[fbn] = blkn
 		return blkn, true, 0
-	} else {
-		fbn -= NIADDRS
-		if fbn < INDADDR {
-			indno := idm.indir
-			indno, isnew, err := idm.ensureb(opid, indno, writing)
-			if err != 0 {
-				return 0, false, err
-			}
-			if isnew {
-				// new indirect block will be written to log by iupdate()
-				idm.indir = indno
-			}
-			indblk := idm.mbread(indno)
-			blkn, err := idm.ensureind(opid, indblk, fbn, writing)
-			idm.fs.fslog.Relse(indblk, "indblk")
-			return blkn, false, err
-		} else if fbn < INDADDR*INDADDR {
-			fbn -= INDADDR
-			dindno := idm.dindir
-			dindno, isnew, err := idm.ensureb(opid, dindno, writing)
-			if err != 0 {
-				return 0, false, err
-			}
-			if isnew {
-				// new dindirect block will be written to log by iupdate()
-				idm.dindir = dindno
-			}
-			dindblk := idm.mbread(dindno)
-			indno, err := idm.ensureind(opid, dindblk, fbn/INDADDR, writing)
-			idm.fs.fslog.Relse(dindblk, "dindblk")
-
-			indblk := idm.mbread(indno)
-			blkn, err := idm.ensureind(opid, indblk, fbn%INDADDR, writing)
-			idm.fs.fslog.Relse(indblk, "indblk2")
-			return blkn, false, err
-		} else {
-			panic("too big fbn")
-			return 0, false, 0
-
-		}
 	}
+	// find the root and depth of the indirect block tree mapping fbn
+	fbn -= NIADDRS
+	var root *int
+	var depth int
+	switch {
+	case fbn < INDADDR:
+		root, depth = &idm.indir, 1
+	case fbn < INDADDR+INDADDR*INDADDR:
+		fbn -= INDADDR
+		root, depth = &idm.dindir, 2
+	case fbn < INDADDR+INDADDR*INDADDR+INDADDR*INDADDR*INDADDR:
+		fbn -= INDADDR + INDADDR*INDADDR
+		root, depth = &idm.tindir, 3
+	default:
+		return 0, false, -defs.EFBIG
+	}
+	indno, isnew, err := idm.ensureb(opid, *root, 0, writing)
+	if err != 0 {
+		return 0, false, err
+	}
+	if isnew {
+		// new indirect block will be written to log by iupdate()
+		*root = indno
+	}
+	blkn, err := idm.indwalk(opid, indno, fbn, depth, writing)
+	return blkn, false, err
 }
 
 func (idm *imemnode_t) bmapfill(opid opid_t, lastblk int, whichblk int, writing bool) (int, bool, defs.Err_t) {
@@ -783,6 +1094,9 @@ func (idm *imemnode_t) iwrite(opid opid_t, src fdops.Userio_i, offset int, n int
 		offset += read
 	}
 	wrote := c
+	if wrote != 0 {
+		idm._logged(false)
+	}
 	if newsz > idm.size {
 		idm.size = newsz
 	}
@@ -824,7 +1138,7 @@ func (idm *imemnode_t) create_undo(opid opid_t, childi defs.Inum_t, childn ustr.
 	return 0
 }
 
-func (idm *imemnode_t) icreate(opid opid_t, name ustr.Ustr, nitype, major, minor int) (*imemnode_t, defs.Err_t) {
+func (idm *imemnode_t) icreate(opid opid_t, name ustr.Ustr, nitype, major, minor int, own iowner_t) (*imemnode_t, defs.Err_t) {
 	// XXX XXX fail if links == 0
 	if !idm._amlocked {
 		panic("lsjdf")
@@ -849,6 +1163,7 @@ func (idm *imemnode_t) icreate(opid opid_t, name ustr.Ustr, nitype, major, minor
 
 	// allocate new inode
 	newinum, err := idm.fs.ialloc.Ialloc(opid)
+	now := fstime()
 	var newidm *imemnode_t
 	var newinode *Inode_t
 	if idm.fs.diskfs {
@@ -870,9 +1185,16 @@ func (idm *imemnode_t) icreate(opid opid_t, name ustr.Ustr, nitype, major, minor
 		newinode.w_minor(minor)
 		newinode.w_indirect(0)
 		newinode.w_dindirect(0)
+		newinode.w_tindirect(0)
 		for i := 0; i < NIADDRS; i++ {
 			newinode.W_addr(i, 0)
 		}
+		newinode.W_atime(now)
+		newinode.W_mtime(now)
+		newinode.W_ctime(now)
+		newinode.W_uid(own.uid)
+		newinode.W_gid(own.gid)
+		newinode.W_mode(own.mode)
 		newiblk.Unlock()
 		idm.fs.fslog.Write(opid, newiblk)
 		idm.fs.fslog.Relse(newiblk, "icreate")
@@ -884,6 +1206,12 @@ func (idm *imemnode_t) icreate(opid opid_t, name ustr.Ustr, nitype, major, minor
 		newidm.links = 1
 		newidm.major = major
 		newidm.minor = minor
+		newidm.atime = now
+		newidm.mtime = now
+		newidm.ctime = now
+		newidm.uid = own.uid
+		newidm.gid = own.gid
+		newidm.mode = own.mode
 		if newidm.itype == I_DIR {
 			newidm.dentc.dents = hashtable.MkHash(100)
 		}
@@ -953,15 +1281,36 @@ func (idm *imemnode_t) idibread() *Bdev_block_t {
 	return idm.fs.fslog.Get_fill(idm.fs.ialloc.Iblock(idm.inum), "idibread", true)
 }
 
+// the logical block indices walked by blockiter_t: first the data blocks,
+// then the indirect blocks referenced by the double-indirect block, the
+// indirect blocks referenced by the triple-indirect block's double-indirect
+// blocks, the double-indirect blocks referenced by the triple-indirect block,
+// and finally the indirect, double-indirect, and triple-indirect blocks of the
+// inode. thus a block is always freed after the blocks it references.
+const (
+	bi_data   = NIADDRS + INDADDR + INDADDR*INDADDR + INDADDR*INDADDR*INDADDR
+	bi_dind   = bi_data + INDADDR
+	bi_tind1  = bi_dind + INDADDR*INDADDR
+	bi_tind2  = bi_tind1 + INDADDR
+	bi_indir  = bi_tind2
+	bi_dindir = bi_tind2 + 1
+	bi_tindir = bi_tind2 + 2
+	bi_all    = bi_tind2 + 3
+)
+
 // a type to iterate over the data and indirect blocks of an imemnode_t without
 // re-reading and re-locking indirect blocks. it may simultaneously hold
-// references to at most two blocks until blockiter_t.release() is called.
+// references to at most four blocks until blockiter_t.release() is called.
 type blockiter_t struct {
 	idm      *imemnode_t
 	which    int
 	tryevict bool
 	dub      *Bdev_block_t
-	lasti    *Bdev_block_t
+	tub      *Bdev_block_t
+	// the last double-indirect block referenced by the triple-indirect
+	// block and the last indirect block
+	lastd *Bdev_block_t
+	lasti *Bdev_block_t
 }
 
 func (bl *blockiter_t) bi_init(idm *imemnode_t, tryevict bool) {
@@ -985,6 +1334,19 @@ func (bl *blockiter_t) _isdub() (*Bdev_block_t, bool) {
 	return bl.dub, true
 }
 
+// like _isdub, but for the triple-indirect block
+func (bl *blockiter_t) _istub() (*Bdev_block_t, bool) {
+	if bl.tub != nil {
+		return bl.tub, true
+	}
+	blkno := bl.idm.tindir
+	if blkno == 0 {
+		return nil, false
+	}
+	bl.tub = bl.idm.mbread(blkno)
+	return bl.tub, true
+}
+
 // returns the indirect block or block number from the given slot in the
 // indirect block
 func (bl *blockiter_t) _isdubind(dubslot int, fetch bool) (*Bdev_block_t, int, bool) {
@@ -1002,105 +1364,151 @@ func (bl *blockiter_t) _isdubind(dubslot int, fetch bool) (*Bdev_block_t, int, b
 	return ret, blkno, ok
 }
 
+// returns the double-indirect block or block number from the given slot in
+// the triple-indirect block
+func (bl *blockiter_t) _istubdub(tubslot int, fetch bool) (*Bdev_block_t, int, bool) {
+	tub, ok := bl._istub()
+	if !ok {
+		return nil, 0, false
+	}
+
+	blkno := util.Readn(tub.Data[:], 8, tubslot*8)
+	var ret *Bdev_block_t
+	ok = blkno != 0
+	if fetch {
+		ret, ok = bl._load(&bl.lastd, blkno)
+	}
+	return ret, blkno, ok
+}
+
+// returns the indirect block or block number referenced by the given slot of
+// the double-indirect block referenced by slot tubslot of the triple-indirect
+// block
+func (bl *blockiter_t) _istubind(tubslot, dubslot int, fetch bool) (*Bdev_block_t, int, bool) {
+	dub, _, ok := bl._istubdub(tubslot, true)
+	if !ok {
+		return nil, 0, false
+	}
+
+	blkno := util.Readn(dub.Data[:], 8, dubslot*8)
+	var ret *Bdev_block_t
+	ok = blkno != 0
+	if fetch {
+		ret, ok = bl._isind(blkno)
+	}
+	return ret, blkno, ok
+}
+
 func (bl *blockiter_t) _isind(blkno int) (*Bdev_block_t, bool) {
+	return bl._load(&bl.lasti, blkno)
+}
+
+// loads block blkno into the cached block *last, releasing the previously
+// cached block.
+func (bl *blockiter_t) _load(last **Bdev_block_t, blkno int) (*Bdev_block_t, bool) {
 	if blkno == 0 {
 		return nil, false
 	}
-	if bl.lasti != nil {
-		if bl.lasti.Block == blkno {
-			return bl.lasti, true
+	if *last != nil {
+		if (*last).Block == blkno {
+			return *last, true
 		}
-		bl.idm.fs.fslog.Relse(bl.lasti, "release")
+		bl.idm.fs.fslog.Relse(*last, "release")
 	}
-	bl.lasti = bl.idm.mbread(blkno)
+	*last = bl.idm.mbread(blkno)
 	if bl.tryevict && bl.idm.fs.diskfs {
-		bl.lasti.Tryevict()
+		(*last).Tryevict()
 	}
-	return bl.lasti, true
+	return *last, true
 }
 
 func (bl *blockiter_t) release() {
-	if bl.dub != nil {
-		bl.idm.fs.fslog.Relse(bl.dub, "release")
-		bl.dub = nil
-	}
-	if bl.lasti != nil {
-		bl.idm.fs.fslog.Relse(bl.lasti, "release")
-		bl.lasti = nil
+	for _, b := range []**Bdev_block_t{&bl.dub, &bl.tub, &bl.lastd,
+		&bl.lasti} {
+		if *b != nil {
+			bl.idm.fs.fslog.Relse(*b, "release")
+			*b = nil
+		}
 	}
 }
 
 // returns block number and the next slot to check for the given slot.
 func (bl *blockiter_t) next1(which int) (int, int) {
-	const DBLOCKS = NIADDRS + INDADDR + INDADDR*INDADDR
-	const INDBLOCKS = DBLOCKS + INDADDR
-	const IMD1 = INDBLOCKS
-	const IMD2 = INDBLOCKS + 1
-	const ALL = INDBLOCKS + 2
-
-	if which >= ALL {
+	if which >= bi_all {
 		panic("none left")
 	}
 
 	ret := -1
 	w := which
-	if w < DBLOCKS {
+	if w < bi_data {
+		blkno := 0
 		if w < NIADDRS {
-			blkno := bl.idm.addrs[w]
-			if blkno == 0 {
-				return -1, DBLOCKS
-			}
-			ret = blkno
+			blkno = bl.idm.addrs[w]
 		} else if w < NIADDRS+INDADDR {
 			w -= NIADDRS
-			blkno := 0
 			single, ok := bl._isind(bl.idm.indir)
 			if ok {
 				blkno = util.Readn(single.Data[:], 8, w*8)
 			}
-			if !ok || blkno == 0 {
-				return -1, DBLOCKS
-			}
-			ret = blkno
-		} else {
+		} else if w < NIADDRS+INDADDR+INDADDR*INDADDR {
 			w -= NIADDRS + INDADDR
 			dslot := w / INDADDR
 			islot := w % INDADDR
-			blkno := 0
 			single, _, ok := bl._isdubind(dslot, true)
 			if ok {
 				blkno = util.Readn(single.Data[:], 8, islot*8)
 			}
-			if !ok || blkno == 0 {
-				return -1, DBLOCKS
+		} else {
+			w -= NIADDRS + INDADDR + INDADDR*INDADDR
+			tslot := w / (INDADDR * INDADDR)
+			dslot := (w / INDADDR) % INDADDR
+			islot := w % INDADDR
+			single, _, ok := bl._istubind(tslot, dslot, true)
+			if ok {
+				blkno = util.Readn(single.Data[:], 8, islot*8)
 			}
-			ret = blkno
 		}
-	} else if w < INDBLOCKS {
-		w -= DBLOCKS
-		dslot := w % INDADDR
-		_, sblkno, ok := bl._isdubind(dslot, false)
+		// files have no holes, thus there are no data blocks after
+		// a missing one
+		if blkno == 0 {
+			return -1, bi_data
+		}
+		ret = blkno
+	} else if w < bi_dind {
+		w -= bi_data
+		_, sblkno, ok := bl._isdubind(w, false)
 		if !ok || sblkno == 0 {
-			return -1, IMD1
+			return -1, bi_dind
 		}
 		ret = sblkno
-	} else if w < ALL {
+	} else if w < bi_tind1 {
+		w -= bi_dind
+		_, sblkno, ok := bl._istubind(w/INDADDR, w%INDADDR, false)
+		if !ok || sblkno == 0 {
+			return -1, bi_tind1
+		}
+		ret = sblkno
+	} else if w < bi_tind2 {
+		w -= bi_tind1
+		_, dblkno, ok := bl._istubdub(w, false)
+		if !ok || dblkno == 0 {
+			return -1, bi_tind2
+		}
+		ret = dblkno
+	} else {
 		switch w {
 		default:
 			panic("huh?")
-		case IMD1:
-			if bl.idm.indir == 0 {
-				return -1, IMD2
-			}
+		case bi_indir:
 			ret = bl.idm.indir
-		case IMD2:
-			if bl.idm.dindir == 0 {
-				return -1, ALL
-			}
+		case bi_dindir:
 			ret = bl.idm.dindir
+		case bi_tindir:
+			ret = bl.idm.tindir
+		}
+		if ret == 0 {
+			return -1, w + 1
 		}
-	} else {
-		panic("bad which")
 	}
 	which++
 	return ret, which
@@ -1110,22 +1518,18 @@ func (bl *blockiter_t) next1(which int) (int, int) {
 // check, and whether any more blocks remain (so the caller can avoid acquiring
 // log admission spuriously).
 func (bl *blockiter_t) next(which int) (int, bool, int, bool) {
-	const DBLOCKS = NIADDRS + INDADDR + INDADDR*INDADDR
-	const INDBLOCKS = DBLOCKS + INDADDR
-	const ALL = INDBLOCKS + 2
-
 	ret := -1
-	for ret == -1 && which != ALL {
+	for ret == -1 && which != bi_all {
 		ret, which = bl.next1(which)
 	}
 	ok := ret != -1
 	remains := false
-	for ok && which != ALL {
+	for ok && which != bi_all {
 		d, next := bl.next1(which)
 		if d != -1 {
 			remains = true
 			break
-		} else if next == ALL {
+		} else if next == bi_all {
 			break
 		}
 		which = next
@@ -1143,14 +1547,13 @@ func (idm *imemnode_t) ifree() defs.Err_t {
 	// the imemnode_t.major field has a different meaning once a file's
 	// link count reaches 0: it becomes a logical index of which (data and
 	// indirect) blocks of a file have been freed. specifically, blocks in
-	// the range [0, major) have been freed. major refers to a data block
-	// when:
-	// 	major < DBLOCKS
-	// where DBLOCKS is NIADDRS+INDADDR+INDADDR*INDADDR, the indirect
-	// blocks referred to by the double-indirect block when
-	// 	DBLOCKS <= major < DBLOCKS + INDADDR, and the
-	// indirect/double-indirect itself when:
-	//	DBLOCKS+INADDR <= major DBLOCKS+INADDR+2
+	// the range [0, major) have been freed, where the indices are those
+	// walked by blockiter_t (see bi_data and friends).
+
+	// an inline symlink target is not a list of blocks
+	if idm.itype == I_SYMLINK && idm._slinline() {
+		idm.addrs = [NIADDRS]int{}
+	}
 
 	var ca res.Cacheallocs_t
 	gimme := bounds.Bounds(bounds.B_IMEMNODE_T_IFREE)
@@ -1212,12 +1615,13 @@ func (idm *imemnode_t) ifree() defs.Err_t {
 // used for {,f}stat
 func (idm *imemnode_t) mkmode() uint {
 	itype := idm.itype
+	perm := idm.mode & 07777
 	switch itype {
-	case I_DIR, I_FILE:
-		return uint(itype << 16)
+	case I_DIR, I_FILE, I_SYMLINK:
+		return uint(itype<<16) | perm
 	case I_DEV:
 		// this can happen by fs-internal stats
-		return defs.Mkdev(idm.major, idm.minor)
+		return defs.Mkdev(idm.major, idm.minor) | perm
 	default:
 		panic("weird itype")
 	}
@@ -1,6 +1,7 @@
 package fs
 
 import "fmt"
+import "hash/fnv"
 import "sync"
 
 import "mem"
@@ -27,7 +28,8 @@ const LogOffset = 1 // log block 0 is used for head
 // necessary in order to guarantee that the log is long enough for the allowed
 // number of concurrent fs syscalls.
 const MaxBlkPerOp = 10
-const MaxDescriptor = BSIZE / 8
+// the last word of a commit block holds the transaction's checksum
+const MaxDescriptor = BSIZE/8 - 1
 const MaxOrdered = 3000
 const EndDescriptor = 0
 const NCommitBlk = 1
@@ -36,6 +38,9 @@ const Canceled = -2
 type opid_t int
 type index_t uint64
 
+// transactions are numbered in the order in which they commit, starting at 1
+type transid_t uint64
+
 //
 // The public interface to the logging layer
 //
@@ -115,12 +120,15 @@ func (log *log_t) Force(doapply bool) {
 	log.Lock()
 	defer log.Unlock()
 
-	t := log.curtrans
+	log.stats.Nforce++
+	log._force(log.curtrans, doapply)
+}
 
+// commits t, which must be the current transaction, and waits for the commit
+// to finish. the caller must hold the log lock.
+func (log *log_t) _force(t *trans_t, doapply bool) {
 	s := stats.Rdtsc()
 
-	log.stats.Nforce++
-
 	if t.isempty() || t.forcedone {
 		log.stats.Nbatchforce++
 		return
@@ -158,6 +166,54 @@ func (log *log_t) Force(doapply bool) {
 	}
 }
 
+// Force_trans ensures that transaction tid and the transactions before it are
+// on disk, without forcing a later transaction. mtid is the last transaction
+// that modified the file being synced, which is later than tid if fdatasync
+// ignored its timestamp changes.
+func (log *log_t) Force_trans(tid, mtid transid_t) {
+	if !log.logging {
+		return
+	}
+
+	log.Lock()
+	defer log.Unlock()
+
+	log.stats.Nfsync++
+
+	if tid <= log.committed {
+		if mtid > log.committed {
+			log.stats.Nfsynctimes++
+		} else {
+			log.stats.Nfsyncclean++
+		}
+		return
+	}
+
+	t := log.curtrans
+	if t.id == tid {
+		log._force(t, false)
+		return
+	}
+
+	// tid is the transaction that the committer started committing early
+	s := stats.Rdtsc()
+	for log.committed < tid {
+		log.donecond.Wait()
+	}
+	log.stats.Forcecycles.Add(s)
+}
+
+// returns the id of the current transaction, to which the writes of the ops in
+// progress belong
+func (log *log_t) Transid() transid_t {
+	if !log.logging {
+		return 0
+	}
+	log.Lock()
+	defer log.Unlock()
+	return log.curtrans.id
+}
+
 // Write increments ref so that the log has always a valid ref to the buf's
 // page.  The logging layer refdowns when it it is done with the page.  The
 // caller of log_write shouldn't hold buf's lock.
@@ -321,7 +377,8 @@ func (ml *memlog_t) readdescriptor(i index_t) (*logdescriptor_t, *Bdev_block_t)
 	return ml.mkdescriptor(dblk), dblk
 }
 
-// Flush i
+// waits for outstanding writes and flushes the disk's write cache; a barrier
+// between the writes before and after it
 func (ml *memlog_t) flush() {
 	ider := MkRequest(nil, BDEV_FLUSH, true)
 	if ml.bcache.disk.Start(ider) {
@@ -334,9 +391,10 @@ func (ml *memlog_t) commit_head(head index_t) {
 	lh, headblk := ml.readhdr()
 	lh.w_head(head)
 	headblk.Unlock()
-	ml.bcache.Write_async(headblk)
 	s := stats.Rdtsc()
-	ml.flush() // commit log header
+	// the caller flushed the logged blocks, so the header need not wait
+	// for the rest of the disk's cache
+	ml.bcache.Write_fua(headblk) // commit log header
 	ml.stats.Headcycles.Add(s)
 	ml.bcache.Relse(headblk, "commit_done")
 }
@@ -346,9 +404,8 @@ func (ml *memlog_t) commit_tail(tail index_t) {
 	lh, headblk := ml.readhdr()
 	lh.w_tail(tail)
 	headblk.Unlock()
-	ml.bcache.Write_async(headblk)
 	s := stats.Rdtsc()
-	ml.flush() // commit log header
+	ml.bcache.Write_fua(headblk) // commit log header
 	ml.stats.Tailcycles.Add(s)
 	ml.bcache.Relse(headblk, "commit_tail")
 }
@@ -417,6 +474,7 @@ func (rl *revokelist_t) addRevokeRecord(blkno int, ml *memlog_t) {
 type trans_t struct {
 	forcecond      *sync.Cond
 	ml             *memlog_t
+	id             transid_t
 	start          index_t
 	head           index_t
 	inprogress     int        // ops in progress this transaction
@@ -434,6 +492,8 @@ type trans_t struct {
 
 func (log *log_t) mk_trans(start index_t, ml *memlog_t) *trans_t {
 	t := &trans_t{start: start, head: start + NCommitBlk}
+	t.id = log.nexttrans
+	log.nexttrans++
 	t.ml = ml
 	t.forcecond = sync.NewCond(log)
 	t.logged = MkBlkList()      // bounded by MaxDescriptor
@@ -588,6 +648,20 @@ func (trans *trans_t) write_ordered(ml *memlog_t) {
 	trans.ordered.Delete()
 }
 
+// writes the checksum of the transaction to its commit block db. a
+// transaction of only ordered writes has no commit block in the log, so its
+// start is its head and there is nothing to checksum.
+func (trans *trans_t) cksum(ml *memlog_t, db *logdescriptor_t) {
+	if trans.start == trans.head {
+		return
+	}
+	db.w_cksum(logcksum(trans.start, db, func(f func(*mem.Bytepg_t)) {
+		for i := trans.start + NCommitBlk; i != trans.head; i++ {
+			f(ml.getmemlog(i).Data)
+		}
+	}))
+}
+
 func (trans *trans_t) commit(tail index_t, ml *memlog_t) {
 	if log_debug {
 		fmt.Printf("commit: start %d head %d\n", trans.start, trans.head)
@@ -623,6 +697,7 @@ func (trans *trans_t) commit(tail index_t, ml *memlog_t) {
 		}
 	}
 	db.w_logdest(j, EndDescriptor) // marker
+	trans.cksum(ml, db)
 
 	if log_debug {
 		fmt.Printf("commit: commit descriptor block at %d:\n", trans.start)
@@ -675,12 +750,23 @@ type logstat_t struct {
 	Writecycles     stats.Cycles_t
 
 	Readcycles stats.Cycles_t
+
+	// fsync and fdatasync calls, and those that didn't force a commit
+	// because the file's transactions had already committed or, for
+	// fdatasync, because only the file's timestamps were uncommitted
+	Nfsync      stats.Counter_t
+	Nfsyncclean stats.Counter_t
+	Nfsynctimes stats.Counter_t
+
+	// transactions discarded by recovery because of a bad checksum
+	Nbadcksum stats.Counter_t
 }
 
 type log_t struct {
 	sync.Mutex
 	admissioncond *sync.Cond
 	commitcond    *sync.Cond
+	donecond      *sync.Cond
 	ml            *memlog_t
 	curtrans      *trans_t
 	tail          index_t
@@ -692,6 +778,10 @@ type log_t struct {
 	logging bool
 	nextop  opid_t
 	stats   logstat_t
+
+	nexttrans transid_t
+	// the last transaction that committed
+	committed transid_t
 }
 
 // first log header block format
@@ -743,13 +833,50 @@ func (ld *logdescriptor_t) w_logdest(p int, n int) {
 	fieldw(ld.data, p, n)
 }
 
+func (ld *logdescriptor_t) r_cksum() int {
+	return fieldr(ld.data, MaxDescriptor)
+}
+
+func (ld *logdescriptor_t) w_cksum(n int) {
+	fieldw(ld.data, MaxDescriptor, n)
+}
+
+// returns the number of log blocks in the transaction described by commit
+// block ld, including the commit block, or -1 if the descriptor isn't
+// terminated.
+func (ld *logdescriptor_t) nblks() int {
+	for j := 1; j < ld.max; j++ {
+		if ld.r_logdest(j) == EndDescriptor {
+			return NCommitBlk + j - 1
+		}
+	}
+	return -1
+}
+
+// the checksum of a transaction covers its position in the log, its commit
+// block (except for the checksum), and its revoke and logged blocks, so that
+// recovery can tell a completely written transaction from a torn one.
+func logcksum(start index_t, ld *logdescriptor_t, blks func(func(*mem.Bytepg_t))) int {
+	h := fnv.New64a()
+	var b [8]uint8
+	util.Writen(b[:], 8, 0, int(start))
+	h.Write(b[:])
+	h.Write(ld.data[:MaxDescriptor*8])
+	blks(func(d *mem.Bytepg_t) {
+		h.Write(d[:])
+	})
+	return int(h.Sum64())
+}
+
 func (log *log_t) mk_log(ls, ll int, bcache *bcache_t, logging bool) {
 	log.ml = mk_memlog(ls, ll, bcache)
 	log.admissioncond = sync.NewCond(log)
 	log.commitcond = sync.NewCond(log)
+	log.donecond = sync.NewCond(log)
 	log.stopc = make(chan bool)
 	log.translog = mkTransLog()
 	log.nextop = opid_t(1)
+	log.nexttrans = transid_t(1)
 	log.logging = logging
 }
 
@@ -893,6 +1020,8 @@ func (log *log_t) committer() {
 
 			t.forcedone = true
 			t.forcecond.Broadcast()
+			log.committed = t.id
+			log.donecond.Broadcast()
 
 			if t.forceapply || log.ml.almosthalffull(log.tail, t.head) {
 				log.cancel(log.tail, t.head, t.revokel)
@@ -1057,6 +1186,32 @@ func (log *log_t) install(tail, head index_t) {
 	}
 }
 
+// returns the end of the transactions in [tail, head) that precede the first
+// transaction whose checksum doesn't match.
+func (log *log_t) cksumok(tail, head index_t) index_t {
+	for i := tail; i != head; {
+		db, dblk := log.ml.readdescriptor(i)
+		n := db.nblks()
+		ok := db.r_logdest(0) == int(CommitBlk) && n > 0 &&
+			head-i >= index_t(n)
+		if ok {
+			ok = db.r_cksum() == logcksum(i, db, func(f func(*mem.Bytepg_t)) {
+				for k := i + NCommitBlk; k != i+index_t(n); k++ {
+					lb := log.ml.bcache.Get_fill(log.ml.diskindex(k), "cksum", false)
+					f(lb.Data)
+					log.ml.bcache.Relse(lb, "cksum")
+				}
+			})
+		}
+		log.ml.bcache.Relse(dblk, "cksumok")
+		if !ok {
+			return i
+		}
+		i += index_t(n)
+	}
+	return head
+}
+
 func (log *log_t) recover() {
 	lh, headblk := log.ml.readhdr()
 	tail := lh.r_tail()
@@ -1067,12 +1222,34 @@ func (log *log_t) recover() {
 	log.head = head
 
 	log.ml.bcache.Relse(headblk, "recover")
+	if head < tail || head-tail > index_t(log.ml.loglen) || head >= 1<<62 {
+		// garbage; there is nothing that can be installed, so start
+		// with an empty log
+		fmt.Printf("bad log header: tail %d head %d\n", tail, head)
+		log.stats.Nbadcksum++
+		log.ml.commit_head(0)
+		log.ml.commit_tail(0)
+		log.head, log.tail = 0, 0
+		return
+	}
 	if tail == head {
 		fmt.Printf("no FS recovery needed: head %d\n", head)
 		return
 	}
+	if valid := log.cksumok(tail, head); valid != head {
+		fmt.Printf("bad log checksum at %d; discarding log till %d\n",
+			valid, head)
+		log.stats.Nbadcksum++
+		head = valid
+		log.head = head
+		log.ml.commit_head(head)
+		if tail == head {
+			return
+		}
+	}
 	fmt.Printf("starting FS recovery start %d end %d\n", tail, head)
 	log.install(tail, head)
+	log.ml.flush() // installed blocks must be durable before the tail moves
 	log.ml.commit_tail(head)
 	log.tail = head
 
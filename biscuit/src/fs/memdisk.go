@@ -0,0 +1,135 @@
+package fs
+
+import "fmt"
+import "sync"
+
+import "mem"
+import "ustr"
+import "util"
+
+// a disk in RAM, which backs memory file systems. only blocks that have been
+// written are stored; the others read as zeros.
+type Memdisk_t struct {
+	sync.Mutex
+	blks   map[int]*mem.Bytepg_t
+	nblks  int
+	nread  int
+	nwrite int
+}
+
+// returns a memory disk formatted with an empty file system that has the
+// given number of inode and data blocks
+func MkMemdisk(ninodeblks, ndatablks int) *Memdisk_t {
+	md := &Memdisk_t{blks: make(map[int]*mem.Bytepg_t)}
+	md.format(ninodeblks, ndatablks)
+	return md
+}
+
+// lays out the file system the same way as mkfs: boot block, superblock,
+// log, orphan map, inode map, block map, inode blocks, and data blocks
+func (md *Memdisk_t) format(ninodeblks, ndatablks int) {
+	const nlogblks = 32
+	const nbits = BSIZE * 8
+
+	boot := md.blk(0)
+	util.Writen(boot[:], 4, FSOFF, 1)
+
+	sb := Superblock_t{md.blk(1)}
+	ni := ninodeblks*(BSIZE/ISIZE)/nbits + 1
+	nb := ndatablks/nbits + 1
+	sb.SetVersion(FSVERSION)
+	sb.SetLoglen(nlogblks)
+	sb.SetIorphanblock(2 + nlogblks)
+	sb.SetIorphanlen(ni)
+	sb.SetImaplen(ni)
+	sb.SetFreeblock(2 + nlogblks + 2*ni)
+	sb.SetFreeblocklen(nb)
+	sb.SetInodelen(ninodeblks)
+	md.nblks = 2 + nlogblks + 2*ni + nb + ninodeblks + ndatablks
+	sb.SetLastblock(md.nblks)
+
+	// mark the root inode and its directory block allocated, as well as
+	// the bits past the end of each map
+	imap := sb.Iorphanblock() + sb.Iorphanlen()
+	md.blk(imap)[0] |= 1
+	md.markrest(imap, ni, ninodeblks*(BSIZE/ISIZE))
+	md.blk(sb.Freeblock())[0] |= 1
+	md.markrest(sb.Freeblock(), nb, ndatablks)
+
+	inodes := sb.Freeblock() + sb.Freeblocklen()
+	firstdata := inodes + sb.Inodelen()
+	root := Inode_t{&Bdev_block_t{Data: md.blk(inodes)}, 0}
+	now := fstime()
+	root.W_itype(I_DIR)
+	root.W_linkcount(1)
+	root.W_size(BSIZE)
+	root.W_addr(0, firstdata)
+	root.W_atime(now)
+	root.W_mtime(now)
+	root.W_ctime(now)
+	root.W_mode(0755)
+
+	dd := Dirdata_t{md.blk(firstdata)[:]}
+	dd.W_filename(0, ustr.Ustr("."))
+	dd.W_inodenext(0, 0)
+	dd.W_filename(1, ustr.Ustr(".."))
+	dd.W_inodenext(1, 0)
+}
+
+// sets the bits of the map starting at block start, which is nblks long,
+// from bit n to the end
+func (md *Memdisk_t) markrest(start, nblks, n int) {
+	for i := n; i < nblks*BSIZE*8; i++ {
+		md.blk(start + i/(BSIZE*8))[(i%(BSIZE*8))/8] |= 1 << uint(i%8)
+	}
+}
+
+// returns block n, allocating it if it hasn't been written
+func (md *Memdisk_t) blk(n int) *mem.Bytepg_t {
+	d, ok := md.blks[n]
+	if !ok {
+		d = &mem.Bytepg_t{}
+		md.blks[n] = d
+	}
+	return d
+}
+
+// requests complete before Start returns
+func (md *Memdisk_t) Start(req *Bdev_req_t) bool {
+	md.Lock()
+	defer md.Unlock()
+
+	switch req.Cmd {
+	case BDEV_READ:
+		for b := req.Blks.FrontBlock(); b != nil; b = req.Blks.NextBlock() {
+			md.nread++
+			if d, ok := md.blks[b.Block]; ok {
+				*b.Data = *d
+			} else {
+				*b.Data = mem.Bytepg_t{}
+			}
+		}
+	case BDEV_WRITE, BDEV_WRITE_FUA:
+		for b := req.Blks.FrontBlock(); b != nil; b = req.Blks.NextBlock() {
+			if b.Block < 0 || b.Block >= md.nblks {
+				panic("memdisk write out of range")
+			}
+			md.nwrite++
+			*md.blk(b.Block) = *b.Data
+			b.Done("memdisk")
+		}
+	case BDEV_FLUSH:
+	}
+	return false
+}
+
+func (md *Memdisk_t) Nblocks() int {
+	return md.nblks
+}
+
+func (md *Memdisk_t) Stats() string {
+	md.Lock()
+	defer md.Unlock()
+	return fmt.Sprintf("memdisk: %v blocks, %v stored, %v reads, %v writes\n",
+		md.nblks, len(md.blks), md.nread, md.nwrite)
+}
@@ -0,0 +1,208 @@
+package fs
+
+import "cred"
+import "defs"
+import "fd"
+import "ustr"
+
+// the owner, group, and permission bits of a new inode
+type iowner_t struct {
+	uid  int
+	gid  int
+	mode uint
+}
+
+// returns the owner of a new inode created by cr in directory idm with
+// permission bits mode. like BSD, new inodes in a setgid directory get the
+// directory's group and new directories inherit the setgid bit. idm must be
+// locked.
+func (idm *imemnode_t) _mkowner(cr *cred.Cred_t, mode uint, isdir bool) iowner_t {
+	ret := iowner_t{uid: cr.Euid, gid: cr.Egid, mode: mode & 07777}
+	if idm.mode&defs.S_ISGID != 0 {
+		ret.gid = idm.gid
+		if isdir {
+			ret.mode |= defs.S_ISGID
+		}
+	}
+	if !isdir && ret.mode&defs.S_ISGID != 0 && !cr.Isroot() &&
+		!cr.Ingroup(ret.gid) {
+		ret.mode &^= defs.S_ISGID
+	}
+	return ret
+}
+
+// returns true if cr may access idm in the way described by want. the
+// lock-free namei calls _permits without holding idm's lock.
+func (idm *imemnode_t) _permits(cr *cred.Cred_t, want uint) bool {
+	return cr.Permits(idm.uid, idm.gid, idm.mode, want, idm.itype == I_DIR)
+}
+
+// returns true if cr may add or remove entries of directory idm
+func (idm *imemnode_t) _maydirw(cr *cred.Cred_t) bool {
+	return idm._permits(cr, cred.MAY_WRITE|cred.MAY_EXEC)
+}
+
+// returns true if cr, which may write directory idm, may also remove or
+// rename child. if idm's sticky bit is set, only the owner of child or idm
+// may. no one may remove an active swap file.
+func (idm *imemnode_t) _mayremove(cr *cred.Cred_t, child *imemnode_t) bool {
+	if child.swapfile {
+		return false
+	}
+	if idm.mode&defs.S_ISVTX == 0 || cr.Isroot() {
+		return true
+	}
+	return cr.Euid == child.uid || cr.Euid == idm.uid
+}
+
+// returns true if cr may set idm's times to atime and mtime. only the owner may
+// set a time other than the current time, which anyone who may write the file
+// may set.
+func (idm *imemnode_t) _mayutime(cr *cred.Cred_t, atime, mtime int) bool {
+	if cr.Isroot() || cr.Euid == idm.uid {
+		return true
+	}
+	if atime >= 0 || mtime >= 0 {
+		return false
+	}
+	return idm._permits(cr, cred.MAY_WRITE)
+}
+
+func (idm *imemnode_t) do_chmod(opid opid_t, cr *cred.Cred_t, mode uint) defs.Err_t {
+	if !cr.Isroot() && cr.Euid != idm.uid {
+		return -defs.EPERM
+	}
+	mode &= 07777
+	if !cr.Isroot() && idm.itype != I_DIR && !cr.Ingroup(idm.gid) {
+		mode &^= defs.S_ISGID
+	}
+	idm.mode = mode
+	idm.ctime = fstime()
+	return idm._iupdate(opid)
+}
+
+// an id of -1 is left unchanged. only root may change the owner; the owner
+// may change the group to one of its groups.
+func (idm *imemnode_t) do_chown(opid opid_t, cr *cred.Cred_t, uid, gid int) defs.Err_t {
+	if uid == -1 {
+		uid = idm.uid
+	}
+	if gid == -1 {
+		gid = idm.gid
+	}
+	if !cr.Isroot() {
+		if uid != idm.uid || cr.Euid != idm.uid {
+			return -defs.EPERM
+		}
+		if gid != idm.gid && !cr.Ingroup(gid) {
+			return -defs.EPERM
+		}
+	}
+	if idm.itype != I_DIR {
+		idm.mode &^= defs.S_ISUID | defs.S_ISGID
+	}
+	idm.uid = uid
+	idm.gid = gid
+	idm.ctime = fstime()
+	return idm._iupdate(opid)
+}
+
+func (fs *Fs_t) Fs_chmod(path ustr.Ustr, mode uint, cwd *fd.Cwd_t, cr *cred.Cred_t) defs.Err_t {
+	dead, err := fs.Fs_op_chmod(path, mode, cwd, cr)
+	if dead != nil {
+		dead.Free()
+	}
+	return err
+}
+
+// returns dead and error
+func (fs *Fs_t) Fs_op_chmod(path ustr.Ustr, mode uint, cwd *fd.Cwd_t, cr *cred.Cred_t) (*imemnode_t, defs.Err_t) {
+	opid := fs.fslog.Op_begin("Fs_chmod")
+	defer fs.fslog.Op_end(opid)
+
+	idm, dead, err := fs.fs_namei_locked(opid, path, cwd, cr, "Fs_chmod")
+	if err != 0 {
+		return dead, err
+	}
+	err = idm.do_chmod(opid, cr, mode)
+	if idm.iunlock_refdown("Fs_chmod") {
+		return idm, err
+	}
+	return nil, err
+}
+
+func (fs *Fs_t) Fs_chown(path ustr.Ustr, uid, gid int, cwd *fd.Cwd_t, cr *cred.Cred_t) defs.Err_t {
+	dead, err := fs.Fs_op_chown(path, uid, gid, cwd, cr)
+	if dead != nil {
+		dead.Free()
+	}
+	return err
+}
+
+// returns dead and error
+func (fs *Fs_t) Fs_op_chown(path ustr.Ustr, uid, gid int, cwd *fd.Cwd_t, cr *cred.Cred_t) (*imemnode_t, defs.Err_t) {
+	opid := fs.fslog.Op_begin("Fs_chown")
+	defer fs.fslog.Op_end(opid)
+
+	idm, dead, err := fs.fs_namei_locked(opid, path, cwd, cr, "Fs_chown")
+	if err != 0 {
+		return dead, err
+	}
+	err = idm.do_chown(opid, cr, uid, gid)
+	if idm.iunlock_refdown("Fs_chown") {
+		return idm, err
+	}
+	return nil, err
+}
+
+// returns 0 if cr may access the file at path in the way described by want,
+// which is a combination of cred.MAY_READ, cred.MAY_WRITE, and
+// cred.MAY_EXEC.
+func (fs *Fs_t) Fs_access(path ustr.Ustr, want uint, cwd *fd.Cwd_t, cr *cred.Cred_t) defs.Err_t {
+	idm, dead, err := fs.fs_namei_locked(opid_t(0), path, cwd, cr, "Fs_access")
+	if err != 0 {
+		if dead != nil {
+			dead.Free()
+		}
+		return err
+	}
+	if !idm._permits(cr, want) {
+		err = -defs.EACCES
+	}
+	if idm.iunlock_refdown("Fs_access") {
+		idm.Free()
+	}
+	return err
+}
+
+func (fo *fsfops_t) Fchmod(cr *cred.Cred_t, mode uint) defs.Err_t {
+	fo.Lock()
+	defer fo.Unlock()
+	if fo.count <= 0 {
+		return -defs.EBADF
+	}
+
+	opid := fo.fs.fslog.Op_begin("fchmod")
+	defer fo.fs.fslog.Op_end(opid)
+
+	idm := fo.fs.icache.Iref_locked(fo.priv, "fchmod")
+	err := idm.do_chmod(opid, cr, mode)
+	idm.iunlock_refdown("fchmod")
+	return err
+}
+
+func (fo *fsfops_t) Fchown(cr *cred.Cred_t, uid, gid int) defs.Err_t {
+	fo.Lock()
+	defer fo.Unlock()
+	if fo.count <= 0 {
+		return -defs.EBADF
+	}
+
+	opid := fo.fs.fslog.Op_begin("fchown")
+	defer fo.fs.fslog.Op_end(opid)
+
+	idm := fo.fs.icache.Iref_locked(fo.priv, "fchown")
+	err := idm.do_chown(opid, cr, uid, gid)
+	idm.iunlock_refdown("fchown")
+	return err
+}
@@ -38,6 +38,54 @@ func (sb *Superblock_t) Lastblock() int {
 	return fieldr(sb.Data, 7)
 }
 
+func (sb *Superblock_t) Version() int {
+	return fieldr(sb.Data, 8)
+}
+
+// the version of the on-disk format, which mkfs writes in the superblock.
+// images made before the version field existed have 0 there and 128-byte
+// inodes; version 1 has ISIZE-byte inodes.
+const FSVERSION = 1
+
+// the largest log that is accepted; the log is kept in memory
+const maxloglen = 1 << 13
+
+// returns true if the superblock at block start has the current format version
+// and the layout it describes is consistent and fits on a disk of nblks blocks
+// (unknown if nblks is 0): the
+// log, the orphan map, the inode map, the block map, the inodes, and the data
+// blocks follow each other and the maps cover all inodes and data blocks.
+// rejects garbage so that mounting it cannot crash log recovery.
+func (sb *Superblock_t) Valid(start, nblks int) bool {
+	const nbits = BSIZE * 8
+	const lim = 1 << 40
+	if sb.Version() != FSVERSION {
+		return false
+	}
+	ll, ob, ol := sb.Loglen(), sb.Iorphanblock(), sb.Iorphanlen()
+	il, fb, fl := sb.Imaplen(), sb.Freeblock(), sb.Freeblocklen()
+	inl, last := sb.Inodelen(), sb.Lastblock()
+	for _, v := range []int{ll, ob, ol, il, fb, fl, inl, last} {
+		if v <= 0 || v >= lim {
+			return false
+		}
+	}
+	data := fb + fl + inl
+	switch {
+	case ll <= LogOffset+2*MaxBlkPerOp || ll > maxloglen:
+		return false
+	case ob != start+1+ll || il != ol || fb != ob+ol+il:
+		return false
+	case inl*(BSIZE/ISIZE) > il*nbits:
+		return false
+	case data >= last || last-data > fl*nbits:
+		return false
+	case nblks != 0 && last > nblks:
+		return false
+	}
+	return true
+}
+
 // writing
 
 func (sb *Superblock_t) SetLoglen(ll int) {
@@ -71,3 +119,7 @@ func (sb *Superblock_t) SetInodelen(n int) {
 func (sb *Superblock_t) SetLastblock(n int) {
 	fieldw(sb.Data, 7, n)
 }
+
+func (sb *Superblock_t) SetVersion(n int) {
+	fieldw(sb.Data, 8, n)
+}
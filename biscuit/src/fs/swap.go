@@ -0,0 +1,111 @@
+package fs
+
+import "defs"
+import "fdops"
+import "mem"
+
+// a swap area on a disk, which holds swapped-out pages. slot i of the area is
+// block blks[i] of the disk, or block i if blks is nil.
+type Swapdev_t struct {
+	disk   Disk_i
+	blks   []int
+	nslots int
+	// the swap file, if any, which is referenced while it is a swap area
+	idm *imemnode_t
+}
+
+// returns a swap area that uses all of disk, which must not hold a file
+// system
+func MkSwapdisk(disk Disk_i) (*Swapdev_t, defs.Err_t) {
+	ds, ok := disk.(Disksize_i)
+	if !ok || ds.Nblocks() <= 0 {
+		return nil, -defs.EINVAL
+	}
+	return &Swapdev_t{disk: disk, nslots: ds.Nblocks()}, 0
+}
+
+// returns a swap area that uses the blocks of the file open as fops. the file
+// cannot be written, truncated, or removed until Release.
+func Swapfile(fops fdops.Fdops_i) (*Swapdev_t, defs.Err_t) {
+	fo, ok := fops.(*fsfops_t)
+	if !ok {
+		return nil, -defs.EINVAL
+	}
+	fo.Lock()
+	if fo.count <= 0 {
+		fo.Unlock()
+		return nil, -defs.EBADF
+	}
+	idm := fo.fs.icache.Iref(fo.priv, "swapfile")
+	fo.Unlock()
+	// mark the file before mapping its blocks so that they cannot be
+	// freed meanwhile
+	idm.ilock("swapfile")
+	if idm.itype != I_FILE || idm.swapfile {
+		idm.iunlock_refdown("swapfile")
+		return nil, -defs.EINVAL
+	}
+	idm.swapfile = true
+	idm.iunlock("swapfile")
+	sd := &Swapdev_t{disk: fo.fs.ahci, idm: idm}
+	blks, err := idm.do_swapmap()
+	if err == 0 && len(blks) == 0 {
+		err = -defs.EINVAL
+	}
+	if err != 0 {
+		sd.Release()
+		return nil, err
+	}
+	// the swap area is written directly to the disk, which the log must
+	// not overwrite with older contents of the blocks later
+	fo.fs.Fs_syncapply()
+	sd.blks = blks
+	sd.nslots = len(blks)
+	return sd, 0
+}
+
+// makes the swap file of sd an ordinary file again. sd must not be used
+// afterwards.
+func (sd *Swapdev_t) Release() {
+	if sd.idm == nil {
+		return
+	}
+	sd.idm.ilock("swapfile")
+	sd.idm.swapfile = false
+	sd.idm.iunlock_refdown("swapfile")
+	sd.idm = nil
+}
+
+func (sd *Swapdev_t) Nslots() int {
+	return sd.nslots
+}
+
+type swapcb_t struct{}
+
+func (swapcb_t) Relse(*Bdev_block_t, string) {
+}
+
+// returns a block for slot whose data is the page pg at p_pg
+func (sd *Swapdev_t) _mkblock(slot int, p_pg mem.Pa_t, pg *mem.Pg_t) *Bdev_block_t {
+	if slot < 0 || slot >= sd.nslots {
+		panic("bad swap slot")
+	}
+	blkn := slot
+	if sd.blks != nil {
+		blkn = sd.blks[slot]
+	}
+	b := MkBlock(blkn, "swap", nil, sd.disk, swapcb_t{})
+	b.Pa = p_pg
+	b.Data = mem.Pg2bytes(pg)
+	return b
+}
+
+func (sd *Swapdev_t) Swapread(slot int, p_pg mem.Pa_t, pg *mem.Pg_t) defs.Err_t {
+	sd._mkblock(slot, p_pg, pg).Read()
+	return 0
+}
+
+func (sd *Swapdev_t) Swapwrite(slot int, p_pg mem.Pa_t, pg *mem.Pg_t) defs.Err_t {
+	sd._mkblock(slot, p_pg, pg).Write()
+	return 0
+}
@@ -0,0 +1,252 @@
+package fs
+
+import "sync/atomic"
+import "unsafe"
+
+import "bpath"
+import "cred"
+import "defs"
+import "fd"
+import "fdops"
+import "stat"
+import "ustr"
+import "util"
+import "vm"
+
+// maximum number of symlinks followed during a single path lookup
+const maxsymlinks = 8
+
+// true iff the symlink's target is stored in the inode
+func (idm *imemnode_t) _slinline() bool {
+	return idm.size <= SYMINLINE
+}
+
+func (idm *imemnode_t) _slpack(target ustr.Ustr) {
+	var b [SYMINLINE]uint8
+	copy(b[:], target)
+	for i := range idm.addrs {
+		idm.addrs[i] = util.Readn(b[:], 8, i*8)
+	}
+}
+
+func (idm *imemnode_t) _slunpack() ustr.Ustr {
+	b := make([]uint8, SYMINLINE)
+	for i := range idm.addrs {
+		util.Writen(b, 8, i*8, idm.addrs[i])
+	}
+	return ustr.Ustr(b[:idm.size])
+}
+
+// returns the cached target of a symlink, or nil if it hasn't been read yet.
+// does not require the lock.
+func (idm *imemnode_t) _slcached() *ustr.Ustr {
+	p := (*unsafe.Pointer)(unsafe.Pointer(&idm.slink))
+	return (*ustr.Ustr)(atomic.LoadPointer(p))
+}
+
+func (idm *imemnode_t) _slcache(target ustr.Ustr) {
+	p := (*unsafe.Pointer)(unsafe.Pointer(&idm.slink))
+	atomic.StorePointer(p, unsafe.Pointer(&target))
+}
+
+// idm must be locked. returns the target of the symlink.
+func (idm *imemnode_t) readlink() (ustr.Ustr, defs.Err_t) {
+	if idm.itype != I_SYMLINK {
+		panic("not a symlink")
+	}
+	if t := idm._slcached(); t != nil {
+		return *t, 0
+	}
+	var ret ustr.Ustr
+	if idm._slinline() {
+		ret = idm._slunpack()
+	} else {
+		buf := make([]uint8, idm.size)
+		ub := &vm.Fakeubuf_t{}
+		ub.Fake_init(buf)
+		n, err := idm.iread(ub, 0)
+		if err != 0 {
+			return nil, err
+		}
+		ret = ustr.Ustr(buf[:n])
+	}
+	idm._slcache(ret)
+	return ret, 0
+}
+
+// idm must be locked and a newly created symlink.
+func (idm *imemnode_t) iwritelink(opid opid_t, target ustr.Ustr) defs.Err_t {
+	if idm.itype != I_SYMLINK || idm.size != 0 {
+		panic("bad symlink")
+	}
+	t := make(ustr.Ustr, len(target))
+	copy(t, target)
+	if len(t) <= SYMINLINE {
+		idm.size = len(t)
+		idm._slpack(t)
+	} else {
+		ub := &vm.Fakeubuf_t{}
+		ub.Fake_init(t)
+		if _, err := idm.iwrite(opid, ub, 0, len(t)); err != 0 {
+			return err
+		}
+	}
+	idm._slcache(t)
+	idm._iupdate(opid)
+	return 0
+}
+
+func (idm *imemnode_t) do_createsymlink(opid opid_t, fn ustr.Ustr, own iowner_t) (*imemnode_t, defs.Err_t) {
+	if idm.itype != I_DIR {
+		return nil, -defs.ENOTDIR
+	}
+
+	itype := I_SYMLINK
+	child, err := idm.icreate(opid, fn, itype, 0, 0, own)
+	idm._iupdate(opid)
+	return child, err
+}
+
+// a symlink reached by a lookup: the bounds of its component in the path and
+// its target
+type slink_t struct {
+	coff, cend int
+	target     ustr.Ustr
+}
+
+// returns the path resulting from replacing the component of paths at
+// [coff, cend) with the symlink target.
+func _slsplice(paths ustr.Ustr, coff, cend int, target ustr.Ustr) ustr.Ustr {
+	rest := paths[cend:]
+	var pre ustr.Ustr
+	if !target.IsAbsolute() {
+		pre = paths[:coff]
+	}
+	ret := make(ustr.Ustr, 0, len(pre)+len(target)+1+len(rest))
+	ret = append(ret, pre...)
+	ret = append(ret, target...)
+	if len(rest) != 0 && rest[0] != '/' {
+		ret = append(ret, '/')
+	}
+	ret = append(ret, rest...)
+	return ret
+}
+
+func (fs *Fs_t) Fs_symlink(target, paths ustr.Ustr, cwd *fd.Cwd_t, cr *cred.Cred_t) defs.Err_t {
+	refs, dead, err := fs.Fs_op_symlink(target, paths, cwd, cr)
+	for _, ref := range refs {
+		if ref.Refdown("") {
+			ref.Free()
+		}
+	}
+	if dead != nil {
+		dead.Free()
+	}
+	return err
+}
+
+// returns refs, dead, and error
+func (fs *Fs_t) Fs_op_symlink(target, paths ustr.Ustr, cwd *fd.Cwd_t, cr *cred.Cred_t) ([]*imemnode_t, *imemnode_t, defs.Err_t) {
+	if len(target) == 0 {
+		return nil, nil, -defs.ENOENT
+	}
+	if len(target) > NAME_MAX {
+		return nil, nil, -defs.ENAMETOOLONG
+	}
+
+	opid := fs.fslog.Op_begin("fs_symlink")
+	defer fs.fslog.Op_end(opid)
+
+	fs.istats.Nsymlink.Inc()
+
+	dirs, fn := bpath.Sdirname(paths)
+	if err, ok := crname(fn, -defs.EEXIST); !ok {
+		return nil, nil, err
+	}
+	if len(fn) > DNAMELEN {
+		return nil, nil, -defs.ENAMETOOLONG
+	}
+
+	par, dead, err := fs.fs_namei_locked(opid, dirs, cwd, cr, "symlink")
+	if err != 0 {
+		return nil, dead, err
+	}
+	if !par._maydirw(cr) {
+		par.iunlock("fs_symlink_par")
+		return []*imemnode_t{par}, nil, -defs.EACCES
+	}
+
+	// the mode of a symlink is never used
+	child, err := par.do_createsymlink(opid, fn, par._mkowner(cr, 0777, false))
+	if err != 0 {
+		par.iunlock("fs_symlink_par")
+		refs := []*imemnode_t{par}
+		if child != nil {
+			refs = append(refs, child)
+		}
+		return refs, nil, err
+	}
+	defer par.iunlock("fs_symlink_par")
+	child.ilock("")
+	defer child.iunlock("")
+
+	if err = child.iwritelink(opid, target); err != 0 {
+		_, nerr := par.iunlink(opid, fn)
+		if nerr != 0 {
+			panic("must succeed")
+		}
+		child._linkdown(opid)
+	}
+	return []*imemnode_t{par, child}, nil, err
+}
+
+// copies the target of the symlink at paths to dst, returning the number of
+// bytes copied.
+func (fs *Fs_t) Fs_readlink(paths ustr.Ustr, dst fdops.Userio_i, cwd *fd.Cwd_t, cr *cred.Cred_t) (int, defs.Err_t) {
+	idm, dead, err := fs.fs_lnamei_locked(opid_t(0), paths, cwd, cr, "Fs_readlink")
+	if err != 0 {
+		if dead != nil {
+			dead.Free()
+		}
+		return 0, err
+	}
+	ret := 0
+	if idm.itype != I_SYMLINK {
+		err = -defs.EINVAL
+	} else {
+		var t ustr.Ustr
+		t, err = idm.readlink()
+		if err == 0 {
+			ret, err = dst.Uiowrite(t)
+		}
+	}
+	if idm.iunlock_refdown("Fs_readlink") {
+		idm.Free()
+	}
+	return ret, err
+}
+
+// like Fs_stat, but does not follow a symlink in the last path component
+func (fs *Fs_t) Fs_lstat(path ustr.Ustr, st *stat.Stat_t, cwd *fd.Cwd_t, cr *cred.Cred_t) defs.Err_t {
+	return fs._fs_stat(path, st, cwd, cr, false)
+}
+
+// looks up paths without following symlinks. returns the offset in paths of
+// the end of the first component that is a symlink, along with its target, or
+// len(paths) and nil if there is none.
+func (fs *Fs_t) Fs_walk(paths ustr.Ustr, cwd *fd.Cwd_t, cr *cred.Cred_t) (int, ustr.Ustr, defs.Err_t) {
+	idm, dead, sl, err := fs._fs_namei_walk(opid_t(0), paths, cwd, cr, true)
+	if err != 0 {
+		if dead != nil {
+			dead.Free()
+		}
+		return 0, nil, err
+	}
+	if sl != nil {
+		return sl.cend, sl.target, 0
+	}
+	if idm.iunlock_refdown("Fs_walk") {
+		idm.Free()
+	}
+	return len(paths), nil, 0
+}
@@ -0,0 +1,76 @@
+package main
+
+import "encoding/json"
+import "flag"
+import "fmt"
+import "os"
+
+import "ufs"
+
+// exit statuses, like e2fsck
+const (
+	exitok      = 0
+	exitfixed   = 1
+	exitunfixed = 4
+	exiterror   = 8
+)
+
+func main() {
+	repair := flag.Bool("y", false, "repair the file system")
+	jsonout := flag.Bool("json", false, "print the report as JSON")
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: fsck [-y] [-json] <image>\n")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() != 1 {
+		flag.Usage()
+		os.Exit(exiterror)
+	}
+
+	rep, err := ufs.Fsck(flag.Arg(0), *repair)
+	if rep == nil {
+		fmt.Fprintf(os.Stderr, "fsck: %v\n", err)
+		os.Exit(exiterror)
+	}
+	if *jsonout {
+		b, err := json.MarshalIndent(rep, "", "  ")
+		if err != nil {
+			panic(err)
+		}
+		fmt.Printf("%s\n", b)
+	} else {
+		for _, p := range rep.Problems {
+			fixed := ""
+			if p.Fixed {
+				fixed = " (fixed)"
+			}
+			fmt.Printf("%s: inode %d block %d: %s%s\n", p.Kind, p.Inum,
+				p.Block, p.Detail, fixed)
+		}
+		if rep.Logblks != 0 {
+			fmt.Printf("replayed %d log blocks\n", rep.Logblks)
+		}
+		if len(rep.Orphans) != 0 {
+			fmt.Printf("freed %d orphan inodes\n", len(rep.Orphans))
+		}
+		fmt.Printf("%d inodes (%d dirs, %d files, %d symlinks, %d devices), %d blocks\n",
+			rep.Ninodes, rep.Ndirs, rep.Nfiles, rep.Nsymlinks, rep.Ndevs,
+			rep.Nblocks)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "fsck: %v\n", err)
+		os.Exit(exiterror)
+	}
+
+	nprobs, nfixed := rep.Nprobs()
+	switch {
+	case rep.Fatal:
+		os.Exit(exiterror)
+	case nfixed != nprobs:
+		os.Exit(exitunfixed)
+	case nfixed != 0:
+		os.Exit(exitfixed)
+	}
+	os.Exit(exitok)
+}
@@ -174,6 +174,11 @@ func (i4 *Ip4hdr_t) Init_tcp(tcplen int, sip, dip Ip4_t) {
 	i4._init(tcplen, sip, dip, tcp)
 }
 
+func (i4 *Ip4hdr_t) Init_udp(udplen int, sip, dip Ip4_t) {
+	udp := uint8(0x11)
+	i4._init(udplen, sip, dip, udp)
+}
+
 func (i4 *Ip4hdr_t) Bytes() []uint8 {
 	return (*[IP4LEN]uint8)(unsafe.Pointer(i4))[:]
 }
@@ -450,6 +455,62 @@ func (tp *Tcppkt_t) Hdrbytes() ([]uint8, []uint8, []uint8) {
 	return tp.Ether.Bytes(), tp.Iphdr.Bytes(), tp.Tcphdr.Bytes()
 }
 
+type Udphdr_t struct {
+	Sport Be16
+	Dport Be16
+	Len   Be16
+	Cksum Be16
+}
+
+const UDPLEN = int(unsafe.Sizeof(Udphdr_t{}))
+
+func (u *Udphdr_t) Init(sport, dport uint16, dlen int) {
+	var z Udphdr_t
+	*u = z
+	u.Sport = Htons(sport)
+	u.Dport = Htons(dport)
+	u.Len = Htons(uint16(UDPLEN + dlen))
+}
+
+func (u *Udphdr_t) Bytes() []uint8 {
+	return (*[UDPLEN]uint8)(unsafe.Pointer(u))[:]
+}
+
+func Sl2udphdr(buf []uint8) (*Udphdr_t, []uint8, bool) {
+	if len(buf) < UDPLEN {
+		return nil, nil, false
+	}
+	p := (*Udphdr_t)(unsafe.Pointer(&buf[0]))
+	rest := buf[UDPLEN:]
+	return p, rest, true
+}
+
+type Udppkt_t struct {
+	Ether  Etherhdr_t
+	Iphdr  Ip4hdr_t
+	Udphdr Udphdr_t
+}
+
+// writes the uncomplemented pseudo header partial cksum to the UDP header
+// cksum field, like Tcppkt_t.Crc.
+func (up *Udppkt_t) Crc(l4len int, sip, dip Ip4_t) {
+	sum := uint32(uint16(sip))
+	sum += uint32(uint16(sip >> 16))
+	sum += uint32(uint16(dip))
+	sum += uint32(uint16(dip >> 16))
+	sum += uint32(up.Iphdr.Proto)
+	sum += uint32(l4len)
+	lm := uint32(^uint16(0))
+	for sum&^0xffff != 0 {
+		sum = (sum >> 16) + (sum & lm)
+	}
+	up.Udphdr.Cksum = Htons(uint16(sum))
+}
+
+func (up *Udppkt_t) Hdrbytes() ([]uint8, []uint8, []uint8) {
+	return up.Ether.Bytes(), up.Iphdr.Bytes(), up.Udphdr.Bytes()
+}
+
 type Icmppkt_t struct {
 	Ether Etherhdr_t
 	Iphdr Ip4hdr_t
@@ -434,6 +434,22 @@ func (td *txdesc_t) ctxt_tcp(_maclen, _ip4len int) {
 	td.hwdesc.rest |= tcp
 }
 
+func (td *txdesc_t) ctxt_udp(_maclen, _ip4len int) {
+	td.ctxt = true
+	td.eop = false
+	maclen := uint64(_maclen)
+	td.hwdesc.p_addr = maclen << 9
+	hlen := uint64(_ip4len)
+	td.hwdesc.p_addr |= hlen
+	// DTYP = 0010b
+	td.hwdesc.rest = 0x2 << 20
+	// DEXT = 1
+	td.hwdesc.rest |= 1 << 29
+	// TUCMD.IPV4 = 1, TUCMD.L4T = 0 (UDP)
+	ipv4 := uint64(1 << 10)
+	td.hwdesc.rest |= ipv4
+}
+
 func (td *txdesc_t) ctxt_tcp_tso(_maclen, _ip4len, _l4hdrlen, _mss int) {
 	td.ctxt = true
 	td.eop = false
@@ -543,6 +559,12 @@ func (td *txdesc_t) mktcp(src [][]uint8, tlen int) [][]uint8 {
 	return ret
 }
 
+// offloads IPv4/UDP checksum to the NIC. returns the remaining bytes.
+func (td *txdesc_t) mkudp(src [][]uint8, tlen int) [][]uint8 {
+	// the L4 type is in the context descriptor
+	return td.mktcp(src, tlen)
+}
+
 // offloads segmentation and checksums to the NIC. the TCP header's
 // pseudo-header checksum must not include the length.
 func (td *txdesc_t) mktcp_tso(src [][]uint8, tcphlen, tlen int) [][]uint8 {
@@ -642,6 +664,7 @@ type ixgbetx_t struct {
 	// cache of most recent context descriptor parameters
 	cc struct {
 		istcp bool
+		isudp bool
 		ethl  int
 		ip4l  int
 	}
@@ -909,27 +932,31 @@ func (x *ixgbe_t) Lmac() *Mac_t {
 // returns after buf is enqueued to be trasmitted. buf's contents are copied to
 // the DMA buffer, so buf's memory can be reused/freed
 func (x *ixgbe_t) Tx_raw(buf [][]uint8) bool {
-	return x._tx_nowait(buf, false, false, false, 0, 0)
+	return x._tx_nowait(buf, false, false, false, false, 0, 0)
 }
 
 func (x *ixgbe_t) Tx_ipv4(buf [][]uint8) bool {
-	return x._tx_nowait(buf, true, false, false, 0, 0)
+	return x._tx_nowait(buf, true, false, false, false, 0, 0)
 }
 
 func (x *ixgbe_t) Tx_tcp(buf [][]uint8) bool {
-	return x._tx_nowait(buf, true, true, false, 0, 0)
+	return x._tx_nowait(buf, true, true, false, false, 0, 0)
 }
 
 func (x *ixgbe_t) Tx_tcp_tso(buf [][]uint8, tcphlen, mss int) bool {
-	return x._tx_nowait(buf, true, true, true, tcphlen, mss)
+	return x._tx_nowait(buf, true, true, false, true, tcphlen, mss)
+}
+
+func (x *ixgbe_t) Tx_udp(buf [][]uint8) bool {
+	return x._tx_nowait(buf, true, false, true, false, 0, 0)
 }
 
-func (x *ixgbe_t) _tx_nowait(buf [][]uint8, ipv4, tcp, tso bool, tcphlen,
-	mss int) bool {
+func (x *ixgbe_t) _tx_nowait(buf [][]uint8, ipv4, tcp, udp, tso bool,
+	tcphlen, mss int) bool {
 	tq := runtime.CPUHint()
 	myq := &x.txs[tq%len(x.txs)]
 	myq.Lock()
-	ok := x._tx_enqueue(myq, buf, ipv4, tcp, tso, tcphlen, mss)
+	ok := x._tx_enqueue(myq, buf, ipv4, tcp, udp, tso, tcphlen, mss)
 	myq.Unlock()
 	if !ok {
 		fmt.Printf("tx packet(s) dropped!\n")
@@ -938,21 +965,23 @@ func (x *ixgbe_t) _tx_nowait(buf [][]uint8, ipv4, tcp, tso bool, tcphlen,
 }
 
 // returns true if the header sizes or context type have changed and thus a new
-// context descriptor should be created. the TCP context descriptor includes
-// IPV4 parameters. alternatively, we could simultaneously use both of the
-// x540's context slots.
-func (x *ixgbe_t) _ctxt_update(myq *ixgbetx_t, ipv4, tcp bool, ethl,
+// context descriptor should be created. the TCP and UDP context descriptors
+// include IPV4 parameters. alternatively, we could simultaneously use both of
+// the x540's context slots.
+func (x *ixgbe_t) _ctxt_update(myq *ixgbetx_t, ipv4, tcp, udp bool, ethl,
 	ip4l int) bool {
-	if !ipv4 && !tcp {
+	if !ipv4 && !tcp && !udp {
 		return false
 	}
 	cc := &myq.cc
 	wastcp := cc.istcp
+	wasudp := cc.isudp
 	pdiffer := cc.ethl != ethl || cc.ip4l != ip4l
-	if tcp == wastcp && !pdiffer {
+	if tcp == wastcp && udp == wasudp && !pdiffer {
 		return false
 	}
 	cc.istcp = tcp
+	cc.isudp = udp
 	cc.ethl = ethl
 	cc.ip4l = ip4l
 	return true
@@ -961,7 +990,7 @@ func (x *ixgbe_t) _ctxt_update(myq *ixgbetx_t, ipv4, tcp bool, ethl,
 // caller must hold the ixgbetx_t's lock. returns true if buf was copied to the
 // transmission queue.
 func (x *ixgbe_t) _tx_enqueue(myq *ixgbetx_t, buf [][]uint8, ipv4, tcp,
-	tso bool, tcphlen, mss int) bool {
+	udp, tso bool, tcphlen, mss int) bool {
 	if len(buf) == 0 {
 		panic("wut")
 	}
@@ -987,8 +1016,8 @@ func (x *ixgbe_t) _tx_enqueue(myq *ixgbetx_t, buf [][]uint8, ipv4, tcp,
 	}
 	need := tlen
 	newtail := tail
-	ctxtstale := (ipv4 || tcp) && x._ctxt_update(myq, ipv4, tcp, ETHERLEN,
-		IP4LEN)
+	ctxtstale := (ipv4 || tcp || udp) && x._ctxt_update(myq, ipv4, tcp,
+		udp, ETHERLEN, IP4LEN)
 	if ctxtstale || tso {
 		// segmentation offload requires a per-packet context
 		// descriptor
@@ -1057,6 +1086,14 @@ func (x *ixgbe_t) _tx_enqueue(myq *ixgbetx_t, buf [][]uint8, ipv4, tcp,
 			fd.wbwait()
 		}
 		buf = fd.mktcp(buf, tlen)
+	} else if udp {
+		if ctxtstale {
+			fd.ctxt_udp(ETHERLEN, IP4LEN)
+			tail = (tail + 1) % myq.ndescs
+			fd = &myq.descs[tail]
+			fd.wbwait()
+		}
+		buf = fd.mkudp(buf, tlen)
 	} else if ipv4 {
 		if ctxtstale {
 			fd.ctxt_ipv4(ETHERLEN, IP4LEN)
@@ -0,0 +1,342 @@
+package main
+
+import "fmt"
+import "sort"
+import "sync"
+
+import "bounds"
+import "defs"
+import "fd"
+import "fs"
+import "mem"
+import "proc"
+import "res"
+import "ustr"
+import "util"
+import "vm"
+
+// a core file is an ELF file whose PT_NOTE segment describes the process and
+// the registers of each of its threads, and whose PT_LOAD segments hold the
+// contents of its memory. the layout is Linux's so that gdb can read it.
+const (
+	EM_X86_64   = 62
+	NT_PRSTATUS = 1
+	NT_PRPSINFO = 3
+)
+
+// the sizes of the ELF header, of a program header, and of Linux's struct
+// elf_prstatus and struct elf_prpsinfo on amd64
+const (
+	core_ehsz     = 64
+	core_phsz     = 56
+	core_prstatus = 336
+	core_prpsinfo = 136
+)
+
+// the trap frame index of each register of Linux's struct user_regs_struct,
+// which is what gdb expects in NT_PRSTATUS. -1 marks orig_rax, which is only
+// meaningful in a system call, and the segment registers and GS base, which
+// user programs do not use; they are written as zero.
+var coreregs = [...]int{
+	defs.TF_R15, defs.TF_R14, defs.TF_R13, defs.TF_R12, defs.TF_RBP,
+	defs.TF_RBX, defs.TF_R11, defs.TF_R10, defs.TF_R9, defs.TF_R8,
+	defs.TF_RAX, defs.TF_RCX, defs.TF_RDX, defs.TF_RSI, defs.TF_RDI,
+	-1, defs.TF_RIP, defs.TF_CS, defs.TF_RFLAGS, defs.TF_RSP, defs.TF_SS,
+	defs.TF_FSBASE, -1, -1, -1, -1, -1,
+}
+
+// a thread's state at the time of the dump
+type corethread_t struct {
+	tid     defs.Tid_t
+	tf      [defs.TFSIZE]uintptr
+	sigmask uint64
+	sigpend uint64
+}
+
+// a mapping of the process; only the pages of a dumped mapping are written.
+// read-only file mappings are not dumped since gdb reads them from the file.
+type coreseg_t struct {
+	va    int
+	len   int
+	flags int
+	file  bool
+	dump  bool
+}
+
+// the directory in which processes killed by a fault leave their core files,
+// or empty for the working directory of the process. root sets it with
+// coredir(2).
+var coredir struct {
+	sync.Mutex
+	dir ustr.Ustr
+}
+
+// sets the directory of core files; a relative path is relative to the
+// working directory of the dumping process
+func sys_coredir(p *proc.Proc_t, dirn int) int {
+	if !p.Cred().Isroot() {
+		return int(-defs.EPERM)
+	}
+	dir, err := p.Vm.Userstr(dirn, fs.NAME_MAX)
+	if err != 0 {
+		return int(err)
+	}
+	coredir.Lock()
+	coredir.dir = dir
+	coredir.Unlock()
+	return 0
+}
+
+// writes the core file of p, which sig is about to kill, to core.<pid> in
+// coredir or in p's working directory. the other threads are not stopped
+// first; their registers are those they had when they last entered the
+// kernel. the file is truncated at p's RLIMIT_CORE.
+func (s *syscall_t) Sys_coredump(p *proc.Proc_t, tid defs.Tid_t, sig int) bool {
+	// a set-user-ID program may have secrets in its memory that its
+	// invoker must not be able to read.
+	cr := p.Cred()
+	if cr.Euid != cr.Ruid || cr.Egid != cr.Rgid {
+		return false
+	}
+	lim := p.Ulim.Core
+	if lim == 0 {
+		return false
+	}
+	gimme := bounds.Bounds(bounds.B_SYSCALL_T_SYS_COREDUMP)
+	if !res.Resadd(gimme) {
+		return false
+	}
+
+	threads := corethreads(p, tid)
+	segs := coresegs(p)
+	// the number of program headers must fit in e_phnum
+	if len(segs)+1 >= 0xffff {
+		return false
+	}
+	hdr := coreheader(p, sig, threads, segs)
+	if uint(len(hdr)) > lim {
+		return false
+	}
+
+	name := fmt.Sprintf("core.%d", p.Pid)
+	coredir.Lock()
+	if len(coredir.dir) != 0 {
+		name = coredir.dir.String() + "/" + name
+	}
+	coredir.Unlock()
+	flags := defs.O_WRONLY | defs.O_CREAT | defs.O_TRUNC | defs.O_NOFOLLOW
+	f, err := thefs.Fs_open(ustr.Ustr(name), flags, 0600, p.Cwd, cr, 0, 0)
+	if err != 0 {
+		return false
+	}
+	defer fd.Close_panic(f)
+
+	if corewrite(f, hdr, 0) != 0 {
+		return false
+	}
+	off := len(hdr)
+	buf := make([]uint8, mem.PGSIZE)
+	for _, seg := range segs {
+		if !seg.dump {
+			continue
+		}
+		for va := seg.va; va < seg.va+seg.len; va += mem.PGSIZE {
+			if uint(off+mem.PGSIZE) > lim {
+				return true
+			}
+			if !res.Resadd(gimme) {
+				return false
+			}
+			corepage(p, va, seg.file, buf)
+			if corewrite(f, buf, off) != 0 {
+				return false
+			}
+			off += mem.PGSIZE
+		}
+	}
+	return true
+}
+
+// returns the state of p's threads, tid's first. threads that have not run
+// yet have no registers and are omitted.
+func corethreads(p *proc.Proc_t, tid defs.Tid_t) []corethread_t {
+	var ret []corethread_t
+	p.Sigl.Lock()
+	p.Threadi.Lock()
+	for t, n := range p.Threadi.Notes {
+		if n.Tf == nil {
+			continue
+		}
+		ret = append(ret, corethread_t{tid: t, tf: *n.Tf,
+			sigmask: n.Sigmask, sigpend: n.Sigpend})
+	}
+	p.Threadi.Unlock()
+	p.Sigl.Unlock()
+	sort.Slice(ret, func(i, j int) bool {
+		if ret[i].tid == tid || ret[j].tid == tid {
+			return ret[i].tid == tid
+		}
+		return ret[i].tid < ret[j].tid
+	})
+	return ret
+}
+
+// returns p's mappings in address order
+func coresegs(p *proc.Proc_t) []coreseg_t {
+	var ret []coreseg_t
+	p.Vm.Lock_pmap()
+	p.Vm.Vmregion.Iter(func(vmi *vm.Vminfo_t) {
+		seg := coreseg_t{va: int(vmi.Pgn << vm.PGSHIFT),
+			len: vmi.Pglen * mem.PGSIZE, file: vmi.Mtype == vm.VFILE}
+		// there is no NX; every readable page is executable
+		if vmi.Perms != 0 {
+			seg.flags = PF_R | PF_X
+			seg.dump = true
+		}
+		if vmi.Perms&uint(vm.PTE_W) != 0 {
+			seg.flags |= PF_W
+		} else if seg.file {
+			seg.dump = false
+		}
+		ret = append(ret, seg)
+	})
+	p.Vm.Unlock_pmap()
+	return ret
+}
+
+// returns the ELF header, the program headers, and the notes, padded to the
+// offset of the first page of memory
+func coreheader(p *proc.Proc_t, sig int, threads []corethread_t,
+	segs []coreseg_t) []uint8 {
+	nphdr := 1 + len(segs)
+	noteoff := core_ehsz + nphdr*core_phsz
+	notesz := corenotesz(core_prpsinfo) + len(threads)*corenotesz(core_prstatus)
+	dataoff := util.Roundup(noteoff+notesz, mem.PGSIZE)
+	ret := make([]uint8, dataoff)
+
+	// ELF header
+	copy(ret, []uint8{0x7f, 'E', 'L', 'F', 2, 1, 1})
+	writen(ret, ELF_QUARTER, 16, ET_CORE)
+	writen(ret, ELF_QUARTER, 18, EM_X86_64)
+	writen(ret, ELF_HALF, 20, 1)
+	writen(ret, ELF_OFF, 32, core_ehsz)
+	writen(ret, ELF_QUARTER, 52, core_ehsz)
+	writen(ret, ELF_QUARTER, 54, core_phsz)
+	writen(ret, ELF_QUARTER, 56, nphdr)
+
+	// program headers
+	ph := ret[core_ehsz:]
+	writen(ph, ELF_HALF, 0, PT_NOTE)
+	writen(ph, ELF_OFF, 8, noteoff)
+	writen(ph, ELF_XWORD, 32, notesz)
+	writen(ph, ELF_XWORD, 48, 4)
+	off := dataoff
+	for _, seg := range segs {
+		ph = ph[core_phsz:]
+		filesz := 0
+		if seg.dump {
+			filesz = seg.len
+		}
+		writen(ph, ELF_HALF, 0, PT_LOAD)
+		writen(ph, ELF_HALF, 4, seg.flags)
+		writen(ph, ELF_OFF, 8, off)
+		writen(ph, ELF_ADDR, 16, seg.va)
+		writen(ph, ELF_XWORD, 32, filesz)
+		writen(ph, ELF_XWORD, 40, seg.len)
+		writen(ph, ELF_XWORD, 48, mem.PGSIZE)
+		off += filesz
+	}
+
+	// notes
+	ppid := 0
+	if p.Pwait != nil {
+		ppid = p.Pwait.Pid
+	}
+	note := corenote(ret[noteoff:], NT_PRPSINFO, core_prpsinfo)
+	cr := p.Cred()
+	note[1] = 'R'
+	writen(note, 4, 16, cr.Ruid)
+	writen(note, 4, 20, cr.Rgid)
+	writen(note, 4, 24, p.Pid)
+	writen(note, 4, 28, ppid)
+	fname := p.Name
+	for i := range p.Name {
+		if p.Name[i] == '/' {
+			fname = p.Name[i+1:]
+		}
+	}
+	copy(note[40:55], fname)
+	copy(note[56:135], p.Name)
+	left := ret[noteoff+corenotesz(core_prpsinfo):]
+	for _, t := range threads {
+		note = corenote(left, NT_PRSTATUS, core_prstatus)
+		writen(note, 4, 0, sig)
+		writen(note, 2, 12, sig)
+		writen(note, 8, 16, int(t.sigpend))
+		writen(note, 8, 24, int(t.sigmask))
+		writen(note, 4, 32, int(t.tid))
+		writen(note, 4, 36, ppid)
+		for i, r := range coreregs {
+			v := 0
+			if r >= 0 {
+				v = int(t.tf[r])
+			}
+			writen(note, 8, 112+8*i, v)
+		}
+		// orig_rax
+		writen(note, 8, 112+8*15, -1)
+		left = left[corenotesz(core_prstatus):]
+	}
+	return ret
+}
+
+// returns the size of a note named "CORE" with a descriptor of descsz bytes
+func corenotesz(descsz int) int {
+	return 12 + 8 + util.Roundup(descsz, 4)
+}
+
+// writes the header of a note named "CORE" to the start of b and returns
+// its descriptor
+func corenote(b []uint8, ntype, descsz int) []uint8 {
+	writen(b, 4, 0, 5)
+	writen(b, 4, 4, descsz)
+	writen(b, 4, 8, ntype)
+	copy(b[12:], "CORE")
+	return b[20 : 20+descsz]
+}
+
+// copies the page of p's memory at va to buf. pages of anonymous memory that
+// were never touched or that cannot be read are zero; they are not faulted in
+// so that a large, sparse mapping does not use memory while it is dumped.
+func corepage(p *proc.Proc_t, va int, file bool, buf []uint8) {
+	p.Vm.Lock_pmap()
+	var pg []uint8
+	if file {
+		pg, _ = p.Vm.Userdmap8_inner(va, false)
+	} else if pa, err := p.Vm.Upage(va); err == 0 {
+		pg = mem.Pg2bytes(mem.Physmem.Dmap(pa))[:]
+	}
+	n := copy(buf, pg)
+	for i := n; i < len(buf); i++ {
+		buf[i] = 0
+	}
+	p.Vm.Unlock_pmap()
+}
+
+// writes all of buf to f at offset off
+func corewrite(f *fd.Fd_t, buf []uint8, off int) defs.Err_t {
+	for len(buf) != 0 {
+		ub := &vm.Fakeubuf_t{}
+		ub.Fake_init(buf)
+		n, err := f.Fops.Pwrite(ub, off)
+		if err != 0 {
+			return err
+		}
+		if n == 0 {
+			return -defs.ENOSPC
+		}
+		buf = buf[n:]
+		off += n
+	}
+	return 0
+}
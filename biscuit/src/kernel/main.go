@@ -14,22 +14,25 @@ import "ahci"
 import "apic"
 import "bnet"
 import "caller"
+import "cred"
 import "defs"
 import "inet"
 import "fd"
-import "fdops"
 import "fs"
 
 import "ixgbe"
 import "mem"
 import "pci"
 import "proc"
+import "procfs"
 import "res"
 import "stat"
 import "stats"
 import "tinfo"
+import "tmpfs"
 import "ustr"
 import "util"
+import "vfs"
 import "vm"
 
 const (
@@ -608,10 +611,6 @@ func kbd_init() {
 	}
 	cons.kbd_int = make(chan bool)
 	cons.com_int = make(chan bool)
-	cons.reader = make(chan []byte)
-	cons.reqc = make(chan int)
-	cons.pollc = make(chan fdops.Pollmsg_t)
-	cons.pollret = make(chan fdops.Ready_t)
 	go kbd_daemon(&cons, km)
 	irq_unmask(defs.IRQ_KBD)
 	irq_unmask(defs.IRQ_COM1)
@@ -631,10 +630,6 @@ func kbd_init() {
 type cons_t struct {
 	kbd_int chan bool
 	com_int chan bool
-	reader  chan []byte
-	reqc    chan int
-	pollc   chan fdops.Pollmsg_t
-	pollret chan fdops.Ready_t
 }
 
 var cons = cons_t{}
@@ -766,19 +761,19 @@ func tabdump() {
 	runtime.Tabclear()
 }
 
+// the scan codes of the control key and the bit that marks a key release
+const (
+	kbd_ctrl    = 0x1d
+	kbd_release = 0x80
+)
+
 func kbd_daemon(cons *cons_t, km map[int]byte) {
 	inb := runtime.Inb
-	start := make([]byte, 0, 10)
-	data := start
 	var lastpk time.Time
 	pkcount := 0
+	ctrl := false
 	addprint := func(c byte) {
-		fmt.Printf("%c", c)
-		if len(data) > 1024 {
-			fmt.Printf("key dropped!\n")
-			return
-		}
-		data = append(data, c)
+		console.tty.Input([]byte{c})
 		if c == '\\' {
 			if time.Since(lastpk) > time.Second {
 				pkcount = 0
@@ -863,8 +858,6 @@ func kbd_daemon(cons *cons_t, km map[int]byte) {
 
 		}
 	}
-	var reqc chan int
-	pollers := &fdops.Pollers_t{}
 	res.Kreswait(res.Afewk, "kbd daemon")
 	for {
 		res.Kunres()
@@ -873,8 +866,17 @@ func kbd_daemon(cons *cons_t, km map[int]byte) {
 		case <-cons.kbd_int:
 			for _kready() {
 				sc := int(inb(0x60))
+				switch sc {
+				case kbd_ctrl:
+					ctrl = true
+				case kbd_ctrl | kbd_release:
+					ctrl = false
+				}
 				c, ok := km[sc]
 				if ok {
+					if ctrl && c >= '@' && c < 0x80 {
+						c &= 0x1f
+					}
 					addprint(c)
 				}
 			}
@@ -893,54 +895,10 @@ func kbd_daemon(cons *cons_t, km map[int]byte) {
 				addprint(c)
 			}
 			irq_eoi(defs.IRQ_COM1)
-		case l := <-reqc:
-			if l > len(data) {
-				l = len(data)
-			}
-			s := data[0:l]
-			cons.reader <- s
-			data = data[l:]
-		case pm := <-cons.pollc:
-			if pm.Events&fdops.R_READ == 0 {
-				cons.pollret <- 0
-				continue
-			}
-			var ret fdops.Ready_t
-			if len(data) > 0 {
-				ret |= fdops.R_READ
-			} else if pm.Dowait {
-				pollers.Addpoller(&pm)
-			}
-			cons.pollret <- ret
-		}
-		if len(data) == 0 {
-			reqc = nil
-			data = start
-		} else {
-			reqc = cons.reqc
-			pollers.Wakeready(fdops.R_READ)
 		}
 	}
 }
 
-// reads keyboard data, blocking for at least 1 byte or until killed. returns
-// at most cnt bytes.
-func kbd_get(cnt int) ([]byte, defs.Err_t) {
-	if cnt < 0 {
-		panic("negative cnt")
-	}
-	kn := &tinfo.Current().Killnaps
-	select {
-	case cons.reqc <- cnt:
-	case <-kn.Killch:
-		if kn.Kerr == 0 {
-			panic("must be non-zero")
-		}
-		return nil, kn.Kerr
-	}
-	return <-cons.reader, 0
-}
-
 func attach_devs() int {
 	// must occur before devices attach (drivers may use Bsp_apic_id to
 	// route interrupts to the BSP)
@@ -1604,10 +1562,17 @@ func structchk() {
 
 var lhits int
 var physmem *mem.Physmem_t
-var thefs *fs.Fs_t
+var thefs *vfs.Vfs_t
+
+// the root file system
+var rootfs *fs.Fs_t
 
 const diskfs = false
 
+// randomize the layout of each process's address space. turn off for
+// reproducible benchmarks; personality(2) turns it off for one process.
+const aslr = true
+
 func main() {
 	res.Kernel = true
 	//runtime.GCDebug(1)
@@ -1665,9 +1630,36 @@ func main() {
 	manymeg := &res.Res_t{Objs: runtime.Resobjs_t{1: 100 << 20}}
 	res.Resbegin(manymeg)
 	rf, fs := fs.StartFS(ahci.Blockmem, ahci.Ahci, console, diskfs)
-	thefs = fs
+	rootfs = fs
+	thefs = vfs.MkVfs(rootfs, "ahci", "bfs")
+
+	// mount procfs on /proc, which is made if the disk image lacks it
+	proot := ustr.Ustr("/proc")
+	pcwd := fd.MkRootCwd(rf)
+	err := thefs.Fs_mkdir(proot, 0555, pcwd, cred.Root)
+	if err != 0 && err != -defs.EEXIST {
+		panic("cannot make /proc")
+	}
+	err = thefs.Mount(proot, procfs.MkProcfs(thefs), "proc", "procfs", pcwd,
+		cred.Root)
+	if err != 0 {
+		panic("cannot mount /proc")
+	}
+	// and a tmpfs on /dev/shm for shm_open(3)
+	for _, d := range []string{"/dev", "/dev/shm"} {
+		err = thefs.Fs_mkdir(ustr.Ustr(d), 0755, pcwd, cred.Root)
+		if err != 0 && err != -defs.EEXIST {
+			panic("cannot make " + d)
+		}
+	}
+	err = thefs.Mount(ustr.Ustr("/dev/shm"), tmpfs.MkTmpfs(), "tmpfs", "tmpfs",
+		pcwd, cred.Root)
+	if err != 0 {
+		panic("cannot mount /dev/shm")
+	}
 
-	proc.Oom_init(thefs.Fs_evict)
+	proc.Oom_init(rootfs.Fs_evict)
+	proc.Aslr_init(aslr)
 
 	exec := func(cmd ustr.Ustr, args ...string) {
 		fmt.Printf("start [%v %v]\n", cmd, args)
@@ -1678,7 +1670,9 @@ func main() {
 		}
 		nargs = append(nargs, uargs...)
 		defaultfds := []*fd.Fd_t{&fd_stdin, &fd_stdout, &fd_stderr}
-		p, ok := proc.Proc_new(cmd, fd.MkRootCwd(rf), defaultfds, sys)
+		cwd := fd.MkRootCwd(rf)
+		cwd.Setumask(022)
+		p, ok := proc.Proc_new(cmd, cwd, cred.Root, defaultfds, sys)
 		if !ok {
 			panic("silly sysprocs")
 		}
@@ -11,10 +11,11 @@ import "sync/atomic"
 import "time"
 import "unsafe"
 
+import "ahci"
 import "bnet"
 import "bounds"
-import "bpath"
 import "circbuf"
+import "cred"
 import "defs"
 import "fd"
 import "fdops"
@@ -25,6 +26,8 @@ import "proc"
 import "res"
 import "stat"
 import "tinfo"
+import "tmpfs"
+import "tty"
 import "ustr"
 import "util"
 import "vm"
@@ -36,14 +39,20 @@ var _sysbounds = []*res.Res_t{
 	defs.SYS_CLOSE:      bounds.Bounds(bounds.B_SYSCALL_T_SYS_CLOSE),
 	defs.SYS_STAT:       bounds.Bounds(bounds.B_SYS_STAT),
 	defs.SYS_FSTAT:      bounds.Bounds(bounds.B_SYS_FSTAT),
+	defs.SYS_LSTAT:      bounds.Bounds(bounds.B_SYS_LSTAT),
 	defs.SYS_POLL:       bounds.Bounds(bounds.B_SYS_POLL),
 	defs.SYS_LSEEK:      bounds.Bounds(bounds.B_SYS_LSEEK),
 	defs.SYS_MMAP:       bounds.Bounds(bounds.B_SYS_MMAP),
+	defs.SYS_MPROTECT:   bounds.Bounds(bounds.B_SYS_MPROTECT),
 	defs.SYS_MUNMAP:     bounds.Bounds(bounds.B_SYS_MUNMAP),
 	defs.SYS_SIGACT:     bounds.Bounds(bounds.B_SYS_SIGACTION),
+	defs.SYS_SIGMASK:    bounds.Bounds(bounds.B_SYS_SIGPROCMASK),
+	defs.SYS_IOCTL:      bounds.Bounds(bounds.B_SYS_IOCTL),
 	defs.SYS_READV:      bounds.Bounds(bounds.B_SYS_READV),
 	defs.SYS_WRITEV:     bounds.Bounds(bounds.B_SYS_WRITEV),
 	defs.SYS_ACCESS:     bounds.Bounds(bounds.B_SYS_ACCESS),
+	defs.SYS_MSYNC:      bounds.Bounds(bounds.B_SYS_MSYNC),
+	defs.SYS_MADVISE:    bounds.Bounds(bounds.B_SYS_MADVISE),
 	defs.SYS_DUP2:       bounds.Bounds(bounds.B_SYS_DUP2),
 	defs.SYS_PAUSE:      bounds.Bounds(bounds.B_SYS_PAUSE),
 	defs.SYS_GETPID:     bounds.Bounds(bounds.B_SYS_GETPID),
@@ -67,6 +76,7 @@ var _sysbounds = []*res.Res_t{
 	defs.SYS_WAIT4:      bounds.Bounds(bounds.B_SYS_WAIT4),
 	defs.SYS_KILL:       bounds.Bounds(bounds.B_SYS_KILL),
 	defs.SYS_FCNTL:      bounds.Bounds(bounds.B_SYS_FCNTL),
+	defs.SYS_FLOCK:      bounds.Bounds(bounds.B_SYS_FLOCK),
 	defs.SYS_TRUNC:      bounds.Bounds(bounds.B_SYS_TRUNCATE),
 	defs.SYS_FTRUNC:     bounds.Bounds(bounds.B_SYS_FTRUNCATE),
 	defs.SYS_GETCWD:     bounds.Bounds(bounds.B_SYS_GETCWD),
@@ -75,15 +85,42 @@ var _sysbounds = []*res.Res_t{
 	defs.SYS_MKDIR:      bounds.Bounds(bounds.B_SYS_MKDIR),
 	defs.SYS_LINK:       bounds.Bounds(bounds.B_SYS_LINK),
 	defs.SYS_UNLINK:     bounds.Bounds(bounds.B_SYS_UNLINK),
+	defs.SYS_SYMLINK:    bounds.Bounds(bounds.B_SYS_SYMLINK),
+	defs.SYS_READLINK:   bounds.Bounds(bounds.B_SYS_READLINK),
+	defs.SYS_CHMOD:      bounds.Bounds(bounds.B_SYS_CHMOD),
+	defs.SYS_FCHMOD:     bounds.Bounds(bounds.B_SYS_FCHMOD),
+	defs.SYS_CHOWN:      bounds.Bounds(bounds.B_SYS_CHOWN),
+	defs.SYS_FCHOWN:     bounds.Bounds(bounds.B_SYS_FCHOWN),
+	defs.SYS_UMASK:      bounds.Bounds(bounds.B_SYS_UMASK),
 	defs.SYS_GETTOD:     bounds.Bounds(bounds.B_SYS_GETTIMEOFDAY),
 	defs.SYS_GETRLMT:    bounds.Bounds(bounds.B_SYS_GETRLIMIT),
 	defs.SYS_GETRUSG:    bounds.Bounds(bounds.B_SYS_GETRUSAGE),
+	defs.SYS_GETUID:     bounds.Bounds(bounds.B_SYS_GETUID),
+	defs.SYS_GETGID:     bounds.Bounds(bounds.B_SYS_GETGID),
+	defs.SYS_SETUID:     bounds.Bounds(bounds.B_SYS_SETUID),
+	defs.SYS_SETGID:     bounds.Bounds(bounds.B_SYS_SETGID),
+	defs.SYS_GETEUID:    bounds.Bounds(bounds.B_SYS_GETEUID),
+	defs.SYS_GETEGID:    bounds.Bounds(bounds.B_SYS_GETEGID),
+	defs.SYS_SETPGID:    bounds.Bounds(bounds.B_SYS_SETPGID),
+	defs.SYS_SETSID:     bounds.Bounds(bounds.B_SYS_SETSID),
+	defs.SYS_GETGROUPS:  bounds.Bounds(bounds.B_SYS_GETGROUPS),
+	defs.SYS_SETGROUPS:  bounds.Bounds(bounds.B_SYS_SETGROUPS),
+	defs.SYS_GETPGID:    bounds.Bounds(bounds.B_SYS_GETPGID),
 	defs.SYS_MKNOD:      bounds.Bounds(bounds.B_SYS_MKNOD),
+	defs.SYS_PERSONA:    bounds.Bounds(bounds.B_SYS_PERSONALITY),
 	defs.SYS_SETRLMT:    bounds.Bounds(bounds.B_SYS_SETRLIMIT),
 	defs.SYS_SYNC:       bounds.Bounds(bounds.B_SYS_SYNC),
+	defs.SYS_FSYNC:      bounds.Bounds(bounds.B_SYS_FSYNC),
+	defs.SYS_FDATASYNC:  bounds.Bounds(bounds.B_SYS_FSYNC),
+	defs.SYS_MOUNT:      bounds.Bounds(bounds.B_SYS_MOUNT),
+	defs.SYS_UMOUNT:     bounds.Bounds(bounds.B_SYS_UMOUNT),
+	defs.SYS_SWAPON:     bounds.Bounds(bounds.B_SYS_SWAPON),
 	defs.SYS_REBOOT:     bounds.Bounds(bounds.B_SYS_REBOOT),
+	defs.SYS_GETDENTS:   bounds.Bounds(bounds.B_SYS_GETDENTS),
 	defs.SYS_NANOSLEEP:  bounds.Bounds(bounds.B_SYS_NANOSLEEP),
+	defs.SYS_UTIMES:     bounds.Bounds(bounds.B_SYS_UTIMES),
 	defs.SYS_PIPE2:      bounds.Bounds(bounds.B_SYS_PIPE2),
+	defs.SYS_MEMFD:      bounds.Bounds(bounds.B_SYS_MEMFD_CREATE),
 	defs.SYS_PROF:       bounds.Bounds(bounds.B_SYS_PROF),
 	defs.SYS_THREXIT:    bounds.Bounds(bounds.B_SYS_THREXIT),
 	defs.SYS_INFO:       bounds.Bounds(bounds.B_SYS_INFO),
@@ -91,6 +128,8 @@ var _sysbounds = []*res.Res_t{
 	defs.SYS_PWRITE:     bounds.Bounds(bounds.B_SYS_PWRITE),
 	defs.SYS_FUTEX:      bounds.Bounds(bounds.B_SYS_FUTEX),
 	defs.SYS_GETTID:     bounds.Bounds(bounds.B_SYS_GETTID),
+	defs.SYS_FUTIMENS:   bounds.Bounds(bounds.B_SYS_FUTIMENS),
+	defs.SYS_COREDIR:    bounds.Bounds(bounds.B_SYS_COREDIR),
 }
 
 // Implements Syscall_i
@@ -142,12 +181,16 @@ func (s *syscall_t) Syscall(p *proc.Proc_t, tid defs.Tid_t, tf *[defs.TFSIZE]uin
 		ret = sys_stat(p, a1, a2)
 	case defs.SYS_FSTAT:
 		ret = sys_fstat(p, a1, a2)
+	case defs.SYS_LSTAT:
+		ret = sys_lstat(p, a1, a2)
 	case defs.SYS_POLL:
 		ret = sys_poll(p, tid, a1, a2, a3)
 	case defs.SYS_LSEEK:
 		ret = sys_lseek(p, a1, a2, a3)
 	case defs.SYS_MMAP:
 		ret = sys_mmap(p, a1, a2, a3, a4, a5)
+	case defs.SYS_MPROTECT:
+		ret = sys_mprotect(p, a1, a2, a3)
 	case defs.SYS_MUNMAP:
 		ret = sys_munmap(p, a1, a2)
 	case defs.SYS_READV:
@@ -155,9 +198,17 @@ func (s *syscall_t) Syscall(p *proc.Proc_t, tid defs.Tid_t, tf *[defs.TFSIZE]uin
 	case defs.SYS_WRITEV:
 		ret = sys_writev(p, a1, a2, a3)
 	case defs.SYS_SIGACT:
-		ret = sys_sigaction(p, a1, a2, a3)
+		ret = sys_sigaction(p, a1, a2, a3, a4)
+	case defs.SYS_SIGMASK:
+		ret = sys_sigprocmask(p, a1, a2, a3)
+	case defs.SYS_IOCTL:
+		ret = sys_ioctl(p, a1, a2, a3)
 	case defs.SYS_ACCESS:
 		ret = sys_access(p, a1, a2)
+	case defs.SYS_MSYNC:
+		ret = sys_msync(p, a1, a2, a3)
+	case defs.SYS_MADVISE:
+		ret = sys_madvise(p, a1, a2, a3)
 	case defs.SYS_DUP2:
 		ret = sys_dup2(p, a1, a2)
 	case defs.SYS_PAUSE:
@@ -206,6 +257,8 @@ func (s *syscall_t) Syscall(p *proc.Proc_t, tid defs.Tid_t, tf *[defs.TFSIZE]uin
 		ret = sys_kill(p, a1, a2)
 	case defs.SYS_FCNTL:
 		ret = sys_fcntl(p, a1, a2, a3)
+	case defs.SYS_FLOCK:
+		ret = sys_flock(p, a1, a2)
 	case defs.SYS_TRUNC:
 		ret = sys_truncate(p, a1, uint(a2))
 	case defs.SYS_FTRUNC:
@@ -222,24 +275,78 @@ func (s *syscall_t) Syscall(p *proc.Proc_t, tid defs.Tid_t, tf *[defs.TFSIZE]uin
 		ret = sys_link(p, a1, a2)
 	case defs.SYS_UNLINK:
 		ret = sys_unlink(p, a1, a2)
+	case defs.SYS_SYMLINK:
+		ret = sys_symlink(p, a1, a2)
+	case defs.SYS_READLINK:
+		ret = sys_readlink(p, a1, a2, a3)
+	case defs.SYS_CHMOD:
+		ret = sys_chmod(p, a1, a2)
+	case defs.SYS_FCHMOD:
+		ret = sys_fchmod(p, a1, a2)
+	case defs.SYS_CHOWN:
+		ret = sys_chown(p, a1, a2, a3)
+	case defs.SYS_FCHOWN:
+		ret = sys_fchown(p, a1, a2, a3)
+	case defs.SYS_UMASK:
+		ret = sys_umask(p, a1)
 	case defs.SYS_GETTOD:
 		ret = sys_gettimeofday(p, a1)
 	case defs.SYS_GETRLMT:
 		ret = sys_getrlimit(p, a1, a2)
 	case defs.SYS_GETRUSG:
 		ret = sys_getrusage(p, a1, a2)
+	case defs.SYS_GETUID:
+		ret = sys_getuid(p)
+	case defs.SYS_GETGID:
+		ret = sys_getgid(p)
+	case defs.SYS_SETUID:
+		ret = sys_setuid(p, a1)
+	case defs.SYS_SETGID:
+		ret = sys_setgid(p, a1)
+	case defs.SYS_GETEUID:
+		ret = sys_geteuid(p)
+	case defs.SYS_GETEGID:
+		ret = sys_getegid(p)
+	case defs.SYS_SETPGID:
+		ret = sys_setpgid(p, a1, a2)
+	case defs.SYS_SETSID:
+		ret = sys_setsid(p)
+	case defs.SYS_GETGROUPS:
+		ret = sys_getgroups(p, a1, a2)
+	case defs.SYS_SETGROUPS:
+		ret = sys_setgroups(p, a1, a2)
+	case defs.SYS_GETPGID:
+		ret = sys_getpgid(p, a1)
 	case defs.SYS_MKNOD:
 		ret = sys_mknod(p, a1, a2, a3)
+	case defs.SYS_PERSONA:
+		ret = sys_personality(p, a1)
 	case defs.SYS_SETRLMT:
 		ret = sys_setrlimit(p, a1, a2)
 	case defs.SYS_SYNC:
 		ret = sys_sync(p)
+	case defs.SYS_FSYNC:
+		ret = sys_fsync(p, a1, false)
+	case defs.SYS_FDATASYNC:
+		ret = sys_fsync(p, a1, true)
+	case defs.SYS_MOUNT:
+		ret = sys_mount(p, a1, a2, a3, a4)
+	case defs.SYS_UMOUNT:
+		ret = sys_umount(p, a1, a2)
+	case defs.SYS_SWAPON:
+		ret = sys_swapon(p, a1, a2)
 	case defs.SYS_REBOOT:
 		ret = sys_reboot(p)
+	case defs.SYS_GETDENTS:
+		ret = sys_getdents(p, a1, a2, a3)
 	case defs.SYS_NANOSLEEP:
 		ret = sys_nanosleep(p, a1, a2)
+	case defs.SYS_UTIMES:
+		ret = sys_utimes(p, a1, a2)
 	case defs.SYS_PIPE2:
 		ret = sys_pipe2(p, a1, a2)
+	case defs.SYS_MEMFD:
+		ret = sys_memfd_create(p, a1, a2)
 	case defs.SYS_PROF:
 		ret = sys_prof(p, a1, a2, a3, a4)
 	case defs.SYS_INFO:
@@ -254,6 +361,10 @@ func (s *syscall_t) Syscall(p *proc.Proc_t, tid defs.Tid_t, tf *[defs.TFSIZE]uin
 		ret = sys_futex(p, a1, a2, a3, a4, a5)
 	case defs.SYS_GETTID:
 		ret = sys_gettid(p, tid)
+	case defs.SYS_FUTIMENS:
+		ret = sys_futimens(p, a1, a2)
+	case defs.SYS_COREDIR:
+		ret = sys_coredir(p, a1)
 	default:
 		fmt.Printf("unexpected syscall %v\n", sysno)
 		s.Sys_exit(p, tid, defs.SIGNALED|defs.Mkexitsig(31))
@@ -261,44 +372,76 @@ func (s *syscall_t) Syscall(p *proc.Proc_t, tid defs.Tid_t, tf *[defs.TFSIZE]uin
 	return ret
 }
 
-// Implements Console_i
+// Implements Console_i. the console is a terminal whose input is typed at the
+// keyboard or the serial port; it starts as the controlling terminal of
+// init's session. the console's driver erases on backspace and turns newlines
+// into carriage return and newline itself.
 type console_t struct {
+	tty *tty.Tty_t
 }
 
-var console = &console_t{}
+var console = mkconsole()
+
+func mkconsole() *console_t {
+	tios := tty.Deftermios()
+	tios.Oflag &^= defs.ONLCR
+	tios.Cc[defs.VERASE] = '\b'
+	utext := int8(0x17)
+	out := func(b []uint8) {
+		runtime.Pmsga(&b[0], len(b), utext)
+	}
+	return &console_t{tty: tty.MkTty(tios, out, 1)}
+}
 
 func (c *console_t) Cons_poll(pm fdops.Pollmsg_t) (fdops.Ready_t, defs.Err_t) {
-	cons.pollc <- pm
-	return <- cons.pollret, 0
+	return c.tty.Poll(pm)
 }
 
 func (c *console_t) Cons_read(ub fdops.Userio_i, offset int) (int, defs.Err_t) {
-	sz := ub.Remain()
-	kdata, err := kbd_get(sz)
-	if err != 0 {
-		return 0, err
-	}
-	ret, err := ub.Uiowrite(kdata)
-	if err != 0 || ret != len(kdata) {
-		fmt.Printf("dropped keys!\n")
-	}
-	return ret, err
+	return c.tty.Read(ub, false)
 }
 
 func (c *console_t) Cons_write(src fdops.Userio_i, off int) (int, defs.Err_t) {
-	// merge into one buffer to avoid taking the console lock many times.
-	// what a sweet optimization.
-	utext := int8(0x17)
-	big := make([]uint8, src.Totalsz())
-	read, err := src.Uioread(big)
-	if err != 0 {
-		return 0, err
+	return c.tty.Write(src, false)
+}
+
+func (c *console_t) Cons_ioctl(req int, arg fdops.Userio_i) defs.Err_t {
+	return c.tty.Ioctl(req, arg)
+}
+
+// the size of the argument of each ioctl(2) request
+var _iocsz = map[int]int{
+	defs.TCGETS:       tty.Termiossz,
+	defs.TCSETS:       tty.Termiossz,
+	defs.TCSETSW:      tty.Termiossz,
+	defs.TCSETSF:      tty.Termiossz,
+	defs.TIOCSCTTY:    0,
+	defs.TIOCGPGRP:    4,
+	defs.TIOCSPGRP:    4,
+	defs.TIOCGWINSZ:   8,
+	defs.TIOCSWINSZ:   8,
+	defs.TIOCGPTN:     4,
+	defs.TIOCSPTLCK:   4,
+	defs.FIONREAD:     4,
+	defs.FIONBIO:      4,
+	defs.BLKGETSIZE:   8,
+	defs.BLKSSZGET:    4,
+	defs.BLKGETSIZE64: 8,
+}
+
+// the request's argument is copied in and out by the file's fops through a
+// user buffer of the request's size.
+func sys_ioctl(p *proc.Proc_t, fdn, req, argn int) int {
+	f, ok := p.Fd_get(fdn)
+	if !ok {
+		return int(-defs.EBADF)
 	}
-	if read != src.Totalsz() {
-		panic("short read")
+	sz, ok := _iocsz[req]
+	if !ok {
+		return int(-defs.ENOTTY)
 	}
-	runtime.Pmsga(&big[0], len(big), utext)
-	return len(big), 0
+	ub := p.Vm.Mkuserbuf(argn, sz)
+	return int(f.Fops.Ioctl(req, ub))
 }
 
 func _fd_read(p *proc.Proc_t, fdn int) (*fd.Fd_t, defs.Err_t) {
@@ -372,6 +515,9 @@ func sys_open(p *proc.Proc_t, pathn int, _flags int, mode int) int {
 	if temp == defs.O_RDONLY && flags&defs.O_TRUNC != 0 {
 		return int(-defs.EINVAL)
 	}
+	if flags&defs.O_EXEC != 0 {
+		return int(-defs.EINVAL)
+	}
 	fdperms := 0
 	switch temp {
 	case defs.O_RDONLY:
@@ -387,7 +533,7 @@ func sys_open(p *proc.Proc_t, pathn int, _flags int, mode int) int {
 	if err != 0 {
 		return int(err)
 	}
-	file, err := thefs.Fs_open(path, flags, mode, p.Cwd, 0, 0)
+	file, err := thefs.Fs_open(path, flags, mode, p.Cwd, p.Cred(), 0, 0)
 	if err != 0 {
 		return int(err)
 	}
@@ -403,14 +549,36 @@ func sys_open(p *proc.Proc_t, pathn int, _flags int, mode int) int {
 	return fdn
 }
 
+// makes a memory object that no directory names and returns a descriptor of
+// it. the name is only for debugging on Linux and is ignored.
+func sys_memfd_create(p *proc.Proc_t, namen, flags int) int {
+	if flags&^defs.MFD_CLOEXEC != 0 {
+		return int(-defs.EINVAL)
+	}
+	if _, err := p.Vm.Userstr(namen, fs.NAME_MAX); err != 0 {
+		return int(err)
+	}
+	file := &fd.Fd_t{Fops: tmpfs.MkMemfd(p.Cred())}
+	fdperms := fd.FD_READ | fd.FD_WRITE
+	if flags&defs.MFD_CLOEXEC != 0 {
+		fdperms |= fd.FD_CLOEXEC
+	}
+	fdn, ok := p.Fd_insert(file, fdperms)
+	if !ok {
+		fd.Close_panic(file)
+		return int(-defs.EMFILE)
+	}
+	return fdn
+}
+
 func sys_pause(p *proc.Proc_t) int {
-	// no signals yet!
+	// pause(2) returns only once a signal interrupts it
 	var c chan bool
 	select {
 	case <-c:
 	case <-tinfo.Current().Killnaps.Killch:
 	}
-	return -1
+	return int(-defs.EINTR)
 }
 
 func (s *syscall_t) Sys_close(p *proc.Proc_t, fdn int) int {
@@ -418,7 +586,7 @@ func (s *syscall_t) Sys_close(p *proc.Proc_t, fdn int) int {
 	if !ok {
 		return int(-defs.EBADF)
 	}
-	ret := fd.Fops.Close()
+	ret := p.Fd_close(fd)
 	return int(ret)
 }
 
@@ -439,7 +607,18 @@ func sys_mmap(p *proc.Proc_t, addrn, lenn, protflags, fdn, offset int) int {
 	if (fdmap && fdn < 0) || (fdmap && offset < 0) || (anon && fdn >= 0) {
 		return int(-defs.EINVAL)
 	}
-	if flags&defs.MAP_FIXED != 0 {
+	if fdmap && offset%mem.PGSIZE != 0 {
+		return int(-defs.EINVAL)
+	}
+	// a fixed mapping replaces the mappings at addrn, like those with which
+	// the interpreter of a dynamically-linked program lays out a shared
+	// library
+	fixed := flags&defs.MAP_FIXED != 0
+	if fixed && (addrn%mem.PGSIZE != 0 || addrn < mem.USERMIN ||
+		lenn > 0x100<<39-addrn) {
+		return int(-defs.EINVAL)
+	}
+	if prot&^(defs.PROT_READ|defs.PROT_WRITE|defs.PROT_EXEC) != 0 {
 		return int(-defs.EINVAL)
 	}
 	// OpenBSD allows mappings of only PROT_WRITE and read accesses that
@@ -447,7 +626,8 @@ func sys_mmap(p *proc.Proc_t, addrn, lenn, protflags, fdn, offset int) int {
 	// following a write do not cause segfault (of course). POSIX
 	// apparently requires an implementation to support only proc.PROT_WRITE,
 	// but it seems better to disallow permission schemes that the CPU
-	// cannot enforce.
+	// cannot enforce. for the same reason, PROT_EXEC is implied since user
+	// pages are not mapped no-execute.
 	if prot&defs.PROT_READ == 0 {
 		return int(-defs.EINVAL)
 	}
@@ -477,8 +657,13 @@ func sys_mmap(p *proc.Proc_t, addrn, lenn, protflags, fdn, offset int) int {
 		perms |= vm.PTE_W
 	}
 	lenn = util.Roundup(lenn, mem.PGSIZE)
-	// limit checks
-	if lenn/int(mem.PGSIZE)+p.Vm.Vmregion.Pglen() > p.Ulim.Pages {
+	// limit checks. the pages that a fixed mapping replaces are not
+	// counted, but they are only unmapped once the checks pass.
+	pglen := p.Vm.Vmregion.Pglen()
+	if fixed {
+		pglen -= p.Vm.Vmregion.Mappedpgs(addrn, lenn)
+	}
+	if lenn/int(mem.PGSIZE)+pglen > p.Ulim.Pages {
 		p.Vm.Unlock_pmap()
 		lhits++
 		return int(-defs.ENOMEM)
@@ -488,9 +673,28 @@ func sys_mmap(p *proc.Proc_t, addrn, lenn, protflags, fdn, offset int) int {
 		lhits++
 		return int(-defs.ENOMEM)
 	}
+	if fixed {
+		if err := _munmap(p, addrn, lenn); err != 0 {
+			p.Vm.Unlock_pmap()
+			return int(err)
+		}
+	}
 
-	addr := p.Vm.Unusedva_inner(p.Mmapi, lenn)
-	p.Mmapi = addr + lenn
+	// large private anonymous mappings are aligned and mapped lazily so
+	// that page faults can back them with huge pages
+	huge := anon && !shared && lenn >= mem.HUGEPGSIZE && !fixed
+	var addr int
+	switch {
+	case fixed:
+		addr = addrn
+	case huge:
+		addr = p.Vm.Unusedva_inner(p.Mmapi, lenn+mem.HUGEPGSIZE)
+		addr = util.Roundup(addr, mem.HUGEPGSIZE)
+		p.Mmapi = addr + lenn
+	default:
+		addr = p.Vm.Unusedva_inner(p.Mmapi, lenn)
+		p.Mmapi = addr + lenn
+	}
 	switch {
 	case anon && shared:
 		p.Vm.Vmadd_shareanon(addr, lenn, perms)
@@ -500,18 +704,21 @@ func sys_mmap(p *proc.Proc_t, addrn, lenn, protflags, fdn, offset int) int {
 		fops := f.Fops
 		// vmadd_*file will increase the open count on the file
 		if shared {
+			// only files of a file system can be mapped; their
+			// pages are unpinned through the file's file system
+			unpin, _ := fops.(mem.Unpin_i)
 			p.Vm.Vmadd_sharefile(addr, lenn, perms, fops, offset,
-				thefs)
+				unpin, f.Perms&fd.FD_WRITE != 0)
 		} else {
 			p.Vm.Vmadd_file(addr, lenn, perms, fops, offset)
 		}
 	}
 	tshoot := false
-	// eagerly map anonymous pages, lazily-map file pages. our vm system
-	// supports lazily-mapped private anonymous pages though.
+	// eagerly map anonymous pages, except for those of huge mappings, and
+	// lazily-map file pages.
 	var ub int
 	failed := false
-	if anon {
+	if anon && !huge {
 		for i := 0; i < lenn; i += int(mem.PGSIZE) {
 			_, p_pg, ok := physmem.Refpg_new()
 			if !ok {
@@ -549,6 +756,36 @@ func sys_mmap(p *proc.Proc_t, addrn, lenn, protflags, fdn, offset int) int {
 	return ret
 }
 
+// removes the mappings in [addr, addr+len), which may cover parts of several
+// mappings or none. caller must hold the pmap lock.
+func _munmap(p *proc.Proc_t, addr, len int) defs.Err_t {
+	end := addr + util.Roundup(len, mem.PGSIZE)
+	for va := addr; va < end; {
+		vmi, ok := p.Vm.Vmregion.Lookup(uintptr(va))
+		if !ok {
+			va += mem.PGSIZE
+			continue
+		}
+		vend := int(vmi.Pgn<<vm.PGSHIFT) + vmi.Pglen<<vm.PGSHIFT
+		if vend > end {
+			vend = end
+		}
+		if err := p.Vm.Hugesplit(va, vend-va, false); err != 0 {
+			return err
+		}
+		err := p.Vm.Vmregion.Remove(va, vend-va, p.Ulim.Novma)
+		if err != 0 {
+			return err
+		}
+		for a := va; a < vend; a += mem.PGSIZE {
+			p.Vm.Page_remove(a)
+		}
+		p.Vm.Tlbshoot(uintptr(va), (vend-va)>>vm.PGSHIFT)
+		va = vend
+	}
+	return 0
+}
+
 func sys_munmap(p *proc.Proc_t, addrn, len int) int {
 	if addrn&int(vm.PGOFFSET) != 0 || addrn < mem.USERMIN {
 		return int(-defs.EINVAL)
@@ -562,23 +799,78 @@ func sys_munmap(p *proc.Proc_t, addrn, len int) int {
 		return int(-defs.EINVAL)
 	}
 
-	err := p.Vm.Vmregion.Remove(addrn, len, p.Ulim.Novma)
-	if err != 0 {
+	if err := _munmap(p, addrn, len); err != 0 {
 		lhits++
 		return int(err)
 	}
-	// addrn must be page-aligned
-	len = util.Roundup(len, mem.PGSIZE)
-	for i := 0; i < len; i += mem.PGSIZE {
-		a := addrn + i
-		if a < mem.USERMIN {
-			panic("how")
+	return 0
+}
+
+func sys_mprotect(p *proc.Proc_t, addrn, len, prot int) int {
+	if addrn&int(vm.PGOFFSET) != 0 || addrn < mem.USERMIN || len < 0 {
+		return int(-defs.EINVAL)
+	}
+	if prot&^(defs.PROT_READ|defs.PROT_WRITE|defs.PROT_EXEC) != 0 {
+		return int(-defs.EINVAL)
+	}
+	// like mmap, the pages of a mapping must be readable unless they are
+	// inaccessible
+	var perms mem.Pa_t
+	if prot != defs.PROT_NONE {
+		if prot&defs.PROT_READ == 0 {
+			return int(-defs.EINVAL)
+		}
+		perms = vm.PTE_U
+		if prot&defs.PROT_WRITE != 0 {
+			perms |= vm.PTE_W
 		}
-		p.Vm.Page_remove(a)
 	}
-	pgs := len >> vm.PGSHIFT
-	p.Vm.Tlbshoot(uintptr(addrn), pgs)
-	return 0
+	if len == 0 {
+		return 0
+	}
+	p.Vm.Lock_pmap()
+	defer p.Vm.Unlock_pmap()
+
+	err := p.Vm.Mprotect(addrn, len, perms, p.Ulim.Novma)
+	if err == -defs.ENOMEM {
+		lhits++
+	}
+	return int(err)
+}
+
+func sys_madvise(p *proc.Proc_t, addrn, len, advice int) int {
+	if addrn&int(vm.PGOFFSET) != 0 || addrn < mem.USERMIN || len < 0 {
+		return int(-defs.EINVAL)
+	}
+	p.Vm.Lock_pmap()
+	defer p.Vm.Unlock_pmap()
+
+	switch advice {
+	case defs.MADV_NORMAL, defs.MADV_RANDOM, defs.MADV_SEQUENTIAL:
+		if !p.Vm.Vmregion.Mapped(addrn, len) {
+			return int(-defs.ENOMEM)
+		}
+		return 0
+	case defs.MADV_WILLNEED:
+		return int(p.Vm.Willneed(addrn, len))
+	case defs.MADV_DONTNEED:
+		return int(p.Vm.Dontneed(addrn, len))
+	default:
+		return int(-defs.EINVAL)
+	}
+}
+
+func sys_msync(p *proc.Proc_t, addrn, len, flags int) int {
+	if addrn&int(vm.PGOFFSET) != 0 || addrn < mem.USERMIN || len < 0 {
+		return int(-defs.EINVAL)
+	}
+	all := defs.MS_ASYNC | defs.MS_INVALIDATE | defs.MS_SYNC
+	if flags&^all != 0 || flags&defs.MS_ASYNC != 0 && flags&defs.MS_SYNC != 0 {
+		return int(-defs.EINVAL)
+	}
+	// the pages of a mapping are the file's cached blocks, so there is
+	// nothing to invalidate
+	return int(p.Vm.Msync(addrn, len, flags&defs.MS_SYNC != 0))
 }
 
 func sys_readv(p *proc.Proc_t, fdn, _iovn, iovcnt int) int {
@@ -615,34 +907,108 @@ func sys_writev(p *proc.Proc_t, fdn, _iovn, iovcnt int) int {
 	return ret
 }
 
-func sys_sigaction(p *proc.Proc_t, sig, actn, oactn int) int {
-	panic("no imp")
+// the layout of litc's struct sigaction
+const (
+	sa_handler   = 0
+	sa_sigaction = 8
+	sa_mask      = 16
+	sa_flags     = 24
+	sa_sz        = 32
+)
+
+func sys_sigaction(p *proc.Proc_t, sig, actn, oactn, restorer int) int {
+	var act, oact proc.Sigact_t
+	var actp, oactp *proc.Sigact_t
+	if actn != 0 {
+		buf := make([]uint8, sa_sz)
+		if err := p.Vm.User2k(buf, actn); err != 0 {
+			return int(err)
+		}
+		act.Flags = util.Readn(buf, 4, sa_flags)
+		act.Mask = uint64(util.Readn(buf, 8, sa_mask))
+		off := sa_handler
+		if act.Flags&defs.SA_SIGINFO != 0 {
+			off = sa_sigaction
+		}
+		act.Handler = uintptr(util.Readn(buf, 8, off))
+		act.Restorer = uintptr(restorer)
+		if !act.Isdfl() && !act.Isign() && act.Restorer == 0 {
+			return int(-defs.EINVAL)
+		}
+		actp = &act
+	}
+	if oactn != 0 {
+		oactp = &oact
+	}
+	if err := p.Sigaction(sig, actp, oactp); err != 0 {
+		return int(err)
+	}
+	if oactn != 0 {
+		buf := make([]uint8, sa_sz)
+		h := int(oact.Handler)
+		if h == 0 {
+			h = defs.SIG_DFL
+		}
+		util.Writen(buf, 8, sa_handler, h)
+		util.Writen(buf, 8, sa_sigaction, h)
+		util.Writen(buf, 8, sa_mask, int(oact.Mask))
+		util.Writen(buf, 4, sa_flags, oact.Flags)
+		if err := p.Vm.K2user(buf, oactn); err != 0 {
+			return int(err)
+		}
+	}
+	return 0
 }
 
-func sys_access(p *proc.Proc_t, pathn, mode int) int {
-	path, err := p.Vm.Userstr(pathn, fs.NAME_MAX)
+func sys_sigprocmask(p *proc.Proc_t, how, setn, osetn int) int {
+	var set *uint64
+	if setn != 0 {
+		v, err := p.Vm.Userreadn(setn, 8)
+		if err != 0 {
+			return int(err)
+		}
+		tmp := uint64(v)
+		set = &tmp
+	}
+	old, err := p.Sigprocmask(how, set)
 	if err != 0 {
 		return int(err)
 	}
-	if mode == 0 {
-		return int(-defs.EINVAL)
+	if osetn != 0 {
+		if err := p.Vm.Userwriten(osetn, 8, int(old)); err != 0 {
+			return int(err)
+		}
 	}
+	return 0
+}
 
-	fsf, err := thefs.Fs_open_inner(path, defs.O_RDONLY, 0, p.Cwd, 0, 0)
+func sys_access(p *proc.Proc_t, pathn, mode int) int {
+	path, err := p.Vm.Userstr(pathn, fs.NAME_MAX)
 	if err != 0 {
 		return int(err)
 	}
-
-	// XXX no permissions yet
-	//R_OK := 1 << 0
-	//W_OK := 1 << 1
-	//X_OK := 1 << 2
-	ret := 0
-
-	if thefs.Fs_close(fsf.Inum) != 0 {
-		panic("must succeed")
+	if mode&^(defs.R_OK|defs.W_OK|defs.X_OK) != 0 {
+		return int(-defs.EINVAL)
 	}
-	return ret
+	var want uint
+	if mode&defs.R_OK != 0 {
+		want |= cred.MAY_READ
+	}
+	if mode&defs.W_OK != 0 {
+		want |= cred.MAY_WRITE
+	}
+	if mode&defs.X_OK != 0 {
+		want |= cred.MAY_EXEC
+	}
+	// access(2) checks permissions using the real ids
+	return int(thefs.Fs_access(path, want, p.Cwd, p.Cred().Real()))
+}
+
+// returns true if cr may access the file with stat st in the way described by
+// want
+func stpermits(cr *cred.Cred_t, st *stat.Stat_t, want uint) bool {
+	isdir := st.Mode()&(0xffff<<16) == fs.I_DIR<<16
+	return cr.Permits(st.Uid(), st.Gid(), st.Mode()&07777, want, isdir)
 }
 
 func sys_dup2(p *proc.Proc_t, oldn, newn int) int {
@@ -654,7 +1020,9 @@ func sys_dup2(p *proc.Proc_t, oldn, newn int) int {
 		return int(err)
 	}
 	if needclose {
-		fd.Close_panic(ofd)
+		if p.Fd_close(ofd) != 0 {
+			panic("must succeed")
+		}
 	}
 	return newn
 }
@@ -665,7 +1033,20 @@ func sys_stat(p *proc.Proc_t, pathn, statn int) int {
 		return int(err)
 	}
 	buf := &stat.Stat_t{}
-	err = thefs.Fs_stat(path, buf, p.Cwd)
+	err = thefs.Fs_stat(path, buf, p.Cwd, p.Cred())
+	if err != 0 {
+		return int(err)
+	}
+	return int(p.Vm.K2user(buf.Bytes(), statn))
+}
+
+func sys_lstat(p *proc.Proc_t, pathn, statn int) int {
+	path, err := p.Vm.Userstr(pathn, fs.NAME_MAX)
+	if err != 0 {
+		return int(err)
+	}
+	buf := &stat.Stat_t{}
+	err = thefs.Fs_lstat(path, buf, p.Cwd, p.Cred())
 	if err != 0 {
 		return int(err)
 	}
@@ -935,6 +1316,7 @@ func (o *pipe_t) op_write(src fdops.Userio_i, noblock bool) (int, defs.Err_t) {
 		}
 		if o.readers == 0 {
 			o.Unlock()
+			proc.Sigpipe()
 			return 0, -defs.EPIPE
 		}
 		if o.cbuf.Left() >= need {
@@ -1146,6 +1528,26 @@ func (of *pipefops_t) Truncate(uint) defs.Err_t {
 	return -defs.EINVAL
 }
 
+func (of *pipefops_t) Utimens(*cred.Cred_t, int, int) defs.Err_t {
+	return -defs.EINVAL
+}
+
+func (of *pipefops_t) Fchmod(*cred.Cred_t, uint) defs.Err_t {
+	return -defs.EINVAL
+}
+
+func (of *pipefops_t) Fchown(*cred.Cred_t, int, int) defs.Err_t {
+	return -defs.EINVAL
+}
+
+func (of *pipefops_t) Getdents(fdops.Userio_i) (int, defs.Err_t) {
+	return 0, -defs.ENOTDIR
+}
+
+func (of *pipefops_t) Fsync(bool) defs.Err_t {
+	return -defs.EINVAL
+}
+
 func (of *pipefops_t) Pread(fdops.Userio_i, int) (int, defs.Err_t) {
 	return 0, -defs.ESPIPE
 }
@@ -1201,7 +1603,22 @@ func (of *pipefops_t) Fcntl(cmd, opt int) int {
 	}
 }
 
-func (of *pipefops_t) Getsockopt(int, fdops.Userio_i, int) (int, defs.Err_t) {
+func (of *pipefops_t) Ioctl(req int, arg fdops.Userio_i) defs.Err_t {
+	switch req {
+	case defs.FIONREAD:
+		of.pipe.Lock()
+		n := of.pipe.cbuf.Used()
+		of.pipe.Unlock()
+		return fdops.Intout(arg, n)
+	case defs.FIONBIO:
+		return fdops.Fionbio(of, arg)
+	default:
+		return -defs.ENOTTY
+	}
+}
+
+func (of *pipefops_t) Getsockopt(int, int, fdops.Userio_i,
+	int) (int, defs.Err_t) {
 	return 0, -defs.ENOTSOCK
 }
 
@@ -1230,7 +1647,7 @@ func sys_rename(p *proc.Proc_t, oldn int, newn int) int {
 	if err2 != 0 {
 		return int(err2)
 	}
-	err := thefs.Fs_rename(old, new, p.Cwd)
+	err := thefs.Fs_rename(old, new, p.Cwd, p.Cred())
 	return int(err)
 }
 
@@ -1243,7 +1660,7 @@ func sys_mkdir(p *proc.Proc_t, pathn int, mode int) int {
 	if err != 0 {
 		return int(err)
 	}
-	err = thefs.Fs_mkdir(path, mode, p.Cwd)
+	err = thefs.Fs_mkdir(path, mode, p.Cwd, p.Cred())
 	return int(err)
 }
 
@@ -1264,7 +1681,7 @@ func sys_link(p *proc.Proc_t, oldn int, newn int) int {
 	if err2 != 0 {
 		return int(err2)
 	}
-	err := thefs.Fs_link(old, new, p.Cwd)
+	err := thefs.Fs_link(old, new, p.Cwd, p.Cred())
 	return int(err)
 }
 
@@ -1278,10 +1695,63 @@ func sys_unlink(p *proc.Proc_t, pathn, isdiri int) int {
 		return int(err)
 	}
 	wantdir := isdiri != 0
-	err = thefs.Fs_unlink(path, p.Cwd, wantdir)
+	err = thefs.Fs_unlink(path, p.Cwd, p.Cred(), wantdir)
+	return int(err)
+}
+
+func sys_symlink(p *proc.Proc_t, targetn, pathn int) int {
+	target, err := p.Vm.Userstr(targetn, fs.NAME_MAX)
+	if err != 0 {
+		return int(err)
+	}
+	path, err := p.Vm.Userstr(pathn, fs.NAME_MAX)
+	if err != 0 {
+		return int(err)
+	}
+	err = badpath(path)
+	if err != 0 {
+		return int(err)
+	}
+	err = thefs.Fs_symlink(target, path, p.Cwd, p.Cred())
 	return int(err)
 }
 
+func sys_readlink(p *proc.Proc_t, pathn, bufn, sz int) int {
+	if sz <= 0 {
+		return int(-defs.EINVAL)
+	}
+	path, err := p.Vm.Userstr(pathn, fs.NAME_MAX)
+	if err != 0 {
+		return int(err)
+	}
+	err = badpath(path)
+	if err != 0 {
+		return int(err)
+	}
+	ub := p.Vm.Mkuserbuf(bufn, sz)
+	ret, err := thefs.Fs_readlink(path, ub, p.Cwd, p.Cred())
+	if err != 0 {
+		return int(err)
+	}
+	return ret
+}
+
+func sys_getdents(p *proc.Proc_t, fdn, bufn, sz int) int {
+	if sz <= 0 {
+		return int(-defs.EINVAL)
+	}
+	fd, err := _fd_read(p, fdn)
+	if err != 0 {
+		return int(err)
+	}
+	ub := p.Vm.Mkuserbuf(bufn, sz)
+	ret, err := fd.Fops.Getdents(ub)
+	if err != 0 {
+		return int(err)
+	}
+	return ret
+}
+
 func sys_gettimeofday(p *proc.Proc_t, timevaln int) int {
 	tvalsz := 16
 	now := time.Now()
@@ -1295,13 +1765,16 @@ func sys_gettimeofday(p *proc.Proc_t, timevaln int) int {
 	return 0
 }
 
-var _rlimits = map[int]uint{defs.RLIMIT_NOFILE: defs.RLIM_INFINITY}
+var _rlimits = map[int]uint{defs.RLIMIT_NOFILE: defs.RLIM_INFINITY,
+	defs.RLIMIT_CORE: defs.RLIM_INFINITY}
 
 func sys_getrlimit(p *proc.Proc_t, resn, rlpn int) int {
 	var cur uint
 	switch resn {
 	case defs.RLIMIT_NOFILE:
 		cur = p.Ulim.Nofile
+	case defs.RLIMIT_CORE:
+		cur = p.Ulim.Core
 	default:
 		return int(-defs.EINVAL)
 	}
@@ -1330,6 +1803,8 @@ func sys_setrlimit(p *proc.Proc_t, resn, rlpn int) int {
 	switch resn {
 	case defs.RLIMIT_NOFILE:
 		p.Ulim.Nofile = ncur
+	case defs.RLIMIT_CORE:
+		p.Ulim.Core = ncur
 	default:
 		return int(-defs.EINVAL)
 	}
@@ -1368,6 +1843,21 @@ func sys_getrusage(p *proc.Proc_t, who, rusagep int) int {
 	return int(-defs.ENOSYS)
 }
 
+// sets the personality flags of the process unless persona is 0xffffffff and
+// returns the old flags. ADDR_NO_RANDOMIZE is the only flag.
+func sys_personality(p *proc.Proc_t, persona int) int {
+	// the argument is an unsigned int; 0xffffffff, which is -1 as an int,
+	// only queries the flags
+	persona = int(uint32(persona))
+	if persona == 0xffffffff {
+		return int(p.Personality())
+	}
+	if uint(persona)&^defs.ADDR_NO_RANDOMIZE != 0 {
+		return int(-defs.EINVAL)
+	}
+	return int(p.Setpersonality(uint(persona)))
+}
+
 func sys_mknod(p *proc.Proc_t, pathn, moden, devn int) int {
 	path, err := p.Vm.Userstr(pathn, fs.NAME_MAX)
 	if err != 0 {
@@ -1378,46 +1868,245 @@ func sys_mknod(p *proc.Proc_t, pathn, moden, devn int) int {
 	if err != 0 {
 		return int(err)
 	}
-	maj, min := defs.Unmkdev(uint(devn))
-	fsf, err := thefs.Fs_open_inner(path, defs.O_CREAT, 0, p.Cwd, maj, min)
-	if err != 0 {
-		return int(err)
-	}
-	if thefs.Fs_close(fsf.Inum) != 0 {
-		panic("must succeed")
+	cr := p.Cred()
+	if !cr.Isroot() {
+		return int(-defs.EPERM)
 	}
-	return 0
+	maj, min := defs.Unmkdev(uint(devn))
+	_, err = thefs.Fs_mknod(path, 0, moden&07777, p.Cwd, cr, maj, min)
+	return int(err)
 }
 
 func sys_sync(p *proc.Proc_t) int {
 	return int(thefs.Fs_sync())
 }
 
-func sys_reboot(p *proc.Proc_t) int {
-	// mov'ing to cr3 does not flush global pages. if, before loading the
-	// zero page into cr3 below, there are just enough TLB entries to
-	// dispatch a fault, but not enough to complete the fault handler, the
-	// fault handler will recursively fault forever since it uses an IST
-	// stack. therefore, flush the global pages too.
-	pge := uintptr(1 << 7)
-	runtime.Lcr4(runtime.Rcr4() &^ pge)
-	// who needs ACPI?
-	runtime.Lcr3(uintptr(mem.P_zeropg))
-	// poof
-	fmt.Printf("what?\n")
-	return 0
+func sys_fsync(p *proc.Proc_t, fdn int, datasync bool) int {
+	fd, ok := p.Fd_get(fdn)
+	if !ok {
+		return int(-defs.EBADF)
+	}
+	return int(fd.Fops.Fsync(datasync))
 }
 
-func sys_nanosleep(p *proc.Proc_t, sleeptsn, remaintsn int) int {
-	tot, _, err := p.Vm.Usertimespec(sleeptsn)
-	if err != 0 {
-		return int(err)
+// the size of a memory file system
+const (
+	memfs_inodeblks = 64
+	memfs_datablks  = 4096
+)
+
+// the disks of the mounted file systems, so that a disk isn't mounted twice
+var _mounted = struct {
+	sync.Mutex
+	disks map[fs.Disk_i]*fs.Fs_t
+}{disks: make(map[fs.Disk_i]*fs.Fs_t)}
+
+// parses the name of an AHCI port, like "ahci1"
+func ahciport(s ustr.Ustr) (int, bool) {
+	pre := ustr.Ustr("ahci")
+	if len(s) <= len(pre) || !s[:len(pre)].Eq(pre) {
+		return 0, false
 	}
-	tochan := time.After(tot)
-	kn := &tinfo.Current().Killnaps
-	select {
-	case <-tochan:
-		return 0
+	n := 0
+	for _, c := range s[len(pre):] {
+		if c < '0' || c > '9' {
+			return 0, false
+		}
+		n = n*10 + int(c-'0')
+		if n >= 32 {
+			return 0, false
+		}
+	}
+	return n, true
+}
+
+// mounts a file system at the directory target. fstype "bfs" mounts the file
+// system on the AHCI port named by source; "memfs" mounts a new, empty memory
+// file system and ignores source.
+func sys_mount(p *proc.Proc_t, srcn, targetn, typen, flags int) int {
+	if !p.Cred().Isroot() {
+		return int(-defs.EPERM)
+	}
+	if flags != 0 {
+		return int(-defs.EINVAL)
+	}
+	target, err := p.Vm.Userstr(targetn, fs.NAME_MAX)
+	if err != 0 {
+		return int(err)
+	}
+	if err := badpath(target); err != 0 {
+		return int(err)
+	}
+	fstype, err := p.Vm.Userstr(typen, fs.NAME_MAX)
+	if err != 0 {
+		return int(err)
+	}
+
+	if fstype.Eq(ustr.Ustr("tmpfs")) {
+		// a tmpfs has no disk
+		tfs := tmpfs.MkTmpfs()
+		err := thefs.Mount(target, tfs, "tmpfs", "tmpfs", p.Cwd, p.Cred())
+		if err != 0 {
+			tfs.StopFS()
+		}
+		return int(err)
+	}
+
+	var disk fs.Disk_i
+	var srcname string
+	diskfs := true
+	switch {
+	case fstype.Eq(ustr.Ustr("memfs")):
+		disk = fs.MkMemdisk(memfs_inodeblks, memfs_datablks)
+		srcname = "memfs"
+		diskfs = false
+	case fstype.Eq(ustr.Ustr("bfs")):
+		src, err := p.Vm.Userstr(srcn, fs.NAME_MAX)
+		if err != 0 {
+			return int(err)
+		}
+		srcname = src.String()
+		n, ok := ahciport(src)
+		if !ok {
+			return int(-defs.ENODEV)
+		}
+		disk, ok = ahci.Port(n)
+		if !ok {
+			return int(-defs.ENXIO)
+		}
+	default:
+		return int(-defs.ENODEV)
+	}
+
+	_mounted.Lock()
+	defer _mounted.Unlock()
+
+	if _, ok := _mounted.disks[disk]; ok || disk == ahci.Ahci {
+		return int(-defs.EBUSY)
+	}
+	nfs, err := fs.AttachFS(ahci.Blockmem, disk, diskfs)
+	if err != 0 {
+		return int(err)
+	}
+	if err := thefs.Mount(target, nfs, srcname, fstype.String(), p.Cwd, p.Cred()); err != 0 {
+		nfs.StopFS()
+		return int(err)
+	}
+	_mounted.disks[disk] = nfs
+	return 0
+}
+
+func sys_umount(p *proc.Proc_t, targetn, flags int) int {
+	if !p.Cred().Isroot() {
+		return int(-defs.EPERM)
+	}
+	if flags != 0 {
+		return int(-defs.EINVAL)
+	}
+	target, err := p.Vm.Userstr(targetn, fs.NAME_MAX)
+	if err != 0 {
+		return int(err)
+	}
+	if err := badpath(target); err != 0 {
+		return int(err)
+	}
+
+	_mounted.Lock()
+	defer _mounted.Unlock()
+
+	ofs, err := thefs.Umount(target, p.Cwd)
+	if err != 0 {
+		return int(err)
+	}
+	for d, mfs := range _mounted.disks {
+		if mfs == ofs {
+			delete(_mounted.disks, d)
+		}
+	}
+	return 0
+}
+
+// makes source the swap device. source is either the AHCI port named by
+// source, like for mount(2), or a file. the swap device cannot be removed.
+func sys_swapon(p *proc.Proc_t, srcn, flags int) int {
+	if !p.Cred().Isroot() {
+		return int(-defs.EPERM)
+	}
+	if flags != 0 {
+		return int(-defs.EINVAL)
+	}
+	src, err := p.Vm.Userstr(srcn, fs.NAME_MAX)
+	if err != 0 {
+		return int(err)
+	}
+	if n, ok := ahciport(src); ok {
+		disk, ok := ahci.Port(n)
+		if !ok {
+			return int(-defs.ENXIO)
+		}
+		_mounted.Lock()
+		defer _mounted.Unlock()
+		if _, ok := _mounted.disks[disk]; ok || disk == ahci.Ahci {
+			return int(-defs.EBUSY)
+		}
+		sd, err := fs.MkSwapdisk(disk)
+		if err != 0 {
+			return int(err)
+		}
+		if err := vm.Swapon(sd); err != 0 {
+			return int(err)
+		}
+		// the disk cannot be mounted while it is the swap device
+		_mounted.disks[disk] = nil
+		return 0
+	}
+	if err := badpath(src); err != 0 {
+		return int(err)
+	}
+	file, err := thefs.Fs_open(src, defs.O_RDWR, 0, p.Cwd, p.Cred(), 0, 0)
+	if err != 0 {
+		return int(err)
+	}
+	sd, err := fs.Swapfile(file.Fops)
+	if err == 0 {
+		err = vm.Swapon(sd)
+		if err != 0 {
+			sd.Release()
+		}
+	}
+	if err != 0 {
+		fd.Close_panic(file)
+		return int(err)
+	}
+	// the file stays open while it is the swap device
+	return 0
+}
+
+func sys_reboot(p *proc.Proc_t) int {
+	// mov'ing to cr3 does not flush global pages. if, before loading the
+	// zero page into cr3 below, there are just enough TLB entries to
+	// dispatch a fault, but not enough to complete the fault handler, the
+	// fault handler will recursively fault forever since it uses an IST
+	// stack. therefore, flush the global pages too.
+	pge := uintptr(1 << 7)
+	runtime.Lcr4(runtime.Rcr4() &^ pge)
+	// who needs ACPI?
+	runtime.Lcr3(uintptr(mem.P_zeropg))
+	// poof
+	fmt.Printf("what?\n")
+	return 0
+}
+
+func sys_nanosleep(p *proc.Proc_t, sleeptsn, remaintsn int) int {
+	tot, _, err := p.Vm.Usertimespec(sleeptsn)
+	if err != 0 {
+		return int(err)
+	}
+	tochan := time.After(tot)
+	kn := &tinfo.Current().Killnaps
+	select {
+	case <-tochan:
+		return 0
 	case <-kn.Killch:
 		if kn.Kerr == 0 {
 			panic("no")
@@ -1434,6 +2123,26 @@ func sys_getppid(p *proc.Proc_t, tid defs.Tid_t) int {
 	return p.Pwait.Pid
 }
 
+func sys_setpgid(p *proc.Proc_t, pid, pgid int) int {
+	return int(p.Setpgid(pid, pgid))
+}
+
+func sys_getpgid(p *proc.Proc_t, pid int) int {
+	pgid, err := p.Getpgid(pid)
+	if err != 0 {
+		return int(err)
+	}
+	return pgid
+}
+
+func sys_setsid(p *proc.Proc_t) int {
+	sid, err := p.Setsid()
+	if err != 0 {
+		return int(err)
+	}
+	return sid
+}
+
 func sys_socket(p *proc.Proc_t, domain, typ, proto int) int {
 	var opts defs.Fdopt_t
 	if typ&defs.SOCK_NONBLOCK != 0 {
@@ -1457,6 +2166,10 @@ func sys_socket(p *proc.Proc_t, domain, typ, proto int) int {
 		tfops := &bnet.Tcpfops_t{}
 		tfops.Set(&bnet.Tcptcb_t{}, opts)
 		sfops = tfops
+	case domain == defs.AF_INET && typ&defs.SOCK_DGRAM != 0:
+		ufops := &bnet.Udpfops_t{}
+		ufops.Set(opts)
+		sfops = ufops
 	default:
 		return int(-defs.EINVAL)
 	}
@@ -1904,7 +2617,8 @@ func (sf *sudfops_t) Close() defs.Err_t {
 }
 
 func (sf *sudfops_t) Fstat(s *stat.Stat_t) defs.Err_t {
-	panic("no imp")
+	s.Wmode(defs.Mkdev(defs.D_SUD, 0))
+	return 0
 }
 
 func (sf *sudfops_t) Mmapi(int, int, bool) ([]mem.Mmapinfo_t, defs.Err_t) {
@@ -1934,6 +2648,26 @@ func (sf *sudfops_t) Truncate(newlen uint) defs.Err_t {
 	return -defs.EINVAL
 }
 
+func (sf *sudfops_t) Utimens(*cred.Cred_t, int, int) defs.Err_t {
+	return -defs.EINVAL
+}
+
+func (sf *sudfops_t) Fchmod(*cred.Cred_t, uint) defs.Err_t {
+	return -defs.EINVAL
+}
+
+func (sf *sudfops_t) Fchown(*cred.Cred_t, int, int) defs.Err_t {
+	return -defs.EINVAL
+}
+
+func (sf *sudfops_t) Getdents(fdops.Userio_i) (int, defs.Err_t) {
+	return 0, -defs.ENOTDIR
+}
+
+func (sf *sudfops_t) Fsync(bool) defs.Err_t {
+	return -defs.EINVAL
+}
+
 func (sf *sudfops_t) Pread(dst fdops.Userio_i, offset int) (int, defs.Err_t) {
 	return 0, -defs.ESPIPE
 }
@@ -1974,15 +2708,12 @@ func (sf *sudfops_t) Bind(sa []uint8) defs.Err_t {
 	path := ustr.MkUstrSlice(sa[poff:])
 	// try to create the specified file as a special device
 	bid := allbuds.bud_id_new()
-	fsf, err := thefs.Fs_open_inner(path, defs.O_CREAT|defs.O_EXCL, 0, proc.CurrentProc().Cwd, defs.D_SUD, int(bid))
+	cp := proc.CurrentProc()
+	inum, err := thefs.Fs_mknod(path, defs.O_EXCL, 0777, cp.Cwd, cp.Cred(), defs.D_SUD, int(bid))
 	if err != 0 {
 		return err
 	}
-	inum := fsf.Inum
 	bud := allbuds.bud_new(bid, path, inum)
-	if thefs.Fs_close(fsf.Inum) != 0 {
-		panic("must succeed")
-	}
 	sf.bud = bud
 	sf.bound = true
 	return 0
@@ -2008,10 +2739,14 @@ func (sf *sudfops_t) Sendmsg(src fdops.Userio_i, sa []uint8,
 	st := &stat.Stat_t{}
 	path := ustr.MkUstrSlice(sa[poff:])
 
-	err := thefs.Fs_stat(path, st, proc.CurrentProc().Cwd)
+	cp := proc.CurrentProc()
+	err := thefs.Fs_stat(path, st, cp.Cwd, cp.Cred())
 	if err != 0 {
 		return 0, err
 	}
+	if !stpermits(cp.Cred(), st, cred.MAY_WRITE) {
+		return 0, -defs.EACCES
+	}
 	maj, min := defs.Unmkdev(st.Rdev())
 	if maj != defs.D_SUD {
 		return 0, -defs.ECONNREFUSED
@@ -2076,7 +2811,21 @@ func (sf *sudfops_t) Fcntl(cmd, opt int) int {
 	return int(-defs.ENOSYS)
 }
 
-func (sf *sudfops_t) Getsockopt(opt int, bufarg fdops.Userio_i,
+// FIONREAD returns the size of the next datagram
+func (sf *sudfops_t) Ioctl(req int, arg fdops.Userio_i) defs.Err_t {
+	if req != defs.FIONREAD {
+		return -defs.ENOTTY
+	}
+	sf.Lock()
+	var n int
+	if sf.bound {
+		n = sf.bud.bud_nextsz()
+	}
+	sf.Unlock()
+	return fdops.Intout(arg, n)
+}
+
+func (sf *sudfops_t) Getsockopt(lev, opt int, bufarg fdops.Userio_i,
 	intarg int) (int, defs.Err_t) {
 	return 0, -defs.EOPNOTSUPP
 }
@@ -2183,6 +2932,14 @@ func (db *dgrambuf_t) _havedgram() bool {
 	return db.head != db.tail
 }
 
+// returns the size of the oldest datagram, or 0 if there is none
+func (db *dgrambuf_t) _nextsz() int {
+	if !db._havedgram() {
+		return 0
+	}
+	return db.dgrams[db.tail%uint(len(db.dgrams))].sz
+}
+
 func (db *dgrambuf_t) copyin(src fdops.Userio_i, from ustr.Ustr) (int, defs.Err_t) {
 	// is there a free source address slot and buffer space?
 	if !db._canhold(src.Totalsz()) {
@@ -2329,6 +3086,12 @@ func (bud *bud_t) bud_out(dst, fromsa, cmsg fdops.Userio_i) (int, int, int,
 	return ddid, fdid, 0, 0, err
 }
 
+func (bud *bud_t) bud_nextsz() int {
+	bud.Lock()
+	defer bud.Unlock()
+	return bud.dbuf._nextsz()
+}
+
 func (bud *bud_t) bud_poll(pm fdops.Pollmsg_t) (fdops.Ready_t, defs.Err_t) {
 	var ret fdops.Ready_t
 	var err defs.Err_t
@@ -2395,8 +3158,9 @@ func (sus *susfops_t) Close() defs.Err_t {
 	return err2
 }
 
-func (sus *susfops_t) Fstat(*stat.Stat_t) defs.Err_t {
-	panic("no imp")
+func (sus *susfops_t) Fstat(s *stat.Stat_t) defs.Err_t {
+	s.Wmode(defs.Mkdev(defs.D_SUS, 0))
+	return 0
 }
 
 func (sus *susfops_t) Lseek(int, int) (int, defs.Err_t) {
@@ -2440,6 +3204,26 @@ func (sus *susfops_t) Truncate(newlen uint) defs.Err_t {
 	return -defs.EINVAL
 }
 
+func (sus *susfops_t) Utimens(*cred.Cred_t, int, int) defs.Err_t {
+	return -defs.EINVAL
+}
+
+func (sus *susfops_t) Fchmod(*cred.Cred_t, uint) defs.Err_t {
+	return -defs.EINVAL
+}
+
+func (sus *susfops_t) Fchown(*cred.Cred_t, int, int) defs.Err_t {
+	return -defs.EINVAL
+}
+
+func (sus *susfops_t) Getdents(fdops.Userio_i) (int, defs.Err_t) {
+	return 0, -defs.ENOTDIR
+}
+
+func (sus *susfops_t) Fsync(bool) defs.Err_t {
+	return -defs.EINVAL
+}
+
 func (sus *susfops_t) Pread(dst fdops.Userio_i, offset int) (int, defs.Err_t) {
 	return 0, -defs.ESPIPE
 }
@@ -2464,13 +3248,11 @@ func (sus *susfops_t) Bind(saddr []uint8) defs.Err_t {
 	sid := susid_new()
 
 	// create special file
-	fsf, err := thefs.Fs_open_inner(path, defs.O_CREAT|defs.O_EXCL, 0, proc.CurrentProc().Cwd, defs.D_SUS, sid)
+	cp := proc.CurrentProc()
+	_, err := thefs.Fs_mknod(path, defs.O_EXCL, 0777, cp.Cwd, cp.Cred(), defs.D_SUS, sid)
 	if err != 0 {
 		return err
 	}
-	if thefs.Fs_close(fsf.Inum) != 0 {
-		panic("must succeed")
-	}
 	sus.myaddr = path
 	sus.mysid = sid
 	sus.bound = true
@@ -2489,10 +3271,14 @@ func (sus *susfops_t) Connect(saddr []uint8) defs.Err_t {
 
 	// lookup sid
 	st := &stat.Stat_t{}
-	err := thefs.Fs_stat(path, st, proc.CurrentProc().Cwd)
+	cp := proc.CurrentProc()
+	err := thefs.Fs_stat(path, st, cp.Cwd, cp.Cred())
 	if err != 0 {
 		return err
 	}
+	if !stpermits(cp.Cred(), st, cred.MAY_WRITE) {
+		return -defs.EACCES
+	}
 	maj, min := defs.Unmkdev(st.Rdev())
 	if maj != defs.D_SUS {
 		return -defs.ECONNREFUSED
@@ -2683,7 +3469,22 @@ func (sus *susfops_t) Fcntl(cmd, opt int) int {
 	}
 }
 
-func (sus *susfops_t) Getsockopt(opt int, bufarg fdops.Userio_i,
+// FIONREAD counts the bytes waiting in the connection's inbound pipe
+func (sus *susfops_t) Ioctl(req int, arg fdops.Userio_i) defs.Err_t {
+	switch req {
+	case defs.FIONREAD:
+		if !sus.conn {
+			return -defs.ENOTCONN
+		}
+		return sus.pipein.Ioctl(req, arg)
+	case defs.FIONBIO:
+		return fdops.Fionbio(sus, arg)
+	default:
+		return -defs.ENOTTY
+	}
+}
+
+func (sus *susfops_t) Getsockopt(lev, opt int, bufarg fdops.Userio_i,
 	intarg int) (int, defs.Err_t) {
 	switch opt {
 	case defs.SO_ERROR:
@@ -2932,8 +3733,9 @@ func (sf *suslfops_t) Close() defs.Err_t {
 	return sf.susl.susl_reopen(-1)
 }
 
-func (sf *suslfops_t) Fstat(*stat.Stat_t) defs.Err_t {
-	panic("no imp")
+func (sf *suslfops_t) Fstat(s *stat.Stat_t) defs.Err_t {
+	s.Wmode(defs.Mkdev(defs.D_SUS, 0))
+	return 0
 }
 
 func (sf *suslfops_t) Lseek(int, int) (int, defs.Err_t) {
@@ -2964,6 +3766,26 @@ func (sf *suslfops_t) Truncate(newlen uint) defs.Err_t {
 	return -defs.EINVAL
 }
 
+func (sf *suslfops_t) Utimens(*cred.Cred_t, int, int) defs.Err_t {
+	return -defs.EINVAL
+}
+
+func (sf *suslfops_t) Fchmod(*cred.Cred_t, uint) defs.Err_t {
+	return -defs.EINVAL
+}
+
+func (sf *suslfops_t) Fchown(*cred.Cred_t, int, int) defs.Err_t {
+	return -defs.EINVAL
+}
+
+func (sf *suslfops_t) Getdents(fdops.Userio_i) (int, defs.Err_t) {
+	return 0, -defs.ENOTDIR
+}
+
+func (sf *suslfops_t) Fsync(bool) defs.Err_t {
+	return -defs.EINVAL
+}
+
 func (sf *suslfops_t) Pread(dst fdops.Userio_i, offset int) (int, defs.Err_t) {
 	return 0, -defs.ESPIPE
 }
@@ -3033,7 +3855,18 @@ func (sf *suslfops_t) Fcntl(cmd, opt int) int {
 	}
 }
 
-func (sf *suslfops_t) Getsockopt(opt int, bufarg fdops.Userio_i,
+func (sf *suslfops_t) Ioctl(req int, arg fdops.Userio_i) defs.Err_t {
+	switch req {
+	case defs.FIONREAD:
+		return -defs.EINVAL
+	case defs.FIONBIO:
+		return fdops.Fionbio(sf, arg)
+	default:
+		return -defs.ENOTTY
+	}
+}
+
+func (sf *suslfops_t) Getsockopt(lev, opt int, bufarg fdops.Userio_i,
 	intarg int) (int, defs.Err_t) {
 	return 0, -defs.EOPNOTSUPP
 }
@@ -3066,8 +3899,8 @@ func sys_listen(p *proc.Proc_t, fdn, backlog int) int {
 }
 
 func sys_getsockopt(p *proc.Proc_t, fdn, level, opt, optvaln, optlenn int) int {
-	if level != defs.SOL_SOCKET {
-		panic("no imp")
+	if level != defs.SOL_SOCKET && level != defs.IPPROTO_TCP {
+		return int(-defs.ENOPROTOOPT)
 	}
 	var olen int
 	if optlenn != 0 {
@@ -3087,7 +3920,7 @@ func sys_getsockopt(p *proc.Proc_t, fdn, level, opt, optvaln, optlenn int) int {
 	if !ok {
 		return int(-defs.EBADF)
 	}
-	optwrote, err := fd.Fops.Getsockopt(opt, bufarg, intarg)
+	optwrote, err := fd.Fops.Getsockopt(level, opt, bufarg, intarg)
 	if err != 0 {
 		return int(err)
 	}
@@ -3148,12 +3981,15 @@ func sys_fork(parent *proc.Proc_t, ptf *[defs.TFSIZE]uintptr, tforkp int, flags
 		// lock fd table for copying
 		parent.Fdl.Lock()
 		cwd := *parent.Cwd
-		child, ok = proc.Proc_new(parent.Name, &cwd, parent.Fds, sys)
+		child, ok = proc.Proc_new(parent.Name, &cwd, parent.Cred(), parent.Fds, sys)
 		parent.Fdl.Unlock()
 		if !ok {
 			lhits++
 			return int(-defs.ENOMEM)
 		}
+		child.Setpersonality(parent.Personality())
+		child.Ulim = parent.Ulim
+		parent.Pgfork(child)
 
 		child.Vm.Pmap, child.Vm.P_pmap, ok = physmem.Pmap_new()
 		if !ok {
@@ -3236,6 +4072,7 @@ func sys_fork(parent *proc.Proc_t, ptf *[defs.TFSIZE]uintptr, tforkp int, flags
 	}
 
 	chtf[defs.TF_RAX] = 0
+	parent.Sigfork(child, childtid)
 	child.Sched_add(chtf, childtid)
 	return ret
 outmem:
@@ -3294,6 +4131,10 @@ func sys_execv1(p *proc.Proc_t, tf *[defs.TFSIZE]uintptr, paths ustr.Ustr,
 		p.Vm.Pmap[e.Pml4slot] = e.Entry
 	}
 
+	// the new image's mmap(2) hint, which the TLS and arguments also use
+	ommapi := p.Mmapi
+	p.Mmapi = mem.USERMIN + p.Aslr(proc.Mmaprand)
+
 	restore := func() {
 		vm.Uvmfree_inner(p.Vm.Pmap, p.Vm.P_pmap, &p.Vm.Vmregion)
 		physmem.Refdown(p.Vm.P_pmap)
@@ -3301,34 +4142,27 @@ func sys_execv1(p *proc.Proc_t, tf *[defs.TFSIZE]uintptr, paths ustr.Ustr,
 		p.Vm.Pmap = opmap
 		p.Vm.P_pmap = op_pmap
 		p.Vm.Vmregion = ovmreg
+		p.Mmapi = ommapi
 	}
 
 	// load binary image -- get first block of file
-	file, err := thefs.Fs_open(paths, defs.O_RDONLY, 0, p.Cwd, 0, 0)
+	file, err := thefs.Fs_open(paths, defs.O_EXEC, 0, p.Cwd, p.Cred(), 0, 0)
 	if err != 0 {
 		restore()
 		return int(err)
 	}
 	defer fd.Close_panic(file)
-
-	hdata := make([]uint8, 512)
-	ub := &vm.Fakeubuf_t{}
-	ub.Fake_init(hdata)
-	ret, err := file.Fops.Read(ub)
-	if err != 0 {
+	st := &stat.Stat_t{}
+	if err := file.Fops.Fstat(st); err != 0 {
 		restore()
 		return int(err)
 	}
-	if ret < len(hdata) {
-		hdata = hdata[0:ret]
-	}
 
 	// assume its always an elf, for now
-	elfhdr := &elf_t{hdata}
-	ok = elfhdr.sanity()
-	if !ok {
+	elfhdr, err := elf_read(file)
+	if err != 0 {
 		restore()
-		return int(-defs.EPERM)
+		return int(err)
 	}
 
 	// elf_load() will create two copies of TLS section: one for the fresh
@@ -3343,7 +4177,7 @@ func sys_execv1(p *proc.Proc_t, tf *[defs.TFSIZE]uintptr, paths ustr.Ustr,
 	numstkpages := 6
 	// +1 for the guard page
 	stksz := (numstkpages + 1) * mem.PGSIZE
-	stackva := p.Vm.Unusedva_inner(0x0ff<<39, stksz)
+	stackva := p.Vm.Unusedva_inner(0x0ff<<39-p.Aslr(proc.Stackrand), stksz)
 	p.Vm.Vmadd_anon(stackva, mem.PGSIZE, 0)
 	p.Vm.Vmadd_anon(stackva+mem.PGSIZE, stksz-mem.PGSIZE, vm.PTE_U|vm.PTE_W)
 	stackva += stksz
@@ -3364,24 +4198,44 @@ func sys_execv1(p *proc.Proc_t, tf *[defs.TFSIZE]uintptr, paths ustr.Ustr,
 	}
 
 	// XXX make insertargs not fail by using more than a page...
-	argc, argv, err := insertargs(p, args)
+	argptrs, argv, err := insertargs(p, args)
 	if err != 0 {
 		restore()
 		return int(err)
 	}
+	argc := len(argptrs) - 1
 
-	// put special struct on stack: fresh tls start, tls len, and tls0
-	// pointer
-	words := 4
-	buf := make([]uint8, words*8)
-	writen(buf, 8, 0, freshtls)
-	writen(buf, 8, 8, tlssz)
-	writen(buf, 8, 16, t0tls)
-	writen(buf, 8, 24, int(runtime.Pspercycle))
+	// put special struct on stack: fresh tls start, tls len, tls0
+	// pointer, cycles per second, and the auxiliary vector
+	words := 5
 	bufdest := stackva - words*8
 	tls0addr := bufdest + 2*8
-
-	if err := p.Vm.K2user_inner(buf, bufdest); err != 0 {
+	// below it are the random bytes of AT_RANDOM and then the initial
+	// stack of the System V ABI: argc, argv, an empty environment, and
+	// the auxiliary vector. the interpreter of a dynamically-linked
+	// program finds the program through the auxiliary vector.
+	randva := bufdest - 16
+	auxv := elfhdr.auxv(randva)
+	vec := append([]int{argc}, argptrs...)
+	vec = append(vec, 0)
+	auxva := len(vec)
+	vec = append(vec, auxv...)
+	sp := util.Rounddown(randva-len(vec)*8, 16)
+	auxva = sp + auxva*8
+
+	buf := make([]uint8, stackva-sp)
+	for i, w := range vec {
+		writen(buf, 8, i*8, w)
+	}
+	proc.Random(buf[randva-sp : bufdest-sp])
+	kinfo := buf[bufdest-sp:]
+	writen(kinfo, 8, 0, freshtls)
+	writen(kinfo, 8, 8, tlssz)
+	writen(kinfo, 8, 16, t0tls)
+	writen(kinfo, 8, 24, int(runtime.Pspercycle))
+	writen(kinfo, 8, 32, auxva)
+
+	if err := p.Vm.K2user_inner(buf, sp); err != 0 {
 		restore()
 		return int(err)
 	}
@@ -3406,8 +4260,8 @@ func sys_execv1(p *proc.Proc_t, tf *[defs.TFSIZE]uintptr, paths ustr.Ustr,
 	}
 
 	// commit new image state
-	tf[defs.TF_RSP] = uintptr(bufdest)
-	tf[defs.TF_RIP] = uintptr(elfhdr.entry())
+	tf[defs.TF_RSP] = uintptr(sp)
+	tf[defs.TF_RIP] = uintptr(elfhdr.start())
 	tf[defs.TF_RFLAGS] = uintptr(defs.TF_FL_IF)
 	ucseg := uintptr(5)
 	udseg := uintptr(6)
@@ -3417,24 +4271,46 @@ func sys_execv1(p *proc.Proc_t, tf *[defs.TFSIZE]uintptr, paths ustr.Ustr,
 	tf[defs.TF_RSI] = uintptr(argv)
 	tf[defs.TF_RDX] = uintptr(bufdest)
 	tf[defs.TF_FSBASE] = uintptr(tls0addr)
-	p.Mmapi = mem.USERMIN
 	p.Name = paths
+	p.Setexeced()
+
+	p.Credl.Lock()
+	p.Setcred(execcred(p.Cred(), st))
+	p.Credl.Unlock()
 
 	return 0
 }
 
-func insertargs(p *proc.Proc_t, sargs []ustr.Ustr) (int, int, defs.Err_t) {
+// returns the credentials of a process with credentials cr after it executes
+// the file with stat st: the setuid and setgid bits change the effective ids,
+// and the saved ids are set to the effective ids.
+func execcred(cr *cred.Cred_t, st *stat.Stat_t) *cred.Cred_t {
+	ret := cr.Copy()
+	if st.Mode()&defs.S_ISUID != 0 {
+		ret.Euid = st.Uid()
+	}
+	if st.Mode()&defs.S_ISGID != 0 {
+		ret.Egid = st.Gid()
+	}
+	ret.Suid = ret.Euid
+	ret.Sgid = ret.Egid
+	return ret
+}
+
+// copies the arguments to a new page, returning their addresses, which end
+// with 0, and the address of the argv array
+func insertargs(p *proc.Proc_t, sargs []ustr.Ustr) ([]int, int, defs.Err_t) {
 	// find free page
-	uva := p.Vm.Unusedva_inner(0, mem.PGSIZE)
+	uva := p.Vm.Unusedva_inner(p.Mmapi, mem.PGSIZE)
 	p.Vm.Vmadd_anon(uva, mem.PGSIZE, vm.PTE_U)
 	_, p_pg, ok := physmem.Refpg_new()
 	if !ok {
-		return 0, 0, -defs.ENOMEM
+		return nil, 0, -defs.ENOMEM
 	}
 	_, ok = p.Vm.Page_insert(uva, p_pg, vm.PTE_U, true, nil)
 	if !ok {
 		physmem.Refdown(p_pg)
-		return 0, 0, -defs.ENOMEM
+		return nil, 0, -defs.ENOMEM
 	}
 	//var args [][]uint8
 	args := make([][]uint8, 0, 12)
@@ -3451,7 +4327,7 @@ func insertargs(p *proc.Proc_t, sargs []ustr.Ustr) (int, int, defs.Err_t) {
 		if err := p.Vm.K2user_inner(arg, uva+cnt); err != 0 {
 			// args take up more than a page? the user is on their
 			// own.
-			return 0, 0, err
+			return nil, 0, err
 		}
 		cnt += len(arg)
 	}
@@ -3462,12 +4338,12 @@ func insertargs(p *proc.Proc_t, sargs []ustr.Ustr) (int, int, defs.Err_t) {
 	if err != 0 || len(vdata) < len(argptrs)*8 {
 		fmt.Printf("no room for args")
 		// XXX
-		return 0, 0, -defs.ENOSPC
+		return nil, 0, -defs.ENOSPC
 	}
 	for i, ptr := range argptrs {
 		writen(vdata, 8, i*8, ptr)
 	}
-	return len(args), argstart, 0
+	return argptrs, argstart, 0
 }
 
 func (s *syscall_t) Sys_exit(p *proc.Proc_t, tid defs.Tid_t, status int) {
@@ -3482,9 +4358,9 @@ func sys_threxit(p *proc.Proc_t, tid defs.Tid_t, status int) {
 
 func sys_wait4(p *proc.Proc_t, tid defs.Tid_t, wpid, statusp, options, rusagep,
 	_isthread int) int {
-	if wpid == defs.WAIT_MYPGRP || options == defs.WCONTINUED ||
-		options == defs.WUNTRACED {
-		panic("no imp")
+	jobctl := defs.WUNTRACED | defs.WCONTINUED
+	if options&^(defs.WNOHANG|jobctl) != 0 {
+		return int(-defs.EINVAL)
 	}
 
 	// no waiting for yourself!
@@ -3492,9 +4368,13 @@ func sys_wait4(p *proc.Proc_t, tid defs.Tid_t, wpid, statusp, options, rusagep,
 		return int(-defs.ECHILD)
 	}
 	isthread := _isthread != 0
-	if isthread && wpid == defs.WAIT_ANY {
+	if isthread && wpid <= 0 {
 		return int(-defs.EINVAL)
 	}
+	if wpid == defs.WAIT_MYPGRP {
+		pgid, _ := p.Pgrp()
+		wpid = -pgid
+	}
 
 	noblk := options&defs.WNOHANG != 0
 	var resp proc.Waitst_t
@@ -3502,7 +4382,7 @@ func sys_wait4(p *proc.Proc_t, tid defs.Tid_t, wpid, statusp, options, rusagep,
 	if isthread {
 		resp, err = p.Mywait.Reaptid(wpid, noblk)
 	} else {
-		resp, err = p.Mywait.Reappid(wpid, noblk)
+		resp, err = p.Mywait.Reappid(wpid, noblk, options&jobctl)
 	}
 
 	if err != 0 {
@@ -3536,14 +4416,33 @@ func sys_wait4(p *proc.Proc_t, tid defs.Tid_t, wpid, statusp, options, rusagep,
 }
 
 func sys_kill(p *proc.Proc_t, pid, sig int) int {
-	if sig != defs.SIGKILL {
-		panic("no imp")
+	if sig < 0 || sig >= defs.NSIG {
+		return int(-defs.EINVAL)
+	}
+	if pid == -1 {
+		return int(-defs.EINVAL)
 	}
-	p, ok := proc.Proc_check(pid)
+	// zero is the caller's process group and -pgid is group pgid
+	if pid <= 0 {
+		pgid := -pid
+		if pid == 0 {
+			pgid, _ = p.Pgrp()
+		}
+		si := &proc.Siginfo_t{Signo: sig, Code: defs.SI_USER, Pid: p.Pid}
+		return int(proc.Pgkill(p, pgid, si))
+	}
+	tp, ok := proc.Proc_check(pid)
 	if !ok {
 		return int(-defs.ESRCH)
 	}
-	p.Doomall()
+	if !p.Maysignal(tp, sig) {
+		return int(-defs.EPERM)
+	}
+	// signal 0 only checks whether the process exists
+	if sig == 0 {
+		return 0
+	}
+	tp.Sigpost(&proc.Siginfo_t{Signo: sig, Code: defs.SI_USER, Pid: p.Pid})
 	return 0
 }
 
@@ -3821,31 +4720,40 @@ func futex_ensure(uniq uintptr) (futex_t, defs.Err_t) {
 	return r, 0
 }
 
-// pmap must be locked. maps user va to kernel va. returns kva as uintptr and
-// *uint32
+// pmap must be locked. maps user va to kernel va, swapping in the page if it
+// was swapped out. returns kva as uintptr and *uint32
 func _uva2kva(p *proc.Proc_t, va uintptr) (uintptr, *uint32, defs.Err_t) {
 	p.Vm.Lockassert_pmap()
 
-	pte := vm.Pmap_lookup(p.Vm.Pmap, int(va))
-	if pte == nil || *pte&vm.PTE_P == 0 || *pte&vm.PTE_U == 0 {
-		return 0, nil, -defs.EFAULT
+	p_pg, err := p.Vm.Upage(int(va))
+	if err != 0 {
+		return 0, nil, err
 	}
-	pgva := physmem.Dmap(*pte & vm.PTE_ADDR)
+	pgva := physmem.Dmap(p_pg)
 	pgoff := uintptr(va) & uintptr(vm.PGOFFSET)
 	uniq := uintptr(unsafe.Pointer(pgva)) + pgoff
 	return uniq, (*uint32)(unsafe.Pointer(uniq)), 0
 }
 
-func va2fut(p *proc.Proc_t, va uintptr) (futex_t, defs.Err_t) {
+// returns the futex at va and its page, which is pinned until the caller
+// unpins it since futexes are keyed by kernel address, which would change if
+// the page were swapped out and in.
+func va2fut(p *proc.Proc_t, va uintptr) (futex_t, mem.Pa_t, defs.Err_t) {
 	p.Vm.Lock_pmap()
 	defer p.Vm.Unlock_pmap()
 
 	var zf futex_t
 	uniq, _, err := _uva2kva(p, va)
 	if err != 0 {
-		return zf, err
+		return zf, 0, err
 	}
-	return futex_ensure(uniq)
+	p_pg, _ := p.Vm.Upage(int(va))
+	ret, err := futex_ensure(uniq)
+	if err != 0 {
+		return zf, 0, err
+	}
+	vm.Swappin(p_pg)
+	return ret, p_pg, 0
 }
 
 // an object for atomically looking-up and incrementing/loading from a user
@@ -3879,10 +4787,11 @@ func sys_futex(p *proc.Proc_t, _op, _futn, _fut2n, aux, timespecn int) int {
 	if (futn|fut2n)&0x3 != 0 {
 		return int(-defs.EINVAL)
 	}
-	fut, err := va2fut(p, futn)
+	fut, p_pg, err := va2fut(p, futn)
 	if err != 0 {
 		return int(err)
 	}
+	defer vm.Swapunpin(p_pg)
 
 	var fm futexmsg_t
 	// could lazily allocate one futex channel per thread
@@ -3903,10 +4812,12 @@ func sys_futex(p *proc.Proc_t, _op, _futn, _fut2n, aux, timespecn int) int {
 	}
 
 	if op == defs.FUTEX_CNDGIVE {
-		fm.othmut, err = va2fut(p, fut2n)
+		var p_pg2 mem.Pa_t
+		fm.othmut, p_pg2, err = va2fut(p, fut2n)
 		if err != 0 {
 			return int(err)
 		}
+		defer vm.Swapunpin(p_pg2)
 	}
 
 	kn := &tinfo.Current().Killnaps
@@ -3945,20 +4856,126 @@ func sys_fcntl(p *proc.Proc_t, fdn, cmd, opt int) int {
 	// fd specific fcntl(2) ops
 	case defs.F_GETFL, defs.F_SETFL:
 		return f.Fops.Fcntl(cmd, opt)
+	case defs.F_GETLK, defs.F_SETLK, defs.F_SETLKW:
+		return int(_fcntl_lock(p, f, cmd, opt))
 	default:
 		return int(-defs.EINVAL)
 	}
 }
 
-func sys_truncate(p *proc.Proc_t, pathn int, newlen uint) int {
-	path, err := p.Vm.Userstr(pathn, fs.NAME_MAX)
+// reads the struct flock at flp and makes its range absolute
+func _userflock(p *proc.Proc_t, f *fd.Fd_t, flp int) (fdops.Flock_t, defs.Err_t) {
+	var fl fdops.Flock_t
+	var whence int
+	var err defs.Err_t
+	if fl.Type, err = p.Vm.Userreadn(flp, 2); err != 0 {
+		return fl, err
+	}
+	if whence, err = p.Vm.Userreadn(flp+2, 2); err != 0 {
+		return fl, err
+	}
+	if fl.Start, err = p.Vm.Userreadn(flp+8, 8); err != 0 {
+		return fl, err
+	}
+	if fl.Len, err = p.Vm.Userreadn(flp+16, 8); err != 0 {
+		return fl, err
+	}
+	switch whence {
+	case defs.SEEK_SET:
+	case defs.SEEK_CUR:
+		off, err := f.Fops.Lseek(0, defs.SEEK_CUR)
+		if err != 0 {
+			return fl, err
+		}
+		fl.Start += off
+	case defs.SEEK_END:
+		st := &stat.Stat_t{}
+		if err := f.Fops.Fstat(st); err != 0 {
+			return fl, err
+		}
+		fl.Start += int(st.Size())
+	default:
+		return fl, -defs.EINVAL
+	}
+	// a negative length locks the bytes before the start
+	if fl.Len < 0 {
+		fl.Start += fl.Len
+		fl.Len = -fl.Len
+	}
+	if fl.Start < 0 {
+		return fl, -defs.EINVAL
+	}
+	return fl, 0
+}
+
+// F_GETLK, F_SETLK, and F_SETLKW
+func _fcntl_lock(p *proc.Proc_t, f *fd.Fd_t, cmd, flp int) defs.Err_t {
+	lk, ok := f.Fops.(fdops.Lockable_i)
+	if !ok {
+		return -defs.EINVAL
+	}
+	fl, err := _userflock(p, f, flp)
+	if err != 0 {
+		return err
+	}
+	switch fl.Type {
+	case defs.F_RDLCK:
+		if cmd != defs.F_GETLK && f.Perms&fd.FD_READ == 0 {
+			return -defs.EBADF
+		}
+	case defs.F_WRLCK:
+		if cmd != defs.F_GETLK && f.Perms&fd.FD_WRITE == 0 {
+			return -defs.EBADF
+		}
+	case defs.F_UNLCK:
+		if cmd == defs.F_GETLK {
+			return -defs.EINVAL
+		}
+	default:
+		return -defs.EINVAL
+	}
+	if err := lk.Reclock(p.Pid, cmd, &fl); err != 0 || cmd != defs.F_GETLK {
+		return err
+	}
+	if err := p.Vm.Userwriten(flp, 2, fl.Type); err != 0 {
+		return err
+	}
+	if fl.Type == defs.F_UNLCK {
+		return 0
+	}
+	if err := p.Vm.Userwriten(flp+2, 2, defs.SEEK_SET); err != 0 {
+		return err
+	}
+	if err := p.Vm.Userwriten(flp+8, 8, fl.Start); err != 0 {
+		return err
+	}
+	if err := p.Vm.Userwriten(flp+16, 8, fl.Len); err != 0 {
+		return err
+	}
+	return p.Vm.Userwriten(flp+24, 8, fl.Pid)
+}
+
+func sys_flock(p *proc.Proc_t, fdn, how int) int {
+	f, ok := p.Fd_get(fdn)
+	if !ok {
+		return int(-defs.EBADF)
+	}
+	lk, ok := f.Fops.(fdops.Lockable_i)
+	if !ok {
+		return int(-defs.EINVAL)
+	}
+	return int(lk.Flock(how))
+}
+
+func sys_truncate(p *proc.Proc_t, pathn int, newlen uint) int {
+	path, err := p.Vm.Userstr(pathn, fs.NAME_MAX)
 	if err != 0 {
 		return int(err)
 	}
 	if err := badpath(path); err != 0 {
 		return int(err)
 	}
-	f, err := thefs.Fs_open(path, defs.O_WRONLY, 0, p.Cwd, 0, 0)
+	f, err := thefs.Fs_open(path, defs.O_WRONLY, 0, p.Cwd, p.Cred(), 0, 0)
 	if err != 0 {
 		return int(err)
 	}
@@ -3975,6 +4992,204 @@ func sys_ftruncate(p *proc.Proc_t, fdn int, newlen uint) int {
 	return int(fd.Fops.Truncate(newlen))
 }
 
+// reads the access and modification times from the user array of two
+// timespecs at tsn, returning nanoseconds since the epoch, UT_OMIT or UT_NOW.
+// a null tsn sets both times to now. the file systems resolve now themselves,
+// since anyone who may write a file may set its times to now, but only its
+// owner may set other times.
+func _usertimes(p *proc.Proc_t, tsn int) (int, int, defs.Err_t) {
+	if tsn == 0 {
+		return defs.UT_NOW, defs.UT_NOW, 0
+	}
+	var ret [2]int
+	for i := range ret {
+		secs, err := p.Vm.Userreadn(tsn+16*i, 8)
+		if err != 0 {
+			return 0, 0, err
+		}
+		nsecs, err := p.Vm.Userreadn(tsn+16*i+8, 8)
+		if err != 0 {
+			return 0, 0, err
+		}
+		switch {
+		case nsecs == defs.UTIME_NOW:
+			ret[i] = defs.UT_NOW
+		case nsecs == defs.UTIME_OMIT:
+			ret[i] = defs.UT_OMIT
+		case secs < 0 || nsecs < 0 || nsecs >= 1e9:
+			return 0, 0, -defs.EINVAL
+		default:
+			ret[i] = secs*1e9 + nsecs
+		}
+	}
+	return ret[0], ret[1], 0
+}
+
+func sys_utimes(p *proc.Proc_t, pathn, tsn int) int {
+	path, err := p.Vm.Userstr(pathn, fs.NAME_MAX)
+	if err != 0 {
+		return int(err)
+	}
+	if err := badpath(path); err != 0 {
+		return int(err)
+	}
+	atime, mtime, err := _usertimes(p, tsn)
+	if err != 0 {
+		return int(err)
+	}
+	return int(thefs.Fs_utimes(path, atime, mtime, p.Cwd, p.Cred()))
+}
+
+func sys_futimens(p *proc.Proc_t, fdn, tsn int) int {
+	fd, ok := p.Fd_get(fdn)
+	if !ok {
+		return int(-defs.EBADF)
+	}
+	atime, mtime, err := _usertimes(p, tsn)
+	if err != 0 {
+		return int(err)
+	}
+	return int(fd.Fops.Utimens(p.Cred(), atime, mtime))
+}
+
+func sys_chmod(p *proc.Proc_t, pathn, mode int) int {
+	path, err := p.Vm.Userstr(pathn, fs.NAME_MAX)
+	if err != 0 {
+		return int(err)
+	}
+	if err := badpath(path); err != 0 {
+		return int(err)
+	}
+	return int(thefs.Fs_chmod(path, uint(mode), p.Cwd, p.Cred()))
+}
+
+func sys_fchmod(p *proc.Proc_t, fdn, mode int) int {
+	fd, ok := p.Fd_get(fdn)
+	if !ok {
+		return int(-defs.EBADF)
+	}
+	return int(fd.Fops.Fchmod(p.Cred(), uint(mode)))
+}
+
+func sys_chown(p *proc.Proc_t, pathn, uid, gid int) int {
+	path, err := p.Vm.Userstr(pathn, fs.NAME_MAX)
+	if err != 0 {
+		return int(err)
+	}
+	if err := badpath(path); err != 0 {
+		return int(err)
+	}
+	return int(thefs.Fs_chown(path, uid, gid, p.Cwd, p.Cred()))
+}
+
+func sys_fchown(p *proc.Proc_t, fdn, uid, gid int) int {
+	fd, ok := p.Fd_get(fdn)
+	if !ok {
+		return int(-defs.EBADF)
+	}
+	return int(fd.Fops.Fchown(p.Cred(), uid, gid))
+}
+
+func sys_umask(p *proc.Proc_t, mask int) int {
+	return int(p.Cwd.Setumask(uint(mask)))
+}
+
+func sys_getuid(p *proc.Proc_t) int {
+	return p.Cred().Ruid
+}
+
+func sys_geteuid(p *proc.Proc_t) int {
+	return p.Cred().Euid
+}
+
+func sys_getgid(p *proc.Proc_t) int {
+	return p.Cred().Rgid
+}
+
+func sys_getegid(p *proc.Proc_t) int {
+	return p.Cred().Egid
+}
+
+// like POSIX, root sets all three ids while other users may only set the
+// effective id to the real or saved id.
+func sys_setuid(p *proc.Proc_t, uid int) int {
+	if uid < 0 {
+		return int(-defs.EINVAL)
+	}
+	p.Credl.Lock()
+	defer p.Credl.Unlock()
+	cr := p.Cred()
+	ncr := cr.Copy()
+	if cr.Isroot() {
+		ncr.Ruid, ncr.Euid, ncr.Suid = uid, uid, uid
+	} else if uid == cr.Ruid || uid == cr.Suid {
+		ncr.Euid = uid
+	} else {
+		return int(-defs.EPERM)
+	}
+	p.Setcred(ncr)
+	return 0
+}
+
+func sys_setgid(p *proc.Proc_t, gid int) int {
+	if gid < 0 {
+		return int(-defs.EINVAL)
+	}
+	p.Credl.Lock()
+	defer p.Credl.Unlock()
+	cr := p.Cred()
+	ncr := cr.Copy()
+	if cr.Isroot() {
+		ncr.Rgid, ncr.Egid, ncr.Sgid = gid, gid, gid
+	} else if gid == cr.Rgid || gid == cr.Sgid {
+		ncr.Egid = gid
+	} else {
+		return int(-defs.EPERM)
+	}
+	p.Setcred(ncr)
+	return 0
+}
+
+// the group ids are 8 bytes each
+func sys_getgroups(p *proc.Proc_t, n, bufn int) int {
+	groups := p.Cred().Groups
+	if n == 0 {
+		return len(groups)
+	}
+	if n < len(groups) {
+		return int(-defs.EINVAL)
+	}
+	for i, g := range groups {
+		if err := p.Vm.Userwriten(bufn+i*8, 8, g); err != 0 {
+			return int(err)
+		}
+	}
+	return len(groups)
+}
+
+func sys_setgroups(p *proc.Proc_t, n, bufn int) int {
+	if n < 0 || n > defs.NGROUPS_MAX {
+		return int(-defs.EINVAL)
+	}
+	if !p.Cred().Isroot() {
+		return int(-defs.EPERM)
+	}
+	groups := make([]int, n)
+	for i := range groups {
+		g, err := p.Vm.Userreadn(bufn+i*8, 8)
+		if err != 0 {
+			return int(err)
+		}
+		groups[i] = g
+	}
+	p.Credl.Lock()
+	defer p.Credl.Unlock()
+	ncr := p.Cred().Copy()
+	ncr.Groups = groups
+	p.Setcred(ncr)
+	return 0
+}
+
 func sys_getcwd(p *proc.Proc_t, bufn, sz int) int {
 	dst := p.Vm.Mkuserbuf(bufn, sz)
 	_, err := dst.Uiowrite([]uint8(p.Cwd.Path))
@@ -4000,17 +5215,19 @@ func sys_chdir(p *proc.Proc_t, dirn int) int {
 	p.Cwd.Lock()
 	defer p.Cwd.Unlock()
 
-	newfd, err := thefs.Fs_open(path, defs.O_RDONLY|defs.O_DIRECTORY, 0, p.Cwd, 0, 0)
+	// the path of the cwd has no symlinks, so that ".." is the parent of
+	// the directory, not of the symlink that led to it
+	rpath, err := thefs.Realpath(path, p.Cwd, p.Cred())
+	if err != 0 {
+		return int(err)
+	}
+	newfd, err := thefs.Fs_open(rpath, defs.O_EXEC|defs.O_DIRECTORY, 0, p.Cwd, p.Cred(), 0, 0)
 	if err != 0 {
 		return int(err)
 	}
 	fd.Close_panic(p.Cwd.Fd)
 	p.Cwd.Fd = newfd
-	if path.IsAbsolute() {
-		p.Cwd.Path = bpath.Canonicalize(path)
-	} else {
-		p.Cwd.Path = p.Cwd.Canonicalpath(path)
-	}
+	p.Cwd.Path = rpath
 	return 0
 }
 
@@ -4255,7 +5472,7 @@ func makefake(p *proc.Proc_t) defs.Err_t {
 		}
 		for i := range newfds {
 			if newfds[i] == nil {
-				newfds[i] = thefs.Makefake()
+				newfds[i] = rootfs.Makefake()
 			}
 		}
 	}
@@ -4369,6 +5586,11 @@ func fieldinfo(sizes []int, n int) (int, int) {
 
 type elf_t struct {
 	data []uint8
+	// what elf_load adds to the addresses of a position-independent
+	// executable
+	bias int
+	// the program interpreter that elf_load loaded, if any
+	interp *elf_t
 }
 
 type elf_phdr struct {
@@ -4388,6 +5610,60 @@ const (
 	ELF_XWORD   = 8
 )
 
+// object file types
+const (
+	ET_EXEC = 2
+	ET_DYN  = 3
+	ET_CORE = 4
+)
+
+// segment types
+const (
+	PT_LOAD   = 1
+	PT_INTERP = 3
+	PT_NOTE   = 4
+	PT_PHDR   = 6
+	PT_TLS    = 7
+)
+
+// segment permissions
+const (
+	PF_X = 1
+	PF_W = 2
+	PF_R = 4
+)
+
+// auxiliary vector entry types
+const (
+	AT_NULL   = 0
+	AT_PHDR   = 3
+	AT_PHENT  = 4
+	AT_PHNUM  = 5
+	AT_PAGESZ = 6
+	AT_BASE   = 7
+	AT_ENTRY  = 9
+	AT_RANDOM = 25
+)
+
+// reads the ELF header and program headers at the start of file
+func elf_read(file *fd.Fd_t) (*elf_t, defs.Err_t) {
+	hdata := make([]uint8, 512)
+	ub := &vm.Fakeubuf_t{}
+	ub.Fake_init(hdata)
+	ret, err := file.Fops.Pread(ub, 0)
+	if err != 0 {
+		return nil, err
+	}
+	if ret < len(hdata) {
+		hdata = hdata[0:ret]
+	}
+	e := &elf_t{data: hdata}
+	if !e.sanity() {
+		return nil, -defs.EPERM
+	}
+	return e, 0
+}
+
 func (e *elf_t) sanity() bool {
 	// make sure its an elf
 	e_ident := 0
@@ -4420,9 +5696,22 @@ func (e *elf_t) sanity() bool {
 		return false
 	}
 
+	if t := e.etype(); t != ET_EXEC && t != ET_DYN {
+		return false
+	}
 	return true
 }
 
+func (e *elf_t) etype() int {
+	e_type := 0x10
+	return readn(e.data, ELF_QUARTER, e_type)
+}
+
+func (e *elf_t) phentsize() int {
+	e_phentsize := 0x36
+	return readn(e.data, ELF_QUARTER, e_phentsize)
+}
+
 func (e *elf_t) npheaders() int {
 	e_phnum := 0x38
 	return readn(e.data, ELF_QUARTER, e_phnum)
@@ -4453,7 +5742,7 @@ func (e *elf_t) header(c int) elf_phdr {
 	ret.etype = f(p_type, ELF_HALF)
 	ret.flags = f(p_flags, ELF_HALF)
 	ret.fileoff = f(p_offset, ELF_OFF)
-	ret.vaddr = f(p_vaddr, ELF_ADDR)
+	ret.vaddr = f(p_vaddr, ELF_ADDR) + e.bias
 	ret.filesz = f(p_filesz, ELF_XWORD)
 	ret.memsz = f(p_memsz, ELF_XWORD)
 	return ret
@@ -4470,7 +5759,142 @@ func (e *elf_t) headers() []elf_phdr {
 
 func (e *elf_t) entry() int {
 	e_entry := 0x18
-	return readn(e.data, ELF_ADDR, e_entry)
+	return readn(e.data, ELF_ADDR, e_entry) + e.bias
+}
+
+// returns where the first thread starts: the entry of the interpreter if there
+// is one
+func (e *elf_t) start() int {
+	if e.interp != nil {
+		return e.interp.entry()
+	}
+	return e.entry()
+}
+
+// returns the lowest and highest addresses of the loadable segments
+func (e *elf_t) span() (int, int) {
+	lo, hi := -1, 0
+	for _, hdr := range e.headers() {
+		if hdr.etype != PT_LOAD {
+			continue
+		}
+		if lo == -1 || hdr.vaddr < lo {
+			lo = hdr.vaddr
+		}
+		if hdr.vaddr+hdr.memsz > hi {
+			hi = hdr.vaddr + hdr.memsz
+		}
+	}
+	return util.Rounddown(lo, mem.PGSIZE), util.Roundup(hi, mem.PGSIZE)
+}
+
+// returns the address of the loaded program headers, or 0 if they are not
+// loaded
+func (e *elf_t) phdrva() int {
+	e_phoff := 0x20
+	phoff := readn(e.data, ELF_OFF, e_phoff)
+	for _, hdr := range e.headers() {
+		if hdr.etype == PT_PHDR {
+			return hdr.vaddr
+		}
+	}
+	for _, hdr := range e.headers() {
+		if hdr.etype == PT_LOAD && phoff >= hdr.fileoff &&
+			phoff < hdr.fileoff+hdr.filesz {
+			return hdr.vaddr + phoff - hdr.fileoff
+		}
+	}
+	return 0
+}
+
+// returns the auxiliary vector of the loaded program, whose AT_RANDOM bytes
+// are at randva
+func (e *elf_t) auxv(randva int) []int {
+	base := 0
+	if e.interp != nil {
+		base = e.interp.bias
+	}
+	return []int{
+		AT_PHDR, e.phdrva(),
+		AT_PHENT, e.phentsize(),
+		AT_PHNUM, e.npheaders(),
+		AT_PAGESZ, mem.PGSIZE,
+		AT_BASE, base,
+		AT_ENTRY, e.entry(),
+		AT_RANDOM, randva,
+		AT_NULL, 0,
+	}
+}
+
+// returns the path of the program interpreter, or false if there is none
+func (e *elf_t) interppath(f *fd.Fd_t) (ustr.Ustr, bool, defs.Err_t) {
+	for _, hdr := range e.headers() {
+		if hdr.etype != PT_INTERP {
+			continue
+		}
+		if hdr.filesz <= 1 || hdr.filesz > fs.NAME_MAX {
+			return nil, false, -defs.EPERM
+		}
+		buf := make([]uint8, hdr.filesz)
+		ub := &vm.Fakeubuf_t{}
+		ub.Fake_init(buf)
+		n, err := f.Fops.Pread(ub, hdr.fileoff)
+		if err != 0 {
+			return nil, false, err
+		}
+		if n != len(buf) || buf[n-1] != 0 {
+			return nil, false, -defs.EPERM
+		}
+		return ustr.Ustr(buf[:n-1]), true, 0
+	}
+	return nil, false, 0
+}
+
+// maps the loadable segments of e
+func (e *elf_t) segsload(p *proc.Proc_t, fops fdops.Fdops_i) defs.Err_t {
+	gimme := bounds.Bounds(bounds.B_ELF_T_ELF_LOAD)
+	entry := e.entry()
+	for _, hdr := range e.headers() {
+		// XXX get rid of worthless user program segments
+		if !res.Resadd_noblock(gimme) {
+			return -defs.ENOHEAP
+		}
+		if hdr.etype == PT_LOAD && hdr.vaddr >= mem.USERMIN {
+			err := segload(p, entry, &hdr, fops)
+			if err != 0 {
+				return err
+			}
+		}
+	}
+	return 0
+}
+
+// loads the program interpreter at path at an unused address. caller must hold
+// proc's pagemap lock.
+func (e *elf_t) interpload(p *proc.Proc_t, path ustr.Ustr) defs.Err_t {
+	f, err := thefs.Fs_open(path, defs.O_EXEC, 0, p.Cwd, p.Cred(), 0, 0)
+	if err != 0 {
+		return err
+	}
+	// the mappings of the interpreter keep it open
+	defer fd.Close_panic(f)
+	ie, err := elf_read(f)
+	if err != 0 {
+		return err
+	}
+	if _, ok, _ := ie.interppath(f); ok || ie.etype() != ET_DYN {
+		return -defs.EPERM
+	}
+	lo, hi := ie.span()
+	if hi <= lo {
+		return -defs.EPERM
+	}
+	ie.bias = p.Vm.Unusedva_inner(p.Mmapi, hi-lo) - lo
+	if err := ie.segsload(p, f.Fops); err != 0 {
+		return err
+	}
+	e.interp = ie
+	return 0
 }
 
 func segload(p *proc.Proc_t, entry int, hdr *elf_phdr, fops fdops.Fdops_i) defs.Err_t {
@@ -4478,8 +5902,6 @@ func segload(p *proc.Proc_t, entry int, hdr *elf_phdr, fops fdops.Fdops_i) defs.
 		panic("requires copying")
 	}
 	perms := vm.PTE_U
-	//PF_X := 1
-	PF_W := 2
 	if hdr.flags&PF_W != 0 {
 		perms |= vm.PTE_W
 	}
@@ -4551,33 +5973,40 @@ func segload(p *proc.Proc_t, entry int, hdr *elf_phdr, fops fdops.Fdops_i) defs.
 }
 
 // returns user address of read-only TLS, thread 0's TLS image, TLS size, and
-// success. caller must hold proc's pagemap lock.
+// success. caller must hold proc's pagemap lock. a position-independent
+// executable is loaded at a random address, after which e's addresses
+// include the bias; the executable must relocate itself.
 func (e *elf_t) elf_load(p *proc.Proc_t, f *fd.Fd_t) (int, int, int, defs.Err_t) {
-	PT_LOAD := 1
-	PT_TLS := 7
 	istls := false
 	tlssize := 0
 	var tlsaddr int
 	var tlscopylen int
 
+	if e.etype() == ET_DYN {
+		e.bias = mem.USERMIN + p.Aslr(proc.Pierand)
+	}
 	gimme := bounds.Bounds(bounds.B_ELF_T_ELF_LOAD)
-	entry := e.entry()
 	// load each elf segment directly into process memory
+	if err := e.segsload(p, f.Fops); err != 0 {
+		return 0, 0, 0, err
+	}
 	for _, hdr := range e.headers() {
-		// XXX get rid of worthless user program segments
-		if !res.Resadd_noblock(gimme) {
-			return 0, 0, 0, -defs.ENOHEAP
-		}
 		if hdr.etype == PT_TLS {
 			istls = true
 			tlsaddr = hdr.vaddr
 			tlssize = util.Roundup(hdr.memsz, 8)
 			tlscopylen = hdr.filesz
-		} else if hdr.etype == PT_LOAD && hdr.vaddr >= mem.USERMIN {
-			err := segload(p, entry, &hdr, f.Fops)
-			if err != 0 {
-				return 0, 0, 0, err
-			}
+		}
+	}
+	// a dynamically-linked program's interpreter maps its shared
+	// libraries
+	ipath, ok, err := e.interppath(f)
+	if err != 0 {
+		return 0, 0, 0, err
+	}
+	if ok {
+		if err := e.interpload(p, ipath); err != 0 {
+			return 0, 0, 0, err
 		}
 	}
 
@@ -4588,7 +6017,7 @@ func (e *elf_t) elf_load(p *proc.Proc_t, f *fd.Fd_t) (int, int, int, defs.Err_t)
 		l := util.Roundup(tlsaddr+tlssize, mem.PGSIZE)
 		l -= util.Rounddown(tlsaddr, mem.PGSIZE)
 
-		freshtls = p.Vm.Unusedva_inner(0, 2*l)
+		freshtls = p.Vm.Unusedva_inner(p.Mmapi, 2*l)
 		t0tls = freshtls + l
 		p.Vm.Vmadd_anon(freshtls, l, vm.PTE_U)
 		p.Vm.Vmadd_anon(t0tls, l, vm.PTE_U|vm.PTE_W)
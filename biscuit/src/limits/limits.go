@@ -20,7 +20,8 @@ type Syslimit_t struct {
 	Routes int
 	// per TCP socket tx/rx segments to remember
 	Tcpsegs int
-	// socks includes pipes and all TCP connections in TIMEWAIT.
+	// socks includes pipes, all TCP connections in TIMEWAIT, and queued UDP
+	// datagrams.
 	Socks Sysatomic_t
 	// total cached dirents
 	// total pipes
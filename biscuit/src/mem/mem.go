@@ -75,6 +75,8 @@ type Physpg_t struct {
 	Refcnt int32
 	// index into pgs of next page on free list
 	nexti uint32
+	// index into pgs of previous page on free list
+	previ uint32
 	// Bitmask where bit n is set if CPU w/logical ID n loaded this page
 	// (which is a pmap) into its cr3 register
 	Cpumask uint64
@@ -93,6 +95,17 @@ type Physmem_t struct {
 	sync.Mutex
 	Dmapinit bool
 	percpu [runtime.MAXCPUS]pcpuphys_t
+	// count of huge page mappings
+	hugepgs int32
+	// the number of pages of each huge page-aligned region that are on the
+	// global free list and the number of regions whose pages are all on
+	// it; both are updated as pages are added to and removed from the list
+	hfree []uint16
+	hfull int32
+	// the free list length when a search for a huge page last failed even
+	// after draining the per-CPU free lists; draining again is futile
+	// until more pages are freed
+	hugemiss int32
 }
 
 type pcpuphys_t struct {
@@ -221,29 +234,169 @@ func (phys *Physmem_t) Pmap_new() (*Pmap_t, Pa_t, bool) {
 	return pg2pmap(a), b, ok
 }
 
-func (phys *Physmem_t) _phys_new(fl *uint32, lock sync.Locker, cnt *int32) (*Pg_t, Pa_t, bool) {
+// a huge page is HUGEPGS contiguous pages aligned to HUGEPGSIZE
+const HUGEPGSIZE int = 1 << 21
+const HUGEPGS int = HUGEPGSIZE / PGSIZE
+
+// returns the index of the huge page-aligned region that contains the page
+// idx
+func (phys *Physmem_t) _hregion(idx uint32) int {
+	hs := uint32(HUGEPGS)
+	return int((idx+phys.startn)/hs - phys.startn/hs)
+}
+
+// updates the count of free pages of the region that contains the page idx,
+// which was just added to (d is 1) or removed from (d is -1) the global free
+// list
+func (phys *Physmem_t) _hfree(idx uint32, d int) {
+	r := phys._hregion(idx)
+	if int(phys.hfree[r]) == HUGEPGS {
+		phys.hfull--
+	}
+	phys.hfree[r] = uint16(int(phys.hfree[r]) + d)
+	if int(phys.hfree[r]) == HUGEPGS {
+		phys.hfull++
+	}
+}
+
+// removes the page idx from the middle of the global free list
+func (phys *Physmem_t) _phys_unlink(idx uint32) {
+	pg := &phys.Pgs[idx]
+	if pg.previ == ^uint32(0) {
+		phys.freei = pg.nexti
+	} else {
+		phys.Pgs[pg.previ].nexti = pg.nexti
+	}
+	if pg.nexti != ^uint32(0) {
+		phys.Pgs[pg.nexti].previ = pg.previ
+	}
+	phys.freelen--
+	phys._hfree(idx, -1)
+}
+
+// moves the pages on the per-CPU page free lists to the global free list so
+// that they can complete free huge page regions
+func (phys *Physmem_t) _pcpu_drain() {
+	for i := range phys.percpu {
+		pc := &phys.percpu[i]
+		pc.Lock()
+		for {
+			idx, ok := phys._phys_pop(&pc.freei, &pc.freelen)
+			if !ok {
+				break
+			}
+			phys._phys_push(&phys.freei, idx, &phys.freelen)
+		}
+		pc.Unlock()
+	}
+}
+
+// returns a huge page from the free pages, leaving at least 1/16th of the
+// pages free for small allocations. the ref count of each of the small pages
+// of the returned huge page is 1.
+func (phys *Physmem_t) _hugepg_new() (Pa_t, bool) {
 	if !phys.Dmapinit {
 		panic("dmap not initted")
 	}
+	phys.Lock()
+	if int(phys.freelen)-HUGEPGS < len(phys.Pgs)/16 {
+		phys.Unlock()
+		return 0, false
+	}
+	if phys.hfull == 0 && phys.freelen > phys.hugemiss {
+		phys._pcpu_drain()
+		if phys.hfull == 0 {
+			phys.hugemiss = phys.freelen
+		}
+	}
+	if phys.hfull == 0 {
+		phys.Unlock()
+		return 0, false
+	}
+	r := 0
+	for int(phys.hfree[r]) != HUGEPGS {
+		r++
+	}
+	hs := int(phys.startn) / HUGEPGS
+	first := (hs+r)*HUGEPGS - int(phys.startn)
+	for i := first; i < first+HUGEPGS; i++ {
+		phys._phys_unlink(uint32(i))
+		phys.Pgs[i].Refcnt = 1
+	}
+	phys.hugemiss = 0
+	atomic.AddInt32(&phys.hugepgs, 1)
+	phys.Unlock()
+	return Pa_t(uint32(first)+phys.startn) << PGSHIFT, true
+}
 
-	var p_pg Pa_t
-	var ok bool
-	lock.Lock()
-	ff := *fl
-	if ff != ^uint32(0) {
-		p_pg = Pa_t(ff+phys.startn) << PGSHIFT
-		*fl = phys.Pgs[ff].nexti
-		ok = true
-		if phys.Pgs[ff].Refcnt < 0 {
-			panic("negative ref count")
+// returns a zeroed huge page like _hugepg_new
+func (phys *Physmem_t) Hugepg_new() (Pa_t, bool) {
+	p_pg, ok := phys._hugepg_new()
+	if !ok {
+		return 0, false
+	}
+	for i := 0; i < HUGEPGS; i++ {
+		*phys.Dmap(p_pg + Pa_t(i<<PGSHIFT)) = *Zeropg
+	}
+	return p_pg, true
+}
+
+func (phys *Physmem_t) Hugepg_new_nozero() (Pa_t, bool) {
+	return phys._hugepg_new()
+}
+
+// records that the huge page p_pg is mapped once more, like when a parent and
+// its child share it copy-on-write.
+func (phys *Physmem_t) Hugepg_dup(p_pg Pa_t) {
+	for i := 0; i < HUGEPGS; i++ {
+		phys.Refup(p_pg + Pa_t(i<<PGSHIFT))
+	}
+	atomic.AddInt32(&phys.hugepgs, 1)
+}
+
+// returns true if the huge page p_pg is mapped only once, so that a
+// copy-on-write mapping of it may claim it without a copy
+func (phys *Physmem_t) Hugepg_owned(p_pg Pa_t) bool {
+	for i := 0; i < HUGEPGS; i++ {
+		if phys.Refcnt(p_pg+Pa_t(i<<PGSHIFT)) != 1 {
+			return false
 		}
-		*cnt--
-		if *cnt < 0 {
-			panic("no")
+	}
+	return true
+}
+
+// frees the huge page p_pg. its pages are returned to the global free list so
+// that they can form a huge page again.
+func (phys *Physmem_t) Hugepg_free(p_pg Pa_t) {
+	for i := 0; i < HUGEPGS; i++ {
+		if add, idx := phys._refdec(p_pg + Pa_t(i<<PGSHIFT)); add {
+			phys._phys_insert(&phys.freei, idx, phys, &phys.freelen)
 		}
 	}
+	atomic.AddInt32(&phys.hugepgs, -1)
+}
+
+// records that the huge page p_pg is now used as HUGEPGS small pages, each of
+// which is freed separately.
+func (phys *Physmem_t) Hugepg_split(p_pg Pa_t) {
+	atomic.AddInt32(&phys.hugepgs, -1)
+}
+
+// returns the number of huge pages in use
+func (phys *Physmem_t) Hugecount() int {
+	return int(atomic.LoadInt32(&phys.hugepgs))
+}
+
+func (phys *Physmem_t) _phys_new(fl *uint32, lock sync.Locker, cnt *int32) (*Pg_t, Pa_t, bool) {
+	if !phys.Dmapinit {
+		panic("dmap not initted")
+	}
+
+	lock.Lock()
+	ff, ok := phys._phys_pop(fl, cnt)
 	lock.Unlock()
 	if ok {
+		p_pg := Pa_t(ff+phys.startn) << PGSHIFT
 		return phys.Dmap(p_pg), p_pg, true
 	}
 	return nil, 0, false
@@ -251,13 +404,48 @@ func (phys *Physmem_t) _phys_new(fl *uint32, lock sync.Locker, cnt *int32) (*Pg_
 
 func (phys *Physmem_t) _phys_insert(fl *uint32, idx uint32, lock sync.Locker, cnt *int32) {
 	lock.Lock()
+	phys._phys_push(fl, idx, cnt)
+	lock.Unlock()
+}
+
+// removes the first page from the free list fl, whose lock must be held
+func (phys *Physmem_t) _phys_pop(fl *uint32, cnt *int32) (uint32, bool) {
+	ff := *fl
+	if ff == ^uint32(0) {
+		return 0, false
+	}
+	*fl = phys.Pgs[ff].nexti
+	if *fl != ^uint32(0) {
+		phys.Pgs[*fl].previ = ^uint32(0)
+	}
+	if phys.Pgs[ff].Refcnt < 0 {
+		panic("negative ref count")
+	}
+	*cnt--
+	if *cnt < 0 {
+		panic("no")
+	}
+	if fl == &phys.freei {
+		phys._hfree(ff, -1)
+	}
+	return ff, true
+}
+
+// adds the page idx to the front of the free list fl, whose lock must be held
+func (phys *Physmem_t) _phys_push(fl *uint32, idx uint32, cnt *int32) {
 	phys.Pgs[idx].nexti = *fl
+	phys.Pgs[idx].previ = ^uint32(0)
+	if *fl != ^uint32(0) {
+		phys.Pgs[*fl].previ = idx
+	}
 	*fl = idx
 	*cnt++
 	if *cnt < 0 {
 		panic("no")
 	}
-	lock.Unlock()
+	if fl == &phys.freei {
+		phys._hfree(idx, 1)
+	}
 }
 
 // returns true iff the p_pg was added to the free list
@@ -382,6 +570,7 @@ func Phys_init() *Physmem_t {
 	phys.pmaps = ^uint32(0)
 	phys.Pgs[0].Refcnt = 0
 	phys.Pgs[0].nexti = ^uint32(0)
+	phys.Pgs[0].previ = ^uint32(0)
 	last := phys.freei
 	for i := 0; i < respgs-1; i++ {
 		p_pg := Pa_t(runtime.Get_phys())
@@ -397,9 +586,14 @@ func Phys_init() *Physmem_t {
 		phys.Pgs[idx].Refcnt = 0
 		phys.Pgs[last].nexti = idx
 		phys.Pgs[idx].nexti = ^uint32(0)
+		phys.Pgs[idx].previ = last
 		last = idx
 		phys.freelen++
 	}
+	phys.hfree = make([]uint16, phys._hregion(uint32(respgs-1))+1)
+	for i := phys.freei; i != ^uint32(0); i = phys.Pgs[i].nexti {
+		phys._hfree(i, 1)
+	}
 	fmt.Printf("Reserved %v pages (%vMB)\n", respgs, respgs>>8)
 	for i := range phys.percpu {
 		phys.percpu[i].percpu_init()
@@ -38,6 +38,23 @@ func copydata(src string, f *ufs.Ufs_t, dst string) {
 	}
 }
 
+// copies the permission bits of the host file
+func setmode(fs *ufs.Ufs_t, p string, info os.FileInfo) {
+	m := uint(info.Mode().Perm())
+	if info.Mode()&os.ModeSetuid != 0 {
+		m |= 04000
+	}
+	if info.Mode()&os.ModeSetgid != 0 {
+		m |= 02000
+	}
+	if info.Mode()&os.ModeSticky != 0 {
+		m |= 01000
+	}
+	if e := fs.Chmod(ustr.Ustr(p), m); e != 0 {
+		fmt.Printf("failed to set mode of %v\n", p)
+	}
+}
+
 func addfiles(fs *ufs.Ufs_t, skeldir string) {
 	err := filepath.Walk(skeldir, func(path string, info os.FileInfo, err error) error {
 		if err != nil {
@@ -48,11 +65,22 @@ func addfiles(fs *ufs.Ufs_t, skeldir string) {
 		if p == "" {
 			return nil
 		}
-		if info.IsDir() {
+		if info.Mode()&os.ModeSymlink != 0 {
+			t, err := os.Readlink(path)
+			if err != nil {
+				fmt.Printf("failed to read link %v\n", path)
+				return nil
+			}
+			e := fs.Symlink(ustr.Ustr(t), ustr.Ustr(p))
+			if e != 0 {
+				fmt.Printf("failed to create symlink %v\n", p)
+			}
+		} else if info.IsDir() {
 			e := fs.MkDir(ustr.Ustr(p))
 			if e != 0 {
 				fmt.Printf("failed to create dir %v\n", p)
 			}
+			setmode(fs, p, info)
 
 		} else {
 			e := fs.MkFile(ustr.Ustr(p), nil)
@@ -60,6 +88,11 @@ func addfiles(fs *ufs.Ufs_t, skeldir string) {
 				fmt.Printf("failed to create file %v\n", p)
 			}
 			copydata(path, fs, p)
+			setmode(fs, p, info)
+			mt := int(info.ModTime().UnixNano())
+			if e := fs.Utimes(ustr.Ustr(p), mt, mt); e != 0 {
+				fmt.Printf("failed to set times of %v\n", p)
+			}
 		}
 		return nil
 	})
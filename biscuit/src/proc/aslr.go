@@ -0,0 +1,88 @@
+package proc
+
+import "crypto/sha256"
+import "encoding/binary"
+import "runtime"
+import "sync"
+
+import "defs"
+import "mem"
+
+// the number of pages over which exec(2) randomizes each part of a new
+// address space
+const (
+	// the top of the stack
+	Stackrand = 1 << 22
+	// the start of mmap(2)'s search for free addresses, which is also where
+	// malloc(3) gets its memory
+	Mmaprand = 1 << 28
+	// the load address of a position-independent executable
+	Pierand = 1 << 24
+)
+
+var _aslr struct {
+	sync.Mutex
+	on bool
+	// true if the CPU has the RDRAND instruction
+	rdrand bool
+	// the state of the generator used without RDRAND, into which the cycle
+	// counter is hashed every time it is used
+	pool [sha256.Size]uint8
+}
+
+// enables or disables the randomization of the layout of the address spaces
+// that exec(2) makes. it is called once at boot; the layout of every process
+// is the same if on is false, which makes benchmarks reproducible.
+func Aslr_init(on bool) {
+	_aslr.Lock()
+	_aslr.on = on
+	_, _, ecx, _ := runtime.Cpuid(1, 0)
+	_aslr.rdrand = ecx&(1<<30) != 0
+	_aslr.Unlock()
+}
+
+// returns 64 random bits from RDRAND or, if the CPU lacks it, from a hash of
+// the cycle counters read at each use. _aslr must be locked.
+func _random() uint64 {
+	if _aslr.rdrand {
+		// RDRAND fails if its entropy is momentarily exhausted
+		for i := 0; i < 10; i++ {
+			if v, ok := runtime.Rdrand(); ok {
+				return v
+			}
+		}
+	}
+	var b [sha256.Size + 8]uint8
+	copy(b[:], _aslr.pool[:])
+	binary.LittleEndian.PutUint64(b[sha256.Size:], runtime.Rdtsc())
+	_aslr.pool = sha256.Sum256(b[:])
+	out := sha256.Sum256(_aslr.pool[:])
+	return binary.LittleEndian.Uint64(out[:])
+}
+
+// returns a random multiple of the page size less than npages pages, or 0 if
+// the layout of p's address spaces is not randomized. npages must be a power
+// of two.
+func (p *Proc_t) Aslr(npages int) int {
+	if p.Personality()&defs.ADDR_NO_RANDOMIZE != 0 {
+		return 0
+	}
+	_aslr.Lock()
+	defer _aslr.Unlock()
+	if !_aslr.on {
+		return 0
+	}
+	return int(_random()%uint64(npages)) * mem.PGSIZE
+}
+
+// fills b with random bytes, like the AT_RANDOM bytes that exec(2) gives each
+// program whether or not its layout is randomized
+func Random(b []uint8) {
+	_aslr.Lock()
+	defer _aslr.Unlock()
+	var w [8]uint8
+	for len(b) > 0 {
+		binary.LittleEndian.PutUint64(w[:], _random())
+		b = b[copy(b, w[:]):]
+	}
+}
@@ -4,22 +4,51 @@ import "fmt"
 import "runtime"
 import "time"
 
+import "mem"
 import "oommsg"
 import "res"
+import "tinfo"
+import "vm"
 
 type oom_t struct {
-	halp   chan oommsg.Oommsg_t
+	halp chan oommsg.Oommsg_t
+	// page faults that found no free user pages
+	pghalp chan chan bool
 	evict  func() (int, int)
 	lastpr time.Time
 }
 
-var Oom *oom_t = &oom_t{halp: oommsg.OomCh}
+var Oom *oom_t = &oom_t{halp: oommsg.OomCh, pghalp: make(chan chan bool)}
 
 func Oom_init(evict func() (int, int)) {
 	Oom.evict = evict
+	vm.Reclaimer(Oom.reclaim)
 	go Oom.reign()
 }
 
+// the number of pages swapped out for a page fault that found no free user
+// pages
+const swapbatch = 64
+
+// called by a page fault that found no free user pages. returns true if the
+// fault should be retried.
+func (o *oom_t) reclaim() bool {
+	ack := make(chan bool, 1)
+	// the OOM killer may be waiting for this process to die
+	kn := &tinfo.Current().Killnaps
+	select {
+	case o.pghalp <- ack:
+	case <-kn.Killch:
+		return false
+	}
+	select {
+	case ok := <-ack:
+		return ok
+	case <-kn.Killch:
+		return false
+	}
+}
+
 func (o *oom_t) gc() {
 	now := time.Now()
 	if now.Sub(o.lastpr) > time.Second {
@@ -29,56 +58,90 @@ func (o *oom_t) gc() {
 }
 
 func (o *oom_t) reign() {
-outter:
-	for msg := range o.halp {
-		fmt.Printf("A need %v, rem %v\n", msg.Need, runtime.Remain())
-		if msg.Need < runtime.Remain() {
-			// there is apparently enough reservation available for
-			// them now
-			msg.Resume <- true
-			continue
-		}
-		o.gc()
-		fmt.Printf("B need %v, rem %v\n", msg.Need, runtime.Remain())
-		//panic("OOM KILL\n")
-		if msg.Need < runtime.Remain() {
-			// there is apparently enough reservation available for
-			// them now
-			msg.Resume <- true
-			continue
+	for {
+		select {
+		case msg := <-o.halp:
+			o.heapoom(msg)
+		case ack := <-o.pghalp:
+			ack <- o.pageoom()
 		}
+	}
+}
+
+func (o *oom_t) heapoom(msg oommsg.Oommsg_t) {
+	fmt.Printf("A need %v, rem %v\n", msg.Need, runtime.Remain())
+	if msg.Need < runtime.Remain() {
+		// there is apparently enough reservation available for them
+		// now
+		msg.Resume <- true
+		return
+	}
+	o.gc()
+	fmt.Printf("B need %v, rem %v\n", msg.Need, runtime.Remain())
+	//panic("OOM KILL\n")
+	if msg.Need < runtime.Remain() {
+		// there is apparently enough reservation available for them
+		// now
+		msg.Resume <- true
+		return
+	}
 
-		// XXX make sure msg.need is a satisfiable reservation size
+	// XXX make sure msg.need is a satisfiable reservation size
 
-		// XXX expand kernel heap with free pages; page if none
-		// available
+	// XXX expand kernel heap with free pages; page if none available
 
-		last := 0
-		for {
-			a, b := o.evict()
-			if a+b == last || a+b < 1000 {
-				break
-			}
-			last = a + b
+	last := 0
+	for {
+		a, b := o.evict()
+		if a+b == last || a+b < 1000 {
+			break
 		}
+		last = a + b
+	}
+	o.gc()
+	if msg.Need < runtime.Remain() {
+		msg.Resume <- true
+		return
+	}
+	for {
+		// someone must die
+		o.dispatch_peasant(msg.Need)
 		o.gc()
 		if msg.Need < runtime.Remain() {
 			msg.Resume <- true
-			continue outter
+			return
 		}
-		for {
-			// someone must die
-			o.dispatch_peasant(msg.Need)
-			o.gc()
-			if msg.Need < runtime.Remain() {
-				msg.Resume <- true
-				continue outter
-			}
+	}
+}
+
+// frees user pages by swapping out the cold anonymous pages of all processes.
+// someone must die only if that frees no pages, because swap is full or all
+// pages are in use. returns false if there is no swap device, in which case
+// the fault fails.
+func (o *oom_t) pageoom() bool {
+	if !vm.Swapping() {
+		return false
+	}
+	head := o.peasants()
+	did := 0
+	free := true
+	// the first pass over a process may only clear accessed bits
+	for pass := 0; pass < 2 && did < swapbatch && free; pass++ {
+		for p := head; p != nil && did < swapbatch && free; p = p.Oomlink {
+			var n int
+			n, free = p.Vm.Swapout(swapbatch - did)
+			did += n
 		}
 	}
+	o.forget(head)
+	if did == 0 {
+		o.dispatch_peasant(mem.PGSIZE)
+	}
+	return true
 }
 
-func (o *oom_t) dispatch_peasant(need int) {
+// returns a list of all processes, linked by Oomlink
+func (o *oom_t) peasants() *Proc_t {
 	// the oom killer's memory use should have a small bound
 	var head *Proc_t
 	Ptable.Iter(func (_ int32, p *Proc_t) bool {
@@ -86,6 +149,20 @@ func (o *oom_t) dispatch_peasant(need int) {
 		head = p
 		return false
 	})
+	return head
+}
+
+// destroys the list so the Proc_ts and reachable objects become dead
+func (o *oom_t) forget(head *Proc_t) {
+	var next *Proc_t
+	for p := head; p != nil; p = next {
+		next = p.Oomlink
+		p.Oomlink = nil
+	}
+}
+
+func (o *oom_t) dispatch_peasant(need int) {
+	head := o.peasants()
 
 	var memmax int
 	var vic *Proc_t
@@ -97,12 +174,7 @@ func (o *oom_t) dispatch_peasant(need int) {
 		}
 	}
 
-	// destroy the list so the Proc_ts and reachable objects become dead
-	var next *Proc_t
-	for p := head; p != nil; p = next {
-		next = p.Oomlink
-		p.Oomlink = nil
-	}
+	o.forget(head)
 
 	if vic == nil {
 		panic("nothing to kill?")
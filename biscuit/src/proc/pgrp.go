@@ -0,0 +1,270 @@
+package proc
+
+import "sync"
+import "sync/atomic"
+
+import "defs"
+
+// protects the process group and session IDs of every process
+var pglock sync.Mutex
+
+// returns the process group and the session of p
+func (p *Proc_t) Pgrp() (int, int) {
+	pglock.Lock()
+	defer pglock.Unlock()
+	return p.pgid, p.sid
+}
+
+// puts child, which p just created, in p's process group and session
+func (p *Proc_t) Pgfork(child *Proc_t) {
+	pglock.Lock()
+	child.pgid, child.sid = p.pgid, p.sid
+	pglock.Unlock()
+}
+
+// returns the session of process group pgid, or false if the group has no
+// processes. the caller must hold pglock.
+func _pgsession(pgid int) (int, bool) {
+	sid := 0
+	found := false
+	Ptable.Iter(func(_ int32, p *Proc_t) bool {
+		if p.pgid == pgid {
+			sid = p.sid
+			found = true
+		}
+		return found
+	})
+	return sid, found
+}
+
+// returns the session of process group pgid, or false if the group has no
+// processes
+func Pgsession(pgid int) (int, bool) {
+	pglock.Lock()
+	defer pglock.Unlock()
+	return _pgsession(pgid)
+}
+
+// moves process pid, which is p or a child of p, to the process group pgid of
+// p's session. the group is created if pgid is pid. zero means p for pid and
+// pid for pgid.
+func (p *Proc_t) Setpgid(pid, pgid int) defs.Err_t {
+	if pid < 0 || pgid < 0 {
+		return -defs.EINVAL
+	}
+	if pid == 0 {
+		pid = p.Pid
+	}
+	if pgid == 0 {
+		pgid = pid
+	}
+	t := p
+	if pid != p.Pid {
+		var ok bool
+		t, ok = Proc_check(pid)
+		if !ok || t.Pwait != &p.Mywait {
+			return -defs.ESRCH
+		}
+	}
+
+	pglock.Lock()
+	defer pglock.Unlock()
+	// a session leader cannot leave its group, and no process can move to
+	// another session. a child cannot be moved once it has executed a
+	// program.
+	if t.sid != p.sid || t.sid == t.Pid {
+		return -defs.EPERM
+	}
+	if t != p && t.execed {
+		return -defs.EACCES
+	}
+	if pgid != pid {
+		if sid, ok := _pgsession(pgid); !ok || sid != p.sid {
+			return -defs.EPERM
+		}
+	}
+	t.pgid = pgid
+	return 0
+}
+
+// records that p executed a program, after which its parent may no longer
+// change its process group
+func (p *Proc_t) Setexeced() {
+	pglock.Lock()
+	p.execed = true
+	pglock.Unlock()
+}
+
+// returns true if process group pgid is orphaned: no member has a parent in
+// another group of the same session, which could continue the group if it
+// were stopped. like Linux, init, which inherits the children of exiting
+// processes, does not count. the caller must hold pglock.
+func _pgorphaned(pgid int) bool {
+	orphaned := true
+	Ptable.Iter(func(_ int32, p *Proc_t) bool {
+		if p.pgid != pgid {
+			return false
+		}
+		pw := p.Pwait
+		if pw == nil || pw.Pid == 1 {
+			return false
+		}
+		if pp, ok := Proc_check(pw.Pid); ok && pp.pgid != pgid &&
+			pp.sid == p.sid {
+			orphaned = false
+		}
+		return !orphaned
+	})
+	return orphaned
+}
+
+// returns true if a member of process group pgid is stopped. the caller must
+// hold pglock.
+func _pgstopped(pgid int) bool {
+	stopped := false
+	Ptable.Iter(func(_ int32, p *Proc_t) bool {
+		stopped = p.pgid == pgid && atomic.LoadUint32(&p.stopped) != 0
+		return stopped
+	})
+	return stopped
+}
+
+// returns the process groups that the exit of p may orphan: its own, if its
+// parent is in another group of its session, and those of its children in
+// other groups of its session. p's children must still refer to p.Mywait.
+func (p *Proc_t) pglinks() []int {
+	pglock.Lock()
+	defer pglock.Unlock()
+	var ret []int
+	if pw := p.Pwait.Pid; pw != 1 {
+		if pp, ok := Proc_check(pw); ok && pp.pgid != p.pgid &&
+			pp.sid == p.sid {
+			ret = append(ret, p.pgid)
+		}
+	}
+	Ptable.Iter(func(_ int32, c *Proc_t) bool {
+		if c.Pwait != &p.Mywait || c.pgid == p.pgid || c.sid != p.sid {
+			return false
+		}
+		for _, pgid := range ret {
+			if pgid == c.pgid {
+				return false
+			}
+		}
+		ret = append(ret, c.pgid)
+		return false
+	})
+	return ret
+}
+
+// sends SIGHUP and then SIGCONT to each process group of pgids that is now
+// orphaned and has a stopped member, as POSIX requires, since nothing else
+// could continue it.
+func pgorphans(pgids []int) {
+	for _, pgid := range pgids {
+		pglock.Lock()
+		hup := _pgorphaned(pgid) && _pgstopped(pgid)
+		pglock.Unlock()
+		if hup {
+			Pgsignal(pgid, &Siginfo_t{Signo: defs.SIGHUP, Code: defs.SI_KERNEL})
+			Pgsignal(pgid, &Siginfo_t{Signo: defs.SIGCONT, Code: defs.SI_KERNEL})
+		}
+	}
+}
+
+// returns true if p's process group is orphaned
+func (p *Proc_t) Pgorphaned() bool {
+	pglock.Lock()
+	defer pglock.Unlock()
+	return _pgorphaned(p.pgid)
+}
+
+// returns the process group of process pid, or of p if pid is zero
+func (p *Proc_t) Getpgid(pid int) (int, defs.Err_t) {
+	t := p
+	if pid != 0 {
+		var ok bool
+		t, ok = Proc_check(pid)
+		if !ok {
+			return 0, -defs.ESRCH
+		}
+	}
+	pgid, _ := t.Pgrp()
+	return pgid, 0
+}
+
+// makes p the leader of a new session and of a new process group in it, both
+// with p's pid. the new session has no controlling terminal.
+func (p *Proc_t) Setsid() (int, defs.Err_t) {
+	pglock.Lock()
+	defer pglock.Unlock()
+	if _, ok := _pgsession(p.Pid); ok {
+		return 0, -defs.EPERM
+	}
+	p.pgid, p.sid = p.Pid, p.Pid
+	return p.Pid, 0
+}
+
+// returns true if p may send signal sig to tp. like Linux, SIGCONT may also
+// be sent to any process of the same session.
+func (p *Proc_t) Maysignal(tp *Proc_t, sig int) bool {
+	if p.Cred().Maysignal(tp.Cred()) {
+		return true
+	}
+	if sig != defs.SIGCONT {
+		return false
+	}
+	pglock.Lock()
+	defer pglock.Unlock()
+	return p.sid == tp.sid
+}
+
+// sends the signal si from the process p to the members of process group
+// pgid that p may signal; a signal number of 0 only checks that it may.
+// returns ESRCH if the group is empty and EPERM if p may signal none of them.
+func Pgkill(p *Proc_t, pgid int, si *Siginfo_t) defs.Err_t {
+	var procs []*Proc_t
+	pglock.Lock()
+	Ptable.Iter(func(_ int32, tp *Proc_t) bool {
+		if tp.pgid == pgid {
+			procs = append(procs, tp)
+		}
+		return false
+	})
+	pglock.Unlock()
+	if len(procs) == 0 {
+		return -defs.ESRCH
+	}
+	ret := -defs.EPERM
+	for _, tp := range procs {
+		if !p.Maysignal(tp, si.Signo) {
+			continue
+		}
+		ret = 0
+		if si.Signo != 0 {
+			tp.Sigpost(si)
+		}
+	}
+	return ret
+}
+
+// sends the signal described by si to every process in process group pgid.
+// returns ESRCH if the group has no processes.
+func Pgsignal(pgid int, si *Siginfo_t) defs.Err_t {
+	var procs []*Proc_t
+	pglock.Lock()
+	Ptable.Iter(func(_ int32, p *Proc_t) bool {
+		if p.pgid == pgid {
+			procs = append(procs, p)
+		}
+		return false
+	})
+	pglock.Unlock()
+	if len(procs) == 0 {
+		return -defs.ESRCH
+	}
+	for _, p := range procs {
+		p.Sigpost(si)
+	}
+	return 0
+}
@@ -2,14 +2,17 @@ package proc
 
 import "sync"
 import "sync/atomic"
+import "unsafe"
 
 import "fmt"
 import "runtime"
 
 import "accnt"
 import "bounds"
+import "cred"
 import "defs"
 import "fd"
+import "fdops"
 import "limits"
 import "mem"
 import "res"
@@ -24,6 +27,8 @@ type Ulimit_t struct {
 	Nofile uint
 	Novma  uint
 	Noproc uint
+	// the largest core file, in bytes
+	Core uint
 }
 
 type Proc_t struct {
@@ -36,6 +41,11 @@ type Proc_t struct {
 	Mywait Wait_t
 	// waitinfo of my parent
 	Pwait *Wait_t
+	// process group and session, and whether the process has executed a
+	// program since fork(2); protected by pglock
+	pgid   int
+	sid    int
+	execed bool
 
 	// thread tids of this process
 	Threadi tinfo.Threadinfo_t
@@ -45,6 +55,9 @@ type Proc_t struct {
 
 	// mmap next virtual address hint
 	Mmapi int
+	// the personality(2) flags, which fork(2) and exec(2) preserve;
+	// accessed atomically
+	persona uint32
 
 	// a process is marked doomed when it has been killed but may have
 	// threads currently running on another processor
@@ -61,6 +74,11 @@ type Proc_t struct {
 
 	Cwd *fd.Cwd_t
 
+	// the process's credentials are replaced, never modified. writers hold
+	// Credl; readers use Cred() without a lock.
+	Credl sync.Mutex
+	_cred *cred.Cred_t
+
 	Ulim Ulimit_t
 
 	// this proc's rusage
@@ -68,6 +86,18 @@ type Proc_t struct {
 	// total child rusage
 	Catime accnt.Accnt_t
 
+	// signal dispositions and the signals sent to the process that no
+	// thread has taken yet; protected by Sigl. the per-thread signal masks
+	// and pending sets live in each thread's tnote.
+	Sigl    sync.Mutex
+	sigacts [defs.NSIG]Sigact_t
+	sigpend uint64
+	siginfo [defs.NSIG]Siginfo_t
+	// non-zero while the process is stopped by a signal; threads wait on
+	// stopcond, which uses Sigl, until it is continued
+	stopped  uint32
+	stopcond *sync.Cond
+
 	syscall Syscall_i
 	// no thread can read/write Oomlink except the OOM killer
 	Oomlink *Proc_t
@@ -206,6 +236,15 @@ func (p *Proc_t) Fd_get(fdn int) (*fd.Fd_t, bool) {
 	return ret, ok
 }
 
+// closes f, which has been removed from p's fd table. like POSIX, closing any
+// fd of a file releases p's record locks on the file.
+func (p *Proc_t) Fd_close(f *fd.Fd_t) defs.Err_t {
+	if lk, ok := f.Fops.(fdops.Lockable_i); ok {
+		lk.Unlockall(p.Pid)
+	}
+	return f.Fops.Close()
+}
+
 // fdn is not guaranteed to be a sane fd
 func (p *Proc_t) Fd_del(fdn int) (*fd.Fd_t, bool) {
 	p.Fdl.Lock()
@@ -262,6 +301,10 @@ func (p *Proc_t) Fd_dup(ofdn, nfdn int) (*fd.Fd_t, bool, defs.Err_t) {
 // successfully copied the parent's address space.
 func (parent *Proc_t) Vm_fork(child *Proc_t, rsp uintptr) (bool, bool) {
 	parent.Vm.Lockassert_pmap()
+	// the swapper may scan the child's address space since the child is
+	// already in the process table
+	child.Vm.Lock_pmap()
+	defer child.Vm.Unlock_pmap()
 	// first add kernel pml4 entries
 	for _, e := range mem.Kents {
 		child.Vm.Pmap[e.Pml4slot] = e.Entry
@@ -272,10 +315,15 @@ func (parent *Proc_t) Vm_fork(child *Proc_t, rsp uintptr) (bool, bool) {
 	failed := false
 	doflush := false
 	child.Vm.Vmregion = parent.Vm.Vmregion.Copy()
+	child.Mmapi = parent.Mmapi
 	parent.Vm.Vmregion.Iter(func(vmi *vm.Vminfo_t) {
 		start := int(vmi.Pgn << vm.PGSHIFT)
 		end := start + int(vmi.Pglen<<vm.PGSHIFT)
 		ashared := vmi.Mtype == vm.VSANON
+		if ashared && parent.Vm.Swapin(vmi) != 0 {
+			failed = true
+			return
+		}
 		fl, ok := vm.Ptefork(child.Vm.Pmap, parent.Vm.Pmap, start, end, ashared)
 		failed = failed || !ok
 		doflush = doflush || fl
@@ -296,13 +344,10 @@ func (parent *Proc_t) Vm_fork(child *Proc_t, rsp uintptr) (bool, bool) {
 	if !ok || *pte&vm.PTE_P == 0 || *pte&vm.PTE_U == 0 {
 		return doflush, true
 	}
-	// sys_pgfault expects pmap to be locked
-	child.Vm.Lock_pmap()
 	perms := uintptr(vm.PTE_U | vm.PTE_W)
 	if vm.Sys_pgfault(&child.Vm, vmi, rsp, perms) != 0 {
 		return doflush, false
 	}
-	child.Vm.Unlock_pmap()
 	vmi, ok = parent.Vm.Vmregion.Lookup(rsp)
 	if !ok || *pte&vm.PTE_P == 0 || *pte&vm.PTE_U == 0 {
 		panic("child has stack but not parent")
@@ -364,7 +409,8 @@ func KillableWait(cond *sync.Cond) defs.Err_t {
 
 // returns true if the kernel may safely use a "fast" resume and whether the
 // system call should be restarted.
-func (p *Proc_t) trap_proc(tf *[defs.TFSIZE]uintptr, tid defs.Tid_t, intno, aux int) (bool, bool) {
+func (p *Proc_t) trap_proc(tf *[defs.TFSIZE]uintptr, fxbuf *[64]uintptr,
+	tid defs.Tid_t, intno, aux int) (bool, bool) {
 	fastret := false
 	restart := false
 	switch intno {
@@ -373,6 +419,18 @@ func (p *Proc_t) trap_proc(tf *[defs.TFSIZE]uintptr, tid defs.Tid_t, intno, aux
 		// specify the arguments for libc _entry(), so do a
 		// slow return when returning from sys_execv().
 		sysno := tf[defs.TF_RAX]
+		if sysno == defs.SYS_SIGRET {
+			// sigreturn replaces the whole trap frame and the
+			// saved FPU state, which only the slow return
+			// restores.
+			if p.sigreturn(tf, fxbuf, tinfo.Current()) != 0 {
+				fmt.Printf("%v: bad sigreturn. killing...\n",
+					p.Name)
+				p.syscall.Sys_exit(p, tid,
+					defs.SIGNALED|defs.Mkexitsig(defs.SIGSEGV))
+			}
+			break
+		}
 		if sysno != defs.SYS_EXECV {
 			fastret = true
 		}
@@ -390,15 +448,32 @@ func (p *Proc_t) trap_proc(tf *[defs.TFSIZE]uintptr, tid defs.Tid_t, intno, aux
 		err := p.Vm.Pgfault(tid, faultaddr, tf[defs.TF_ERROR])
 		restart = err == -defs.ENOHEAP
 		if err != 0 && !restart {
-			fmt.Printf("*** fault *** %v: addr %x, "+
-				"rip %x, err %v. killing...\n", p.Name, faultaddr,
-				tf[defs.TF_RIP], err)
-			p.syscall.Sys_exit(p, tid, defs.SIGNALED|defs.Mkexitsig(11))
+			code := defs.SEGV_ACCERR
+			if err == -defs.EFAULT {
+				code = defs.SEGV_MAPERR
+			}
+			if !p.Sigcaught(defs.SIGSEGV) {
+				fmt.Printf("*** fault *** %v: addr %x, "+
+					"rip %x, err %v. killing...\n", p.Name,
+					faultaddr, tf[defs.TF_RIP], err)
+			}
+			p.Sigforce(&Siginfo_t{Signo: defs.SIGSEGV, Code: code,
+				Addr: faultaddr})
 		}
 	case defs.DIVZERO, defs.GPFAULT, defs.UD:
-		fmt.Printf("%s -- TRAP: %v, RIP: %x\n", p.Name, intno,
-			tf[defs.TF_RIP])
-		p.syscall.Sys_exit(p, tid, defs.SIGNALED|defs.Mkexitsig(4))
+		sig := defs.SIGILL
+		switch intno {
+		case defs.DIVZERO:
+			sig = defs.SIGFPE
+		case defs.GPFAULT:
+			sig = defs.SIGSEGV
+		}
+		if !p.Sigcaught(sig) {
+			fmt.Printf("%s -- TRAP: %v, RIP: %x\n", p.Name, intno,
+				tf[defs.TF_RIP])
+		}
+		p.Sigforce(&Siginfo_t{Signo: sig, Code: defs.SI_KERNEL,
+			Addr: tf[defs.TF_RIP]})
 	case defs.TLBSHOOT, defs.PERFMASK, defs.INT_KBD, defs.INT_COM1, defs.INT_MSI0,
 		defs.INT_MSI1, defs.INT_MSI2, defs.INT_MSI3, defs.INT_MSI4, defs.INT_MSI5, defs.INT_MSI6,
 		defs.INT_MSI7:
@@ -420,6 +495,7 @@ func (p *Proc_t) run(tf *[defs.TFSIZE]uintptr, tid defs.Tid_t) {
 		panic("note must exist")
 	}
 	tinfo.SetCurrent(mynote)
+	mynote.Tf = tf
 
 	var fxbuf *[64]uintptr
 	if res.Resbegin(res.Onek) {
@@ -448,14 +524,31 @@ func (p *Proc_t) run(tf *[defs.TFSIZE]uintptr, tid defs.Tid_t) {
 
 	again:
 		var restart bool
-		if res.Resbegin(gimme) {
-			fastret, restart = p.trap_proc(tf, tid, intno, aux)
+		// delivering signals allocates too. the wait for a reservation
+		// is also interrupted by a signal's wakeup, which is drained so
+		// that only a doomed thread goes without one; the thread stays
+		// marked killed so that the signal interrupts the syscall's
+		// waits.
+		resok := res.Resbegin(gimme)
+		for !resok && !p.doomed && !mynote.Doomed() {
+			select {
+			case <-mynote.Killnaps.Killch:
+			default:
+			}
+			resok = res.Resbegin(gimme)
+		}
+		if resok {
+			fastret, restart = p.trap_proc(tf, fxbuf, tid, intno, aux)
 		}
 		if restart && !p.doomed {
 			//fmt.Printf("restart! ")
 			res.Resend()
 			goto again
 		}
+		if resok && mynote.Alive && !p.doomed &&
+			p.sigdeliver(tf, fxbuf, tid, mynote) {
+			fastret = false
+		}
 
 		// did we switch pmaps? if so, the old pmap may need to be
 		// freed.
@@ -549,21 +642,8 @@ func (p *Proc_t) Doomall() {
 	p.Threadi.Lock()
 	for _, tnote := range p.Threadi.Notes {
 		tnote.Lock()
-
-		tnote.Killed = true
 		tnote.Isdoomed = true
-		kn := &tnote.Killnaps
-		if kn.Kerr == 0 {
-			kn.Kerr = -defs.EINTR
-		}
-		select {
-		case kn.Killch <- false:
-		default:
-		}
-		if tmp := kn.Cond; tmp != nil {
-			tmp.Broadcast()
-		}
-
+		_sigwake(tnote)
 		tnote.Unlock()
 	}
 	p.Threadi.Unlock()
@@ -652,7 +732,9 @@ func (p *Proc_t) terminate() {
 		if p.Fds[i] == nil {
 			continue
 		}
-		fd.Close_panic(p.Fds[i])
+		if p.Fd_close(p.Fds[i]) != 0 {
+			panic("must succeed")
+		}
 	}
 	p.Fdl.Unlock()
 	fd.Close_panic(p.Cwd.Fd)
@@ -670,6 +752,7 @@ func (p *Proc_t) terminate() {
 	if p.Pwait == nil {
 		panic("nil pwait")
 	}
+	pgs := p.pglinks()
 
 	// combine total child rusage with ours, send to parent
 	na := accnt.Accnt_t{Userns: p.Atime.Userns, Sysns: p.Atime.Sysns}
@@ -680,13 +763,29 @@ func (p *Proc_t) terminate() {
 	na.Sysns += p.Catime.Sysns
 
 	// put process exit status to parent's wait info
-	p.Pwait.putpid(p.Pid, p.exitstatus, &na)
+	pgid, _ := p.Pgrp()
+	p.Pwait.putpid(p.Pid, pgid, p.exitstatus, &na)
+	if parent, ok := Proc_check(p.Pwait.Pid); ok {
+		si := &Siginfo_t{Signo: defs.SIGCHLD, Pid: p.Pid}
+		if p.exitstatus&defs.SIGNALED != 0 {
+			si.Code = defs.CLD_KILLED
+			if p.exitstatus&defs.COREDUMP != 0 {
+				si.Code = defs.CLD_DUMPED
+			}
+			si.Status = (p.exitstatus >> defs.SIGSHIFT) & 0x1f
+		} else {
+			si.Code = defs.CLD_EXITED
+			si.Status = p.exitstatus & 0xff
+		}
+		parent.Sigpost(si)
+	}
 	// remove pointer to parent to prevent deep fork trees from consuming
 	// unbounded memory.
 	p.Pwait = nil
 	// OOM killer assumes a process has terminated once its pid is no
 	// longer in the pid table.
 	Proc_del(p.Pid)
+	pgorphans(pgs)
 }
 
 // returns false if the number of running threads or unreaped child statuses is
@@ -719,11 +818,13 @@ var _deflimits = Ulimit_t{
 	//Novma:  (1 << 8),
 	Novma:  defs.RLIM_INFINITY,
 	Noproc: (1 << 10),
+	// like Linux, no core files unless a process asks for them
+	Core: 0,
 }
 
 // returns the new proc and success; can fail if the system-wide limit of
 // procs/threads has been reached. the parent's fdtable must be locked.
-func Proc_new(name ustr.Ustr, cwd *fd.Cwd_t, fds []*fd.Fd_t, sys Syscall_i) (*Proc_t, bool) {
+func Proc_new(name ustr.Ustr, cwd *fd.Cwd_t, cr *cred.Cred_t, fds []*fd.Fd_t, sys Syscall_i) (*Proc_t, bool) {
 	if atomic.AddInt64(&nthreads, 1) >= int64(limits.Syslimit.Sysprocs) {
 		atomic.AddInt64(&nthreads, -1)
 		return nil, false
@@ -740,6 +841,7 @@ func Proc_new(name ustr.Ustr, cwd *fd.Cwd_t, fds []*fd.Fd_t, sys Syscall_i) (*Pr
 
 	ret.Name = name
 	ret.Pid = int(np)
+	ret.pgid, ret.sid = ret.Pid, ret.Pid
 	ret.Fds = make([]*fd.Fd_t, len(fds))
 	ret.fdstart = 3
 	for i := range fds {
@@ -758,9 +860,12 @@ func Proc_new(name ustr.Ustr, cwd *fd.Cwd_t, fds []*fd.Fd_t, sys Syscall_i) (*Pr
 	if ret.Cwd.Fd.Fops.Reopen() != 0 {
 		panic("must succeed")
 	}
+	ret._cred = cr
 	ret.Mmapi = mem.USERMIN
 	ret.Ulim = _deflimits
 
+	ret.stopcond = sync.NewCond(&ret.Sigl)
+
 	ret.Threadi.Init()
 	ret.tid0 = tid0
 	ret._thread_new(tid0)
@@ -774,6 +879,27 @@ func Proc_new(name ustr.Ustr, cwd *fd.Cwd_t, fds []*fd.Fd_t, sys Syscall_i) (*Pr
 	return ret, true
 }
 
+func (p *Proc_t) Cred() *cred.Cred_t {
+	ptr := (*unsafe.Pointer)(unsafe.Pointer(&p._cred))
+	return (*cred.Cred_t)(atomic.LoadPointer(ptr))
+}
+
+// returns the personality(2) flags
+func (p *Proc_t) Personality() uint {
+	return uint(atomic.LoadUint32(&p.persona))
+}
+
+// sets the personality(2) flags, returning the old ones
+func (p *Proc_t) Setpersonality(persona uint) uint {
+	return uint(atomic.SwapUint32(&p.persona, uint32(persona)))
+}
+
+// caller must hold Credl
+func (p *Proc_t) Setcred(cr *cred.Cred_t) {
+	ptr := (*unsafe.Pointer)(unsafe.Pointer(&p._cred))
+	atomic.StorePointer(ptr, unsafe.Pointer(cr))
+}
+
 func (p *Proc_t) Reap_doomed(tid defs.Tid_t) {
 	if !p.doomed {
 		panic("p not doomed")
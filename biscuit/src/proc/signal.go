@@ -0,0 +1,596 @@
+package proc
+
+import "fmt"
+import "sync/atomic"
+
+import "defs"
+import "mem"
+import "tinfo"
+import "util"
+
+// a signal disposition, as installed by sigaction(2)
+type Sigact_t struct {
+	// user address of the handler, SIG_DFL, or SIG_IGN. zero means SIG_DFL.
+	Handler uintptr
+	// signals blocked while the handler runs
+	Mask  uint64
+	Flags int
+	// user address of the code that calls sigreturn(2) when the handler
+	// returns
+	Restorer uintptr
+}
+
+func (sa *Sigact_t) Isdfl() bool {
+	return sa.Handler == 0 || sa.Handler == defs.SIG_DFL
+}
+
+func (sa *Sigact_t) Isign() bool {
+	return sa.Handler == defs.SIG_IGN
+}
+
+// information about the generation of a signal, given to SA_SIGINFO handlers
+type Siginfo_t struct {
+	Signo  int
+	Code   int
+	Pid    int
+	Addr   uintptr
+	Status int
+}
+
+func sigbit(sig int) uint64 {
+	return 1 << uint(sig)
+}
+
+// signals that cannot be caught, blocked, or ignored
+const sigcantcatch = 1<<defs.SIGKILL | 1<<defs.SIGSTOP
+
+// signals whose default action is to do nothing. SIGCONT continues a stopped
+// process when it is sent, whatever its disposition.
+const sigdflign = 1<<defs.SIGCHLD | 1<<defs.SIGWINCH | 1<<defs.SIGIO |
+	1<<defs.SIGCONT
+
+// signals whose default action is to stop the process
+const sigdflstop = 1<<defs.SIGSTOP | 1<<defs.SIGTSTP | 1<<defs.SIGTTIN |
+	1<<defs.SIGTTOU
+
+// signals whose default action also writes a core file
+const sigdflcore = 1<<defs.SIGQUIT | 1<<defs.SIGILL | 1<<defs.SIGFPE |
+	1<<defs.SIGSEGV | 1<<defs.SIGSYS
+
+// the layout of a signal frame on the user stack. the handler is entered with
+// the stack pointer pointing at the return address, which is the restorer
+// given to sigaction(2). the context is the ucontext given to SA_SIGINFO
+// handlers and is restored by sigreturn(2).
+const (
+	sf_ret   = 0
+	sf_info  = 8
+	sf_ctx   = sf_info + si_sz
+	sf_sz    = sf_ctx + ctx_sz
+	sf_rzone = 128
+
+	// siginfo_t offsets, as defined by litc
+	si_signo  = 0
+	si_code   = 4
+	si_pid    = 16
+	si_addr   = 32
+	si_status = 40
+	si_sz     = 64
+
+	ctx_mask  = 0
+	ctx_magic = 8
+	ctx_tf    = 16
+	ctx_fx    = ctx_tf + defs.TFSIZE*8
+	ctx_sz    = ctx_fx + 64*8
+
+	ctx_magicval = 0x5167c0de
+)
+
+// rflags bits a signal handler is allowed to change
+const sigflmask = 0xcd5
+
+// user addresses must be below the non-canonical hole
+const sigusermax = 1 << 47
+
+func (p *Proc_t) _sigpending(n *tinfo.Tnote_t) uint64 {
+	return (p.sigpend | n.Sigpend) &^ n.Sigmask
+}
+
+// the caller must hold Sigl
+func (p *Proc_t) _sigsetpend(n *tinfo.Tnote_t, ppend, tpend uint64) {
+	atomic.StoreUint64(&p.sigpend, ppend)
+	if n != nil {
+		atomic.StoreUint64(&n.Sigpend, tpend)
+	}
+}
+
+// interrupts any killable sleep of the thread so that it returns to user space
+// promptly. the caller must hold the tnote's lock.
+func _sigwake(n *tinfo.Tnote_t) {
+	n.Killed = true
+	kn := &n.Killnaps
+	if kn.Kerr == 0 {
+		kn.Kerr = -defs.EINTR
+	}
+	select {
+	case kn.Killch <- false:
+	default:
+	}
+	if tmp := kn.Cond; tmp != nil {
+		tmp.Broadcast()
+	}
+}
+
+// undoes _sigwake once the thread is about to take its signals.
+func _sigunwake(n *tinfo.Tnote_t) {
+	n.Lock()
+	if !n.Isdoomed {
+		n.Killed = false
+		n.Killnaps.Kerr = 0
+		select {
+		case <-n.Killnaps.Killch:
+		default:
+		}
+	}
+	n.Unlock()
+}
+
+// discards pending instances of sig from the process and all of its threads.
+// the caller must hold Sigl.
+func (p *Proc_t) _sigdiscard(sig int) {
+	bit := sigbit(sig)
+	atomic.StoreUint64(&p.sigpend, p.sigpend&^bit)
+	p.Threadi.Lock()
+	for _, n := range p.Threadi.Notes {
+		atomic.StoreUint64(&n.Sigpend, n.Sigpend&^bit)
+	}
+	p.Threadi.Unlock()
+}
+
+// installs act, if non-nil, as the disposition of sig and returns the previous
+// disposition in oact, if non-nil.
+func (p *Proc_t) Sigaction(sig int, act, oact *Sigact_t) defs.Err_t {
+	if sig <= 0 || sig >= defs.NSIG {
+		return -defs.EINVAL
+	}
+	if act != nil && sigbit(sig)&sigcantcatch != 0 {
+		return -defs.EINVAL
+	}
+	p.Sigl.Lock()
+	defer p.Sigl.Unlock()
+
+	if oact != nil {
+		*oact = p.sigacts[sig]
+	}
+	if act != nil {
+		p.sigacts[sig] = *act
+		p.sigacts[sig].Mask &^= sigcantcatch
+		// setting the disposition of a pending signal to be ignored
+		// discards the signal, even if it is blocked.
+		if act.Isign() || (act.Isdfl() && sigbit(sig)&sigdflign != 0) {
+			p._sigdiscard(sig)
+		}
+	}
+	return 0
+}
+
+// changes the signal mask of the calling thread according to how and returns
+// the old mask. set may be nil, in which case the mask is unchanged.
+func (p *Proc_t) Sigprocmask(how int, set *uint64) (uint64, defs.Err_t) {
+	n := tinfo.Current()
+	p.Sigl.Lock()
+	defer p.Sigl.Unlock()
+
+	old := n.Sigmask
+	if set == nil {
+		return old, 0
+	}
+	nmask := old
+	switch how {
+	case defs.SIG_BLOCK:
+		nmask |= *set
+	case defs.SIG_UNBLOCK:
+		nmask &^= *set
+	case defs.SIG_SETMASK:
+		nmask = *set
+	default:
+		return 0, -defs.EINVAL
+	}
+	n.Sigmask = nmask &^ sigcantcatch
+	// newly unblocked signals are taken on the way back to user space
+	return old, 0
+}
+
+// returns true if the calling thread runs a handler when it takes sig.
+func (p *Proc_t) Sigcaught(sig int) bool {
+	p.Sigl.Lock()
+	act := p.sigacts[sig]
+	blocked := tinfo.Current().Sigmask&sigbit(sig) != 0
+	p.Sigl.Unlock()
+	return !act.Isdfl() && !act.Isign() && !blocked
+}
+
+// terminates the process with the exit status of a process killed by SIGKILL.
+func (p *Proc_t) sigkill() {
+	p.Threadi.Lock()
+	if !p.doomed {
+		p.exitstatus = defs.SIGNALED | defs.Mkexitsig(defs.SIGKILL)
+	}
+	p.Threadi.Unlock()
+	p.Doomall()
+}
+
+// sends the signal described by si to the process. the signal is taken by some
+// thread which does not block it; if all threads block it, it stays pending
+// until one unblocks it.
+func (p *Proc_t) Sigpost(si *Siginfo_t) {
+	sig := si.Signo
+	if sig <= 0 || sig >= defs.NSIG {
+		panic("bad sig")
+	}
+	if sig == defs.SIGKILL {
+		p.sigkill()
+		return
+	}
+	if sig == defs.SIGCONT && p.sigcont() {
+		p.jobnotify(defs.CONTINUED, defs.CLD_CONTINUED, sig)
+	}
+	bit := sigbit(sig)
+
+	p.Sigl.Lock()
+	defer p.Sigl.Unlock()
+
+	// a stop signal cancels a pending SIGCONT and vice versa
+	if bit&sigdflstop != 0 {
+		p._sigdiscard(defs.SIGCONT)
+	}
+	act := &p.sigacts[sig]
+	if act.Isign() || (act.Isdfl() && bit&sigdflign != 0) {
+		return
+	}
+	p.siginfo[sig] = *si
+	p._sigsetpend(nil, p.sigpend|bit, 0)
+
+	p.Threadi.Lock()
+	for _, n := range p.Threadi.Notes {
+		if n.Sigmask&bit == 0 {
+			n.Lock()
+			_sigwake(n)
+			n.Unlock()
+			break
+		}
+	}
+	p.Threadi.Unlock()
+}
+
+// continues p if it is stopped and discards its pending stop signals. returns
+// true if p was stopped.
+func (p *Proc_t) sigcont() bool {
+	p.Sigl.Lock()
+	defer p.Sigl.Unlock()
+	for sig := 0; sig < defs.NSIG; sig++ {
+		if sigbit(sig)&sigdflstop != 0 {
+			p._sigdiscard(sig)
+		}
+	}
+	if atomic.LoadUint32(&p.stopped) == 0 {
+		return false
+	}
+	atomic.StoreUint32(&p.stopped, 0)
+	p.stopcond.Broadcast()
+	return true
+}
+
+// stops p, one of whose threads took the stop signal sig. the other threads
+// are made to enter the kernel, where they stop too on their way back to user
+// space.
+func (p *Proc_t) sigstop(sig int) {
+	p.Sigl.Lock()
+	if atomic.LoadUint32(&p.stopped) != 0 {
+		p.Sigl.Unlock()
+		return
+	}
+	atomic.StoreUint32(&p.stopped, 1)
+	p.Threadi.Lock()
+	for _, n := range p.Threadi.Notes {
+		n.Lock()
+		_sigwake(n)
+		n.Unlock()
+	}
+	p.Threadi.Unlock()
+	p.Sigl.Unlock()
+	p.jobnotify(defs.STOPPED|defs.Mkexitsig(sig), defs.CLD_STOPPED, sig)
+}
+
+// sleeps while p is stopped, until it is continued or killed. the caller must
+// hold Sigl.
+func (p *Proc_t) _stopwait(n *tinfo.Tnote_t) {
+	for atomic.LoadUint32(&p.stopped) != 0 && !p.doomed {
+		KillableWait(p.stopcond)
+		_sigunwake(n)
+	}
+}
+
+// tells p's parent that p stopped or continued
+func (p *Proc_t) jobnotify(status, code, sig int) {
+	// p may have been killed and reaped since
+	pw := p.Pwait
+	if pw == nil || !pw.putjob(p.Pid, status) {
+		return
+	}
+	if parent, ok := Proc_check(pw.Pid); ok {
+		parent.Sigpost(&Siginfo_t{Signo: defs.SIGCHLD, Code: code,
+			Pid: p.Pid, Status: sig})
+	}
+}
+
+// returns true if the calling thread blocks sig or p ignores it
+func (p *Proc_t) Sigblocked(sig int) bool {
+	p.Sigl.Lock()
+	defer p.Sigl.Unlock()
+	return p.sigacts[sig].Isign() ||
+		tinfo.Current().Sigmask&sigbit(sig) != 0
+}
+
+// sends a synchronous signal, caused by the thread's own execution, to the
+// calling thread. like Sigforce, but the signal may be blocked or ignored.
+func (p *Proc_t) Sigself(si *Siginfo_t) {
+	p._sigthread(si, false)
+}
+
+// sends a signal caused by a fault to the calling thread. if the signal is
+// blocked or ignored, its disposition is reset to the default so that the
+// thread cannot loop on the faulting instruction forever.
+func (p *Proc_t) Sigforce(si *Siginfo_t) {
+	p._sigthread(si, true)
+}
+
+func (p *Proc_t) _sigthread(si *Siginfo_t, force bool) {
+	sig := si.Signo
+	bit := sigbit(sig)
+	n := tinfo.Current()
+
+	p.Sigl.Lock()
+	defer p.Sigl.Unlock()
+
+	act := &p.sigacts[sig]
+	if force && (act.Isign() || n.Sigmask&bit != 0) {
+		*act = Sigact_t{}
+		n.Sigmask &^= bit
+	}
+	if act.Isign() || (act.Isdfl() && bit&sigdflign != 0) {
+		return
+	}
+	p.siginfo[sig] = *si
+	p._sigsetpend(n, p.sigpend, n.Sigpend|bit)
+}
+
+// sends SIGPIPE to the calling thread, which wrote to a pipe or socket with no
+// reader.
+func Sigpipe() {
+	p := CurrentProc()
+	p.Sigself(&Siginfo_t{Signo: defs.SIGPIPE, Code: defs.SI_KERNEL})
+}
+
+// initializes the signal state of the new thread ctid of child, which was
+// created by the calling thread of p. a new thread inherits the mask of its
+// creator and a new process also inherits its parent's dispositions.
+func (p *Proc_t) Sigfork(child *Proc_t, ctid defs.Tid_t) {
+	p.Sigl.Lock()
+	mask := tinfo.Current().Sigmask
+	acts := p.sigacts
+	p.Sigl.Unlock()
+
+	child.Sigl.Lock()
+	if child != p {
+		child.sigacts = acts
+	}
+	child.Threadi.Lock()
+	n, ok := child.Threadi.Notes[ctid]
+	if !ok {
+		panic("no such thread")
+	}
+	n.Sigmask = mask
+	child.Threadi.Unlock()
+	child.Sigl.Unlock()
+}
+
+// resets caught signals to their default action since their handlers no
+// longer exist after exec. ignored signals stay ignored; the mask and pending
+// signals are preserved.
+func (p *Proc_t) Sigexec() {
+	p.Sigl.Lock()
+	for i := range p.sigacts {
+		act := &p.sigacts[i]
+		if !act.Isign() {
+			*act = Sigact_t{}
+		}
+	}
+	p.Sigl.Unlock()
+}
+
+// takes all pending signals which the current thread does not block before it
+// returns to user space, performing the default action or pushing a frame for
+// the handler onto the user stack. returns true if the trap frame was changed
+// and thus the slow return path must be used.
+func (p *Proc_t) sigdeliver(tf *[defs.TFSIZE]uintptr, fxbuf *[64]uintptr,
+	tid defs.Tid_t, n *tinfo.Tnote_t) bool {
+	// a thread woken for a signal that another thread took, that was
+	// discarded, or for a stop that was continued, must still undo the
+	// wakeup, or its later waits would all be interrupted.
+	if atomic.LoadUint64(&p.sigpend)|atomic.LoadUint64(&n.Sigpend) == 0 &&
+		atomic.LoadUint32(&p.stopped) == 0 && !n.Killed {
+		return false
+	}
+
+	p.Sigl.Lock()
+	_sigunwake(n)
+	p._stopwait(n)
+	changed := false
+	for !p.doomed {
+		pend := p._sigpending(n)
+		if pend == 0 {
+			break
+		}
+		sig := 0
+		for pend&sigbit(sig) == 0 {
+			sig++
+		}
+		bit := sigbit(sig)
+		if n.Sigpend&bit != 0 {
+			p._sigsetpend(n, p.sigpend, n.Sigpend&^bit)
+		} else {
+			p._sigsetpend(n, p.sigpend&^bit, n.Sigpend)
+		}
+		si := p.siginfo[sig]
+		act := p.sigacts[sig]
+		if act.Isign() {
+			continue
+		}
+		if act.Isdfl() {
+			if bit&sigdflign != 0 {
+				continue
+			}
+			if bit&sigdflstop != 0 {
+				p.Sigl.Unlock()
+				// nothing would continue a stopped orphaned
+				// process group, so only SIGSTOP stops it
+				if sig != defs.SIGSTOP && p.Pgorphaned() {
+					p.Sigl.Lock()
+					continue
+				}
+				p.sigstop(sig)
+				p.Sigl.Lock()
+				_sigunwake(n)
+				p._stopwait(n)
+				continue
+			}
+			p.Sigl.Unlock()
+			status := defs.SIGNALED | defs.Mkexitsig(sig)
+			if bit&sigdflcore != 0 && p.syscall.Sys_coredump(p, tid, sig) {
+				status |= defs.COREDUMP
+			}
+			p.syscall.Sys_exit(p, tid, status)
+			return changed
+		}
+		err := p.sigframe(tf, fxbuf, n.Sigmask, &act, &si)
+		if err == -defs.ENOHEAP {
+			// try again on the next return to user space
+			p._sigsetpend(n, p.sigpend, n.Sigpend|bit)
+			break
+		} else if err != 0 {
+			// the stack is unusable; there is nothing we can do for
+			// this process.
+			p.Sigl.Unlock()
+			fmt.Printf("%v: cannot deliver signal %v: %v\n", p.Name,
+				sig, err)
+			p.syscall.Sys_exit(p, tid,
+				defs.SIGNALED|defs.Mkexitsig(defs.SIGSEGV))
+			return changed
+		}
+		changed = true
+		nmask := n.Sigmask | act.Mask
+		if act.Flags&defs.SA_NODEFER == 0 {
+			nmask |= bit
+		}
+		n.Sigmask = nmask &^ sigcantcatch
+		if act.Flags&defs.SA_RESETHAND != 0 {
+			p.sigacts[sig] = Sigact_t{}
+		}
+	}
+	p.Sigl.Unlock()
+	return changed
+}
+
+// pushes a signal frame for the handler of act onto the user stack and
+// modifies the trap frame to enter the handler.
+func (p *Proc_t) sigframe(tf *[defs.TFSIZE]uintptr, fxbuf *[64]uintptr,
+	omask uint64, act *Sigact_t, si *Siginfo_t) defs.Err_t {
+	sp := int(tf[defs.TF_RSP]) - sf_rzone - sf_sz
+	// the handler expects the stack to be aligned as though a call
+	// instruction pushed the return address.
+	sp = util.Rounddown(sp, 16) - 8
+	if sp < mem.USERMIN {
+		return -defs.EFAULT
+	}
+
+	buf := make([]uint8, sf_sz)
+	util.Writen(buf, 8, sf_ret, int(act.Restorer))
+
+	util.Writen(buf, 4, sf_info+si_signo, si.Signo)
+	util.Writen(buf, 4, sf_info+si_code, si.Code)
+	util.Writen(buf, 8, sf_info+si_pid, si.Pid)
+	util.Writen(buf, 8, sf_info+si_addr, int(si.Addr))
+	util.Writen(buf, 4, sf_info+si_status, si.Status)
+
+	util.Writen(buf, 8, sf_ctx+ctx_mask, int(omask))
+	util.Writen(buf, 8, sf_ctx+ctx_magic, ctx_magicval)
+	for i, v := range tf {
+		util.Writen(buf, 8, sf_ctx+ctx_tf+i*8, int(v))
+	}
+	if fxbuf != nil {
+		for i, v := range fxbuf {
+			util.Writen(buf, 8, sf_ctx+ctx_fx+i*8, int(v))
+		}
+	}
+	if err := p.Vm.K2user(buf, sp); err != 0 {
+		return err
+	}
+
+	tf[defs.TF_RSP] = uintptr(sp)
+	tf[defs.TF_RIP] = act.Handler
+	tf[defs.TF_RDI] = uintptr(si.Signo)
+	tf[defs.TF_RSI] = uintptr(sp + sf_info)
+	tf[defs.TF_RDX] = uintptr(sp + sf_ctx)
+	// the ABI requires the direction flag to be clear on function entry
+	tf[defs.TF_RFLAGS] &^= 1 << 10
+	return 0
+}
+
+// restores the context saved by sigframe once a handler returns to its
+// restorer. the restorer calls sigreturn(2) with the stack pointer just past
+// the handler's return address.
+func (p *Proc_t) sigreturn(tf *[defs.TFSIZE]uintptr, fxbuf *[64]uintptr,
+	n *tinfo.Tnote_t) defs.Err_t {
+	ctx := int(tf[defs.TF_RSP]) - 8 + sf_ctx
+	buf := make([]uint8, ctx_sz)
+	if err := p.Vm.User2k(buf, ctx); err != 0 {
+		return err
+	}
+	if util.Readn(buf, 8, ctx_magic) != ctx_magicval {
+		return -defs.EINVAL
+	}
+
+	var ntf [defs.TFSIZE]uintptr
+	for i := range ntf {
+		ntf[i] = uintptr(util.Readn(buf, 8, ctx_tf+i*8))
+	}
+	// the handler may have changed the saved context; make sure we do not
+	// fault in the kernel when returning to it.
+	if ntf[defs.TF_RIP] >= sigusermax || ntf[defs.TF_RSP] >= sigusermax ||
+		ntf[defs.TF_FSBASE] >= sigusermax {
+		return -defs.EFAULT
+	}
+	ntf[defs.TF_CS] = tf[defs.TF_CS]
+	ntf[defs.TF_SS] = tf[defs.TF_SS]
+	ntf[defs.TF_RFLAGS] = (tf[defs.TF_RFLAGS] &^ sigflmask) |
+		(ntf[defs.TF_RFLAGS] & sigflmask) | defs.TF_FL_IF
+	*tf = ntf
+
+	if fxbuf != nil {
+		for i := range fxbuf {
+			v := uintptr(util.Readn(buf, 8, ctx_fx+i*8))
+			if i == 3 {
+				// reserved MXCSR bits make fxrstor fault; keep
+				// the kernel's copy of MXCSR_MASK.
+				v = (fxbuf[i] &^ 0xffffffff) | (v & 0xffbf)
+			}
+			fxbuf[i] = v
+		}
+	}
+
+	mask := uint64(util.Readn(buf, 8, ctx_mask))
+	p.Sigl.Lock()
+	n.Sigmask = mask &^ sigcantcatch
+	p.Sigl.Unlock()
+	return 0
+}
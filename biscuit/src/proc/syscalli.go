@@ -8,10 +8,14 @@ type Syscall_i interface {
 	Syscall(p *Proc_t, tid defs.Tid_t, tf *[defs.TFSIZE]uintptr) int
 	Sys_close(proc *Proc_t, fdn int) int
 	Sys_exit(Proc *Proc_t, tid defs.Tid_t, status int)
+	// writes a core file for p, which sig is about to kill. returns true
+	// if the file was written.
+	Sys_coredump(p *Proc_t, tid defs.Tid_t, sig int) bool
 }
 
 type Cons_i interface {
 	Cons_poll(pm fdops.Pollmsg_t) (fdops.Ready_t, defs.Err_t)
 	Cons_read(ub fdops.Userio_i, offset int) (int, defs.Err_t)
 	Cons_write(src fdops.Userio_i, off int) (int, defs.Err_t)
+	Cons_ioctl(req int, arg fdops.Userio_i) defs.Err_t
 }
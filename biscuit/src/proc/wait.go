@@ -34,6 +34,11 @@ func (w *Wait_t) Wait_init(mypid int) {
 type wlist_t struct {
 	next *wlist_t
 	wst  Waitst_t
+	// the process group of an exited process
+	pgid int
+	// the status of the latest unreported stop or continue of the process,
+	// or zero
+	job int
 }
 
 type whead_t struct {
@@ -49,21 +54,6 @@ func (wh *whead_t) wpush(id int) {
 	wh.count++
 }
 
-func (wh *whead_t) wpopvalid() (Waitst_t, bool) {
-	var prev *wlist_t
-	n := wh.head
-	for n != nil {
-		if n.wst.Valid {
-			wh.wremove(prev, n)
-			return n.wst, true
-		}
-		prev = n
-		n = n.next
-	}
-	var zw Waitst_t
-	return zw, false
-}
-
 // returns the previous element in the wait status singly-linked list (in order
 // to remove the requested element), the requested element, and whether the
 // requested element was found.
@@ -122,15 +112,15 @@ func (w *Wait_t) _start(id int, isproc bool, noproc uint) bool {
 	return true
 }
 
-func (w *Wait_t) putpid(pid, status int, atime *accnt.Accnt_t) {
-	w._put(pid, status, true, atime)
+func (w *Wait_t) putpid(pid, pgid, status int, atime *accnt.Accnt_t) {
+	w._put(pid, pgid, status, true, atime)
 }
 
 func (w *Wait_t) puttid(tid, status int, atime *accnt.Accnt_t) {
-	w._put(tid, status, false, atime)
+	w._put(tid, 0, status, false, atime)
 }
 
-func (w *Wait_t) _put(id, status int, isproc bool, atime *accnt.Accnt_t) {
+func (w *Wait_t) _put(id, pgid, status int, isproc bool, atime *accnt.Accnt_t) {
 	w.Lock()
 	defer w.Unlock()
 	var wh *whead_t
@@ -145,6 +135,8 @@ func (w *Wait_t) _put(id, status int, isproc bool, atime *accnt.Accnt_t) {
 	}
 	wn.wst.Valid = true
 	wn.wst.Status = status
+	wn.pgid = pgid
+	wn.job = 0
 	if atime != nil {
 		wn.wst.Atime.Userns += atime.Userns
 		wn.wst.Atime.Sysns += atime.Sysns
@@ -152,15 +144,54 @@ func (w *Wait_t) _put(id, status int, isproc bool, atime *accnt.Accnt_t) {
 	w.cond.Broadcast()
 }
 
-func (w *Wait_t) Reappid(pid int, noblk bool) (Waitst_t, defs.Err_t) {
-	return w._reap(pid, true, noblk)
+// records that the child process pid stopped or continued, which wait(2)
+// reports if given WUNTRACED or WCONTINUED. a change replaces an unreported
+// one. returns false if the child already exited.
+func (w *Wait_t) putjob(pid, status int) bool {
+	w.Lock()
+	defer w.Unlock()
+	_, wn, ok := w.pwait.wfind(pid)
+	if !ok || wn.wst.Valid {
+		return false
+	}
+	wn.job = status
+	w.cond.Broadcast()
+	return true
+}
+
+// reaps the child process pid, any child if pid is WAIT_ANY, or any child in
+// the process group -pid if pid is less than -1. stops and continues are
+// reported too if jobctl has WUNTRACED or WCONTINUED; they do not reap the
+// child.
+func (w *Wait_t) Reappid(pid int, noblk bool, jobctl int) (Waitst_t, defs.Err_t) {
+	return w._reap(pid, true, noblk, jobctl)
 }
 
 func (w *Wait_t) Reaptid(tid int, noblk bool) (Waitst_t, defs.Err_t) {
-	return w._reap(tid, false, noblk)
+	return w._reap(tid, false, noblk, 0)
 }
 
-func (w *Wait_t) _reap(id int, isproc bool, noblk bool) (Waitst_t, defs.Err_t) {
+// returns true if the child of wn is one that a wait for id may reap
+func _wmatch(wn *wlist_t, id int) bool {
+	if id == defs.WAIT_ANY {
+		return true
+	} else if id > 0 {
+		return wn.wst.Pid == id
+	}
+	pgid := wn.pgid
+	if !wn.wst.Valid {
+		c, ok := Proc_check(wn.wst.Pid)
+		if !ok {
+			// the child is exiting; its status will tell
+			return true
+		}
+		pgid, _ = c.Pgrp()
+	}
+	return pgid == -id
+}
+
+func (w *Wait_t) _reap(id int, isproc bool, noblk bool,
+	jobctl int) (Waitst_t, defs.Err_t) {
 	if id == defs.WAIT_MYPGRP {
 		panic("no imp")
 	}
@@ -175,26 +206,33 @@ func (w *Wait_t) _reap(id int, isproc bool, noblk bool) (Waitst_t, defs.Err_t) {
 	defer w.Unlock()
 	var zw Waitst_t
 	for {
-		if id == defs.WAIT_ANY {
-			// XXXPANIC
-			if wh.count < 0 {
-				panic("neg childs")
-			}
-			if wh.count == 0 {
-				return zw, -defs.ECHILD
-			}
-			if ret, ok := wh.wpopvalid(); ok {
-				return ret, 0
-			}
-		} else {
-			wp, wn, ok := wh.wfind(id)
-			if !ok {
-				return zw, -defs.ECHILD
+		// XXXPANIC
+		if wh.count < 0 {
+			panic("neg childs")
+		}
+		found := false
+		var prev *wlist_t
+		for wn := wh.head; wn != nil; prev, wn = wn, wn.next {
+			if !_wmatch(wn, id) {
+				continue
 			}
+			found = true
 			if wn.wst.Valid {
-				wh.wremove(wp, wn)
+				wh.wremove(prev, wn)
 				return wn.wst, 0
 			}
+			stop := wn.job&defs.STOPPED != 0 &&
+				jobctl&defs.WUNTRACED != 0
+			cont := wn.job&defs.CONTINUED != 0 &&
+				jobctl&defs.WCONTINUED != 0
+			if stop || cont {
+				ret := Waitst_t{Pid: wn.wst.Pid, Status: wn.job}
+				wn.job = 0
+				return ret, 0
+			}
+		}
+		if !found {
+			return zw, -defs.ECHILD
 		}
 		if noblk {
 			return zw, 0
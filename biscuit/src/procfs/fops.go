@@ -0,0 +1,268 @@
+package procfs
+
+import "sync"
+import "sync/atomic"
+
+import "cred"
+import "defs"
+import "fdops"
+import "fs"
+import "mem"
+import "stat"
+import "util"
+
+// an open procfs file or directory
+type pfile_t struct {
+	sync.Mutex
+	pf *Procfs_t
+	n  node_t
+	// the contents of a file, generated by the first read
+	data []uint8
+	gen  bool
+	// the byte offset of a file, or the index of the next entry of a
+	// directory
+	offset int
+	count  int
+}
+
+// generates the contents of the file if they haven't been. the caller must
+// hold the lock.
+func (pfl *pfile_t) _fill() defs.Err_t {
+	if pfl.gen {
+		return 0
+	}
+	d, err := pfl.pf.contents(pfl.n)
+	if err != 0 {
+		return err
+	}
+	pfl.data = d
+	pfl.gen = true
+	return 0
+}
+
+func (pfl *pfile_t) _read(dst fdops.Userio_i, toff int) (int, defs.Err_t) {
+	pfl.Lock()
+	defer pfl.Unlock()
+	if pfl.count <= 0 {
+		return 0, -defs.EBADF
+	}
+	if pfl.n.isdir() {
+		return 0, -defs.EISDIR
+	}
+	if err := pfl._fill(); err != 0 {
+		return 0, err
+	}
+	offset := pfl.offset
+	if toff != -1 {
+		offset = toff
+	}
+	if offset >= len(pfl.data) {
+		return 0, 0
+	}
+	did, err := dst.Uiowrite(pfl.data[offset:])
+	if toff == -1 && err == 0 {
+		pfl.offset += did
+	}
+	return did, err
+}
+
+func (pfl *pfile_t) Read(dst fdops.Userio_i) (int, defs.Err_t) {
+	return pfl._read(dst, -1)
+}
+
+func (pfl *pfile_t) Pread(dst fdops.Userio_i, offset int) (int, defs.Err_t) {
+	return pfl._read(dst, offset)
+}
+
+func (pfl *pfile_t) Write(fdops.Userio_i) (int, defs.Err_t) {
+	return 0, -defs.EPERM
+}
+
+func (pfl *pfile_t) Pwrite(fdops.Userio_i, int) (int, defs.Err_t) {
+	return 0, -defs.EPERM
+}
+
+func (pfl *pfile_t) Truncate(uint) defs.Err_t {
+	return -defs.EPERM
+}
+
+func (pfl *pfile_t) Utimens(*cred.Cred_t, int, int) defs.Err_t {
+	return -defs.EPERM
+}
+
+func (pfl *pfile_t) Fchmod(*cred.Cred_t, uint) defs.Err_t {
+	return -defs.EPERM
+}
+
+func (pfl *pfile_t) Fchown(*cred.Cred_t, int, int) defs.Err_t {
+	return -defs.EPERM
+}
+
+// fills dst with the directory's entries starting at the file offset, in the
+// layout of fs's getdents records. the cookie of an entry is its index plus
+// one; the entries of the root and fd directories change as processes and
+// fds come and go, so an entry may be skipped or repeated.
+func (pfl *pfile_t) Getdents(dst fdops.Userio_i) (int, defs.Err_t) {
+	pfl.Lock()
+	defer pfl.Unlock()
+	if pfl.count <= 0 {
+		return 0, -defs.EBADF
+	}
+	if !pfl.n.isdir() {
+		return 0, -defs.ENOTDIR
+	}
+	names, nodes := pfl.pf.children(pfl.n)
+	var ret []uint8
+	i := pfl.offset
+	for ; i < len(names); i++ {
+		reclen := util.Roundup(fs.DIRENT_HDR+len(names[i])+1, 8)
+		if len(ret)+reclen > dst.Remain() {
+			break
+		}
+		rec := make([]uint8, reclen)
+		util.Writen(rec, 8, 0, int(nodes[i].ino()))
+		util.Writen(rec, 8, 8, i+1)
+		util.Writen(rec, 2, 16, reclen)
+		switch {
+		case nodes[i].isdir():
+			rec[18] = defs.DT_DIR
+		case nodes[i].islink():
+			rec[18] = defs.DT_LNK
+		default:
+			rec[18] = defs.DT_REG
+		}
+		copy(rec[fs.DIRENT_HDR:], names[i])
+		ret = append(ret, rec...)
+	}
+	if len(ret) == 0 && i < len(names) {
+		return 0, -defs.EINVAL
+	}
+	did, err := dst.Uiowrite(ret)
+	if err == 0 {
+		pfl.offset = i
+	}
+	return did, err
+}
+
+func (pfl *pfile_t) Fsync(bool) defs.Err_t {
+	return -defs.EINVAL
+}
+
+// the size of a file is 0 until it is read
+func (pfl *pfile_t) Fstat(st *stat.Stat_t) defs.Err_t {
+	pfl.Lock()
+	defer pfl.Unlock()
+	pfl.pf.stat(pfl.n, st)
+	st.Wsize(uint(len(pfl.data)))
+	return 0
+}
+
+func (pfl *pfile_t) Lseek(off, whence int) (int, defs.Err_t) {
+	pfl.Lock()
+	defer pfl.Unlock()
+	if pfl.count <= 0 {
+		return 0, -defs.EBADF
+	}
+
+	switch whence {
+	case defs.SEEK_SET:
+		pfl.offset = off
+	case defs.SEEK_CUR:
+		pfl.offset += off
+	case defs.SEEK_END:
+		if pfl.n.isdir() {
+			return 0, -defs.EINVAL
+		}
+		if err := pfl._fill(); err != 0 {
+			return 0, err
+		}
+		pfl.offset = len(pfl.data) + off
+	default:
+		return 0, -defs.EINVAL
+	}
+	if pfl.offset < 0 {
+		pfl.offset = 0
+	}
+	return pfl.offset, 0
+}
+
+func (pfl *pfile_t) Mmapi(int, int, bool) ([]mem.Mmapinfo_t, defs.Err_t) {
+	return nil, -defs.ENODEV
+}
+
+func (pfl *pfile_t) Pathi() defs.Inum_t {
+	return defs.Inum_t(pfl.n.ino())
+}
+
+func (pfl *pfile_t) Close() defs.Err_t {
+	pfl.Lock()
+	defer pfl.Unlock()
+	if pfl.count <= 0 {
+		return -defs.EBADF
+	}
+	pfl.count--
+	atomic.AddInt64(&pfl.pf.nopen, -1)
+	return 0
+}
+
+func (pfl *pfile_t) Reopen() defs.Err_t {
+	pfl.Lock()
+	defer pfl.Unlock()
+	if pfl.count <= 0 {
+		return -defs.EBADF
+	}
+	pfl.count++
+	atomic.AddInt64(&pfl.pf.nopen, 1)
+	return 0
+}
+
+func (pfl *pfile_t) Accept(fdops.Userio_i) (fdops.Fdops_i, int, defs.Err_t) {
+	return nil, 0, -defs.ENOTSOCK
+}
+
+func (pfl *pfile_t) Bind([]uint8) defs.Err_t {
+	return -defs.ENOTSOCK
+}
+
+func (pfl *pfile_t) Connect([]uint8) defs.Err_t {
+	return -defs.ENOTSOCK
+}
+
+func (pfl *pfile_t) Listen(int) (fdops.Fdops_i, defs.Err_t) {
+	return nil, -defs.ENOTSOCK
+}
+
+func (pfl *pfile_t) Sendmsg(fdops.Userio_i, []uint8, []uint8,
+	int) (int, defs.Err_t) {
+	return 0, -defs.ENOTSOCK
+}
+
+func (pfl *pfile_t) Recvmsg(fdops.Userio_i,
+	fdops.Userio_i, fdops.Userio_i, int) (int, int, int, defs.Msgfl_t, defs.Err_t) {
+	return 0, 0, 0, 0, -defs.ENOTSOCK
+}
+
+func (pfl *pfile_t) Pollone(pm fdops.Pollmsg_t) (fdops.Ready_t, defs.Err_t) {
+	return pm.Events & fdops.R_READ, 0
+}
+
+func (pfl *pfile_t) Fcntl(cmd, opt int) int {
+	return int(-defs.ENOSYS)
+}
+
+func (pfl *pfile_t) Ioctl(int, fdops.Userio_i) defs.Err_t {
+	return -defs.ENOTTY
+}
+
+func (pfl *pfile_t) Getsockopt(int, int, fdops.Userio_i,
+	int) (int, defs.Err_t) {
+	return 0, -defs.ENOTSOCK
+}
+
+func (pfl *pfile_t) Setsockopt(int, int, fdops.Userio_i, int) defs.Err_t {
+	return -defs.ENOTSOCK
+}
+
+func (pfl *pfile_t) Shutdown(read, write bool) defs.Err_t {
+	return -defs.ENOTSOCK
+}
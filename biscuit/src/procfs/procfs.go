@@ -0,0 +1,538 @@
+package procfs
+
+import "fmt"
+import "strconv"
+import "sync/atomic"
+import "time"
+
+import "bnet"
+import "bpath"
+import "cred"
+import "defs"
+import "fd"
+import "fdops"
+import "fs"
+import "mem"
+import "proc"
+import "stat"
+import "tmpfs"
+import "ustr"
+import "vfs"
+import "vm"
+
+// the kinds of files in procfs
+type kind_t int
+
+const (
+	kroot kind_t = iota + 1
+	kmeminfo
+	kmounts
+	knet
+	ktcp
+	// the per-process directory and its entries
+	kpid
+	kstatus
+	kmaps
+	kcwd
+	kfddir
+	kfd
+)
+
+// a file in procfs. pid is the process of the per-process kinds and fdn is
+// the fd of kfd.
+type node_t struct {
+	kind kind_t
+	pid  int
+	fdn  int
+}
+
+func (n node_t) isdir() bool {
+	switch n.kind {
+	case kroot, knet, kpid, kfddir:
+		return true
+	}
+	return false
+}
+
+func (n node_t) islink() bool {
+	return n.kind == kcwd || n.kind == kfd
+}
+
+// the memory map, the cwd, and the open files of a process are only
+// accessible by root and by the process's user
+func (n node_t) private() bool {
+	switch n.kind {
+	case kmaps, kcwd, kfddir, kfd:
+		return true
+	}
+	return false
+}
+
+// inode numbers are made from the node, so that they are stable
+func (n node_t) ino() uint {
+	return uint(n.pid)<<32 | uint(n.fdn+1)<<8 | uint(n.kind)
+}
+
+func (n node_t) mode() uint {
+	switch {
+	case n.kind == kfddir:
+		return fs.I_DIR<<16 | 0500
+	case n.isdir():
+		return fs.I_DIR<<16 | 0555
+	case n.islink():
+		return fs.I_SYMLINK<<16 | 0777
+	case n.kind == kmaps:
+		return fs.I_FILE<<16 | 0400
+	default:
+		return fs.I_FILE<<16 | 0444
+	}
+}
+
+// the fixed entries of each directory
+type dent_t struct {
+	name string
+	kind kind_t
+}
+
+var rootdents = []dent_t{{"meminfo", kmeminfo}, {"mounts", kmounts},
+	{"net", knet}}
+var netdents = []dent_t{{"tcp", ktcp}}
+var piddents = []dent_t{{"status", kstatus}, {"maps", kmaps}, {"cwd", kcwd},
+	{"fd", kfddir}}
+
+// a synthetic file system that describes the processes and the kernel's
+// state. the contents of a file are generated when it is first read, so that
+// every read of an open file sees the same snapshot. procfs never follows its
+// symlinks (a process's cwd and fds) itself, since the target may be in
+// another file system; the vfs follows them. the target of an fd is not a
+// path, so following one fails.
+type Procfs_t struct {
+	vfs *vfs.Vfs_t
+	dev uint
+	// when procfs was made; the time of every file
+	made int
+	// the number of open files
+	nopen int64
+}
+
+// returns a procfs whose /mounts describes the mounts of v
+func MkProcfs(v *vfs.Vfs_t) *Procfs_t {
+	return &Procfs_t{vfs: v, dev: fs.Newdev(), made: int(time.Now().UnixNano())}
+}
+
+// returns the process of a per-process node, or false if it has exited
+func (n node_t) proc() (*proc.Proc_t, bool) {
+	return proc.Ptable.Get(int32(n.pid))
+}
+
+// returns the child of directory n named name
+func (pf *Procfs_t) child(n node_t, name ustr.Ustr) (node_t, defs.Err_t) {
+	var dents []dent_t
+	switch n.kind {
+	case kroot:
+		dents = rootdents
+	case knet:
+		dents = netdents
+	case kpid:
+		dents = piddents
+	}
+	for _, de := range dents {
+		if name.Eq(ustr.Ustr(de.name)) {
+			return node_t{kind: de.kind, pid: n.pid}, 0
+		}
+	}
+	num, err := strconv.Atoi(name.String())
+	if err != nil || num < 0 {
+		return node_t{}, -defs.ENOENT
+	}
+	switch n.kind {
+	case kroot:
+		ret := node_t{kind: kpid, pid: num}
+		if _, ok := ret.proc(); ok {
+			return ret, 0
+		}
+	case kfddir:
+		if p, ok := n.proc(); ok {
+			if _, ok := p.Fd_get(num); ok {
+				return node_t{kind: kfd, pid: n.pid, fdn: num}, 0
+			}
+		}
+	}
+	return node_t{}, -defs.ENOENT
+}
+
+// returns the names and nodes of the entries of directory n, including "."
+// and ".."
+func (pf *Procfs_t) children(n node_t) ([]string, []node_t) {
+	names := []string{".", ".."}
+	nodes := []node_t{n, n}
+	add := func(dents []dent_t) {
+		for _, de := range dents {
+			names = append(names, de.name)
+			nodes = append(nodes, node_t{kind: de.kind, pid: n.pid})
+		}
+	}
+	switch n.kind {
+	case kroot:
+		add(rootdents)
+		proc.Ptable.Iter(func(pid int32, _ *proc.Proc_t) bool {
+			names = append(names, strconv.Itoa(int(pid)))
+			nodes = append(nodes, node_t{kind: kpid, pid: int(pid)})
+			return false
+		})
+	case knet:
+		add(netdents)
+	case kpid:
+		add(piddents)
+	case kfddir:
+		p, ok := n.proc()
+		if !ok {
+			break
+		}
+		p.Fdl.Lock()
+		for i, f := range p.Fds {
+			if f != nil {
+				names = append(names, strconv.Itoa(i))
+				nodes = append(nodes, node_t{kind: kfd, pid: n.pid, fdn: i})
+			}
+		}
+		p.Fdl.Unlock()
+	}
+	return names, nodes
+}
+
+// returns true if cr may access n. like Linux's ptrace access check, cr's
+// effective uid must be the real, effective, and saved uid of the process of
+// a private node.
+func (n node_t) mayaccess(cr *cred.Cred_t) bool {
+	if !n.private() || cr.Isroot() {
+		return true
+	}
+	p, ok := n.proc()
+	if !ok {
+		return false
+	}
+	pcr := p.Cred()
+	return cr.Euid == pcr.Ruid && cr.Euid == pcr.Euid && cr.Euid == pcr.Suid
+}
+
+// returns the node of path. paths are resolved lexically, like the mount
+// points of vfs. the entries of a process's fd directory can only be looked up
+// by those who may access it.
+func (pf *Procfs_t) lookup(path ustr.Ustr, cwd *fd.Cwd_t, cr *cred.Cred_t) (node_t, defs.Err_t) {
+	full := make(ustr.Ustr, 0, len(cwd.Path)+1+len(path))
+	if !path.IsAbsolute() {
+		full = append(full, cwd.Path...)
+		full = append(full, '/')
+	}
+	full = append(full, path...)
+
+	n := node_t{kind: kroot}
+	var pp bpath.Pathparts_t
+	pp.Pp_init(bpath.Canonicalize(full))
+	for c, ok := pp.Next(); ok; c, ok = pp.Next() {
+		if !n.isdir() {
+			return node_t{}, -defs.ENOTDIR
+		}
+		if !n.mayaccess(cr) {
+			return node_t{}, -defs.EACCES
+		}
+		var err defs.Err_t
+		n, err = pf.child(n, c)
+		if err != 0 {
+			return node_t{}, err
+		}
+	}
+	return n, 0
+}
+
+// returns the owner of n: the credentials of the process for the
+// per-process kinds, otherwise root
+func (n node_t) owner() (int, int) {
+	if n.pid != 0 {
+		if p, ok := n.proc(); ok {
+			cr := p.Cred()
+			return cr.Euid, cr.Egid
+		}
+	}
+	return 0, 0
+}
+
+func (pf *Procfs_t) stat(n node_t, st *stat.Stat_t) {
+	uid, gid := n.owner()
+	st.Wdev(pf.dev)
+	st.Wino(n.ino())
+	st.Wmode(n.mode())
+	st.Wsize(0)
+	st.Wuid(uint(uid))
+	st.Wgid(uint(gid))
+	st.Watime(pf.made)
+	st.Wmtime(pf.made)
+	st.Wctime(pf.made)
+}
+
+// returns the contents of file n
+func (pf *Procfs_t) contents(n node_t) ([]uint8, defs.Err_t) {
+	var s string
+	switch n.kind {
+	case kmeminfo:
+		s = meminfo()
+	case kmounts:
+		s = pf.vfs.Mounts()
+	case ktcp:
+		s = bnet.Tcpconns()
+	case kstatus, kmaps:
+		p, ok := n.proc()
+		if !ok {
+			return nil, -defs.ESRCH
+		}
+		if n.kind == kstatus {
+			s = status(p)
+		} else {
+			p.Vm.Lock_pmap()
+			s = p.Vm.Vmregion.Maps()
+			p.Vm.Unlock_pmap()
+		}
+	default:
+		panic("not a file")
+	}
+	return []uint8(s), 0
+}
+
+func meminfo() string {
+	free, pmaps, pcfree, pcpmaps := mem.Physmem.Pgcount()
+	for i := range pcfree {
+		free += pcfree[i]
+		pmaps += pcpmaps[i]
+	}
+	swaptot, swapfree := vm.Swapstat()
+	kb := mem.PGSIZE / 1024
+	huge := mem.Physmem.Hugecount()
+	return fmt.Sprintf("MemTotal:\t%d kB\nMemFree:\t%d kB\nPageMaps:\t%d\n"+
+		"SwapTotal:\t%d kB\nSwapFree:\t%d kB\nShmem:\t%d kB\n"+
+		"AnonHugePages:\t%d kB\nHugePages_Inuse:\t%d\n"+
+		"Hugepagesize:\t%d kB\n", len(mem.Physmem.Pgs)*kb,
+		free*kb, pmaps, swaptot*kb, swapfree*kb, tmpfs.Pages()*kb,
+		huge*mem.HUGEPGSIZE/1024, huge, mem.HUGEPGSIZE/1024)
+}
+
+func status(p *proc.Proc_t) string {
+	state := "R (running)"
+	if p.Doomed() {
+		state = "K (killed)"
+	}
+	p.Atime.Lock()
+	utime, stime := p.Atime.Userns, p.Atime.Sysns
+	p.Atime.Unlock()
+	cr := p.Cred()
+	s := fmt.Sprintf("Name:\t%s\nState:\t%s\nPid:\t%d\nUid:\t%d\t%d\nGid:\t%d\t%d\n",
+		p.Name, state, p.Pid, cr.Ruid, cr.Euid, cr.Rgid, cr.Egid)
+	s += fmt.Sprintf("Threads:\t%d\n", p.Thread_count())
+	s += fmt.Sprintf("MaxPages:\t%d\nMaxFiles:\t%d\nMaxVmas:\t%d\nMaxProcs:\t%d\n",
+		p.Ulim.Pages, p.Ulim.Nofile, p.Ulim.Novma, p.Ulim.Noproc)
+	s += fmt.Sprintf("Utime:\t%d us\nStime:\t%d us\n", utime/1000, stime/1000)
+	return s
+}
+
+// returns the target of symlink n: the path of a process's cwd, or a
+// description of an open file, like Linux's "pipe:[ino]", since the path of
+// an open file isn't known.
+func (pf *Procfs_t) readlink(n node_t) (string, defs.Err_t) {
+	p, ok := n.proc()
+	if !ok {
+		return "", -defs.ENOENT
+	}
+	if n.kind == kcwd {
+		p.Cwd.Lock()
+		ret := p.Cwd.Path.String()
+		p.Cwd.Unlock()
+		return ret, 0
+	}
+	f, ok := p.Fd_get(n.fdn)
+	if !ok {
+		return "", -defs.ENOENT
+	}
+	st := &stat.Stat_t{}
+	if err := f.Fops.Fstat(st); err != 0 {
+		return "", err
+	}
+	var what string
+	if maj, _ := defs.Unmkdev(st.Mode()); maj != 0 {
+		what = "dev"
+		if maj == defs.D_SUD || maj == defs.D_SUS {
+			what = "socket"
+		}
+	} else {
+		switch st.Mode() >> 16 {
+		case fs.I_FILE:
+			what = "file"
+		case fs.I_DIR:
+			what = "dir"
+		case 3:
+			what = "pipe"
+		default:
+			what = "anon"
+		}
+	}
+	return fmt.Sprintf("%s:[%d:%d]", what, st.Dev(), st.Rino()), 0
+}
+
+func (pf *Procfs_t) Fs_open(path ustr.Ustr, flags defs.Fdopt_t, mode int, cwd *fd.Cwd_t, cr *cred.Cred_t, major, minor int) (*fd.Fd_t, defs.Err_t) {
+	n, err := pf.lookup(path, cwd, cr)
+	if err != 0 {
+		if err == -defs.ENOENT && flags&defs.O_CREAT != 0 {
+			err = -defs.EACCES
+		}
+		return nil, err
+	}
+	if n.islink() {
+		return nil, -defs.ELOOP
+	}
+	if !n.mayaccess(cr) {
+		return nil, -defs.EACCES
+	}
+	if flags&defs.O_DIRECTORY != 0 && !n.isdir() {
+		return nil, -defs.ENOTDIR
+	}
+	if flags&(defs.O_WRONLY|defs.O_RDWR|defs.O_TRUNC) != 0 {
+		if n.isdir() {
+			return nil, -defs.EISDIR
+		}
+		return nil, -defs.EACCES
+	}
+	if flags&defs.O_EXEC != 0 && !n.isdir() {
+		return nil, -defs.EACCES
+	}
+	atomic.AddInt64(&pf.nopen, 1)
+	return &fd.Fd_t{Fops: &pfile_t{pf: pf, n: n, count: 1}}, 0
+}
+
+func (pf *Procfs_t) Fs_mknod(ustr.Ustr, defs.Fdopt_t, int, *fd.Cwd_t, *cred.Cred_t, int, int) (defs.Inum_t, defs.Err_t) {
+	return 0, -defs.EPERM
+}
+
+func (pf *Procfs_t) Fs_mkdir(ustr.Ustr, int, *fd.Cwd_t, *cred.Cred_t) defs.Err_t {
+	return -defs.EPERM
+}
+
+func (pf *Procfs_t) Fs_unlink(ustr.Ustr, *fd.Cwd_t, *cred.Cred_t, bool) defs.Err_t {
+	return -defs.EPERM
+}
+
+func (pf *Procfs_t) Fs_rename(ustr.Ustr, ustr.Ustr, *fd.Cwd_t, *cred.Cred_t) defs.Err_t {
+	return -defs.EPERM
+}
+
+func (pf *Procfs_t) Fs_link(ustr.Ustr, ustr.Ustr, *fd.Cwd_t, *cred.Cred_t) defs.Err_t {
+	return -defs.EPERM
+}
+
+func (pf *Procfs_t) Fs_symlink(ustr.Ustr, ustr.Ustr, *fd.Cwd_t, *cred.Cred_t) defs.Err_t {
+	return -defs.EPERM
+}
+
+func (pf *Procfs_t) Fs_readlink(path ustr.Ustr, dst fdops.Userio_i, cwd *fd.Cwd_t, cr *cred.Cred_t) (int, defs.Err_t) {
+	n, err := pf.lookup(path, cwd, cr)
+	if err != 0 {
+		return 0, err
+	}
+	if !n.islink() {
+		return 0, -defs.EINVAL
+	}
+	if !n.mayaccess(cr) {
+		return 0, -defs.EACCES
+	}
+	t, err := pf.readlink(n)
+	if err != 0 {
+		return 0, err
+	}
+	return dst.Uiowrite([]uint8(t))
+}
+
+func (pf *Procfs_t) Fs_stat(path ustr.Ustr, st *stat.Stat_t, cwd *fd.Cwd_t, cr *cred.Cred_t) defs.Err_t {
+	return pf.Fs_lstat(path, st, cwd, cr)
+}
+
+func (pf *Procfs_t) Fs_lstat(path ustr.Ustr, st *stat.Stat_t, cwd *fd.Cwd_t, cr *cred.Cred_t) defs.Err_t {
+	n, err := pf.lookup(path, cwd, cr)
+	if err != 0 {
+		return err
+	}
+	pf.stat(n, st)
+	return 0
+}
+
+// stops at the first symlink, for the vfs to follow
+func (pf *Procfs_t) Fs_walk(path ustr.Ustr, cwd *fd.Cwd_t, cr *cred.Cred_t) (int, ustr.Ustr, defs.Err_t) {
+	n := node_t{kind: kroot}
+	var pp bpath.Pathparts_t
+	pp.Pp_init(path)
+	for c, ok := pp.Next(); ok; c, ok = pp.Next() {
+		if !n.isdir() {
+			return 0, nil, -defs.ENOTDIR
+		}
+		if !n.mayaccess(cr) {
+			return 0, nil, -defs.EACCES
+		}
+		var err defs.Err_t
+		if n, err = pf.child(n, c); err != 0 {
+			return 0, nil, err
+		}
+		if !n.islink() {
+			continue
+		}
+		if !n.mayaccess(cr) {
+			return 0, nil, -defs.EACCES
+		}
+		t, err := pf.readlink(n)
+		if err != 0 {
+			return 0, nil, err
+		}
+		return pp.Off() + len(c), ustr.Ustr(t), 0
+	}
+	return len(path), nil, 0
+}
+
+func (pf *Procfs_t) Fs_chmod(ustr.Ustr, uint, *fd.Cwd_t, *cred.Cred_t) defs.Err_t {
+	return -defs.EPERM
+}
+
+func (pf *Procfs_t) Fs_chown(ustr.Ustr, int, int, *fd.Cwd_t, *cred.Cred_t) defs.Err_t {
+	return -defs.EPERM
+}
+
+func (pf *Procfs_t) Fs_utimes(ustr.Ustr, int, int, *fd.Cwd_t, *cred.Cred_t) defs.Err_t {
+	return -defs.EPERM
+}
+
+func (pf *Procfs_t) Fs_access(path ustr.Ustr, want uint, cwd *fd.Cwd_t, cr *cred.Cred_t) defs.Err_t {
+	n, err := pf.lookup(path, cwd, cr)
+	if err != 0 {
+		return err
+	}
+	if !n.mayaccess(cr) {
+		return -defs.EACCES
+	}
+	uid, gid := n.owner()
+	if !cr.Permits(uid, gid, n.mode()&07777, want, n.isdir()) {
+		return -defs.EACCES
+	}
+	return 0
+}
+
+// there is nothing to write back
+func (pf *Procfs_t) Fs_sync() defs.Err_t {
+	return 0
+}
+
+func (pf *Procfs_t) Fs_busy() bool {
+	return atomic.LoadInt64(&pf.nopen) != 0
+}
+
+func (pf *Procfs_t) MkRootCwd() *fd.Cwd_t {
+	f := &fd.Fd_t{Fops: &pfile_t{pf: pf, n: node_t{kind: kroot}}}
+	return fd.MkRootCwd(f)
+}
+
+func (pf *Procfs_t) StopFS() {
+}
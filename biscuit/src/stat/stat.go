@@ -12,6 +12,11 @@ type Stat_t struct {
 	_blocks uint
 	_m_sec  uint
 	_m_nsec uint
+	_a_sec  uint
+	_a_nsec uint
+	_c_sec  uint
+	_c_nsec uint
+	_gid    uint
 }
 
 func (st *Stat_t) Wdev(v uint) {
@@ -34,6 +39,36 @@ func (st *Stat_t) Wrdev(v uint) {
 	st._rdev = v
 }
 
+func (st *Stat_t) Wuid(v uint) {
+	st._uid = v
+}
+
+func (st *Stat_t) Wgid(v uint) {
+	st._gid = v
+}
+
+// the times are in nanoseconds since the epoch
+func (st *Stat_t) Watime(ns int) {
+	st._a_sec, st._a_nsec = _splitns(ns)
+}
+
+func (st *Stat_t) Wmtime(ns int) {
+	st._m_sec, st._m_nsec = _splitns(ns)
+}
+
+func (st *Stat_t) Wctime(ns int) {
+	st._c_sec, st._c_nsec = _splitns(ns)
+}
+
+func _splitns(ns int) (uint, uint) {
+	const sec = 1e9
+	return uint(ns / sec), uint(ns % sec)
+}
+
+func (st *Stat_t) Dev() uint {
+	return st._dev
+}
+
 func (st *Stat_t) Mode() uint {
 	return st._mode
 }
@@ -50,6 +85,26 @@ func (st *Stat_t) Rino() uint {
 	return st._ino
 }
 
+func (st *Stat_t) Uid() int {
+	return int(st._uid)
+}
+
+func (st *Stat_t) Gid() int {
+	return int(st._gid)
+}
+
+func (st *Stat_t) Atime() int {
+	return int(st._a_sec*1e9 + st._a_nsec)
+}
+
+func (st *Stat_t) Mtime() int {
+	return int(st._m_sec*1e9 + st._m_nsec)
+}
+
+func (st *Stat_t) Ctime() int {
+	return int(st._c_sec*1e9 + st._c_nsec)
+}
+
 func (st *Stat_t) Bytes() []uint8 {
 	const sz = unsafe.Sizeof(*st)
 	sl := (*[sz]uint8)(unsafe.Pointer(&st._dev))
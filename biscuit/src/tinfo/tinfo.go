@@ -19,6 +19,13 @@ type Tnote_t struct {
 		Cond   *sync.Cond
 		Kerr   defs.Err_t
 	}
+	// blocked signals and signals directed at this thread; protected by
+	// the owning process' signal lock.
+	Sigmask uint64
+	Sigpend uint64
+	// the registers the thread had when it last entered the kernel; set
+	// once when the thread starts running, and used for core dumps.
+	Tf *[defs.TFSIZE]uintptr
 }
 
 func (t *Tnote_t) Doomed() bool {
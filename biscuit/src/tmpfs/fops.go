@@ -0,0 +1,342 @@
+package tmpfs
+
+import "sync"
+import "sync/atomic"
+
+import "cred"
+import "defs"
+import "fdops"
+import "fs"
+import "mem"
+import "stat"
+import "util"
+
+// an open memory object or tmpfs root directory. tfs is nil for a memfd.
+type tfops_t struct {
+	sync.Mutex
+	tfs *Tmpfs_t
+	mf  *memfile_t
+	// the byte offset of a file, or the index of the next entry of a
+	// directory
+	offset   int
+	append   bool
+	writable bool
+	count    int
+}
+
+// returns a new memory object that no directory names, like memfd_create(2).
+// its pages are freed once it is closed and unmapped.
+func MkMemfd(cr *cred.Cred_t) fdops.Fdops_i {
+	mf := mkmemfile(_memfddev, cr, 0777)
+	mf.nopen = 1
+	return &tfops_t{mf: mf, writable: true, count: 1}
+}
+
+// the device of memfds
+var _memfddev = fs.Newdev()
+
+func (tf *tfops_t) _read(dst fdops.Userio_i, toff int) (int, defs.Err_t) {
+	tf.Lock()
+	defer tf.Unlock()
+	if tf.count <= 0 {
+		return 0, -defs.EBADF
+	}
+	if tf.mf.dir {
+		return 0, -defs.EISDIR
+	}
+	offset := tf.offset
+	if toff != -1 {
+		offset = toff
+	}
+	if offset >= maxsize {
+		return 0, 0
+	}
+	// the object's lock is not held while copying to the user, whose
+	// buffer may be a mapping of the object
+	buf := make([]uint8, mem.PGSIZE)
+	did := 0
+	for dst.Remain() != 0 {
+		n := tf.mf.readat(buf[:util.Min(len(buf), dst.Remain())], offset+did)
+		if n == 0 {
+			break
+		}
+		c, err := dst.Uiowrite(buf[:n])
+		did += c
+		if err != 0 {
+			return did, err
+		}
+	}
+	if toff == -1 {
+		tf.offset += did
+	}
+	return did, 0
+}
+
+func (tf *tfops_t) Read(dst fdops.Userio_i) (int, defs.Err_t) {
+	return tf._read(dst, -1)
+}
+
+func (tf *tfops_t) Pread(dst fdops.Userio_i, offset int) (int, defs.Err_t) {
+	if offset < 0 {
+		return 0, -defs.EINVAL
+	}
+	return tf._read(dst, offset)
+}
+
+func (tf *tfops_t) _write(src fdops.Userio_i, toff int) (int, defs.Err_t) {
+	tf.Lock()
+	defer tf.Unlock()
+	if tf.count <= 0 {
+		return 0, -defs.EBADF
+	}
+	offset := tf.offset
+	if toff != -1 {
+		offset = toff
+	} else if tf.append {
+		tf.mf.Lock()
+		offset = tf.mf.size
+		tf.mf.Unlock()
+	}
+	if offset >= maxsize && src.Remain() != 0 {
+		return 0, -defs.EFBIG
+	}
+	buf := make([]uint8, mem.PGSIZE)
+	did := 0
+	// a write that would grow the object past maxsize is cut short
+	for src.Remain() != 0 && offset+did < maxsize {
+		off := offset + did
+		n := util.Min(mem.PGSIZE-off%mem.PGSIZE, src.Remain())
+		c, err := src.Uioread(buf[:n])
+		if err != 0 {
+			return did, err
+		}
+		if c == 0 {
+			break
+		}
+		if err := tf.mf.writeat(buf[:c], off); err != 0 {
+			return did, err
+		}
+		did += c
+	}
+	if toff == -1 {
+		tf.offset = offset + did
+	}
+	return did, 0
+}
+
+func (tf *tfops_t) Write(src fdops.Userio_i) (int, defs.Err_t) {
+	return tf._write(src, -1)
+}
+
+func (tf *tfops_t) Pwrite(src fdops.Userio_i, offset int) (int, defs.Err_t) {
+	if offset < 0 {
+		return 0, -defs.EINVAL
+	}
+	return tf._write(src, offset)
+}
+
+// growing the object makes a hole that reads as zeros
+func (tf *tfops_t) Truncate(newlen uint) defs.Err_t {
+	if tf.mf.dir {
+		return -defs.EISDIR
+	}
+	if !tf.writable {
+		return -defs.EINVAL
+	}
+	if newlen > maxsize {
+		return -defs.EFBIG
+	}
+	tf.mf.Lock()
+	tf.mf._truncate(int(newlen))
+	tf.mf.Unlock()
+	return 0
+}
+
+func (tf *tfops_t) Utimens(cr *cred.Cred_t, atime, mtime int) defs.Err_t {
+	return tf.mf.utimens(cr, atime, mtime)
+}
+
+func (tf *tfops_t) Fchmod(cr *cred.Cred_t, mode uint) defs.Err_t {
+	return tf.mf.chmod(cr, mode)
+}
+
+func (tf *tfops_t) Fchown(cr *cred.Cred_t, uid, gid int) defs.Err_t {
+	return tf.mf.chown(cr, uid, gid)
+}
+
+// fills dst with the directory's entries starting at the file offset, in the
+// layout of fs's getdents records. the cookie of an entry is its index plus
+// one in the sorted names, so an entry may be skipped or repeated if names
+// are added or removed between calls.
+func (tf *tfops_t) Getdents(dst fdops.Userio_i) (int, defs.Err_t) {
+	tf.Lock()
+	defer tf.Unlock()
+	if tf.count <= 0 {
+		return 0, -defs.EBADF
+	}
+	if !tf.mf.dir {
+		return 0, -defs.ENOTDIR
+	}
+	names, inos := tf.tfs.entries()
+	var ret []uint8
+	i := tf.offset
+	for ; i < len(names); i++ {
+		reclen := util.Roundup(fs.DIRENT_HDR+len(names[i])+1, 8)
+		if len(ret)+reclen > dst.Remain() {
+			break
+		}
+		rec := make([]uint8, reclen)
+		util.Writen(rec, 8, 0, int(inos[i]))
+		util.Writen(rec, 8, 8, i+1)
+		util.Writen(rec, 2, 16, reclen)
+		if i < 2 {
+			rec[18] = defs.DT_DIR
+		} else {
+			rec[18] = defs.DT_REG
+		}
+		copy(rec[fs.DIRENT_HDR:], names[i])
+		ret = append(ret, rec...)
+	}
+	if len(ret) == 0 && i < len(names) {
+		return 0, -defs.EINVAL
+	}
+	did, err := dst.Uiowrite(ret)
+	if err == 0 {
+		tf.offset = i
+	}
+	return did, err
+}
+
+// there is no disk to commit to
+func (tf *tfops_t) Fsync(bool) defs.Err_t {
+	return 0
+}
+
+func (tf *tfops_t) Fstat(st *stat.Stat_t) defs.Err_t {
+	tf.mf.stat(st)
+	return 0
+}
+
+func (tf *tfops_t) Lseek(off, whence int) (int, defs.Err_t) {
+	tf.Lock()
+	defer tf.Unlock()
+	if tf.count <= 0 {
+		return 0, -defs.EBADF
+	}
+
+	switch whence {
+	case defs.SEEK_SET:
+		tf.offset = off
+	case defs.SEEK_CUR:
+		tf.offset += off
+	case defs.SEEK_END:
+		if tf.mf.dir {
+			return 0, -defs.EINVAL
+		}
+		tf.mf.Lock()
+		tf.offset = tf.mf.size + off
+		tf.mf.Unlock()
+	default:
+		return 0, -defs.EINVAL
+	}
+	if tf.offset < 0 {
+		tf.offset = 0
+	}
+	return tf.offset, 0
+}
+
+// the file's lock is not taken since a page fault on a buffer of a read(2) of
+// this file may map the file's pages
+func (tf *tfops_t) Mmapi(offset, len int, inc bool) ([]mem.Mmapinfo_t, defs.Err_t) {
+	if tf.mf.dir {
+		return nil, -defs.ENODEV
+	}
+	return tf.mf.mmapi(offset, len)
+}
+
+func (tf *tfops_t) Pathi() defs.Inum_t {
+	return defs.Inum_t(tf.mf.ino)
+}
+
+func (tf *tfops_t) Close() defs.Err_t {
+	tf.Lock()
+	defer tf.Unlock()
+	if tf.count <= 0 {
+		return -defs.EBADF
+	}
+	tf.count--
+	if !tf.mf.dir {
+		tf.mf.close()
+	}
+	if tf.tfs != nil {
+		atomic.AddInt64(&tf.tfs.nopen, -1)
+	}
+	return 0
+}
+
+func (tf *tfops_t) Reopen() defs.Err_t {
+	tf.Lock()
+	defer tf.Unlock()
+	if tf.count <= 0 {
+		return -defs.EBADF
+	}
+	tf.count++
+	if !tf.mf.dir {
+		tf.mf.open()
+	}
+	if tf.tfs != nil {
+		atomic.AddInt64(&tf.tfs.nopen, 1)
+	}
+	return 0
+}
+
+func (tf *tfops_t) Accept(fdops.Userio_i) (fdops.Fdops_i, int, defs.Err_t) {
+	return nil, 0, -defs.ENOTSOCK
+}
+
+func (tf *tfops_t) Bind([]uint8) defs.Err_t {
+	return -defs.ENOTSOCK
+}
+
+func (tf *tfops_t) Connect([]uint8) defs.Err_t {
+	return -defs.ENOTSOCK
+}
+
+func (tf *tfops_t) Listen(int) (fdops.Fdops_i, defs.Err_t) {
+	return nil, -defs.ENOTSOCK
+}
+
+func (tf *tfops_t) Sendmsg(fdops.Userio_i, []uint8, []uint8,
+	int) (int, defs.Err_t) {
+	return 0, -defs.ENOTSOCK
+}
+
+func (tf *tfops_t) Recvmsg(fdops.Userio_i,
+	fdops.Userio_i, fdops.Userio_i, int) (int, int, int, defs.Msgfl_t, defs.Err_t) {
+	return 0, 0, 0, 0, -defs.ENOTSOCK
+}
+
+func (tf *tfops_t) Pollone(pm fdops.Pollmsg_t) (fdops.Ready_t, defs.Err_t) {
+	return pm.Events & (fdops.R_READ | fdops.R_WRITE), 0
+}
+
+func (tf *tfops_t) Fcntl(cmd, opt int) int {
+	return int(-defs.ENOSYS)
+}
+
+func (tf *tfops_t) Ioctl(int, fdops.Userio_i) defs.Err_t {
+	return -defs.ENOTTY
+}
+
+func (tf *tfops_t) Getsockopt(int, int, fdops.Userio_i,
+	int) (int, defs.Err_t) {
+	return 0, -defs.ENOTSOCK
+}
+
+func (tf *tfops_t) Setsockopt(int, int, fdops.Userio_i, int) defs.Err_t {
+	return -defs.ENOTSOCK
+}
+
+func (tf *tfops_t) Shutdown(read, write bool) defs.Err_t {
+	return -defs.ENOTSOCK
+}
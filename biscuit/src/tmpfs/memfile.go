@@ -0,0 +1,327 @@
+package tmpfs
+
+import "sync"
+import "sync/atomic"
+import "time"
+
+import "bounds"
+import "cred"
+import "defs"
+import "fs"
+import "mem"
+import "res"
+import "stat"
+import "util"
+
+// the number of pages held by all memory objects
+var _npages int64
+
+// returns the number of pages that memory objects hold
+func Pages() int {
+	return int(atomic.LoadInt64(&_npages))
+}
+
+var _nextino uint64
+
+func now() int {
+	return int(time.Now().UnixNano())
+}
+
+// the largest size of a memory object
+const maxsize = 1 << 40
+
+// a memory object: the contents of a tmpfs file or of a memfd. its pages are
+// user pages that shared mappings of the object map directly, so that the
+// mappings, read(2), and write(2) all see the same bytes. the root directory
+// of a tmpfs is a memory object without pages so that it has attributes too.
+type memfile_t struct {
+	sync.Mutex
+	dev uint
+	ino uint
+	dir bool
+	// the pages of the object by page number, each with one reference held
+	// by the object. a hole has no page and reads as zeros.
+	pgs   map[int]mem.Pa_t
+	size  int
+	uid   int
+	gid   int
+	mode  uint
+	atime int
+	mtime int
+	ctime int
+	// the number of directory entries that name the object; a memfd has
+	// none
+	nlink int
+	// the number of open files of the object, which include those of the
+	// mappings of the object
+	nopen int
+	// the tmpfs whose size the pages count against, or nil for a memfd
+	tfs *Tmpfs_t
+}
+
+func mkmemfile(dev uint, cr *cred.Cred_t, mode uint) *memfile_t {
+	t := now()
+	return &memfile_t{dev: dev, ino: uint(atomic.AddUint64(&_nextino, 1)),
+		pgs: make(map[int]mem.Pa_t), uid: cr.Euid, gid: cr.Egid,
+		mode: mode & 07777, atime: t, mtime: t, ctime: t}
+}
+
+func (mf *memfile_t) _permits(cr *cred.Cred_t, want uint) bool {
+	return cr.Permits(mf.uid, mf.gid, mf.mode, want, mf.dir)
+}
+
+func (mf *memfile_t) permits(cr *cred.Cred_t, want uint) bool {
+	mf.Lock()
+	defer mf.Unlock()
+	return mf._permits(cr, want)
+}
+
+func (mf *memfile_t) stat(st *stat.Stat_t) {
+	mf.Lock()
+	defer mf.Unlock()
+	st.Wdev(mf.dev)
+	st.Wino(mf.ino)
+	if mf.dir {
+		st.Wmode(fs.I_DIR<<16 | mf.mode)
+	} else {
+		st.Wmode(fs.I_FILE<<16 | mf.mode)
+	}
+	st.Wsize(uint(mf.size))
+	st.Wuid(uint(mf.uid))
+	st.Wgid(uint(mf.gid))
+	st.Watime(mf.atime)
+	st.Wmtime(mf.mtime)
+	st.Wctime(mf.ctime)
+}
+
+func (mf *memfile_t) chmod(cr *cred.Cred_t, mode uint) defs.Err_t {
+	mf.Lock()
+	defer mf.Unlock()
+	if !cr.Isroot() && cr.Euid != mf.uid {
+		return -defs.EPERM
+	}
+	mode &= 07777
+	if !cr.Isroot() && !mf.dir && !cr.Ingroup(mf.gid) {
+		mode &^= defs.S_ISGID
+	}
+	mf.mode = mode
+	mf.ctime = now()
+	return 0
+}
+
+// an id of -1 is left unchanged. only root may change the owner; the owner
+// may change the group to one of its groups.
+func (mf *memfile_t) chown(cr *cred.Cred_t, uid, gid int) defs.Err_t {
+	mf.Lock()
+	defer mf.Unlock()
+	if uid == -1 {
+		uid = mf.uid
+	}
+	if gid == -1 {
+		gid = mf.gid
+	}
+	if !cr.Isroot() {
+		if uid != mf.uid || cr.Euid != mf.uid {
+			return -defs.EPERM
+		}
+		if gid != mf.gid && !cr.Ingroup(gid) {
+			return -defs.EPERM
+		}
+	}
+	if !mf.dir {
+		mf.mode &^= defs.S_ISUID | defs.S_ISGID
+	}
+	mf.uid = uid
+	mf.gid = gid
+	mf.ctime = now()
+	return 0
+}
+
+// UT_NOW sets a time to now and UT_OMIT leaves it unchanged. only the owner
+// may set other times.
+func (mf *memfile_t) utimens(cr *cred.Cred_t, atime, mtime int) defs.Err_t {
+	mf.Lock()
+	defer mf.Unlock()
+	if !cr.Isroot() && cr.Euid != mf.uid && (atime >= 0 || mtime >= 0 ||
+		!mf._permits(cr, cred.MAY_WRITE)) {
+		return -defs.EPERM
+	}
+	t := now()
+	if atime == defs.UT_NOW {
+		atime = t
+	}
+	if mtime == defs.UT_NOW {
+		mtime = t
+	}
+	if atime >= 0 {
+		mf.atime = atime
+	}
+	if mtime >= 0 {
+		mf.mtime = mtime
+	}
+	mf.ctime = t
+	return 0
+}
+
+// returns the page pgn of the object. if alloc is true, a hole is filled with
+// a new zero page, otherwise a hole is returned as 0.
+func (mf *memfile_t) _page(pgn int, alloc bool) (mem.Pa_t, defs.Err_t) {
+	if pgn < 0 || pgn >= maxsize/mem.PGSIZE {
+		panic("bad page")
+	}
+	p_pg, ok := mf.pgs[pgn]
+	if ok || !alloc {
+		return p_pg, 0
+	}
+	if mf.tfs != nil && !mf.tfs.charge() {
+		return 0, -defs.ENOSPC
+	}
+	if !res.Resadd_noblock(bounds.Bounds(bounds.B_MEMFILE_T__PAGE)) {
+		mf._uncharge(1)
+		return 0, -defs.ENOHEAP
+	}
+	_, p_pg, ok = mem.Physmem.Refpg_new()
+	if !ok {
+		mf._uncharge(1)
+		return 0, -defs.ENOMEM
+	}
+	mem.Physmem.Refup(p_pg)
+	atomic.AddInt64(&_npages, 1)
+	mf.pgs[pgn] = p_pg
+	return p_pg, 0
+}
+
+// returns n pages to the size of the object's tmpfs
+func (mf *memfile_t) _uncharge(n int) {
+	if mf.tfs != nil {
+		atomic.AddInt64(&mf.tfs.npages, -int64(n))
+	}
+}
+
+// sets the size of the object to n, freeing the pages past the end. the pages
+// that are mapped remain until they are unmapped, but are no longer part of
+// the object.
+func (mf *memfile_t) _truncate(n int) {
+	npg := util.Roundup(n, mem.PGSIZE) / mem.PGSIZE
+	for i, p_pg := range mf.pgs {
+		if i >= npg {
+			mem.Physmem.Refdown(p_pg)
+			atomic.AddInt64(&_npages, -1)
+			mf._uncharge(1)
+			delete(mf.pgs, i)
+		}
+	}
+	// zero the rest of the last page so that growing the object again
+	// reads zeros
+	if p_pg, ok := mf.pgs[npg-1]; ok && n%mem.PGSIZE != 0 {
+		off := n % mem.PGSIZE
+		bpg := mem.Pg2bytes(mem.Physmem.Dmap(p_pg))
+		for i := off; i < mem.PGSIZE; i++ {
+			bpg[i] = 0
+		}
+	}
+	mf.size = n
+	t := now()
+	mf.mtime = t
+	mf.ctime = t
+}
+
+// copies the bytes at off up to the end of its page or of the object to dst,
+// returning how many were copied
+func (mf *memfile_t) readat(dst []uint8, off int) int {
+	mf.Lock()
+	defer mf.Unlock()
+	if off >= mf.size {
+		return 0
+	}
+	n := mem.PGSIZE - off%mem.PGSIZE
+	if off+n > mf.size {
+		n = mf.size - off
+	}
+	if n > len(dst) {
+		n = len(dst)
+	}
+	p_pg, _ := mf._page(off/mem.PGSIZE, false)
+	if p_pg == 0 {
+		for i := range dst[:n] {
+			dst[i] = 0
+		}
+	} else {
+		bpg := mem.Pg2bytes(mem.Physmem.Dmap(p_pg))
+		copy(dst, bpg[off%mem.PGSIZE:][:n])
+	}
+	mf.atime = now()
+	return n
+}
+
+// copies src, which must not cross a page boundary at off, to the object
+func (mf *memfile_t) writeat(src []uint8, off int) defs.Err_t {
+	mf.Lock()
+	defer mf.Unlock()
+	p_pg, err := mf._page(off/mem.PGSIZE, true)
+	if err != 0 {
+		return err
+	}
+	bpg := mem.Pg2bytes(mem.Physmem.Dmap(p_pg))
+	copy(bpg[off%mem.PGSIZE:], src)
+	if off+len(src) > mf.size {
+		mf.size = off + len(src)
+	}
+	t := now()
+	mf.mtime = t
+	mf.ctime = t
+	return 0
+}
+
+// returns the pages of the object in [offset, offset+len), like the Mmapi of
+// fs's files. the holes are filled and each page gets a reference for the
+// mapping.
+func (mf *memfile_t) mmapi(offset, len int) ([]mem.Mmapinfo_t, defs.Err_t) {
+	mf.Lock()
+	defer mf.Unlock()
+	if offset < 0 || (len != -1 && len < 0) {
+		panic("bad off/len")
+	}
+	if offset >= mf.size {
+		return nil, -defs.EINVAL
+	}
+	if len == -1 || offset+len > mf.size {
+		len = mf.size - offset
+	}
+	o := util.Rounddown(offset, mem.PGSIZE)
+	len = util.Roundup(offset+len, mem.PGSIZE) - o
+	ret := make([]mem.Mmapinfo_t, len/mem.PGSIZE)
+	for i := range ret {
+		p_pg, err := mf._page(o/mem.PGSIZE+i, true)
+		if err != 0 {
+			for _, mi := range ret[:i] {
+				mem.Physmem.Refdown(mi.Phys)
+			}
+			return nil, err
+		}
+		mem.Physmem.Refup(p_pg)
+		ret[i].Pg = mem.Physmem.Dmap(p_pg)
+		ret[i].Phys = p_pg
+	}
+	return ret, 0
+}
+
+func (mf *memfile_t) open() {
+	mf.Lock()
+	mf.nopen++
+	mf.Unlock()
+}
+
+func (mf *memfile_t) close() {
+	mf.Lock()
+	mf.nopen--
+	mf._release()
+	mf.Unlock()
+}
+
+// frees the pages of the object once nothing names or opens it
+func (mf *memfile_t) _release() {
+	if mf.nlink == 0 && mf.nopen == 0 {
+		mf._truncate(0)
+	}
+}
@@ -0,0 +1,434 @@
+package tmpfs
+
+import "sort"
+import "sync"
+import "sync/atomic"
+
+import "bpath"
+import "cred"
+import "defs"
+import "fd"
+import "fdops"
+import "fs"
+import "mem"
+import "stat"
+import "ustr"
+
+// the longest name of a file
+const namemax = 255
+
+// a file system that keeps its files in memory, like the POSIX shared memory
+// objects of shm_open(3) in /dev/shm. it is flat: the root directory holds
+// only files, which are memory objects. its root has the sticky bit set, so
+// anyone may create files but only remove their own.
+type Tmpfs_t struct {
+	sync.Mutex
+	dev   uint
+	root  *memfile_t
+	files map[string]*memfile_t
+	// the number of open files
+	nopen int64
+	// the number of pages that the files hold and its limit, past which
+	// writes fail with ENOSPC
+	npages   int64
+	maxpages int64
+}
+
+// like Linux, a tmpfs may hold up to half of the memory
+func MkTmpfs() *Tmpfs_t {
+	dev := fs.Newdev()
+	root := mkmemfile(dev, cred.Root, defs.S_ISVTX|0777)
+	root.dir = true
+	return &Tmpfs_t{dev: dev, root: root, files: make(map[string]*memfile_t),
+		maxpages: int64(len(mem.Physmem.Pgs) / 2)}
+}
+
+// reserves a page of the size of tfs, returning false if it is full
+func (tfs *Tmpfs_t) charge() bool {
+	if atomic.AddInt64(&tfs.npages, 1) > tfs.maxpages {
+		atomic.AddInt64(&tfs.npages, -1)
+		return false
+	}
+	return true
+}
+
+// returns the name of the file at path, or "" for the root directory. paths
+// are resolved lexically, like the mount points of vfs.
+func (tfs *Tmpfs_t) lookup(path ustr.Ustr, cwd *fd.Cwd_t) (string, defs.Err_t) {
+	full := make(ustr.Ustr, 0, len(cwd.Path)+1+len(path))
+	if !path.IsAbsolute() {
+		full = append(full, cwd.Path...)
+		full = append(full, '/')
+	}
+	full = append(full, path...)
+
+	var pp bpath.Pathparts_t
+	pp.Pp_init(bpath.Canonicalize(full))
+	name, ok := pp.Next()
+	if !ok {
+		return "", 0
+	}
+	if len(name) > namemax {
+		return "", -defs.ENAMETOOLONG
+	}
+	if _, ok := pp.Next(); ok {
+		if tfs.file(name.String()) != nil {
+			return "", -defs.ENOTDIR
+		}
+		return "", -defs.ENOENT
+	}
+	return name.String(), 0
+}
+
+func (tfs *Tmpfs_t) file(name string) *memfile_t {
+	tfs.Lock()
+	defer tfs.Unlock()
+	return tfs.files[name]
+}
+
+// returns the memory object of path, which may be the root directory
+func (tfs *Tmpfs_t) namei(path ustr.Ustr, cwd *fd.Cwd_t) (*memfile_t, defs.Err_t) {
+	name, err := tfs.lookup(path, cwd)
+	if err != 0 {
+		return nil, err
+	}
+	if name == "" {
+		return tfs.root, 0
+	}
+	if mf := tfs.file(name); mf != nil {
+		return mf, 0
+	}
+	return nil, -defs.ENOENT
+}
+
+// returns the names of the entries of the root directory, including "." and
+// "..", and their inode numbers
+func (tfs *Tmpfs_t) entries() ([]string, []uint) {
+	tfs.Lock()
+	defer tfs.Unlock()
+	names := make([]string, 0, len(tfs.files))
+	for name := range tfs.files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	names = append([]string{".", ".."}, names...)
+	inos := make([]uint, len(names))
+	for i, name := range names {
+		if i < 2 {
+			inos[i] = tfs.root.ino
+		} else {
+			inos[i] = tfs.files[name].ino
+		}
+	}
+	return names, inos
+}
+
+func (tfs *Tmpfs_t) mkfd(mf *memfile_t, flags defs.Fdopt_t) *fd.Fd_t {
+	atomic.AddInt64(&tfs.nopen, 1)
+	return &fd.Fd_t{Fops: &tfops_t{tfs: tfs, mf: mf, count: 1,
+		append:   flags&defs.O_APPEND != 0,
+		writable: flags&(defs.O_WRONLY|defs.O_RDWR) != 0}}
+}
+
+// returns true if cr may remove the file mf from the root directory, whose
+// lock must be held
+func (tfs *Tmpfs_t) _mayremove(cr *cred.Cred_t, mf *memfile_t) bool {
+	if !tfs.root.permits(cr, cred.MAY_WRITE|cred.MAY_EXEC) {
+		return false
+	}
+	return cr.Isroot() || cr.Euid == mf.uid || cr.Euid == tfs.root.uid
+}
+
+// removes the directory entry name, whose file is mf. the caller must hold
+// the lock.
+func (tfs *Tmpfs_t) _unlink(name string, mf *memfile_t) {
+	delete(tfs.files, name)
+	mf.Lock()
+	mf.nlink--
+	mf.ctime = now()
+	mf._release()
+	mf.Unlock()
+}
+
+func (tfs *Tmpfs_t) _dirmod() {
+	t := now()
+	tfs.root.Lock()
+	tfs.root.mtime = t
+	tfs.root.ctime = t
+	tfs.root.Unlock()
+}
+
+func (tfs *Tmpfs_t) Fs_open(path ustr.Ustr, flags defs.Fdopt_t, mode int, cwd *fd.Cwd_t, cr *cred.Cred_t, major, minor int) (*fd.Fd_t, defs.Err_t) {
+	name, err := tfs.lookup(path, cwd)
+	if err != 0 {
+		return nil, err
+	}
+	wantwrite := flags&(defs.O_WRONLY|defs.O_RDWR|defs.O_TRUNC) != 0
+	if name == "" {
+		if wantwrite || flags&defs.O_CREAT != 0 {
+			return nil, -defs.EISDIR
+		}
+		want := cred.MAY_READ
+		if flags&defs.O_EXEC != 0 {
+			want = cred.MAY_EXEC
+		}
+		if !tfs.root.permits(cr, want) {
+			return nil, -defs.EACCES
+		}
+		return tfs.mkfd(tfs.root, flags), 0
+	}
+	if flags&defs.O_DIRECTORY != 0 {
+		if tfs.file(name) == nil {
+			return nil, -defs.ENOENT
+		}
+		return nil, -defs.ENOTDIR
+	}
+	if !tfs.root.permits(cr, cred.MAY_EXEC) {
+		return nil, -defs.EACCES
+	}
+
+	tfs.Lock()
+	defer tfs.Unlock()
+	mf, ok := tfs.files[name]
+	created := false
+	switch {
+	case !ok && flags&defs.O_CREAT == 0:
+		return nil, -defs.ENOENT
+	case !ok:
+		// device files are not supported
+		if major != 0 || minor != 0 {
+			return nil, -defs.EPERM
+		}
+		if !tfs.root.permits(cr, cred.MAY_WRITE|cred.MAY_EXEC) {
+			return nil, -defs.EACCES
+		}
+		mf = mkmemfile(tfs.dev, cr, uint(mode)&^cwd.Umask())
+		mf.tfs = tfs
+		mf.nlink = 1
+		tfs.files[name] = mf
+		tfs._dirmod()
+		created = true
+	case flags&defs.O_EXCL != 0 && flags&defs.O_CREAT != 0:
+		return nil, -defs.EEXIST
+	}
+
+	mf.Lock()
+	defer mf.Unlock()
+	// the creator of a file may open it regardless of its mode
+	if !created {
+		var want uint
+		if flags&defs.O_EXEC != 0 {
+			want |= cred.MAY_EXEC
+		} else if flags&defs.O_WRONLY == 0 {
+			want |= cred.MAY_READ
+		}
+		if wantwrite {
+			want |= cred.MAY_WRITE
+		}
+		if !mf._permits(cr, want) {
+			return nil, -defs.EACCES
+		}
+	}
+	if flags&defs.O_TRUNC != 0 {
+		mf._truncate(0)
+	}
+	mf.nopen++
+	return tfs.mkfd(mf, flags), 0
+}
+
+// the root directory holds only files
+func (tfs *Tmpfs_t) Fs_mknod(ustr.Ustr, defs.Fdopt_t, int, *fd.Cwd_t, *cred.Cred_t, int, int) (defs.Inum_t, defs.Err_t) {
+	return 0, -defs.EPERM
+}
+
+func (tfs *Tmpfs_t) Fs_mkdir(ustr.Ustr, int, *fd.Cwd_t, *cred.Cred_t) defs.Err_t {
+	return -defs.EPERM
+}
+
+func (tfs *Tmpfs_t) Fs_unlink(path ustr.Ustr, cwd *fd.Cwd_t, cr *cred.Cred_t, wantdir bool) defs.Err_t {
+	name, err := tfs.lookup(path, cwd)
+	if err != 0 {
+		return err
+	}
+	if name == "" {
+		return -defs.EBUSY
+	}
+	tfs.Lock()
+	defer tfs.Unlock()
+	mf, ok := tfs.files[name]
+	switch {
+	case !ok:
+		return -defs.ENOENT
+	case wantdir:
+		return -defs.ENOTDIR
+	case !tfs._mayremove(cr, mf):
+		return -defs.EACCES
+	}
+	tfs._unlink(name, mf)
+	tfs._dirmod()
+	return 0
+}
+
+func (tfs *Tmpfs_t) Fs_rename(oldp, newp ustr.Ustr, cwd *fd.Cwd_t, cr *cred.Cred_t) defs.Err_t {
+	oname, err := tfs.lookup(oldp, cwd)
+	if err != 0 {
+		return err
+	}
+	nname, err := tfs.lookup(newp, cwd)
+	if err != 0 {
+		return err
+	}
+	if oname == "" || nname == "" {
+		return -defs.EBUSY
+	}
+	tfs.Lock()
+	defer tfs.Unlock()
+	mf, ok := tfs.files[oname]
+	if !ok {
+		return -defs.ENOENT
+	}
+	if !tfs._mayremove(cr, mf) {
+		return -defs.EACCES
+	}
+	old, ok := tfs.files[nname]
+	if ok && old == mf {
+		return 0
+	}
+	if ok {
+		if !tfs._mayremove(cr, old) {
+			return -defs.EACCES
+		}
+		tfs._unlink(nname, old)
+	}
+	delete(tfs.files, oname)
+	tfs.files[nname] = mf
+	tfs._dirmod()
+	return 0
+}
+
+func (tfs *Tmpfs_t) Fs_link(old, new ustr.Ustr, cwd *fd.Cwd_t, cr *cred.Cred_t) defs.Err_t {
+	oname, err := tfs.lookup(old, cwd)
+	if err != 0 {
+		return err
+	}
+	nname, err := tfs.lookup(new, cwd)
+	if err != 0 {
+		return err
+	}
+	if oname == "" {
+		return -defs.EPERM
+	}
+	if nname == "" {
+		return -defs.EEXIST
+	}
+	if !tfs.root.permits(cr, cred.MAY_WRITE|cred.MAY_EXEC) {
+		return -defs.EACCES
+	}
+	tfs.Lock()
+	defer tfs.Unlock()
+	mf, ok := tfs.files[oname]
+	if !ok {
+		return -defs.ENOENT
+	}
+	if _, ok := tfs.files[nname]; ok {
+		return -defs.EEXIST
+	}
+	tfs.files[nname] = mf
+	mf.Lock()
+	mf.nlink++
+	mf.ctime = now()
+	mf.Unlock()
+	tfs._dirmod()
+	return 0
+}
+
+func (tfs *Tmpfs_t) Fs_symlink(ustr.Ustr, ustr.Ustr, *fd.Cwd_t, *cred.Cred_t) defs.Err_t {
+	return -defs.EPERM
+}
+
+// there are no symlinks
+func (tfs *Tmpfs_t) Fs_readlink(path ustr.Ustr, dst fdops.Userio_i, cwd *fd.Cwd_t, cr *cred.Cred_t) (int, defs.Err_t) {
+	if _, err := tfs.namei(path, cwd); err != 0 {
+		return 0, err
+	}
+	return 0, -defs.EINVAL
+}
+
+func (tfs *Tmpfs_t) Fs_stat(path ustr.Ustr, st *stat.Stat_t, cwd *fd.Cwd_t, cr *cred.Cred_t) defs.Err_t {
+	return tfs.Fs_lstat(path, st, cwd, cr)
+}
+
+func (tfs *Tmpfs_t) Fs_lstat(path ustr.Ustr, st *stat.Stat_t, cwd *fd.Cwd_t, cr *cred.Cred_t) defs.Err_t {
+	mf, err := tfs.namei(path, cwd)
+	if err != 0 {
+		return err
+	}
+	mf.stat(st)
+	return 0
+}
+
+// there are no symlinks
+func (tfs *Tmpfs_t) Fs_walk(path ustr.Ustr, cwd *fd.Cwd_t, cr *cred.Cred_t) (int, ustr.Ustr, defs.Err_t) {
+	if _, err := tfs.namei(path, cwd); err != 0 {
+		return 0, nil, err
+	}
+	return len(path), nil, 0
+}
+
+func (tfs *Tmpfs_t) Fs_chmod(path ustr.Ustr, mode uint, cwd *fd.Cwd_t, cr *cred.Cred_t) defs.Err_t {
+	mf, err := tfs.namei(path, cwd)
+	if err != 0 {
+		return err
+	}
+	return mf.chmod(cr, mode)
+}
+
+func (tfs *Tmpfs_t) Fs_chown(path ustr.Ustr, uid, gid int, cwd *fd.Cwd_t, cr *cred.Cred_t) defs.Err_t {
+	mf, err := tfs.namei(path, cwd)
+	if err != 0 {
+		return err
+	}
+	return mf.chown(cr, uid, gid)
+}
+
+func (tfs *Tmpfs_t) Fs_utimes(path ustr.Ustr, atime, mtime int, cwd *fd.Cwd_t, cr *cred.Cred_t) defs.Err_t {
+	mf, err := tfs.namei(path, cwd)
+	if err != 0 {
+		return err
+	}
+	return mf.utimens(cr, atime, mtime)
+}
+
+func (tfs *Tmpfs_t) Fs_access(path ustr.Ustr, want uint, cwd *fd.Cwd_t, cr *cred.Cred_t) defs.Err_t {
+	mf, err := tfs.namei(path, cwd)
+	if err != 0 {
+		return err
+	}
+	if !mf.permits(cr, want) {
+		return -defs.EACCES
+	}
+	return 0
+}
+
+// there is nothing to write back
+func (tfs *Tmpfs_t) Fs_sync() defs.Err_t {
+	return 0
+}
+
+func (tfs *Tmpfs_t) Fs_busy() bool {
+	return atomic.LoadInt64(&tfs.nopen) != 0
+}
+
+func (tfs *Tmpfs_t) MkRootCwd() *fd.Cwd_t {
+	f := &fd.Fd_t{Fops: &tfops_t{tfs: tfs, mf: tfs.root}}
+	return fd.MkRootCwd(f)
+}
+
+// frees the files, none of which are open once the file system is unmounted
+func (tfs *Tmpfs_t) StopFS() {
+	tfs.Lock()
+	defer tfs.Unlock()
+	for name, mf := range tfs.files {
+		tfs._unlink(name, mf)
+	}
+}
@@ -0,0 +1,470 @@
+package tty
+
+import "sync"
+
+import "cred"
+import "defs"
+import "fdops"
+import "mem"
+import "proc"
+import "stat"
+import "util"
+
+// the number of pseudo-terminals. pseudo-terminal n's slave is the device
+// with major D_PTS and minor n, which init makes as /dev/pts/n.
+const Npty = 16
+
+// a pseudo-terminal: a terminal whose device is a process holding the
+// master. what the master writes is input to the terminal; the terminal's
+// output is what the master reads. the counts of open fds are protected by
+// the terminal's lock.
+type pty_t struct {
+	tty     *Tty_t
+	n       int
+	masters int
+	slaves  int
+	// true once every fd of the slave was closed; the master then reads
+	// EIO after the remaining output
+	sclosed bool
+	// the effective uid of the process that opened the master; only it
+	// and root may open the slave
+	uid int
+}
+
+var _ptys struct {
+	sync.Mutex
+	ptys [Npty]*pty_t
+}
+
+// makes a new pseudo-terminal for the user cr and returns its master and
+// its number
+func Openmaster(cr *cred.Cred_t) (fdops.Fdops_i, int, defs.Err_t) {
+	_ptys.Lock()
+	defer _ptys.Unlock()
+	for i, pt := range _ptys.ptys {
+		if pt != nil {
+			continue
+		}
+		pt = &pty_t{n: i, masters: 1, uid: cr.Euid}
+		pt.tty = MkTty(Deftermios(), nil, 0)
+		_ptys.ptys[i] = pt
+		return &Ptmfops_t{pty: pt}, i, 0
+	}
+	return nil, 0, -defs.ENOSPC
+}
+
+// returns the slave of pseudo-terminal n, which fails with EIO if n has no
+// master and with EACCES if cr is neither root nor the master's owner
+func Openslave(n int, cr *cred.Cred_t) (fdops.Fdops_i, defs.Err_t) {
+	_ptys.Lock()
+	defer _ptys.Unlock()
+	if n < 0 || n >= Npty {
+		return nil, -defs.ENXIO
+	}
+	pt := _ptys.ptys[n]
+	if pt == nil {
+		return nil, -defs.EIO
+	}
+	t := pt.tty
+	t.Lock()
+	defer t.Unlock()
+	if pt.masters == 0 {
+		return nil, -defs.EIO
+	}
+	if !cr.Isroot() && cr.Euid != pt.uid {
+		return nil, -defs.EACCES
+	}
+	pt.slaves++
+	pt.sclosed = false
+	return &Ptsfops_t{pty: pt}, 0
+}
+
+// changes the counts of open fds of the master and the slave. the master's
+// last close hangs up the terminal, and the pseudo-terminal is freed once
+// neither is open.
+func (pt *pty_t) reopen(m, s int) defs.Err_t {
+	t := pt.tty
+	t.Lock()
+	if pt.masters+m < 0 || pt.slaves+s < 0 {
+		t.Unlock()
+		return -defs.EBADF
+	}
+	pt.masters += m
+	pt.slaves += s
+	if s < 0 && pt.slaves == 0 {
+		pt.sclosed = true
+		t.cond.Broadcast()
+		t.mpollers.Wakeready(fdops.R_READ | fdops.R_HUP)
+	}
+	hangup := m < 0 && pt.masters == 0
+	free := pt.masters == 0 && pt.slaves == 0
+	t.Unlock()
+
+	if hangup {
+		t.hangup()
+	}
+	if free {
+		_ptys.Lock()
+		if _ptys.ptys[pt.n] == pt {
+			_ptys.ptys[pt.n] = nil
+		}
+		_ptys.Unlock()
+	}
+	return 0
+}
+
+// the master of a pseudo-terminal
+type Ptmfops_t struct {
+	pty     *pty_t
+	options defs.Fdopt_t
+}
+
+// returns the output of the terminal. once the slave is closed, a read of no
+// remaining output fails with EIO, like Linux's.
+func (mf *Ptmfops_t) Read(dst fdops.Userio_i) (int, defs.Err_t) {
+	pt := mf.pty
+	t := pt.tty
+	t.Lock()
+	defer t.Unlock()
+	for len(t.outq) == 0 {
+		if pt.sclosed {
+			return 0, -defs.EIO
+		}
+		if mf.options&defs.O_NONBLOCK != 0 {
+			return 0, -defs.EWOULDBLOCK
+		}
+		if err := proc.KillableWait(t.cond); err != 0 {
+			return 0, err
+		}
+	}
+	did, err := dst.Uiowrite(t.outq)
+	t.outq = append(t.outq[:0], t.outq[did:]...)
+	t.cond.Broadcast()
+	t.pollers.Wakeready(fdops.R_WRITE)
+	return did, err
+}
+
+// types src at the terminal. a write waits while the terminal's input queue
+// is full.
+func (mf *Ptmfops_t) Write(src fdops.Userio_i) (int, defs.Err_t) {
+	t := mf.pty.tty
+	buf := make([]uint8, chunk)
+	did := 0
+	for src.Remain() != 0 {
+		t.Lock()
+		for t._room() == 0 {
+			if mf.options&defs.O_NONBLOCK != 0 {
+				t.Unlock()
+				if did != 0 {
+					return did, 0
+				}
+				return 0, -defs.EWOULDBLOCK
+			}
+			if err := proc.KillableWait(t.cond); err != 0 {
+				t.Unlock()
+				return did, err
+			}
+		}
+		n := util.Min(t._room(), len(buf))
+		n, err := src.Uioread(buf[:n])
+		sigs := t._input(buf[:n])
+		pgrp := t.pgrp
+		t.Unlock()
+		sendsigs(pgrp, sigs)
+		did += n
+		if err != 0 {
+			return did, err
+		}
+	}
+	return did, 0
+}
+
+func (mf *Ptmfops_t) Pollone(pm fdops.Pollmsg_t) (fdops.Ready_t, defs.Err_t) {
+	pt := mf.pty
+	t := pt.tty
+	t.Lock()
+	defer t.Unlock()
+	var r fdops.Ready_t
+	if pm.Events&fdops.R_READ != 0 && (len(t.outq) != 0 || pt.sclosed) {
+		r |= fdops.R_READ
+	}
+	if pm.Events&fdops.R_HUP != 0 && pt.sclosed {
+		r |= fdops.R_HUP
+	}
+	if pm.Events&fdops.R_WRITE != 0 && t._room() != 0 {
+		r |= fdops.R_WRITE
+	}
+	if r != 0 || !pm.Dowait {
+		return r, 0
+	}
+	return 0, t.mpollers.Addpoller(&pm)
+}
+
+// handles TIOCGPTN, which returns the number of the pseudo-terminal, and
+// TIOCSPTLCK, which is accepted but does nothing since a slave is never
+// locked. FIONREAD counts the terminal's output. the other requests are the
+// terminal's.
+func (mf *Ptmfops_t) Ioctl(req int, arg fdops.Userio_i) defs.Err_t {
+	switch req {
+	case defs.FIONREAD:
+		t := mf.pty.tty
+		t.Lock()
+		n := len(t.outq)
+		t.Unlock()
+		return fdops.Intout(arg, n)
+	case defs.FIONBIO:
+		return fdops.Fionbio(mf, arg)
+	case defs.TIOCGPTN:
+		b := make([]uint8, 4)
+		util.Writen(b, 4, 0, mf.pty.n)
+		return fdops.Argout(arg, b)
+	case defs.TIOCSPTLCK:
+		_, err := fdops.Argin(arg, 4)
+		return err
+	default:
+		return mf.pty.tty.Ioctl(req, arg)
+	}
+}
+
+func (mf *Ptmfops_t) Close() defs.Err_t {
+	return mf.pty.reopen(-1, 0)
+}
+
+func (mf *Ptmfops_t) Reopen() defs.Err_t {
+	return mf.pty.reopen(1, 0)
+}
+
+func (mf *Ptmfops_t) Fstat(st *stat.Stat_t) defs.Err_t {
+	st.Wmode(defs.Mkdev(defs.D_PTMX, 0))
+	return 0
+}
+
+func (mf *Ptmfops_t) Fcntl(cmd, opt int) int {
+	switch cmd {
+	case defs.F_GETFL:
+		return int(mf.options)
+	case defs.F_SETFL:
+		mf.options = defs.Fdopt_t(opt)
+		return 0
+	default:
+		panic("weird cmd")
+	}
+}
+
+func (mf *Ptmfops_t) Lseek(int, int) (int, defs.Err_t) {
+	return 0, -defs.ESPIPE
+}
+
+func (mf *Ptmfops_t) Mmapi(int, int, bool) ([]mem.Mmapinfo_t, defs.Err_t) {
+	return nil, -defs.ENODEV
+}
+
+func (mf *Ptmfops_t) Pathi() defs.Inum_t {
+	panic("pty cwd")
+}
+
+func (mf *Ptmfops_t) Truncate(uint) defs.Err_t {
+	return -defs.EINVAL
+}
+
+func (mf *Ptmfops_t) Utimens(*cred.Cred_t, int, int) defs.Err_t {
+	return -defs.EINVAL
+}
+
+func (mf *Ptmfops_t) Fchmod(*cred.Cred_t, uint) defs.Err_t {
+	return -defs.EINVAL
+}
+
+func (mf *Ptmfops_t) Fchown(*cred.Cred_t, int, int) defs.Err_t {
+	return -defs.EINVAL
+}
+
+func (mf *Ptmfops_t) Getdents(fdops.Userio_i) (int, defs.Err_t) {
+	return 0, -defs.ENOTDIR
+}
+
+func (mf *Ptmfops_t) Fsync(bool) defs.Err_t {
+	return -defs.EINVAL
+}
+
+func (mf *Ptmfops_t) Pread(fdops.Userio_i, int) (int, defs.Err_t) {
+	return 0, -defs.ESPIPE
+}
+
+func (mf *Ptmfops_t) Pwrite(fdops.Userio_i, int) (int, defs.Err_t) {
+	return 0, -defs.ESPIPE
+}
+
+func (mf *Ptmfops_t) Accept(fdops.Userio_i) (fdops.Fdops_i, int, defs.Err_t) {
+	return nil, 0, -defs.ENOTSOCK
+}
+
+func (mf *Ptmfops_t) Bind([]uint8) defs.Err_t {
+	return -defs.ENOTSOCK
+}
+
+func (mf *Ptmfops_t) Connect([]uint8) defs.Err_t {
+	return -defs.ENOTSOCK
+}
+
+func (mf *Ptmfops_t) Listen(int) (fdops.Fdops_i, defs.Err_t) {
+	return nil, -defs.ENOTSOCK
+}
+
+func (mf *Ptmfops_t) Sendmsg(fdops.Userio_i, []uint8, []uint8,
+	int) (int, defs.Err_t) {
+	return 0, -defs.ENOTSOCK
+}
+
+func (mf *Ptmfops_t) Recvmsg(fdops.Userio_i, fdops.Userio_i,
+	fdops.Userio_i, int) (int, int, int, defs.Msgfl_t, defs.Err_t) {
+	return 0, 0, 0, 0, -defs.ENOTSOCK
+}
+
+func (mf *Ptmfops_t) Getsockopt(int, int, fdops.Userio_i,
+	int) (int, defs.Err_t) {
+	return 0, -defs.ENOTSOCK
+}
+
+func (mf *Ptmfops_t) Setsockopt(int, int, fdops.Userio_i, int) defs.Err_t {
+	return -defs.ENOTSOCK
+}
+
+func (mf *Ptmfops_t) Shutdown(read, write bool) defs.Err_t {
+	return -defs.ENOTSOCK
+}
+
+// the slave of a pseudo-terminal
+type Ptsfops_t struct {
+	pty     *pty_t
+	options defs.Fdopt_t
+}
+
+func (sf *Ptsfops_t) Read(dst fdops.Userio_i) (int, defs.Err_t) {
+	noblk := sf.options&defs.O_NONBLOCK != 0
+	return sf.pty.tty.Read(dst, noblk)
+}
+
+func (sf *Ptsfops_t) Write(src fdops.Userio_i) (int, defs.Err_t) {
+	noblk := sf.options&defs.O_NONBLOCK != 0
+	return sf.pty.tty.Write(src, noblk)
+}
+
+func (sf *Ptsfops_t) Pollone(pm fdops.Pollmsg_t) (fdops.Ready_t, defs.Err_t) {
+	return sf.pty.tty.Poll(pm)
+}
+
+func (sf *Ptsfops_t) Ioctl(req int, arg fdops.Userio_i) defs.Err_t {
+	if req == defs.FIONBIO {
+		return fdops.Fionbio(sf, arg)
+	}
+	return sf.pty.tty.Ioctl(req, arg)
+}
+
+func (sf *Ptsfops_t) Close() defs.Err_t {
+	return sf.pty.reopen(0, -1)
+}
+
+func (sf *Ptsfops_t) Reopen() defs.Err_t {
+	return sf.pty.reopen(0, 1)
+}
+
+func (sf *Ptsfops_t) Fstat(st *stat.Stat_t) defs.Err_t {
+	st.Wmode(defs.Mkdev(defs.D_PTS, sf.pty.n))
+	return 0
+}
+
+func (sf *Ptsfops_t) Fcntl(cmd, opt int) int {
+	switch cmd {
+	case defs.F_GETFL:
+		return int(sf.options)
+	case defs.F_SETFL:
+		sf.options = defs.Fdopt_t(opt)
+		return 0
+	default:
+		panic("weird cmd")
+	}
+}
+
+func (sf *Ptsfops_t) Lseek(int, int) (int, defs.Err_t) {
+	return 0, -defs.ESPIPE
+}
+
+func (sf *Ptsfops_t) Mmapi(int, int, bool) ([]mem.Mmapinfo_t, defs.Err_t) {
+	return nil, -defs.ENODEV
+}
+
+func (sf *Ptsfops_t) Pathi() defs.Inum_t {
+	panic("pty cwd")
+}
+
+func (sf *Ptsfops_t) Truncate(uint) defs.Err_t {
+	return -defs.EINVAL
+}
+
+func (sf *Ptsfops_t) Utimens(*cred.Cred_t, int, int) defs.Err_t {
+	return -defs.EINVAL
+}
+
+func (sf *Ptsfops_t) Fchmod(*cred.Cred_t, uint) defs.Err_t {
+	return -defs.EINVAL
+}
+
+func (sf *Ptsfops_t) Fchown(*cred.Cred_t, int, int) defs.Err_t {
+	return -defs.EINVAL
+}
+
+func (sf *Ptsfops_t) Getdents(fdops.Userio_i) (int, defs.Err_t) {
+	return 0, -defs.ENOTDIR
+}
+
+func (sf *Ptsfops_t) Fsync(bool) defs.Err_t {
+	return -defs.EINVAL
+}
+
+func (sf *Ptsfops_t) Pread(fdops.Userio_i, int) (int, defs.Err_t) {
+	return 0, -defs.ESPIPE
+}
+
+func (sf *Ptsfops_t) Pwrite(fdops.Userio_i, int) (int, defs.Err_t) {
+	return 0, -defs.ESPIPE
+}
+
+func (sf *Ptsfops_t) Accept(fdops.Userio_i) (fdops.Fdops_i, int, defs.Err_t) {
+	return nil, 0, -defs.ENOTSOCK
+}
+
+func (sf *Ptsfops_t) Bind([]uint8) defs.Err_t {
+	return -defs.ENOTSOCK
+}
+
+func (sf *Ptsfops_t) Connect([]uint8) defs.Err_t {
+	return -defs.ENOTSOCK
+}
+
+func (sf *Ptsfops_t) Listen(int) (fdops.Fdops_i, defs.Err_t) {
+	return nil, -defs.ENOTSOCK
+}
+
+func (sf *Ptsfops_t) Sendmsg(fdops.Userio_i, []uint8, []uint8,
+	int) (int, defs.Err_t) {
+	return 0, -defs.ENOTSOCK
+}
+
+func (sf *Ptsfops_t) Recvmsg(fdops.Userio_i, fdops.Userio_i,
+	fdops.Userio_i, int) (int, int, int, defs.Msgfl_t, defs.Err_t) {
+	return 0, 0, 0, 0, -defs.ENOTSOCK
+}
+
+func (sf *Ptsfops_t) Getsockopt(int, int, fdops.Userio_i,
+	int) (int, defs.Err_t) {
+	return 0, -defs.ENOTSOCK
+}
+
+func (sf *Ptsfops_t) Setsockopt(int, int, fdops.Userio_i, int) defs.Err_t {
+	return -defs.ENOTSOCK
+}
+
+func (sf *Ptsfops_t) Shutdown(read, write bool) defs.Err_t {
+	return -defs.ENOTSOCK
+}
@@ -0,0 +1,598 @@
+package tty
+
+import "sync"
+
+import "defs"
+import "fdops"
+import "proc"
+import "util"
+
+// the most input a terminal holds for its readers and the most output a
+// pseudo-terminal holds for its master
+const qmax = 4096
+
+// the number of bytes of user memory a read or write copies at a time
+const chunk = 512
+
+// Linux's struct termios, as TCGETS and TCSETS copy it
+type Termios_t struct {
+	Iflag uint32
+	Oflag uint32
+	Cflag uint32
+	Lflag uint32
+	Line  uint8
+	Cc    [defs.NCCS]uint8
+}
+
+// the size of struct termios
+const Termiossz = 4*4 + 1 + defs.NCCS
+
+// returns the settings of a new terminal: canonical mode with echo and the
+// signal characters, like Linux's
+func Deftermios() Termios_t {
+	t := Termios_t{
+		Iflag: defs.ICRNL,
+		Oflag: defs.OPOST | defs.ONLCR,
+		Cflag: defs.B38400 | defs.CS8 | defs.CREAD,
+		Lflag: defs.ISIG | defs.ICANON | defs.ECHO | defs.ECHOE |
+			defs.ECHOK | defs.ECHOCTL | defs.IEXTEN,
+	}
+	t.Cc[defs.VINTR] = 0x03
+	t.Cc[defs.VQUIT] = 0x1c
+	t.Cc[defs.VERASE] = 0x7f
+	t.Cc[defs.VKILL] = 0x15
+	t.Cc[defs.VEOF] = 0x04
+	t.Cc[defs.VMIN] = 1
+	t.Cc[defs.VSUSP] = 0x1a
+	return t
+}
+
+func (tios *Termios_t) bytes() []uint8 {
+	ret := make([]uint8, Termiossz)
+	util.Writen(ret, 4, 0, int(tios.Iflag))
+	util.Writen(ret, 4, 4, int(tios.Oflag))
+	util.Writen(ret, 4, 8, int(tios.Cflag))
+	util.Writen(ret, 4, 12, int(tios.Lflag))
+	ret[16] = tios.Line
+	copy(ret[17:], tios.Cc[:])
+	return ret
+}
+
+func (tios *Termios_t) frombytes(b []uint8) {
+	tios.Iflag = uint32(util.Readn(b, 4, 0))
+	tios.Oflag = uint32(util.Readn(b, 4, 4))
+	tios.Cflag = uint32(util.Readn(b, 4, 8))
+	tios.Lflag = uint32(util.Readn(b, 4, 12))
+	tios.Line = b[16]
+	copy(tios.Cc[:], b[17:])
+}
+
+// a terminal's line discipline. it edits the characters typed at the
+// terminal into lines in canonical mode, echoes them, turns the signal
+// characters into signals for the foreground process group, and translates
+// the output. a terminal is the controlling terminal of at most one session.
+type Tty_t struct {
+	sync.Mutex
+	tios Termios_t
+	rows int
+	cols int
+	// the line being edited in canonical mode
+	edit []uint8
+	// the input that can be read. in canonical mode, ends has the offset
+	// in inq of the end of each complete line; a line ended by VEOF does
+	// not include the VEOF.
+	inq  []uint8
+	ends []int
+	// writes output to the device. it is nil for a pseudo-terminal, whose
+	// output is queued in outq until the master reads it.
+	out  func([]uint8)
+	outq []uint8
+	// true once the device hung up: reads return end-of-file and writes
+	// fail
+	hup bool
+	// broadcast whenever the queues change
+	cond *sync.Cond
+	// the pollers of the terminal, and of the master of a pseudo-terminal
+	pollers  fdops.Pollers_t
+	mpollers fdops.Pollers_t
+	// the session whose controlling terminal this is and the foreground
+	// process group of that session, or zero if there are none
+	sid  int
+	pgrp int
+}
+
+// returns a terminal with the settings tios whose output is written by out.
+// the terminal is the controlling terminal of session sid if sid is not zero.
+func MkTty(tios Termios_t, out func([]uint8), sid int) *Tty_t {
+	t := &Tty_t{tios: tios, out: out, sid: sid, rows: 25, cols: 80}
+	t.cond = sync.NewCond(t)
+	return t
+}
+
+func (t *Tty_t) _canon() bool {
+	return t.tios.Lflag&defs.ICANON != 0
+}
+
+// returns true if c is control character i, which is disabled if it is zero
+func (t *Tty_t) _isc(c uint8, i int) bool {
+	return t.tios.Cc[i] != 0 && c == t.tios.Cc[i]
+}
+
+// returns true if a read of want bytes would not wait
+func (t *Tty_t) _readable(want int) bool {
+	if t.hup {
+		return true
+	}
+	if t._canon() {
+		return len(t.ends) != 0
+	}
+	need := int(t.tios.Cc[defs.VMIN])
+	if need > want {
+		need = want
+	}
+	return len(t.inq) >= need
+}
+
+// writes b to the device, translating it if OPOST is set. output to a
+// pseudo-terminal whose master does not read is discarded once the queue is
+// well over its limit, so that echoes cannot grow it without bound.
+func (t *Tty_t) _output(b []uint8) {
+	if t.tios.Oflag&defs.OPOST != 0 && t.tios.Oflag&defs.ONLCR != 0 {
+		var nb []uint8
+		for i, c := range b {
+			if c == '\n' {
+				if nb == nil {
+					nb = append(make([]uint8, 0, len(b)+8), b[:i]...)
+				}
+				nb = append(nb, '\r')
+			}
+			if nb != nil {
+				nb = append(nb, c)
+			}
+		}
+		if nb != nil {
+			b = nb
+		}
+	}
+	if len(b) == 0 {
+		return
+	}
+	if t.out != nil {
+		t.out(b)
+		return
+	}
+	if len(t.outq) > 2*qmax {
+		return
+	}
+	t.outq = append(t.outq, b...)
+	t.cond.Broadcast()
+	t.mpollers.Wakeready(fdops.R_READ)
+}
+
+// echoes input character c. control characters are echoed as ^X if ECHOCTL
+// is set.
+func (t *Tty_t) _echo(c uint8) {
+	lf := t.tios.Lflag
+	if lf&defs.ECHO == 0 {
+		if c == '\n' && lf&defs.ECHONL != 0 && t._canon() {
+			t._output([]uint8{c})
+		}
+		return
+	}
+	if lf&defs.ECHOCTL != 0 && (c < 0x20 && c != '\n' && c != '\t' ||
+		c == 0x7f) {
+		t._output([]uint8{'^', c ^ 0x40})
+		return
+	}
+	t._output([]uint8{c})
+}
+
+// echoes the erasure of n characters
+func (t *Tty_t) _echoerase(n int) {
+	lf := t.tios.Lflag
+	if lf&defs.ECHO == 0 || lf&defs.ECHOE == 0 {
+		return
+	}
+	for i := 0; i < n; i++ {
+		t._output([]uint8{'\b', ' ', '\b'})
+	}
+}
+
+// makes the line being edited readable
+func (t *Tty_t) _endline() {
+	t.inq = append(t.inq, t.edit...)
+	t.ends = append(t.ends, len(t.inq))
+	t.edit = t.edit[:0]
+}
+
+// discards the unread input
+func (t *Tty_t) _flush() {
+	t.inq = t.inq[:0]
+	t.ends = t.ends[:0]
+	t.edit = t.edit[:0]
+}
+
+// returns the number of bytes of input the terminal can take before its
+// input queue is full
+func (t *Tty_t) _room() int {
+	return qmax - len(t.inq)
+}
+
+// processes the characters of b as typed at the terminal. the input that
+// does not fit in the input queue is discarded. returns the signals for the
+// foreground process group, which the caller sends once it releases the
+// lock.
+func (t *Tty_t) _input(b []uint8) []int {
+	var sigs []int
+	for _, c := range b {
+		if t.tios.Iflag&defs.ISTRIP != 0 {
+			c &= 0x7f
+		}
+		switch {
+		case c == '\r' && t.tios.Iflag&defs.IGNCR != 0:
+			continue
+		case c == '\r' && t.tios.Iflag&defs.ICRNL != 0:
+			c = '\n'
+		case c == '\n' && t.tios.Iflag&defs.INLCR != 0:
+			c = '\r'
+		}
+		if t.tios.Lflag&defs.ISIG != 0 {
+			sig := 0
+			switch {
+			case t._isc(c, defs.VINTR):
+				sig = defs.SIGINT
+			case t._isc(c, defs.VQUIT):
+				sig = defs.SIGQUIT
+			case t._isc(c, defs.VSUSP):
+				sig = defs.SIGTSTP
+			}
+			if sig != 0 {
+				if t.tios.Lflag&defs.NOFLSH == 0 {
+					t._flush()
+				}
+				t._echo(c)
+				sigs = append(sigs, sig)
+				continue
+			}
+		}
+		if !t._canon() {
+			if len(t.inq) < qmax {
+				t.inq = append(t.inq, c)
+				t._echo(c)
+			}
+			continue
+		}
+		switch {
+		case t._isc(c, defs.VERASE):
+			if len(t.edit) != 0 {
+				t.edit = t.edit[:len(t.edit)-1]
+				t._echoerase(1)
+			}
+			continue
+		case t._isc(c, defs.VKILL):
+			if t.tios.Lflag&defs.ECHOE != 0 {
+				t._echoerase(len(t.edit))
+			} else if t.tios.Lflag&defs.ECHOK != 0 {
+				t._echo(c)
+				t._echo('\n')
+			}
+			t.edit = t.edit[:0]
+			continue
+		case t._isc(c, defs.VEOF):
+			t._endline()
+			continue
+		}
+		// the last byte of the queue is kept for a newline so that a
+		// line can always end
+		if len(t.inq)+len(t.edit) >= qmax-1 && c != '\n' {
+			continue
+		}
+		t.edit = append(t.edit, c)
+		t._echo(c)
+		if c == '\n' || t._isc(c, defs.VEOL) {
+			t._endline()
+		}
+	}
+	if t._readable(1) {
+		t.cond.Broadcast()
+		t.pollers.Wakeready(fdops.R_READ)
+	}
+	return sigs
+}
+
+// sends sigs to the foreground process group pgrp
+func sendsigs(pgrp int, sigs []int) {
+	if pgrp == 0 {
+		return
+	}
+	for _, sig := range sigs {
+		proc.Pgsignal(pgrp, &proc.Siginfo_t{Signo: sig,
+			Code: defs.SI_KERNEL})
+	}
+}
+
+// processes the characters typed at the terminal
+func (t *Tty_t) Input(b []uint8) {
+	t.Lock()
+	sigs := t._input(b)
+	pgrp := t.pgrp
+	t.Unlock()
+	sendsigs(pgrp, sigs)
+}
+
+// checks that the calling process may read from the terminal (sig is SIGTTIN)
+// or write to it or change its settings (SIGTTOU). a process in a background
+// process group of the terminal's session may not; its group is sent sig and
+// the operation fails with EINTR, since system calls are not restarted. a
+// write is only checked if TOSTOP is set or if always is true. a process that
+// blocks or ignores sig may write, but it fails to read with EIO, as does a
+// process of an orphaned group, which sig would not stop.
+func (t *Tty_t) jobcheck(sig int, always bool) defs.Err_t {
+	p := proc.CurrentProc()
+	pgid, sid := p.Pgrp()
+	t.Lock()
+	bg := sid == t.sid && t.pgrp != 0 && pgid != t.pgrp
+	tostop := t.tios.Lflag&defs.TOSTOP != 0
+	t.Unlock()
+	if !bg || (sig == defs.SIGTTOU && !tostop && !always) {
+		return 0
+	}
+	if p.Sigblocked(sig) {
+		if sig == defs.SIGTTOU {
+			return 0
+		}
+		return -defs.EIO
+	}
+	if p.Pgorphaned() {
+		return -defs.EIO
+	}
+	proc.Pgsignal(pgid, &proc.Siginfo_t{Signo: sig, Code: defs.SI_KERNEL})
+	return -defs.EINTR
+}
+
+// reads the terminal's input. in canonical mode a read returns at most one
+// line; otherwise it waits for VMIN bytes or for as many as dst holds,
+// whichever is fewer. VTIME is not supported. a read returns end-of-file
+// once the terminal hung up.
+func (t *Tty_t) Read(dst fdops.Userio_i, noblk bool) (int, defs.Err_t) {
+	if err := t.jobcheck(defs.SIGTTIN, false); err != 0 {
+		return 0, err
+	}
+	t.Lock()
+	defer t.Unlock()
+	for !t._readable(dst.Remain()) {
+		if noblk {
+			return 0, -defs.EWOULDBLOCK
+		}
+		if err := proc.KillableWait(t.cond); err != 0 {
+			return 0, err
+		}
+	}
+	n := len(t.inq)
+	if t._canon() {
+		n = 0
+		if len(t.ends) != 0 {
+			n = t.ends[0]
+		}
+	}
+	if n > dst.Remain() {
+		n = dst.Remain()
+	}
+	did, err := dst.Uiowrite(t.inq[:n])
+	t.inq = append(t.inq[:0], t.inq[did:]...)
+	for i := range t.ends {
+		t.ends[i] -= did
+	}
+	// a line is consumed once all of it is read, even if it is empty,
+	// which is how VEOF on an empty line makes a read return 0
+	if len(t.ends) != 0 && t.ends[0] == 0 && err == 0 {
+		t.ends = append(t.ends[:0], t.ends[1:]...)
+	}
+	t.cond.Broadcast()
+	t.mpollers.Wakeready(fdops.R_WRITE)
+	return did, err
+}
+
+// writes src to the terminal. a write to a pseudo-terminal waits while the
+// master has much unread output.
+func (t *Tty_t) Write(src fdops.Userio_i, noblk bool) (int, defs.Err_t) {
+	if err := t.jobcheck(defs.SIGTTOU, false); err != 0 {
+		return 0, err
+	}
+	buf := make([]uint8, chunk)
+	did := 0
+	t.Lock()
+	defer t.Unlock()
+	for src.Remain() != 0 {
+		for !t.hup && t.out == nil && len(t.outq) >= qmax {
+			if noblk {
+				if did != 0 {
+					return did, 0
+				}
+				return 0, -defs.EWOULDBLOCK
+			}
+			if err := proc.KillableWait(t.cond); err != 0 {
+				return did, err
+			}
+		}
+		if t.hup {
+			return did, -defs.EIO
+		}
+		n, err := src.Uioread(buf)
+		t._output(buf[:n])
+		did += n
+		if err != 0 {
+			return did, err
+		}
+	}
+	return did, 0
+}
+
+func (t *Tty_t) Poll(pm fdops.Pollmsg_t) (fdops.Ready_t, defs.Err_t) {
+	t.Lock()
+	defer t.Unlock()
+	var r fdops.Ready_t
+	if pm.Events&fdops.R_READ != 0 && t._readable(1) {
+		r |= fdops.R_READ
+	}
+	if pm.Events&fdops.R_HUP != 0 && t.hup {
+		r |= fdops.R_HUP
+	} else if pm.Events&fdops.R_WRITE != 0 &&
+		(t.out != nil || len(t.outq) < qmax) {
+		r |= fdops.R_WRITE
+	}
+	if r != 0 || !pm.Dowait {
+		return r, 0
+	}
+	return 0, t.pollers.Addpoller(&pm)
+}
+
+// changes the settings to tios, discarding the unread input first if flush is
+// true. the input is kept when canonical mode is turned on or off: the line
+// being edited becomes readable, and the readable input becomes one line.
+func (t *Tty_t) _settermios(tios Termios_t, flush bool) {
+	if flush {
+		t._flush()
+	}
+	wascanon := t._canon()
+	t.tios = tios
+	if wascanon && !t._canon() {
+		t.inq = append(t.inq, t.edit...)
+		t.edit = t.edit[:0]
+		t.ends = t.ends[:0]
+	} else if !wascanon && t._canon() && len(t.inq) != 0 {
+		t.ends = append(t.ends[:0], len(t.inq))
+	}
+	t.cond.Broadcast()
+	if t._readable(1) {
+		t.pollers.Wakeready(fdops.R_READ)
+	}
+}
+
+// handles the terminal requests of ioctl(2) on behalf of the calling process.
+// arg is the request's argument in user memory. TCSETSW does not wait for the
+// output to drain.
+func (t *Tty_t) Ioctl(req int, arg fdops.Userio_i) defs.Err_t {
+	switch req {
+	case defs.TCGETS:
+		t.Lock()
+		b := t.tios.bytes()
+		t.Unlock()
+		return fdops.Argout(arg, b)
+	case defs.FIONREAD:
+		t.Lock()
+		n := len(t.inq)
+		if t._canon() {
+			n = 0
+			if len(t.ends) != 0 {
+				n = t.ends[len(t.ends)-1]
+			}
+		}
+		t.Unlock()
+		return fdops.Intout(arg, n)
+	case defs.TCSETS, defs.TCSETSW, defs.TCSETSF:
+		if err := t.jobcheck(defs.SIGTTOU, true); err != 0 {
+			return err
+		}
+		b, err := fdops.Argin(arg, Termiossz)
+		if err != 0 {
+			return err
+		}
+		var tios Termios_t
+		tios.frombytes(b)
+		t.Lock()
+		t._settermios(tios, req == defs.TCSETSF)
+		t.Unlock()
+		return 0
+	case defs.TIOCGWINSZ:
+		b := make([]uint8, 8)
+		t.Lock()
+		util.Writen(b, 2, 0, t.rows)
+		util.Writen(b, 2, 2, t.cols)
+		t.Unlock()
+		return fdops.Argout(arg, b)
+	case defs.TIOCSWINSZ:
+		b, err := fdops.Argin(arg, 8)
+		if err != 0 {
+			return err
+		}
+		rows, cols := util.Readn(b, 2, 0), util.Readn(b, 2, 2)
+		t.Lock()
+		changed := rows != t.rows || cols != t.cols
+		t.rows, t.cols = rows, cols
+		pgrp := t.pgrp
+		t.Unlock()
+		if changed {
+			sendsigs(pgrp, []int{defs.SIGWINCH})
+		}
+		return 0
+	case defs.TIOCSCTTY, defs.TIOCGPGRP, defs.TIOCSPGRP:
+		return t.jobctl(req, arg)
+	default:
+		return -defs.ENOTTY
+	}
+}
+
+// handles the requests for job control
+func (t *Tty_t) jobctl(req int, arg fdops.Userio_i) defs.Err_t {
+	if req == defs.TIOCSPGRP {
+		if err := t.jobcheck(defs.SIGTTOU, true); err != 0 {
+			return err
+		}
+	}
+	p := proc.CurrentProc()
+	pgid, sid := p.Pgrp()
+	t.Lock()
+	defer t.Unlock()
+	if req == defs.TIOCSCTTY {
+		// only a session leader may acquire a controlling terminal. a
+		// terminal may be taken from a session whose leader exited.
+		if sid != p.Pid {
+			return -defs.EPERM
+		}
+		if t.sid != sid && t.sid != 0 {
+			if _, ok := proc.Proc_check(t.sid); ok {
+				return -defs.EPERM
+			}
+		}
+		t.sid, t.pgrp = sid, pgid
+		return 0
+	}
+	if sid != t.sid {
+		return -defs.ENOTTY
+	}
+	switch req {
+	case defs.TIOCGPGRP:
+		b := make([]uint8, 4)
+		util.Writen(b, 4, 0, t.pgrp)
+		return fdops.Argout(arg, b)
+	default:
+		b, err := fdops.Argin(arg, 4)
+		if err != 0 {
+			return err
+		}
+		pgrp := int(int32(util.Readn(b, 4, 0)))
+		if pgrp <= 0 {
+			return -defs.EINVAL
+		}
+		if s, ok := proc.Pgsession(pgrp); !ok || s != sid {
+			return -defs.EPERM
+		}
+		t.pgrp = pgrp
+		return 0
+	}
+}
+
+// hangs up the terminal: it stops being the controlling terminal of its
+// session, whose foreground process group is sent SIGHUP and SIGCONT, its
+// reads return end-of-file, and its writes fail with EIO.
+func (t *Tty_t) hangup() {
+	t.Lock()
+	t.hup = true
+	pgrp := t.pgrp
+	t.sid, t.pgrp = 0, 0
+	t.cond.Broadcast()
+	t.pollers.Wakeready(fdops.R_READ | fdops.R_WRITE | fdops.R_HUP)
+	t.Unlock()
+	sendsigs(pgrp, []int{defs.SIGHUP, defs.SIGCONT})
+}
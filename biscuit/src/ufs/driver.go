@@ -45,11 +45,14 @@ func (ahci *ahci_disk_t) Start(req *fs.Bdev_req_t) bool {
 		if n != fs.BSIZE || err != nil {
 			panic(err)
 		}
-		blk.Data = &mem.Bytepg_t{}
+		// read into the block's page, like a real disk
+		if blk.Data == nil {
+			blk.Data = &mem.Bytepg_t{}
+		}
 		for i, _ := range b {
 			blk.Data[i] = uint8(b[i])
 		}
-	case fs.BDEV_WRITE:
+	case fs.BDEV_WRITE, fs.BDEV_WRITE_FUA:
 		for b := req.Blks.FrontBlock(); b != nil; b = req.Blks.NextBlock() {
 			ahci.Seek(b.Block * fs.BSIZE)
 			buf := make([]byte, fs.BSIZE)
@@ -65,6 +68,12 @@ func (ahci *ahci_disk_t) Start(req *fs.Bdev_req_t) bool {
 			}
 			b.Done("Start")
 		}
+		if req.Cmd == fs.BDEV_WRITE_FUA {
+			ahci.f.Sync()
+			if ahci.t != nil {
+				ahci.t.sync()
+			}
+		}
 	case fs.BDEV_FLUSH:
 		ahci.f.Sync()
 		if ahci.t != nil {
@@ -125,3 +134,7 @@ func (c console_t) Cons_read(ub fdops.Userio_i, offset int) (int, defs.Err_t) {
 func (c console_t) Cons_write(src fdops.Userio_i, off int) (int, defs.Err_t) {
 	return 0, 0
 }
+
+func (c console_t) Cons_ioctl(req int, arg fdops.Userio_i) defs.Err_t {
+	return -defs.ENOTTY
+}
@@ -0,0 +1,67 @@
+package ufs
+
+import "os"
+
+import "fs"
+import "mem"
+
+// the image file checked by fsck
+type fsckdisk_t struct {
+	f     *os.File
+	nblks int
+}
+
+func (d *fsckdisk_t) Readblk(blkno int) *mem.Bytepg_t {
+	b := make([]byte, fs.BSIZE)
+	n, err := d.f.ReadAt(b, int64(blkno*fs.BSIZE))
+	if n != fs.BSIZE {
+		panic(err)
+	}
+	ret := &mem.Bytepg_t{}
+	copy(ret[:], b)
+	return ret
+}
+
+func (d *fsckdisk_t) Writeblk(blkno int, data *mem.Bytepg_t) {
+	n, err := d.f.WriteAt(bytepg2byte(data), int64(blkno*fs.BSIZE))
+	if n != fs.BSIZE {
+		panic(err)
+	}
+}
+
+func (d *fsckdisk_t) Nblks() int {
+	return d.nblks
+}
+
+// checks the file system in the disk image at path. if repair is true, fsck
+// writes its repairs back to the image; otherwise the image is not modified
+// and the report describes the repairs fsck would make.
+func Fsck(path string, repair bool) (*fs.Fsckreport_t, error) {
+	flags := os.O_RDONLY
+	if repair {
+		flags = os.O_RDWR
+	}
+	f, err := os.OpenFile(path, flags, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	st, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	d := &fsckdisk_t{f: f, nblks: int(st.Size() / fs.BSIZE)}
+	fk := fs.MkFsck(d, repair)
+	if !fk.Checksuper() {
+		return fk.Rep, nil
+	}
+	fk.Checklog()
+	ok := fk.Check()
+	if repair && ok {
+		fk.Flush()
+		if err := f.Sync(); err != nil {
+			return fk.Rep, err
+		}
+	}
+	return fk.Rep, nil
+}
@@ -2,6 +2,7 @@ package ufs
 
 import "os"
 import "fmt"
+import "time"
 
 import "fs"
 import "mem"
@@ -58,6 +59,7 @@ func writeSuperBlock(f *os.File, start int, nlogblks, ninodeblks, ndatablks int)
 	}
 	d := &mem.Bytepg_t{}
 	sb := fs.Superblock_t{d}
+	sb.SetVersion(fs.FSVERSION)
 	sb.SetLoglen(nlogblks)
 	ninode := ninodeblks * (fs.BSIZE / fs.ISIZE)
 	ni := ninode/nbitsperblock + 1
@@ -163,6 +165,11 @@ func writeInodes(f *os.File, sb *fs.Superblock_t) {
 	root.W_linkcount(1)
 	root.W_size(fs.BSIZE)
 	root.W_addr(0, firstdata)
+	now := int(time.Now().UnixNano())
+	root.W_atime(now)
+	root.W_mtime(now)
+	root.W_ctime(now)
+	root.W_mode(0755)
 	block := bytepg2byte(b.Data)
 
 	if Tell(f) != sb.Freeblock()+sb.Freeblocklen() {
@@ -4,11 +4,13 @@ import "os"
 
 import "log"
 
+import "cred"
 import "defs"
 import "fd"
 import "fs"
 import "stat"
 import "ustr"
+import "util"
 import "vm"
 
 //
@@ -19,6 +21,8 @@ type Ufs_t struct {
 	ahci *ahci_disk_t
 	fs   *fs.Fs_t
 	cwd  *fd.Cwd_t
+	// the credentials used for all operations
+	cred *cred.Cred_t
 }
 
 func mkData(v uint8, n int) *vm.Fakeubuf_t {
@@ -57,8 +61,18 @@ func (ufs *Ufs_t) SyncApply() defs.Err_t {
 	return err
 }
 
+// fsyncs, or if datasync is true fdatasyncs, the file at p
+func (ufs *Ufs_t) Fsync(p ustr.Ustr, datasync bool) defs.Err_t {
+	fd, err := ufs.fs.Fs_open(p, defs.O_RDONLY, 0, ufs.cwd, ufs.cred, 0, 0)
+	if err != 0 {
+		return err
+	}
+	defer fd.Fops.Close()
+	return fd.Fops.Fsync(datasync)
+}
+
 func (ufs *Ufs_t) MkFile(p ustr.Ustr, ub *vm.Fakeubuf_t) defs.Err_t {
-	fd, err := ufs.fs.Fs_open(p, defs.O_CREAT, 0, ufs.cwd, 0, 0)
+	fd, err := ufs.fs.Fs_open(p, defs.O_CREAT, 0644, ufs.cwd, ufs.cred, 0, 0)
 	if err != 0 {
 		return err
 	}
@@ -77,7 +91,7 @@ func (ufs *Ufs_t) MkFile(p ustr.Ustr, ub *vm.Fakeubuf_t) defs.Err_t {
 }
 
 func (ufs *Ufs_t) MkDir(p ustr.Ustr) defs.Err_t {
-	err := ufs.fs.Fs_mkdir(p, 0755, ufs.cwd)
+	err := ufs.fs.Fs_mkdir(p, 0755, ufs.cwd, ufs.cred)
 	if err != 0 {
 		return err
 	}
@@ -85,13 +99,13 @@ func (ufs *Ufs_t) MkDir(p ustr.Ustr) defs.Err_t {
 }
 
 func (ufs *Ufs_t) Rename(oldp, newp ustr.Ustr) defs.Err_t {
-	err := ufs.fs.Fs_rename(oldp, newp, ufs.cwd)
+	err := ufs.fs.Fs_rename(oldp, newp, ufs.cwd, ufs.cred)
 	return err
 }
 
 // update (XXX check that ub < len(file)?)
 func (ufs *Ufs_t) Update(p ustr.Ustr, ub *vm.Fakeubuf_t) defs.Err_t {
-	fd, err := ufs.fs.Fs_open(p, defs.O_RDWR, 0, ufs.cwd, 0, 0)
+	fd, err := ufs.fs.Fs_open(p, defs.O_RDWR, 0, ufs.cwd, ufs.cred, 0, 0)
 	if err != 0 {
 		return err
 	}
@@ -108,7 +122,7 @@ func (ufs *Ufs_t) Update(p ustr.Ustr, ub *vm.Fakeubuf_t) defs.Err_t {
 }
 
 func (ufs *Ufs_t) Append(p ustr.Ustr, ub *vm.Fakeubuf_t) defs.Err_t {
-	fd, err := ufs.fs.Fs_open(p, defs.O_RDWR, 0, ufs.cwd, 0, 0)
+	fd, err := ufs.fs.Fs_open(p, defs.O_RDWR, 0, ufs.cwd, ufs.cred, 0, 0)
 	if err != 0 {
 		return err
 	}
@@ -131,7 +145,7 @@ func (ufs *Ufs_t) Append(p ustr.Ustr, ub *vm.Fakeubuf_t) defs.Err_t {
 }
 
 func (ufs *Ufs_t) Unlink(p ustr.Ustr) defs.Err_t {
-	err := ufs.fs.Fs_unlink(p, ufs.cwd, false)
+	err := ufs.fs.Fs_unlink(p, ufs.cwd, ufs.cred, false)
 	if err != 0 {
 		return err
 	}
@@ -139,7 +153,7 @@ func (ufs *Ufs_t) Unlink(p ustr.Ustr) defs.Err_t {
 }
 
 func (ufs *Ufs_t) UnlinkDir(p ustr.Ustr) defs.Err_t {
-	err := ufs.fs.Fs_unlink(p, ufs.cwd, true)
+	err := ufs.fs.Fs_unlink(p, ufs.cwd, ufs.cred, true)
 	if err != 0 {
 		return err
 	}
@@ -148,19 +162,62 @@ func (ufs *Ufs_t) UnlinkDir(p ustr.Ustr) defs.Err_t {
 
 func (ufs *Ufs_t) Stat(p ustr.Ustr) (*stat.Stat_t, defs.Err_t) {
 	s := &stat.Stat_t{}
-	err := ufs.fs.Fs_stat(p, s, ufs.cwd)
+	err := ufs.fs.Fs_stat(p, s, ufs.cwd, ufs.cred)
+	if err != 0 {
+		return nil, err
+	}
+	return s, err
+}
+
+func (ufs *Ufs_t) Lstat(p ustr.Ustr) (*stat.Stat_t, defs.Err_t) {
+	s := &stat.Stat_t{}
+	err := ufs.fs.Fs_lstat(p, s, ufs.cwd, ufs.cred)
 	if err != 0 {
 		return nil, err
 	}
 	return s, err
 }
 
+func (ufs *Ufs_t) Symlink(target, p ustr.Ustr) defs.Err_t {
+	return ufs.fs.Fs_symlink(target, p, ufs.cwd, ufs.cred)
+}
+
+func (ufs *Ufs_t) Readlink(p ustr.Ustr) (ustr.Ustr, defs.Err_t) {
+	hdata := make([]uint8, fs.NAME_MAX)
+	ub := &vm.Fakeubuf_t{}
+	ub.Fake_init(hdata)
+	n, err := ufs.fs.Fs_readlink(p, ub, ufs.cwd, ufs.cred)
+	if err != 0 {
+		return nil, err
+	}
+	return ustr.Ustr(hdata[:n]), 0
+}
+
+// times are in nanoseconds since the epoch; a negative time is left unchanged
+func (ufs *Ufs_t) Utimes(p ustr.Ustr, atime, mtime int) defs.Err_t {
+	return ufs.fs.Fs_utimes(p, atime, mtime, ufs.cwd, ufs.cred)
+}
+
+func (ufs *Ufs_t) Chmod(p ustr.Ustr, mode uint) defs.Err_t {
+	return ufs.fs.Fs_chmod(p, mode, ufs.cwd, ufs.cred)
+}
+
+// an id of -1 is left unchanged
+func (ufs *Ufs_t) Chown(p ustr.Ustr, uid, gid int) defs.Err_t {
+	return ufs.fs.Fs_chown(p, uid, gid, ufs.cwd, ufs.cred)
+}
+
+// subsequent operations use the credentials cr
+func (ufs *Ufs_t) SetCred(cr *cred.Cred_t) {
+	ufs.cred = cr
+}
+
 func (ufs *Ufs_t) Read(p ustr.Ustr) ([]byte, defs.Err_t) {
 	st, err := ufs.Stat(p)
 	if err != 0 {
 		return nil, err
 	}
-	fd, err := ufs.fs.Fs_open(p, defs.O_RDONLY, 0, ufs.cwd, 0, 0)
+	fd, err := ufs.fs.Fs_open(p, defs.O_RDONLY, 0, ufs.cwd, ufs.cred, 0, 0)
 	if err != 0 {
 		return nil, err
 	}
@@ -183,27 +240,66 @@ func (ufs *Ufs_t) Read(p ustr.Ustr) ([]byte, defs.Err_t) {
 
 func (ufs *Ufs_t) Ls(p ustr.Ustr) (map[string]*stat.Stat_t, defs.Err_t) {
 	res := make(map[string]*stat.Stat_t, 100)
-	d, e := ufs.Read(p)
+	ents, e := ufs.Getdents(p)
 	if e != 0 {
 		return nil, e
 	}
-	for i := 0; i < len(d)/fs.BSIZE; i++ {
-		dd := fs.Dirdata_t{d[i*fs.BSIZE:]}
-		for j := 0; j < fs.NDIRENTS; j++ {
-			tfn := dd.Filename(j)
-			if len(tfn) > 0 {
-				f := p.Extend(tfn)
-				st, e := ufs.Stat(f)
-				if e != 0 {
-					return nil, e
-				}
-				res[string(tfn)] = st
-			}
+	for _, tfn := range ents {
+		f := p.Extend(tfn)
+		st, e := ufs.Lstat(f)
+		if e != 0 {
+			return nil, e
 		}
+		res[string(tfn)] = st
 	}
 	return res, 0
 }
 
+// returns the names of the entries of directory p, in the order getdents
+// returns them
+func (ufs *Ufs_t) Getdents(p ustr.Ustr) ([]ustr.Ustr, defs.Err_t) {
+	fd, err := ufs.fs.Fs_open(p, defs.O_RDONLY|defs.O_DIRECTORY, 0, ufs.cwd, ufs.cred, 0, 0)
+	if err != 0 {
+		return nil, err
+	}
+	defer fd.Fops.Close()
+	var ret []ustr.Ustr
+	buf := make([]uint8, 256)
+	for {
+		ub := &vm.Fakeubuf_t{}
+		ub.Fake_init(buf)
+		n, err := fd.Fops.Getdents(ub)
+		if err != 0 {
+			return nil, err
+		}
+		if n == 0 {
+			return ret, 0
+		}
+		names, _ := parsedents(buf[:n])
+		ret = append(ret, names...)
+	}
+}
+
+// returns the names and cookies of the getdents records in d
+func parsedents(d []uint8) ([]ustr.Ustr, []int) {
+	var names []ustr.Ustr
+	var cookies []int
+	for len(d) > 0 {
+		reclen := util.Readn(d, 2, 16)
+		fn := d[fs.DIRENT_HDR:reclen]
+		for i, c := range fn {
+			if c == 0 {
+				fn = fn[:i]
+				break
+			}
+		}
+		names = append(names, append(ustr.Ustr{}, fn...))
+		cookies = append(cookies, util.Readn(d, 8, 8))
+		d = d[reclen:]
+	}
+	return names, cookies
+}
+
 func (ufs *Ufs_t) Statistics() string {
 	return ufs.fs.Fs_statistics()
 }
@@ -231,6 +327,7 @@ func BootFS(dst string) *Ufs_t {
 	ufs := &Ufs_t{}
 	ufs.ahci = openDisk(dst)
 	ufs.cwd = ufs.fs.MkRootCwd()
+	ufs.cred = cred.Root
 	_, ufs.fs = fs.StartFS(blockmem, ufs.ahci, c, true)
 	return ufs
 }
@@ -240,6 +337,7 @@ func BootMemFS(dst string) *Ufs_t {
 	ufs := &Ufs_t{}
 	ufs.ahci = openDisk(dst)
 	ufs.cwd = ufs.fs.MkRootCwd()
+	ufs.cred = cred.Root
 	_, ufs.fs = fs.StartFS(blockmem, ufs.ahci, c, false)
 	return ufs
 }
@@ -9,11 +9,17 @@ import "sync"
 import "time"
 
 import "bpath"
+import "cred"
 import "defs"
 import "fd"
+import "fdops"
 import "fs"
 import "mem"
+import "stat"
 import "ustr"
+import "util"
+import "vfs"
+import "vm"
 
 const (
 	SMALL = 512
@@ -22,7 +28,7 @@ const (
 
 const (
 	nlogblks   = 32
-	ninodeblks = 1
+	ninodeblks = 2
 	ndatablks  = 20
 )
 
@@ -344,6 +350,928 @@ func TestFSSimple(t *testing.T) {
 	os.Remove(dst)
 }
 
+//
+// Test symlinks
+//
+
+func doTestSymlink(tfs *Ufs_t, t *testing.T) {
+	if e := tfs.MkDir(ustr.Ustr("d")); e != 0 {
+		t.Fatalf("mkDir failed %v", e)
+	}
+	if e := tfs.MkFile(ustr.Ustr("d/f"), mkData(1, SMALL)); e != 0 {
+		t.Fatalf("mkFile failed %v", e)
+	}
+	// inline target
+	if e := tfs.Symlink(ustr.Ustr("d/f"), ustr.Ustr("l")); e != 0 {
+		t.Fatalf("Symlink l failed %v", e)
+	}
+	// target stored in a data block
+	long := "/d/"
+	for len(long) <= fs.SYMINLINE {
+		long += "./"
+	}
+	long += "f"
+	if e := tfs.Symlink(ustr.Ustr(long), ustr.Ustr("d/ll")); e != 0 {
+		t.Fatalf("Symlink ll failed %v", e)
+	}
+	if e := tfs.Symlink(ustr.Ustr("d"), ustr.Ustr("dl")); e != 0 {
+		t.Fatalf("Symlink dl failed %v", e)
+	}
+	if e := tfs.Symlink(ustr.Ustr("b"), ustr.Ustr("a")); e != 0 {
+		t.Fatalf("Symlink a failed %v", e)
+	}
+	if e := tfs.Symlink(ustr.Ustr("a"), ustr.Ustr("b")); e != 0 {
+		t.Fatalf("Symlink b failed %v", e)
+	}
+	if e := tfs.Symlink(ustr.Ustr("d"), ustr.Ustr("l")); e != -defs.EEXIST {
+		t.Fatalf("Symlink l succeeded %v", e)
+	}
+}
+
+func doCheckSymlink(tfs *Ufs_t, t *testing.T) {
+	for _, p := range []string{"l", "d/ll", "dl/f", "dl/ll", "/dl/../l"} {
+		d, e := tfs.Read(ustr.Ustr(p))
+		if e != 0 {
+			t.Fatalf("Read %v failed %v", p, e)
+		}
+		if len(d) != SMALL || d[0] != 1 {
+			t.Fatalf("Read %v wrong data", p)
+		}
+	}
+	tg, e := tfs.Readlink(ustr.Ustr("l"))
+	if e != 0 || !tg.Eq(ustr.Ustr("d/f")) {
+		t.Fatalf("Readlink l failed %v %v", tg, e)
+	}
+	tg, e = tfs.Readlink(ustr.Ustr("dl/ll"))
+	if e != 0 || len(tg) <= fs.SYMINLINE {
+		t.Fatalf("Readlink ll failed %v %v", tg, e)
+	}
+	if _, e = tfs.Readlink(ustr.Ustr("d/f")); e != -defs.EINVAL {
+		t.Fatalf("Readlink of file %v", e)
+	}
+	st, e := tfs.Lstat(ustr.Ustr("l"))
+	if e != 0 || st.Mode() != fs.I_SYMLINK<<16|0777 || st.Size() != 3 {
+		t.Fatalf("Lstat l failed %v", e)
+	}
+	st, e = tfs.Stat(ustr.Ustr("dl"))
+	if e != 0 || st.Mode() != fs.I_DIR<<16|0755 {
+		t.Fatalf("Stat dl failed %v", e)
+	}
+	if _, e = tfs.Stat(ustr.Ustr("a")); e != -defs.ELOOP {
+		t.Fatalf("Stat a didn't loop %v", e)
+	}
+	if _, e = tfs.Lstat(ustr.Ustr("a")); e != 0 {
+		t.Fatalf("Lstat a failed %v", e)
+	}
+	if _, e = tfs.Stat(ustr.Ustr("l/x")); e != -defs.ENOTDIR {
+		t.Fatalf("Stat l/x %v", e)
+	}
+	fd, e := tfs.fs.Fs_open(ustr.Ustr("l"), defs.O_RDONLY|defs.O_NOFOLLOW, 0, tfs.cwd, cred.Root, 0, 0)
+	if e != -defs.ELOOP {
+		if e == 0 {
+			fd.Fops.Close()
+		}
+		t.Fatalf("O_NOFOLLOW open %v", e)
+	}
+}
+
+func TestFSSymlink(t *testing.T) {
+	dst := "tmp.img"
+	MkDisk(dst, nil, nlogblks, ninodeblks, ndatablks)
+
+	fmt.Printf("Test FSSymlink %v ...\n", dst)
+	tfs := BootFS(dst)
+	doTestSymlink(tfs, t)
+	doCheckSymlink(tfs, t)
+	ShutdownFS(tfs)
+
+	tfs = BootFS(dst)
+	doCheckSymlink(tfs, t)
+	_, nblks := tfs.fs.Fs_size()
+	for _, p := range []string{"l", "d/ll", "dl", "a", "b"} {
+		if e := tfs.Unlink(ustr.Ustr(p)); e != 0 {
+			t.Fatalf("Unlink %v failed %v", p, e)
+		}
+	}
+	if _, nb := tfs.fs.Fs_size(); nb != nblks+1 {
+		t.Fatalf("symlink block not freed %v %v", nblks, nb)
+	}
+	if _, e := tfs.Stat(ustr.Ustr("d/f")); e != 0 {
+		t.Fatalf("Stat d/f failed %v", e)
+	}
+	ShutdownFS(tfs)
+	os.Remove(dst)
+}
+
+func TestFSTimes(t *testing.T) {
+	dst := "tmp.img"
+	MkDisk(dst, nil, nlogblks, ninodeblks, ndatablks)
+
+	fmt.Printf("Test FSTimes %v ...\n", dst)
+	tfs := BootFS(dst)
+	d := ustr.Ustr("d")
+	f := ustr.Ustr("d/f")
+	if e := tfs.MkDir(d); e != 0 {
+		t.Fatalf("MkDir %v failed %v", d, e)
+	}
+	if e := tfs.MkFile(f, mkData(1, SMALL)); e != 0 {
+		t.Fatalf("MkFile %v failed %v", f, e)
+	}
+	st, e := tfs.Stat(f)
+	if e != 0 {
+		t.Fatalf("Stat %v failed %v", f, e)
+	}
+	if st.Atime() == 0 || st.Mtime() == 0 || st.Ctime() == 0 {
+		t.Fatalf("times not set %v %v %v", st.Atime(), st.Mtime(), st.Ctime())
+	}
+
+	const sec = 1000000000
+	if e := tfs.Utimes(f, sec, 2*sec); e != 0 {
+		t.Fatalf("Utimes %v failed %v", f, e)
+	}
+	st, _ = tfs.Stat(f)
+	if st.Atime() != sec || st.Mtime() != 2*sec {
+		t.Fatalf("Utimes: wrong times %v %v", st.Atime(), st.Mtime())
+	}
+	if e := tfs.Utimes(f, defs.UT_OMIT, 3*sec); e != 0 {
+		t.Fatalf("Utimes %v failed %v", f, e)
+	}
+	st, _ = tfs.Stat(f)
+	if st.Atime() != sec || st.Mtime() != 3*sec {
+		t.Fatalf("Utimes omit: wrong times %v %v", st.Atime(), st.Mtime())
+	}
+
+	// the first read updates the stale access time, the second doesn't
+	if _, e := tfs.Read(f); e != 0 {
+		t.Fatalf("Read %v failed %v", f, e)
+	}
+	st, _ = tfs.Stat(f)
+	atime := st.Atime()
+	if atime <= 3*sec {
+		t.Fatalf("atime not updated %v", atime)
+	}
+	tfs.Read(f)
+	st, _ = tfs.Stat(f)
+	if st.Atime() != atime {
+		t.Fatalf("atime updated again %v %v", atime, st.Atime())
+	}
+
+	// writes update the modification time of the file, creates and
+	// unlinks that of the directory
+	tfs.Utimes(f, -1, sec)
+	if e := tfs.Append(f, mkData(2, SMALL)); e != 0 {
+		t.Fatalf("Append %v failed %v", f, e)
+	}
+	st, _ = tfs.Stat(f)
+	if st.Mtime() <= sec || st.Ctime() < st.Mtime() {
+		t.Fatalf("write: wrong times %v %v", st.Mtime(), st.Ctime())
+	}
+	for _, op := range []string{"create", "unlink"} {
+		tfs.Utimes(d, -1, sec)
+		g := ustr.Ustr("d/g")
+		if op == "create" {
+			e = tfs.MkFile(g, nil)
+		} else {
+			e = tfs.Unlink(g)
+		}
+		if e != 0 {
+			t.Fatalf("%v %v failed %v", op, g, e)
+		}
+		st, _ = tfs.Stat(d)
+		if st.Mtime() <= sec {
+			t.Fatalf("%v: dir mtime not updated", op)
+		}
+	}
+	want, _ := tfs.Stat(f)
+	ShutdownFS(tfs)
+
+	tfs = BootFS(dst)
+	st, e = tfs.Stat(f)
+	if e != 0 {
+		t.Fatalf("Stat %v failed %v", f, e)
+	}
+	if st.Atime() != want.Atime() || st.Mtime() != want.Mtime() ||
+		st.Ctime() != want.Ctime() {
+		t.Fatalf("times not persistent")
+	}
+	ShutdownFS(tfs)
+	os.Remove(dst)
+}
+
+func mkcred(id int) *cred.Cred_t {
+	return &cred.Cred_t{Ruid: id, Euid: id, Suid: id, Rgid: id, Egid: id,
+		Sgid: id}
+}
+
+func TestFSPerms(t *testing.T) {
+	dst := "tmp.img"
+	MkDisk(dst, nil, nlogblks, ninodeblks, ndatablks)
+
+	fmt.Printf("Test FSPerms %v ...\n", dst)
+	tfs := BootFS(dst)
+	d := ustr.Ustr("d")
+	s := ustr.Ustr("d/s")
+	f := ustr.Ustr("d/f")
+	tmp := ustr.Ustr("t")
+	u := ustr.Ustr("t/u")
+	for _, p := range []ustr.Ustr{d, tmp} {
+		if e := tfs.MkDir(p); e != 0 {
+			t.Fatalf("MkDir %v failed %v", p, e)
+		}
+	}
+	if e := tfs.Chmod(tmp, 01777); e != 0 {
+		t.Fatalf("Chmod %v failed %v", tmp, e)
+	}
+	if e := tfs.MkFile(s, mkData(1, SMALL)); e != 0 {
+		t.Fatalf("MkFile %v failed %v", s, e)
+	}
+
+	tfs.SetCred(mkcred(1000))
+	if e := tfs.MkFile(f, nil); e != -defs.EACCES {
+		t.Fatalf("MkFile %v in root's dir: %v", f, e)
+	}
+	if _, e := tfs.Read(s); e != 0 {
+		t.Fatalf("Read %v failed %v", s, e)
+	}
+	if e := tfs.Chmod(s, 0666); e != -defs.EPERM {
+		t.Fatalf("Chmod %v by non-owner: %v", s, e)
+	}
+
+	tfs.SetCred(cred.Root)
+	if e := tfs.Chown(d, 1000, -1); e != 0 {
+		t.Fatalf("Chown %v failed %v", d, e)
+	}
+	if e := tfs.Chmod(s, 0600); e != 0 {
+		t.Fatalf("Chmod %v failed %v", s, e)
+	}
+
+	tfs.SetCred(mkcred(1000))
+	if e := tfs.MkFile(f, nil); e != 0 {
+		t.Fatalf("MkFile %v failed %v", f, e)
+	}
+	if _, e := tfs.Read(s); e != -defs.EACCES {
+		t.Fatalf("Read %v: %v", s, e)
+	}
+	if e := tfs.MkFile(u, nil); e != 0 {
+		t.Fatalf("MkFile %v failed %v", u, e)
+	}
+	if e := tfs.Chmod(u, 0666); e != 0 {
+		t.Fatalf("Chmod %v failed %v", u, e)
+	}
+
+	// the sticky bit keeps others from removing u
+	tfs.SetCred(mkcred(1001))
+	if e := tfs.Unlink(u); e != -defs.EPERM {
+		t.Fatalf("Unlink %v in sticky dir: %v", u, e)
+	}
+	// others who may write u may only set its times to now
+	if e := tfs.Utimes(u, defs.UT_NOW, defs.UT_NOW); e != 0 {
+		t.Fatalf("Utimes %v to now failed %v", u, e)
+	}
+	if e := tfs.Utimes(u, defs.UT_OMIT, 1); e != -defs.EPERM {
+		t.Fatalf("Utimes %v by non-owner: %v", u, e)
+	}
+	if e := tfs.Utimes(f, defs.UT_NOW, defs.UT_NOW); e != -defs.EPERM {
+		t.Fatalf("Utimes %v without write permission: %v", f, e)
+	}
+	ShutdownFS(tfs)
+
+	tfs = BootFS(dst)
+	st, e := tfs.Stat(f)
+	if e != 0 {
+		t.Fatalf("Stat %v failed %v", f, e)
+	}
+	if st.Uid() != 1000 || st.Gid() != 1000 || st.Mode()&07777 != 0644 {
+		t.Fatalf("wrong owner or mode %v %v %o", st.Uid(), st.Gid(),
+			st.Mode())
+	}
+	st, _ = tfs.Stat(tmp)
+	if st.Mode()&07777 != 01777 {
+		t.Fatalf("wrong mode %o", st.Mode())
+	}
+	if e := tfs.Unlink(u); e != 0 {
+		t.Fatalf("Unlink %v failed %v", u, e)
+	}
+	ShutdownFS(tfs)
+	os.Remove(dst)
+}
+
+func TestFSGetdents(t *testing.T) {
+	dst := "tmp.img"
+	MkDisk(dst, nil, nlogblks, ninodeblks, ndatablks)
+
+	fmt.Printf("Test FSGetdents %v ...\n", dst)
+	tfs := BootFS(dst)
+	d := ustr.Ustr("d")
+	if e := tfs.MkDir(d); e != 0 {
+		t.Fatalf("MkDir %v failed %v", d, e)
+	}
+	const n = 20
+	for i := 0; i < n; i++ {
+		f := d.Extend(ustr.Ustr("f" + strconv.Itoa(i)))
+		if e := tfs.MkFile(f, nil); e != 0 {
+			t.Fatalf("MkFile %v failed %v", f, e)
+		}
+	}
+	all, e := tfs.Getdents(d)
+	if e != 0 {
+		t.Fatalf("Getdents %v failed %v", d, e)
+	}
+	if len(all) != n+2 {
+		t.Fatalf("Getdents returned %v entries", len(all))
+	}
+
+	fd, e := tfs.fs.Fs_open(d, defs.O_RDONLY|defs.O_DIRECTORY, 0, tfs.cwd,
+		cred.Root, 0, 0)
+	if e != 0 {
+		t.Fatalf("open %v failed %v", d, e)
+	}
+	buf := make([]uint8, 64)
+	getdents := func() ([]ustr.Ustr, []int) {
+		ub := &vm.Fakeubuf_t{}
+		ub.Fake_init(buf)
+		c, e := fd.Fops.Getdents(ub)
+		if e != 0 {
+			t.Fatalf("Getdents failed %v", e)
+		}
+		return parsedents(buf[:c])
+	}
+	ub := &vm.Fakeubuf_t{}
+	ub.Fake_init(buf)
+	if _, e := fd.Fops.Read(ub); e != -defs.EISDIR {
+		t.Fatalf("Read of directory: %v", e)
+	}
+
+	// entries that exist during the whole walk are returned exactly once,
+	// despite concurrent unlinks and inserts
+	seen := make(map[string]int)
+	for i := 0; ; i++ {
+		names, _ := getdents()
+		if len(names) == 0 {
+			break
+		}
+		for _, fn := range names {
+			seen[string(fn)]++
+		}
+		if i != 1 {
+			continue
+		}
+		for j := 0; j < 5; j++ {
+			f := d.Extend(ustr.Ustr("f" + strconv.Itoa(j)))
+			if e := tfs.Unlink(f); e != 0 {
+				t.Fatalf("Unlink %v failed %v", f, e)
+			}
+			f = d.Extend(ustr.Ustr("g" + strconv.Itoa(j)))
+			if e := tfs.MkFile(f, nil); e != 0 {
+				t.Fatalf("MkFile %v failed %v", f, e)
+			}
+		}
+	}
+	for fn, c := range seen {
+		if c != 1 {
+			t.Fatalf("%v returned %v times", fn, c)
+		}
+	}
+	for i := 5; i < n; i++ {
+		if seen["f"+strconv.Itoa(i)] != 1 {
+			t.Fatalf("f%v not returned", i)
+		}
+	}
+
+	// resuming from a cookie returns the following entry
+	fd.Fops.Lseek(0, defs.SEEK_SET)
+	first, cookies := getdents()
+	fd.Fops.Lseek(cookies[0], defs.SEEK_SET)
+	if names, _ := getdents(); !names[0].Eq(first[1]) {
+		t.Fatalf("resumed at %v, not %v", names[0], first[1])
+	}
+
+	// each record has the type of its entry
+	if e := tfs.MkDir(d.Extend(ustr.Ustr("dd"))); e != 0 {
+		t.Fatalf("MkDir failed %v", e)
+	}
+	if e := tfs.Symlink(ustr.Ustr("f5"), d.Extend(ustr.Ustr("l"))); e != 0 {
+		t.Fatalf("Symlink failed %v", e)
+	}
+	fd.Fops.Lseek(0, defs.SEEK_SET)
+	big := make([]uint8, fs.BSIZE)
+	ub.Fake_init(big)
+	c, e := fd.Fops.Getdents(ub)
+	if e != 0 {
+		t.Fatalf("Getdents failed %v", e)
+	}
+	types := make(map[string]uint8)
+	names, _ := parsedents(big[:c])
+	rec := big[:c]
+	for _, fn := range names {
+		types[string(fn)] = rec[18]
+		rec = rec[util.Readn(rec, 2, 16):]
+	}
+	want := map[string]uint8{".": defs.DT_DIR, "..": defs.DT_DIR,
+		"f5": defs.DT_REG, "dd": defs.DT_DIR, "l": defs.DT_LNK}
+	for fn, dt := range want {
+		if types[fn] != dt {
+			t.Fatalf("%v has type %v, not %v", fn, types[fn], dt)
+		}
+	}
+	fd.Fops.Close()
+	ShutdownFS(tfs)
+	os.Remove(dst)
+}
+
+func TestFSFsync(t *testing.T) {
+	dst := "tmp.img"
+	MkDisk(dst, nil, nlogblks, ninodeblks, ndatablks)
+
+	fmt.Printf("Test FSFsync %v ...\n", dst)
+	tfs := BootFS(dst)
+	f := ustr.Ustr("f")
+	g := ustr.Ustr("g")
+	if e := tfs.MkFile(f, mkData(1, fs.BSIZE)); e != 0 {
+		t.Fatalf("mkFile %v failed %v", f, e)
+	}
+	if e := tfs.MkFile(g, mkData(1, fs.BSIZE)); e != 0 {
+		t.Fatalf("mkFile %v failed %v", g, e)
+	}
+	tfs.Sync()
+
+	// fsyncs the file at p and checks how many forces were avoided
+	fsync := func(p ustr.Ustr, datasync bool, avoided int) {
+		if e := tfs.Fsync(p, datasync); e != 0 {
+			t.Fatalf("fsync %v failed %v", p, e)
+		}
+		if _, n := tfs.fs.Fs_nfsync(); n != avoided {
+			t.Fatalf("fsync %v: %v forces avoided, not %v", p, n, avoided)
+		}
+	}
+	fsync(f, false, 1)
+
+	// a dirty g doesn't make f dirty
+	if e := tfs.Update(g, mkData(2, fs.BSIZE)); e != 0 {
+		t.Fatalf("update %v failed %v", g, e)
+	}
+	fsync(f, false, 2)
+	fsync(f, true, 3)
+	fsync(g, true, 3)
+
+	// the fsync of g committed its data
+	copyDisk(dst, "crash.img")
+	cfs := BootFS("crash.img")
+	d, e := cfs.Read(g)
+	if e != 0 || len(d) != fs.BSIZE || d[0] != 2 {
+		t.Fatalf("fsync %v didn't commit its data %v", g, e)
+	}
+	ShutdownFS(cfs)
+	os.Remove("crash.img")
+
+	// fdatasync ignores changes to the timestamps
+	if e := tfs.Utimes(f, 0, 0); e != 0 {
+		t.Fatalf("utimes %v failed %v", f, e)
+	}
+	fsync(f, true, 4)
+	fsync(f, false, 4)
+	fsync(f, false, 5)
+	if n, _ := tfs.fs.Fs_nfsync(); n != 7 {
+		t.Fatalf("%v fsyncs, not 7", n)
+	}
+
+	ShutdownFS(tfs)
+	os.Remove(dst)
+}
+
+func TestVfsMount(t *testing.T) {
+	dst := "tmp.img"
+	MkDisk(dst, nil, nlogblks, ninodeblks, ndatablks)
+
+	fmt.Printf("Test VfsMount %v ...\n", dst)
+	tfs := BootFS(dst)
+	v := vfs.MkVfs(tfs.fs, "tmp.img", "bfs")
+	mnt := ustr.Ustr("/mnt")
+	if e := tfs.MkDir(mnt); e != 0 {
+		t.Fatalf("mkdir %v failed %v", mnt, e)
+	}
+	mfs, e := fs.AttachFS(blockmem, fs.MkMemdisk(2, 20), false)
+	if e != 0 {
+		t.Fatalf("attach memory fs failed %v", e)
+	}
+	if e := v.Mount(mnt, mfs, "memfs", "memfs", tfs.cwd, tfs.cred); e != 0 {
+		t.Fatalf("mount failed %v", e)
+	}
+	if e := v.Mount(mnt, mfs, "memfs", "memfs", tfs.cwd, tfs.cred); e != -defs.EBUSY {
+		t.Fatalf("mount twice: %v", e)
+	}
+
+	// files created below the mount point are in the memory fs
+	a := ustr.Ustr("/mnt/a")
+	f, e := v.Fs_open(a, defs.O_CREAT, 0644, tfs.cwd, tfs.cred, 0, 0)
+	if e != 0 {
+		t.Fatalf("create %v failed %v", a, e)
+	}
+	fd.Close_panic(f)
+	if e := v.Fs_mkdir(ustr.Ustr("/mnt/d"), 0755, tfs.cwd, tfs.cred); e != 0 {
+		t.Fatalf("mkdir failed %v", e)
+	}
+	if _, e := tfs.Stat(a); e != -defs.ENOENT {
+		t.Fatalf("%v in root fs: %v", a, e)
+	}
+	rst := &stat.Stat_t{}
+	mst := &stat.Stat_t{}
+	if e := v.Fs_stat(ustr.MkUstrRoot(), rst, tfs.cwd, tfs.cred); e != 0 {
+		t.Fatalf("stat / failed %v", e)
+	}
+	if e := v.Fs_stat(mnt, mst, tfs.cwd, tfs.cred); e != 0 {
+		t.Fatalf("stat %v failed %v", mnt, e)
+	}
+	if rst.Dev() == mst.Dev() {
+		t.Fatalf("mounted fs has the same device as /")
+	}
+
+	// paths relative to a cwd in the memory fs cross the mount point in
+	// both directions
+	df, e := v.Fs_open(ustr.Ustr("/mnt/d"), defs.O_RDONLY|defs.O_DIRECTORY, 0, tfs.cwd, tfs.cred, 0, 0)
+	if e != 0 {
+		t.Fatalf("open /mnt/d failed %v", e)
+	}
+	cwd := fd.MkRootCwd(df)
+	cwd.Path = ustr.Ustr("/mnt/d")
+	st := &stat.Stat_t{}
+	if e := v.Fs_stat(ustr.Ustr("../a"), st, cwd, tfs.cred); e != 0 {
+		t.Fatalf("stat ../a failed %v", e)
+	}
+	if e := v.Fs_stat(ustr.Ustr("../.."), st, cwd, tfs.cred); e != 0 {
+		t.Fatalf("stat ../.. failed %v", e)
+	}
+	if st.Rino() != rst.Rino() {
+		t.Fatalf("../.. is not /")
+	}
+	if e := v.Fs_stat(ustr.Ustr("../../mnt/d/../a"), st, cwd, tfs.cred); e != 0 {
+		t.Fatalf("stat ../../mnt/d/../a failed %v", e)
+	}
+
+	// symlinks cross mount points in both directions. an absolute target
+	// starts at the root of the vfs, and ".." after a symlinked directory
+	// is the parent of the directory.
+	b := ustr.Ustr("/b")
+	if e := tfs.MkFile(b, nil); e != 0 {
+		t.Fatalf("mkfile %v failed %v", b, e)
+	}
+	bst := &stat.Stat_t{}
+	if e := v.Fs_stat(b, bst, tfs.cwd, tfs.cred); e != 0 {
+		t.Fatalf("stat %v failed %v", b, e)
+	}
+	links := []struct{ target, path string }{{"/mnt/d", "/lnk"},
+		{"/b", "/mnt/abs"}, {"../b", "/mnt/rel"}, {"/lnk", "/mnt/d/back"}}
+	for _, l := range links {
+		if e := v.Fs_symlink(ustr.Ustr(l.target), ustr.Ustr(l.path), tfs.cwd, tfs.cred); e != 0 {
+			t.Fatalf("symlink %v failed %v", l.path, e)
+		}
+	}
+	for _, p := range []string{"/mnt/abs", "/mnt/rel", "/lnk/../../b"} {
+		if e := v.Fs_stat(ustr.Ustr(p), st, tfs.cwd, tfs.cred); e != 0 {
+			t.Fatalf("stat %v failed %v", p, e)
+		}
+		if st.Dev() != bst.Dev() || st.Rino() != bst.Rino() {
+			t.Fatalf("%v isn't %v", p, b)
+		}
+	}
+	ast := &stat.Stat_t{}
+	if e := v.Fs_stat(a, ast, tfs.cwd, tfs.cred); e != 0 {
+		t.Fatalf("stat %v failed %v", a, e)
+	}
+	for _, p := range []string{"/lnk/../a", "/mnt/d/back/../a"} {
+		if e := v.Fs_stat(ustr.Ustr(p), st, tfs.cwd, tfs.cred); e != 0 {
+			t.Fatalf("stat %v failed %v", p, e)
+		}
+		if st.Dev() != ast.Dev() || st.Rino() != ast.Rino() {
+			t.Fatalf("%v isn't %v", p, a)
+		}
+	}
+	if e := v.Fs_lstat(ustr.Ustr("/mnt/abs"), st, tfs.cwd, tfs.cred); e != 0 ||
+		st.Mode()>>16 != fs.I_SYMLINK {
+		t.Fatalf("lstat followed the link %v", e)
+	}
+	if rp, e := v.Realpath(ustr.Ustr("/mnt/d/back"), tfs.cwd, tfs.cred); e != 0 ||
+		!rp.Eq(ustr.Ustr("/mnt/d")) {
+		t.Fatalf("realpath %v %v", rp, e)
+	}
+	// a mount point reached through a symlink is still busy
+	if e := v.Fs_unlink(ustr.Ustr("/lnk/.."), tfs.cwd, tfs.cred, true); e == 0 {
+		t.Fatalf("removed .. of a symlinked directory")
+	}
+
+	// a file created through a symlinked directory is in the memory fs,
+	// and a lookup fails at a missing directory or a symlink loop
+	nf, e := v.Fs_open(ustr.Ustr("/lnk/new"), defs.O_CREAT, 0644, tfs.cwd, tfs.cred, 0, 0)
+	if e != 0 {
+		t.Fatalf("create /lnk/new failed %v", e)
+	}
+	fd.Close_panic(nf)
+	if e := v.Fs_stat(ustr.Ustr("/mnt/d/new"), st, tfs.cwd, tfs.cred); e != 0 || st.Dev() != ast.Dev() {
+		t.Fatalf("/mnt/d/new not in the memory fs %v", e)
+	}
+	if e := v.Fs_stat(ustr.Ustr("/lnk/none/new"), st, tfs.cwd, tfs.cred); e != -defs.ENOENT {
+		t.Fatalf("stat below a missing directory: %v", e)
+	}
+	loop := ustr.Ustr("/mnt/loop")
+	if e := v.Fs_symlink(ustr.Ustr("/mnt/loop/x"), loop, tfs.cwd, tfs.cred); e != 0 {
+		t.Fatalf("symlink %v failed %v", loop, e)
+	}
+	if e := v.Fs_stat(loop, st, tfs.cwd, tfs.cred); e != -defs.ELOOP {
+		t.Fatalf("stat %v: %v", loop, e)
+	}
+	if e := v.Fs_unlink(loop, tfs.cwd, tfs.cred, false); e != 0 {
+		t.Fatalf("unlink %v failed %v", loop, e)
+	}
+	for _, l := range links {
+		if e := v.Fs_unlink(ustr.Ustr(l.path), tfs.cwd, tfs.cred, false); e != 0 {
+			t.Fatalf("unlink %v failed %v", l.path, e)
+		}
+	}
+
+	// files cannot move between file systems, and the mount point can't
+	// be removed
+	if e := v.Fs_rename(a, ustr.Ustr("/b"), tfs.cwd, tfs.cred); e != -defs.EXDEV {
+		t.Fatalf("rename across mounts: %v", e)
+	}
+	if e := v.Fs_unlink(mnt, tfs.cwd, tfs.cred, true); e != -defs.EBUSY {
+		t.Fatalf("rmdir mount point: %v", e)
+	}
+
+	// the open cwd keeps the memory fs busy
+	if _, e := v.Umount(mnt, tfs.cwd); e != -defs.EBUSY {
+		t.Fatalf("umount busy fs: %v", e)
+	}
+	fd.Close_panic(df)
+	if _, e := v.Umount(mnt, tfs.cwd); e != 0 {
+		t.Fatalf("umount failed %v", e)
+	}
+	if e := v.Fs_stat(a, st, tfs.cwd, tfs.cred); e != -defs.ENOENT {
+		t.Fatalf("%v after umount: %v", a, e)
+	}
+	if _, e := v.Umount(mnt, tfs.cwd); e != -defs.EINVAL {
+		t.Fatalf("umount twice: %v", e)
+	}
+
+	ShutdownFS(tfs)
+	os.Remove(dst)
+}
+
+// a superblock that doesn't describe a consistent layout can't be mounted
+func TestFSBadSuper(t *testing.T) {
+	dst := "tmp.img"
+	fmt.Printf("Test FSBadSuper %v ...\n", dst)
+	// fields of the superblock, which is block 1
+	const loglen, freeblock, lastblock, version = 0, 4, 7, 8
+	bad := []struct{ field, val int }{{loglen, 1 << 40}, {loglen, 1},
+		{freeblock, 3}, {lastblock, 1 << 30}, {lastblock, -1},
+		{version, 0}, {version, fs.FSVERSION + 1}}
+	for _, b := range bad {
+		MkDisk(dst, nil, nlogblks, ninodeblks, ndatablks)
+		f, err := os.OpenFile(dst, os.O_RDWR, 0)
+		if err != nil {
+			t.Fatalf("open %v", err)
+		}
+		buf := make([]byte, 8)
+		util.Writen(buf, 8, 0, b.val)
+		if _, err := f.WriteAt(buf, int64(fs.BSIZE+b.field*8)); err != nil {
+			t.Fatalf("write %v", err)
+		}
+		f.Close()
+		d := openDisk(dst)
+		if _, e := fs.AttachFS(blockmem, d, true); e != -defs.EINVAL {
+			t.Fatalf("attached bad superblock %v: %v", b, e)
+		}
+		d.close()
+		if b.field != version {
+			continue
+		}
+		// an image of another format version, like one with 128-byte
+		// inodes, is not checked
+		rep, err := Fsck(dst, true)
+		if err != nil || !rep.Fatal || len(rep.Problems) != 1 ||
+			rep.Problems[0].Kind != fs.FK_SUPER {
+			t.Fatalf("fsck of version %v: %v %v", b.val, err,
+				rep.Problems)
+		}
+	}
+	os.Remove(dst)
+}
+
+func TestFSLocks(t *testing.T) {
+	dst := "tmp.img"
+	MkDisk(dst, nil, nlogblks, ninodeblks, ndatablks)
+
+	fmt.Printf("Test FSLocks %v ...\n", dst)
+	tfs := BootFS(dst)
+	fn := ustr.Ustr("f")
+	if e := tfs.MkFile(fn, nil); e != 0 {
+		t.Fatalf("mkfile %v failed %v", fn, e)
+	}
+	open := func() (*fd.Fd_t, fdops.Lockable_i) {
+		f, e := tfs.fs.Fs_open(fn, defs.O_RDWR, 0, tfs.cwd, tfs.cred, 0, 0)
+		if e != 0 {
+			t.Fatalf("open %v failed %v", fn, e)
+		}
+		return f, f.Fops.(fdops.Lockable_i)
+	}
+	f1, l1 := open()
+	f2, l2 := open()
+
+	// a flock lock is shared by the copies of an fd and released when the
+	// last one is closed
+	if e := l1.Flock(defs.LOCK_EX); e != 0 {
+		t.Fatalf("flock failed %v", e)
+	}
+	if e := l2.Flock(defs.LOCK_SH | defs.LOCK_NB); e != -defs.EAGAIN {
+		t.Fatalf("conflicting flock: %v", e)
+	}
+	cpy, e := fd.Copyfd(f1)
+	if e != 0 {
+		t.Fatalf("copyfd failed %v", e)
+	}
+	if e := l1.Flock(defs.LOCK_EX | defs.LOCK_NB); e != 0 {
+		t.Fatalf("flock of the same file failed %v", e)
+	}
+	fd.Close_panic(f1)
+	if e := l2.Flock(defs.LOCK_SH | defs.LOCK_NB); e != -defs.EAGAIN {
+		t.Fatalf("flock after closing a copy: %v", e)
+	}
+	fd.Close_panic(cpy)
+	if e := l2.Flock(defs.LOCK_SH | defs.LOCK_NB); e != 0 {
+		t.Fatalf("flock after close failed %v", e)
+	}
+
+	// record locks are owned by processes and split by unlocking part of
+	// their range
+	f1, l1 = open()
+	reclock := func(l fdops.Lockable_i, pid, cmd, typ, start, len int) defs.Err_t {
+		fl := &fdops.Flock_t{Type: typ, Start: start, Len: len}
+		return l.Reclock(pid, cmd, fl)
+	}
+	if e := reclock(l1, 1, defs.F_SETLK, defs.F_WRLCK, 0, 10); e != 0 {
+		t.Fatalf("setlk failed %v", e)
+	}
+	if e := reclock(l2, 2, defs.F_SETLK, defs.F_RDLCK, 5, 10); e != -defs.EAGAIN {
+		t.Fatalf("conflicting setlk: %v", e)
+	}
+	fl := &fdops.Flock_t{Type: defs.F_RDLCK, Start: 5, Len: 10}
+	if e := l2.Reclock(2, defs.F_GETLK, fl); e != 0 {
+		t.Fatalf("getlk failed %v", e)
+	}
+	if fl.Type != defs.F_WRLCK || fl.Start != 0 || fl.Len != 10 || fl.Pid != 1 {
+		t.Fatalf("getlk returned %v", fl)
+	}
+	if e := reclock(l2, 2, defs.F_SETLK, defs.F_RDLCK, 10, 10); e != 0 {
+		t.Fatalf("adjacent setlk failed %v", e)
+	}
+	if e := reclock(l1, 1, defs.F_SETLK, defs.F_UNLCK, 0, 5); e != 0 {
+		t.Fatalf("unlock failed %v", e)
+	}
+	if e := reclock(l2, 2, defs.F_SETLK, defs.F_RDLCK, 0, 5); e != 0 {
+		t.Fatalf("setlk of unlocked range failed %v", e)
+	}
+	if e := reclock(l2, 2, defs.F_SETLK, defs.F_RDLCK, 5, 1); e != -defs.EAGAIN {
+		t.Fatalf("setlk of the rest of the range: %v", e)
+	}
+
+	// process 1 waits for process 2, so process 2 waiting for process 1
+	// would deadlock
+	done := make(chan defs.Err_t)
+	go func() {
+		done <- reclock(l1, 1, defs.F_SETLKW, defs.F_WRLCK, 10, 1)
+	}()
+	time.Sleep(100 * time.Millisecond)
+	if e := reclock(l2, 2, defs.F_SETLKW, defs.F_WRLCK, 5, 1); e != -defs.EDEADLK {
+		t.Fatalf("deadlocking setlkw: %v", e)
+	}
+	l2.Unlockall(2)
+	if e := <-done; e != 0 {
+		t.Fatalf("setlkw failed %v", e)
+	}
+	if e := reclock(l2, 2, defs.F_SETLK, defs.F_WRLCK, 0, 5); e != 0 {
+		t.Fatalf("setlk after unlockall failed %v", e)
+	}
+	l1.Unlockall(1)
+	if e := reclock(l2, 2, defs.F_SETLK, defs.F_WRLCK, 0, 0); e != 0 {
+		t.Fatalf("setlk of the whole file failed %v", e)
+	}
+	fd.Close_panic(f1)
+	fd.Close_panic(f2)
+
+	ShutdownFS(tfs)
+	os.Remove(dst)
+}
+
+func TestFSSyncpages(t *testing.T) {
+	dst := "tmp.img"
+	MkDisk(dst, nil, nlogblks, ninodeblks, ndatablks)
+
+	fmt.Printf("Test FSSyncpages %v ...\n", dst)
+	tfs := BootFS(dst)
+	fn := ustr.Ustr("f")
+	if e := tfs.MkFile(fn, mkData(1, 2*fs.BSIZE)); e != 0 {
+		t.Fatalf("mkfile %v failed %v", fn, e)
+	}
+	tfs.Sync()
+	f, e := tfs.fs.Fs_open(fn, defs.O_RDWR, 0, tfs.cwd, tfs.cred, 0, 0)
+	if e != 0 {
+		t.Fatalf("open %v failed %v", fn, e)
+	}
+
+	// write to the second page as through a shared mapping
+	mmi, e := f.Fops.Mmapi(fs.BSIZE, fs.BSIZE, true)
+	if e != 0 {
+		t.Fatalf("mmapi failed %v", e)
+	}
+	mem.Pg2bytes(mmi[0].Pg)[0] = 9
+	if e := f.Fops.(fdops.Pagesync_i).Syncpages([]int{fs.BSIZE}, true); e != 0 {
+		t.Fatalf("syncpages failed %v", e)
+	}
+
+	// the write is committed
+	copyDisk(dst, "crash.img")
+	cfs := BootFS("crash.img")
+	d, e := cfs.Read(fn)
+	if e != 0 || len(d) != 2*fs.BSIZE || d[0] != 1 || d[fs.BSIZE] != 9 {
+		t.Fatalf("syncpages didn't commit the page %v", e)
+	}
+	ShutdownFS(cfs)
+	os.Remove("crash.img")
+
+	f.Fops.(mem.Unpin_i).Unpin(mmi[0].Phys)
+	fd.Close_panic(f)
+	ShutdownFS(tfs)
+	os.Remove(dst)
+}
+
+func TestFSSwapfile(t *testing.T) {
+	dst := "tmp.img"
+	MkDisk(dst, nil, nlogblks, ninodeblks, ndatablks)
+
+	fmt.Printf("Test FSSwapfile %v ...\n", dst)
+	tfs := BootFS(dst)
+	fn := ustr.Ustr("swap")
+	if e := tfs.MkFile(fn, mkData(1, 3*fs.BSIZE)); e != 0 {
+		t.Fatalf("mkfile %v failed %v", fn, e)
+	}
+	f, e := tfs.fs.Fs_open(fn, defs.O_RDWR, 0, tfs.cwd, tfs.cred, 0, 0)
+	if e != 0 {
+		t.Fatalf("open %v failed %v", fn, e)
+	}
+	sd, e := fs.Swapfile(f.Fops)
+	if e != 0 {
+		t.Fatalf("swapfile failed %v", e)
+	}
+	if sd.Nslots() != 3 {
+		t.Fatalf("swapfile has %v slots", sd.Nslots())
+	}
+
+	pg := &mem.Pg_t{}
+	mem.Pg2bytes(pg)[0] = 7
+	if e := sd.Swapwrite(2, 0, pg); e != 0 {
+		t.Fatalf("swapwrite failed %v", e)
+	}
+	rpg := &mem.Pg_t{}
+	if e := sd.Swapread(2, 0, rpg); e != 0 || mem.Pg2bytes(rpg)[0] != 7 {
+		t.Fatalf("swapread failed %v", e)
+	}
+
+	// the slot is the file's last block
+	copyDisk(dst, "crash.img")
+	cfs := BootFS("crash.img")
+	d, e := cfs.Read(fn)
+	if e != 0 || len(d) != 3*fs.BSIZE || d[0] != 1 || d[2*fs.BSIZE] != 7 {
+		t.Fatalf("slot isn't the file's block %v", e)
+	}
+	ShutdownFS(cfs)
+	os.Remove("crash.img")
+
+	// the swap file's blocks must not be freed or overwritten
+	if e := tfs.Update(fn, mkData(2, fs.BSIZE)); e != -defs.ETXTBSY {
+		t.Fatalf("open for write of swapfile %v", e)
+	}
+	if _, e := f.Fops.Write(mkData(2, fs.BSIZE)); e != -defs.ETXTBSY {
+		t.Fatalf("write of swapfile %v", e)
+	}
+	if e := f.Fops.Truncate(0); e != -defs.ETXTBSY {
+		t.Fatalf("truncate of swapfile %v", e)
+	}
+	if e := tfs.Unlink(fn); e != -defs.EPERM {
+		t.Fatalf("unlink of swapfile %v", e)
+	}
+	if e := tfs.Rename(fn, ustr.Ustr("x")); e != -defs.EPERM {
+		t.Fatalf("rename of swapfile %v", e)
+	}
+	sd.Release()
+	if e := tfs.Unlink(fn); e != 0 {
+		t.Fatalf("unlink after release %v", e)
+	}
+
+	fd.Close_panic(f)
+	ShutdownFS(tfs)
+	os.Remove(dst)
+}
+
 //
 // Test eviction
 
@@ -486,6 +1414,172 @@ func TestFSBlockReuse(t *testing.T) {
 	os.Remove(dst)
 }
 
+// a file large enough to use the double-indirect block is read back intact and
+// all its blocks are freed when it is unlinked
+func TestFSDindirect(t *testing.T) {
+	dst := "tmp.img"
+	const nblks = fs.NIADDRS + fs.INDADDR + 2*fs.INDADDR
+	MkDisk(dst, nil, nlogblks, ninodeblks, nblks+100)
+
+	fmt.Printf("Test FSDindirect %v ...\n", dst)
+	tfs := BootFS(dst)
+	_, free := tfs.fs.Fs_size()
+	f := ustr.Ustr("f")
+	d := make([]byte, nblks*fs.BSIZE)
+	for i := range d {
+		d[i] = byte(i/fs.BSIZE + i%7)
+	}
+	if e := tfs.MkFile(f, MkBuf(d)); e != 0 {
+		t.Fatalf("MkFile %v failed %v", f, e)
+	}
+	ShutdownFS(tfs)
+
+	tfs = BootFS(dst)
+	r, e := tfs.Read(f)
+	if e != 0 {
+		t.Fatalf("Read %v failed %v", f, e)
+	}
+	if len(r) != len(d) {
+		t.Fatalf("Read %v: short read %v", f, len(r))
+	}
+	for i := range d {
+		if r[i] != d[i] {
+			t.Fatalf("Read %v: wrong data at %v", f, i)
+		}
+	}
+	if e := tfs.Unlink(f); e != 0 {
+		t.Fatalf("Unlink %v failed %v", f, e)
+	}
+	if _, nfree := tfs.fs.Fs_size(); nfree != free {
+		t.Fatalf("blocks not freed %v %v", free, nfree)
+	}
+	ShutdownFS(tfs)
+	os.Remove(dst)
+}
+
+func TestFSTindirect(t *testing.T) {
+	dst := "tmp.img"
+	const tstart = fs.NIADDRS + fs.INDADDR + fs.INDADDR*fs.INDADDR
+	const nblks = tstart + 2
+	MkDisk(dst, nil, nlogblks, ninodeblks, nblks+2*fs.INDADDR)
+
+	fmt.Printf("Test FSTindirect %v ...\n", dst)
+	tfs := BootFS(dst)
+	_, free := tfs.fs.Fs_size()
+	fn := ustr.Ustr("f")
+	f, e := tfs.fs.Fs_open(fn, defs.O_CREAT|defs.O_RDWR, 0, tfs.cwd, tfs.cred, 0, 0)
+	if e != 0 {
+		t.Fatalf("open %v failed %v", fn, e)
+	}
+	// each block holds its block number
+	const chunk = 64
+	d := make([]byte, chunk*fs.BSIZE)
+	for b := 0; b < nblks; b += chunk {
+		n := chunk
+		if nblks-b < n {
+			n = nblks - b
+		}
+		for i := 0; i < n; i++ {
+			util.Writen(d, 8, i*fs.BSIZE, b+i)
+		}
+		if _, e := f.Fops.Write(MkBuf(d[:n*fs.BSIZE])); e != 0 {
+			t.Fatalf("Write %v at block %v failed %v", fn, b, e)
+		}
+	}
+	fd.Close_panic(f)
+	ShutdownFS(tfs)
+
+	tfs = BootFS(dst)
+	f, e = tfs.fs.Fs_open(fn, defs.O_RDONLY, 0, tfs.cwd, tfs.cred, 0, 0)
+	if e != 0 {
+		t.Fatalf("open %v failed %v", fn, e)
+	}
+	for _, b := range []int{0, fs.NIADDRS, tstart - 1, tstart, tstart + 1} {
+		buf := make([]uint8, 8)
+		ub := &vm.Fakeubuf_t{}
+		ub.Fake_init(buf)
+		if n, e := f.Fops.Pread(ub, b*fs.BSIZE); e != 0 || n != len(buf) {
+			t.Fatalf("Pread block %v failed %v", b, e)
+		}
+		if v := util.Readn(buf, 8, 0); v != b {
+			t.Fatalf("block %v holds %v", b, v)
+		}
+	}
+	fd.Close_panic(f)
+	ShutdownFS(tfs)
+
+	rep, err := Fsck(dst, false)
+	if err != nil || rep.Fatal || len(rep.Problems) != 0 {
+		t.Fatalf("fsck: %v %v", err, rep.Problems)
+	}
+	tfs = BootFS(dst)
+	if e := tfs.Unlink(fn); e != 0 {
+		t.Fatalf("Unlink %v failed %v", fn, e)
+	}
+	if _, nfree := tfs.fs.Fs_size(); nfree != free {
+		t.Fatalf("blocks not freed %v %v", free, nfree)
+	}
+	ShutdownFS(tfs)
+	os.Remove(dst)
+}
+
+// returns the direct block addresses of inode inum
+func inodeaddrs(disk string, inum uint) []int {
+	d := fsckopen(disk)
+	defer d.f.Close()
+	start := util.Readn(d.Readblk(0)[:], 4, fs.FSOFF)
+	sb := &fs.Superblock_t{d.Readblk(start)}
+	bn := sb.Freeblock() + sb.Freeblocklen() + int(inum)/(fs.BSIZE/fs.ISIZE)
+	b := d.Readblk(bn)
+	off := int(inum) % (fs.BSIZE / fs.ISIZE) * fs.ISIZE
+	ret := make([]int, fs.NIADDRS)
+	for i := range ret {
+		ret[i] = util.Readn(b[:], 8, off+(7+i)*8)
+	}
+	return ret
+}
+
+func TestFSContig(t *testing.T) {
+	dst := "tmp.img"
+	MkDisk(dst, nil, nlogblks, ninodeblks, 1000)
+
+	fmt.Printf("Test FSContig %v ...\n", dst)
+	tfs := BootFS(dst)
+	names := []ustr.Ustr{ustr.Ustr("a"), ustr.Ustr("b")}
+	for _, n := range names {
+		if e := tfs.MkFile(n, nil); e != 0 {
+			t.Fatalf("MkFile %v failed %v", n, e)
+		}
+	}
+	// files that grow at the same time are still laid out contiguously
+	for i := 0; i < fs.NIADDRS; i++ {
+		for _, n := range names {
+			if e := tfs.Append(n, mkData(uint8(i), fs.BSIZE)); e != 0 {
+				t.Fatalf("Append %v failed %v", n, e)
+			}
+		}
+	}
+	var inums []uint
+	for _, n := range names {
+		st, e := tfs.Stat(n)
+		if e != 0 {
+			t.Fatalf("Stat %v failed %v", n, e)
+		}
+		inums = append(inums, st.Rino())
+	}
+	ShutdownFS(tfs)
+
+	for i, inum := range inums {
+		addrs := inodeaddrs(dst, inum)
+		for j := 1; j < len(addrs); j++ {
+			if addrs[j] != addrs[0]+j {
+				t.Fatalf("%v is not contiguous: %v", names[i], addrs)
+			}
+		}
+	}
+	os.Remove(dst)
+}
+
 //
 // Orphan inodes.  Inodes (and its blocks) should be freed on recovery
 //
@@ -495,7 +1589,7 @@ func doTestOrphans(tfs *Ufs_t, t *testing.T, nfile int) {
 	for i := 0; i < nfile; i++ {
 		fn := ustr.Ustr(uniqfile(i))
 		var err defs.Err_t
-		fds[i], err = tfs.fs.Fs_open(fn, defs.O_CREAT, 0, tfs.fs.MkRootCwd(), 0, 0)
+		fds[i], err = tfs.fs.Fs_open(fn, defs.O_CREAT, 0, tfs.fs.MkRootCwd(), cred.Root, 0, 0)
 		if err != 0 {
 			t.Fatalf("ufs.fs.Fs_open %v failed %v\n", fn, err)
 		}
@@ -504,7 +1598,7 @@ func doTestOrphans(tfs *Ufs_t, t *testing.T, nfile int) {
 		if err != 0 || ub.Remain() != 0 {
 			t.Fatalf("Write %v failed %v %d\n", fn, err, n)
 		}
-		err = tfs.fs.Fs_unlink(fn, tfs.fs.MkRootCwd(), false)
+		err = tfs.fs.Fs_unlink(fn, tfs.fs.MkRootCwd(), cred.Root, false)
 		if err != 0 {
 			t.Fatalf("doUnlink %v failed %v\n", fn, err)
 		}
@@ -588,6 +1682,163 @@ func TestFSOrphansMany(t *testing.T) {
 	os.Remove(dst)
 }
 
+//
+// fsck
+//
+
+func fsckopen(disk string) *fsckdisk_t {
+	f, err := os.OpenFile(disk, os.O_RDWR, 0755)
+	if err != nil {
+		panic(err)
+	}
+	st, err := f.Stat()
+	if err != nil {
+		panic(err)
+	}
+	return &fsckdisk_t{f: f, nblks: int(st.Size() / fs.BSIZE)}
+}
+
+// returns the first data block of inode inum
+func fsckaddr0(d *fsckdisk_t, sb *fs.Superblock_t, inum uint) int {
+	bn := sb.Freeblock() + sb.Freeblocklen() + int(inum)/(fs.BSIZE/fs.ISIZE)
+	b := d.Readblk(bn)
+	off := int(inum) % (fs.BSIZE / fs.ISIZE) * fs.ISIZE
+	return util.Readn(b[:], 8, off+7*8)
+}
+
+// leaks a free block, corrupts the link count of /a, and removes the entry
+// of /d/f
+func fsckcorrupt(disk string, ainum, dinum uint) {
+	d := fsckopen(disk)
+	defer d.f.Close()
+	start := util.Readn(d.Readblk(0)[:], 4, fs.FSOFF)
+	sb := &fs.Superblock_t{d.Readblk(start)}
+
+	// leak the last free data block
+	bm := d.Readblk(sb.Freeblock())
+	for b := ndatablks - 1; b >= 0; b-- {
+		if bm[b/8]&(1<<uint(b%8)) == 0 {
+			bm[b/8] |= 1 << uint(b%8)
+			break
+		}
+	}
+	d.Writeblk(sb.Freeblock(), bm)
+
+	ibn := sb.Freeblock() + sb.Freeblocklen() + int(ainum)/(fs.BSIZE/fs.ISIZE)
+	b := d.Readblk(ibn)
+	off := int(ainum) % (fs.BSIZE / fs.ISIZE) * fs.ISIZE
+	util.Writen(b[:], 8, off+8, 3)
+	d.Writeblk(ibn, b)
+
+	dbn := fsckaddr0(d, sb, dinum)
+	b = d.Readblk(dbn)
+	dd := &fs.Dirdata_t{Data: b[:]}
+	for i := 0; i < fs.NDIRENTS; i++ {
+		if dd.Filename(i).Eq(ustr.Ustr("f")) {
+			dd.W_filename(i, ustr.MkUstr())
+			dd.W_inodenext(i, 0)
+		}
+	}
+	d.Writeblk(dbn, b)
+}
+
+func fsckkinds(rep *fs.Fsckreport_t) map[string]int {
+	ret := make(map[string]int)
+	for _, p := range rep.Problems {
+		ret[p.Kind]++
+	}
+	return ret
+}
+
+func TestFsck(t *testing.T) {
+	dst := "tmp.img"
+	MkDisk(dst, nil, nlogblks, ninodeblks, ndatablks)
+
+	fmt.Printf("Test Fsck %v ...\n", dst)
+	tfs := BootFS(dst)
+	data := make([]byte, 3*fs.BSIZE)
+	for i := range data {
+		data[i] = byte(i % 13)
+	}
+	if e := tfs.MkDir(ustr.Ustr("d")); e != 0 {
+		t.Fatalf("MkDir failed %v", e)
+	}
+	for _, p := range []string{"a", "d/f", "d/g"} {
+		if e := tfs.MkFile(ustr.Ustr(p), MkBuf(data)); e != 0 {
+			t.Fatalf("MkFile %v failed %v", p, e)
+		}
+	}
+	if e := tfs.Symlink(ustr.Ustr("d/g"), ustr.Ustr("s")); e != 0 {
+		t.Fatalf("Symlink failed %v", e)
+	}
+	ast, _ := tfs.Stat(ustr.Ustr("a"))
+	dst1, _ := tfs.Stat(ustr.Ustr("d"))
+	fst, _ := tfs.Stat(ustr.Ustr("d/f"))
+	ShutdownFS(tfs)
+
+	rep, err := Fsck(dst, false)
+	if err != nil || rep.Fatal || len(rep.Problems) != 0 {
+		t.Fatalf("fsck of clean image: %v %v", err, rep.Problems)
+	}
+	if rep.Ndirs != 2 || rep.Nfiles != 3 || rep.Nsymlinks != 1 {
+		t.Fatalf("fsck counts %v %v %v", rep.Ndirs, rep.Nfiles, rep.Nsymlinks)
+	}
+
+	fsckcorrupt(dst, ast.Rino(), dst1.Rino())
+	for i := 0; i < 2; i++ {
+		// checking must not modify the image
+		rep, err = Fsck(dst, false)
+		if err != nil || rep.Fatal {
+			t.Fatalf("fsck failed: %v %v", err, rep.Problems)
+		}
+		k := fsckkinds(rep)
+		if k[fs.FK_NLINK] != 1 || k[fs.FK_UNREACH] != 1 || k[fs.FK_BMAP] != 1 ||
+			len(rep.Problems) != 3 {
+			t.Fatalf("fsck found %v", rep.Problems)
+		}
+		if _, nfixed := rep.Nprobs(); nfixed != 0 {
+			t.Fatalf("fsck fixed problems without repairing")
+		}
+	}
+
+	rep, err = Fsck(dst, true)
+	if nprobs, nfixed := rep.Nprobs(); err != nil || nprobs != 3 || nfixed != 3 {
+		t.Fatalf("fsck repair: %v %v", err, rep.Problems)
+	}
+	rep, err = Fsck(dst, false)
+	if err != nil || len(rep.Problems) != 0 {
+		t.Fatalf("fsck after repair: %v %v", err, rep.Problems)
+	}
+
+	tfs = BootFS(dst)
+	lf := ustr.Ustr(fmt.Sprintf("lost+found/#%d", fst.Rino()))
+	r, e := tfs.Read(lf)
+	if e != 0 || string(r) != string(data) {
+		t.Fatalf("Read %v failed %v", lf, e)
+	}
+	if _, e := tfs.Stat(ustr.Ustr("d/f")); e != -defs.ENOENT {
+		t.Fatalf("d/f still exists %v", e)
+	}
+	// an unlinked but open file is left in the orphan map
+	doTestOrphans(tfs, t, 1)
+	ShutdownFS(tfs)
+
+	rep, err = Fsck(dst, false)
+	if err != nil || len(rep.Problems) != 0 || len(rep.Orphans) != 1 {
+		t.Fatalf("fsck with orphan: %v %v %v", err, rep.Problems, rep.Orphans)
+	}
+	rep, err = Fsck(dst, true)
+	if err != nil || len(rep.Problems) != 0 || len(rep.Orphans) != 1 {
+		t.Fatalf("fsck free orphan: %v %v %v", err, rep.Problems, rep.Orphans)
+	}
+	rep, err = Fsck(dst, false)
+	if err != nil || len(rep.Problems) != 0 || len(rep.Orphans) != 0 ||
+		rep.Logblks != 0 {
+		t.Fatalf("fsck after orphan: %v %v %v", err, rep.Problems, rep.Orphans)
+	}
+	os.Remove(dst)
+}
+
 //
 // Simple concurrent test (for race detector)
 //
@@ -1143,6 +2394,80 @@ func TestTracesAtomic(t *testing.T) {
 	os.Remove(disk)
 }
 
+//
+// Test: a torn log commit is not replayed
+//
+
+// returns the bounds of the log blocks of disk, excluding the log header
+func logbounds(disk string) (int, int) {
+	d := fsckopen(disk)
+	defer d.f.Close()
+	start := util.Readn(d.Readblk(0)[:], 4, fs.FSOFF)
+	sb := &fs.Superblock_t{Data: d.Readblk(start)}
+	return start + 1 + fs.LogOffset, start + 1 + sb.Loglen()
+}
+
+// returns true if record i of trace is a write of a log block after which
+// only log blocks are written; a crash that tears it cannot have started
+// installing its transaction.
+func lastlogwrite(trace trace_t, i, lstart, lend int) bool {
+	for k := i; k < len(trace); k++ {
+		r := trace[k]
+		if r.Cmd != "write" {
+			continue
+		}
+		if r.BlkNo < lstart-fs.LogOffset || r.BlkNo >= lend ||
+			(k == i && r.BlkNo < lstart) {
+			return false
+		}
+	}
+	return true
+}
+
+func TestTracesCksum(t *testing.T) {
+	fmt.Printf("Test TracesCksum ...\n")
+	disk := "disk.img"
+	MkDisk(disk, nil, nlogblks, ninodeblks, ndatablks)
+	produceTrace(disk, t, doAtomicInit, doTestAtomic)
+	trace := readTrace("trace.json")
+	lstart, lend := logbounds(disk)
+	nbad := 0
+	for n := trace.findSync(0); n != -1; n = trace.findSync(n + 1) {
+		// crash at the n-th record with one of the log blocks written
+		// before it torn
+		for i := 0; i < n; i++ {
+			tc := trace.copyTrace(0, n)
+			if !lastlogwrite(tc, i, lstart, lend) {
+				continue
+			}
+			d := tc[i].BlkData
+			for k := len(d) / 2; k < len(d); k++ {
+				d[k] = ^d[k]
+			}
+			dst := "tmp.img"
+			copyDisk(disk, dst)
+			genDisk(tc, dst)
+			tfs := BootFS(dst)
+			nbad += tfs.fs.Fs_nbadcksum()
+			s, ok := doCheckAtomic(tfs)
+			ShutdownFS(tfs)
+			if !ok {
+				t.Fatalf("torn block %v before %v: %v", tc[i].BlkNo, n, s)
+			}
+			rep, err := Fsck(dst, false)
+			if err != nil || len(rep.Problems) != 0 {
+				t.Fatalf("fsck after torn block %v before %v: %v %v",
+					tc[i].BlkNo, n, err, rep.Problems)
+			}
+			os.Remove(dst)
+		}
+	}
+	if nbad == 0 {
+		t.Fatalf("no torn commit detected")
+	}
+	os.Remove(disk)
+}
+
 //
 // Test: big ifree (i.e., several ops, spanning several transactions)
 //
@@ -0,0 +1,594 @@
+package vfs
+
+import "fmt"
+import "sync"
+import "sync/atomic"
+
+import "bpath"
+import "cred"
+import "defs"
+import "fd"
+import "fdops"
+import "stat"
+import "ustr"
+
+// the operations of a file system that can be mounted. paths are resolved
+// relative to cwd, which belongs to the same file system.
+type Fs_i interface {
+	Fs_open(ustr.Ustr, defs.Fdopt_t, int, *fd.Cwd_t, *cred.Cred_t, int, int) (*fd.Fd_t, defs.Err_t)
+	Fs_mknod(ustr.Ustr, defs.Fdopt_t, int, *fd.Cwd_t, *cred.Cred_t, int, int) (defs.Inum_t, defs.Err_t)
+	Fs_mkdir(ustr.Ustr, int, *fd.Cwd_t, *cred.Cred_t) defs.Err_t
+	Fs_unlink(ustr.Ustr, *fd.Cwd_t, *cred.Cred_t, bool) defs.Err_t
+	Fs_rename(ustr.Ustr, ustr.Ustr, *fd.Cwd_t, *cred.Cred_t) defs.Err_t
+	Fs_link(ustr.Ustr, ustr.Ustr, *fd.Cwd_t, *cred.Cred_t) defs.Err_t
+	Fs_symlink(ustr.Ustr, ustr.Ustr, *fd.Cwd_t, *cred.Cred_t) defs.Err_t
+	Fs_readlink(ustr.Ustr, fdops.Userio_i, *fd.Cwd_t, *cred.Cred_t) (int, defs.Err_t)
+	Fs_stat(ustr.Ustr, *stat.Stat_t, *fd.Cwd_t, *cred.Cred_t) defs.Err_t
+	Fs_lstat(ustr.Ustr, *stat.Stat_t, *fd.Cwd_t, *cred.Cred_t) defs.Err_t
+	Fs_chmod(ustr.Ustr, uint, *fd.Cwd_t, *cred.Cred_t) defs.Err_t
+	Fs_chown(ustr.Ustr, int, int, *fd.Cwd_t, *cred.Cred_t) defs.Err_t
+	Fs_utimes(ustr.Ustr, int, int, *fd.Cwd_t, *cred.Cred_t) defs.Err_t
+	Fs_access(ustr.Ustr, uint, *fd.Cwd_t, *cred.Cred_t) defs.Err_t
+	// looks up the absolute, canonical path without following symlinks.
+	// returns the offset in path of the end of the first component that
+	// is a symlink, along with its target, or len(path) and nil if there
+	// is none.
+	Fs_walk(ustr.Ustr, *fd.Cwd_t, *cred.Cred_t) (int, ustr.Ustr, defs.Err_t)
+	Fs_sync() defs.Err_t
+	// returns true if the file system has open files
+	Fs_busy() bool
+	MkRootCwd() *fd.Cwd_t
+	StopFS()
+}
+
+// a file system mounted at a directory
+type mount_t struct {
+	// the canonical path of the mount point
+	path ustr.Ustr
+	fs   Fs_i
+	// what was mounted and its type, for /proc/mounts
+	src    string
+	fstype string
+	// the root directory of fs
+	root *fd.Fd_t
+	// the number of operations in progress on fs, which cannot be
+	// unmounted until they finish
+	ops int64
+}
+
+// ends an operation on m's file system
+func (m *mount_t) release() {
+	atomic.AddInt64(&m.ops, -1)
+}
+
+// the mount table. path syscalls go through Vfs_t, which follows symlinks
+// itself, so that it knows the canonical path of each directory it passes
+// through: a symlink or ".." may cross from one file system into another.
+// each file system reports the first symlink on a path in a single lookup,
+// and ".." is the parent of the canonical path. the file system that holds
+// the resulting path is the one whose mount point is the longest prefix of
+// it.
+type Vfs_t struct {
+	// protects the mount table only; operations on the file systems run
+	// without it and are counted by their mounts instead
+	sync.RWMutex
+	// mounts[0] is the root file system
+	mounts []*mount_t
+}
+
+func MkVfs(root Fs_i, src, fstype string) *Vfs_t {
+	vfs := &Vfs_t{}
+	vfs.mounts = []*mount_t{vfs.mkmount(ustr.MkUstrRoot(), root, src, fstype)}
+	return vfs
+}
+
+func (vfs *Vfs_t) mkmount(path ustr.Ustr, fs Fs_i, src, fstype string) *mount_t {
+	return &mount_t{path: path, fs: fs, root: fs.MkRootCwd().Fd, src: src,
+		fstype: fstype}
+}
+
+// returns true if the canonical path p is at or below mount point mp
+func under(p, mp ustr.Ustr) bool {
+	if len(mp) == 1 {
+		return true
+	}
+	if len(p) < len(mp) || !p[:len(mp)].Eq(mp) {
+		return false
+	}
+	return len(p) == len(mp) || p[len(mp)] == '/'
+}
+
+// maximum number of symlinks followed during a single path lookup, like the
+// file systems' own lookups
+const maxsymlinks = 8
+
+// returns the mount that contains the canonical path p. the caller must hold
+// the vfs lock.
+func (vfs *Vfs_t) _lookup(p ustr.Ustr) *mount_t {
+	ret := vfs.mounts[0]
+	for _, m := range vfs.mounts[1:] {
+		if under(p, m.path) && len(m.path) > len(ret.path) {
+			ret = m
+		}
+	}
+	return ret
+}
+
+// returns the mount that holds the canonical path p, along with the path and
+// cwd to use in its file system. the caller must release the mount once its
+// operation is done.
+func (vfs *Vfs_t) fsof(p ustr.Ustr, cwd *fd.Cwd_t) (*mount_t, ustr.Ustr, *fd.Cwd_t) {
+	vfs.RLock()
+	m := vfs._lookup(p)
+	atomic.AddInt64(&m.ops, 1)
+	vfs.RUnlock()
+	rest := p
+	if len(m.path) != 1 {
+		rest = p[len(m.path):]
+		if len(rest) == 0 {
+			rest = ustr.MkUstrRoot()
+		}
+	}
+	ncwd := fd.MkRootCwd(m.root)
+	ncwd.Setumask(cwd.Umask())
+	return m, rest, ncwd
+}
+
+// returns the canonical path of the directory entry c of the canonical path
+// dir
+func join(dir, c ustr.Ustr) ustr.Ustr {
+	ret := make(ustr.Ustr, 0, len(dir)+1+len(c))
+	ret = append(ret, dir...)
+	if len(dir) != 1 {
+		ret = append(ret, '/')
+	}
+	return append(ret, c...)
+}
+
+// returns the parent of the canonical path dir
+func parent(dir ustr.Ustr) ustr.Ustr {
+	i := len(dir) - 1
+	for i > 0 && dir[i] != '/' {
+		i--
+	}
+	if i == 0 {
+		return ustr.MkUstrRoot()
+	}
+	return dir[:i]
+}
+
+// returns true if p has a component
+func hascomp(p ustr.Ustr) bool {
+	for _, c := range p {
+		if c != '/' {
+			return true
+		}
+	}
+	return false
+}
+
+// checks the components of the canonical path p after its prefix done, which
+// has been checked. returns len(p) and nil if none is a symlink, otherwise the
+// offset in p of the end of the first symlink and its target.
+func (vfs *Vfs_t) walk(done, p ustr.Ustr, cwd *fd.Cwd_t, cr *cred.Cred_t) (int, ustr.Ustr, defs.Err_t) {
+	if len(p) <= len(done) {
+		return len(p), nil, 0
+	}
+	m, rest, c := vfs.fsof(p, cwd)
+	defer m.release()
+	// the components up to a mount point that p crosses are in the file
+	// systems below it
+	if len(m.path) > len(done) {
+		n, target, err := vfs.walk(done, parent(m.path), cwd, cr)
+		if err != 0 || target != nil {
+			return n, target, err
+		}
+	}
+	// a mount point is always a directory
+	if !hascomp(rest) {
+		return len(p), nil, 0
+	}
+	n, target, err := m.fs.Fs_walk(rest, c, cr)
+	if err != 0 {
+		return 0, nil, err
+	}
+	return n + len(p) - len(rest), target, 0
+}
+
+// returns the canonical path, without symlinks, of the file that path names,
+// relative to cwd. ".." is the parent of the directory reached so far, even if
+// a symlink led there, and an absolute symlink target starts at the root of
+// the vfs regardless of the file system that holds the symlink. if follow is
+// false, a symlink in the last component isn't followed and a last "." or ".."
+// is kept, so that the file system sees it. the last component need not
+// exist. the components between two "." or ".." are checked by a single walk
+// of the file system.
+func (vfs *Vfs_t) resolve(path ustr.Ustr, cwd *fd.Cwd_t, cr *cred.Cred_t, follow bool) (ustr.Ustr, defs.Err_t) {
+	todo := path
+	if !path.IsAbsolute() {
+		todo = make(ustr.Ustr, 0, len(cwd.Path)+1+len(path))
+		todo = append(todo, cwd.Path...)
+		todo = append(todo, '/')
+		todo = append(todo, path...)
+	}
+	// like Linux, a trailing slash follows a symlink
+	if len(path) != 0 && path[len(path)-1] == '/' {
+		follow = true
+	}
+	// done has been checked; pend is done followed by components which
+	// haven't been
+	done := ustr.MkUstrRoot()
+	pend := done
+	nlinks := 0
+	var pp bpath.Pathparts_t
+	pp.Pp_init(todo)
+	for {
+		c, ok := pp.Next()
+		last, plain := true, false
+		var left ustr.Ustr
+		if ok {
+			left = todo[pp.Off():]
+			last = !hascomp(todo[pp.Off()+len(c):])
+			plain = !c.Isdot() && !c.Isdotdot() && (!last || follow)
+			if plain {
+				pend = join(pend, c)
+				left = todo[pp.Off()+len(c):]
+				if !last {
+					continue
+				}
+			}
+		}
+		if len(pend) != len(done) {
+			n, target, err := vfs.walk(done, pend, cwd, cr)
+			if err == -defs.ENOENT && plain {
+				// the last component need not exist
+				n, target, err = vfs.walk(done, parent(pend), cwd, cr)
+				if err == 0 && target == nil {
+					n = len(pend)
+				}
+			}
+			if err != 0 {
+				return nil, err
+			}
+			if target != nil {
+				if nlinks++; nlinks > maxsymlinks {
+					return nil, -defs.ELOOP
+				}
+				done = parent(pend[:n])
+				if target.IsAbsolute() {
+					done = ustr.MkUstrRoot()
+				}
+				rest := pend[n:]
+				todo = make(ustr.Ustr, 0, len(target)+len(rest)+1+len(left))
+				todo = append(todo, target...)
+				todo = append(todo, rest...)
+				todo = append(todo, '/')
+				todo = append(todo, left...)
+				pp.Pp_init(todo)
+				pend = done
+				continue
+			}
+			done = pend
+		}
+		if !ok || plain {
+			return done, 0
+		}
+		if last && !follow {
+			return join(done, c), 0
+		}
+		if c.Isdotdot() {
+			done = parent(done)
+		}
+		pend = done
+	}
+}
+
+// resolves path: returns the mount that holds path, along with the path and
+// cwd to use in its file system. follow is like for resolve. the caller must
+// release the mount once its operation is done.
+func (vfs *Vfs_t) namei(path ustr.Ustr, cwd *fd.Cwd_t, cr *cred.Cred_t, follow bool) (*mount_t, ustr.Ustr, *fd.Cwd_t, defs.Err_t) {
+	vfs.RLock()
+	if len(vfs.mounts) == 1 {
+		m := vfs.mounts[0]
+		atomic.AddInt64(&m.ops, 1)
+		vfs.RUnlock()
+		return m, path, cwd, 0
+	}
+	vfs.RUnlock()
+	p, err := vfs.resolve(path, cwd, cr, follow)
+	if err != 0 {
+		return nil, nil, nil, err
+	}
+	m, rest, ncwd := vfs.fsof(p, cwd)
+	return m, rest, ncwd, 0
+}
+
+// resolves path like namei for operations that name two files, which must be
+// in the same file system. neither last component is followed.
+func (vfs *Vfs_t) namei2(p1, p2 ustr.Ustr, cwd *fd.Cwd_t, cr *cred.Cred_t) (*mount_t, ustr.Ustr, ustr.Ustr, *fd.Cwd_t, defs.Err_t) {
+	m1, np1, ncwd, err := vfs.namei(p1, cwd, cr, false)
+	if err != 0 {
+		return nil, nil, nil, nil, err
+	}
+	m2, np2, _, err := vfs.namei(p2, cwd, cr, false)
+	if err != 0 {
+		m1.release()
+		return nil, nil, nil, nil, err
+	}
+	m2.release()
+	if m1 != m2 {
+		m1.release()
+		return nil, nil, nil, nil, -defs.EXDEV
+	}
+	return m1, np1, np2, ncwd, 0
+}
+
+// returns the canonical path, without symlinks, of the file that path names.
+// the last component need not exist.
+func (vfs *Vfs_t) Realpath(path ustr.Ustr, cwd *fd.Cwd_t, cr *cred.Cred_t) (ustr.Ustr, defs.Err_t) {
+	return vfs.resolve(path, cwd, cr, true)
+}
+
+func (vfs *Vfs_t) Fs_open(path ustr.Ustr, flags defs.Fdopt_t, mode int, cwd *fd.Cwd_t, cr *cred.Cred_t, major, minor int) (*fd.Fd_t, defs.Err_t) {
+	// like O_NOFOLLOW, O_CREAT|O_EXCL doesn't follow a last symlink
+	excl := flags&defs.O_CREAT != 0 && flags&defs.O_EXCL != 0
+	m, p, c, err := vfs.namei(path, cwd, cr, flags&defs.O_NOFOLLOW == 0 && !excl)
+	if err != 0 {
+		return nil, err
+	}
+	defer m.release()
+	return m.fs.Fs_open(p, flags, mode, c, cr, major, minor)
+}
+
+func (vfs *Vfs_t) Fs_mknod(path ustr.Ustr, flags defs.Fdopt_t, mode int, cwd *fd.Cwd_t, cr *cred.Cred_t, major, minor int) (defs.Inum_t, defs.Err_t) {
+	m, p, c, err := vfs.namei(path, cwd, cr, false)
+	if err != 0 {
+		return 0, err
+	}
+	defer m.release()
+	return m.fs.Fs_mknod(p, flags, mode, c, cr, major, minor)
+}
+
+func (vfs *Vfs_t) Fs_mkdir(path ustr.Ustr, mode int, cwd *fd.Cwd_t, cr *cred.Cred_t) defs.Err_t {
+	m, p, c, err := vfs.namei(path, cwd, cr, false)
+	if err != 0 {
+		return err
+	}
+	defer m.release()
+	return m.fs.Fs_mkdir(p, mode, c, cr)
+}
+
+func (vfs *Vfs_t) Fs_unlink(path ustr.Ustr, cwd *fd.Cwd_t, cr *cred.Cred_t, wantdir bool) defs.Err_t {
+	if vfs.ismount(path, cwd, cr) {
+		return -defs.EBUSY
+	}
+	m, p, c, err := vfs.namei(path, cwd, cr, false)
+	if err != 0 {
+		return err
+	}
+	defer m.release()
+	return m.fs.Fs_unlink(p, c, cr, wantdir)
+}
+
+func (vfs *Vfs_t) Fs_rename(oldp, newp ustr.Ustr, cwd *fd.Cwd_t, cr *cred.Cred_t) defs.Err_t {
+	if vfs.ismount(oldp, cwd, cr) || vfs.ismount(newp, cwd, cr) {
+		return -defs.EBUSY
+	}
+	m, o, n, c, err := vfs.namei2(oldp, newp, cwd, cr)
+	if err != 0 {
+		return err
+	}
+	defer m.release()
+	return m.fs.Fs_rename(o, n, c, cr)
+}
+
+func (vfs *Vfs_t) Fs_link(old, new ustr.Ustr, cwd *fd.Cwd_t, cr *cred.Cred_t) defs.Err_t {
+	m, o, n, c, err := vfs.namei2(old, new, cwd, cr)
+	if err != 0 {
+		return err
+	}
+	defer m.release()
+	return m.fs.Fs_link(o, n, c, cr)
+}
+
+// the target of a symlink is stored as is
+func (vfs *Vfs_t) Fs_symlink(target, path ustr.Ustr, cwd *fd.Cwd_t, cr *cred.Cred_t) defs.Err_t {
+	m, p, c, err := vfs.namei(path, cwd, cr, false)
+	if err != 0 {
+		return err
+	}
+	defer m.release()
+	return m.fs.Fs_symlink(target, p, c, cr)
+}
+
+func (vfs *Vfs_t) Fs_readlink(path ustr.Ustr, dst fdops.Userio_i, cwd *fd.Cwd_t, cr *cred.Cred_t) (int, defs.Err_t) {
+	m, p, c, err := vfs.namei(path, cwd, cr, false)
+	if err != 0 {
+		return 0, err
+	}
+	defer m.release()
+	return m.fs.Fs_readlink(p, dst, c, cr)
+}
+
+func (vfs *Vfs_t) Fs_stat(path ustr.Ustr, st *stat.Stat_t, cwd *fd.Cwd_t, cr *cred.Cred_t) defs.Err_t {
+	m, p, c, err := vfs.namei(path, cwd, cr, true)
+	if err != 0 {
+		return err
+	}
+	defer m.release()
+	return m.fs.Fs_stat(p, st, c, cr)
+}
+
+func (vfs *Vfs_t) Fs_lstat(path ustr.Ustr, st *stat.Stat_t, cwd *fd.Cwd_t, cr *cred.Cred_t) defs.Err_t {
+	m, p, c, err := vfs.namei(path, cwd, cr, false)
+	if err != 0 {
+		return err
+	}
+	defer m.release()
+	return m.fs.Fs_lstat(p, st, c, cr)
+}
+
+func (vfs *Vfs_t) Fs_chmod(path ustr.Ustr, mode uint, cwd *fd.Cwd_t, cr *cred.Cred_t) defs.Err_t {
+	m, p, c, err := vfs.namei(path, cwd, cr, true)
+	if err != 0 {
+		return err
+	}
+	defer m.release()
+	return m.fs.Fs_chmod(p, mode, c, cr)
+}
+
+func (vfs *Vfs_t) Fs_chown(path ustr.Ustr, uid, gid int, cwd *fd.Cwd_t, cr *cred.Cred_t) defs.Err_t {
+	m, p, c, err := vfs.namei(path, cwd, cr, true)
+	if err != 0 {
+		return err
+	}
+	defer m.release()
+	return m.fs.Fs_chown(p, uid, gid, c, cr)
+}
+
+func (vfs *Vfs_t) Fs_utimes(path ustr.Ustr, atime, mtime int, cwd *fd.Cwd_t, cr *cred.Cred_t) defs.Err_t {
+	m, p, c, err := vfs.namei(path, cwd, cr, true)
+	if err != 0 {
+		return err
+	}
+	defer m.release()
+	return m.fs.Fs_utimes(p, atime, mtime, c, cr)
+}
+
+func (vfs *Vfs_t) Fs_access(path ustr.Ustr, want uint, cwd *fd.Cwd_t, cr *cred.Cred_t) defs.Err_t {
+	m, p, c, err := vfs.namei(path, cwd, cr, true)
+	if err != 0 {
+		return err
+	}
+	defer m.release()
+	return m.fs.Fs_access(p, want, c, cr)
+}
+
+// syncs every mounted file system
+func (vfs *Vfs_t) Fs_sync() defs.Err_t {
+	vfs.RLock()
+	ms := make([]*mount_t, len(vfs.mounts))
+	copy(ms, vfs.mounts)
+	for _, m := range ms {
+		atomic.AddInt64(&m.ops, 1)
+	}
+	vfs.RUnlock()
+	var ret defs.Err_t
+	for _, m := range ms {
+		if err := m.fs.Fs_sync(); err != 0 && ret == 0 {
+			ret = err
+		}
+		m.release()
+	}
+	return ret
+}
+
+// returns true if path, whose last component isn't followed, names a mount
+// point
+func (vfs *Vfs_t) ismount(path ustr.Ustr, cwd *fd.Cwd_t, cr *cred.Cred_t) bool {
+	vfs.RLock()
+	n := len(vfs.mounts)
+	vfs.RUnlock()
+	if n == 1 {
+		return false
+	}
+	p, err := vfs.resolve(path, cwd, cr, false)
+	if err != 0 {
+		return false
+	}
+	vfs.RLock()
+	defer vfs.RUnlock()
+	for _, m := range vfs.mounts {
+		if p.Eq(m.path) {
+			return true
+		}
+	}
+	return false
+}
+
+// mounts fs, of type fstype and made from src, on the directory at path
+func (vfs *Vfs_t) Mount(path ustr.Ustr, fs Fs_i, src, fstype string, cwd *fd.Cwd_t, cr *cred.Cred_t) defs.Err_t {
+	// the mount point is kept without symlinks, as the walk sees it
+	mp, err := vfs.resolve(path, cwd, cr, true)
+	if err != 0 {
+		return err
+	}
+	pm, p, c := vfs.fsof(mp, cwd)
+	dir, err := pm.fs.Fs_open(p, defs.O_RDONLY|defs.O_DIRECTORY, 0, c, cr, 0, 0)
+	pm.release()
+	if err != 0 {
+		return err
+	}
+	fd.Close_panic(dir)
+
+	vfs.Lock()
+	defer vfs.Unlock()
+	// the mount table may have changed since the lookup
+	if vfs._lookup(mp) != pm {
+		return -defs.EBUSY
+	}
+	for _, m := range vfs.mounts {
+		if mp.Eq(m.path) {
+			return -defs.EBUSY
+		}
+	}
+	m := vfs.mkmount(mp, fs, src, fstype)
+	vfs.mounts = append(vfs.mounts, m)
+	return 0
+}
+
+// unmounts the file system mounted at path, returning it so the caller can
+// release its disk. fails with EBUSY if the file system has open files (which
+// includes the cwd of any process inside it), an operation in progress, or
+// another file system mounted on it.
+func (vfs *Vfs_t) Umount(path ustr.Ustr, cwd *fd.Cwd_t) (Fs_i, defs.Err_t) {
+	p, err := vfs.resolve(path, cwd, cred.Root, true)
+	if err != 0 {
+		return nil, err
+	}
+	m, err := vfs._umount(p)
+	if err != 0 {
+		return nil, err
+	}
+	m.fs.Fs_sync()
+	m.fs.StopFS()
+	return m.fs, 0
+}
+
+// removes the mount at the canonical path p from the mount table
+func (vfs *Vfs_t) _umount(p ustr.Ustr) (*mount_t, defs.Err_t) {
+	vfs.Lock()
+	defer vfs.Unlock()
+	found := -1
+	for i, m := range vfs.mounts[1:] {
+		if p.Eq(m.path) {
+			found = i + 1
+		} else if under(m.path, p) {
+			return nil, -defs.EBUSY
+		}
+	}
+	if found == -1 {
+		return nil, -defs.EINVAL
+	}
+	m := vfs.mounts[found]
+	// operations only begin with the lock held, so none can begin on m
+	// once it is out of the table
+	if atomic.LoadInt64(&m.ops) != 0 || m.fs.Fs_busy() {
+		return nil, -defs.EBUSY
+	}
+	copy(vfs.mounts[found:], vfs.mounts[found+1:])
+	vfs.mounts = vfs.mounts[:len(vfs.mounts)-1]
+	return m, 0
+}
+
+// returns the mount table, one mount per line: the source, the mount point,
+// and the type
+func (vfs *Vfs_t) Mounts() string {
+	vfs.RLock()
+	defer vfs.RUnlock()
+	s := ""
+	for _, m := range vfs.mounts {
+		s += fmt.Sprintf("%s %s %s\n", m.src, m.path, m.fstype)
+	}
+	return s
+}
@@ -52,9 +52,15 @@ func (as *Vm_t) Userdmap8_inner(va int, k2u bool) ([]uint8, defs.Err_t) {
 	voff := va & int(PGOFFSET)
 	uva := uintptr(va)
 	vmi, ok := as.Vmregion.Lookup(uva)
-	if !ok {
+	if !ok || vmi.Perms == 0 {
 		return nil, -defs.EFAULT
 	}
+	if huge, err := as._hugefault(vmi, uva, k2u); err != 0 {
+		return nil, err
+	} else if huge {
+		pg, _ := as._hugepg(va)
+		return mem.Pg2bytes(pg)[voff:], 0
+	}
 	pte, ok := vmi.Ptefor(as.Pmap, uva)
 	if !ok {
 		return nil, -defs.ENOMEM
@@ -91,10 +97,34 @@ func (as *Vm_t) Userdmap8_inner(va int, k2u bool) ([]uint8, defs.Err_t) {
 	return bpg[voff:], 0
 }
 
+// returns the physical address of the present user page that maps va,
+// swapping the page in if it was swapped out.
+func (as *Vm_t) Upage(va int) (mem.Pa_t, defs.Err_t) {
+	as.Lockassert_pmap()
+	if pde := pmap_huge(as.Pmap, va); pde != nil {
+		if *pde&PTE_U == 0 {
+			return 0, -defs.EFAULT
+		}
+		_, p_pg := as._hugepg(va)
+		return p_pg, 0
+	}
+	pte := Pmap_lookup(as.Pmap, va)
+	if pte != nil && _isswapent(*pte) {
+		if _, err := as.Userdmap8_inner(va, false); err != 0 {
+			return 0, err
+		}
+	}
+	if pte == nil || *pte&PTE_P == 0 || *pte&PTE_U == 0 {
+		return 0, -defs.EFAULT
+	}
+	return *pte & PTE_ADDR, 0
+}
+
 // _userdmap8 and userdmap8r functions must only be used if concurrent
 // modifications to the address space is impossible.
 func (as *Vm_t) _userdmap8(va int, k2u bool) ([]uint8, defs.Err_t) {
 	as.Lock_pmap()
+	as._swapprefetch(va)
 	ret, err := as.Userdmap8_inner(va, k2u)
 	as.Unlock_pmap()
 	return ret, err
@@ -114,6 +144,7 @@ func (as *Vm_t) usermapped(va, n int) bool {
 
 func (as *Vm_t) Userreadn(va, n int) (int, defs.Err_t) {
 	as.Lock_pmap()
+	as._swapprefetchn(va, n)
 	a, b := as.userreadn_inner(va, n)
 	as.Unlock_pmap()
 	return a, b
@@ -148,6 +179,7 @@ func (as *Vm_t) Userwriten(va, n, val int) defs.Err_t {
 	}
 	as.Lock_pmap()
 	defer as.Unlock_pmap()
+	as._swapprefetchn(va, n)
 	var dst []uint8
 	for i := 0; i < n; i += len(dst) {
 		v := val >> (8 * uint(i))
@@ -171,6 +203,7 @@ func (as *Vm_t) Userstr(uva int, lenmax int) (ustr.Ustr, defs.Err_t) {
 	i := 0
 	s := ustr.MkUstr()
 	for {
+		as._swapprefetch(uva + i)
 		str, err := as.Userdmap8_inner(uva+i, false)
 		if err != 0 {
 			as.Unlock_pmap()
@@ -217,6 +250,7 @@ func (as *Vm_t) Usertimespec(va int) (time.Duration, time.Time, defs.Err_t) {
 // len(src) is not mapped
 func (as *Vm_t) K2user(src []uint8, uva int) defs.Err_t {
 	as.Lock_pmap()
+	as._swapprefetchn(uva, len(src))
 	ret := as.K2user_inner(src, uva)
 	as.Unlock_pmap()
 	return ret
@@ -249,6 +283,7 @@ func (as *Vm_t) K2user_inner(src []uint8, uva int) defs.Err_t {
 // copies len(dst) bytes from userspace address uva to dst
 func (as *Vm_t) User2k(dst []uint8, uva int) defs.Err_t {
 	as.Lock_pmap()
+	as._swapprefetchn(uva, len(dst))
 	ret := as.User2k_inner(dst, uva)
 	as.Unlock_pmap()
 	return ret
@@ -334,14 +369,20 @@ func Sys_pgfault(as *Vm_t, vmi *Vminfo_t, faultaddr, ecode uintptr) defs.Err_t {
 		// runtime.trap(), but just in case
 		panic("kernel page fault")
 	}
-	if vmi.Mtype == VSANON {
-		panic("shared anon pages should always be mapped")
-	}
 
+	if huge, err := as._hugefault(vmi, faultaddr, iswrite); huge || err != 0 {
+		return err
+	}
 	pte, ok := vmi.Ptefor(as.Pmap, faultaddr)
 	if !ok {
 		return -defs.ENOMEM
 	}
+	if _isswapent(*pte) {
+		return as._swapin(vmi, faultaddr, pte)
+	}
+	if vmi.Mtype == VSANON {
+		panic("shared anon pages should always be mapped")
+	}
 	if (iswrite && *pte&PTE_WASCOW != 0) ||
 		(!iswrite && *pte&PTE_P != 0) {
 		// two threads simultaneously faulted on same page
@@ -495,11 +536,13 @@ func (as *Vm_t) _page_insert(va int, p_pg mem.Pa_t, perms mem.Pa_t,
 	}
 	ninval := false
 	var p_old mem.Pa_t
-	if *pte&PTE_P != 0 {
+	if _isswapent(*pte) {
+		_swap.put(_swapslot(*pte))
+	} else if *pte&PTE_P != 0 {
 		if vempty {
 			panic("pte not empty")
 		}
-		if *pte&PTE_U == 0 {
+		if *pte&(PTE_U|PTE_PROTNONE) == 0 {
 			panic("replacing kernel page")
 		}
 		ninval = true
@@ -515,9 +558,21 @@ func (as *Vm_t) _page_insert(va int, p_pg mem.Pa_t, perms mem.Pa_t,
 func (as *Vm_t) Page_remove(va int) bool {
 	as.Lockassert_pmap()
 	remmed := false
+	if pde := pmap_huge(as.Pmap, va); pde != nil {
+		if va&(mem.HUGEPGSIZE-1) != 0 {
+			panic("partial removal of huge page")
+		}
+		mem.Physmem.Hugepg_free(*pde & PTE_ADDR)
+		*pde = 0
+		return true
+	}
 	pte := Pmap_lookup(as.Pmap, va)
-	if pte != nil && *pte&PTE_P != 0 {
-		if *pte&PTE_U == 0 {
+	if pte != nil && _isswapent(*pte) {
+		// the page isn't mapped, so no TLB flush is needed
+		_swap.put(_swapslot(*pte))
+		*pte = 0
+	} else if pte != nil && *pte&PTE_P != 0 {
+		if *pte&(PTE_U|PTE_PROTNONE) == 0 {
 			panic("removing kernel page")
 		}
 		p_old := mem.Pa_t(*pte & PTE_ADDR)
@@ -528,26 +583,217 @@ func (as *Vm_t) Page_remove(va int) bool {
 	return remmed
 }
 
+// returns pte changed to grant the permissions of vmi, which maps it. a page
+// that becomes writable is mapped copy-on-write unless it belongs to a shared
+// mapping or is already the mapping's private copy.
+func _protpte(pte mem.Pa_t, vmi *Vminfo_t) mem.Pa_t {
+	if vmi.Perms == 0 {
+		return pte&^(PTE_U|PTE_W) | PTE_PROTNONE
+	}
+	pte = pte&^PTE_PROTNONE | PTE_U
+	switch {
+	case vmi.Perms&uint(PTE_W) == 0:
+		pte &^= PTE_W
+	case vmi.Mtype == VSANON, vmi.Mtype == VFILE && vmi.file.shared:
+		pte |= PTE_W
+	case pte&(PTE_WASCOW|PTE_COW) == PTE_WASCOW:
+		pte |= PTE_W
+	default:
+		pte |= PTE_COW
+	}
+	return pte
+}
+
+// sets the permissions of [start, start+len) to perms, which are like those
+// of _mkvmi, and changes the ptes of the present pages to match.
+func (as *Vm_t) Mprotect(start, len int, perms mem.Pa_t, novma uint) defs.Err_t {
+	as.Lockassert_pmap()
+	if err := as.Hugesplit(start, len, false); err != 0 {
+		return err
+	}
+	if err := as.Vmregion.Protect(start, len, uint(perms), novma); err != 0 {
+		return err
+	}
+	len = util.Roundup(len, mem.PGSIZE)
+	shoot := false
+	for va := start; va < start+len; va += mem.PGSIZE {
+		pte := pmap_huge(as.Pmap, va)
+		if pte != nil {
+			// the range contains the whole huge page
+			va += mem.HUGEPGSIZE - mem.PGSIZE
+		} else {
+			pte = Pmap_lookup(as.Pmap, va)
+		}
+		if pte == nil || *pte&PTE_P == 0 {
+			continue
+		}
+		vmi, _ := as.Vmregion.Lookup(uintptr(va))
+		if npte := _protpte(*pte, vmi); npte != *pte {
+			*pte = npte
+			shoot = true
+		}
+	}
+	if shoot {
+		as.Tlbshoot(uintptr(start), len>>PGSHIFT)
+	}
+	return 0
+}
+
+// frees the pages of the private mappings in [start, start+len), all of which
+// must be mapped; later accesses fault in zero pages or the file's pages
+// again. the pages of shared mappings are kept since they hold the only copy
+// of data that hasn't been written back.
+func (as *Vm_t) Dontneed(start, len int) defs.Err_t {
+	as.Lockassert_pmap()
+	if !as.Vmregion.Mapped(start, len) {
+		return -defs.ENOMEM
+	}
+	len = util.Roundup(len, mem.PGSIZE)
+	if err := as.Hugesplit(start, len, false); err != 0 {
+		return err
+	}
+	shoot := false
+	for va := start; va < start+len; va += mem.PGSIZE {
+		vmi, _ := as.Vmregion.Lookup(uintptr(va))
+		if vmi.Mtype == VSANON || (vmi.Mtype == VFILE && vmi.file.shared) {
+			continue
+		}
+		if as.Page_remove(va) {
+			shoot = true
+		}
+	}
+	if shoot {
+		as.Tlbshoot(uintptr(start), len>>PGSHIFT)
+	}
+	return 0
+}
+
+// faults in the pages of the file mappings in [start, start+len), all of
+// which must be mapped, so that they are read before they are used. stops
+// quietly at the end of a file.
+func (as *Vm_t) Willneed(start, len int) defs.Err_t {
+	as.Lockassert_pmap()
+	if !as.Vmregion.Mapped(start, len) {
+		return -defs.ENOMEM
+	}
+	for va := start; va < start+len; va += mem.PGSIZE {
+		vmi, _ := as.Vmregion.Lookup(uintptr(va))
+		if vmi.Mtype != VFILE || vmi.Perms == 0 {
+			continue
+		}
+		pte, ok := vmi.Ptefor(as.Pmap, uintptr(va))
+		if !ok {
+			return -defs.ENOMEM
+		}
+		if *pte&PTE_P != 0 {
+			continue
+		}
+		if Sys_pgfault(as, vmi, uintptr(va), uintptr(PTE_U)) != 0 {
+			break
+		}
+	}
+	return 0
+}
+
+// writes back the pages of the shared file mappings in [start, start+len),
+// all of which must be mapped, that were modified through the mappings since
+// they were last written back. if wait is true, waits for the file systems to
+// commit the writes. the dirty pages are found with the pmap lock held, but
+// the writes, which may block, are done without it.
+func (as *Vm_t) Msync(start, len int, wait bool) defs.Err_t {
+	as.Lock_pmap()
+	dirty, err := as._msyncpages(start, len)
+	// the files stay open while they are written even if they are
+	// unmapped meanwhile
+	for mf := range dirty {
+		if err := mf.mfops.Reopen(); err != 0 {
+			delete(dirty, mf)
+		}
+	}
+	as.Unlock_pmap()
+	for mf, offs := range dirty {
+		if ps, ok := mf.mfops.(fdops.Pagesync_i); ok && err == 0 {
+			err = ps.Syncpages(offs, wait)
+		}
+		mf.mfops.Close()
+	}
+	return err
+}
+
+// returns the file offsets of the dirty pages of each file mapped shared in
+// [start, start+len) and clears their dirty bits
+func (as *Vm_t) _msyncpages(start, len int) (map[*Mfile_t][]int, defs.Err_t) {
+	as.Lockassert_pmap()
+	if !as.Vmregion.Mapped(start, len) {
+		return nil, -defs.ENOMEM
+	}
+	len = util.Roundup(len, mem.PGSIZE)
+	// the file offsets of the dirty pages of each mapped file
+	dirty := make(map[*Mfile_t][]int)
+	shoot := false
+	for va := start; va < start+len; va += mem.PGSIZE {
+		vmi, _ := as.Vmregion.Lookup(uintptr(va))
+		if vmi.Mtype != VFILE || !vmi.file.shared {
+			continue
+		}
+		mf := vmi.file.mfile
+		offs := dirty[mf]
+		pte := Pmap_lookup(as.Pmap, va)
+		if pte != nil && *pte&(PTE_P|PTE_D) == PTE_P|PTE_D {
+			// clear the dirty bit so that the next msync(2) only
+			// writes the pages modified after this one
+			*pte &^= PTE_D
+			shoot = true
+			foff := vmi.file.foff + va - int(vmi.Pgn<<PGSHIFT)
+			offs = append(offs, util.Rounddown(foff, mem.PGSIZE))
+		}
+		dirty[mf] = offs
+	}
+	// the CPUs must set the dirty bits again on later writes
+	if shoot {
+		as.Tlbshoot(uintptr(start), len>>PGSHIFT)
+	}
+	return dirty, 0
+}
+
 // returns true if the pagefault was handled successfully
 func (as *Vm_t) Pgfault(tid defs.Tid_t, fa, ecode uintptr) defs.Err_t {
 	as.Lock_pmap()
+	as._swapprefetch(int(fa))
 	vmi, ok := as.Vmregion.Lookup(fa)
 	if !ok {
 		as.Unlock_pmap()
 		return -defs.EFAULT
 	}
 	ret := Sys_pgfault(as, vmi, fa, ecode)
+	if ret == -defs.ENOMEM && _reclaim != nil {
+		// the reclaimer may swap out the pages of any address space,
+		// including this one, so it must not hold the pmap lock
+		as.Unlock_pmap()
+		ok = _reclaim()
+		as.Lock_pmap()
+		if ok {
+			ret = -defs.EFAULT
+			if vmi, ok = as.Vmregion.Lookup(fa); ok {
+				ret = Sys_pgfault(as, vmi, fa, ecode)
+			}
+		}
+	}
 	as.Unlock_pmap()
 	return ret
 }
 
 func (as *Vm_t) Uvmfree() {
+	// the swapper may scan the address space until it is empty
+	as.Lock_pmap()
 	Uvmfree_inner(as.Pmap, as.P_pmap, &as.Vmregion)
+	// close all open mmap'ed files
+	as.Vmregion.Clear()
+	as.Vmregion = Vmregion_t{}
+	as.Unlock_pmap()
 	// Dec_pmap could free the pmap itself. thus it must come after
 	// Uvmfree.
 	mem.Physmem.Dec_pmap(as.P_pmap)
-	// close all open mmap'ed files
-	as.Vmregion.Clear()
 }
 
 func (as *Vm_t) Vmadd_anon(start, len int, perms mem.Pa_t) {
@@ -566,9 +812,11 @@ func (as *Vm_t) Vmadd_shareanon(start, len int, perms mem.Pa_t) {
 	as.Vmregion.insert(vmi)
 }
 
+// writable is true if the file was opened for writing
 func (as *Vm_t) Vmadd_sharefile(start, len int, perms mem.Pa_t, fops fdops.Fdops_i,
-	foff int, unpin mem.Unpin_i) {
+	foff int, unpin mem.Unpin_i, writable bool) {
 	vmi := as._mkvmi(VFILE, start, len, perms, foff, fops, unpin)
+	vmi.file.mfile.writable = writable
 	as.Vmregion.insert(vmi)
 }
 
@@ -0,0 +1,127 @@
+package vm
+
+import "unsafe"
+
+import "defs"
+import "mem"
+import "util"
+
+// maps the huge page-aligned range containing va with a huge page if the range
+// is unmapped and lies within vmi, a private anonymous mapping, and a huge page
+// is free. if write is true and va is mapped by a copy-on-write huge page, the
+// huge page is claimed or copied, or split if no huge page is free. returns
+// true if va is mapped by a huge page that permits the access.
+func (as *Vm_t) _hugefault(vmi *Vminfo_t, va uintptr, write bool) (bool, defs.Err_t) {
+	as.Lockassert_pmap()
+	if vmi.Mtype != VANON || vmi.Perms == 0 {
+		return false, 0
+	}
+	hva := util.Rounddown(int(va), mem.HUGEPGSIZE)
+	start := int(vmi.Pgn << PGSHIFT)
+	end := start + vmi.Pglen<<PGSHIFT
+	if hva < start || hva+mem.HUGEPGSIZE > end {
+		return false, 0
+	}
+	pd, pdb := pmap_pd(as.Pmap, hva, true, PTE_U|PTE_W)
+	if pd == nil {
+		return false, 0
+	}
+	if pd[pdb]&PTE_P != 0 {
+		// the range has a page table or another thread faulted on it
+		// first
+		if pd[pdb]&PTE_PS == 0 {
+			return false, 0
+		}
+		if write && vmi.Perms&uint(PTE_W) == 0 {
+			return false, -defs.EFAULT
+		}
+		if write && pd[pdb]&PTE_COW != 0 {
+			return as._hugecow(vmi, hva, &pd[pdb])
+		}
+		return true, 0
+	}
+	p_pg, ok := mem.Physmem.Hugepg_new()
+	if !ok {
+		return false, 0
+	}
+	perms := _protpte(PTE_U|PTE_WASCOW, vmi)
+	if perms&PTE_W != 0 {
+		perms |= PTE_D
+	}
+	pd[pdb] = p_pg | perms | PTE_A | PTE_PS | PTE_P
+	return true, 0
+}
+
+// handles a write to the copy-on-write huge page that pde maps at hva. the
+// huge page is made writable if no other mapping shares it and is copied to a
+// new huge page otherwise. if no huge page is free, it is split so that the
+// faulting page is copied like any other copy-on-write page.
+func (as *Vm_t) _hugecow(vmi *Vminfo_t, hva int, pde *mem.Pa_t) (bool, defs.Err_t) {
+	p_old := *pde & PTE_ADDR
+	perms := *pde&^(PTE_ADDR|PTE_COW) | PTE_W | PTE_WASCOW | PTE_D
+	if mem.Physmem.Hugepg_owned(p_old) {
+		*pde = p_old | perms
+		as.Tlbshoot(uintptr(hva), mem.HUGEPGS)
+		return true, 0
+	}
+	p_pg, ok := mem.Physmem.Hugepg_new_nozero()
+	if !ok {
+		if err := as.Hugesplit(hva, mem.HUGEPGSIZE, true); err != 0 {
+			return false, err
+		}
+		return false, 0
+	}
+	for i := 0; i < mem.HUGEPGS; i++ {
+		off := mem.Pa_t(i << PGSHIFT)
+		*mem.Physmem.Dmap(p_pg + off) = *mem.Physmem.Dmap(p_old + off)
+	}
+	*pde = p_pg | perms
+	mem.Physmem.Hugepg_free(p_old)
+	as.Tlbshoot(uintptr(hva), mem.HUGEPGS)
+	return true, 0
+}
+
+// returns the page of the huge page that maps va, or nil if va isn't mapped by
+// a huge page
+func (as *Vm_t) _hugepg(va int) (*mem.Pg_t, mem.Pa_t) {
+	pde := pmap_huge(as.Pmap, va)
+	if pde == nil {
+		return nil, 0
+	}
+	off := mem.Pa_t(va & (mem.HUGEPGSIZE - 1) &^ int(PGOFFSET))
+	p_pg := *pde&PTE_ADDR + off
+	return mem.Physmem.Dmap(p_pg), p_pg
+}
+
+// replaces the huge pages that map [start, start+len) with page tables that map
+// the same pages. if all is false, only the huge pages that also map addresses
+// outside of the range are split, like those at the ends of a range that is
+// unmapped.
+func (as *Vm_t) Hugesplit(start, len int, all bool) defs.Err_t {
+	as.Lockassert_pmap()
+	end := start + util.Roundup(len, mem.PGSIZE)
+	for hva := util.Rounddown(start, mem.HUGEPGSIZE); hva < end; hva += mem.HUGEPGSIZE {
+		pde := pmap_huge(as.Pmap, hva)
+		if pde == nil {
+			continue
+		}
+		if !all && hva >= start && hva+mem.HUGEPGSIZE <= end {
+			continue
+		}
+		_, p_pt, ok := mem.Physmem.Refpg_new()
+		if !ok {
+			return -defs.ENOMEM
+		}
+		mem.Physmem.Refup(p_pt)
+		pt := (*mem.Pmap_t)(unsafe.Pointer(mem.Physmem.Dmap(p_pt)))
+		p_pg := *pde & PTE_ADDR
+		flags := *pde & (PTE_FLAGS | PTE_A | PTE_D) &^ PTE_PS
+		for i := range pt {
+			pt[i] = p_pg + mem.Pa_t(i)<<PGSHIFT | flags
+		}
+		mem.Physmem.Hugepg_split(p_pg)
+		*pde = p_pt | PTE_U | PTE_W | PTE_P
+		as.Tlbshoot(uintptr(hva), mem.HUGEPGS)
+	}
+	return 0
+}
@@ -21,14 +21,21 @@ func _instpg(pg *mem.Pmap_t, idx uint, perms mem.Pa_t) (mem.Pa_t, bool) {
 	return npte, true
 }
 
-// returns nil if either 1) create was false and the mapping doesn't exist or
-// 2) create was true but we failed to allocate a page to create the mapping.
-func pmap_pgtbl(pml4 *mem.Pmap_t, v int, create bool, perms mem.Pa_t) (*mem.Pmap_t, int) {
+func _cpe(pe mem.Pa_t) *mem.Pmap_t {
+	if pe&PTE_PS != 0 {
+		panic("insert mapping into PS page")
+	}
+	phys := uintptr(pe & PTE_ADDR)
+	return (*mem.Pmap_t)(unsafe.Pointer(mem.Vdirect + phys))
+}
+
+// returns the page directory and the index of the entry that maps v; the entry
+// maps either a page table or a huge page. returns nil like pmap_pgtbl.
+func pmap_pd(pml4 *mem.Pmap_t, v int, create bool, perms mem.Pa_t) (*mem.Pmap_t, int) {
 	vn := uint(uintptr(v))
 	l4b := (vn >> (12 + 9*3)) & 0x1ff
 	pdpb := (vn >> (12 + 9*2)) & 0x1ff
 	pdb := (vn >> (12 + 9*1)) & 0x1ff
-	ptb := (vn >> (12 + 9*0)) & 0x1ff
 	if l4b >= uint(mem.VREC) && l4b <= uint(mem.VEND) {
 		panic(fmt.Sprintf("map in special slots: %#x", l4b))
 	}
@@ -37,14 +44,7 @@ func pmap_pgtbl(pml4 *mem.Pmap_t, v int, create bool, perms mem.Pa_t) (*mem.Pmap
 		panic("mapping page 0")
 	}
 
-	cpe := func(pe mem.Pa_t) *mem.Pmap_t {
-		if pe&PTE_PS != 0 {
-			panic("insert mapping into PS page")
-		}
-		phys := uintptr(pe & PTE_ADDR)
-		return (*mem.Pmap_t)(unsafe.Pointer(mem.Vdirect + phys))
-	}
-
+	cpe := _cpe
 	var ok bool
 	pe := pml4[l4b]
 	if pe&PTE_P == 0 {
@@ -68,18 +68,39 @@ func pmap_pgtbl(pml4 *mem.Pmap_t, v int, create bool, perms mem.Pa_t) (*mem.Pmap
 		}
 	}
 	next = cpe(pe)
-	pe = next[pdb]
+	return next, int(pdb)
+}
+
+// returns nil if either 1) create was false and the mapping doesn't exist or
+// 2) create was true but we failed to allocate a page to create the mapping.
+func pmap_pgtbl(pml4 *mem.Pmap_t, v int, create bool, perms mem.Pa_t) (*mem.Pmap_t, int) {
+	ptb := (uint(uintptr(v)) >> (12 + 9*0)) & 0x1ff
+	pd, pdb := pmap_pd(pml4, v, create, perms)
+	if pd == nil {
+		return nil, 0
+	}
+	pe := pd[pdb]
 	if pe&PTE_P == 0 {
 		if !create {
 			return nil, 0
 		}
-		pe, ok = _instpg(next, pdb, perms)
+		var ok bool
+		pe, ok = _instpg(pd, uint(pdb), perms)
 		if !ok {
 			return nil, 0
 		}
 	}
-	next = cpe(pe)
-	return next, int(ptb)
+	return _cpe(pe), int(ptb)
+}
+
+// returns the page directory entry of the huge page that maps v, or nil if v
+// isn't mapped by a huge page
+func pmap_huge(pml4 *mem.Pmap_t, v int) *mem.Pa_t {
+	pd, pdb := pmap_pd(pml4, v, false, 0)
+	if pd == nil || pd[pdb]&(PTE_P|PTE_PS) != PTE_P|PTE_PS {
+		return nil
+	}
+	return &pd[pdb]
 }
 
 // requires direct mapping
@@ -106,6 +127,15 @@ func Pmap_lookup(pml4 *mem.Pmap_t, v int) *mem.Pa_t {
 
 func pmfree(pml4 *mem.Pmap_t, start, end uintptr, fops mem.Unpin_i) {
 	for i := start; i < end; {
+		if pde := pmap_huge(pml4, int(i)); pde != nil {
+			// only anonymous mappings, which have no fops, are
+			// backed by huge pages
+			mem.Physmem.Hugepg_free(*pde & PTE_ADDR)
+			*pde = 0
+			i += HUGESIZEW
+			i &^= HUGESIZEW - 1
+			continue
+		}
 		pg, slot := pmap_pgtbl(pml4, int(i), false, 0)
 		if pg == nil {
 			// this level is not mapped; skip to the next va that
@@ -120,8 +150,11 @@ func pmfree(pml4 *mem.Pmap_t, start, end uintptr, fops mem.Unpin_i) {
 			tofree = tofree[:left]
 		}
 		for idx, p_pg := range tofree {
-			if p_pg&PTE_P != 0 {
-				if p_pg&PTE_U == 0 {
+			if _isswapent(p_pg) {
+				_swap.put(_swapslot(p_pg))
+				tofree[idx] = 0
+			} else if p_pg&PTE_P != 0 {
+				if p_pg&(PTE_U|PTE_PROTNONE) == 0 {
 					panic("kernel pages in vminfo?")
 				}
 				pa := p_pg & PTE_ADDR
@@ -145,6 +178,23 @@ func Ptefork(cpmap, ppmap *mem.Pmap_t, start, end int,
 	mkcow := !shared
 	i := start
 	for i < end {
+		if pde := pmap_huge(ppmap, i); pde != nil {
+			// the parent and child share the huge page
+			// copy-on-write
+			cpd, cpdb := pmap_pd(cpmap, i, true, PTE_U|PTE_W)
+			if cpd == nil {
+				return doflush, false
+			}
+			if *pde&(PTE_W|PTE_WASCOW) != 0 {
+				*pde = *pde&^(PTE_W|PTE_WASCOW) | PTE_COW
+				doflush = true
+			}
+			cpd[cpdb] = *pde
+			mem.Physmem.Hugepg_dup(*pde & PTE_ADDR)
+			i += mem.HUGEPGSIZE
+			i &^= mem.HUGEPGSIZE - 1
+			continue
+		}
 		pptb, slot := pmap_pgtbl(ppmap, i, false, 0)
 		if pptb == nil {
 			// skip to next page directory
@@ -165,13 +215,25 @@ func Ptefork(cpmap, ppmap *mem.Pmap_t, start, end int,
 			cs = cs[:left]
 		}
 		for j, pte := range ps {
+			if _isswapent(pte) {
+				if shared {
+					panic("shared pages must be swapped in")
+				}
+				// the parent and child share the swapped-out
+				// page copy-on-write; each reads in its own copy
+				_swap.dup(_swapslot(pte))
+				cs[j] = pte
+				continue
+			}
 			// may be guard pages
 			if pte&PTE_P == 0 {
 				continue
 			}
 			phys := pte & PTE_ADDR
 			flags := pte & PTE_FLAGS
-			if flags&PTE_W != 0 && mkcow {
+			// a private copy made read-only by mprotect(2) is
+			// shared copy-on-write too
+			if flags&(PTE_W|PTE_WASCOW) != 0 && mkcow {
 				flags &^= (PTE_W | PTE_WASCOW)
 				flags |= PTE_COW
 				doflush = true
@@ -179,7 +241,7 @@ func Ptefork(cpmap, ppmap *mem.Pmap_t, start, end int,
 			}
 			cs[j] = phys | flags
 			// XXXPANIC
-			if pte&PTE_U == 0 {
+			if pte&(PTE_U|PTE_PROTNONE) == 0 {
 				panic("huh?")
 			}
 			mem.Physmem.Refup(phys)
@@ -0,0 +1,404 @@
+package vm
+
+import "sync"
+
+import "defs"
+import "mem"
+import "util"
+
+// a disk area that holds swapped-out pages, one page per slot
+type Swapdev_i interface {
+	Nslots() int
+	Swapread(slot int, p_pg mem.Pa_t, pg *mem.Pg_t) defs.Err_t
+	Swapwrite(slot int, p_pg mem.Pa_t, pg *mem.Pg_t) defs.Err_t
+}
+
+// at most this many slots of a swap device are used, which bounds the kernel
+// memory used to track them
+const maxslots = 1 << 20
+
+type swap_t struct {
+	sync.Mutex
+	dev Swapdev_i
+	// the number of swap entries that refer to each slot; a slot is free
+	// once its count is 0
+	refs  []int32
+	nfree int
+	// where to start looking for a free slot
+	next int
+	// the number of pins of physical pages that must not be swapped out
+	pinned map[mem.Pa_t]int
+	// the pages that hold the contents of slots which are being written
+	// out, which could not be written, or which were read in without the
+	// pmap lock. swap-ins copy them instead of reading the swap device.
+	cache map[int]*swpg_t
+}
+
+type swpg_t struct {
+	p_pg mem.Pa_t
+	// the page is being written to its slot
+	writing bool
+}
+
+var _swap = swap_t{pinned: make(map[mem.Pa_t]int),
+	cache: make(map[int]*swpg_t)}
+
+// makes dev the swap device. there is at most one swap device and it cannot
+// be removed.
+func Swapon(dev Swapdev_i) defs.Err_t {
+	n := dev.Nslots()
+	if n <= 0 {
+		return -defs.EINVAL
+	}
+	if n > maxslots {
+		n = maxslots
+	}
+	_swap.Lock()
+	defer _swap.Unlock()
+	if _swap.dev != nil {
+		return -defs.EBUSY
+	}
+	_swap.refs = make([]int32, n)
+	_swap.nfree = n
+	_swap.dev = dev
+	return 0
+}
+
+func Swapping() bool {
+	_swap.Lock()
+	ret := _swap.dev != nil
+	_swap.Unlock()
+	return ret
+}
+
+// returns the number of slots of the swap device and how many of them are
+// free
+func Swapstat() (int, int) {
+	_swap.Lock()
+	defer _swap.Unlock()
+	return len(_swap.refs), _swap.nfree
+}
+
+// keeps the page p_pg from being swapped out until Swapunpin, like a page
+// with a futex that is keyed by its physical address. the pmap lock of an
+// address space that maps the page must be held.
+func Swappin(p_pg mem.Pa_t) {
+	_swap.Lock()
+	_swap.pinned[p_pg]++
+	_swap.Unlock()
+}
+
+func Swapunpin(p_pg mem.Pa_t) {
+	_swap.Lock()
+	_swap.pinned[p_pg]--
+	if _swap.pinned[p_pg] == 0 {
+		delete(_swap.pinned, p_pg)
+	}
+	_swap.Unlock()
+}
+
+func (sw *swap_t) ispinned(p_pg mem.Pa_t) bool {
+	sw.Lock()
+	_, ok := sw.pinned[p_pg]
+	sw.Unlock()
+	return ok
+}
+
+// returns a free slot, referred to by one swap entry. a free slot that is
+// still being written is not reused.
+func (sw *swap_t) alloc() (int, bool) {
+	sw.Lock()
+	defer sw.Unlock()
+	if sw.nfree == 0 {
+		return 0, false
+	}
+	for i := 0; i < len(sw.refs); i++ {
+		slot := sw.next
+		sw.next = (sw.next + 1) % len(sw.refs)
+		if _, ok := sw.cache[slot]; sw.refs[slot] != 0 || ok {
+			continue
+		}
+		sw.refs[slot] = 1
+		sw.nfree--
+		return slot, true
+	}
+	return 0, false
+}
+
+// adds a swap entry that refers to slot
+func (sw *swap_t) dup(slot int) {
+	sw.Lock()
+	if sw.refs[slot] <= 0 {
+		panic("dup of free slot")
+	}
+	sw.refs[slot]++
+	sw.Unlock()
+}
+
+// removes a swap entry that refers to slot
+func (sw *swap_t) put(slot int) {
+	sw.Lock()
+	sw.refs[slot]--
+	switch {
+	case sw.refs[slot] < 0:
+		panic("negative slot ref count")
+	case sw.refs[slot] == 0:
+		sw.nfree++
+		if c, ok := sw.cache[slot]; ok && !c.writing {
+			delete(sw.cache, slot)
+			mem.Physmem.Refdown(c.p_pg)
+		}
+	}
+	sw.Unlock()
+}
+
+// returns a new page with the cached contents of slot, or false if slot is
+// not cached
+func (sw *swap_t) cached(slot int) (mem.Pa_t, bool, defs.Err_t) {
+	sw.Lock()
+	defer sw.Unlock()
+	c, ok := sw.cache[slot]
+	if !ok {
+		return 0, false, 0
+	}
+	pg, p_pg, ok := mem.Physmem.Refpg_new_nozero()
+	if !ok {
+		return 0, true, -defs.ENOMEM
+	}
+	*pg = *mem.Physmem.Dmap(c.p_pg)
+	return p_pg, true, 0
+}
+
+// writes the page that was swapped out to slot, whose reference the swap
+// cache holds. the page stays cached if the write fails.
+func (sw *swap_t) writeout(slot int) {
+	sw.Lock()
+	c := sw.cache[slot]
+	sw.Unlock()
+	err := sw.dev.Swapwrite(slot, c.p_pg, mem.Physmem.Dmap(c.p_pg))
+	sw.Lock()
+	c.writing = false
+	if err == 0 || sw.refs[slot] == 0 {
+		delete(sw.cache, slot)
+		mem.Physmem.Refdown(c.p_pg)
+	}
+	sw.Unlock()
+}
+
+// reads slot into the swap cache. the caller holds a reference to slot.
+func (sw *swap_t) readin(slot int) {
+	sw.Lock()
+	_, ok := sw.cache[slot]
+	sw.Unlock()
+	if ok {
+		return
+	}
+	pg, p_pg, ok := mem.Physmem.Refpg_new_nozero()
+	if !ok {
+		return
+	}
+	mem.Physmem.Refup(p_pg)
+	if sw.dev.Swapread(slot, p_pg, pg) != 0 {
+		mem.Physmem.Refdown(p_pg)
+		return
+	}
+	sw.Lock()
+	if _, ok := sw.cache[slot]; ok {
+		// read in concurrently
+		mem.Physmem.Refdown(p_pg)
+	} else {
+		sw.cache[slot] = &swpg_t{p_pg: p_pg}
+	}
+	sw.Unlock()
+}
+
+// reads the swapped-out page at va, if any, into the swap cache so that the
+// swap-in by the page fault that follows does not read the swap device with
+// the pmap lock held. the caller holds the pmap lock, which is released during
+// the read; the caller must look up the mapping again afterwards.
+func (as *Vm_t) _swapprefetch(va int) {
+	as.Lockassert_pmap()
+	if !Swapping() || pmap_huge(as.Pmap, va) != nil {
+		return
+	}
+	pte := Pmap_lookup(as.Pmap, va)
+	if pte == nil || !_isswapent(*pte) {
+		return
+	}
+	// the reference keeps the slot from being reused during the read
+	slot := _swapslot(*pte)
+	_swap.dup(slot)
+	as.Unlock_pmap()
+	_swap.readin(slot)
+	_swap.put(slot)
+	as.Lock_pmap()
+}
+
+// prefetches the swapped-out pages of [va, va+n)
+func (as *Vm_t) _swapprefetchn(va, n int) {
+	end := va + n
+	for va = util.Rounddown(va, mem.PGSIZE); va < end; va += mem.PGSIZE {
+		as._swapprefetch(va)
+	}
+}
+
+func _swapent(slot int) mem.Pa_t {
+	return mem.Pa_t(slot)<<PGSHIFT | PTE_SWAP
+}
+
+func _isswapent(pte mem.Pa_t) bool {
+	return pte&(PTE_P|PTE_SWAP) == PTE_SWAP
+}
+
+func _swapslot(pte mem.Pa_t) int {
+	return int((pte &^ PTE_SWAP) >> PGSHIFT)
+}
+
+var _reclaim func() bool
+
+// registers f, which the page fault handler calls without any locks held when
+// there are no free user pages. f returns true if it freed pages.
+func Reclaimer(f func() bool) {
+	_reclaim = f
+}
+
+// swaps out up to want of the cold anonymous pages of the address space. a
+// page is cold if it was not accessed since the previous scan; the scan clears
+// the accessed bits of the others. returns the number of pages swapped out and
+// false if there are no free swap slots. the pages are written without the
+// pmap lock.
+func (as *Vm_t) Swapout(want int) (int, bool) {
+	if !Swapping() {
+		return 0, false
+	}
+	var slots []int
+	defer func() {
+		for _, slot := range slots {
+			_swap.writeout(slot)
+		}
+	}()
+	as.Lock_pmap()
+	defer as.Unlock_pmap()
+
+	did := 0
+	free := true
+	as.Vmregion.Iter(func(vmi *Vminfo_t) {
+		if vmi.Mtype != VANON && vmi.Mtype != VSANON {
+			return
+		}
+		start := int(vmi.Pgn << PGSHIFT)
+		end := start + vmi.Pglen<<PGSHIFT
+		for va := start; va < end && did < want && free; va += mem.PGSIZE {
+			if pmap_huge(as.Pmap, va) != nil {
+				// huge pages are not swapped out
+				va = util.Rounddown(va, mem.HUGEPGSIZE) +
+					mem.HUGEPGSIZE - mem.PGSIZE
+				continue
+			}
+			pgtbl, idx := pmap_pgtbl(as.Pmap, va, false, 0)
+			if pgtbl == nil {
+				// skip to the next page table
+				va = util.Rounddown(va, 1<<21) + 1<<21 - mem.PGSIZE
+				continue
+			}
+			var slot int
+			var ok bool
+			slot, ok, free = as._swapout1(va, &pgtbl[idx])
+			if ok {
+				slots = append(slots, slot)
+				did++
+			}
+		}
+	})
+	return did, free
+}
+
+// unmaps the page mapped by pte at va if it is cold and only mapped there,
+// moving it to the swap cache until it is written to the returned slot.
+// returns whether the page was unmapped and false if there are no free swap
+// slots.
+func (as *Vm_t) _swapout1(va int, pte *mem.Pa_t) (int, bool, bool) {
+	if *pte&PTE_P == 0 {
+		return 0, false, true
+	}
+	p_pg := *pte & PTE_ADDR
+	if p_pg == mem.P_zeropg || mem.Physmem.Refcnt(p_pg) != 1 ||
+		_swap.ispinned(p_pg) {
+		return 0, false, true
+	}
+	if *pte&PTE_A != 0 {
+		*pte &^= PTE_A
+		return 0, false, true
+	}
+	slot, ok := _swap.alloc()
+	if !ok {
+		return 0, false, false
+	}
+	// the swap cache takes the mapping's reference to the page
+	_swap.Lock()
+	_swap.cache[slot] = &swpg_t{p_pg: p_pg, writing: true}
+	_swap.Unlock()
+	*pte = _swapent(slot)
+	// no CPU may modify the page while it is written out
+	as.Tlbshoot(uintptr(va), 1)
+	return slot, true, true
+}
+
+// reads the page of the swap entry pte, which maps va of vmi, into a new page.
+// the new page is the mapping's private copy even if fork(2) shared the swap
+// entry copy-on-write.
+func (as *Vm_t) _swapin(vmi *Vminfo_t, va uintptr, pte *mem.Pa_t) defs.Err_t {
+	as.Lockassert_pmap()
+	slot := _swapslot(*pte)
+	p_pg, ok, err := _swap.cached(slot)
+	if err != 0 {
+		return err
+	}
+	if ok {
+		mem.Physmem.Refup(p_pg)
+	} else {
+		// not prefetched; read it with the pmap lock held
+		var pg *mem.Pg_t
+		pg, p_pg, ok = mem.Physmem.Refpg_new_nozero()
+		if !ok {
+			return -defs.ENOMEM
+		}
+		mem.Physmem.Refup(p_pg)
+		if err := _swap.dev.Swapread(slot, p_pg, pg); err != 0 {
+			mem.Physmem.Refdown(p_pg)
+			return err
+		}
+	}
+	_swap.put(slot)
+	perms := PTE_U | PTE_A
+	if vmi.Mtype == VANON {
+		perms |= PTE_WASCOW
+	}
+	perms = _protpte(perms, vmi)
+	if perms&PTE_W != 0 {
+		perms |= PTE_D
+	}
+	*pte = p_pg | perms | PTE_P
+	return 0
+}
+
+// reads the swapped-out pages of vmi back in. the pages of a shared mapping
+// must be swapped in before fork(2) so that the processes share them.
+func (as *Vm_t) Swapin(vmi *Vminfo_t) defs.Err_t {
+	as.Lockassert_pmap()
+	if !Swapping() {
+		return 0
+	}
+	start := vmi.Pgn << PGSHIFT
+	end := start + uintptr(vmi.Pglen)<<PGSHIFT
+	for va := start; va < end; va += PGSIZEW {
+		pte := Pmap_lookup(as.Pmap, int(va))
+		if pte == nil || !_isswapent(*pte) {
+			continue
+		}
+		if err := as._swapin(vmi, va, pte); err != 0 {
+			return err
+		}
+	}
+	return 0
+}
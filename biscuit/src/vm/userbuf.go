@@ -65,6 +65,7 @@ func (ub *Userbuf_t) _tx(buf []uint8, write bool) (int, defs.Err_t) {
 			return ret, -defs.ENOHEAP
 		}
 		va := ub.userva + ub.off
+		ub.as._swapprefetch(va)
 		ubuf, err := ub.as.Userdmap8_inner(va, write)
 		if err != 0 {
 			return ret, err
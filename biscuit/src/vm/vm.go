@@ -5,6 +5,7 @@ import "fmt"
 import "defs"
 import "fdops"
 import "mem"
+import "stat"
 import "util"
 
 //import "fd"
@@ -22,14 +23,23 @@ const PTE_PS mem.Pa_t = 1 << 7
 const PTE_COW mem.Pa_t = 1 << 9
 const PTE_WASCOW mem.Pa_t = 1 << 10
 
+// a present page of a mapping whose permissions are PROT_NONE; PTE_U is clear
+// so that the user cannot access it, but the page remains the user's.
+const PTE_PROTNONE mem.Pa_t = 1 << 11
+
+// a non-present pte with PTE_SWAP set is a swap entry: its page was swapped
+// out to the swap slot in the pte's address bits.
+const PTE_SWAP mem.Pa_t = 1 << 62
+
 const PGSIZEW uintptr = uintptr(mem.PGSIZE)
+const HUGESIZEW uintptr = uintptr(mem.HUGEPGSIZE)
 const PGSHIFT uint = 12
 const PGOFFSET mem.Pa_t = 0xfff
 const PGMASK mem.Pa_t = ^(PGOFFSET)
 const IPGMASK int = ^(int(PGOFFSET))
 const PTE_ADDR mem.Pa_t = PGMASK
 const PTE_FLAGS mem.Pa_t = (PTE_P | PTE_W | PTE_U | PTE_PCD | PTE_PS | PTE_COW |
-	PTE_WASCOW)
+	PTE_WASCOW | PTE_PROTNONE)
 
 type mtype_t uint
 
@@ -45,6 +55,9 @@ const (
 type Mfile_t struct {
 	mfops fdops.Fdops_i
 	unpin mem.Unpin_i
+	// the file was opened for writing, so that a shared mapping of it may
+	// be made writable
+	writable bool
 	// once mapcount is 0, close mfops
 	mapcount int
 }
@@ -87,8 +100,10 @@ func (vmi *Vminfo_t) Filepage(va uintptr) (*mem.Pg_t, mem.Pa_t, defs.Err_t) {
 }
 
 func (vmi *Vminfo_t) Ptefor(pmap *mem.Pmap_t, va uintptr) (*mem.Pa_t, bool) {
-	if vmi.pch == nil {
-		bva := int(vmi.Pgn) << PGSHIFT
+	bva := int(vmi.Pgn) << PGSHIFT
+	// there is no page table to cache if a huge page maps the first pages
+	// of the mapping
+	if vmi.pch == nil && pmap_huge(pmap, bva) == nil {
 		ptbl, slot := pmap_pgtbl(pmap, bva, true, PTE_U|PTE_W)
 		if ptbl == nil {
 			return nil, false
@@ -338,6 +353,45 @@ func (m *Vmregion_t) dump() {
 	})
 }
 
+// returns the mappings, one per line like Linux's /proc/<pid>/maps: the
+// address range, the permissions, the file offset, and the device and inode
+// of a mapped file. the caller must hold the pmap lock.
+func (m *Vmregion_t) Maps() string {
+	s := ""
+	m.Iter(func(vmi *Vminfo_t) {
+		start := vmi.Pgn << PGSHIFT
+		end := (vmi.Pgn + uintptr(vmi.Pglen)) << PGSHIFT
+		// without NX, readable mappings are also executable.
+		// PROT_NONE mappings have no permissions.
+		perms := []uint8("---p")
+		if vmi.Perms&uint(PTE_U) != 0 {
+			perms[0] = 'r'
+			perms[2] = 'x'
+		}
+		if vmi.Perms&uint(PTE_W) != 0 {
+			perms[1] = 'w'
+		}
+		var foff int
+		var dev, ino uint
+		switch vmi.Mtype {
+		case VSANON:
+			perms[3] = 's'
+		case VFILE:
+			if vmi.file.shared {
+				perms[3] = 's'
+			}
+			foff = vmi.file.foff
+			st := &stat.Stat_t{}
+			if vmi.file.mfile.mfops.Fstat(st) == 0 {
+				dev, ino = st.Dev(), st.Rino()
+			}
+		}
+		s += fmt.Sprintf("%012x-%012x %s %08x %d %d\n", start, end,
+			perms, foff, dev, ino)
+	})
+	return s
+}
+
 func (m *Vmregion_t) _iterX(n *Rbn_t, f func(*Vminfo_t)) {
 	if n == nil {
 		return
@@ -478,3 +532,136 @@ func (m *Vmregion_t) Remove(start, len int, novma uint) defs.Err_t {
 	m.Novma++
 	return 0
 }
+
+// returns true if all pages of [start, start+len) are mapped
+func (m *Vmregion_t) Mapped(start, len int) bool {
+	pgn := uintptr(start) >> PGSHIFT
+	end := pgn + uintptr(util.Roundup(len, mem.PGSIZE)>>PGSHIFT)
+	for pgn < end {
+		n := m.rb.lookup(pgn)
+		if n == nil {
+			return false
+		}
+		pgn = n.vmi.Pgn + uintptr(n.vmi.Pglen)
+	}
+	return true
+}
+
+// returns the number of pages of [start, start+len) that are mapped
+func (m *Vmregion_t) Mappedpgs(start, len int) int {
+	pgn := uintptr(start) >> PGSHIFT
+	end := pgn + uintptr(util.Roundup(len, mem.PGSIZE)>>PGSHIFT)
+	ret := 0
+	for ; pgn < end; pgn++ {
+		n := m.rb.lookup(pgn)
+		if n == nil {
+			continue
+		}
+		vend := n.vmi.Pgn + uintptr(n.vmi.Pglen)
+		if vend > end {
+			vend = end
+		}
+		ret += int(vend - pgn)
+		pgn = vend - 1
+	}
+	return ret
+}
+
+// splits the mapping of n at page pgn, which must be inside it, and returns
+// the node of the upper part. the caller must check the vma limit.
+func (m *Vmregion_t) _split(n *Rbn_t, pgn uintptr) *Rbn_t {
+	avmi := n.vmi
+	avmi.Pgn = pgn
+	avmi.Pglen = int(n.vmi.Pgn + uintptr(n.vmi.Pglen) - pgn)
+	avmi.pch = nil
+	if avmi.Mtype == VFILE {
+		avmi.file.foff += int((pgn - n.vmi.Pgn) << PGSHIFT)
+	}
+	n.vmi.Pglen -= avmi.Pglen
+	m.Novma++
+	return m.rb._insert(&avmi)
+}
+
+// merges the mapping that ends at page pgn with the one that starts there if
+// they are alike. file mappings are merged only if they share an Mfile_t, as
+// after a split, so that the open count of the file stays right.
+func (m *Vmregion_t) _mergeat(pgn uintptr) {
+	if pgn == 0 {
+		return
+	}
+	a := m.rb.lookup(pgn - 1)
+	b := m.rb.lookup(pgn)
+	if a == nil || b == nil || a == b || !m._canmerge(&a.vmi, &b.vmi) {
+		return
+	}
+	if a.vmi.Mtype == VFILE && a.vmi.file.mfile != b.vmi.file.mfile {
+		return
+	}
+	// _merge adds the mapcounts of distinct Mfile_ts
+	var mc int
+	if a.vmi.Mtype == VFILE {
+		mc = a.vmi.file.mfile.mapcount
+	}
+	m._merge(&a.vmi, &b.vmi)
+	if a.vmi.Mtype == VFILE {
+		a.vmi.file.mfile.mapcount = mc
+	}
+	m.rb.remove(b)
+	m.Novma--
+}
+
+// sets the permissions of the mapped pages in [start, start+len) to perms,
+// splitting the mappings that extend past the range and merging the ones
+// that become alike. fails with ENOMEM if a page isn't mapped or the splits
+// would exceed novma, and with EACCES if perms allows writes to a shared file
+// mapping of a file that wasn't opened for writing.
+func (m *Vmregion_t) Protect(start, len int, perms uint, novma uint) defs.Err_t {
+	pgn := uintptr(start) >> PGSHIFT
+	end := pgn + uintptr(util.Roundup(len, mem.PGSIZE)>>PGSHIFT)
+	splits := uint(0)
+	for p := pgn; p < end; {
+		n := m.rb.lookup(p)
+		if n == nil {
+			return -defs.ENOMEM
+		}
+		vmi := &n.vmi
+		if perms&uint(PTE_W) != 0 && vmi.Mtype == VFILE &&
+			vmi.file.shared && !vmi.file.mfile.writable {
+			return -defs.EACCES
+		}
+		nend := vmi.Pgn + uintptr(vmi.Pglen)
+		if vmi.Perms != perms {
+			if vmi.Pgn < pgn {
+				splits++
+			}
+			if nend > end {
+				splits++
+			}
+		}
+		p = nend
+	}
+	if m.Novma+splits > novma {
+		return -defs.ENOMEM
+	}
+	for p := pgn; p < end; {
+		n := m.rb.lookup(p)
+		if n.vmi.Perms != perms {
+			if n.vmi.Pgn < p {
+				n = m._split(n, p)
+			}
+			if n.vmi.Pgn+uintptr(n.vmi.Pglen) > end {
+				m._split(n, end)
+			}
+			n.vmi.Perms = perms
+		}
+		p = n.vmi.Pgn + uintptr(n.vmi.Pglen)
+	}
+	// merge at the boundaries of the range and of the mappings inside it
+	for p := end; p > pgn; {
+		n := m.rb.lookup(p - 1)
+		m._mergeat(p)
+		p = n.vmi.Pgn
+	}
+	m._mergeat(pgn)
+	return 0
+}
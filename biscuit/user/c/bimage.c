@@ -100,6 +100,9 @@ int main(int argc, char **argv)
 	int fd;
 	if ((fd = open("/dev/rsd0c", O_WRONLY)) == -1)
 		err(-1, "open");
+	uint64_t disksz;
+	if (ioctl(fd, BLKGETSIZE64, &disksz) == -1)
+		err(-1, "BLKGETSIZE64");
 
 	int s = lstn(31338);
 
@@ -120,6 +123,8 @@ int main(int argc, char **argv)
 			err(-1, "read");
 		if (bs == 0)
 			break;
+		if (did + bs > disksz)
+			errx(-1, "image is larger than the disk");
 		if ((did % blksz) != 0)
 			fprintf(stderr, "slow write\n");
 		if (write(fd, buf, bs) != bs)
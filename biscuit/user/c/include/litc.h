@@ -20,6 +20,7 @@ extern "C" {
 #define		ESRCH		3
 #define		EINTR		4
 #define		EIO		5
+#define		ENXIO		6
 #define		E2BIG		7
 #define		EBADF		9
 #define		ECHILD		10
@@ -37,10 +38,14 @@ extern "C" {
 #define		EINVAL		22
 #define		ENFILE		23
 #define		EMFILE		24
+#define		ENOTTY		25
+#define		ETXTBSY		26
+#define		EFBIG		27
 #define		ENOSPC		28
 #define		ESPIPE		29
 #define		EPIPE		32
 #define		ERANGE		34
+#define		EDEADLK		35
 #define		ENAMETOOLONG	36
 #define		ENOSYS		38
 #define		ENOTEMPTY	39
@@ -56,6 +61,7 @@ extern "C" {
 #define		EHOSTUNREACH	65
 #define		EOVERFLOW	75
 #define		ENOTSOCK	88
+#define		ENOPROTOOPT	92
 #define		EOPNOTSUPP	95
 #define		ECONNRESET	104
 #define		EISCONN		106
@@ -69,6 +75,7 @@ extern "C" {
 
 #define		MAP_SHARED	0x01
 #define		MAP_PRIVATE	0x02
+#define		MAP_FIXED	0x10
 #define		MAP_ANON	0x20
 #define		MAP_ANONYMOUS	MAP_ANON
 
@@ -190,6 +197,8 @@ struct sigaction {
 #define		sigismember(ss, s)	(*ss & (1ull << s))
 	int	sa_flags;
 #define		SA_SIGINFO		1
+#define		SA_NODEFER		2
+#define		SA_RESETHAND		4
 };
 
 struct sockaddr {
@@ -236,6 +245,11 @@ struct stat {
 	blkcnt_t	st_blocks;
 	time_t		st_mtime;
 	ulong		st_mtimensec;
+	time_t		st_atime;
+	ulong		st_atimensec;
+	time_t		st_ctime;
+	ulong		st_ctimensec;
+	gid_t		st_gid;
 };
 
 #define		S_IFMT		(0xffff0000ul)
@@ -254,9 +268,9 @@ struct stat {
 #define		S_ISLNK(mode)	((mode & S_IFMT) == S_IFLNK)
 #define		S_ISBLK(mode)	(MAJOR(mode) == S_IFBLK)
 
-// please never use these
 #define		S_ISUID		(04000)
 #define		S_ISGID		(02000)
+#define		S_ISVTX		(01000)
 #define		S_IRWXU		(00700)
 #define		S_IRUSR		(00400)
 #define		S_IWUSR		(00200)
@@ -281,13 +295,16 @@ int accept(int, struct sockaddr *, socklen_t*);
 // access(2) cannot be a wrapper around stat(2) because access(2) uses real-id
 // instead of effective-id
 int access(const char *, int);
+#define		F_OK	0
 #define		R_OK	(1 << 0)
 #define		W_OK	(1 << 1)
 #define		X_OK	(1 << 2)
 int bind(int, const struct sockaddr *, socklen_t);
 int connect(int, const struct sockaddr *, socklen_t);
 int chmod(const char *, mode_t);
+int chown(const char *, uid_t, gid_t);
 int close(int);
+int coredir(const char *);
 int chdir(const char *);
 int dup(int);
 int dup2(int, int);
@@ -296,15 +313,37 @@ void _exit(int)
 int execv(const char *, char * const[]);
 int execve(const char *, char * const[], char * const[]);
 int execvp(const char *, char * const[]);
+int fchmod(int, mode_t);
+int fchown(int, uid_t, gid_t);
 pid_t fork(void);
 int fstat(int, struct stat *);
 int ftruncate(int, off_t);
+int futimens(int, const struct timespec[2]);
+#define		UTIME_NOW	((1l << 30) - 1)
+#define		UTIME_OMIT	((1l << 30) - 2)
 int futex(const int, void *, void *, int, const struct timespec *);
 #define		FUTEX_SLEEP	1
 #define		FUTEX_WAKE	2
 #define		FUTEX_CNDGIVE	3
 
 char *getcwd(char *, size_t);
+unsigned long getauxval(unsigned long);
+#define		AT_PHDR		3
+#define		AT_PHENT	4
+#define		AT_PHNUM	5
+#define		AT_PAGESZ	6
+#define		AT_BASE		7
+#define		AT_ENTRY	9
+#define		AT_RANDOM	25
+ssize_t getdents(int, void *, size_t);
+gid_t getegid(void);
+uid_t geteuid(void);
+gid_t getgid(void);
+int getgroups(int, gid_t *);
+#define		NGROUPS_MAX	32
+uid_t getuid(void);
+pid_t getpgid(pid_t);
+pid_t getpgrp(void);
 pid_t getpid(void);
 pid_t getppid(void);
 
@@ -319,6 +358,8 @@ int getsockopt(int, int, int, void *, socklen_t *);
 #define		SHUT_WR		(1 << 0)
 #define		SHUT_RD		(1 << 1)
 int shutdown(int, int);
+int shm_open(const char *, int, mode_t);
+int shm_unlink(const char *);
 int gettimeofday(struct timeval *, struct timezone *);
 long gettid(void);
 
@@ -330,10 +371,18 @@ int fcntl(int, int, ...);
 #define		F_SETLK		5
 #define		F_SETLKW	6
 #define		F_SETOWN	7
+#define		F_GETLK		8
 
 #define		FD_CLOEXEC	0x4
 
+int flock(int, int);
+#define		LOCK_SH		1
+#define		LOCK_EX		2
+#define		LOCK_NB		4
+#define		LOCK_UN		8
+
 int kill(int, int);
+int killpg(int, int);
 int link(const char *, const char *);
 int listen(int, int);
 off_t lseek(int, off_t, int);
@@ -341,9 +390,23 @@ off_t lseek(int, off_t, int);
 #define		SEEK_CUR	2
 #define		SEEK_END	4
 
+int madvise(void *, size_t, int);
+#define		MADV_NORMAL	0
+#define		MADV_RANDOM	1
+#define		MADV_SEQUENTIAL	2
+#define		MADV_WILLNEED	3
+#define		MADV_DONTNEED	4
+int memfd_create(const char *, unsigned int);
+#define		MFD_CLOEXEC	(1 << 0)
 int mkdir(const char *, long);
 int mknod(const char *, mode_t, dev_t);
 void *mmap(void *, size_t, int, int, int, long);
+int mount(const char *, const char *, const char *, ulong);
+int mprotect(void *, size_t, int);
+int msync(void *, size_t, int);
+#define		MS_ASYNC	0x1
+#define		MS_INVALIDATE	0x2
+#define		MS_SYNC		0x4
 int munmap(void *, size_t);
 int nanosleep(const struct timespec *, struct timespec *);
 int open(const char *, int, ...);
@@ -356,15 +419,19 @@ int open(const char *, int, ...);
 #define		O_APPEND	0x400
 #define		O_NONBLOCK	0x800
 #define		O_DIRECTORY	0x10000
+#define		O_NOFOLLOW	0x20000
 #define		O_CLOEXEC	0x80000
 
 int pause(void);
+int personality(unsigned long);
+#define		ADDR_NO_RANDOMIZE	0x0040000
 int pipe(int[2]);
 int pipe2(int[2], int);
 int poll(struct pollfd *, nfds_t, int);
 ssize_t pread(int, void *, size_t, off_t);
 ssize_t pwrite(int, const void *, size_t, off_t);
 ssize_t read(int, void*, size_t);
+ssize_t readlink(const char *, char *, size_t);
 ssize_t readv(int, const struct iovec *, int);
 int reboot(void);
 ssize_t recv(int, void *, size_t, int);
@@ -410,11 +477,15 @@ ssize_t send(int, const void *, size_t, int);
 ssize_t sendto(int, const void *, size_t, int, const struct sockaddr *,
     socklen_t);
 ssize_t sendmsg(int, struct msghdr *, int);
+int setgid(gid_t);
+int setgroups(size_t, const gid_t *);
+int setpgid(pid_t, pid_t);
 int setrlimit(int, const struct rlimit *);
 pid_t setsid(void);
+int setuid(uid_t);
 // levels
 #define		SOL_SOCKET	1
-#define		IPPROTO_TCP	2
+#define		IPPROTO_TCP	6
 // socket options
 #define		SO_SNDBUF	1
 #define		SO_SNDTIMEO	2
@@ -434,11 +505,23 @@ struct linger {
 };
 // TCP options
 #define		TCP_NODELAY	20
+#define		TCP_INFO	21
+// windows are in bytes, times in milliseconds
+struct tcp_info {
+	uint		tcpi_state;
+	uint		tcpi_snd_mss;
+	uint		tcpi_snd_cwnd;
+	uint		tcpi_snd_ssthresh;
+	uint		tcpi_rtt;
+	uint		tcpi_rttvar;
+	uint		tcpi_rto;
+};
 int sigaction(int, const struct sigaction *, struct sigaction *);
 #define		SIGHUP		1
 #define		SIGINT		2
 #define		SIGQUIT		3
 #define		SIGILL		4
+#define		SIGFPE		8
 #define		SIGKILL		9
 #define		SIGUSR1		10
 #define		SIGSEGV		11
@@ -447,7 +530,11 @@ int sigaction(int, const struct sigaction *, struct sigaction *);
 #define		SIGALRM		14
 #define		SIGTERM		15
 #define		SIGSTOP		17
+#define		SIGTSTP		18
+#define		SIGCONT		19
 #define		SIGCHLD		20
+#define		SIGTTIN		21
+#define		SIGTTOU		22
 #define		SIGIO		23
 #define		SIGWINCH	28
 #define		SIGUSR2		31
@@ -457,6 +544,15 @@ void (*signal(int, void (*)(int)))(int);
 #define		SIG_BLOCK	1
 #define		SIG_SETMASK	2
 #define		SIG_UNBLOCK	3
+#define		SI_USER		0
+#define		SI_KERNEL	0x80
+#define		SEGV_MAPERR	1
+#define		SEGV_ACCERR	2
+#define		CLD_EXITED	1
+#define		CLD_KILLED	2
+#define		CLD_DUMPED	3
+#define		CLD_STOPPED	5
+#define		CLD_CONTINUED	6
 int socket(int, int, int);
 #define		AF_UNIX		1
 #define		AF_LOCAL	AF_UNIX
@@ -470,6 +566,8 @@ int socket(int, int, int);
 #define		SOCK_NONBLOCK	(1 << 5)
 
 int stat(const char *, struct stat *);
+int swapon(const char *, int);
+int symlink(const char *, const char *);
 int sync(void);
 long sys_prof(long, long, long, long);
 #define		PROF_DISABLE   (1ul << 0)
@@ -532,6 +630,9 @@ pid_t wait4(pid_t, int *, int, struct rusage *);
 #define		WIFSIGNALED(x)		(x & (1 << 11))
 #define		WEXITSTATUS(x)		(x & 0xff)
 #define		WTERMSIG(x)		((int)((uint)x >> 27) & 0x1f)
+#define		WCOREDUMP(x)		(x & (1 << 12))
+#define		WIFSTOPPED(x)		(x & (1 << 13))
+#define		WSTOPSIG(x)		WTERMSIG(x)
 ssize_t write(int, const void*, size_t);
 ssize_t writev(int, const struct iovec *, int);
 
@@ -673,14 +774,27 @@ int posix_spawn_file_actions_init(posix_spawn_file_actions_t *);
 #define		_POSIX_NAME_MAX	14
 struct dirent {
 	ino_t d_ino;
-	char d_name[_POSIX_NAME_MAX];
+	// cookie of the next entry; see seekdir
+	long d_off;
+	uchar d_type;
+	char d_name[_POSIX_NAME_MAX + 1];
 };
 
+#define		DT_UNKNOWN	0
+#define		DT_CHR		2
+#define		DT_DIR		4
+#define		DT_REG		8
+#define		DT_LNK		10
+#define		DT_SOCK		12
+
 typedef struct {
 	int fd;
-	uint cent;
-	uint nent;
-	struct dirent dents[];
+	// offset and length of the unread getdents records in buf
+	uint boff;
+	uint blen;
+	// cookie of the next entry
+	long loc;
+	char buf[2048];
 } DIR;
 
 extern __thread int errno;
@@ -758,6 +872,7 @@ FILE *fopen(const char *, const char *);
 int fprintf(FILE *, const char *, ...)
     __attribute__((format(printf, 2, 3)));
 int fsync(int);
+int fdatasync(int);
 //int fputs(const char *, FILE *); /*REDIS*/
 size_t fread(void *, size_t, size_t, FILE *);
 off_t ftello(FILE *);
@@ -818,6 +933,7 @@ struct dirent *readdir(DIR *);
 int readdir_r(DIR *, struct dirent *, struct dirent **);
 char *readline(const char *);
 void rewinddir(DIR *);
+void seekdir(DIR *, long);
 //int scanf(const char *, ...) /*REDIS*/
 //    __attribute__((format(scanf, 1, 2))); /*REDIS*/
 int setenv(const char *, const char *, int);
@@ -871,6 +987,7 @@ void syslog(int, const char *, ...);
 #define		LOG_LOCAL7	(1ull << 15)
 #define		LOG_USER	(1ull << 16)
 #define		LOG_ALL		(0x1ffff)
+long telldir(DIR *);
 time_t time(time_t*);
 int tolower(int);
 int toupper(int);
@@ -897,7 +1014,6 @@ extern char **environ;
 
 /* NGINX STUFF */
 char *getenv(char *);
-uid_t geteuid(void);
 
 struct passwd {
 	char *pw_name;
@@ -926,7 +1042,6 @@ struct hostent {
 };
 
 struct hostent *gethostbyname(const char *);
-int chown(const char *, uid_t, gid_t);
 time_t mktime(struct tm *);
 int getpeername(int, struct sockaddr *, socklen_t *);
 int getsockname(int, struct sockaddr *, socklen_t *);
@@ -959,6 +1074,7 @@ void globfree(glob_t *);
 
 struct flock {
 	short	l_type;
+#define		F_RDLCK		0
 #define		F_WRLCK		1
 #define		F_UNLCK		2
 	short	l_whence;
@@ -970,9 +1086,88 @@ struct flock {
 int socketpair(int, int, int, int[2]);
 int ioctl(int, ulong, ...);
 #define		FIOASYNC	3
+#define		FIONREAD	0x541b
+#define		FIONBIO		0x5421
+#define		BLKGETSIZE	0x1260
+#define		BLKSSZGET	0x1268
+#define		BLKGETSIZE64	0x80081272
+#define		TCGETS		0x5401
+#define		TCSETS		0x5402
+#define		TCSETSW		0x5403
+#define		TCSETSF		0x5404
+#define		TIOCSCTTY	0x540e
+#define		TIOCGPGRP	0x540f
+#define		TIOCSPGRP	0x5410
+#define		TIOCGWINSZ	0x5413
+#define		TIOCSWINSZ	0x5414
+#define		TIOCGPTN	0x80045430
+#define		TIOCSPTLCK	0x40045431
+
+struct winsize {
+	unsigned short	ws_row;
+	unsigned short	ws_col;
+	unsigned short	ws_xpixel;
+	unsigned short	ws_ypixel;
+};
+
+typedef uint32_t tcflag_t;
+typedef uint8_t cc_t;
+#define		NCCS		19
+struct termios {
+	tcflag_t	c_iflag;
+#define		ISTRIP		0x20
+#define		INLCR		0x40
+#define		IGNCR		0x80
+#define		ICRNL		0x100
+	tcflag_t	c_oflag;
+#define		OPOST		0x1
+#define		ONLCR		0x4
+	tcflag_t	c_cflag;
+#define		B38400		0xf
+#define		CS8		0x30
+#define		CREAD		0x80
+	tcflag_t	c_lflag;
+#define		ISIG		0x1
+#define		ICANON		0x2
+#define		ECHO		0x8
+#define		ECHOE		0x10
+#define		ECHOK		0x20
+#define		ECHONL		0x40
+#define		NOFLSH		0x80
+#define		TOSTOP		0x100
+#define		ECHOCTL		0x200
+#define		IEXTEN		0x8000
+	cc_t		c_line;
+	cc_t		c_cc[NCCS];
+#define		VINTR		0
+#define		VQUIT		1
+#define		VERASE		2
+#define		VKILL		3
+#define		VEOF		4
+#define		VTIME		5
+#define		VMIN		6
+#define		VSUSP		10
+#define		VEOL		11
+};
+
+void cfmakeraw(struct termios *);
+int isatty(int);
+int tcgetattr(int, struct termios *);
+int tcsetattr(int, int, const struct termios *);
+#define		TCSANOW		0
+#define		TCSADRAIN	1
+#define		TCSAFLUSH	2
+pid_t tcgetpgrp(int);
+int tcsetpgrp(int, pid_t);
+
+int grantpt(int);
+int posix_openpt(int);
+char *ptsname(int);
+int unlockpt(int);
 
 int raise(int);
 mode_t umask(mode_t);
+int umount(const char *);
 int getpagesize(void);
 int sigprocmask(int, sigset_t *, sigset_t *);
 int sigsuspend(const sigset_t *);
@@ -980,9 +1175,6 @@ int sigsuspend(const sigset_t *);
 int setpriority(int, int, int);
 #define		PRIO_PROCESS	1
 
-uid_t getuid(void);
-int setuid(uid_t);
-int setgid(gid_t);
 int initgroups(const char *, gid_t);
 
 #define		MSG_PEEK	1
@@ -46,23 +46,37 @@ int main(int argc, char **argv)
 	printf("init starting...\n");
 
 	// create dev nodes
-	mkdir("/dev", 0);
+	mode_t omask = umask(0);
+	mkdir("/dev", 0755);
 	int ret;
-	ret = mknod("/dev/console", 0, MKDEV(1, 0));
+	ret = mknod("/dev/console", 0666, MKDEV(1, 0));
 	if (ret != 0 && errno != EEXIST)
 		err(-1, "mknod");
-	ret = mknod("/dev/null", 0, MKDEV(4, 0));
+	ret = mknod("/dev/null", 0666, MKDEV(4, 0));
 	if (ret != 0 && errno != EEXIST)
 		err(-1, "mknod");
-	ret = mknod("/dev/rsd0c", 0, MKDEV(5, 0));
+	ret = mknod("/dev/rsd0c", 0600, MKDEV(5, 0));
 	if (ret != 0 && errno != EEXIST)
 		err(-1, "mknod");
-	ret = mknod("/dev/stats", 0, MKDEV(6, 0));
+	ret = mknod("/dev/stats", 0444, MKDEV(6, 0));
 	if (ret != 0 && errno != EEXIST)
 		err(-1, "mknod");
-	ret = mknod("/dev/prof", 0, MKDEV(7, 0));
+	ret = mknod("/dev/prof", 0644, MKDEV(7, 0));
 	if (ret != 0 && errno != EEXIST)
 		err(-1, "mknod");
+	ret = mknod("/dev/ptmx", 0666, MKDEV(8, 0));
+	if (ret != 0 && errno != EEXIST)
+		err(-1, "mknod");
+	mkdir("/dev/pts", 0755);
+	int i;
+	for (i = 0; i < 16; i++) {
+		char buf[32];
+		snprintf(buf, sizeof(buf), "/dev/pts/%d", i);
+		ret = mknod(buf, 0620, MKDEV(9, i));
+		if (ret != 0 && errno != EEXIST)
+			err(-1, "mknod");
+	}
+	umask(omask);
 
 	char * const largs [] = {"/bin/bmgc", "-l", "512", NULL};
 	fexec(largs);
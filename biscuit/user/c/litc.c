@@ -7,14 +7,21 @@
 #define SYS_CLOSE        3
 #define SYS_STAT         4
 #define SYS_FSTAT        5
+#define SYS_LSTAT        6
 #define SYS_POLL         7
 #define SYS_LSEEK        8
 #define SYS_MMAP         9
+#define SYS_MPROTECT     10
 #define SYS_MUNMAP       11
 #define SYS_SIGACTION    13
+#define SYS_SIGPROCMASK  14
+#define SYS_SIGRETURN    15
+#define SYS_IOCTL        16
 #define SYS_READV        19
 #define SYS_WRITEV       20
 #define SYS_ACCESS       21
+#define SYS_MSYNC        26
+#define SYS_MADVISE      28
 #define SYS_DUP2         33
 #define SYS_PAUSE        34
 #define SYS_GETPID       39
@@ -38,6 +45,9 @@
 #define SYS_WAIT4        61
 #define SYS_KILL         62
 #define SYS_FCNTL        72
+#define SYS_FLOCK        73
+#define SYS_FSYNC        74
+#define SYS_FDATASYNC    75
 #define SYS_TRUNC        76
 #define SYS_FTRUNC       77
 #define SYS_GETCWD       79
@@ -46,15 +56,40 @@
 #define SYS_MKDIR        83
 #define SYS_LINK         86
 #define SYS_UNLINK       87
+#define SYS_SYMLINK      88
+#define SYS_READLINK     89
+#define SYS_CHMOD        90
+#define SYS_FCHMOD       91
+#define SYS_CHOWN        92
+#define SYS_FCHOWN       93
+#define SYS_UMASK        95
 #define SYS_GETTOD       96
 #define SYS_GETRLIMIT    97
 #define SYS_GETRUSAGE    98
+#define SYS_GETUID       102
+#define SYS_GETGID       104
+#define SYS_SETUID       105
+#define SYS_SETGID       106
+#define SYS_GETEUID      107
+#define SYS_GETEGID      108
+#define SYS_SETPGID      109
+#define SYS_SETSID       112
+#define SYS_GETGROUPS    115
+#define SYS_SETGROUPS    116
+#define SYS_GETPGID      121
 #define SYS_MKNOD        133
+#define SYS_PERSONA      135
 #define SYS_SETRLIMIT    160
 #define SYS_SYNC         162
+#define SYS_MOUNT        165
+#define SYS_UMOUNT       166
+#define SYS_SWAPON       167
 #define SYS_REBOOT       169
+#define SYS_GETDENTS     217
 #define SYS_NANOSLEEP    230
+#define SYS_UTIMES       235
 #define SYS_PIPE2        293
+#define SYS_MEMFD        319
 #define SYS_PROF         31337
 #define SYS_THREXIT      31338
 #define SYS_INFO         31339
@@ -62,6 +97,8 @@
 #define SYS_PWRITE       31341
 #define SYS_FUTEX        31342
 #define SYS_GETTID       31343
+#define SYS_FUTIMENS     31344
+#define SYS_COREDIR      31345
 
 __thread int errno;
 
@@ -74,6 +111,8 @@ struct kinfo_t {
 	size_t len;
 	void *t0tls;
 	ulong pspercycle;
+	// the auxiliary vector: pairs of type and value, ending with type 0
+	ulong *auxv;
 };
 
 // initialized in _entry, given to us by kernel
@@ -185,8 +224,25 @@ connect(int fd, const struct sockaddr *sa, socklen_t salen)
 int
 chmod(const char *path, mode_t mode)
 {
-	printf("warning: chmod is a no-op\n");
-	return 0;
+	int ret = syscall(SA(path), SA(mode), 0, 0, 0, SYS_CHMOD);
+	ERRNO_NZ(ret);
+	return ret;
+}
+
+int
+chown(const char *path, uid_t uid, gid_t gid)
+{
+	int ret = syscall(SA(path), SA(uid), SA(gid), 0, 0, SYS_CHOWN);
+	ERRNO_NZ(ret);
+	return ret;
+}
+
+int
+coredir(const char *dir)
+{
+	int ret = syscall(SA(dir), 0, 0, 0, 0, SYS_COREDIR);
+	ERRNO_NZ(ret);
+	return ret;
 }
 
 int
@@ -255,6 +311,22 @@ execvp(const char *path, char * const argv[])
 	return execv(p, argv);
 }
 
+int
+fchmod(int fd, mode_t mode)
+{
+	int ret = syscall(SA(fd), SA(mode), 0, 0, 0, SYS_FCHMOD);
+	ERRNO_NZ(ret);
+	return ret;
+}
+
+int
+fchown(int fd, uid_t uid, gid_t gid)
+{
+	int ret = syscall(SA(fd), SA(uid), SA(gid), 0, 0, SYS_FCHOWN);
+	ERRNO_NZ(ret);
+	return ret;
+}
+
 int
 fcntl(int fd, int cmd, ...)
 {
@@ -275,6 +347,15 @@ fcntl(int fd, int cmd, ...)
 		ERRNO_NEG(ret);
 		break;
 	}
+	case F_GETLK:
+	case F_SETLK:
+	case F_SETLKW:
+	{
+		struct flock *fl = va_arg(ap, struct flock *);
+		ret = syscall(a1, a2, SA(fl), 0, 0, SYS_FCNTL);
+		ERRNO_NZ(ret);
+		break;
+	}
 	case F_SETOWN:
 	{
 		fprintf(stderr, "warning: F_SETOWN is no-op\n");
@@ -288,6 +369,14 @@ fcntl(int fd, int cmd, ...)
 	return ret;
 }
 
+int
+flock(int fd, int how)
+{
+	int ret = syscall(SA(fd), SA(how), 0, 0, 0, SYS_FLOCK);
+	ERRNO_NZ(ret);
+	return ret;
+}
+
 pid_t
 fork(void)
 {
@@ -315,6 +404,71 @@ getcwd(char *buf, size_t sz)
 	return buf;
 }
 
+unsigned long
+getauxval(unsigned long type)
+{
+	ulong *a;
+	for (a = kinfo->auxv; a[0] != 0; a += 2)
+		if (a[0] == type)
+			return a[1];
+	errno = ENOENT;
+	return 0;
+}
+
+ssize_t
+getdents(int fd, void *buf, size_t sz)
+{
+	ssize_t ret = syscall(SA(fd), SA(buf), SA(sz), 0, 0, SYS_GETDENTS);
+	ERRNO_NEG(ret);
+	return ret;
+}
+
+uid_t
+getuid(void)
+{
+	return syscall(0, 0, 0, 0, 0, SYS_GETUID);
+}
+
+uid_t
+geteuid(void)
+{
+	return syscall(0, 0, 0, 0, 0, SYS_GETEUID);
+}
+
+gid_t
+getgid(void)
+{
+	return syscall(0, 0, 0, 0, 0, SYS_GETGID);
+}
+
+gid_t
+getegid(void)
+{
+	return syscall(0, 0, 0, 0, 0, SYS_GETEGID);
+}
+
+int
+getgroups(int n, gid_t *groups)
+{
+	int ret = syscall(SA(n), SA(groups), 0, 0, 0, SYS_GETGROUPS);
+	ERRNO_NEG(ret);
+	return ret;
+}
+
+pid_t
+getpgid(pid_t pid)
+{
+	pid_t ret = syscall(SA(pid), 0, 0, 0, 0, SYS_GETPGID);
+	ERRNO_NEG(ret);
+	return ret;
+}
+
+pid_t
+getpgrp(void)
+{
+	return getpgid(0);
+}
+
 pid_t
 getpid(void)
 {
@@ -387,17 +541,47 @@ getrusage(int who, struct rusage *r)
 }
 
 int
-kill(int pid, int sig)
+ioctl(int fd, ulong req, ...)
 {
-	if (sig != SIGKILL) {
-		printf("%s: kill: only SIGKILL is supported\n", __progname);
-		return -1;
+	// nginx sets FIOASYNC, which is not supported, on its sockets
+	if (req == FIOASYNC) {
+		fprintf(stderr, "warning: FIOASYNC is a no-op\n");
+		return 0;
 	}
+	va_list ap;
+	va_start(ap, req);
+	long arg = va_arg(ap, long);
+	va_end(ap);
+	int ret = syscall(SA(fd), SA(req), SA(arg), 0, 0, SYS_IOCTL);
+	ERRNO_NZ(ret);
+	return ret;
+}
+
+int
+isatty(int fd)
+{
+	struct termios t;
+	return tcgetattr(fd, &t) == 0;
+}
+
+int
+kill(int pid, int sig)
+{
 	int ret = syscall(SA(pid), SA(sig), 0, 0, 0, SYS_KILL);
 	ERRNO_NZ(ret);
 	return ret;
 }
 
+int
+killpg(int pgrp, int sig)
+{
+	if (pgrp <= 1) {
+		errno = EINVAL;
+		return -1;
+	}
+	return kill(-pgrp, sig);
+}
+
 int
 link(const char *old, const char *new)
 {
@@ -406,6 +590,14 @@ link(const char *old, const char *new)
 	return ret;
 }
 
+int
+lstat(const char *path, struct stat *st)
+{
+	int ret = syscall(SA(path), SA(st), 0, 0, 0, SYS_LSTAT);
+	ERRNO_NZ(ret);
+	return ret;
+}
+
 int
 listen(int fd, int backlog)
 {
@@ -422,6 +614,14 @@ lseek(int fd, off_t off, int whence)
 	return ret;
 }
 
+int
+madvise(void *addr, size_t len, int advice)
+{
+	int ret = syscall(SA(addr), SA(len), SA(advice), 0, 0, SYS_MADVISE);
+	ERRNO_NZ(ret);
+	return ret;
+}
+
 int
 mkdir(const char *p, long mode)
 {
@@ -455,6 +655,30 @@ mmap(void *addr, size_t len, int prot, int flags, int fd, long offset)
 	return (void *)ret;
 }
 
+int
+memfd_create(const char *name, unsigned int flags)
+{
+	int ret = syscall(SA(name), SA(flags), 0, 0, 0, SYS_MEMFD);
+	ERRNO_NEG(ret);
+	return ret;
+}
+
+int
+mprotect(void *addr, size_t len, int prot)
+{
+	int ret = syscall(SA(addr), SA(len), SA(prot), 0, 0, SYS_MPROTECT);
+	ERRNO_NZ(ret);
+	return ret;
+}
+
+int
+msync(void *addr, size_t len, int flags)
+{
+	int ret = syscall(SA(addr), SA(len), SA(flags), 0, 0, SYS_MSYNC);
+	ERRNO_NZ(ret);
+	return ret;
+}
+
 int
 munmap(void *addr, size_t len)
 {
@@ -490,10 +714,18 @@ int
 pause(void)
 {
 	int ret = syscall(0, 0, 0, 0, 0, SYS_PAUSE);
-	errno = ret;
+	errno = -ret;
 	return -1;
 }
 
+int
+personality(unsigned long persona)
+{
+	int ret = syscall(SA(persona), 0, 0, 0, 0, SYS_PERSONA);
+	ERRNO_NEG(ret);
+	return ret;
+}
+
 int
 pipe(int pfds[2])
 {
@@ -510,6 +742,37 @@ pipe2(int pfds[2], int flags)
 	return ret;
 }
 
+int
+posix_openpt(int flags)
+{
+	return open("/dev/ptmx", flags);
+}
+
+// the slaves are made by init and are never locked
+int
+grantpt(int fd)
+{
+	return 0;
+}
+
+int
+unlockpt(int fd)
+{
+	int unlock = 0;
+	return ioctl(fd, TIOCSPTLCK, &unlock);
+}
+
+char *
+ptsname(int fd)
+{
+	static char buf[32];
+	int n;
+	if (ioctl(fd, TIOCGPTN, &n) == -1)
+		return NULL;
+	snprintf(buf, sizeof(buf), "/dev/pts/%d", n);
+	return buf;
+}
+
 int
 poll(struct pollfd *fds, nfds_t nfds, int timeout)
 {
@@ -546,6 +809,14 @@ read(int fd, void *buf, size_t c)
 	return ret;
 }
 
+ssize_t
+readlink(const char *path, char *buf, size_t sz)
+{
+	long ret = syscall(SA(path), SA(buf), SA(sz), 0, 0, SYS_READLINK);
+	ERRNO_NEG(ret);
+	return ret;
+}
+
 int
 reboot(void)
 {
@@ -618,6 +889,22 @@ sendmsg(int fd, struct msghdr *msg, int flags)
 	return ret;
 }
 
+int
+setgid(gid_t gid)
+{
+	int ret = syscall(SA(gid), 0, 0, 0, 0, SYS_SETGID);
+	ERRNO_NZ(ret);
+	return ret;
+}
+
+int
+setgroups(size_t n, const gid_t *groups)
+{
+	int ret = syscall(SA(n), SA(groups), 0, 0, 0, SYS_SETGROUPS);
+	ERRNO_NZ(ret);
+	return ret;
+}
+
 int
 setrlimit(int res, const struct rlimit *rlp)
 {
@@ -626,11 +913,20 @@ setrlimit(int res, const struct rlimit *rlp)
 	return ret;
 }
 
+int
+setpgid(pid_t pid, pid_t pgid)
+{
+	int ret = syscall(SA(pid), SA(pgid), 0, 0, 0, SYS_SETPGID);
+	ERRNO_NZ(ret);
+	return ret;
+}
+
 pid_t
 setsid(void)
 {
-	printf("warning: no sessions or process groups yet\n");
-	return getpid();
+	pid_t ret = syscall(0, 0, 0, 0, 0, SYS_SETSID);
+	ERRNO_NEG(ret);
+	return ret;
 }
 
 int
@@ -660,14 +956,34 @@ setsockopt(int a, int b, int c, const void *d, socklen_t e)
 	return (int)ret;
 }
 
+int
+setuid(uid_t uid)
+{
+	int ret = syscall(SA(uid), 0, 0, 0, 0, SYS_SETUID);
+	ERRNO_NZ(ret);
+	return ret;
+}
+
+// signal handlers return to _sigtramp, which asks the kernel to restore the
+// context saved on the stack just above the handler's return address.
+void _sigtramp(void);
+asm(
+    ".text\n"
+    ".globl	_sigtramp\n"
+    "_sigtramp:\n"
+    "	movq	$15, %rax\n"	// SYS_SIGRETURN
+    "	movq	%rsp, %r10\n"
+    "	leaq	2(%rip), %r11\n"
+    "	sysenter\n"
+    "	ud2\n");
+
 int
 sigaction(int sig, const struct sigaction *act, struct sigaction *oact)
 {
-	printf("warning: no signals yet\n");
-	return 0;
-	//int ret = syscall(SA(sig), SA(act), SA(oact), 0, 0, SYS_SIGACTION);
-	//ERRNO_NEG(ret);
-	//return ret;
+	int ret = syscall(SA(sig), SA(act), SA(oact), SA(_sigtramp), 0,
+	    SYS_SIGACTION);
+	ERRNO_NZ(ret);
+	return ret;
 }
 
 ssize_t
@@ -688,6 +1004,42 @@ void
 	return oa.sa_handler;
 }
 
+/*
+ * shared memory objects are the files of the tmpfs on /dev/shm. a name is one
+ * '/' followed by a file name.
+ */
+static int
+_shmpath(char *dst, size_t sz, const char *name)
+{
+	if (name[0] != '/' || name[1] == '\0' || strchr(name + 1, '/')) {
+		errno = EINVAL;
+		return -1;
+	}
+	if (snprintf(dst, sz, "/dev/shm%s", name) >= sz) {
+		errno = ENAMETOOLONG;
+		return -1;
+	}
+	return 0;
+}
+
+int
+shm_open(const char *name, int flags, mode_t mode)
+{
+	char path[64];
+	if (_shmpath(path, sizeof(path), name))
+		return -1;
+	return open(path, flags | O_CLOEXEC, mode);
+}
+
+int
+shm_unlink(const char *name)
+{
+	char path[64];
+	if (_shmpath(path, sizeof(path), name))
+		return -1;
+	return unlink(path);
+}
+
 int
 shutdown(int fd, int how)
 {
@@ -721,6 +1073,14 @@ stat(const char *path, struct stat *st)
 	return ret;
 }
 
+int
+symlink(const char *target, const char *path)
+{
+	int ret = syscall(SA(target), SA(path), 0, 0, 0, SYS_SYMLINK);
+	ERRNO_NZ(ret);
+	return ret;
+}
+
 int
 sync(void)
 {
@@ -729,6 +1089,31 @@ sync(void)
 	return ret;
 }
 
+int
+mount(const char *src, const char *target, const char *fstype, ulong flags)
+{
+	int ret = syscall(SA(src), SA(target), SA(fstype), SA(flags), 0,
+	    SYS_MOUNT);
+	ERRNO_NZ(ret);
+	return ret;
+}
+
+int
+umount(const char *target)
+{
+	int ret = syscall(SA(target), 0, 0, 0, 0, SYS_UMOUNT);
+	ERRNO_NZ(ret);
+	return ret;
+}
+
+int
+swapon(const char *src, int flags)
+{
+	int ret = syscall(SA(src), flags, 0, 0, 0, SYS_SWAPON);
+	ERRNO_NZ(ret);
+	return ret;
+}
+
 long
 sys_prof(long ptype, long events, long flags, long intperiod)
 {
@@ -745,6 +1130,59 @@ sys_info(long n)
 	return ret;
 }
 
+void
+cfmakeraw(struct termios *t)
+{
+	t->c_iflag &= ~(ISTRIP | INLCR | IGNCR | ICRNL);
+	t->c_oflag &= ~OPOST;
+	t->c_lflag &= ~(ECHO | ECHONL | ICANON | ISIG | IEXTEN);
+	t->c_cflag |= CS8;
+	t->c_cc[VMIN] = 1;
+	t->c_cc[VTIME] = 0;
+}
+
+int
+tcgetattr(int fd, struct termios *t)
+{
+	return ioctl(fd, TCGETS, t);
+}
+
+int
+tcsetattr(int fd, int act, const struct termios *t)
+{
+	ulong req;
+	switch (act) {
+	case TCSANOW:
+		req = TCSETS;
+		break;
+	case TCSADRAIN:
+		req = TCSETSW;
+		break;
+	case TCSAFLUSH:
+		req = TCSETSF;
+		break;
+	default:
+		errno = EINVAL;
+		return -1;
+	}
+	return ioctl(fd, req, t);
+}
+
+pid_t
+tcgetpgrp(int fd)
+{
+	pid_t pgrp;
+	if (ioctl(fd, TIOCGPGRP, &pgrp) == -1)
+		return -1;
+	return pgrp;
+}
+
+int
+tcsetpgrp(int fd, pid_t pgrp)
+{
+	return ioctl(fd, TIOCSPGRP, &pgrp);
+}
+
 int
 truncate(const char *p, off_t newlen)
 {
@@ -1201,8 +1639,8 @@ pthread_cond_signal(pthread_cond_t *c)
 int
 pthread_sigmask(int how, const sigset_t *set, sigset_t *oset)
 {
-	printf("warning: signals not implemented\n");
-	return 0;
+	int ret = syscall(SA(how), SA(set), SA(oset), 0, 0, SYS_SIGPROCMASK);
+	return -ret;
 }
 
 int
@@ -1862,6 +2300,14 @@ ftruncate(int fd, off_t newlen)
 	return ret;
 }
 
+int
+futimens(int fd, const struct timespec times[2])
+{
+	int ret = syscall(SA(fd), SA(times), 0, 0, 0, SYS_FUTIMENS);
+	ERRNO_NZ(ret);
+	return ret;
+}
+
 int
 futex(const int op, void *fut, void *fut2, int aux, const struct timespec *ts)
 {
@@ -1874,8 +2320,17 @@ futex(const int op, void *fut, void *fut2, int aux, const struct timespec *ts)
 int
 fsync(int fd)
 {
-	sync();
-	return 0;
+	int ret = syscall(SA(fd), 0, 0, 0, 0, SYS_FSYNC);
+	ERRNO_NZ(ret);
+	return ret;
+}
+
+int
+fdatasync(int fd)
+{
+	int ret = syscall(SA(fd), 0, 0, 0, 0, SYS_FDATASYNC);
+	ERRNO_NZ(ret);
+	return ret;
 }
 
 static void
@@ -2178,8 +2633,6 @@ mkdtemp(char *t)
 DIR *
 fdopendir(int fd)
 {
-        #define BSIZE 4096
-  
 	struct stat st;
 	if (fstat(fd, &st) == -1)
 		return NULL;
@@ -2187,59 +2640,15 @@ fdopendir(int fd)
 		errno = ENOTDIR;
 		return NULL;
 	}
-	// allocate enough space for all dirents; count them.
 	if (lseek(fd, 0, SEEK_SET) == -1)
 		return NULL;
-	// on disk format of directory entries
-	struct  __attribute__((packed)) _dirent_t {
-		char	name[_POSIX_NAME_MAX];
-		ulong	inum;
-	};
-	const int nde = BSIZE/sizeof(struct _dirent_t);
-	size_t c = 0;
-	char buf[BSIZE];
-	ssize_t r;
-	while ((r = read(fd, buf, sizeof(buf))) > 0) {
-		int i;
-		for (i = 0; i < nde; i++) {
-			struct _dirent_t *de = (struct _dirent_t *)buf + i;
-			if (de->name[0] != '\0')
-				c++;
-		}
-	}
-	if (r == -1)
-		return NULL;
-	if (c > (ULONG_MAX - sizeof(DIR))/sizeof(struct dirent))
-		errx(-1, "very fat dir");
-	DIR *ret = malloc(sizeof(DIR) + c*sizeof(struct dirent));
+	DIR *ret = malloc(sizeof(DIR));
 	if (!ret)
 		return NULL;
-
-	// copy dirents into ret
 	ret->fd = fd;
-	ret->nent = (int)c;
-	ret->cent = 0;
-	if (lseek(fd, 0, SEEK_SET) == -1)
-		goto out;
-	struct dirent *p = &ret->dents[0];
-	while ((r = read(fd, buf, sizeof(buf))) > 0) {
-		int i;
-		for (i = 0; i < nde; i++) {
-			struct _dirent_t *de = (struct _dirent_t *)buf + i;
-			if (de->name[0] != '\0') {
-				p->d_ino = de->inum;
-				strncpy(p->d_name, de->name,
-				    sizeof(p->d_name));
-				p++;
-			}
-		}
-	}
-	if (r == -1)
-		goto out;
+	ret->boff = ret->blen = 0;
+	ret->loc = 0;
 	return ret;
-out:
-	free(ret);
-	return NULL;
 }
 
 DIR *
@@ -2272,12 +2681,33 @@ readdir(DIR *d)
 int
 readdir_r(DIR *d, struct dirent *entry, struct dirent **ret)
 {
-	if (d->cent == d->nent) {
-		*ret = NULL;
-		return 0;
+	// the layout of the records returned by getdents
+	struct _dirent64_t {
+		ulong	d_ino;
+		long	d_off;
+		ushort	d_reclen;
+		uchar	d_type;
+		char	d_name[];
+	};
+	if (d->boff == d->blen) {
+		ssize_t r = getdents(d->fd, d->buf, sizeof(d->buf));
+		if (r == -1)
+			return errno;
+		if (r == 0) {
+			*ret = NULL;
+			return 0;
+		}
+		d->boff = 0;
+		d->blen = r;
 	}
-	struct dirent *src = &d->dents[d->cent++];
-	*entry = *src;
+	struct _dirent64_t *de = (struct _dirent64_t *)(d->buf + d->boff);
+	d->boff += de->d_reclen;
+	d->loc = de->d_off;
+	entry->d_ino = de->d_ino;
+	entry->d_off = de->d_off;
+	entry->d_type = de->d_type;
+	strncpy(entry->d_name, de->d_name, sizeof(entry->d_name));
+	entry->d_name[sizeof(entry->d_name) - 1] = '\0';
 	*ret = entry;
 	return 0;
 }
@@ -2285,7 +2715,24 @@ readdir_r(DIR *d, struct dirent *entry, struct dirent **ret)
 void
 rewinddir(DIR *d)
 {
-	d->cent = 0;
+	seekdir(d, 0);
+}
+
+// loc is a cookie returned by telldir or in d_off; it remains valid even if
+// entries are created or removed.
+void
+seekdir(DIR *d, long loc)
+{
+	if (lseek(d->fd, loc, SEEK_SET) == -1)
+		return;
+	d->boff = d->blen = 0;
+	d->loc = loc;
+}
+
+long
+telldir(DIR *d)
+{
+	return d->loc;
 }
 
 struct {
@@ -3046,6 +3493,7 @@ static const char * const _errstr[] = {
 	[ESRCH] = "No such process",
 	[EINTR] = "Interrupted system call",
 	[EIO] = "Input/output error",
+	[ENXIO] = "Device not configured",
 	[E2BIG] = "Argument list too long",
 	[EBADF] = "Bad file descriptor",
 	[EAGAIN] = "Resource temporarily unavailable",
@@ -3062,10 +3510,13 @@ static const char * const _errstr[] = {
 	[EINVAL] = "Invalid argument",
 	[ENFILE] = "Too many open files in system",
 	[EMFILE] = "Too many open files",
+	[ENOTTY] = "Inappropriate ioctl for device",
+	[EFBIG] = "File too large",
 	[ENOSPC] = "No space left on device",
 	[ESPIPE] = "Illegal seek",
 	[EPIPE] = "Broken pipe",
 	[ERANGE] = "Result too large",
+	[EDEADLK] = "Resource deadlock avoided",
 	[ENAMETOOLONG] = "File name too long",
 	[ENOSYS] = "Function not implemented",
 	[ENOTEMPTY] = "Directory not empty",
@@ -3081,6 +3532,7 @@ static const char * const _errstr[] = {
 	[EHOSTUNREACH] = "No route to host",
 	[EOVERFLOW] = "Value too large to be stored in data type",
 	[ENOTSOCK] = "Socket operation on non-socket",
+	[ENOPROTOOPT] = "Protocol not available",
 	[EOPNOTSUPP] = "Operation not supported",
 	[EISCONN] = "Socket is already connected",
 	[ENOTCONN] = "Socket is not connected",
@@ -3598,12 +4050,6 @@ getenv(char *name)
 	HACK(NULL);
 }
 
-uid_t
-geteuid(void)
-{
-	HACK(666);
-}
-
 struct passwd *
 getpwnam(const char *a)
 {
@@ -3631,15 +4077,6 @@ gethostbyname(const char *a)
 	FAIL;
 }
 
-int
-chown(const char *a, uid_t b, gid_t c)
-{
-	if (b != 666 || c != -1)
-		errx(-1, "unexpected chown");
-	errno = 0;
-	HACK(0);
-}
-
 time_t
 mktime(struct tm *a)
 {
@@ -3692,9 +4129,20 @@ gmtime(const time_t *a)
 }
 
 int
-utimes(const char *a, const struct timeval b[2])
+utimes(const char *path, const struct timeval tvs[2])
 {
-	FAIL;
+	struct timespec ts[2], *tsp = NULL;
+	if (tvs) {
+		int i;
+		for (i = 0; i < 2; i++) {
+			ts[i].tv_sec = tvs[i].tv_sec;
+			ts[i].tv_nsec = tvs[i].tv_usec * 1000;
+		}
+		tsp = ts;
+	}
+	int ret = syscall(SA(path), SA(tsp), 0, 0, 0, SYS_UTIMES);
+	ERRNO_NZ(ret);
+	return ret;
 }
 
 int
@@ -3709,27 +4157,16 @@ globfree(glob_t *a)
 	FAIL;
 }
 
-int
-ioctl(int fd, ulong req, ...)
-{
-	if (req != FIOASYNC)
-		errx(-1, "nyet");
-	HACK(0);
-}
-
 int
 raise(int a)
 {
-	FAIL;
+	return kill(getpid(), a);
 }
 
 mode_t
-umask(mode_t a)
+umask(mode_t mask)
 {
-	static mode_t dur = 0022;
-	mode_t old = dur;
-	dur = a;
-	HACK(old);
+	return syscall(SA(mask), 0, 0, 0, 0, SYS_UMASK);
 }
 
 int
@@ -3741,17 +4178,23 @@ getpagesize(void)
 int
 sigprocmask(int a, sigset_t *b, sigset_t *c)
 {
-	if (c)
-		errx(-1, "no old set");
-	HACK(0);
+	int ret = syscall(SA(a), SA(b), SA(c), 0, 0, SYS_SIGPROCMASK);
+	ERRNO_NZ(ret);
+	return ret;
 }
 
 int
 sigsuspend(const sigset_t *a)
 {
-	fprintf(stderr, "warning: no signals, thus sleep forever...\n");
+	// XXX not atomic; a signal taken between sigprocmask and pause is
+	// missed.
+	sigset_t old;
+	if (sigprocmask(SIG_SETMASK, (sigset_t *)a, &old) == -1)
+		return -1;
 	pause();
-	errx(-1, "sigsuspend no imp");
+	sigprocmask(SIG_SETMASK, &old, NULL);
+	errno = EINTR;
+	return -1;
 }
 
 int
@@ -3760,28 +4203,11 @@ setpriority(int a, int b, int c)
 	FAIL;
 }
 
-uid_t
-getuid(void)
-{
-	FAIL;
-}
-
-int
-setuid(uid_t a)
-{
-	FAIL;
-}
-
+// there is no group database, so the only supplementary group is group
 int
-setgid(gid_t a)
+initgroups(const char *user, gid_t group)
 {
-	FAIL;
-}
-
-int
-initgroups(const char *a, gid_t b)
-{
-	FAIL;
+	return setgroups(1, &group);
 }
 
 char *
@@ -3790,21 +4216,6 @@ realpath(const char *a, char *b)
 	FAIL;
 }
 
-int
-lstat(const char *a, struct stat *b)
-{
-	// will some applications break because they expect lstat to be a
-	// system call?
-	// XXX yes, if it has maximum open fds already
-	int fd = open(a, O_RDONLY);
-	if (fd == -1)
-		return -1;
-	int ret = fstat(fd, b);
-	if (close(fd) == -1)
-		fprintf(stderr, "lstat close failed\n");
-	return ret;
-}
-
 /* LMBENCH STUFF */
 unsigned int
 alarm(unsigned int sec)
@@ -27,10 +27,141 @@ void mkargs(char *line, char *args[], size_t n)
 	//	printf("arg %d: %s\n", ai, args[ai]);
 }
 
+// job control is only done when the shell's input is a terminal of its
+// session; a shell reading a script runs background jobs without it.
+static int interactive;
+
+static struct job {
+	pid_t pgid;
+	int stopped;
+	char cmd[64];
+} jobs[16];
+
+struct job *jobadd(pid_t pgid, char *args[])
+{
+	int i;
+	for (i = 0; i < sizeof(jobs)/sizeof(jobs[0]); i++)
+		if (jobs[i].pgid == 0)
+			break;
+	if (i == sizeof(jobs)/sizeof(jobs[0]))
+		return NULL;
+	struct job *j = &jobs[i];
+	j->pgid = pgid;
+	j->stopped = 0;
+	char *p = j->cmd;
+	char *e = j->cmd + sizeof(j->cmd);
+	*p = '\0';
+	for (i = 0; args[i] != NULL && p < e; i++)
+		p += snprintf(p, e - p, "%s%s", i ? " " : "", args[i]);
+	return j;
+}
+
+struct job *jobfind(char *arg)
+{
+	int i;
+	if (arg == NULL) {
+		// the most recent job
+		for (i = sizeof(jobs)/sizeof(jobs[0]) - 1; i >= 0; i--)
+			if (jobs[i].pgid != 0)
+				return &jobs[i];
+		printf("no current job\n");
+		return NULL;
+	}
+	if (*arg == '%')
+		arg++;
+	i = atoi(arg) - 1;
+	if (i < 0 || i >= sizeof(jobs)/sizeof(jobs[0]) || jobs[i].pgid == 0) {
+		printf("no such job: %s\n", arg);
+		return NULL;
+	}
+	return &jobs[i];
+}
+
+// updates job j with the wait status st of its process. returns 1 if the
+// job finished.
+int jobstatus(struct job *j, int st, int verbose)
+{
+	int n = j - jobs + 1;
+	if (WIFSTOPPED(st)) {
+		j->stopped = 1;
+		printf("\n[%d] stopped  %s\n", n, j->cmd);
+		return 0;
+	}
+	if (WIFCONTINUED(st)) {
+		j->stopped = 0;
+		return 0;
+	}
+	if (verbose) {
+		if (WIFSIGNALED(st))
+			printf("[%d] killed by signal %d  %s\n", n, WTERMSIG(st),
+			    j->cmd);
+		else if (WEXITSTATUS(st) != 0)
+			printf("[%d] exit %d  %s\n", n, WEXITSTATUS(st),
+			    j->cmd);
+		else
+			printf("[%d] done  %s\n", n, j->cmd);
+	}
+	j->pgid = 0;
+	return 1;
+}
+
+// gives the terminal to job j and waits for it to finish or stop
+void jobfg(struct job *j)
+{
+	if (interactive && tcsetpgrp(0, j->pgid) == -1)
+		err(-1, "tcsetpgrp");
+	int st;
+	pid_t pid;
+	while ((pid = waitpid(j->pgid, &st, WUNTRACED)) == -1 && errno == EINTR)
+		;
+	if (pid == -1)
+		err(-1, "waitpid");
+	// the terminal only echoes ^C
+	if (WIFSIGNALED(st) && WTERMSIG(st) == SIGINT)
+		printf("\n");
+	jobstatus(j, st, 0);
+	if (interactive && tcsetpgrp(0, getpid()) == -1)
+		err(-1, "tcsetpgrp");
+}
+
+// reports the background jobs that finished or stopped
+void jobreap(void)
+{
+	int st;
+	pid_t pid;
+	while ((pid = waitpid(WAIT_ANY, &st, WNOHANG | WUNTRACED)) > 0) {
+		int i;
+		for (i = 0; i < sizeof(jobs)/sizeof(jobs[0]); i++)
+			if (jobs[i].pgid == pid) {
+				jobstatus(&jobs[i], st, 1);
+				break;
+			}
+	}
+}
+
 int builtins(char *args[], size_t n)
 {
 	char *cmd = args[0];
-	if (strncmp(cmd, "cd", 3) == 0) {
+	if (strncmp(cmd, "jobs", 5) == 0) {
+		int i;
+		for (i = 0; i < sizeof(jobs)/sizeof(jobs[0]); i++)
+			if (jobs[i].pgid != 0)
+				printf("[%d] %s  %s\n", i + 1,
+				    jobs[i].stopped ? "stopped" : "running",
+				    jobs[i].cmd);
+		return 1;
+	} else if (strncmp(cmd, "fg", 3) == 0 || strncmp(cmd, "bg", 3) == 0) {
+		struct job *j = jobfind(args[1]);
+		if (j == NULL)
+			return 1;
+		printf("%s\n", j->cmd);
+		if (killpg(j->pgid, SIGCONT) == -1)
+			printf("killpg: %s\n", strerror(errno));
+		j->stopped = 0;
+		if (cmd[0] == 'f')
+			jobfg(j);
+		return 1;
+	} else if (strncmp(cmd, "cd", 3) == 0) {
 		int ret = chdir(args[1]);
 		if (ret)
 			printf("chdir to %s failed\n", args[1]);
@@ -146,8 +277,22 @@ void doredirs(char *infn, char *outfn, int append)
 
 int main(int argc, char **argv)
 {
-	int nbgs = 0;
+	if (tcgetpgrp(0) != -1) {
+		interactive = 1;
+		// ignore the signals for the foreground job and take the
+		// terminal in a process group of our own
+		signal(SIGINT, SIG_IGN);
+		signal(SIGQUIT, SIG_IGN);
+		signal(SIGTSTP, SIG_IGN);
+		signal(SIGTTIN, SIG_IGN);
+		signal(SIGTTOU, SIG_IGN);
+		if (getpgrp() != getpid() && setpgid(0, 0) == -1)
+			err(-1, "setpgid");
+		if (tcsetpgrp(0, getpid()) == -1)
+			err(-1, "tcsetpgrp");
+	}
 	while (1) {
+		jobreap();
 		// if you change the output of lsh, you need to update
 		// posixtest() in usertests.c so the test is aware of the new
 		// changes.
@@ -177,27 +322,29 @@ int main(int argc, char **argv)
 		if (pid < 0)
 			err(-1, "fork");
 		if (pid) {
-			if (isbg)
-				nbgs++;
+			// each job is a process group; both the shell and the
+			// child set it so that neither depends on which runs
+			// first.
+			setpgid(pid, pid);
+			struct job *j = jobadd(pid, args);
+			if (j == NULL) {
+				printf("too many jobs\n");
+				waitpid(pid, NULL, 0);
+			} else if (isbg)
+				printf("[%d] %d\n", (int)(j - jobs + 1), pid);
 			else
-				while (wait(NULL) != pid)
-					;
+				jobfg(j);
 			continue;
 		}
-		// if background job, fork another child to check the commands
-		// exit code
-		int pid2;
-		if (isbg && (pid2 = fork()) != 0) {
-			printf("background pid %d\n", pid2);
-			int status;
-			wait(&status);
-			int st = WEXITSTATUS(status);
-			if (!WIFEXITED(status) || st != 0)
-				printf("background job %d failed with %d",
-				    pid2, st);
-			else
-				printf("background job %d done\n", pid2);
-			exit(st);
+		setpgid(0, 0);
+		if (interactive) {
+			if (!isbg)
+				tcsetpgrp(0, getpid());
+			signal(SIGINT, SIG_DFL);
+			signal(SIGQUIT, SIG_DFL);
+			signal(SIGTSTP, SIG_DFL);
+			signal(SIGTTIN, SIG_DFL);
+			signal(SIGTTOU, SIG_DFL);
 		}
 		doredirs(infile, outfile, append);
 		execvp(args[0], args);
@@ -18,6 +18,88 @@ static int lstn(uint16_t lport)
 	return s;
 }
 
+// copy whatever is ready on from to to. returns 0 once from reaches EOF or
+// its pty has hung up.
+static int relay(int from, int to)
+{
+	char buf[512];
+	ssize_t r = read(from, buf, sizeof(buf));
+	if (r <= 0)
+		return 0;
+	ssize_t did = 0;
+	while (did < r) {
+		ssize_t w = write(to, buf + did, r - did);
+		if (w <= 0)
+			return 0;
+		did += w;
+	}
+	return 1;
+}
+
+// gives the connected socket s a shell on a fresh pseudo-terminal and
+// shuttles bytes between the two until either side goes away.
+static void session(int s)
+{
+	int m = posix_openpt(O_RDWR);
+	if (m == -1)
+		err(-1, "posix_openpt");
+	if (grantpt(m) == -1 || unlockpt(m) == -1)
+		err(-1, "unlockpt");
+	char *slave = ptsname(m);
+	if (slave == NULL)
+		err(-1, "ptsname");
+
+	pid_t sh;
+	if ((sh = fork()) == -1)
+		err(-1, "fork");
+	if (sh == 0) {
+		close(m);
+		close(s);
+		if (setsid() == -1)
+			err(-1, "setsid");
+		int fd = open(slave, O_RDWR);
+		if (fd == -1)
+			err(-1, "open %s", slave);
+		if (ioctl(fd, TIOCSCTTY, 0) == -1)
+			err(-1, "TIOCSCTTY");
+		if (dup2(fd, 0) == -1)
+			err(-1, "dup2");
+		if (dup2(fd, 1) == -1)
+			err(-1, "dup2");
+		if (dup2(fd, 2) == -1)
+			err(-1, "dup2");
+		if (fd > 2)
+			close(fd);
+		char *args[] = {"/bin/lsh", NULL};
+		execv(args[0], args);
+		err(-1, "execv");
+	}
+
+	for (;;) {
+		struct pollfd pfds[2] = {
+			{.fd = s, .events = POLLIN},
+			{.fd = m, .events = POLLIN},
+		};
+		if (poll(pfds, 2, -1) == -1) {
+			if (errno == EINTR)
+				continue;
+			err(-1, "poll");
+		}
+		if (pfds[0].revents && !relay(s, m))
+			break;
+		if (pfds[1].revents && !relay(m, s))
+			break;
+	}
+	// closing the master hangs up the slave, which sends the shell's
+	// foreground job SIGHUP
+	close(m);
+	close(s);
+	int status;
+	if (waitpid(sh, &status, 0) == -1)
+		err(-1, "waitpid");
+	exit(WIFEXITED(status) ? WEXITSTATUS(status) : 1);
+}
+
 int main(int argc, char **argv)
 {
 	int lfd = lstn(22);
@@ -32,16 +114,8 @@ int main(int argc, char **argv)
 		if ((p = fork()) == -1)
 			err(-1, "fork");
 		if (p == 0) {
-			if (dup2(s, 0) == -1)
-				err(-1, "dup2");
-			if (dup2(s, 1) == -1)
-				err(-1, "dup2");
-			if (dup2(s, 2) == -1)
-				err(-1, "dup2");
-			close(s);
-			char *args[] = {"/bin/lsh", NULL};
-			execv(args[0], args);
-			err(-1, "execv");
+			close(lfd);
+			session(s);
 		}
 		if (close(s) == -1)
 			err(-1, "close");
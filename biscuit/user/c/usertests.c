@@ -461,11 +461,37 @@ exitwait(void)
   printf("exitwait ok\n");
 
   printf("exit status test\n");
+  // no core file by default
+  int status;
   if (!fork())
     _childfault();
-  int status;
   wait(&status);
   stchk(status, SIGSEGV);
+  if (WCOREDUMP(status))
+    errx(-1, "unexpected core dump");
+  // a raised RLIMIT_CORE dumps to the directory set by coredir
+  if (mkdir("cores") < 0)
+    err(-1, "mkdir");
+  if (coredir("cores") < 0)
+    err(-1, "coredir");
+  if ((pid = fork()) == 0) {
+    struct rlimit rl = {RLIM_INFINITY, RLIM_INFINITY};
+    if (setrlimit(RLIMIT_CORE, &rl) < 0)
+      err(-1, "setrlimit");
+    _childfault();
+  }
+  wait(&status);
+  stchk(status, SIGSEGV);
+  if (!WCOREDUMP(status))
+    errx(-1, "expected core dump");
+  if (coredir("") < 0)
+    err(-1, "coredir");
+  char core[32];
+  snprintf(core, sizeof(core), "cores/core.%d", pid);
+  if (unlink(core) < 0)
+    errx(-1, "no core file");
+  if (rmdir("cores") < 0)
+    err(-1, "rmdir");
   if (!fork())
     exit(0);
   wait(&status);
@@ -473,6 +499,358 @@ exitwait(void)
   printf("exit status test ok\n");
 }
 
+void
+jobctl(void)
+{
+  int pid, status, p[2], q[2];
+  char c;
+
+  printf("job control test\n");
+  if ((pid = fork()) == 0) {
+    setpgid(0, 0);
+    for (;;)
+      pause();
+  }
+  if (setpgid(pid, pid) < 0)
+    err(-1, "setpgid");
+  if (getpgid(pid) != pid)
+    errx(-1, "wrong pgid");
+  if (getpgrp() == pid)
+    errx(-1, "parent moved");
+
+  if ((kill)(-pid, SIGSTOP) < 0)
+    err(-1, "kill pgrp");
+  if (waitpid(pid, &status, WUNTRACED) != pid)
+    err(-1, "waitpid");
+  if (!WIFSTOPPED(status) || WSTOPSIG(status) != SIGSTOP)
+    errx(-1, "expected stopped");
+  // the stop is reported once
+  if (waitpid(pid, &status, WNOHANG | WUNTRACED) != 0)
+    errx(-1, "stop reported twice");
+
+  if (killpg(pid, SIGCONT) < 0)
+    err(-1, "killpg");
+  if (waitpid(pid, &status, WCONTINUED) != pid)
+    err(-1, "waitpid");
+  if (!WIFCONTINUED(status))
+    errx(-1, "expected continued");
+
+  if (killpg(pid, SIGKILL) < 0)
+    err(-1, "killpg");
+  if (waitpid(pid, &status, WUNTRACED | WCONTINUED) != pid)
+    err(-1, "waitpid");
+  stchk(status, SIGKILL);
+  if ((kill)(-pid, SIGKILL) != -1 || errno != ESRCH)
+    errx(-1, "empty group signaled");
+
+  if ((pid = fork()) == 0) {
+    pid_t sid = setsid();
+    if (sid != getpid() || getpgrp() != sid)
+      errx(-1, "setsid");
+    // a session leader may not make another session
+    if (setsid() != -1 || errno != EPERM)
+      errx(-1, "second setsid");
+    if (setpgid(0, getppid()) != -1 || errno != EPERM)
+      errx(-1, "joined group in another session");
+    exit(0);
+  }
+  wait(&status);
+  stchk(status, 0);
+
+  // an unprivileged process may signal only its own user's processes
+  if ((pid = fork()) == 0) {
+    if (setuid(1000) < 0)
+      err(-1, "setuid");
+    if ((kill)(getppid(), SIGTERM) != -1 || errno != EPERM)
+      errx(-1, "signaled root's process");
+    if ((kill)(1, SIGKILL) != -1 || errno != EPERM)
+      errx(-1, "signaled init");
+    if ((kill)(-getpgid(getppid()), 0) != 0)
+      err(-1, "own group");
+    if ((kill)(getpid(), 0) != 0)
+      err(-1, "self");
+    exit(0);
+  }
+  wait(&status);
+  stchk(status, 0);
+
+  // a child cannot be moved to another group after it executes a program.
+  // the parent learns of the exec when it closes q.
+  if (pipe(p) < 0 || pipe2(q, O_CLOEXEC) < 0)
+    err(-1, "pipe");
+  if ((pid = fork()) == 0) {
+    char *args[] = {"cat", NULL};
+    dup2(p[0], 0);
+    close(p[0]);
+    close(p[1]);
+    execvp(args[0], args);
+    err(-1, "exec failed");
+  }
+  close(p[0]);
+  close(q[1]);
+  if (read(q[0], &c, 1) != 0)
+    errx(-1, "exec pipe");
+  close(q[0]);
+  if (setpgid(pid, pid) != -1 || errno != EACCES)
+    errx(-1, "moved child after exec");
+  close(p[1]);
+  wait(&status);
+  stchk(status, 0);
+
+  // the group of an exited process is orphaned; its members ignore
+  // SIGTSTP, since nothing would continue them.
+  if (pipe(p) < 0)
+    err(-1, "pipe");
+  if ((pid = fork()) == 0) {
+    setpgid(0, 0);
+    if (fork() == 0) {
+      while (getppid() != 1)
+        usleep(1000);
+      (kill)(getpid(), SIGTSTP);
+      write(p[1], "x", 1);
+      exit(0);
+    }
+    exit(0);
+  }
+  close(p[1]);
+  wait(&status);
+  stchk(status, 0);
+  if (read(p[0], &c, 1) != 1)
+    errx(-1, "orphaned group stopped");
+  close(p[0]);
+
+  // a group that is orphaned while a member is stopped gets SIGHUP and
+  // SIGCONT, so the member dies instead of staying stopped. the parent
+  // learns of its death when the pipe closes.
+  if (pipe(p) < 0)
+    err(-1, "pipe");
+  if ((pid = fork()) == 0) {
+    int g;
+    setpgid(0, 0);
+    if ((g = fork()) == 0) {
+      close(p[0]);
+      (kill)(getpid(), SIGSTOP);
+      write(p[1], "x", 1);
+      exit(0);
+    }
+    if (waitpid(g, &status, WUNTRACED) != g || !WIFSTOPPED(status))
+      errx(-1, "expected stopped");
+    exit(0);
+  }
+  close(p[1]);
+  wait(&status);
+  stchk(status, 0);
+  if (read(p[0], &c, 1) != 0)
+    errx(-1, "orphaned stopped group not hung up");
+  close(p[0]);
+  printf("job control test ok\n");
+}
+
+void
+ttytest(void)
+{
+  int m, s, p[2];
+  char buf[64];
+  char *slave;
+  struct termios t;
+  struct winsize ws;
+
+  printf("tty test\n");
+  if ((m = posix_openpt(O_RDWR)) < 0)
+    err(-1, "posix_openpt");
+  if (grantpt(m) < 0 || unlockpt(m) < 0)
+    err(-1, "unlockpt");
+  if ((slave = ptsname(m)) == NULL)
+    err(-1, "ptsname");
+  if ((s = open(slave, O_RDWR)) < 0)
+    err(-1, "open %s", slave);
+  if (!isatty(s) || !isatty(m))
+    errx(-1, "pty not a tty");
+  // the slave belongs to the master's owner, and only it and root may open
+  // it
+  struct stat st;
+  if (stat(slave, &st) < 0)
+    err(-1, "stat %s", slave);
+  if (st.st_uid != geteuid() || (st.st_mode & 0777) != 0620)
+    errx(-1, "slave not granted");
+  int status;
+  if (fork() == 0) {
+    if (setuid(1000) < 0)
+      err(-1, "setuid");
+    if (open(slave, O_RDWR) != -1 || errno != EACCES)
+      errx(-1, "other user opened the slave");
+    exit(0);
+  }
+  wait(&status);
+  if (!WIFEXITED(status) || WEXITSTATUS(status) != 0)
+    errx(-1, "slave permission child failed");
+  if (pipe(p) < 0)
+    err(-1, "pipe");
+  if (isatty(p[0]) || errno != ENOTTY)
+    errx(-1, "pipe is a tty");
+  close(p[0]);
+  close(p[1]);
+
+  // canonical mode edits the line and echoes it back to the master
+  if (write(m, "ab\177c\n", 5) != 5)
+    err(-1, "write master");
+  if (read(s, buf, sizeof(buf)) != 3 || memcmp(buf, "ac\n", 3) != 0)
+    errx(-1, "bad line");
+  if (read(m, buf, sizeof(buf)) != 9 || memcmp(buf, "ab\b \bc\r\n", 9) != 0)
+    errx(-1, "bad echo");
+  // VEOF on an empty line is end-of-file
+  if (write(m, "\x04", 1) != 1)
+    err(-1, "write master");
+  if (read(s, buf, sizeof(buf)) != 0)
+    errx(-1, "expected eof");
+
+  // raw mode passes every byte through without echo
+  if (tcgetattr(s, &t) < 0)
+    err(-1, "tcgetattr");
+  if (!(t.c_lflag & ICANON))
+    errx(-1, "not canonical");
+  cfmakeraw(&t);
+  if (tcsetattr(s, TCSANOW, &t) < 0)
+    err(-1, "tcsetattr");
+  if (write(m, "x\x7f", 2) != 2)
+    err(-1, "write master");
+  if (read(s, buf, sizeof(buf)) != 2 || memcmp(buf, "x\x7f", 2) != 0)
+    errx(-1, "bad raw read");
+  if (write(s, "y\n", 2) != 2)
+    err(-1, "write slave");
+  if (read(m, buf, sizeof(buf)) != 2 || memcmp(buf, "y\n", 2) != 0)
+    errx(-1, "bad raw output");
+  if (tcsetattr(s, 7, &t) != -1 || errno != EINVAL)
+    errx(-1, "bad action accepted");
+
+  ws.ws_row = 50;
+  ws.ws_col = 132;
+  ws.ws_xpixel = ws.ws_ypixel = 0;
+  if (ioctl(m, TIOCSWINSZ, &ws) < 0)
+    err(-1, "TIOCSWINSZ");
+  memset(&ws, 0, sizeof(ws));
+  if (ioctl(s, TIOCGWINSZ, &ws) < 0)
+    err(-1, "TIOCGWINSZ");
+  if (ws.ws_row != 50 || ws.ws_col != 132)
+    errx(-1, "bad window size");
+
+  // the slave reads end-of-file once the master is gone
+  close(m);
+  if (read(s, buf, sizeof(buf)) != 0)
+    errx(-1, "expected hangup");
+  if (write(s, "z", 1) != -1 || errno != EIO)
+    errx(-1, "write after hangup");
+  close(s);
+  printf("tty test ok\n");
+}
+
+void
+ioctltest(void)
+{
+  int p[2], s[2], fd, n;
+  char buf[16];
+
+  printf("ioctl test\n");
+  if (pipe(p) < 0)
+    err(-1, "pipe");
+  if (write(p[1], "hello", 5) != 5)
+    err(-1, "write");
+  if (ioctl(p[0], FIONREAD, &n) < 0)
+    err(-1, "FIONREAD");
+  if (n != 5)
+    errx(-1, "FIONREAD got %d", n);
+  if (read(p[0], buf, sizeof(buf)) != 5)
+    err(-1, "read");
+  n = 1;
+  if (ioctl(p[0], FIONBIO, &n) < 0)
+    err(-1, "FIONBIO");
+  if (!(fcntl(p[0], F_GETFL) & O_NONBLOCK))
+    errx(-1, "FIONBIO did not set O_NONBLOCK");
+  if (read(p[0], buf, sizeof(buf)) != -1 || errno != EAGAIN)
+    errx(-1, "read did not fail with EAGAIN");
+  n = 0;
+  if (ioctl(p[0], FIONBIO, &n) < 0)
+    err(-1, "FIONBIO");
+  if (fcntl(p[0], F_GETFL) & O_NONBLOCK)
+    errx(-1, "FIONBIO did not clear O_NONBLOCK");
+  close(p[0]);
+  close(p[1]);
+
+  if (socketpair(AF_UNIX, SOCK_STREAM, 0, s) < 0)
+    err(-1, "socketpair");
+  if (write(s[0], "abc", 3) != 3)
+    err(-1, "write");
+  if (ioctl(s[1], FIONREAD, &n) < 0)
+    err(-1, "FIONREAD");
+  if (n != 3)
+    errx(-1, "socket FIONREAD got %d", n);
+  close(s[0]);
+  close(s[1]);
+
+  if ((fd = open("ioctltest", O_CREATE|O_RDWR)) < 0)
+    err(-1, "open");
+  if (ioctl(fd, FIONREAD, &n) != -1 || errno != ENOTTY)
+    errx(-1, "file accepted FIONREAD");
+  close(fd);
+  unlink("ioctltest");
+  if (ioctl(fd, FIONREAD, &n) != -1 || errno != EBADF)
+    errx(-1, "closed fd accepted ioctl");
+  printf("ioctl test ok\n");
+}
+
+void
+proctest(void)
+{
+  static char buf[16384];
+  char path[64], line[32];
+  int fd, n, tot, status;
+
+  printf("proc test\n");
+  char *va = mmap(NULL, 4096, PROT_NONE, MAP_PRIVATE | MAP_ANON, -1, 0);
+  if (va == MAP_FAILED)
+    err(-1, "mmap");
+  snprintf(path, sizeof(path), "/proc/%d/maps", getpid());
+  if ((fd = open(path, O_RDONLY)) < 0)
+    err(-1, "open %s", path);
+  tot = 0;
+  while ((n = read(fd, buf + tot, sizeof(buf) - 1 - tot)) > 0)
+    tot += n;
+  if (n < 0)
+    err(-1, "read %s", path);
+  buf[tot] = 0;
+  close(fd);
+  // a PROT_NONE mapping is neither readable nor executable
+  snprintf(line, sizeof(line), "%012lx-%012lx ---p", (ulong)va,
+      (ulong)va + 4096);
+  if (strstr(buf, line) == NULL)
+    errx(-1, "no PROT_NONE mapping in maps");
+  munmap(va, 4096);
+
+  // only root and a process's user may see its maps, cwd, and fds
+  if (fork() == 0) {
+    if (setuid(1000) < 0)
+      err(-1, "setuid");
+    if (open("/proc/1/maps", O_RDONLY) != -1 || errno != EACCES)
+      errx(-1, "read another user's maps");
+    if (readlink("/proc/1/cwd", buf, sizeof(buf)) != -1 || errno != EACCES)
+      errx(-1, "read another user's cwd");
+    if (open("/proc/1/fd", O_RDONLY) != -1 || errno != EACCES)
+      errx(-1, "listed another user's fds");
+    if (open("/proc/1/fd/0", O_RDONLY) != -1 || errno != EACCES)
+      errx(-1, "looked up another user's fd");
+    if (open("/proc/1/status", O_RDONLY) < 0)
+      err(-1, "status");
+    snprintf(path, sizeof(path), "/proc/%d/maps", getpid());
+    if ((fd = open(path, O_RDONLY)) < 0)
+      err(-1, "own maps");
+    exit(0);
+  }
+  wait(&status);
+  if (!WIFEXITED(status) || WEXITSTATUS(status) != 0)
+    errx(-1, "proc permission child failed");
+  printf("proc test ok\n");
+}
+
 void
 mem(void)
 {
@@ -802,17 +1180,6 @@ linktest(void)
   printf("linktest ok\n");
 }
 
-struct  __attribute__((packed)) dirent_t {
-#define NMAX	14
-       char	name[NMAX];
-       ulong	inum;
-};
-
-struct dirdata_t {
-#define NDIRENTS	(BSIZE/sizeof(struct dirent_t))
-       struct dirent_t de[NDIRENTS];
-};
-
 // test concurrent create/link/unlink of the same file
 void
 concreate(void)
@@ -820,7 +1187,8 @@ concreate(void)
   char file[3];
   int i, pid, n, fd;
   char fa[40];
-  char buf[BSIZE];
+  DIR *dir;
+  struct dirent *de;
 
   printf("concreate test\n");
   file[0] = 'C';
@@ -848,32 +1216,26 @@ concreate(void)
   }
 
   memset(fa, 0, sizeof(fa));
-  fd = open(".", 0);
-  if (fd < 0)
-	err(fd, "open");
+  dir = opendir(".");
+  if (dir == NULL)
+	err(-1, "opendir");
   n = 0;
-  while(read(fd, buf, sizeof(buf)) == sizeof(buf)){
-    struct dirdata_t *dd = (struct dirdata_t *)buf;
-    int j;
-    for (j = 0; j < NDIRENTS; j++) {
-      if(dd->de[j].inum == 0)
-        continue;
-      if(dd->de[j].name[0] == 'C' && dd->de[j].name[2] == '\0'){
-        i = dd->de[j].name[1] - '0';
-        if(i < 0 || i >= sizeof(fa)){
-          printf("concreate weird file %s\n", dd->de[j].name);
-          exit(0);
-        }
-        if(fa[i]){
-          printf("concreate duplicate file %s\n", dd->de[j].name);
-          exit(0);
-        }
-        fa[i] = 1;
-        n++;
+  while((de = readdir(dir)) != NULL){
+    if(de->d_name[0] == 'C' && de->d_name[2] == '\0'){
+      i = de->d_name[1] - '0';
+      if(i < 0 || i >= sizeof(fa)){
+        printf("concreate weird file %s\n", de->d_name);
+        exit(0);
+      }
+      if(fa[i]){
+        printf("concreate duplicate file %s\n", de->d_name);
+        exit(0);
       }
+      fa[i] = 1;
+      n++;
     }
   }
-  close(fd);
+  closedir(dir);
 
   if(n != 40){
     printf("concreate not enough files in directory listing (%d)\n", n);
@@ -2437,6 +2799,32 @@ runsockettest(void)
 		errx(-1, "child failed");
 }
 
+// TCP_INFO is only an option of the TCP level
+void sockopttest(void)
+{
+	printf("sockopt test\n");
+	int s = socket(AF_INET, SOCK_STREAM, 0);
+	if (s == -1)
+		err(-1, "socket");
+	struct tcp_info ti;
+	socklen_t len = sizeof(ti);
+	if (getsockopt(s, IPPROTO_TCP, TCP_INFO, &ti, &len) == -1)
+		err(-1, "getsockopt");
+	if (len != sizeof(ti))
+		errx(-1, "short tcp_info");
+	len = sizeof(ti);
+	if (getsockopt(s, SOL_SOCKET, TCP_INFO, &ti, &len) != -1 ||
+	    errno != ENOPROTOOPT)
+		errx(-1, "TCP_INFO at the socket level");
+	int v;
+	len = sizeof(v);
+	if (getsockopt(s, IPPROTO_TCP, SO_ERROR, &v, &len) != -1 ||
+	    errno != ENOPROTOOPT)
+		errx(-1, "SO_ERROR at the TCP level");
+	close(s);
+	printf("sockopt test ok\n");
+}
+
 void _testnoblk(int rfd, int wfd)
 {
 	char buf[BSIZE];
@@ -3370,6 +3758,146 @@ void scmtest(void)
 	printf("scm rights ok\n");
 }
 
+static void _sendfd(int s, int fd)
+{
+	char buf[CMSG_SPACE(sizeof(int))];
+	struct msghdr msg;
+	struct iovec iov;
+	memset(&msg, 0, sizeof(msg));
+	memset(buf, 0, sizeof(buf));
+	char dur = 0;
+	iov.iov_base = &dur;
+	iov.iov_len = 1;
+	msg.msg_iov = &iov;
+	msg.msg_iovlen = 1;
+	msg.msg_control = buf;
+	msg.msg_controllen = sizeof(buf);
+	struct cmsghdr *cmsg = CMSG_FIRSTHDR(&msg);
+	cmsg->cmsg_len = CMSG_LEN(sizeof(int));
+	cmsg->cmsg_level = SOL_SOCKET;
+	cmsg->cmsg_type = SCM_RIGHTS;
+	*(int *)CMSG_DATA(cmsg) = fd;
+	if (sendmsg(s, &msg, 0) != 1)
+		err(-1, "sendmsg");
+}
+
+static int _recvfd(int s)
+{
+	char buf[CMSG_SPACE(sizeof(int))];
+	struct msghdr msg;
+	struct iovec iov;
+	memset(&msg, 0, sizeof(msg));
+	char dur;
+	iov.iov_base = &dur;
+	iov.iov_len = 1;
+	msg.msg_iov = &iov;
+	msg.msg_iovlen = 1;
+	msg.msg_control = buf;
+	msg.msg_controllen = sizeof(buf);
+	if (recvmsg(s, &msg, 0) != 1)
+		err(-1, "recvmsg");
+	struct cmsghdr *cmsg = CMSG_FIRSTHDR(&msg);
+	if (cmsg == NULL || cmsg->cmsg_type != SCM_RIGHTS)
+		errx(-1, "no fd received");
+	return *(int *)CMSG_DATA(cmsg);
+}
+
+void memfdtest(void)
+{
+	printf("memfd test\n");
+
+	const size_t sz = 2*4096;
+	int fd;
+	if ((fd = memfd_create("usertests", 0)) == -1)
+		err(-1, "memfd_create");
+	if (ftruncate(fd, sz) == -1)
+		err(-1, "ftruncate");
+	struct stat st;
+	if (fstat(fd, &st) == -1)
+		err(-1, "fstat");
+	if (st.st_size != sz)
+		errx(-1, "bad size %ld", (long)st.st_size);
+	char *p = mmap(NULL, sz, PROT_READ | PROT_WRITE, MAP_SHARED, fd, 0);
+	if (p == MAP_FAILED)
+		err(-1, "mmap");
+
+	// a child shares the mapping across fork and writes through an fd
+	// passed over a unix socket
+	int s[2];
+	if (socketpair(AF_UNIX, SOCK_STREAM, 0, s) == -1)
+		err(-1, "socketpair");
+	pid_t c = fork();
+	if (c == -1)
+		err(-1, "fork");
+	if (c == 0) {
+		close(s[0]);
+		memcpy(p, "child", 5);
+		int nfd = _recvfd(s[1]);
+		if (pwrite(nfd, "x", 1, 4096 + 100) != 1)
+			err(-1, "pwrite");
+		exit(0);
+	}
+	close(s[1]);
+	_sendfd(s[0], fd);
+	int status;
+	if (wait(&status) != c)
+		err(-1, "wait");
+	if (!WIFEXITED(status) || WEXITSTATUS(status) != 0)
+		errx(-1, "child failed");
+	close(s[0]);
+	char buf[8];
+	if (pread(fd, buf, 5, 0) != 5 || strncmp(buf, "child", 5) != 0)
+		errx(-1, "child's store not in the file");
+	if (p[4096 + 100] != 'x')
+		errx(-1, "child's write not in the mapping");
+	if (munmap(p, sz) == -1)
+		err(-1, "munmap");
+
+	// the offsets are bounded and the pages are sparse
+	if (pwrite(fd, "y", 1, -1) != -1 || errno != EINVAL)
+		errx(-1, "negative pwrite offset");
+	if (pread(fd, buf, 1, -4096) != -1 || errno != EINVAL)
+		errx(-1, "negative pread offset");
+	if (pwrite(fd, "y", 1, 1L << 41) != -1 || errno != EFBIG)
+		errx(-1, "pwrite past the largest size");
+	if (ftruncate(fd, 1L << 41) != -1 || errno != EFBIG)
+		errx(-1, "ftruncate past the largest size");
+	if (lseek(fd, 1L << 41, SEEK_SET) == -1)
+		err(-1, "lseek");
+	if (write(fd, "y", 1) != -1 || errno != EFBIG)
+		errx(-1, "write past the largest size");
+	if (pwrite(fd, "y", 1, 1L << 39) != 1)
+		err(-1, "sparse pwrite");
+	if (fstat(fd, &st) == -1)
+		err(-1, "fstat");
+	if (st.st_size != (1L << 39) + 1)
+		errx(-1, "bad sparse size");
+	if (pread(fd, buf, 1, 1L << 38) != 1 || buf[0] != 0)
+		errx(-1, "hole not zero");
+	close(fd);
+
+	// a named object outlives its fds until it is unlinked
+	shm_unlink("/usertests");
+	if ((fd = shm_open("/usertests", O_CREAT | O_EXCL | O_RDWR, 0600)) == -1)
+		err(-1, "shm_open");
+	if (ftruncate(fd, 4096) == -1)
+		err(-1, "ftruncate");
+	if (write(fd, "shm", 3) != 3)
+		err(-1, "write");
+	close(fd);
+	if ((fd = shm_open("/usertests", O_RDWR, 0)) == -1)
+		err(-1, "shm_open");
+	if (read(fd, buf, 3) != 3 || strncmp(buf, "shm", 3) != 0)
+		errx(-1, "shm contents lost");
+	close(fd);
+	if (shm_unlink("/usertests") == -1)
+		err(-1, "shm_unlink");
+	if (shm_open("/usertests", O_RDWR, 0) != -1 || errno != ENOENT)
+		errx(-1, "unlinked shm object opened");
+
+	printf("memfd ok\n");
+}
+
 void mkstemptest(void)
 {
 	printf("mkstemp test\n");
@@ -3638,6 +4166,385 @@ logtest()
   printf("log test OK\n");
 }
 
+static void _hugefill(char *p, size_t len, char c)
+{
+	size_t i;
+	for (i = 0; i < len; i += 512)
+		p[i] = c;
+}
+
+static void _hugecheck(char *p, size_t len, char c)
+{
+	size_t i;
+	for (i = 0; i < len; i += 512)
+		if (p[i] != c)
+			errx(-1, "huge page %zu: got %c, want %c", i, p[i], c);
+}
+
+// large anonymous mappings may be backed by huge pages, which a parent and
+// its child share copy-on-write
+void hugetest(void)
+{
+	printf("huge page test\n");
+	const size_t len = 8 << 20;
+	char *p = mmap(0, len, PROT_READ | PROT_WRITE,
+	    MAP_PRIVATE | MAP_ANON, -1, 0);
+	if (p == MAP_FAILED)
+		err(-1, "mmap");
+	_hugefill(p, len, 'a');
+
+	// the child writes first
+	pid_t c = fork();
+	if (c == -1)
+		err(-1, "fork");
+	if (c == 0) {
+		_hugecheck(p, len, 'a');
+		_hugefill(p, len, 'b');
+		_hugecheck(p, len, 'b');
+		exit(0);
+	}
+	int status;
+	if (wait(&status) != c)
+		err(-1, "wait");
+	if (!WIFEXITED(status) || WEXITSTATUS(status) != 0)
+		errx(-1, "child failed");
+	_hugecheck(p, len, 'a');
+	_hugefill(p, len, 'c');
+
+	// the parent writes first while the child still shares the pages
+	int pp[2];
+	if (pipe(pp) == -1)
+		err(-1, "pipe");
+	if ((c = fork()) == -1)
+		err(-1, "fork");
+	if (c == 0) {
+		close(pp[1]);
+		char b;
+		if (read(pp[0], &b, 1) != 1)
+			err(-1, "read");
+		_hugecheck(p, len, 'c');
+		exit(0);
+	}
+	close(pp[0]);
+	_hugefill(p, len, 'd');
+	if (write(pp[1], "x", 1) != 1)
+		err(-1, "write");
+	close(pp[1]);
+	if (wait(&status) != c)
+		err(-1, "wait");
+	if (!WIFEXITED(status) || WEXITSTATUS(status) != 0)
+		errx(-1, "child failed");
+	_hugecheck(p, len, 'd');
+	if (munmap(p, len) == -1)
+		err(-1, "munmap");
+	printf("huge page test ok\n");
+}
+
+// the ELF header and a program header of the tiny programs that interptest
+// writes
+struct _ehdr {
+	uint8_t		ident[16];
+	uint16_t	type;
+	uint16_t	machine;
+	uint32_t	version;
+	uint64_t	entry;
+	uint64_t	phoff;
+	uint64_t	shoff;
+	uint32_t	flags;
+	uint16_t	ehsize;
+	uint16_t	phentsize;
+	uint16_t	phnum;
+	uint16_t	shentsize;
+	uint16_t	shnum;
+	uint16_t	shstrndx;
+};
+
+struct _phdr {
+	uint32_t	type;
+	uint32_t	flags;
+	uint64_t	offset;
+	uint64_t	vaddr;
+	uint64_t	paddr;
+	uint64_t	filesz;
+	uint64_t	memsz;
+	uint64_t	align;
+};
+
+// mov $60, %eax; mov %rsp, %r10; lea 2(%rip), %r11; sysenter, which exits
+// with the status in %edi
+#define SYSEXIT		"\xb8\x3c\x00\x00\x00\x49\x89\xe2" \
+    "\x4c\x8d\x1d\x02\x00\x00\x00\x0f\x34\xeb\xfe"
+// mov $status, %edi; SYSEXIT
+#define EXITCODE(status)	"\xbf" status "\x00\x00\x00" SYSEXIT
+
+// an interpreter that finds the program's entry in the auxiliary vector and
+// jumps to it, exiting with status 1 if there is none. it must not be run
+// directly since the entry is then its own.
+static const char _interpcode[] =
+	"\x48\x89\xe0"			// mov %rsp, %rax
+	"\x48\x8b\x08"			// mov (%rax), %rcx
+	"\x48\x8d\x44\xc8\x10"		// lea 16(%rax,%rcx,8), %rax
+	"\x48\x83\x38\x00"		// 1: cmpq $0, (%rax)
+	"\x48\x8d\x40\x08"		// lea 8(%rax), %rax
+	"\x75\xf6"			// jne 1b
+	"\x48\x8b\x08"			// 2: mov (%rax), %rcx
+	"\x48\x83\xf9\x09"		// cmp $AT_ENTRY, %rcx
+	"\x74\x0b"			// je 3f
+	"\x48\x85\xc9"			// test %rcx, %rcx
+	"\x74\x09"			// jz 4f
+	"\x48\x83\xc0\x10"		// add $16, %rax
+	"\xeb\xec"			// jmp 2b
+	"\xff\x60\x08"			// 3: jmp *8(%rax)
+	EXITCODE("\x01");		// 4: exit(1)
+
+static const char _progcode[] = EXITCODE("\x2a");
+
+// writes a program of type type that is linked at vaddr, runs code and is
+// interpreted by interp, if it isn't NULL
+static void _mkelf(const char *f, int type, uint64_t vaddr, const char *code,
+    size_t clen, const char *interp)
+{
+	char buf[512];
+	memset(buf, 0, sizeof(buf));
+	struct _ehdr *eh = (struct _ehdr *)buf;
+	struct _phdr *ph = (struct _phdr *)(eh + 1);
+	const int nph = interp ? 2 : 1;
+	size_t ioff = sizeof(*eh) + nph*sizeof(*ph);
+	size_t coff = ioff + (interp ? strlen(interp) + 1 : 0);
+	if (coff + clen > sizeof(buf))
+		errx(-1, "program too big");
+	memcpy(eh->ident, "\x7f" "ELF\x02\x01\x01", 7);
+	eh->type = type;
+	eh->machine = 62;
+	eh->version = 1;
+	eh->entry = vaddr + coff;
+	eh->phoff = sizeof(*eh);
+	eh->ehsize = sizeof(*eh);
+	eh->phentsize = sizeof(*ph);
+	eh->phnum = nph;
+	ph->type = 1;
+	ph->flags = 5;
+	ph->vaddr = vaddr;
+	ph->filesz = ph->memsz = coff + clen;
+	ph->align = 4096;
+	if (interp) {
+		ph++;
+		ph->type = 3;
+		ph->flags = 4;
+		ph->offset = ioff;
+		ph->vaddr = vaddr + ioff;
+		ph->filesz = ph->memsz = strlen(interp) + 1;
+		ph->align = 1;
+		strncpy(buf + ioff, interp, sizeof(buf) - ioff);
+	}
+	memcpy(buf + coff, code, clen);
+
+	unlink(f);
+	int fd = open(f, O_WRONLY | O_CREAT | O_EXCL);
+	if (fd == -1)
+		err(-1, "open");
+	if (write(fd, buf, sizeof(buf)) != sizeof(buf))
+		err(-1, "write");
+	if (close(fd) == -1)
+		err(-1, "close");
+	if (chmod(f, 0755) == -1)
+		err(-1, "chmod");
+}
+
+// returns the exit status of f, or -1 if exec fails with errno experr
+static int _runelf(const char *f, int experr)
+{
+	pid_t c = fork();
+	if (c == -1)
+		err(-1, "fork");
+	if (c == 0) {
+		char *args[] = {(char *)f, NULL};
+		execv(f, args);
+		if (errno != experr)
+			err(-1, "execv %s", f);
+		exit(0xff);
+	}
+	int status;
+	if (wait(&status) != c)
+		err(-1, "wait");
+	if (!WIFEXITED(status))
+		errx(-1, "%s failed", f);
+	int ret = WEXITSTATUS(status);
+	return ret == 0xff ? -1 : ret;
+}
+
+// exec(2) loads the interpreter named by a program's PT_INTERP segment and
+// starts it, passing the program's auxiliary vector
+void interptest(void)
+{
+	printf("interp test\n");
+	void _entry(void);
+	if (getauxval(AT_PAGESZ) != 4096)
+		errx(-1, "AT_PAGESZ");
+	if (getauxval(AT_ENTRY) != (unsigned long)_entry)
+		errx(-1, "AT_ENTRY");
+	if (getauxval(AT_BASE) != 0)
+		errx(-1, "AT_BASE without interpreter");
+	if (getauxval(AT_PHENT) != sizeof(struct _phdr))
+		errx(-1, "AT_PHENT");
+	struct _phdr *ph = (struct _phdr *)getauxval(AT_PHDR);
+	unsigned long nph = getauxval(AT_PHNUM);
+	if (ph == NULL || nph == 0)
+		errx(-1, "AT_PHDR");
+	unsigned long i;
+	for (i = 0; i < nph; i++)
+		if (ph[i].type == 1 && ph[i].flags & 1)
+			break;
+	if (i == nph)
+		errx(-1, "no text segment in AT_PHDR");
+	uint8_t *r = (uint8_t *)getauxval(AT_RANDOM);
+	if (r == NULL)
+		errx(-1, "AT_RANDOM");
+	uint8_t z[16] = {0};
+	if (memcmp(r, z, sizeof(z)) == 0)
+		errx(-1, "AT_RANDOM bytes are zero");
+	errno = 0;
+	if (getauxval(12345) != 0 || errno != ENOENT)
+		errx(-1, "getauxval of missing type");
+
+	const char *in = "/tmp/interp";
+	const char *prog = "/tmp/interped";
+	const uint64_t va = 0x2c8010000000ull;
+	_mkelf(in, 3, 0, _interpcode, sizeof(_interpcode) - 1, NULL);
+	_mkelf(prog, 2, va, _progcode, sizeof(_progcode) - 1, in);
+	// the interpreter runs first and then jumps to the program
+	if (_runelf(prog, 0) != 42)
+		errx(-1, "interpreted program failed");
+
+	_mkelf(prog, 2, va, _progcode, sizeof(_progcode) - 1, "/tmp/nointerp");
+	if (_runelf(prog, ENOENT) != -1)
+		errx(-1, "missing interpreter");
+	// an interpreter must be position-independent
+	_mkelf(in, 2, va + (1 << 20), _interpcode, sizeof(_interpcode) - 1,
+	    NULL);
+	_mkelf(prog, 2, va, _progcode, sizeof(_progcode) - 1, in);
+	if (_runelf(prog, EPERM) != -1)
+		errx(-1, "non-PIE interpreter");
+	unlink(in);
+	unlink(prog);
+	printf("interp test ok\n");
+}
+
+// programs that exit with the low bits of the page number of their stack and
+// of their code
+static const char _stackcode[] =
+	"\x48\x89\xe7"			// mov %rsp, %rdi
+	"\x48\xc1\xef\x0c"		// shr $12, %rdi
+	"\x83\xe7\x7f"			// and $0x7f, %edi
+	SYSEXIT;
+static const char _textcode[] =
+	"\x48\x8d\x3d\x00\x00\x00\x00"	// lea 0(%rip), %rdi
+	"\x48\xc1\xef\x0c"		// shr $12, %rdi
+	"\x83\xe7\x7f"			// and $0x7f, %edi
+	SYSEXIT;
+
+// returns true if f, run n times, exits with the same status every time
+static int _samelayout(const char *f, int n)
+{
+	int first = _runelf(f, 0);
+	int i;
+	for (i = 1; i < n; i++)
+		if (_runelf(f, 0) != first)
+			return 0;
+	return 1;
+}
+
+// exec(2) randomizes the stack and the load address of position-independent
+// executables unless personality(2) disables it
+void aslrtest(void)
+{
+	printf("aslr test\n");
+	const char *sf = "/tmp/aslrstack";
+	const char *tf = "/tmp/aslrtext";
+	_mkelf(sf, 2, 0x2c8010000000ull, _stackcode, sizeof(_stackcode) - 1,
+	    NULL);
+	_mkelf(tf, 3, 0, _textcode, sizeof(_textcode) - 1, NULL);
+
+	int old = personality(0xffffffff);
+	if (old == -1)
+		err(-1, "personality");
+	if (personality(-1) != old)
+		errx(-1, "personality(-1) doesn't query");
+	if (personality(old | 0x1000000) != -1 || errno != EINVAL)
+		errx(-1, "unknown personality");
+	// the chance that 8 randomized layouts are the same is 2^-49
+	if (!(old & ADDR_NO_RANDOMIZE)) {
+		if (_samelayout(sf, 8))
+			errx(-1, "stack isn't randomized");
+		if (_samelayout(tf, 8))
+			errx(-1, "PIE isn't randomized");
+	}
+	if (personality(old | ADDR_NO_RANDOMIZE) != old)
+		err(-1, "personality");
+	if (personality(0xffffffff) != (old | ADDR_NO_RANDOMIZE))
+		errx(-1, "personality not set");
+	if (!_samelayout(sf, 8))
+		errx(-1, "stack randomized with ADDR_NO_RANDOMIZE");
+	if (!_samelayout(tf, 8))
+		errx(-1, "PIE randomized with ADDR_NO_RANDOMIZE");
+	if (personality(old) == -1)
+		err(-1, "personality");
+	unlink(sf);
+	unlink(tf);
+	printf("aslr test ok\n");
+}
+
+// MAP_FIXED replaces the mappings at the address
+void fixedtest(void)
+{
+	printf("MAP_FIXED test\n");
+	const char * const f = "/tmp/fixed";
+	unlink(f);
+	int fd = open(f, O_RDWR | O_CREAT | O_EXCL);
+	if (fd == -1)
+		err(-1, "open");
+	char b[4096];
+	memset(b, 'f', sizeof(b));
+	if (write(fd, b, sizeof(b)) != sizeof(b))
+		err(-1, "write");
+	char *p = mmap(0, 4096*3, PROT_READ | PROT_WRITE,
+	    MAP_PRIVATE | MAP_ANON, -1, 0);
+	if (p == MAP_FAILED)
+		err(-1, "mmap");
+	memset(p, 'a', 4096*3);
+	char *q = mmap(p + 4096, 4096, PROT_READ, MAP_PRIVATE | MAP_FIXED,
+	    fd, 0);
+	if (q != p + 4096)
+		err(-1, "mmap fixed file");
+	if (p[0] != 'a' || p[4096] != 'f' || p[4096*2] != 'a')
+		errx(-1, "fixed file mapping");
+	q = mmap(p + 4096, 4096*2, PROT_READ | PROT_WRITE,
+	    MAP_PRIVATE | MAP_ANON | MAP_FIXED, -1, 0);
+	if (q != p + 4096)
+		err(-1, "mmap fixed anon");
+	if (p[0] != 'a' || p[4096] != 0 || p[4096*2] != 0)
+		errx(-1, "fixed anon mapping");
+	p[4096] = 'b';
+	// a fixed mapping may cover unmapped pages too
+	if (munmap(p, 4096) == -1)
+		err(-1, "munmap");
+	q = mmap(p, 4096*2, PROT_READ, MAP_PRIVATE | MAP_ANON | MAP_FIXED,
+	    -1, 0);
+	if (q != p)
+		err(-1, "mmap fixed over hole");
+	if (p[0] != 0 || p[4096] != 0 || p[4096*2] != 0)
+		errx(-1, "fixed mapping over hole");
+	if (mmap(p + 1, 4096, PROT_READ, MAP_PRIVATE | MAP_FIXED, fd, 0) !=
+	    MAP_FAILED || errno != EINVAL)
+		errx(-1, "unaligned fixed mapping");
+	if (munmap(p, 4096*3) == -1)
+		err(-1, "munmap");
+	if (close(fd) == -1)
+		err(-1, "close");
+	unlink(f);
+	printf("MAP_FIXED test ok\n");
+}
+
 enum {
 	KREAD,
 	KWRITE,
@@ -3772,6 +4679,71 @@ void killtest(void)
 	printf("kill test passed\n");
 }
 
+// reads one byte from fd, which a stop may interrupt. a thread must not be
+// left interrupted once the process continues.
+static void _stopread(int fd)
+{
+	char c;
+	int n = 0;
+	while (read(fd, &c, 1) != 1) {
+		if (errno != EINTR)
+			err(-1, "read");
+		if (++n > 1000)
+			errx(-1, "waits interrupted after continuing");
+	}
+}
+
+static void *_stopreader(void *arg)
+{
+	_stopread((int)(long)arg);
+	return NULL;
+}
+
+// stops and continues a multithreaded process whose threads then block
+void stopconttest(void)
+{
+	printf("stop/continue test\n");
+	int p[2], q[2];
+	if (pipe(p) == -1 || pipe(q) == -1)
+		err(-1, "pipe");
+	pid_t child = fork();
+	if (child == -1)
+		err(-1, "fork");
+	if (!child) {
+		pthread_t t;
+		if (pthread_create(&t, NULL, _stopreader, (void *)(long)q[0]))
+			errx(-1, "pthread_create");
+		_stopread(p[0]);
+		if (pthread_join(t, NULL))
+			errx(-1, "pthread_join");
+		exit(0);
+	}
+	int status;
+	for (int i = 0; i < 20; i++) {
+		if ((kill)(child, SIGSTOP) == -1)
+			err(-1, "kill");
+		if (waitpid(child, &status, WUNTRACED) != child ||
+		    !WIFSTOPPED(status))
+			errx(-1, "not stopped");
+		if ((kill)(child, SIGCONT) == -1)
+			err(-1, "kill");
+		if (waitpid(child, &status, WCONTINUED) != child ||
+		    !WIFCONTINUED(status))
+			errx(-1, "not continued");
+	}
+	if (write(p[1], "x", 1) != 1 || write(q[1], "x", 1) != 1)
+		err(-1, "write");
+	if (wait(&status) != child)
+		err(-1, "wait");
+	if (!WIFEXITED(status) || WEXITSTATUS(status) != 0)
+		errx(-1, "child failed");
+	close(p[0]);
+	close(p[1]);
+	close(q[0]);
+	close(q[1]);
+	printf("stop/continue test ok\n");
+}
+
 void lstats(void)
 {
 	printf("lstat test\n");
@@ -3834,6 +4806,10 @@ main(int argc, char *argv[])
   pipe1();
   preempt();
   exitwait();
+  jobctl();
+  ttytest();
+  ioctltest();
+  proctest();
 
   rmdot();
   fourteen();
@@ -3862,6 +4838,7 @@ main(int argc, char *argv[])
 
   polltest();
   runsockettest();
+  sockopttest();
   accesstest();
   futextest();
 
@@ -3871,11 +4848,17 @@ main(int argc, char *argv[])
   spair();
   iovtest();
   scmtest();
+  memfdtest();
   mkstemptest();
   getppidtest();
   mmaptest();
+  hugetest();
+  interptest();
+  aslrtest();
+  fixedtest();
 
   killtest();
+  stopconttest();
   lstats();
 
   exectest();
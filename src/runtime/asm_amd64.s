@@ -722,6 +722,17 @@ TEXT ·Rdtsc(SB), NOSPLIT, $0-8
 	MOVL	DX, ret+4(FP)
 	RET
 
+// returns a random number and whether the CPU had enough entropy to make it
+TEXT ·Rdrand(SB), NOSPLIT, $0-16
+	// rdrand %rax
+	BYTE	$0x48
+	BYTE	$0x0f
+	BYTE	$0xc7
+	BYTE	$0xf0
+	SETCS	ok+8(FP)
+	MOVQ	AX, ret+0(FP)
+	RET
+
 TEXT ·Cli(SB), NOSPLIT, $0-0
 	CLI
 	RET
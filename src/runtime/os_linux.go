@@ -416,6 +416,7 @@ func Rcr2() uintptr
 func Rcr3() uintptr
 func Rcr4() uintptr
 func Rdmsr(int) uintptr
+func Rdrand() (uint64, bool)
 func Rdtsc() uint64
 func Sgdt(*uintptr)
 func Sidt(*uintptr)